@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/bench"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	tcpAddress  = flag.String("nsqd-tcp-address", "127.0.0.1:4150", "<addr>:<port> of the nsqd to consume from")
+	topic       = flag.String("topic", "bench", "topic to consume")
+	channel     = flag.String("channel", "bench", "channel to consume")
+	connections = flag.Int("connections", 1, "number of connections to consume over")
+	maxInFlight = flag.Int("max-in-flight", 2500, "RDY count of each connection")
+	num         = flag.Int64("num", 0, "number of messages to consume (0 for --duration)")
+	duration    = flag.Duration("duration", 10*time.Second, "how long to consume for (when --num is 0)")
+
+	reportInterval = flag.Duration("report-interval", 5*time.Second, "interval at which throughput is logged (0 to disable)")
+
+	connOpts = bench.AddConnFlags()
+)
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(util.Version("nsq_bench_consumer"))
+		return
+	}
+
+	if *connections < 1 || *maxInFlight < 1 {
+		log.Fatalf("--connections and --max-in-flight must be at least 1")
+	}
+	if *num == 0 && *duration <= 0 {
+		log.Fatalf("--num or --duration is required")
+	}
+
+	conns := make([]*bench.Conn, *connections)
+	for i := range conns {
+		conn, err := bench.Dial(*tcpAddress, connOpts)
+		if err != nil {
+			log.Fatalf("failed to connect to nsqd (%s) - %s", *tcpAddress, err.Error())
+		}
+		defer conn.Close()
+		_, err = conn.Command(nsq.Subscribe(*topic, *channel))
+		if err != nil {
+			log.Fatalf("failed to SUB - %s", err.Error())
+		}
+		conns[i] = conn
+	}
+
+	stats := bench.NewStats()
+	exitChan := make(chan int)
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		if *num > 0 {
+			<-signalChan
+		} else {
+			select {
+			case <-signalChan:
+			case <-time.After(*duration):
+			}
+		}
+		close(exitChan)
+		// unblock the workers waiting on messages
+		for _, conn := range conns {
+			conn.SetReadDeadline(time.Now())
+		}
+	}()
+
+	reportExitChan := make(chan int)
+	if *reportInterval > 0 {
+		go stats.ReportLoop(*reportInterval, reportExitChan)
+	}
+
+	var wg sync.WaitGroup
+	var remaining int64 = *num
+	var remainingMutex sync.Mutex
+	// take claims one of the --num messages, it returns false when they've
+	// all been consumed
+	take := func() bool {
+		if *num == 0 {
+			return true
+		}
+		remainingMutex.Lock()
+		defer remainingMutex.Unlock()
+		if remaining == 0 {
+			return false
+		}
+		remaining--
+		return true
+	}
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *bench.Conn) {
+			defer wg.Done()
+			err := subWorker(conn, take, stats, exitChan)
+			if err != nil {
+				log.Printf("ERROR: consuming - %s", err.Error())
+			}
+			// once --num messages are consumed the other workers are done too
+			for _, c := range conns {
+				c.SetReadDeadline(time.Now())
+			}
+		}(conn)
+	}
+	wg.Wait()
+	close(reportExitChan)
+
+	stats.Report(os.Stdout, fmt.Sprintf("nsq_bench_consumer: %d connections, max in flight %d, features %s (latency is end to end)",
+		*connections, *maxInFlight, connOpts))
+}
+
+// subWorker FINs the messages delivered on conn, recording their end to end
+// latency (from the timestamp nsq_bench_producer puts at the start of each
+// body, or nsqd's publish timestamp)
+func subWorker(conn *bench.Conn, take func() bool, stats *bench.Stats, exitChan chan int) error {
+	rdy := *maxInFlight
+	err := conn.WriteCommand(nsq.Ready(rdy))
+	if err != nil {
+		return err
+	}
+	err = conn.Flush()
+	if err != nil {
+		return err
+	}
+
+	for {
+		frameType, data, err := conn.ReadFrame()
+		if err != nil {
+			select {
+			case <-exitChan:
+				return nil
+			default:
+			}
+			if nerr, ok := err.(interface {
+				Timeout() bool
+			}); ok && nerr.Timeout() {
+				// another worker consumed the last of --num
+				return nil
+			}
+			return err
+		}
+		if frameType != nsq.FrameTypeMessage {
+			if frameType == nsq.FrameTypeError {
+				stats.Error()
+			}
+			continue
+		}
+
+		now := time.Now()
+		msg, err := nsq.DecodeMessage(data)
+		if err != nil {
+			stats.Error()
+			continue
+		}
+		if !take() {
+			return nil
+		}
+		sent := bench.Timestamp(msg.Body)
+		if sent.IsZero() || sent.After(now) || now.Sub(sent) > 24*time.Hour {
+			// not published by nsq_bench_producer
+			sent = time.Unix(0, msg.Timestamp)
+		}
+		stats.Record(1, len(msg.Body), now.Sub(sent))
+
+		err = conn.WriteCommand(nsq.Finish(msg.Id))
+		if err != nil {
+			return err
+		}
+		rdy--
+		// top up RDY once half of it is used
+		if rdy <= *maxInFlight/2 {
+			err = conn.WriteCommand(nsq.Ready(*maxInFlight))
+			if err != nil {
+				return err
+			}
+			rdy = *maxInFlight
+		}
+		// FINs are sent along with the next read's worth of messages
+		if conn.Buffered() == 0 {
+			err = conn.Flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	panic("unreachable")
+}
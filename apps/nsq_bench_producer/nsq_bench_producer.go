@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/bench"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	tcpAddress  = flag.String("nsqd-tcp-address", "127.0.0.1:4150", "<addr>:<port> of the nsqd to publish to")
+	topic       = flag.String("topic", "bench", "topic to publish to")
+	connections = flag.Int("connections", 1, "number of connections to publish over")
+	size        = flag.Int("size", 200, "size of the messages in bytes")
+	batchSize   = flag.Int("batch-size", 1, "messages per publish (PUB when 1, MPUB otherwise)")
+	rate        = flag.Int("rate", 0, "messages per second to publish (across all connections, 0 for as fast as possible)")
+	num         = flag.Int64("num", 0, "number of messages to publish (0 for --duration)")
+	duration    = flag.Duration("duration", 10*time.Second, "how long to publish for (when --num is 0)")
+	random      = flag.Bool("random-bodies", false, "publish random bodies rather than zeros (ie. for compression)")
+
+	reportInterval = flag.Duration("report-interval", 5*time.Second, "interval at which throughput is logged (0 to disable)")
+
+	connOpts = bench.AddConnFlags()
+)
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(util.Version("nsq_bench_producer"))
+		return
+	}
+
+	if *connections < 1 || *batchSize < 1 || *size < 1 {
+		log.Fatalf("--connections, --batch-size and --size must be at least 1")
+	}
+	if *num == 0 && *duration <= 0 {
+		log.Fatalf("--num or --duration is required")
+	}
+
+	conns := make([]*bench.Conn, *connections)
+	for i := range conns {
+		conn, err := bench.Dial(*tcpAddress, connOpts)
+		if err != nil {
+			log.Fatalf("failed to connect to nsqd (%s) - %s", *tcpAddress, err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	exitChan := make(chan int)
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signalChan:
+		case <-time.After(*duration):
+			if *num > 0 {
+				<-signalChan
+			}
+		}
+		close(exitChan)
+	}()
+
+	stats := bench.NewStats()
+	reportExitChan := make(chan int)
+	if *reportInterval > 0 {
+		go stats.ReportLoop(*reportInterval, reportExitChan)
+	}
+
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		// each connection publishes its share of --num and --rate
+		n := *num / int64(len(conns))
+		if int64(i) < *num%int64(len(conns)) {
+			n++
+		}
+		if *num > 0 && n == 0 {
+			continue
+		}
+		connRate := float64(*rate) / float64(len(conns))
+		wg.Add(1)
+		go func(conn *bench.Conn, n int64) {
+			defer wg.Done()
+			err := pubWorker(conn, n, connRate, stats, exitChan)
+			if err != nil {
+				log.Printf("ERROR: publishing - %s", err.Error())
+			}
+		}(conn, n)
+	}
+	wg.Wait()
+	close(reportExitChan)
+
+	stats.Report(os.Stdout, fmt.Sprintf("nsq_bench_producer: %d connections, %d byte messages, batches of %d, features %s",
+		*connections, *size, *batchSize, connOpts))
+}
+
+// pubWorker publishes n messages (or until exitChan is closed when n is 0) at
+// up to rate messages per second (0 for as fast as possible)
+func pubWorker(conn *bench.Conn, n int64, rate float64, stats *bench.Stats, exitChan chan int) error {
+	bodies := make([][]byte, *batchSize)
+	for i := range bodies {
+		bodies[i] = make([]byte, *size)
+		if *random {
+			for j := range bodies[i] {
+				bodies[i][j] = byte(rand.Intn(256))
+			}
+		}
+	}
+
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) * float64(*batchSize) / rate)
+	}
+	next := time.Now()
+
+	var published int64
+	for n == 0 || published < n {
+		select {
+		case <-exitChan:
+			return nil
+		default:
+		}
+
+		batch := bodies
+		if n > 0 && n-published < int64(len(batch)) {
+			batch = batch[:n-published]
+		}
+
+		if interval > 0 {
+			time.Sleep(next.Sub(time.Now()))
+			next = next.Add(interval)
+		}
+
+		start := time.Now()
+		for _, body := range batch {
+			bench.PutTimestamp(body, start)
+		}
+		var cmd *nsq.Command
+		var err error
+		if len(batch) == 1 {
+			cmd = nsq.Publish(*topic, batch[0])
+		} else {
+			cmd, err = nsq.MultiPublish(*topic, batch)
+			if err != nil {
+				return err
+			}
+		}
+		data, err := conn.Command(cmd)
+		if err != nil {
+			stats.Error()
+			return err
+		}
+		if !bytes.Equal(data, []byte("OK")) {
+			stats.Error()
+			continue
+		}
+		stats.Record(len(batch), *size, time.Since(start))
+		published += int64(len(batch))
+	}
+	return nil
+}
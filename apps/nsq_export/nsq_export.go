@@ -0,0 +1,94 @@
+// This is a client that saves a topic's on disk backlog (and that of its
+// channels) from an nsqd, via its /topic/export endpoint, so that it can be
+// loaded into another nsqd with nsq_import
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/bitly/nsq/util"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	nsqdHTTPAddr = flag.String("nsqd-http-address", "", "nsqd HTTP address to export from")
+	topic        = flag.String("topic", "", "nsq topic to export")
+	output       = flag.String("output", "", "file to write the export to, - for stdout (default <topic>.nsqx)")
+)
+
+func export(w io.Writer) (int64, error) {
+	endpoint := fmt.Sprintf("http://%s/topic/export?topic=%s", *nsqdHTTPAddr, url.QueryEscape(*topic))
+	resp, err := http.Get(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("got response %s %q", resp.Status, body)
+	}
+
+	return io.Copy(w, resp.Body)
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsq_export v%s\n", util.BINARY_VERSION)
+		return
+	}
+
+	if *nsqdHTTPAddr == "" {
+		log.Fatalf("--nsqd-http-address is required")
+	}
+
+	if *topic == "" {
+		log.Fatalf("--topic is required")
+	}
+
+	if *output == "-" {
+		_, err := export(os.Stdout)
+		if err != nil {
+			log.Fatalf("ERROR: export failed - %s", err.Error())
+		}
+		return
+	}
+
+	fileName := *output
+	if fileName == "" {
+		fileName = *topic + ".nsqx"
+	}
+	// only a complete export ends up at fileName
+	tmpFileName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatalf("ERROR: failed to open %s - %s", tmpFileName, err.Error())
+	}
+
+	n, err := export(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFileName)
+		log.Fatalf("ERROR: export failed - %s", err.Error())
+	}
+
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		log.Fatalf("ERROR: failed to rename %s - %s", tmpFileName, err.Error())
+	}
+	log.Printf("exported %s from %s to %s (%d bytes)", *topic, *nsqdHTTPAddr, fileName, n)
+}
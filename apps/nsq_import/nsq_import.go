@@ -0,0 +1,87 @@
+// This is a client that loads the output of nsq_export into an nsqd, via its
+// /topic/import endpoint, preserving message IDs and timestamps
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/bitly/nsq/util"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	nsqdHTTPAddr = flag.String("nsqd-http-address", "", "nsqd HTTP address to import into")
+	topic        = flag.String("topic", "", "nsq topic to import into (default the exported topic)")
+	input        = flag.String("input", "", "file written by nsq_export, - for stdin")
+)
+
+type importResponse struct {
+	StatusCode int    `json:"status_code"`
+	StatusTxt  string `json:"status_txt"`
+	Data       struct {
+		Topic string `json:"topic"`
+		Count int64  `json:"count"`
+	} `json:"data"`
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsq_import v%s\n", util.BINARY_VERSION)
+		return
+	}
+
+	if *nsqdHTTPAddr == "" {
+		log.Fatalf("--nsqd-http-address is required")
+	}
+
+	if *input == "" {
+		log.Fatalf("--input is required")
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatalf("ERROR: failed to open %s - %s", *input, err.Error())
+		}
+		defer f.Close()
+		r = f
+	}
+
+	endpoint := fmt.Sprintf("http://%s/topic/import", *nsqdHTTPAddr)
+	if *topic != "" {
+		endpoint += "?topic=" + url.QueryEscape(*topic)
+	}
+	resp, err := http.Post(endpoint, "application/octet-stream", r)
+	if err != nil {
+		log.Fatalf("ERROR: import failed - %s", err.Error())
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Fatalf("ERROR: import failed - %s", err.Error())
+	}
+
+	var ir importResponse
+	err = json.Unmarshal(body, &ir)
+	if err != nil {
+		log.Fatalf("ERROR: import failed - got response %s %q", resp.Status, body)
+	}
+	if ir.StatusCode != 200 {
+		log.Fatalf("ERROR: import failed after %d messages - %s", ir.Data.Count, ir.StatusTxt)
+	}
+
+	log.Printf("imported %d messages into %s on %s", ir.Data.Count, ir.Data.Topic, *nsqdHTTPAddr)
+}
@@ -4,6 +4,8 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -19,12 +21,26 @@ import (
 	"github.com/bitly/nsq/util"
 )
 
+// the bounds of the heartbeat interval a client can request
+const (
+	minHeartbeatInterval = time.Second
+	maxHeartbeatInterval = 5 * time.Minute
+)
+
 var (
 	showVersion      = flag.Bool("version", false, "print version string")
 	httpAddress      = flag.String("http-address", "0.0.0.0:8080", "<addr>:<port> to listen on for HTTP clients")
-	maxInFlight      = flag.Int("max-in-flight", 100, "max number of messages to allow in flight")
+	maxInFlight      = flag.Int("max-in-flight", 100, "max number of messages to allow in flight (per topic of a client)")
 	nsqdTCPAddrs     = util.StringArray{}
 	lookupdHTTPAddrs = util.StringArray{}
+
+	// hardening for use as a web push gateway
+	heartbeatInterval   = flag.Duration("heartbeat-interval", 30*time.Second, "interval of heartbeats to HTTP clients (clients can request theirs with ?heartbeat=)")
+	writeTimeout        = flag.Duration("write-timeout", 10*time.Second, "deadline of each write to an HTTP client (one that doesn't keep up is disconnected)")
+	gzipLevel           = flag.Int("gzip-level", 6, "gzip compression level of the stream to HTTP clients that accept it (1-9, 0 disables)")
+	maxConnections      = flag.Int("max-connections", 0, "maximum number of concurrent HTTP clients (0 for no limit)")
+	maxConnectionsPerIP = flag.Int("max-connections-per-ip", 0, "maximum number of concurrent HTTP clients from one IP (0 for no limit)")
+	maxTopics           = flag.Int("max-topics-per-connection", 10, "maximum number of topics an HTTP client can subscribe to")
 )
 
 func init() {
@@ -32,6 +48,9 @@ func init() {
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 }
 
+var errTooManyConnections = errors.New("too many connections")
+var errTooManyConnectionsFromIP = errors.New("too many connections from this IP")
+
 type StreamServer struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	messageCount uint64
@@ -40,16 +59,35 @@ type StreamServer struct {
 	clients      []*StreamReader
 }
 
-func (s *StreamServer) Set(sr *StreamReader) {
+// Set adds a client, unless that would exceed --max-connections or
+// --max-connections-per-ip
+func (s *StreamServer) Set(sr *StreamReader) error {
 	s.Lock()
 	defer s.Unlock()
+
+	if *maxConnections > 0 && len(s.clients) >= *maxConnections {
+		return errTooManyConnections
+	}
+	if *maxConnectionsPerIP > 0 {
+		var count int
+		for _, x := range s.clients {
+			if x.remoteIP == sr.remoteIP {
+				count++
+			}
+		}
+		if count >= *maxConnectionsPerIP {
+			return errTooManyConnectionsFromIP
+		}
+	}
+
 	s.clients = append(s.clients, sr)
+	return nil
 }
 
 func (s *StreamServer) Del(sr *StreamReader) {
 	s.Lock()
 	defer s.Unlock()
-	n := make([]*StreamReader, len(s.clients)-1)
+	n := make([]*StreamReader, 0, len(s.clients))
 	for _, x := range s.clients {
 		if x != sr {
 			n = append(n, x)
@@ -62,13 +100,38 @@ var streamServer *StreamServer
 
 type StreamReader struct {
 	sync.RWMutex // embed a r/w mutex
-	topic        string
+	topics       []string
 	channel      string
-	reader       *nsq.Reader
+	readers      []*nsq.Reader
 	req          *http.Request
+	remoteIP     string
 	conn         net.Conn
 	bufrw        *bufio.ReadWriter
 	connectTime  time.Time
+
+	// what's written to the client, a gzip.Writer over bufrw when it accepts
+	// gzip
+	w          io.Writer
+	gzipWriter *gzip.Writer
+
+	// messages are sent as server-sent events (to clients that accept
+	// text/event-stream), rather than a line each
+	sse bool
+
+	heartbeatInterval time.Duration
+
+	exitChan chan int
+	stopOnce sync.Once
+}
+
+// topicHandler hands the messages of one of a client's topics to it
+type topicHandler struct {
+	sr    *StreamReader
+	topic string
+}
+
+func (h *topicHandler) HandleMessage(message *nsq.Message) error {
+	return h.sr.writeMessage(h.topic, message)
 }
 
 func ConnectToNSQAndLookupd(r *nsq.Reader, nsqAddrs []string, lookupd []string) error {
@@ -94,18 +157,28 @@ func StatsHandler(w http.ResponseWriter, req *http.Request) {
 	totalMessages := atomic.LoadUint64(&streamServer.messageCount)
 	io.WriteString(w, fmt.Sprintf("Total Messages: %d\n\n", totalMessages))
 
+	streamServer.RLock()
+	defer streamServer.RUnlock()
+
 	now := time.Now()
 	for _, sr := range streamServer.clients {
 		duration := now.Sub(sr.connectTime).Seconds()
 		secondsDuration := time.Duration(int64(duration)) * time.Second // turncate to the second
 
+		var received, finished, requeued uint64
+		for _, r := range sr.readers {
+			received += r.MessagesReceived
+			finished += r.MessagesFinished
+			requeued += r.MessagesRequeued
+		}
+
 		io.WriteString(w, fmt.Sprintf("[%s] [%s : %s] msgs: %-8d fin: %-8d re-q: %-8d connected: %s\n",
-			sr.conn.RemoteAddr().String(),
-			sr.topic,
+			sr.req.RemoteAddr,
+			strings.Join(sr.topics, ","),
 			sr.channel,
-			sr.reader.MessagesReceived,
-			sr.reader.MessagesFinished,
-			sr.reader.MessagesRequeued,
+			received,
+			finished,
+			requeued,
 			secondsDuration))
 	}
 }
@@ -127,50 +200,112 @@ func (s *StreamServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// every topic is consumed from the same channel
 	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	topicNames, _ := reqParams.GetAll("topic")
+	for _, topicName = range topicNames {
+		if !nsq.IsValidTopicName(topicName) {
+			http.Error(w, "INVALID_ARG_TOPIC", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(topicNames) > *maxTopics {
+		http.Error(w, "TOO_MANY_TOPICS", http.StatusBadRequest)
+		return
+	}
+
+	interval := *heartbeatInterval
+	if intervalStr, _ := reqParams.Get("heartbeat"); intervalStr != "" {
+		interval, err = time.ParseDuration(intervalStr)
+		if err != nil || interval < minHeartbeatInterval || interval > maxHeartbeatInterval {
+			http.Error(w, "INVALID_ARG_HEARTBEAT", http.StatusBadRequest)
+			return
+		}
+	}
+
+	format, _ := reqParams.Get("format")
+	remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+	sr := &StreamReader{
+		topics:            topicNames,
+		channel:           channelName,
+		req:               req,
+		remoteIP:          remoteIP,
+		connectTime:       time.Now(),
+		sse:               format == "sse" || strings.Contains(req.Header.Get("Accept"), "text/event-stream"),
+		heartbeatInterval: interval,
+		exitChan:          make(chan int),
+	}
+
+	for _, topicName := range topicNames {
+		r, err := nsq.NewReader(topicName, channelName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.SetMaxInFlight(*maxInFlight)
+		r.AddHandler(&topicHandler{sr: sr, topic: topicName})
+		sr.readers = append(sr.readers, r)
+	}
+
+	err = s.Set(sr)
+	if err != nil {
+		log.Printf("[%s] refusing connection - %s", req.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	hj, ok := w.(http.Hijacker)
 	if !ok {
+		s.Del(sr)
 		http.Error(w, "httpserver doesn't support hijacking", http.StatusInternalServerError)
 		return
 	}
 	conn, bufrw, err := hj.Hijack()
 	if err != nil {
+		s.Del(sr)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	sr.conn = conn
+	sr.bufrw = bufrw
+	sr.w = bufrw
 
-	r, err := nsq.NewReader(topicName, channelName)
-	r.SetMaxInFlight(*maxInFlight)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	log.Printf("[%s] new connection", conn.RemoteAddr().String())
+	header := "HTTP/1.1 200 OK\r\nConnection: close\r\n"
+	if sr.sse {
+		header += "Content-Type: text/event-stream\r\nCache-Control: no-cache\r\n"
+	} else {
+		header += "Content-Type: text/plain; charset=utf-8\r\n"
 	}
-
-	sr := &StreamReader{
-		topic:       topicName,
-		channel:     channelName,
-		reader:      r,
-		req:         req,
-		conn:        conn,
-		bufrw:       bufrw, // TODO: latency writer
-		connectTime: time.Now(),
+	if *gzipLevel > 0 && strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		header += "Content-Encoding: gzip\r\n"
+		sr.gzipWriter, _ = gzip.NewWriterLevel(bufrw, *gzipLevel)
+		sr.w = sr.gzipWriter
 	}
-	s.Set(sr)
-
-	log.Printf("[%s] new connection", conn.RemoteAddr().String())
-	bufrw.WriteString("HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	sr.Lock()
+	bufrw.WriteString(header + "\r\n")
 	bufrw.Flush()
+	sr.Unlock()
 
-	r.AddHandler(sr)
+	go sr.HeartbeatLoop()
 
-	// TODO: handle the error cases better (ie. at all :) )
-	errors := ConnectToNSQAndLookupd(r, nsqdTCPAddrs, lookupdHTTPAddrs)
-	log.Printf("connected to NSQ %v", errors)
+	for i, r := range sr.readers {
+		go func(r *nsq.Reader) {
+			<-r.ExitChan
+			sr.stop()
+		}(r)
+
+		err := ConnectToNSQAndLookupd(r, nsqdTCPAddrs, lookupdHTTPAddrs)
+		if err != nil {
+			log.Printf("[%s] failed to connect to NSQ for %s - %s", conn.RemoteAddr().String(), sr.topics[i], err.Error())
+			sr.stop()
+			return
+		}
+	}
 
 	// this read allows us to detect clients that disconnect
 	go func(rw *bufio.ReadWriter) {
@@ -180,42 +315,94 @@ func (s *StreamServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		} else {
 			log.Printf("unexpected data on request socket (%s); closing", b)
 		}
-		sr.reader.Stop()
+		sr.stop()
 	}(bufrw)
+}
 
-	go sr.HeartbeatLoop()
+// stop stops consuming every topic, once
+func (sr *StreamReader) stop() {
+	sr.stopOnce.Do(func() {
+		for _, r := range sr.readers {
+			r.Stop()
+		}
+		close(sr.exitChan)
+	})
 }
 
 func (sr *StreamReader) HeartbeatLoop() {
-	heartbeatTicker := time.NewTicker(30 * time.Second)
+	heartbeatTicker := time.NewTicker(sr.heartbeatInterval)
 	defer func() {
+		sr.Lock()
 		sr.conn.Close()
+		sr.Unlock()
 		heartbeatTicker.Stop()
 		streamServer.Del(sr)
 	}()
 	for {
 		select {
-		case <-sr.reader.ExitChan:
+		case <-sr.exitChan:
 			return
 		case ts := <-heartbeatTicker.C:
-			sr.Lock()
-			sr.bufrw.WriteString(fmt.Sprintf("{\"_heartbeat_\":%d}\n", ts.Unix()))
-			sr.bufrw.Flush()
-			sr.Unlock()
+			var err error
+			if sr.sse {
+				// a comment, which EventSource ignores
+				err = sr.write(fmt.Sprintf(": _heartbeat_ %d\n\n", ts.Unix()))
+			} else {
+				err = sr.write(fmt.Sprintf("{\"_heartbeat_\":%d}\n", ts.Unix()))
+			}
+			if err != nil {
+				log.Printf("[%s] failed to write heartbeat - %s", sr.conn.RemoteAddr().String(), err.Error())
+				sr.stop()
+			}
 		}
 	}
 }
 
-func (sr *StreamReader) HandleMessage(message *nsq.Message) error {
-	sr.Lock()
-	sr.bufrw.Write(message.Body)
-	sr.bufrw.WriteString("\n")
-	sr.bufrw.Flush()
-	sr.Unlock()
+func (sr *StreamReader) writeMessage(topic string, message *nsq.Message) error {
+	var s string
+	switch {
+	case sr.sse:
+		// the topic is the event's type, each line of the body a data field
+		s = fmt.Sprintf("id: %s\nevent: %s\n", message.Id, topic)
+		for _, line := range strings.Split(string(message.Body), "\n") {
+			s += "data: " + line + "\n"
+		}
+		s += "\n"
+	case len(sr.topics) > 1:
+		s = topic + " " + string(message.Body) + "\n"
+	default:
+		s = string(message.Body) + "\n"
+	}
+
+	err := sr.write(s)
+	if err != nil {
+		// the message is requeued for another client
+		sr.stop()
+		return err
+	}
 	atomic.AddUint64(&streamServer.messageCount, 1)
 	return nil
 }
 
+// write writes s to the client within --write-timeout
+func (sr *StreamReader) write(s string) error {
+	sr.Lock()
+	defer sr.Unlock()
+
+	sr.conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	_, err := io.WriteString(sr.w, s)
+	if err != nil {
+		return err
+	}
+	if sr.gzipWriter != nil {
+		err = sr.gzipWriter.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return sr.bufrw.Flush()
+}
+
 func main() {
 	flag.Parse()
 
@@ -236,6 +423,18 @@ func main() {
 		log.Fatalf("use --nsqd-tcp-address or --lookupd-tcp-address not both")
 	}
 
+	if *heartbeatInterval < minHeartbeatInterval || *heartbeatInterval > maxHeartbeatInterval {
+		log.Fatalf("--heartbeat-interval must be [%s,%s]", minHeartbeatInterval, maxHeartbeatInterval)
+	}
+
+	if *gzipLevel < 0 || *gzipLevel > 9 {
+		log.Fatalf("--gzip-level must be [0,9]")
+	}
+
+	if *maxTopics <= 0 {
+		log.Fatalf("--max-topics-per-connection must be > 0")
+	}
+
 	httpAddr, err := net.ResolveTCPAddr("tcp", *httpAddress)
 	if err != nil {
 		log.Fatal(err)
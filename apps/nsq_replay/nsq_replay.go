@@ -0,0 +1,307 @@
+// This is a client that republishes the output of nsq_to_file (one message
+// per line, optionally gzip or snappy compressed) to an nsqd topic
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/mreiferson/go-snappystream"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	topic       = flag.String("topic", "", "nsq topic to publish to")
+	rate        = flag.Int("rate", 0, "max number of messages to publish per second (0 = unlimited)")
+	since       = flag.String("since", "", "only replay messages at or after this time (RFC3339 or unix seconds)")
+	until       = flag.String("until", "", "only replay messages before this time (RFC3339 or unix seconds)")
+	tsField     = flag.String("timestamp-json-field", "", "for JSON messages: field holding the message time (RFC3339 or unix seconds), otherwise the file modification time is used")
+	preserveTS  = flag.String("preserve-timestamp-field", "", "for JSON messages: set this field to the original message time (unix seconds) before republishing")
+	statusEvery = flag.Int("status-every", 10000, "the # of messages between logging status, 0 disables")
+
+	nsqdTCPAddrs = util.StringArray{}
+)
+
+func init() {
+	flag.Var(&nsqdTCPAddrs, "nsqd-tcp-address", "destination nsqd TCP address (may be given multiple times)")
+}
+
+type Replayer struct {
+	writers    []*nsq.Writer
+	counter    uint64
+	throttle   <-chan time.Time
+	since      time.Time
+	until      time.Time
+	tsField    string
+	preserveTS string
+	exitChan   chan int
+
+	published int64
+	skipped   int64
+}
+
+// parseTime accepts either an RFC3339 timestamp or unix seconds
+func parseTime(s string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func openFile(filename string) (io.ReadCloser, time.Time, error) {
+	if filename == "-" {
+		return os.Stdin, time.Now(), nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+
+	// nsq_to_file names compressed files *.gz and *.sz (the revision suffix
+	// precedes the datetime, so the extension is not always last)
+	switch {
+	case strings.HasSuffix(filename, ".gz") || strings.Contains(filename, ".gz."):
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, time.Time{}, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{gr, f}, fi.ModTime(), nil
+	case strings.HasSuffix(filename, ".sz") || strings.Contains(filename, ".sz."):
+		return struct {
+			io.Reader
+			io.Closer
+		}{snappystream.NewReader(f, snappystream.SkipVerifyChecksum), f}, fi.ModTime(), nil
+	}
+	return f, fi.ModTime(), nil
+}
+
+// messageTime returns the time of a message, taken from --timestamp-json-field
+// when possible and falling back to the time of the file it was read from
+func (r *Replayer) messageTime(js map[string]interface{}, fileTime time.Time) time.Time {
+	if js == nil || r.tsField == "" {
+		return fileTime
+	}
+	switch v := js[r.tsField].(type) {
+	case float64:
+		return time.Unix(int64(v), 0)
+	case string:
+		if t, err := parseTime(v); err == nil {
+			return t
+		}
+	}
+	return fileTime
+}
+
+func (r *Replayer) inWindow(t time.Time) bool {
+	if !r.since.IsZero() && t.Before(r.since) {
+		return false
+	}
+	if !r.until.IsZero() && !t.Before(r.until) {
+		return false
+	}
+	return true
+}
+
+// addField adds "name": value to the JSON object obj (empty when it has no
+// fields), it isn't re-encoded so that the rest of it (ie. numbers too big
+// for a float64) is republished as it was
+func addField(obj []byte, name string, value int64, empty bool) []byte {
+	end := bytes.LastIndex(obj, []byte("}"))
+	key, _ := json.Marshal(name)
+
+	var buf bytes.Buffer
+	buf.Write(obj[:end])
+	if !empty {
+		buf.WriteString(",")
+	}
+	buf.Write(key)
+	buf.WriteString(":")
+	buf.WriteString(strconv.FormatInt(value, 10))
+	buf.Write(obj[end:])
+	return buf.Bytes()
+}
+
+func (r *Replayer) HandleLine(line []byte, fileTime time.Time) error {
+	var js map[string]interface{}
+	if r.tsField != "" || r.preserveTS != "" {
+		if json.Unmarshal(line, &js) != nil {
+			js = nil
+		}
+	}
+
+	t := r.messageTime(js, fileTime)
+	if !r.inWindow(t) {
+		r.skipped++
+		return nil
+	}
+
+	body := line
+	if js != nil && r.preserveTS != "" {
+		if _, ok := js[r.preserveTS]; !ok {
+			body = addField(line, r.preserveTS, t.Unix(), len(js) == 0)
+		}
+	}
+
+	if r.throttle != nil {
+		<-r.throttle
+	}
+
+	idx := r.counter % uint64(len(r.writers))
+	r.counter++
+	frameType, data, err := r.writers[idx].Publish(*topic, body)
+	if err != nil {
+		return err
+	}
+	if frameType == nsq.FrameTypeError {
+		return fmt.Errorf("%s returned %s", r.writers[idx], data)
+	}
+
+	r.published++
+	if *statusEvery > 0 && r.published%int64(*statusEvery) == 0 {
+		log.Printf("published %d messages (%d skipped)", r.published, r.skipped)
+	}
+	return nil
+}
+
+func (r *Replayer) ReplayFile(filename string) error {
+	f, fileTime, err := openFile(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	log.Printf("replaying %s", filename)
+	rd := bufio.NewReader(f)
+	for {
+		select {
+		case <-r.exitChan:
+			return nil
+		default:
+		}
+
+		line, err := rd.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] == '\n' {
+				line = line[:len(line)-1]
+			}
+			if len(line) > 0 {
+				if herr := r.HandleLine(line, fileTime); herr != nil {
+					return herr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	panic("unreachable")
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsq_replay v%s\n", util.BINARY_VERSION)
+		return
+	}
+
+	if *topic == "" {
+		log.Fatalf("--topic is required")
+	}
+
+	if len(nsqdTCPAddrs) == 0 {
+		log.Fatalf("--nsqd-tcp-address required")
+	}
+
+	if flag.NArg() == 0 {
+		log.Fatalf("at least one file (or - for stdin) is required")
+	}
+
+	if *rate < 0 {
+		log.Fatalf("--rate must be >= 0")
+	}
+
+	r := &Replayer{
+		tsField:    *tsField,
+		preserveTS: *preserveTS,
+		exitChan:   make(chan int),
+	}
+
+	var err error
+	if *since != "" {
+		r.since, err = parseTime(*since)
+		if err != nil {
+			log.Fatalf("invalid --since (%s) - %s", *since, err.Error())
+		}
+	}
+	if *until != "" {
+		r.until, err = parseTime(*until)
+		if err != nil {
+			log.Fatalf("invalid --until (%s) - %s", *until, err.Error())
+		}
+	}
+
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(*rate))
+		defer ticker.Stop()
+		r.throttle = ticker.C
+	}
+
+	for _, addr := range nsqdTCPAddrs {
+		writer := nsq.NewWriter(addr)
+		defer writer.Stop()
+		r.writers = append(r.writers, writer)
+	}
+
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-termChan
+		log.Printf("stopping")
+		close(r.exitChan)
+	}()
+
+	for _, filename := range flag.Args() {
+		err := r.ReplayFile(filename)
+		if err != nil {
+			log.Fatalf("ERROR: replaying %s - %s", filename, err.Error())
+		}
+		select {
+		case <-r.exitChan:
+			log.Printf("published %d messages (%d skipped)", r.published, r.skipped)
+			return
+		default:
+		}
+	}
+
+	log.Printf("published %d messages (%d skipped)", r.published, r.skipped)
+}
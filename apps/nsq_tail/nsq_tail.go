@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"os/signal"
+	"regexp"
+	"sort"
+	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/bitly/go-nsq"
@@ -17,43 +22,125 @@ import (
 var (
 	showVersion = flag.Bool("version", false, "print version string")
 
-	topic         = flag.String("topic", "", "nsq topic")
 	channel       = flag.String("channel", "", "nsq channel")
 	maxInFlight   = flag.Int("max-in-flight", 200, "max number of messages to allow in flight")
 	totalMessages = flag.Int("n", 0, "total messages to show (will wait if starved)")
 
+	format        = flag.String("format", "", "text/template to print each message with (ie. '{{.Topic}} {{.ID}} {{.Attempts}} {{.Body}}'), the default is the raw body")
+	countOnly     = flag.Bool("count-only", false, "print the number of messages received per topic (every --count-interval) instead of the messages")
+	countInterval = flag.Duration("count-interval", time.Second, "interval at which counts are printed with --count-only")
+	highlight     = flag.String("highlight", "", "regular expression whose matches in the output are highlighted")
+
+	topics           = util.StringArray{}
 	readerOpts       = util.StringArray{}
 	nsqdTCPAddrs     = util.StringArray{}
 	lookupdHTTPAddrs = util.StringArray{}
 )
 
 func init() {
+	flag.Var(&topics, "topic", "nsq topic (may be given multiple times)")
 	flag.Var(&readerOpts, "reader-opt", "option to passthrough to nsq.Reader (may be given multiple times)")
 	flag.Var(&nsqdTCPAddrs, "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 }
 
+// TailMessage is what --format templates are executed with
+type TailMessage struct {
+	Topic     string
+	ID        string
+	Timestamp time.Time
+	Attempts  uint16
+	Body      string
+}
+
+// highlight (ANSI bold red) for --highlight matches
+const highlightStart, highlightEnd = "\033[1;31m", "\033[0m"
+
+// TailHandler is shared by the readers of every topic
 type TailHandler struct {
+	sync.Mutex
 	totalMessages int
 	messagesShown int
+	tmpl          *template.Template
+	highlightRe   *regexp.Regexp
+	countOnly     bool
+	counts        map[string]int
+	buf           bytes.Buffer
+}
+
+// topicHandler tags messages from one topic's reader
+type topicHandler struct {
+	*TailHandler
+	topic string
 }
 
-func (th *TailHandler) HandleMessage(m *nsq.Message) error {
+func (h *topicHandler) HandleMessage(m *nsq.Message) error {
+	return h.handle(h.topic, m)
+}
+
+func (th *TailHandler) handle(topic string, m *nsq.Message) error {
+	th.Lock()
+	defer th.Unlock()
+
 	th.messagesShown++
-	_, err := os.Stdout.Write(m.Body)
-	if err != nil {
-		log.Fatalf("ERROR: failed to write to os.Stdout - %s", err.Error())
-	}
-	_, err = os.Stdout.WriteString("\n")
-	if err != nil {
-		log.Fatalf("ERROR: failed to write to os.Stdout - %s", err.Error())
+	if th.countOnly {
+		th.counts[topic]++
+	} else {
+		th.buf.Reset()
+		if th.tmpl != nil {
+			err := th.tmpl.Execute(&th.buf, &TailMessage{
+				Topic:     topic,
+				ID:        string(m.Id[:]),
+				Timestamp: time.Unix(0, m.Timestamp),
+				Attempts:  m.Attempts,
+				Body:      string(m.Body),
+			})
+			if err != nil {
+				log.Fatalf("ERROR: failed to execute --format template - %s", err.Error())
+			}
+		} else {
+			th.buf.Write(m.Body)
+		}
+
+		out := th.buf.Bytes()
+		if th.highlightRe != nil {
+			out = th.highlightRe.ReplaceAllFunc(out, func(match []byte) []byte {
+				return []byte(highlightStart + string(match) + highlightEnd)
+			})
+		}
+		_, err := os.Stdout.Write(out)
+		if err != nil {
+			log.Fatalf("ERROR: failed to write to os.Stdout - %s", err.Error())
+		}
+		_, err = os.Stdout.WriteString("\n")
+		if err != nil {
+			log.Fatalf("ERROR: failed to write to os.Stdout - %s", err.Error())
+		}
 	}
+
 	if th.totalMessages > 0 && th.messagesShown >= th.totalMessages {
+		if th.countOnly {
+			th.printCounts()
+		}
 		os.Exit(0)
 	}
 	return nil
 }
 
+// printCounts prints (and resets) the per-topic counts,
+// this expects the caller to hold the lock
+func (th *TailHandler) printCounts() {
+	names := make([]string, 0, len(th.counts))
+	for name := range th.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s %s %d\n", time.Now().Format(time.RFC3339), name, th.counts[name])
+		th.counts[name] = 0
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -67,7 +154,7 @@ func main() {
 		*channel = fmt.Sprintf("tail%06d#ephemeral", rand.Int()%999999)
 	}
 
-	if *topic == "" {
+	if len(topics) == 0 {
 		log.Fatalf("--topic is required")
 	}
 
@@ -78,46 +165,101 @@ func main() {
 		log.Fatalf("use --nsqd-tcp-address or --lookupd-http-address not both")
 	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if *countOnly && *countInterval <= 0 {
+		log.Fatalf("--count-interval must be > 0")
+	}
 
-	r, err := nsq.NewReader(*topic, *channel)
-	if err != nil {
-		log.Fatalf(err.Error())
+	handler := &TailHandler{
+		totalMessages: *totalMessages,
+		countOnly:     *countOnly,
+		counts:        make(map[string]int),
 	}
-	err = util.ParseReaderOpts(r, readerOpts)
-	if err != nil {
-		log.Fatalf(err.Error())
+	if *format != "" {
+		tmpl, err := template.New("format").Parse(*format)
+		if err != nil {
+			log.Fatalf("invalid --format template - %s", err.Error())
+		}
+		handler.tmpl = tmpl
 	}
+	if *highlight != "" {
+		re, err := regexp.Compile(*highlight)
+		if err != nil {
+			log.Fatalf("invalid --highlight regexp - %s", err.Error())
+		}
+		handler.highlightRe = re
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Don't ask for more messages than we want
 	if *totalMessages > 0 && *totalMessages < *maxInFlight {
 		*maxInFlight = *totalMessages
 	}
-	r.SetMaxInFlight(*maxInFlight)
-	r.AddHandler(&TailHandler{totalMessages: *totalMessages})
 
-	for _, addrString := range nsqdTCPAddrs {
-		err := r.ConnectToNSQ(addrString)
+	readers := make([]*nsq.Reader, 0, len(topics))
+	for _, topic := range topics {
+		r, err := nsq.NewReader(topic, *channel)
 		if err != nil {
 			log.Fatalf(err.Error())
 		}
-	}
-
-	for _, addrString := range lookupdHTTPAddrs {
-		log.Printf("lookupd addr %s", addrString)
-		err := r.ConnectToLookupd(addrString)
+		err = util.ParseReaderOpts(r, readerOpts)
 		if err != nil {
 			log.Fatalf(err.Error())
 		}
+
+		r.SetMaxInFlight(*maxInFlight)
+		r.AddHandler(&topicHandler{handler, topic})
+
+		for _, addrString := range nsqdTCPAddrs {
+			err := r.ConnectToNSQ(addrString)
+			if err != nil {
+				log.Fatalf(err.Error())
+			}
+		}
+
+		for _, addrString := range lookupdHTTPAddrs {
+			log.Printf("lookupd addr %s", addrString)
+			err := r.ConnectToLookupd(addrString)
+			if err != nil {
+				log.Fatalf(err.Error())
+			}
+		}
+		readers = append(readers, r)
+	}
+
+	var countChan <-chan time.Time
+	if *countOnly {
+		ticker := time.NewTicker(*countInterval)
+		defer ticker.Stop()
+		countChan = ticker.C
 	}
 
+	exitChan := make(chan int)
+	go func() {
+		for _, r := range readers {
+			<-r.ExitChan
+		}
+		close(exitChan)
+	}()
+
 	for {
 		select {
-		case <-r.ExitChan:
+		case <-exitChan:
+			if *countOnly {
+				handler.Lock()
+				handler.printCounts()
+				handler.Unlock()
+			}
 			return
+		case <-countChan:
+			handler.Lock()
+			handler.printCounts()
+			handler.Unlock()
 		case <-sigChan:
-			r.Stop()
+			for _, r := range readers {
+				r.Stop()
+			}
 		}
 	}
 }
@@ -3,20 +3,25 @@
 package main
 
 import (
+	"bufio"
 	"compress/gzip"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/bitly/nsq/util"
+	"github.com/mreiferson/go-snappystream"
 )
 
 var (
@@ -28,11 +33,14 @@ var (
 
 	outputDir      = flag.String("output-dir", "/tmp", "directory to write output files to")
 	datetimeFormat = flag.String("datetime-format", "%Y-%m-%d_%H", "strftime compatible format for <DATETIME> in filename format")
-	filenameFormat = flag.String("filename-format", "<TOPIC>.<HOST><GZIPREV>.<DATETIME>.log", "output filename format (<TOPIC>, <HOST>, <DATETIME>, <GZIPREV> are replaced. <GZIPREV> is a suffix when an existing gzip file already exists)")
+	filenameFormat = flag.String("filename-format", "<TOPIC>.<HOST><GZIPREV>.<DATETIME>.log", "output filename format (<TOPIC>, <HOST>, <DATETIME>, <GZIPREV> are replaced. <GZIPREV> is a suffix when an existing compressed (or size rotated) file already exists)")
 	hostIdentifier = flag.String("host-identifier", "", "value to output in log filename in place of hostname. <SHORT_HOST> and <HOSTNAME> are valid replacement tokens")
 	gzipLevel      = flag.Int("gzip-level", 6, "gzip compression level (1-9, 1=BestSpeed, 9=BestCompression)")
-	gzipEnabled    = flag.Bool("gzip", false, "gzip output files.")
+	gzipEnabled    = flag.Bool("gzip", false, "gzip output files (same as --compression=gzip)")
+	compression    = flag.String("compression", "", "compress output files (gzip, snappy)")
 	skipEmptyFiles = flag.Bool("skip-empty-files", false, "Skip writting empty files")
+	maxFileSize    = flag.Int64("max-file-size", 0, "rotate to a new file once this many (uncompressed) bytes have been written to the current one (0 = only rotate by <DATETIME>)")
+	execOnRotate   = flag.String("exec-on-rotate", "", "command to run (with the path of the finished file as the final argument) each time a file is closed")
 
 	readerOpts       = util.StringArray{}
 	nsqdTCPAddrs     = util.StringArray{}
@@ -51,12 +59,19 @@ func init() {
 
 type FileLogger struct {
 	out              *os.File
+	writer           io.Writer
 	gzipWriter       *gzip.Writer
+	snappyWriter     *bufio.Writer
 	lastFilename     string
+	lastPath         string
+	bytesWritten     int64
 	logChan          chan *Message
+	compression      string
 	compressionLevel int
-	gzipEnabled      bool
+	maxFileSize      int64
 	filenameFormat   string
+	execOnRotate     []string
+	execWaitGroup    sync.WaitGroup
 
 	ExitChan chan int
 }
@@ -159,16 +174,43 @@ func (f *FileLogger) Close() {
 		if f.gzipWriter != nil {
 			f.gzipWriter.Close()
 		}
+		if f.snappyWriter != nil {
+			err := f.snappyWriter.Flush()
+			if err != nil {
+				log.Printf("ERROR: flushing %s - %s", f.lastPath, err.Error())
+			}
+		}
 		f.out.Close()
 		f.out = nil
+		f.writer = nil
+		f.gzipWriter = nil
+		f.snappyWriter = nil
+
+		if len(f.execOnRotate) > 0 {
+			f.execWaitGroup.Add(1)
+			go f.runExecOnRotate(f.lastPath)
+		}
 	}
 }
 
-func (f *FileLogger) Write(p []byte) (n int, err error) {
-	if f.gzipWriter != nil {
-		return f.gzipWriter.Write(p)
+// runExecOnRotate runs the --exec-on-rotate command for a finished file
+func (f *FileLogger) runExecOnRotate(fullPath string) {
+	defer f.execWaitGroup.Done()
+
+	args := make([]string, 0, len(f.execOnRotate))
+	args = append(args, f.execOnRotate[1:]...)
+	args = append(args, fullPath)
+	log.Printf("running %s %s", f.execOnRotate[0], strings.Join(args, " "))
+	output, err := exec.Command(f.execOnRotate[0], args...).CombinedOutput()
+	if err != nil {
+		log.Printf("ERROR: --exec-on-rotate for %s failed - %s - %s", fullPath, err.Error(), output)
 	}
-	return f.out.Write(p)
+}
+
+func (f *FileLogger) Write(p []byte) (n int, err error) {
+	n, err = f.writer.Write(p)
+	f.bytesWritten += int64(n)
+	return n, err
 }
 
 func (f *FileLogger) Sync() error {
@@ -177,6 +219,12 @@ func (f *FileLogger) Sync() error {
 		f.gzipWriter.Close()
 		err = f.out.Sync()
 		f.gzipWriter, _ = gzip.NewWriterLevel(f.out, f.compressionLevel)
+		f.writer = f.gzipWriter
+	} else if f.snappyWriter != nil {
+		err = f.snappyWriter.Flush()
+		if err == nil {
+			err = f.out.Sync()
+		}
 	} else {
 		err = f.out.Sync()
 	}
@@ -188,28 +236,39 @@ func (f *FileLogger) calculateCurrentFilename() string {
 
 	datetime := strftime(*datetimeFormat, t)
 	filename := strings.Replace(f.filenameFormat, "<DATETIME>", datetime, -1)
-	if !f.gzipEnabled {
+	if !f.useRevisions() {
 		filename = strings.Replace(filename, "<GZIPREV>", "", -1)
 	}
 	return filename
 
 }
 
+// useRevisions indicates whether we must always create a new file (replacing
+// <GZIPREV> with a revision suffix) rather than append to an existing one
+func (f *FileLogger) useRevisions() bool {
+	return f.compression != "" || f.maxFileSize > 0
+}
+
 func (f *FileLogger) needsFileRotate() bool {
 	filename := f.calculateCurrentFilename()
-	return filename != f.lastFilename
+	return filename != f.lastFilename || f.exceedsMaxFileSize()
+}
+
+func (f *FileLogger) exceedsMaxFileSize() bool {
+	return f.maxFileSize > 0 && f.bytesWritten >= f.maxFileSize
 }
 
 func (f *FileLogger) updateFile() bool {
 	filename := f.calculateCurrentFilename()
 	maxGzipRevisions := 1000
-	if filename != f.lastFilename || f.out == nil {
+	if filename != f.lastFilename || f.out == nil || f.exceedsMaxFileSize() {
 		f.Close()
 		os.MkdirAll(*outputDir, 777)
 		var newFile *os.File
+		var fullPath string
 		var err error
-		if f.gzipEnabled {
-			// for gzip files, we never append to an existing file
+		if f.useRevisions() {
+			// for compressed (or size rotated) files, we never append to an existing file
 			// we try to create different revisions, replacing <GZIPREV> in the filename
 			for gzipRevision := 0; gzipRevision < maxGzipRevisions; gzipRevision += 1 {
 				var revisionSuffix string
@@ -217,7 +276,7 @@ func (f *FileLogger) updateFile() bool {
 					revisionSuffix = fmt.Sprintf("-%d", gzipRevision)
 				}
 				tempFilename := strings.Replace(filename, "<GZIPREV>", revisionSuffix, -1)
-				fullPath := path.Join(*outputDir, tempFilename)
+				fullPath = path.Join(*outputDir, tempFilename)
 				newFile, err = os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 				if err != nil && os.IsExist(err) {
 					log.Printf("INFO: file already exists: %s", fullPath)
@@ -234,7 +293,8 @@ func (f *FileLogger) updateFile() bool {
 			}
 		} else {
 			log.Printf("opening %s/%s", *outputDir, filename)
-			newFile, err = os.OpenFile(path.Join(*outputDir, filename), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+			fullPath = path.Join(*outputDir, filename)
+			newFile, err = os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -242,8 +302,19 @@ func (f *FileLogger) updateFile() bool {
 
 		f.out = newFile
 		f.lastFilename = filename
-		if f.gzipEnabled {
+		f.lastPath = fullPath
+		f.bytesWritten = 0
+		switch f.compression {
+		case "gzip":
 			f.gzipWriter, _ = gzip.NewWriterLevel(newFile, f.compressionLevel)
+			f.writer = f.gzipWriter
+		case "snappy":
+			// snappystream writes a frame per Write() call, buffer so that
+			// frames span many messages (64KB is the most a frame holds)
+			f.snappyWriter = bufio.NewWriterSize(snappystream.NewWriter(newFile), 65536)
+			f.writer = f.snappyWriter
+		default:
+			f.writer = newFile
 		}
 		return true
 	}
@@ -251,8 +322,15 @@ func (f *FileLogger) updateFile() bool {
 	return false
 }
 
-func NewFileLogger(gzipEnabled bool, compressionLevel int, filenameFormat string) (*FileLogger, error) {
-	if gzipEnabled && strings.Index(filenameFormat, "<GZIPREV>") == -1 {
+func NewFileLogger(compression string, compressionLevel int, maxFileSize int64,
+	filenameFormat string, execOnRotate string) (*FileLogger, error) {
+	switch compression {
+	case "", "gzip", "snappy":
+	default:
+		return nil, fmt.Errorf("invalid compression (%s), should be gzip or snappy", compression)
+	}
+
+	if (compression != "" || maxFileSize > 0) && strings.Index(filenameFormat, "<GZIPREV>") == -1 {
 		return nil, errors.New("missing <GZIPREV> in filenameFormat")
 	}
 
@@ -268,15 +346,20 @@ func NewFileLogger(gzipEnabled bool, compressionLevel int, filenameFormat string
 	}
 	filenameFormat = strings.Replace(filenameFormat, "<TOPIC>", *topic, -1)
 	filenameFormat = strings.Replace(filenameFormat, "<HOST>", identifier, -1)
-	if gzipEnabled && !strings.HasSuffix(filenameFormat, ".gz") {
+	if compression == "gzip" && !strings.HasSuffix(filenameFormat, ".gz") {
 		filenameFormat = filenameFormat + ".gz"
 	}
+	if compression == "snappy" && !strings.HasSuffix(filenameFormat, ".sz") {
+		filenameFormat = filenameFormat + ".sz"
+	}
 
 	f := &FileLogger{
 		logChan:          make(chan *Message, 1),
+		compression:      compression,
 		compressionLevel: compressionLevel,
+		maxFileSize:      maxFileSize,
 		filenameFormat:   filenameFormat,
-		gzipEnabled:      gzipEnabled,
+		execOnRotate:     strings.Fields(execOnRotate),
 		ExitChan:         make(chan int),
 	}
 	return f, nil
@@ -334,7 +417,14 @@ func main() {
 	signal.Notify(hupChan, syscall.SIGHUP)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
 
-	f, err := NewFileLogger(*gzipEnabled, *gzipLevel, *filenameFormat)
+	if *gzipEnabled {
+		if *compression != "" && *compression != "gzip" {
+			log.Fatalf("use --gzip or --compression not both")
+		}
+		*compression = "gzip"
+	}
+
+	f, err := NewFileLogger(*compression, *gzipLevel, *maxFileSize, *filenameFormat, *execOnRotate)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -374,4 +464,5 @@ func main() {
 	}
 
 	<-f.ExitChan
+	f.execWaitGroup.Wait()
 }
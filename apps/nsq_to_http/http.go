@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/bitly/go-nsq"
 	"github.com/bitly/nsq/util"
@@ -22,16 +23,25 @@ func HttpGet(endpoint string) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", userAgent)
+	setHeaders(req)
 	return httpclient.Do(req)
 }
 
 func HttpPost(endpoint string, body *bytes.Buffer) (*http.Response, error) {
-	req, err := http.NewRequest("POST", endpoint, body)
+	req, err := http.NewRequest(*method, endpoint, body)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("Content-Type", *contentType)
+	setHeaders(req)
 	return httpclient.Do(req)
 }
+
+// setHeaders sets the User-Agent and the --header headers (which take precedence)
+func setHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", userAgent)
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+}
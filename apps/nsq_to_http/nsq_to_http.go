@@ -19,7 +19,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/bitly/go-hostpool"
 	"github.com/bitly/go-nsq"
 	"github.com/bitly/nsq/util"
 )
@@ -43,10 +42,14 @@ var (
 	httpTimeout   = flag.Duration("http-timeout", 20*time.Second, "timeout for HTTP connect/read/write (each)")
 	statusEvery   = flag.Int("status-every", 250, "the # of requests between logging status (per handler), 0 disables")
 	contentType   = flag.String("content-type", "application/octet-stream", "the Content-Type used for POST requests")
+	method        = flag.String("method", "POST", "the HTTP method used for --post (and --route) requests: POST, PUT, PATCH or DELETE")
+	routeField    = flag.String("route-field", "", "JSON field of the message (ie. \"type\" or \"user.region\") whose value selects the --route addresses")
 
 	readerOpts       = util.StringArray{}
 	getAddrs         = util.StringArray{}
 	postAddrs        = util.StringArray{}
+	routes           = util.StringArray{}
+	headers          = util.StringArray{}
 	nsqdTCPAddrs     = util.StringArray{}
 	lookupdHTTPAddrs = util.StringArray{}
 
@@ -62,6 +65,8 @@ func init() {
 	flag.Var(&readerOpts, "reader-opt", "option to passthrough to nsq.Reader (may be given multiple times)")
 	flag.Var(&postAddrs, "post", "HTTP address to make a POST request to.  data will be in the body (may be given multiple times)")
 	flag.Var(&getAddrs, "get", "HTTP address to make a GET request to. '%s' will be printf replaced with data (may be given multiple times)")
+	flag.Var(&routes, "route", "<value>=<address> of --route-field, messages with that value go to that address rather than the --post/--get ones (may be given multiple times)")
+	flag.Var(&headers, "header", "'<name>: <value>' header added to every request (may be given multiple times)")
 	flag.Var(&nsqdTCPAddrs, "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 }
@@ -86,12 +91,52 @@ type Publisher interface {
 
 type PublishHandler struct {
 	Publisher
-	addresses util.StringArray
-	counter   uint64
-	mode      int
-	hostPool  hostpool.HostPool
-	reqs      Durations
-	id        int
+	mode int
+	reqs Durations
+	id   int
+
+	// the --post/--get addresses (nil without any) and those of each --route
+	destination *destination
+	routes      map[string]*destination
+	// whether messages are decoded for --route-field or address templates
+	decode bool
+}
+
+// route returns the destination of a message (nil if it has none) and, when
+// needed, its fields
+func (ph *PublishHandler) route(body []byte) (*destination, map[string]interface{}, error) {
+	if !ph.decode {
+		return ph.destination, nil, nil
+	}
+
+	fields, err := messageFields(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *routeField == "" {
+		return ph.destination, fields, nil
+	}
+
+	value, err := fieldValue(fields, *routeField)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dest, ok := ph.routes[value]; ok {
+		return dest, fields, nil
+	}
+	return ph.destination, fields, nil
+}
+
+func (ph *PublishHandler) publish(addr string, fields map[string]interface{}, body []byte) error {
+	if fields != nil && isTemplate(addr) {
+		var err error
+		_, printf := ph.Publisher.(*GetPublisher)
+		addr, err = fillTemplate(addr, fields, printf)
+		if err != nil {
+			return err
+		}
+	}
+	return ph.Publish(addr, body)
 }
 
 func (ph *PublishHandler) HandleMessage(m *nsq.Message) error {
@@ -105,24 +150,35 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message) error {
 		startTime = time.Now()
 	}
 
+	dest, fields, err := ph.route(m.Body)
+	if err != nil {
+		// it would fail every time
+		log.Printf("ERROR: handler(%d): dropping message %s - %s", ph.id, m.Id, err.Error())
+		return nil
+	}
+	if dest == nil {
+		log.Printf("ERROR: handler(%d): dropping message %s - no --route", ph.id, m.Id)
+		return nil
+	}
+
 	switch ph.mode {
 	case ModeAll:
-		for _, addr := range ph.addresses {
-			err := ph.Publish(addr, m.Body)
+		for _, addr := range dest.addresses {
+			err := ph.publish(addr, fields, m.Body)
 			if err != nil {
 				return err
 			}
 		}
 	case ModeRoundRobin:
-		idx := ph.counter % uint64(len(ph.addresses))
-		err := ph.Publish(ph.addresses[idx], m.Body)
+		idx := dest.counter % uint64(len(dest.addresses))
+		err := ph.publish(dest.addresses[idx], fields, m.Body)
 		if err != nil {
 			return err
 		}
-		ph.counter++
+		dest.counter++
 	case ModeHostPool:
-		hostPoolResponse := ph.hostPool.Get()
-		err := ph.Publish(hostPoolResponse.Host(), m.Body)
+		hostPoolResponse := dest.hostPool.Get()
+		err := ph.publish(hostPoolResponse.Host(), fields, m.Body)
 		hostPoolResponse.Mark(err)
 		if err != nil {
 			return err
@@ -218,8 +274,8 @@ func main() {
 	}
 
 	if *contentType != flag.Lookup("content-type").DefValue {
-		if len(postAddrs) == 0 {
-			log.Fatalf("--content-type only used with --post")
+		if len(getAddrs) > 0 {
+			log.Fatalf("--content-type only used with --post (or --route)")
 		}
 		if len(*contentType) == 0 {
 			log.Fatalf("--content-type requires a value when used")
@@ -233,18 +289,52 @@ func main() {
 		log.Fatalf("use --nsqd-tcp-address or --lookupd-http-address not both")
 	}
 
-	if len(getAddrs) == 0 && len(postAddrs) == 0 {
-		log.Fatalf("--get or --post required")
+	if len(getAddrs) == 0 && len(postAddrs) == 0 && len(routes) == 0 {
+		log.Fatalf("--get, --post or --route required")
 	}
 	if len(getAddrs) > 0 && len(postAddrs) > 0 {
 		log.Fatalf("use --get or --post not both")
 	}
+
+	if (*routeField == "") != (len(routes) == 0) {
+		log.Fatalf("--route-field and --route are used together")
+	}
+	routeAddrs, err := parseRoutes(routes)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	// --route addresses are requests of the same kind as the --get/--post ones
 	if len(getAddrs) > 0 {
 		for _, get := range getAddrs {
 			if strings.Count(get, "%s") != 1 {
 				log.Fatal("invalid GET address - must be a printf string")
 			}
 		}
+		for _, addrs := range routeAddrs {
+			for _, get := range addrs {
+				if strings.Count(get, "%s") != 1 {
+					log.Fatal("invalid --route GET address - must be a printf string")
+				}
+			}
+		}
+	}
+
+	*method = strings.ToUpper(*method)
+	switch *method {
+	case "POST", "PUT", "PATCH", "DELETE":
+	default:
+		log.Fatalf("--method must be one of POST, PUT, PATCH or DELETE")
+	}
+	if *method != "POST" && len(getAddrs) > 0 {
+		log.Fatalf("--method only used with --post (or --route)")
+	}
+
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			log.Fatalf("invalid --header %q - must be '<name>: <value>'", header)
+		}
 	}
 
 	switch *mode {
@@ -282,18 +372,30 @@ func main() {
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	if len(postAddrs) > 0 {
-		publisher = &PostPublisher{}
-		addresses = postAddrs
-	} else {
+	if len(getAddrs) > 0 {
 		publisher = &GetPublisher{}
 		addresses = getAddrs
+	} else {
+		publisher = &PostPublisher{}
+		addresses = postAddrs
+	}
+
+	decode := *routeField != ""
+	for _, addr := range addresses {
+		decode = decode || isTemplate(addr)
+	}
+	for _, addrs := range routeAddrs {
+		for _, addr := range addrs {
+			decode = decode || isTemplate(addr)
+		}
 	}
 
 	r, err := nsq.NewReader(*topic, *channel)
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
+	// identifies it as a relay (see nsqadmin's /topology), --reader-opt can override it
+	r.Configure("user_agent", fmt.Sprintf("nsq_to_http/%s go-nsq/%s", util.BINARY_VERSION, nsq.VERSION))
 	err = util.ParseReaderOpts(r, readerOpts)
 	if err != nil {
 		log.Fatalf(err.Error())
@@ -315,11 +417,17 @@ func main() {
 	for i := 0; i < *numPublishers; i++ {
 		handler := &PublishHandler{
 			Publisher: publisher,
-			addresses: addresses,
 			mode:      selectedMode,
 			reqs:      make(Durations, 0, *statusEvery),
 			id:        i,
-			hostPool:  hostpool.New(addresses),
+			routes:    make(map[string]*destination),
+			decode:    decode,
+		}
+		if len(addresses) > 0 {
+			handler.destination = newDestination(addresses)
+		}
+		for value, addrs := range routeAddrs {
+			handler.routes[value] = newDestination(addrs)
 		}
 		r.AddHandler(handler)
 	}
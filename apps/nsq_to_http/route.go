@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bitly/go-hostpool"
+	"github.com/bitly/nsq/util"
+)
+
+// addresses can be templates, "{field}" is replaced with the (query escaped)
+// value of that field of the message (a JSON object), nested fields are
+// dotted ("{user.id}"), and a message can be routed by the value of a field
+// (--route-field) to the addresses of that value (--route=<value>=<address>)
+
+// destination is a set of addresses a message is published to (according
+// to --mode)
+type destination struct {
+	addresses util.StringArray
+	counter   uint64
+	hostPool  hostpool.HostPool
+}
+
+func newDestination(addresses util.StringArray) *destination {
+	return &destination{
+		addresses: addresses,
+		hostPool:  hostpool.New(addresses),
+	}
+}
+
+// parseRoutes parses --route values (<value>=<address>) into the addresses
+// of each value
+func parseRoutes(routes util.StringArray) (map[string]util.StringArray, error) {
+	routeAddrs := make(map[string]util.StringArray)
+	for _, route := range routes {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid --route %q - must be <value>=<address>", route)
+		}
+		routeAddrs[parts[0]] = append(routeAddrs[parts[0]], parts[1])
+	}
+	return routeAddrs, nil
+}
+
+func isTemplate(addr string) bool {
+	return strings.Contains(addr, "{")
+}
+
+// messageFields decodes a message body (a JSON object) for templates and routing
+func messageFields(body []byte) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("message is not a JSON object - %s", err.Error())
+	}
+	return fields, nil
+}
+
+// fieldValue returns the value of a (dotted) field as a string, only strings,
+// numbers and booleans have one (numbers are decoded as float64, so integers
+// beyond 2^53 aren't exact)
+func fieldValue(fields map[string]interface{}, name string) (string, error) {
+	var v interface{} = fields
+	for _, key := range strings.Split(name, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("field %q not found", name)
+		}
+		v, ok = obj[key]
+		if !ok {
+			return "", fmt.Errorf("field %q not found", name)
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return fmt.Sprintf("%t", v), nil
+	}
+	return "", fmt.Errorf("field %q is not a string, number or boolean", name)
+}
+
+// fillTemplate replaces the "{field}"s of addr with their values, for a printf
+// address (--get) every % of the escaped values is doubled
+func fillTemplate(addr string, fields map[string]interface{}, printf bool) (string, error) {
+	var buf bytes.Buffer
+	for {
+		start := strings.Index(addr, "{")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(addr[start:], "}")
+		if end == -1 {
+			return "", errors.New("unterminated { in " + addr)
+		}
+		value, err := fieldValue(fields, addr[start+1:start+end])
+		if err != nil {
+			return "", err
+		}
+		value = url.QueryEscape(value)
+		if printf {
+			value = strings.Replace(value, "%", "%%", -1)
+		}
+		buf.WriteString(addr[:start])
+		buf.WriteString(value)
+		addr = addr[start+end+1:]
+	}
+	buf.WriteString(addr)
+	return buf.String(), nil
+}
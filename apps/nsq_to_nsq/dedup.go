@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// dedupWindow remembers the keys of the messages published over the last ttl
+// (and at most maxSize of them) so that the same message, redelivered or
+// relayed from another source cluster, isn't published twice
+type dedupWindow struct {
+	sync.Mutex
+	byBody  bool
+	ttl     time.Duration
+	maxSize int
+	keys    map[string]*list.Element
+	order   *list.List
+}
+
+type dedupEntry struct {
+	key string
+	ts  time.Time
+}
+
+func newDedupWindow(byBody bool, ttl time.Duration, maxSize int) *dedupWindow {
+	return &dedupWindow{
+		byBody:  byBody,
+		ttl:     ttl,
+		maxSize: maxSize,
+		keys:    make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// key is the message's ID or the SHA-1 of its body
+func (d *dedupWindow) key(m *nsq.Message) string {
+	if d.byBody {
+		h := sha1.New()
+		h.Write(m.Body)
+		return string(h.Sum(nil))
+	}
+	return string(m.Id[:])
+}
+
+// Reserve returns false if m is a duplicate, otherwise it's remembered (until
+// Release if publishing it fails)
+func (d *dedupWindow) Reserve(m *nsq.Message) bool {
+	key := d.key(m)
+	now := time.Now()
+
+	d.Lock()
+	defer d.Unlock()
+
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		entry := e.Value.(*dedupEntry)
+		if now.Sub(entry.ts) < d.ttl && d.order.Len() < d.maxSize {
+			break
+		}
+		d.order.Remove(e)
+		delete(d.keys, entry.key)
+	}
+
+	if _, ok := d.keys[key]; ok {
+		return false
+	}
+	d.keys[key] = d.order.PushBack(&dedupEntry{key, now})
+	return true
+}
+
+// Release forgets m, so that it's published when it's redelivered
+func (d *dedupWindow) Release(m *nsq.Message) {
+	key := d.key(m)
+
+	d.Lock()
+	defer d.Unlock()
+
+	if e, ok := d.keys[key]; ok {
+		d.order.Remove(e)
+		delete(d.keys, key)
+	}
+}
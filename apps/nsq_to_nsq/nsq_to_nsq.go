@@ -49,6 +49,10 @@ var (
 	requireJsonField = flag.String("require-json-field", "", "for JSON messages: only pass messages that contain this field")
 	requireJsonValue = flag.String("require-json-value", "", "for JSON messages: only pass messages in which the required field has this value")
 
+	dedup           = flag.String("dedup", "", "drop messages already published within --dedup-window, matched by their id or (a hash of their) body (disabled by default)")
+	dedupTTL        = flag.Duration("dedup-window", 10*time.Minute, "duration messages are remembered for --dedup")
+	dedupWindowSize = flag.Int("dedup-window-size", 1000000, "maximum number of messages remembered for --dedup")
+
 	// TODO: remove, deprecated
 	maxBackoffDuration = flag.Duration("max-backoff-duration", 120*time.Second, "(deprecated) use --reader-opt=max_backoff_duration=X, the maximum backoff duration")
 	verbose            = flag.Bool("verbose", false, "(depgrecated) use --reader-opt=verbose")
@@ -91,6 +95,9 @@ type PublishHandler struct {
 	id        int
 	respChan  chan *nsq.WriterTransaction
 
+	// shared by every handler, nil without --dedup
+	dedup *dedupWindow
+
 	requireJsonValueParsed   bool
 	requireJsonValueIsNumber bool
 	requireJsonNumber        float64
@@ -117,6 +124,9 @@ func (ph *PublishHandler) responder() {
 		}
 
 		success := t.Error == nil && t.FrameType == nsq.FrameTypeResponse
+		if !success && ph.dedup != nil {
+			ph.dedup.Release(msg)
+		}
 
 		if hostPoolResponse != nil {
 			if !success {
@@ -265,6 +275,11 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message, respChan chan *nsq.Finis
 		}
 	}
 
+	if ph.dedup != nil && !ph.dedup.Reserve(m) {
+		respChan <- &nsq.FinishedMessage{m.Id, 0, true}
+		return
+	}
+
 	startTime := time.Now()
 
 	switch ph.mode {
@@ -283,6 +298,9 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message, respChan chan *nsq.Finis
 	}
 
 	if err != nil {
+		if ph.dedup != nil {
+			ph.dedup.Release(m)
+		}
 		respChan <- &nsq.FinishedMessage{m.Id, getRequeueDelay(m), false}
 	}
 }
@@ -352,6 +370,20 @@ func main() {
 		selectedMode = ModeHostPool
 	}
 
+	// the window is per nsq_to_nsq, relaying multiple source clusters to the
+	// same destination needs a single nsq_to_nsq reading all of them
+	var window *dedupWindow
+	switch *dedup {
+	case "":
+	case "id", "body":
+		if *dedupTTL <= 0 || *dedupWindowSize <= 0 {
+			log.Fatalf("--dedup-window and --dedup-window-size must be > 0")
+		}
+		window = newDedupWindow(*dedup == "body", *dedupTTL, *dedupWindowSize)
+	default:
+		log.Fatalf("--dedup must be id or body")
+	}
+
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
@@ -359,6 +391,8 @@ func main() {
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
+	// identifies it as a relay (see nsqadmin's /topology), --reader-opt can override it
+	r.Configure("user_agent", fmt.Sprintf("nsq_to_nsq/%s go-nsq/%s", util.BINARY_VERSION, nsq.VERSION))
 	err = util.ParseReaderOpts(r, readerOpts)
 	if err != nil {
 		log.Fatalf(err.Error())
@@ -394,6 +428,7 @@ func main() {
 			id:        i,
 			hostPool:  hostpool.New(destNsqdTCPAddrs),
 			respChan:  respChan,
+			dedup:     window,
 		}
 		r.AddAsyncHandler(handler)
 		go handler.responder()
@@ -0,0 +1,622 @@
+// This is a command line tool for operating an NSQ cluster, it wraps the
+// nsqd/nsqlookupd (and, optionally, nsqadmin) HTTP APIs so that common
+// operations can be scripted
+//
+//	nsqctl --lookupd-http-address=127.0.0.1:4161 channel empty --topic=events --channel=archive
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+	verbose     = flag.Bool("verbose", false, "log every HTTP request made")
+	output      = flag.String("output", "table", "output format (table or json)")
+
+	topic    = flag.String("topic", "", "NSQ topic")
+	channel  = flag.String("channel", "", "NSQ channel")
+	node     = flag.String("node", "", "nsqd HTTP address (as registered with lookupd)")
+	interval = flag.Duration("interval", 2*time.Second, "duration of time between polls for stats watch and node drain --wait")
+	wait     = flag.Bool("wait", false, "node drain: wait for the node's messages to be consumed")
+
+	nsqadminHTTPAddr = flag.String("nsqadmin-http-address", "", "nsqadmin HTTP address, topic/channel actions are made through its /api (so that they are recorded as admin actions)")
+	apiAuthToken     = flag.String("api-auth-token", "", "token to present to nsqadmin's /api (see nsqadmin --api-auth-token)")
+
+	nsqdHTTPAddrs    = util.StringArray{}
+	lookupdHTTPAddrs = util.StringArray{}
+)
+
+func init() {
+	flag.Var(&nsqdHTTPAddrs, "nsqd-http-address", "nsqd HTTP address (may be given multiple times)")
+	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
+}
+
+type command struct {
+	usage string
+	run   func() error
+}
+
+var commands = map[string]*command{
+	"topics list":     {"list topics", topicsList},
+	"channels list":   {"list a --topic's channels", channelsList},
+	"topic create":    {"create a --topic", topicAction("create")},
+	"topic delete":    {"delete a --topic", topicAction("delete")},
+	"topic empty":     {"empty a --topic", topicAction("empty")},
+	"topic pause":     {"pause a --topic", topicAction("pause")},
+	"topic unpause":   {"unpause a --topic", topicAction("unpause")},
+	"channel create":  {"create a --topic's --channel", channelAction("create")},
+	"channel delete":  {"delete a --topic's --channel", channelAction("delete")},
+	"channel empty":   {"empty a --topic's --channel", channelAction("empty")},
+	"channel pause":   {"pause a --topic's --channel", channelAction("pause")},
+	"channel unpause": {"unpause a --topic's --channel", channelAction("unpause")},
+	"nodes list":      {"list nsqd nodes (requires --lookupd-http-address)", nodesList},
+	"node drain":      {"stop a --node being discovered by consumers (optionally --wait for it to be consumed)", nodeDrain},
+	"stats show":      {"show topic/channel stats (optionally of a --topic and --channel)", statsShow},
+	"stats watch":     {"show topic/channel stats every --interval", statsWatch},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: nsqctl [flags] <command> [flags]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", name, commands[name].usage)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsqctl v%s\n", util.BINARY_VERSION)
+		return
+	}
+
+	// flags may also follow the command
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	os.Args = append(os.Args[:1], args[2:]...)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		log.Fatalf("ERROR: unexpected arguments %v", flag.Args())
+	}
+
+	cmd, ok := commands[args[0]+" "+args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if *output != "table" && *output != "json" {
+		log.Fatalf("ERROR: --output must be table or json")
+	}
+	if len(nsqdHTTPAddrs) == 0 && len(lookupdHTTPAddrs) == 0 {
+		log.Fatalf("ERROR: --nsqd-http-address or --lookupd-http-address required")
+	}
+	if len(nsqdHTTPAddrs) > 0 && len(lookupdHTTPAddrs) > 0 {
+		log.Fatalf("ERROR: use --nsqd-http-address or --lookupd-http-address not both")
+	}
+
+	// the lookupd package logs every request
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	err := cmd.run()
+	if err != nil {
+		log.SetOutput(os.Stderr)
+		log.Fatalf("ERROR: %s", err.Error())
+	}
+}
+
+func requireTopic() error {
+	if *topic == "" {
+		return errors.New("--topic is required")
+	}
+	return nil
+}
+
+func requireTopicChannel() error {
+	if *topic == "" || *channel == "" {
+		return errors.New("--topic and --channel are required")
+	}
+	return nil
+}
+
+func getTopics() ([]string, error) {
+	if len(lookupdHTTPAddrs) != 0 {
+		return lookupd.GetLookupdTopics(lookupdHTTPAddrs)
+	}
+	return lookupd.GetNSQDTopics(nsqdHTTPAddrs)
+}
+
+func getProducers(topicName string) ([]string, error) {
+	if len(lookupdHTTPAddrs) != 0 {
+		return lookupd.GetLookupdTopicProducers(topicName, lookupdHTTPAddrs)
+	}
+	return lookupd.GetNSQDTopicProducers(topicName, nsqdHTTPAddrs)
+}
+
+func getNodes() ([]string, error) {
+	if len(lookupdHTTPAddrs) == 0 {
+		return nsqdHTTPAddrs, nil
+	}
+	producers, err := lookupd.GetLookupdProducers(lookupdHTTPAddrs)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]string, 0, len(producers))
+	for _, p := range producers {
+		nodes = append(nodes, p.HTTPAddress())
+	}
+	return nodes, nil
+}
+
+func endpoints(addrs []string, format string, args ...interface{}) []string {
+	var endpoints []string
+	for _, addr := range addrs {
+		endpoints = append(endpoints, "http://"+addr+fmt.Sprintf(format, args...))
+	}
+	return endpoints
+}
+
+// callEndpoints requests every endpoint (even once one has failed)
+func callEndpoints(endpoints []string) error {
+	var failed []string
+	for _, endpoint := range endpoints {
+		log.Printf("querying %s", endpoint)
+		_, err := util.ApiRequest(endpoint)
+		if err != nil {
+			log.Printf("ERROR: %s - %s", endpoint, err.Error())
+			failed = append(failed, endpoint)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to request %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// nsqadminAPI makes a request to nsqadmin's /api
+func nsqadminAPI(method string, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("http://%s/api%s", *nsqadminHTTPAddr, path)
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *apiAuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*apiAuthToken)
+	}
+
+	log.Printf("querying %s %s", method, endpoint)
+	httpclient := &http.Client{Transport: util.NewDeadlineTransport(10 * time.Second)}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s %s - %d %s", method, endpoint, resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+	return nil
+}
+
+func topicAction(action string) func() error {
+	return func() error {
+		err := requireTopic()
+		if err != nil {
+			return err
+		}
+
+		if *nsqadminHTTPAddr != "" {
+			path := "/topics/" + url.QueryEscape(*topic)
+			switch action {
+			case "create":
+				return nsqadminAPI("POST", "/topics", map[string]string{"topic": *topic})
+			case "delete":
+				return nsqadminAPI("DELETE", path, nil)
+			}
+			return nsqadminAPI("POST", path, map[string]string{"action": action})
+		}
+
+		topicName := url.QueryEscape(*topic)
+		switch action {
+		case "create":
+			if len(lookupdHTTPAddrs) == 0 {
+				return callEndpoints(endpoints(nsqdHTTPAddrs, "/create_topic?topic=%s", topicName))
+			}
+			return callEndpoints(endpoints(lookupdHTTPAddrs, "/create_topic?topic=%s", topicName))
+		case "delete":
+			// the producers have to be found before the topic is removed from lookupd
+			producers, err := getProducers(*topic)
+			if err != nil {
+				return err
+			}
+			err = callEndpoints(endpoints(lookupdHTTPAddrs, "/delete_topic?topic=%s", topicName))
+			if err != nil {
+				return err
+			}
+			return callEndpoints(endpoints(producers, "/delete_topic?topic=%s", topicName))
+		}
+
+		producers, err := getProducers(*topic)
+		if err != nil {
+			return err
+		}
+		return callEndpoints(endpoints(producers, "/%s_topic?topic=%s", action, topicName))
+	}
+}
+
+func channelAction(action string) func() error {
+	return func() error {
+		err := requireTopicChannel()
+		if err != nil {
+			return err
+		}
+
+		if *nsqadminHTTPAddr != "" {
+			path := "/topics/" + url.QueryEscape(*topic) + "/" + url.QueryEscape(*channel)
+			if action == "delete" {
+				return nsqadminAPI("DELETE", path, nil)
+			}
+			return nsqadminAPI("POST", path, map[string]string{"action": action})
+		}
+
+		topicName := url.QueryEscape(*topic)
+		channelName := url.QueryEscape(*channel)
+		producers, err := getProducers(*topic)
+		if err != nil {
+			return err
+		}
+		if action == "create" || action == "delete" {
+			err = callEndpoints(endpoints(lookupdHTTPAddrs, "/%s_channel?topic=%s&channel=%s",
+				action, topicName, channelName))
+			if err != nil {
+				return err
+			}
+		}
+		return callEndpoints(endpoints(producers, "/%s_channel?topic=%s&channel=%s",
+			action, topicName, channelName))
+	}
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", data)
+	return nil
+}
+
+func printTable(header []string, rows [][]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+func topicsList() error {
+	topics, err := getTopics()
+	if err != nil {
+		return err
+	}
+	sort.Strings(topics)
+	if *output == "json" {
+		return printJSON(map[string][]string{"topics": topics})
+	}
+	rows := make([][]string, 0, len(topics))
+	for _, t := range topics {
+		rows = append(rows, []string{t})
+	}
+	printTable([]string{"TOPIC"}, rows)
+	return nil
+}
+
+func channelsList() error {
+	err := requireTopic()
+	if err != nil {
+		return err
+	}
+
+	var channels []string
+	if len(lookupdHTTPAddrs) != 0 {
+		channels, err = lookupd.GetLookupdTopicChannels(*topic, lookupdHTTPAddrs)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, channelStats, err := lookupd.GetNSQDStats(nsqdHTTPAddrs, *topic)
+		if err != nil {
+			return err
+		}
+		for name := range channelStats {
+			channels = append(channels, name)
+		}
+	}
+	sort.Strings(channels)
+	if *output == "json" {
+		return printJSON(map[string][]string{"channels": channels})
+	}
+	rows := make([][]string, 0, len(channels))
+	for _, c := range channels {
+		rows = append(rows, []string{*topic, c})
+	}
+	printTable([]string{"TOPIC", "CHANNEL"}, rows)
+	return nil
+}
+
+func nodesList() error {
+	if len(lookupdHTTPAddrs) == 0 {
+		return errors.New("--lookupd-http-address is required")
+	}
+	producers, err := lookupd.GetLookupdProducers(lookupdHTTPAddrs)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return printJSON(map[string][]*lookupd.Producer{"nodes": producers})
+	}
+	rows := make([][]string, 0, len(producers))
+	for _, p := range producers {
+		rows = append(rows, []string{p.Hostname, p.HTTPAddress(), p.TCPAddress(), p.Version,
+			strconv.Itoa(len(p.Topics))})
+	}
+	printTable([]string{"HOSTNAME", "HTTP ADDRESS", "TCP ADDRESS", "VERSION", "TOPICS"}, rows)
+	return nil
+}
+
+// nodeDrain tombstones the node as a producer of each of its topics so that
+// consumers stop discovering it, with --wait the tombstones are renewed
+// (they only last for nsqlookupd's --tombstone-lifetime) until the node's
+// topics and channels are empty
+func nodeDrain() error {
+	if len(lookupdHTTPAddrs) == 0 {
+		return errors.New("--lookupd-http-address is required")
+	}
+	if *node == "" {
+		return errors.New("--node is required")
+	}
+
+	producers, err := lookupd.GetLookupdProducers(lookupdHTTPAddrs)
+	if err != nil {
+		return err
+	}
+	var topics []string
+	for _, p := range producers {
+		if p.HTTPAddress() != *node {
+			continue
+		}
+		for _, t := range p.Topics {
+			topics = append(topics, t.Topic)
+		}
+	}
+	if topics == nil {
+		return fmt.Errorf("node %s not found (or has no topics)", *node)
+	}
+
+	for {
+		for _, t := range topics {
+			err := callEndpoints(endpoints(lookupdHTTPAddrs, "/tombstone_topic_producer?topic=%s&node=%s",
+				url.QueryEscape(t), url.QueryEscape(*node)))
+			if err != nil {
+				return err
+			}
+		}
+		if !*wait {
+			return nil
+		}
+
+		topicStats, channelStats, err := lookupd.GetNSQDStats([]string{*node}, "")
+		if err != nil {
+			return err
+		}
+		var remaining int64
+		for _, t := range topicStats {
+			remaining += t.Depth
+		}
+		for _, c := range channelStats {
+			remaining += c.Depth + c.InFlightCount + c.DeferredCount
+		}
+
+		if *output == "json" {
+			printJSON(map[string]interface{}{"node": *node, "remaining": remaining})
+		} else {
+			fmt.Printf("%s %s: %d messages remaining\n", time.Now().Format(time.RFC3339), *node, remaining)
+		}
+		if remaining == 0 {
+			return nil
+		}
+		time.Sleep(*interval)
+	}
+	panic("unreachable")
+}
+
+type statsRow struct {
+	Topic         string `json:"topic"`
+	Channel       string `json:"channel,omitempty"`
+	Depth         int64  `json:"depth"`
+	BackendDepth  int64  `json:"backend_depth"`
+	InFlightCount int64  `json:"in_flight_count"`
+	DeferredCount int64  `json:"deferred_count"`
+	RequeueCount  int64  `json:"requeue_count"`
+	TimeoutCount  int64  `json:"timeout_count"`
+	MessageCount  int64  `json:"message_count"`
+	ClientCount   int    `json:"client_count"`
+	Paused        bool   `json:"paused"`
+}
+
+// getStats returns a row per topic (aggregated across nodes) followed by a
+// row per each of its channels
+func getStats() ([]*statsRow, error) {
+	var nodes []string
+	var err error
+	if *topic != "" {
+		nodes, err = getProducers(*topic)
+	} else {
+		nodes, err = getNodes()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	topicStats, channelStats, err := lookupd.GetNSQDStats(nodes, *topic)
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make(map[string]*statsRow)
+	var names []string
+	for _, t := range topicStats {
+		row, ok := topics[t.TopicName]
+		if !ok {
+			row = &statsRow{Topic: t.TopicName}
+			topics[t.TopicName] = row
+			names = append(names, t.TopicName)
+		}
+		row.Depth += t.Depth
+		row.BackendDepth += t.BackendDepth
+		row.MessageCount += t.MessageCount
+		row.Paused = row.Paused || t.Paused
+	}
+	sort.Strings(names)
+
+	channels := make(map[string][]*statsRow)
+	for _, c := range channelStats {
+		if *channel != "" && c.ChannelName != *channel {
+			continue
+		}
+		channels[c.TopicName] = append(channels[c.TopicName], &statsRow{
+			Topic:         c.TopicName,
+			Channel:       c.ChannelName,
+			Depth:         c.Depth,
+			BackendDepth:  c.BackendDepth,
+			InFlightCount: c.InFlightCount,
+			DeferredCount: c.DeferredCount,
+			RequeueCount:  c.RequeueCount,
+			TimeoutCount:  c.TimeoutCount,
+			MessageCount:  c.MessageCount,
+			ClientCount:   c.ClientCount,
+			Paused:        c.Paused,
+		})
+	}
+
+	var rows []*statsRow
+	for _, name := range names {
+		rows = append(rows, topics[name])
+		sort.Sort(statsRowsByChannel{channels[name]})
+		rows = append(rows, channels[name]...)
+	}
+	return rows, nil
+}
+
+type statsRows []*statsRow
+type statsRowsByChannel struct {
+	statsRows
+}
+
+func (s statsRows) Len() int      { return len(s) }
+func (s statsRows) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s statsRowsByChannel) Less(i, j int) bool {
+	return s.statsRows[i].Channel < s.statsRows[j].Channel
+}
+
+func printStats(rows []*statsRow) error {
+	if *output == "json" {
+		return printJSON(map[string]interface{}{"ts": time.Now().Unix(), "stats": rows})
+	}
+
+	table := make([][]string, 0, len(rows))
+	for _, r := range rows {
+		name := r.Topic
+		if r.Channel != "" {
+			name = "  " + r.Channel
+		}
+		paused := ""
+		if r.Paused {
+			paused = "yes"
+		}
+		if r.Channel == "" {
+			table = append(table, []string{name, i64(r.Depth), i64(r.BackendDepth), "", "", "", "",
+				i64(r.MessageCount), "", paused})
+			continue
+		}
+		table = append(table, []string{name, i64(r.Depth), i64(r.BackendDepth), i64(r.InFlightCount),
+			i64(r.DeferredCount), i64(r.RequeueCount), i64(r.TimeoutCount), i64(r.MessageCount),
+			strconv.Itoa(r.ClientCount), paused})
+	}
+	printTable([]string{"TOPIC/CHANNEL", "DEPTH", "BE-DEPTH", "IN-FLIGHT", "DEFERRED", "REQUEUED",
+		"TIMED-OUT", "MSGS", "CLIENTS", "PAUSED"}, table)
+	return nil
+}
+
+func i64(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
+
+func statsShow() error {
+	rows, err := getStats()
+	if err != nil {
+		return err
+	}
+	return printStats(rows)
+}
+
+func statsWatch() error {
+	for {
+		rows, err := getStats()
+		if err != nil {
+			return err
+		}
+		if *output == "table" {
+			fmt.Printf("--- %s\n", time.Now().Format(time.RFC3339))
+		}
+		err = printStats(rows)
+		if err != nil {
+			return err
+		}
+		time.Sleep(*interval)
+	}
+	panic("unreachable")
+}
@@ -22,14 +22,35 @@ var (
 	showVersion = flagSet.Bool("version", false, "print version string")
 	verbose     = flagSet.Bool("verbose", false, "enable verbose logging")
 
-	tcpAddress       = flagSet.String("tcp-address", "0.0.0.0:4160", "<addr>:<port> to listen on for TCP clients")
-	httpAddress      = flagSet.String("http-address", "0.0.0.0:4161", "<addr>:<port> to listen on for HTTP clients")
+	tcpAddrs         = util.StringArray{}
+	httpAddrs        = util.StringArray{}
 	broadcastAddress = flagSet.String("broadcast-address", "", "address of this lookupd node, (default to the OS hostname)")
 
 	inactiveProducerTimeout = flagSet.Duration("inactive-producer-timeout", 300*time.Second, "duration of time a producer will remain in the active list since its last ping")
 	tombstoneLifetime       = flagSet.Duration("tombstone-lifetime", 45*time.Second, "duration of time a producer will remain tombstoned if registration remains")
+
+	producerHeartbeatInterval = flagSet.Duration("producer-heartbeat-interval", 15*time.Second, "interval at which producers are expected to heartbeat (PING)")
+	staleProducerHeartbeats   = flagSet.Int("stale-producer-heartbeats", 3, "number of consecutive missed heartbeats after which a producer is stale and no longer returned by /lookup (0 to disable)")
+	httpProducerTimeout       = flagSet.Duration("http-producer-timeout", 60*time.Second, "duration after which a producer registered over HTTP (POST /producer/register) that hasn't POSTed again is unregistered")
+	evictProducerHeartbeats   = flagSet.Int("evict-producer-heartbeats", 0, "number of consecutive missed heartbeats after which a producer is evicted from all registrations (0 to disable)")
+
+	dnsAddress = flagSet.String("dns-address", "", "<addr>:<port> to serve topic producers over DNS (SRV, A and AAAA records) on, UDP and TCP (disabled by default)")
+	dnsDomain  = flagSet.String("dns-domain", "nsq.", "DNS domain the topic records are served under (ie. _nsqd._tcp.<topic>.<domain>)")
+	dnsTTL     = flagSet.Duration("dns-ttl", 5*time.Second, "TTL of the DNS records served")
+
+	workerIDLeaseTTL = flagSet.Duration("worker-id-lease-ttl", 5*time.Minute, "duration a worker id leased by nsqd (--worker-id-lease) is held for unless it's renewed")
+
+	topicConfigFile = flagSet.String("topic-config-file", "", "path to a JSON file to persist per-topic configuration (/set_topic_config) to")
+
+	httpDebug          = flagSet.Bool("http-debug", false, "enable the /debug/ HTTP endpoints (pprof, trace, goroutine dump, forced GC), requires --http-debug-auth-token")
+	httpDebugAuthToken = flagSet.String("http-debug-auth-token", "", "token required (as a bearer token or basic auth password) to access /debug/ HTTP endpoints")
 )
 
+func init() {
+	flagSet.Var(&tcpAddrs, "tcp-address", "<addr>:<port> to listen on for TCP clients, IPv6 as [<addr>]:<port> (may be given multiple times, default 0.0.0.0:4160)")
+	flagSet.Var(&httpAddrs, "http-address", "<addr>:<port> to listen on for HTTP clients, IPv6 as [<addr>]:<port> (may be given multiple times, default 0.0.0.0:4161)")
+}
+
 func main() {
 	flagSet.Parse(os.Args[1:])
 
@@ -54,6 +75,8 @@ func main() {
 		}
 	}
 
+	util.UpgradeConfigKeys(cfg, util.ListenAddressConfigKeys)
+
 	opts := nsqlookupd.NewNSQLookupdOptions()
 	options.Resolve(opts, flagSet, cfg)
 	daemon := nsqlookupd.NewNSQLookupd(opts)
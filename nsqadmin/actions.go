@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+// the admin actions below are shared by the HTML form handlers and the JSON API,
+// each one fans out to the relevant nsqlookupd/nsqd and returns the endpoints
+// that failed (the rest are still attempted)
+
+func callEndpoints(prefix string, endpoints []string) []string {
+	var failed []string
+	for _, endpoint := range endpoints {
+		log.Printf("%s: querying %s", prefix, endpoint)
+		_, err := util.ApiRequest(endpoint)
+		if err != nil {
+			log.Printf("ERROR: %s %s - %s", prefix, endpoint, err.Error())
+			failed = append(failed, endpoint)
+		}
+	}
+	return failed
+}
+
+func (s *httpServer) lookupdEndpoints(format string, args ...interface{}) []string {
+	var endpoints []string
+	for _, addr := range s.context.nsqadmin.options.NSQLookupdHTTPAddresses {
+		endpoints = append(endpoints, "http://"+addr+fmt.Sprintf(format, args...))
+	}
+	return endpoints
+}
+
+func nsqdEndpoints(producers []string, format string, args ...interface{}) []string {
+	var endpoints []string
+	for _, addr := range producers {
+		endpoints = append(endpoints, "http://"+addr+fmt.Sprintf(format, args...))
+	}
+	return endpoints
+}
+
+func (s *httpServer) createTopic(topicName string) []string {
+	return callEndpoints("LOOKUPD", s.lookupdEndpoints("/create_topic?topic=%s",
+		url.QueryEscape(topicName)))
+}
+
+func (s *httpServer) createChannel(topicName string, channelName string) []string {
+	failed := callEndpoints("LOOKUPD", s.lookupdEndpoints("/create_channel?topic=%s&channel=%s",
+		url.QueryEscape(topicName), url.QueryEscape(channelName)))
+
+	// TODO: we can remove this when we push new channel information from nsqlookupd -> nsqd
+	producers, _ := lookupd.GetLookupdTopicProducers(topicName, s.context.nsqadmin.options.NSQLookupdHTTPAddresses)
+	return append(failed, callEndpoints("NSQD", nsqdEndpoints(producers,
+		"/create_channel?topic=%s&channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName)))...)
+}
+
+func (s *httpServer) tombstoneTopicProducer(topicName string, node string) []string {
+	// tombstone the topic on all the lookupds
+	failed := callEndpoints("LOOKUPD", s.lookupdEndpoints("/tombstone_topic_producer?topic=%s&node=%s",
+		url.QueryEscape(topicName), url.QueryEscape(node)))
+
+	// delete the topic on the producer
+	return append(failed, callEndpoints("NSQD", nsqdEndpoints([]string{node},
+		"/delete_topic?topic=%s", url.QueryEscape(topicName)))...)
+}
+
+func (s *httpServer) deleteTopic(topicName string) []string {
+	// for topic removal, you need to get all the producers *first*
+	producers := s.getProducers(topicName)
+
+	// remove the topic from all the lookupds
+	failed := callEndpoints("LOOKUPD", s.lookupdEndpoints("/delete_topic?topic=%s",
+		url.QueryEscape(topicName)))
+
+	// now remove the topic from all the producers
+	return append(failed, callEndpoints("NSQD", nsqdEndpoints(producers,
+		"/delete_topic?topic=%s", url.QueryEscape(topicName)))...)
+}
+
+func (s *httpServer) deleteChannel(topicName string, channelName string) []string {
+	failed := callEndpoints("LOOKUPD", s.lookupdEndpoints("/delete_channel?topic=%s&channel=%s",
+		url.QueryEscape(topicName), url.QueryEscape(channelName)))
+
+	producers := s.getProducers(topicName)
+	return append(failed, callEndpoints("NSQD", nsqdEndpoints(producers,
+		"/delete_channel?topic=%s&channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName)))...)
+}
+
+func (s *httpServer) emptyTopic(topicName string) []string {
+	return callEndpoints("NSQD", nsqdEndpoints(s.getProducers(topicName),
+		"/empty_topic?topic=%s", url.QueryEscape(topicName)))
+}
+
+func (s *httpServer) pauseTopic(topicName string, pause bool) []string {
+	return callEndpoints("NSQD", nsqdEndpoints(s.getProducers(topicName),
+		"/%s?topic=%s", pauseAction(pause, "topic"), url.QueryEscape(topicName)))
+}
+
+func (s *httpServer) emptyChannel(topicName string, channelName string) []string {
+	return callEndpoints("NSQD", nsqdEndpoints(s.getProducers(topicName),
+		"/empty_channel?topic=%s&channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName)))
+}
+
+func (s *httpServer) pauseChannel(topicName string, channelName string, pause bool) []string {
+	return callEndpoints("NSQD", nsqdEndpoints(s.getProducers(topicName),
+		"/%s?topic=%s&channel=%s", pauseAction(pause, "channel"),
+		url.QueryEscape(topicName), url.QueryEscape(channelName)))
+}
+
+func pauseAction(pause bool, kind string) string {
+	if pause {
+		return "pause_" + kind
+	}
+	return "unpause_" + kind
+}
+
+// isKnownNode returns whether node is the HTTP address of an nsqd we were
+// configured with or that is registered with nsqlookupd
+func (s *httpServer) isKnownNode(node string) bool {
+	for _, n := range s.context.nsqadmin.options.NSQDHTTPAddresses {
+		if node == n {
+			return true
+		}
+	}
+	producers, _ := lookupd.GetLookupdProducers(s.context.nsqadmin.options.NSQLookupdHTTPAddresses)
+	for _, p := range producers {
+		if node == p.HTTPAddress() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+// apiRequest is the (optional) JSON body of a mutating API request
+type apiRequest struct {
+	Action  string `json:"action"`
+	Topic   string `json:"topic"`
+	Channel string `json:"channel"`
+
+	// the message(s) of an inject action (see inject.go)
+	Node  string `json:"node"`
+	Body  string `json:"body"`
+	Delay string `json:"delay"`
+	Count int    `json:"count"`
+}
+
+// apiHandler serves the JSON equivalent of every UI page and action under
+// /api/ (see README.md), when --api-auth-token is set every request must
+// present it as "Authorization: Bearer <token>"
+//
+// it relies on neither cookies nor forms, and mutating requests must be
+// Content-Type: application/json (which a cross-site form can't send without
+// a CORS preflight) so it can't be driven cross-site
+func (s *httpServer) apiHandler(w http.ResponseWriter, req *http.Request) {
+	if !s.apiAuthorized(req) {
+		util.ApiResponse(w, 401, "UNAUTHORIZED", nil)
+		return
+	}
+
+	var body apiRequest
+	if req.Method == "POST" || req.Method == "DELETE" {
+		mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			util.ApiResponse(w, 415, "UNSUPPORTED_MEDIA_TYPE", nil)
+			return
+		}
+		err = json.NewDecoder(io.LimitReader(req.Body, 1024*1024)).Decode(&body)
+		if err != nil && err != io.EOF {
+			util.ApiResponse(w, 400, "INVALID_BODY", nil)
+			return
+		}
+	}
+
+	// (ServeHTTP only routes /api/ paths here)
+	parts := strings.Split(strings.Trim(req.URL.Path[len("/api/"):], "/"), "/")
+	switch {
+	case parts[0] == "topics" && len(parts) == 1:
+		s.apiTopicsHandler(w, req, body)
+	case parts[0] == "topics" && len(parts) == 2:
+		s.apiTopicHandler(w, req, body, parts[1])
+	case parts[0] == "topics" && len(parts) == 3:
+		s.apiChannelHandler(w, req, body, parts[1], parts[2])
+	case parts[0] == "nodes" && len(parts) == 1:
+		s.apiNodesHandler(w, req)
+	case parts[0] == "nodes" && len(parts) == 2:
+		s.apiNodeHandler(w, req, body, parts[1])
+	case parts[0] == "ping" && len(parts) == 1:
+		util.OKResponse(w)
+	case parts[0] == "counter" && len(parts) == 1:
+		if req.Method != "GET" {
+			util.ApiResponse(w, 405, "METHOD_NOT_ALLOWED", nil)
+			return
+		}
+		s.counterDataHandler(w, req)
+	case parts[0] == "leaderboard" && len(parts) == 1:
+		s.apiLeaderboardHandler(w, req)
+	case parts[0] == "topology" && len(parts) == 1:
+		s.apiTopologyHandler(w, req)
+	default:
+		util.ApiResponse(w, 404, "NOT_FOUND", nil)
+	}
+}
+
+func (s *httpServer) apiAuthorized(req *http.Request) bool {
+	authToken := s.context.nsqadmin.options.APIAuthToken
+	if authToken == "" {
+		return true
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := auth[len("Bearer "):]
+	return subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) == 1
+}
+
+// apiActionResponse reports the outcome of an action that fanned out to
+// nsqlookupd/nsqd, listing any endpoints that failed
+func apiActionResponse(w http.ResponseWriter, failed []string) {
+	if len(failed) > 0 {
+		util.ApiResponse(w, 502, "UPSTREAM_ERROR", struct {
+			Failed []string `json:"failed"`
+		}{failed})
+		return
+	}
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) apiTopicsHandler(w http.ResponseWriter, req *http.Request, body apiRequest) {
+	switch req.Method {
+	case "GET":
+		var topics []string
+		if len(s.context.nsqadmin.options.NSQLookupdHTTPAddresses) != 0 {
+			topics, _ = lookupd.GetLookupdTopics(s.context.nsqadmin.options.NSQLookupdHTTPAddresses)
+		} else {
+			topics, _ = lookupd.GetNSQDTopics(s.context.nsqadmin.options.NSQDHTTPAddresses)
+		}
+		util.ApiResponse(w, 200, "OK", struct {
+			Topics []string `json:"topics"`
+		}{topics})
+	case "POST":
+		if !nsq.IsValidTopicName(body.Topic) {
+			util.ApiResponse(w, 400, "INVALID_TOPIC", nil)
+			return
+		}
+		if len(body.Channel) > 0 && !nsq.IsValidChannelName(body.Channel) {
+			util.ApiResponse(w, 400, "INVALID_CHANNEL", nil)
+			return
+		}
+
+		failed := s.createTopic(body.Topic)
+		s.notifyAdminAction("create_topic", body.Topic, "", "", req)
+		if len(body.Channel) > 0 {
+			failed = append(failed, s.createChannel(body.Topic, body.Channel)...)
+			s.notifyAdminAction("create_channel", body.Topic, body.Channel, "", req)
+		}
+		apiActionResponse(w, failed)
+	default:
+		util.ApiResponse(w, 405, "METHOD_NOT_ALLOWED", nil)
+	}
+}
+
+func (s *httpServer) apiTopicHandler(w http.ResponseWriter, req *http.Request, body apiRequest, topicName string) {
+	if !nsq.IsValidTopicName(topicName) {
+		util.ApiResponse(w, 400, "INVALID_TOPIC", nil)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		producers := s.getProducers(topicName)
+		topicStats, channelStats, _ := lookupd.GetNSQDStats(producers, topicName)
+
+		globalTopicStats := &lookupd.TopicStats{HostAddress: "Total"}
+		for _, t := range topicStats {
+			globalTopicStats.Add(t)
+		}
+
+		util.ApiResponse(w, 200, "OK", struct {
+			Topic     string                           `json:"topic"`
+			Producers []string                         `json:"producers"`
+			Total     *lookupd.TopicStats              `json:"total"`
+			Nodes     []*lookupd.TopicStats            `json:"nodes"`
+			Channels  map[string]*lookupd.ChannelStats `json:"channels"`
+		}{topicName, producers, globalTopicStats, topicStats, channelStats})
+	case "POST":
+		var failed []string
+		switch body.Action {
+		case "empty":
+			failed = s.emptyTopic(topicName)
+			s.notifyAdminAction("empty_topic", topicName, "", "", req)
+		case "pause", "unpause":
+			failed = s.pauseTopic(topicName, body.Action == "pause")
+			s.notifyAdminAction(body.Action+"_topic", topicName, "", "", req)
+		case "inject":
+			s.apiInject(w, req, body, topicName)
+			return
+		default:
+			util.ApiResponse(w, 400, "INVALID_ACTION", nil)
+			return
+		}
+		apiActionResponse(w, failed)
+	case "DELETE":
+		failed := s.deleteTopic(topicName)
+		s.notifyAdminAction("delete_topic", topicName, "", "", req)
+		apiActionResponse(w, failed)
+	default:
+		util.ApiResponse(w, 405, "METHOD_NOT_ALLOWED", nil)
+	}
+}
+
+func (s *httpServer) apiInject(w http.ResponseWriter, req *http.Request, body apiRequest, topicName string) {
+	var count string
+	if body.Count != 0 {
+		count = strconv.Itoa(body.Count)
+	}
+	r, err := newInjectRequest(topicName, body.Node, body.Body, body.Delay, count)
+	if err != nil {
+		util.ApiResponse(w, 400, err.Error(), nil)
+		return
+	}
+	result := s.inject(r)
+	s.notifyAdminAction("inject_message", topicName, "", result.Node, req)
+	if result.Error != "" {
+		util.ApiResponse(w, 502, "UPSTREAM_ERROR", result)
+		return
+	}
+	util.ApiResponse(w, 200, "OK", result)
+}
+
+func (s *httpServer) apiChannelHandler(w http.ResponseWriter, req *http.Request, body apiRequest,
+	topicName string, channelName string) {
+	if !nsq.IsValidTopicName(topicName) {
+		util.ApiResponse(w, 400, "INVALID_TOPIC", nil)
+		return
+	}
+	if !nsq.IsValidChannelName(channelName) {
+		util.ApiResponse(w, 400, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		producers := s.getProducers(topicName)
+		_, allChannelStats, _ := lookupd.GetNSQDStats(producers, topicName)
+		channelStats, ok := allChannelStats[channelName]
+		if !ok {
+			util.ApiResponse(w, 404, "CHANNEL_NOT_FOUND", nil)
+			return
+		}
+		util.ApiResponse(w, 200, "OK", channelStats)
+	case "POST":
+		var failed []string
+		switch body.Action {
+		case "create":
+			failed = s.createChannel(topicName, channelName)
+			s.notifyAdminAction("create_channel", topicName, channelName, "", req)
+		case "empty":
+			failed = s.emptyChannel(topicName, channelName)
+			s.notifyAdminAction("empty_channel", topicName, channelName, "", req)
+		case "pause", "unpause":
+			failed = s.pauseChannel(topicName, channelName, body.Action == "pause")
+			s.notifyAdminAction(body.Action+"_channel", topicName, channelName, "", req)
+		default:
+			util.ApiResponse(w, 400, "INVALID_ACTION", nil)
+			return
+		}
+		apiActionResponse(w, failed)
+	case "DELETE":
+		failed := s.deleteChannel(topicName, channelName)
+		s.notifyAdminAction("delete_channel", topicName, channelName, "", req)
+		apiActionResponse(w, failed)
+	default:
+		util.ApiResponse(w, 405, "METHOD_NOT_ALLOWED", nil)
+	}
+}
+
+func (s *httpServer) apiNodesHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		util.ApiResponse(w, 405, "METHOD_NOT_ALLOWED", nil)
+		return
+	}
+	producers, err := lookupd.GetLookupdProducers(s.context.nsqadmin.options.NSQLookupdHTTPAddresses)
+	if err != nil {
+		log.Printf("ERROR: failed to get producers - %s", err.Error())
+	}
+	util.ApiResponse(w, 200, "OK", struct {
+		Nodes []*lookupd.Producer `json:"nodes"`
+	}{producers})
+}
+
+func (s *httpServer) apiNodeHandler(w http.ResponseWriter, req *http.Request, body apiRequest, node string) {
+	if !s.isKnownNode(node) {
+		util.ApiResponse(w, 404, "NODE_NOT_FOUND", nil)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		topicStats, _, _ := lookupd.GetNSQDStats([]string{node}, "")
+
+		numClients := int64(0)
+		numMessages := int64(0)
+		for _, ts := range topicStats {
+			for _, cs := range ts.Channels {
+				numClients += int64(len(cs.Clients))
+			}
+			numMessages += ts.MessageCount
+		}
+
+		util.ApiResponse(w, 200, "OK", struct {
+			Node          string                `json:"node"`
+			Topics        []*lookupd.TopicStats `json:"topics"`
+			TotalMessages int64                 `json:"total_messages"`
+			TotalClients  int64                 `json:"total_clients"`
+		}{node, topicStats, numMessages, numClients})
+	case "DELETE":
+		// tombstones body.Topic on this node
+		if !nsq.IsValidTopicName(body.Topic) {
+			util.ApiResponse(w, 400, "INVALID_TOPIC", nil)
+			return
+		}
+		failed := s.tombstoneTopicProducer(body.Topic, node)
+		s.notifyAdminAction("tombstone_topic_producer", body.Topic, "", node, req)
+		apiActionResponse(w, failed)
+	default:
+		util.ApiResponse(w, 405, "METHOD_NOT_ALLOWED", nil)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+// graphiteConfig is how nsqadmin talks to graphite (ie. over HTTPS and with
+// the headers an SSO proxy in front of it requires) and how it builds the
+// render targets for each metric
+type graphiteConfig struct {
+	header       http.Header
+	transport    *http.Transport
+	aggregations map[string]string
+	retentions   map[string]time.Duration
+	templates    map[string]*template.Template
+}
+
+// graphTargetData is what --graphite-target-template templates are executed with
+type graphTargetData struct {
+	Prefix  string
+	Key     string
+	Host    string
+	Topic   string
+	Channel string
+	Target  string // the default target
+}
+
+func newGraphiteConfig(options *nsqadminOptions) (*graphiteConfig, error) {
+	g := &graphiteConfig{
+		header:       make(http.Header),
+		transport:    util.NewDeadlineTransport(20 * time.Second),
+		aggregations: make(map[string]string),
+		retentions:   make(map[string]time.Duration),
+		templates:    make(map[string]*template.Template),
+	}
+
+	for _, h := range options.GraphiteHeaders {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid --graphite-header %q (expected <name>: <value>)", h)
+		}
+		g.header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if len(g.header) > 0 && !options.ProxyGraphite {
+		// graphs are rendered by the browser, which can't send them
+		return nil, errors.New("--graphite-header requires --proxy-graphite")
+	}
+
+	if options.GraphiteTLSRootCAFile != "" || options.GraphiteTLSInsecureSkipVerify {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: options.GraphiteTLSInsecureSkipVerify,
+		}
+		if options.GraphiteTLSRootCAFile != "" {
+			data, err := ioutil.ReadFile(options.GraphiteTLSRootCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in %s", options.GraphiteTLSRootCAFile)
+			}
+		}
+		g.transport.TLSClientConfig = tlsConfig
+	}
+
+	for _, a := range options.GraphiteAggregations {
+		key, fn, err := parseMetricOption(a, "--graphite-aggregation")
+		if err != nil {
+			return nil, err
+		}
+		g.aggregations[key] = fn
+	}
+
+	for _, r := range options.GraphiteRetentions {
+		key, value, err := parseMetricOption(r, "--graphite-retention")
+		if err != nil {
+			return nil, err
+		}
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < time.Second {
+			return nil, fmt.Errorf("invalid --graphite-retention %q", r)
+		}
+		g.retentions[key] = interval
+	}
+
+	for _, t := range options.GraphiteTargetTemplates {
+		key, value, err := parseMetricOption(t, "--graphite-target-template")
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(key).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --graphite-target-template %q - %s", t, err.Error())
+		}
+		g.templates[key] = tmpl
+	}
+
+	return g, nil
+}
+
+// parseMetricOption parses <metric>=<value>
+func parseMetricOption(s string, flagName string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid %s %q (expected <metric>=<value>)", flagName, s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// summarize returns the interval and function graphs of key are summarized with
+func (g *graphiteConfig) summarize(key string) (time.Duration, string) {
+	interval := *statsdInterval
+	if r, ok := g.retentions[key]; ok {
+		interval = r
+	}
+	fn := "avg"
+	if a, ok := g.aggregations[key]; ok {
+		fn = a
+	}
+	return interval, fn
+}
+
+// target applies key's --graphite-target-template (if any) to target
+func (g *graphiteConfig) target(gr GraphTarget, key string, prefix string, target string) string {
+	tmpl, ok := g.templates[key]
+	if !ok {
+		return target
+	}
+
+	data := &graphTargetData{
+		Prefix: prefix,
+		Key:    key,
+		Host:   gr.Host(),
+		Target: target,
+	}
+	switch t := gr.(type) {
+	case *Topic:
+		data.Topic = t.TopicName
+	case *lookupd.TopicStats:
+		data.Topic = t.TopicName
+	case *lookupd.ChannelStats:
+		data.Topic = t.TopicName
+		data.Channel = t.ChannelName
+	case *util.E2eProcessingLatencyAggregate:
+		data.Topic = t.Topic
+		data.Channel = t.Channel
+	}
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		log.Printf("ERROR: failed to execute graphite target template for %s - %s", key, err.Error())
+		return target
+	}
+	return buf.String()
+}
+
+// get performs a GET request to graphite, with the configured headers
+func (g *graphiteConfig) get(requestURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range g.header {
+		req.Header[name] = values
+	}
+
+	httpclient := &http.Client{Transport: g.transport}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		log.Printf("ERROR: GET request to graphite failed %s", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("ERROR: reading GET body failed %s", err)
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got response %s", resp.Status)
+	}
+	return contents, nil
+}
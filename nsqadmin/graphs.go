@@ -196,11 +196,13 @@ func (g *GraphOptions) Sparkline(gr GraphTarget, key string) template.URL {
 	params.Set("lineMode", "connected")
 	params.Set("drawNullAsZero", "false")
 
-	interval := fmt.Sprintf("%dsec", *statsdInterval/time.Second)
+	graphite := g.context.nsqadmin.graphite
+	interval, fn := graphite.summarize(key)
 	targets, color := gr.Target(key)
 	for _, target := range targets {
-		target = fmt.Sprintf(target, g.Prefix(gr.Host(), metricType(key)))
-		params.Add("target", fmt.Sprintf(`summarize(%s,"%s","avg")`, target, interval))
+		prefix := g.Prefix(gr.Host(), metricType(key))
+		target = graphite.target(gr, key, prefix, fmt.Sprintf(target, prefix))
+		params.Add("target", fmt.Sprintf(`summarize(%s,"%dsec","%s")`, target, interval/time.Second, fn))
 	}
 	params.Add("colorList", color)
 
@@ -219,13 +221,15 @@ func (g *GraphOptions) LargeGraph(gr GraphTarget, key string) template.URL {
 	params.Set("lineMode", "connected")
 	params.Set("drawNullAsZero", "false")
 
-	interval := fmt.Sprintf("%dsec", *statsdInterval/time.Second)
+	graphite := g.context.nsqadmin.graphite
+	interval, fn := graphite.summarize(key)
 	targets, color := gr.Target(key)
 	for _, target := range targets {
-		target = fmt.Sprintf(target, g.Prefix(gr.Host(), metricType(key)))
-		target = fmt.Sprintf(`summarize(%s,"%s","avg")`, target, interval)
+		prefix := g.Prefix(gr.Host(), metricType(key))
+		target = graphite.target(gr, key, prefix, fmt.Sprintf(target, prefix))
+		target = fmt.Sprintf(`summarize(%s,"%dsec","%s")`, target, interval/time.Second, fn)
 		if metricType(key) == "counter" {
-			scale := fmt.Sprintf("%.04f", 1/float64(*statsdInterval/time.Second))
+			scale := fmt.Sprintf("%.04f", 1/float64(interval/time.Second))
 			target = fmt.Sprintf(`scale(%s,%s)`, target, scale)
 		}
 		log.Println("Adding target: ", target)
@@ -240,7 +244,8 @@ func (g *GraphOptions) LargeGraph(gr GraphTarget, key string) template.URL {
 
 func (g *GraphOptions) Rate(gr GraphTarget) string {
 	target, _ := gr.Target("message_count")
-	return fmt.Sprintf(target[0], g.Prefix(gr.Host(), metricType("message_count")))
+	prefix := g.Prefix(gr.Host(), metricType("message_count"))
+	return g.context.nsqadmin.graphite.target(gr, "message_count", prefix, fmt.Sprintf(target[0], prefix))
 }
 
 func metricType(key string) string {
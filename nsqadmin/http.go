@@ -3,8 +3,6 @@ package main
 import (
 	"fmt"
 	"html/template"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -20,25 +18,31 @@ import (
 )
 
 // this is similar to httputil.NewSingleHostReverseProxy except it passes along basic auth
-func NewSingleHostReverseProxy(target *url.URL, timeout time.Duration) *httputil.ReverseProxy {
+// and any --graphite-header headers
+func NewSingleHostReverseProxy(target *url.URL, transport http.RoundTripper, header http.Header) *httputil.ReverseProxy {
 	director := func(req *http.Request) {
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
+		req.Host = target.Host
 		if target.User != nil {
 			passwd, _ := target.User.Password()
 			req.SetBasicAuth(target.User.Username(), passwd)
 		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
 	}
 	return &httputil.ReverseProxy{
 		Director:  director,
-		Transport: util.NewDeadlineTransport(timeout),
+		Transport: transport,
 	}
 }
 
 type httpServer struct {
-	context  *Context
-	counters map[string]map[string]int64
-	proxy    *httputil.ReverseProxy
+	context     *Context
+	counters    map[string]map[string]int64
+	leaderboard leaderboard
+	proxy       *httputil.ReverseProxy
 }
 
 func NewHTTPServer(context *Context) *httpServer {
@@ -49,6 +53,12 @@ func NewHTTPServer(context *Context) *httpServer {
 		"nanotohuman":    util.NanoSecondToHuman,
 		"floatToPercent": util.FloatToPercent,
 		"percSuffix":     util.PercSuffix,
+		"humanBytes": func(v int64) string {
+			return util.HumanBytes(uint64(v))
+		},
+		"nanoInt64ToHuman": func(v int64) string {
+			return util.NanoSecondToHuman(float64(v))
+		},
 		"getNodeConsistencyClass": func(node *lookupd.Producer) string {
 			if node.IsInconsistent(len(context.nsqadmin.options.NSQLookupdHTTPAddresses)) {
 				return "btn-warning"
@@ -64,7 +74,8 @@ func NewHTTPServer(context *Context) *httpServer {
 			log.Fatalf("ERROR: failed to parse --graphite-url='%s' - %s",
 				context.nsqadmin.options.GraphiteURL, err.Error())
 		}
-		proxy = NewSingleHostReverseProxy(url, 20*time.Second)
+		graphite := context.nsqadmin.graphite
+		proxy = NewSingleHostReverseProxy(url, graphite.transport, graphite.header)
 	}
 
 	return &httpServer{
@@ -75,12 +86,23 @@ func NewHTTPServer(context *Context) *httpServer {
 }
 
 func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// the v1 API is /api/ (which remains as an alias)
+	if strings.HasPrefix(req.URL.Path, "/v1/") {
+		req.URL.Path = "/api/" + req.URL.Path[len("/v1/"):]
+		w = util.NewV1ResponseWriter(w, req)
+	} else if strings.HasPrefix(req.URL.Path, "/api/") && util.AcceptsV1(req) {
+		w = util.NewV1ResponseWriter(w, req)
+	}
+
 	if strings.HasPrefix(req.URL.Path, "/node/") {
 		s.nodeHandler(w, req)
 		return
 	} else if strings.HasPrefix(req.URL.Path, "/topic/") {
 		s.topicHandler(w, req)
 		return
+	} else if strings.HasPrefix(req.URL.Path, "/api/") {
+		s.apiHandler(w, req)
+		return
 	}
 
 	switch req.URL.Path {
@@ -112,10 +134,16 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		s.counterDataHandler(w, req)
 	case "/counter":
 		s.counterHandler(w, req)
+	case "/leaderboard":
+		s.leaderboardHandler(w, req)
+	case "/topology":
+		s.topologyHandler(w, req)
 	case "/lookup":
 		s.lookupHandler(w, req)
 	case "/create_topic_channel":
 		s.createTopicChannelHandler(w, req)
+	case "/inject":
+		s.injectHandler(w, req)
 	case "/graphite_data":
 		s.graphiteDataHandler(w, req)
 	case "/render":
@@ -131,8 +159,7 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Length", "2")
-	io.WriteString(w, "OK")
+	util.OKResponse(w)
 }
 
 func (s *httpServer) indexHandler(w http.ResponseWriter, req *http.Request) {
@@ -352,42 +379,12 @@ func (s *httpServer) createTopicChannelHandler(w http.ResponseWriter, req *http.
 		return
 	}
 
-	for _, addr := range s.context.nsqadmin.options.NSQLookupdHTTPAddresses {
-		endpoint := fmt.Sprintf("http://%s/create_topic?topic=%s", addr, url.QueryEscape(topicName))
-		log.Printf("LOOKUPD: querying %s", endpoint)
-		_, err := util.ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
-			continue
-		}
-	}
+	s.createTopic(topicName)
 
 	s.notifyAdminAction("create_topic", topicName, "", "", req)
 
 	if len(channelName) > 0 {
-		for _, addr := range s.context.nsqadmin.options.NSQLookupdHTTPAddresses {
-			endpoint := fmt.Sprintf("http://%s/create_channel?topic=%s&channel=%s",
-				addr, url.QueryEscape(topicName), url.QueryEscape(channelName))
-			log.Printf("LOOKUPD: querying %s", endpoint)
-			_, err := util.ApiRequest(endpoint)
-			if err != nil {
-				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
-				continue
-			}
-		}
-
-		// TODO: we can remove this when we push new channel information from nsqlookupd -> nsqd
-		producers, _ := lookupd.GetLookupdTopicProducers(topicName, s.context.nsqadmin.options.NSQLookupdHTTPAddresses)
-		for _, addr := range producers {
-			endpoint := fmt.Sprintf("http://%s/create_channel?topic=%s&channel=%s",
-				addr, url.QueryEscape(topicName), url.QueryEscape(channelName))
-			log.Printf("NSQD: querying %s", endpoint)
-			_, err := util.ApiRequest(endpoint)
-			if err != nil {
-				log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
-				continue
-			}
-		}
+		s.createChannel(topicName, channelName)
 		s.notifyAdminAction("create_channel", topicName, channelName, "", req)
 	}
 
@@ -419,24 +416,7 @@ func (s *httpServer) tombstoneTopicProducerHandler(w http.ResponseWriter, req *h
 		rd = "/"
 	}
 
-	// tombstone the topic on all the lookupds
-	for _, addr := range s.context.nsqadmin.options.NSQLookupdHTTPAddresses {
-		endpoint := fmt.Sprintf("http://%s/tombstone_topic_producer?topic=%s&node=%s",
-			addr, url.QueryEscape(topicName), url.QueryEscape(node))
-		log.Printf("LOOKUPD: querying %s", endpoint)
-		_, err := util.ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
-		}
-	}
-
-	// delete the topic on the producer
-	endpoint := fmt.Sprintf("http://%s/delete_topic?topic=%s", node, url.QueryEscape(topicName))
-	log.Printf("NSQD: querying %s", endpoint)
-	_, err = util.ApiRequest(endpoint)
-	if err != nil {
-		log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
-	}
+	s.tombstoneTopicProducer(topicName, node)
 
 	s.notifyAdminAction("tombstone_topic_producer", topicName, "", node, req)
 
@@ -462,31 +442,7 @@ func (s *httpServer) deleteTopicHandler(w http.ResponseWriter, req *http.Request
 		rd = "/"
 	}
 
-	// for topic removal, you need to get all the producers *first*
-	producers := s.getProducers(topicName)
-
-	// remove the topic from all the lookupds
-	for _, addr := range s.context.nsqadmin.options.NSQLookupdHTTPAddresses {
-		endpoint := fmt.Sprintf("http://%s/delete_topic?topic=%s", addr, url.QueryEscape(topicName))
-		log.Printf("LOOKUPD: querying %s", endpoint)
-
-		_, err := util.ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
-			continue
-		}
-	}
-
-	// now remove the topic from all the producers
-	for _, addr := range producers {
-		endpoint := fmt.Sprintf("http://%s/delete_topic?topic=%s", addr, url.QueryEscape(topicName))
-		log.Printf("NSQD: querying %s", endpoint)
-		_, err := util.ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
-			continue
-		}
-	}
+	s.deleteTopic(topicName)
 
 	s.notifyAdminAction("delete_topic", topicName, "", "", req)
 
@@ -512,29 +468,7 @@ func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Reque
 		rd = fmt.Sprintf("/topic/%s", url.QueryEscape(topicName))
 	}
 
-	for _, addr := range s.context.nsqadmin.options.NSQLookupdHTTPAddresses {
-		endpoint := fmt.Sprintf("http://%s/delete_channel?topic=%s&channel=%s",
-			addr, url.QueryEscape(topicName), url.QueryEscape(channelName))
-		log.Printf("LOOKUPD: querying %s", endpoint)
-
-		_, err := util.ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
-			continue
-		}
-	}
-
-	producers := s.getProducers(topicName)
-	for _, addr := range producers {
-		endpoint := fmt.Sprintf("http://%s/delete_channel?topic=%s&channel=%s",
-			addr, url.QueryEscape(topicName), url.QueryEscape(channelName))
-		log.Printf("NSQD: querying %s", endpoint)
-		_, err := util.ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
-			continue
-		}
-	}
+	s.deleteChannel(topicName, channelName)
 
 	s.notifyAdminAction("delete_channel", topicName, channelName, "", req)
 
@@ -555,17 +489,7 @@ func (s *httpServer) emptyTopicHandler(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	producers := s.getProducers(topicName)
-	for _, addr := range producers {
-		endpoint := fmt.Sprintf("http://%s/empty_topic?topic=%s", addr, url.QueryEscape(topicName))
-		log.Printf("NSQD: calling %s", endpoint)
-
-		_, err := util.ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
-			continue
-		}
-	}
+	s.emptyTopic(topicName)
 
 	s.notifyAdminAction("empty_topic", topicName, "", "", req)
 
@@ -586,18 +510,7 @@ func (s *httpServer) pauseTopicHandler(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	producers := s.getProducers(topicName)
-	for _, addr := range producers {
-		endpoint := fmt.Sprintf("http://%s%s?topic=%s",
-			addr, req.URL.Path, url.QueryEscape(topicName))
-		log.Printf("NSQD: calling %s", endpoint)
-
-		_, err := util.ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
-			continue
-		}
-	}
+	s.pauseTopic(topicName, req.URL.Path == "/pause_topic")
 
 	s.notifyAdminAction(strings.TrimLeft(req.URL.Path, "/"), topicName, "", "", req)
 
@@ -618,18 +531,7 @@ func (s *httpServer) emptyChannelHandler(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	producers := s.getProducers(topicName)
-	for _, addr := range producers {
-		endpoint := fmt.Sprintf("http://%s/empty_channel?topic=%s&channel=%s",
-			addr, url.QueryEscape(topicName), url.QueryEscape(channelName))
-		log.Printf("NSQD: calling %s", endpoint)
-
-		_, err := util.ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
-			continue
-		}
-	}
+	s.emptyChannel(topicName, channelName)
 
 	s.notifyAdminAction("empty_channel", topicName, channelName, "", req)
 
@@ -650,18 +552,7 @@ func (s *httpServer) pauseChannelHandler(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	producers := s.getProducers(topicName)
-	for _, addr := range producers {
-		endpoint := fmt.Sprintf("http://%s%s?topic=%s&channel=%s",
-			addr, req.URL.Path, url.QueryEscape(topicName), url.QueryEscape(channelName))
-		log.Printf("NSQD: calling %s", endpoint)
-
-		_, err := util.ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
-			continue
-		}
-	}
+	s.pauseChannel(topicName, channelName, req.URL.Path == "/pause_channel")
 
 	s.notifyAdminAction(strings.TrimLeft(req.URL.Path, "/"), topicName, channelName, "", req)
 
@@ -685,21 +576,7 @@ func (s *httpServer) nodeHandler(w http.ResponseWriter, req *http.Request) {
 	parts := strings.Split(matches[1], "/")
 	node := parts[0]
 
-	found := false
-	for _, n := range s.context.nsqadmin.options.NSQDHTTPAddresses {
-		if node == n {
-			found = true
-			break
-		}
-	}
-	producers, _ := lookupd.GetLookupdProducers(s.context.nsqadmin.options.NSQLookupdHTTPAddresses)
-	for _, p := range producers {
-		if node == fmt.Sprintf("%s:%d", p.BroadcastAddress, p.HttpPort) {
-			found = true
-			break
-		}
-	}
-	if !found {
+	if !s.isKnownNode(node) {
 		http.Error(w, "INVALID_NODE", 500)
 		return
 	}
@@ -749,6 +626,7 @@ func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	producers, _ := lookupd.GetLookupdProducers(s.context.nsqadmin.options.NSQLookupdHTTPAddresses)
+	lookupd.GetNSQDResources(producers)
 
 	p := struct {
 		Title        string
@@ -898,7 +776,7 @@ func (s *httpServer) graphiteDataHandler(w http.ResponseWriter, req *http.Reques
 	query := queryFunc(target)
 	url := s.context.nsqadmin.options.GraphiteURL + query
 	log.Printf("GRAPHITE: %s", url)
-	response, err := GraphiteGet(url)
+	response, err := s.context.nsqadmin.graphite.get(url)
 	if err != nil {
 		log.Printf("ERROR: graphite request failed %s", err.Error())
 		http.Error(w, "GRAPHITE_FAILED", 500)
@@ -917,25 +795,6 @@ func (s *httpServer) graphiteDataHandler(w http.ResponseWriter, req *http.Reques
 	return
 }
 
-func GraphiteGet(request_url string) ([]byte, error) {
-	response, err := http.Get(request_url)
-
-	var contents []byte
-
-	if err != nil {
-		log.Printf("ERROR: GET request to graphite failed %s", err)
-		return nil, err
-	}
-
-	defer response.Body.Close()
-	contents, err = ioutil.ReadAll(response.Body)
-	if err != nil {
-		log.Printf("ERROR: reading GET body failed %s", err)
-		return nil, err
-	}
-	return contents, nil
-}
-
 func (s *httpServer) getProducers(topicName string) []string {
 	var producers []string
 	if len(s.context.nsqadmin.options.NSQLookupdHTTPAddresses) != 0 {
@@ -945,3 +804,16 @@ func (s *httpServer) getProducers(topicName string) []string {
 	}
 	return producers
 }
+
+// nsqdAddresses returns the HTTP addresses of every nsqd in the cluster
+func (s *httpServer) nsqdAddresses() []string {
+	if len(s.context.nsqadmin.options.NSQLookupdHTTPAddresses) == 0 {
+		return s.context.nsqadmin.options.NSQDHTTPAddresses
+	}
+	producers, _ := lookupd.GetLookupdProducers(s.context.nsqadmin.options.NSQLookupdHTTPAddresses)
+	addresses := make([]string, len(producers))
+	for i, p := range producers {
+		addresses[i] = p.HTTPAddress()
+	}
+	return addresses
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/nsqadmin/templates"
+	"github.com/bitly/nsq/util"
+)
+
+// injecting publishes test messages to a topic (through one of its nsqd's
+// /put) to smoke test a pipeline... nsqd has no deferred publishes, so the
+// delay is nsqadmin waiting before each publish
+const (
+	maxInjectCount    = 1000
+	maxInjectDuration = time.Minute
+	maxInjectBodySize = 1024 * 1024
+)
+
+// injectRequest is a validated inject, from the form or the JSON API
+type injectRequest struct {
+	Topic string
+	Node  string
+	Body  []byte
+	Delay time.Duration
+	Count int
+}
+
+// injectResult reports how an inject went, publishing stops at the first
+// error
+type injectResult struct {
+	Node      string `json:"node"`
+	Published int    `json:"published"`
+	Count     int    `json:"count"`
+	Error     string `json:"error,omitempty"`
+	Duration  int64  `json:"duration"`
+}
+
+func newInjectRequest(topicName string, node string, body string, delay string, count string) (*injectRequest, error) {
+	r := &injectRequest{
+		Topic: topicName,
+		Node:  node,
+		Body:  []byte(body),
+		Count: 1,
+	}
+	if !nsq.IsValidTopicName(r.Topic) {
+		return nil, errors.New("INVALID_TOPIC")
+	}
+	if len(r.Body) == 0 || len(r.Body) > maxInjectBodySize {
+		return nil, errors.New("INVALID_BODY")
+	}
+	if delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return nil, errors.New("INVALID_DELAY")
+		}
+		r.Delay = d
+	}
+	if count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 || n > maxInjectCount {
+			return nil, errors.New("INVALID_COUNT")
+		}
+		r.Count = n
+	}
+	if time.Duration(r.Count)*r.Delay > maxInjectDuration {
+		return nil, errors.New("INVALID_DELAY")
+	}
+	return r, nil
+}
+
+// inject publishes r.Count messages to r.Node (or one of the topic's
+// producers, or any nsqd when it has none)
+func (s *httpServer) inject(r *injectRequest) *injectResult {
+	start := time.Now()
+	result := &injectResult{Node: r.Node, Count: r.Count}
+	defer func() {
+		result.Duration = int64(time.Since(start) / time.Millisecond)
+	}()
+
+	if result.Node == "" {
+		nodes := s.getProducers(r.Topic)
+		if len(nodes) == 0 {
+			nodes = s.nsqdAddresses()
+		}
+		if len(nodes) == 0 {
+			result.Error = "no nsqd to publish to"
+			return result
+		}
+		result.Node = nodes[0]
+	} else if !s.isKnownNode(result.Node) {
+		result.Error = "unknown node " + result.Node
+		return result
+	}
+
+	endpoint := fmt.Sprintf("http://%s/put?topic=%s", result.Node, url.QueryEscape(r.Topic))
+	httpclient := &http.Client{Transport: util.NewDeadlineTransport(2 * time.Second)}
+	for i := 0; i < r.Count; i++ {
+		if r.Delay > 0 {
+			time.Sleep(r.Delay)
+		}
+		resp, err := httpclient.Post(endpoint, "application/octet-stream", bytes.NewReader(r.Body))
+		if err != nil {
+			result.Error = err.Error()
+			break
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			result.Error = fmt.Sprintf("%d %s", resp.StatusCode, strings.TrimSpace(string(body)))
+			break
+		}
+		result.Published++
+	}
+
+	if result.Error != "" {
+		log.Printf("ERROR: inject to %s (%s) - %s", r.Topic, result.Node, result.Error)
+	} else {
+		log.Printf("INJECT: published %d messages to %s (%s)", result.Published, r.Topic, result.Node)
+	}
+	return result
+}
+
+// injectNode is an option of the form's node select
+type injectNode struct {
+	Address  string
+	Selected bool
+}
+
+func (s *httpServer) injectHandler(w http.ResponseWriter, req *http.Request) {
+	// the form is prefilled from the query string (ie. ?topic= from the topic page)
+	reqParams := &util.PostParams{req}
+	topicName, _ := reqParams.Get("topic")
+	node, _ := reqParams.Get("node")
+	body, _ := reqParams.Get("body")
+	delay, _ := reqParams.Get("delay")
+	count, _ := reqParams.Get("count")
+
+	var result *injectResult
+	var requestErr string
+	if req.Method == "POST" {
+		r, err := newInjectRequest(topicName, node, body, delay, count)
+		if err != nil {
+			requestErr = err.Error()
+		} else {
+			result = s.inject(r)
+			s.notifyAdminAction("inject_message", topicName, "", result.Node, req)
+		}
+	}
+
+	var nodes []injectNode
+	for _, address := range s.nsqdAddresses() {
+		nodes = append(nodes, injectNode{address, address == node})
+	}
+
+	p := struct {
+		Title        string
+		GraphOptions *GraphOptions
+		Topic        string
+		Nodes        []injectNode
+		Body         string
+		Delay        string
+		Count        string
+		RequestError string
+		Result       *injectResult
+		Version      string
+	}{
+		Title:        "NSQ Inject Message",
+		GraphOptions: NewGraphOptions(w, req, &util.ReqParams{Values: req.URL.Query()}, s.context),
+		Topic:        topicName,
+		Nodes:        nodes,
+		Body:         body,
+		Delay:        delay,
+		Count:        count,
+		RequestError: requestErr,
+		Result:       result,
+		Version:      util.BINARY_VERSION,
+	}
+	err := templates.T.ExecuteTemplate(w, "inject.html", p)
+	if err != nil {
+		log.Printf("Template Error %s", err.Error())
+		http.Error(w, "Template Error", 500)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitly/nsq/nsqadmin/templates"
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+// the leaderboard is re-sampled at most this often, rates are the change in
+// the cluster wide counters between two consecutive samples
+const leaderboardInterval = 5 * time.Second
+
+// leaderboardEntry is a topic (Channel is empty) or channel aggregated across
+// every nsqd it's on, rates are per second
+type leaderboardEntry struct {
+	Topic        string  `json:"topic"`
+	Channel      string  `json:"channel,omitempty"`
+	PublishRate  float64 `json:"publish_rate"`
+	DepthRate    float64 `json:"depth_rate"`
+	RequeueRate  float64 `json:"requeue_rate"`
+	Depth        int64   `json:"depth"`
+	MessageCount int64   `json:"message_count"`
+	RequeueCount int64   `json:"requeue_count"`
+	ClientCount  int     `json:"client_count"`
+	Nodes        int     `json:"nodes"`
+}
+
+func (e *leaderboardEntry) key() string {
+	if e.Channel == "" {
+		return e.Topic
+	}
+	return e.Topic + ":" + e.Channel
+}
+
+// Growing returns whether the entry's depth grew since the previous sample
+func (e *leaderboardEntry) Growing() bool {
+	return e.DepthRate > 0
+}
+
+// leaderboardColumn is a column the leaderboard can be sorted by (descending)
+type leaderboardColumn struct {
+	Name   string
+	Title  string
+	Sorted bool
+	value  func(e *leaderboardEntry) float64
+}
+
+// in the order they're displayed
+var leaderboardColumns = []leaderboardColumn{
+	{Name: "publish_rate", Title: "Publish Rate", value: func(e *leaderboardEntry) float64 { return e.PublishRate }},
+	{Name: "depth_rate", Title: "Depth Growth", value: func(e *leaderboardEntry) float64 { return e.DepthRate }},
+	{Name: "requeue_rate", Title: "Requeue Rate", value: func(e *leaderboardEntry) float64 { return e.RequeueRate }},
+	{Name: "depth", Title: "Depth", value: func(e *leaderboardEntry) float64 { return float64(e.Depth) }},
+	{Name: "client_count", Title: "Clients", value: func(e *leaderboardEntry) float64 { return float64(e.ClientCount) }},
+}
+
+// getLeaderboardColumn returns the named column (publish_rate if unknown)
+func getLeaderboardColumn(name string) leaderboardColumn {
+	for _, c := range leaderboardColumns {
+		if c.Name == name {
+			return c
+		}
+	}
+	return leaderboardColumns[0]
+}
+
+type leaderboardEntries []*leaderboardEntry
+
+func (l leaderboardEntries) Len() int      { return len(l) }
+func (l leaderboardEntries) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+type leaderboardEntriesBy struct {
+	leaderboardEntries
+	column func(e *leaderboardEntry) float64
+}
+
+func (l leaderboardEntriesBy) Less(i, j int) bool {
+	a, b := l.column(l.leaderboardEntries[i]), l.column(l.leaderboardEntries[j])
+	if a == b {
+		return l.leaderboardEntries[i].key() < l.leaderboardEntries[j].key()
+	}
+	return a > b
+}
+
+type leaderboard struct {
+	sync.Mutex
+	sampledAt time.Time
+	interval  time.Duration
+	entries   map[string]*leaderboardEntry
+}
+
+// sample returns the topics (or channels) sorted by column and the interval
+// their rates were computed over (zero until there have been two samples)
+func (l *leaderboard) sample(addresses []string, channels bool, column string) ([]*leaderboardEntry, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.sampledAt) >= leaderboardInterval {
+		entries := newLeaderboardEntries(addresses)
+		if l.entries != nil {
+			l.interval = now.Sub(l.sampledAt)
+			for key, e := range entries {
+				if prev, ok := l.entries[key]; ok {
+					e.setRates(prev, l.interval)
+				}
+			}
+		}
+		l.sampledAt = now
+		l.entries = entries
+	}
+
+	sorted := make([]*leaderboardEntry, 0, len(l.entries))
+	for _, e := range l.entries {
+		if (e.Channel != "") == channels {
+			sorted = append(sorted, e)
+		}
+	}
+	sort.Sort(leaderboardEntriesBy{sorted, getLeaderboardColumn(column).value})
+	return sorted, l.interval
+}
+
+func newLeaderboardEntries(addresses []string) map[string]*leaderboardEntry {
+	topicStats, channelStats, _ := lookupd.GetNSQDStats(addresses, "")
+
+	entries := make(map[string]*leaderboardEntry)
+	for _, t := range topicStats {
+		e, ok := entries[t.TopicName]
+		if !ok {
+			e = &leaderboardEntry{Topic: t.TopicName}
+			entries[t.TopicName] = e
+		}
+		e.Depth += t.Depth
+		e.MessageCount += t.MessageCount
+		e.Nodes++
+	}
+	for _, c := range channelStats {
+		e := &leaderboardEntry{
+			Topic:        c.TopicName,
+			Channel:      c.ChannelName,
+			Depth:        c.Depth,
+			MessageCount: c.MessageCount,
+			RequeueCount: c.RequeueCount,
+			ClientCount:  c.ClientCount,
+			Nodes:        len(c.HostStats),
+		}
+		entries[e.key()] = e
+
+		// a topic's requeues and clients are those of its channels
+		if t, ok := entries[c.TopicName]; ok {
+			t.RequeueCount += c.RequeueCount
+			t.ClientCount += c.ClientCount
+		}
+	}
+	return entries
+}
+
+// setRates computes e's rates since prev, counters that went backwards (an
+// nsqd restarted or left the cluster) count as no change
+func (e *leaderboardEntry) setRates(prev *leaderboardEntry, interval time.Duration) {
+	seconds := interval.Seconds()
+	if e.MessageCount >= prev.MessageCount {
+		e.PublishRate = float64(e.MessageCount-prev.MessageCount) / seconds
+	}
+	if e.RequeueCount >= prev.RequeueCount {
+		e.RequeueRate = float64(e.RequeueCount-prev.RequeueCount) / seconds
+	}
+	e.DepthRate = float64(e.Depth-prev.Depth) / seconds
+}
+
+// leaderboardParams returns the view (topics or channels) and sort column of
+// a leaderboard request
+func leaderboardParams(reqParams *util.ReqParams) (string, string) {
+	view, _ := reqParams.Get("view")
+	if view != "channels" {
+		view = "topics"
+	}
+	column, _ := reqParams.Get("sort")
+	return view, getLeaderboardColumn(column).Name
+}
+
+func (s *httpServer) leaderboardHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		http.Error(w, "INVALID_REQUEST", 500)
+		return
+	}
+
+	view, column := leaderboardParams(reqParams)
+	entries, interval := s.leaderboard.sample(s.nsqdAddresses(), view == "channels", column)
+
+	format, _ := reqParams.Get("format")
+	if format == "csv" {
+		writeLeaderboardCSV(w, view, entries)
+		return
+	}
+
+	columns := make([]leaderboardColumn, len(leaderboardColumns))
+	for i, c := range leaderboardColumns {
+		c.Sorted = c.Name == column
+		columns[i] = c
+	}
+
+	p := struct {
+		Title        string
+		Version      string
+		GraphOptions *GraphOptions
+		View         string
+		Channels     bool
+		Sort         string
+		Columns      []leaderboardColumn
+		Interval     time.Duration
+		Entries      []*leaderboardEntry
+	}{
+		Title:        "NSQ Leaderboard",
+		Version:      util.BINARY_VERSION,
+		GraphOptions: NewGraphOptions(w, req, reqParams, s.context),
+		View:         view,
+		Channels:     view == "channels",
+		Sort:         column,
+		Columns:      columns,
+		Interval:     interval,
+		Entries:      entries,
+	}
+	err = templates.T.ExecuteTemplate(w, "leaderboard.html", p)
+	if err != nil {
+		log.Printf("Template Error %s", err.Error())
+		http.Error(w, "Template Error", 500)
+	}
+}
+
+func (s *httpServer) apiLeaderboardHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		util.ApiResponse(w, 405, "METHOD_NOT_ALLOWED", nil)
+		return
+	}
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		util.ApiResponse(w, 400, "INVALID_REQUEST", nil)
+		return
+	}
+
+	view, column := leaderboardParams(reqParams)
+	entries, interval := s.leaderboard.sample(s.nsqdAddresses(), view == "channels", column)
+	util.ApiResponse(w, 200, "OK", struct {
+		View     string              `json:"view"`
+		Sort     string              `json:"sort"`
+		Interval float64             `json:"interval"`
+		Entries  []*leaderboardEntry `json:"entries"`
+	}{view, column, interval.Seconds(), entries})
+}
+
+func writeLeaderboardCSV(w http.ResponseWriter, view string, entries []*leaderboardEntry) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=nsq_leaderboard_%s.csv", view))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"topic", "channel", "publish_rate", "depth_rate", "requeue_rate",
+		"depth", "message_count", "requeue_count", "client_count", "nodes"})
+	for _, e := range entries {
+		cw.Write([]string{
+			e.Topic,
+			e.Channel,
+			strconv.FormatFloat(e.PublishRate, 'f', 2, 64),
+			strconv.FormatFloat(e.DepthRate, 'f', 2, 64),
+			strconv.FormatFloat(e.RequeueRate, 'f', 2, 64),
+			strconv.FormatInt(e.Depth, 10),
+			strconv.FormatInt(e.MessageCount, 10),
+			strconv.FormatInt(e.RequeueCount, 10),
+			strconv.Itoa(e.ClientCount),
+			strconv.Itoa(e.Nodes),
+		})
+	}
+	cw.Flush()
+}
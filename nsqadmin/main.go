@@ -26,19 +26,33 @@ var (
 	graphiteURL   = flagSet.String("graphite-url", "", "graphite HTTP address")
 	proxyGraphite = flagSet.Bool("proxy-graphite", false, "proxy HTTP requests to graphite")
 
+	graphiteTLSRootCAFile         = flagSet.String("graphite-tls-root-ca-file", "", "path to certificate authority file used to verify graphite's HTTPS certificate")
+	graphiteTLSInsecureSkipVerify = flagSet.Bool("graphite-tls-insecure-skip-verify", false, "skip verification of graphite's HTTPS certificate")
+
 	useStatsdPrefixes = flagSet.Bool("use-statsd-prefixes", true, "expect statsd prefixed keys in graphite (ie: 'stats_counts.')")
 	statsdPrefix      = flagSet.String("statsd-prefix", "nsq.%s", "prefix used for keys sent to statsd (%s for host replacement, must match nsqd)")
 	statsdInterval    = flagSet.Duration("statsd-interval", 60*time.Second, "time interval nsqd is configured to push to statsd (must match nsqd)")
 
 	notificationHTTPEndpoint = flagSet.String("notification-http-endpoint", "", "HTTP endpoint (fully qualified) to which POST notifications of admin actions will be sent")
 
+	apiAuthToken = flagSet.String("api-auth-token", "", "require this token (as 'Authorization: Bearer <token>') for requests to the /api/ endpoints")
+
 	nsqlookupdHTTPAddresses = util.StringArray{}
 	nsqdHTTPAddresses       = util.StringArray{}
+
+	graphiteHeaders         = util.StringArray{}
+	graphiteAggregations    = util.StringArray{}
+	graphiteRetentions      = util.StringArray{}
+	graphiteTargetTemplates = util.StringArray{}
 )
 
 func init() {
 	flagSet.Var(&nsqlookupdHTTPAddresses, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 	flagSet.Var(&nsqdHTTPAddresses, "nsqd-http-address", "nsqd HTTP address (may be given multiple times)")
+	flagSet.Var(&graphiteHeaders, "graphite-header", "header to send with requests to graphite as '<name>: <value>', requires --proxy-graphite (may be given multiple times)")
+	flagSet.Var(&graphiteAggregations, "graphite-aggregation", "summarize function for a metric as '<metric>=<func>' (ie. 'depth=max', default 'avg') (may be given multiple times)")
+	flagSet.Var(&graphiteRetentions, "graphite-retention", "summarize interval for a metric as '<metric>=<duration>' (ie. 'message_count=5m', default --statsd-interval) (may be given multiple times)")
+	flagSet.Var(&graphiteTargetTemplates, "graphite-target-template", "text/template for a metric's graphite target as '<metric>=<template>' with .Prefix .Key .Host .Topic .Channel .Target (may be given multiple times)")
 }
 
 func main() {
@@ -17,6 +17,7 @@ type NSQAdmin struct {
 	httpListener  net.Listener
 	waitGroup     util.WaitGroupWrapper
 	notifications chan *AdminAction
+	graphite      *graphiteConfig
 }
 
 func NewNSQAdmin(options *nsqadminOptions) *NSQAdmin {
@@ -33,10 +34,20 @@ func NewNSQAdmin(options *nsqadminOptions) *NSQAdmin {
 		log.Fatal(err)
 	}
 
+	if options.APIAuthToken == "" {
+		log.Printf("WARNING: --api-auth-token is not set, anyone who can reach nsqadmin can use /api/ to create, empty and delete topics and channels")
+	}
+
+	graphite, err := newGraphiteConfig(options)
+	if err != nil {
+		log.Fatalf("FATAL: failed to configure graphite - %s", err.Error())
+	}
+
 	return &NSQAdmin{
 		options:       options,
 		httpAddr:      httpAddr,
 		notifications: make(chan *AdminAction),
+		graphite:      graphite,
 	}
 }
 
@@ -10,6 +10,13 @@ type nsqadminOptions struct {
 	GraphiteURL   string `flag:"graphite-url"`
 	ProxyGraphite bool   `flag:"proxy-graphite"`
 
+	GraphiteHeaders               []string `flag:"graphite-header" cfg:"graphite_headers"`
+	GraphiteTLSRootCAFile         string   `flag:"graphite-tls-root-ca-file"`
+	GraphiteTLSInsecureSkipVerify bool     `flag:"graphite-tls-insecure-skip-verify"`
+	GraphiteAggregations          []string `flag:"graphite-aggregation" cfg:"graphite_aggregations"`
+	GraphiteRetentions            []string `flag:"graphite-retention" cfg:"graphite_retentions"`
+	GraphiteTargetTemplates       []string `flag:"graphite-target-template" cfg:"graphite_target_templates"`
+
 	UseStatsdPrefixes bool          `flag:"use-statsd-prefixes"`
 	StatsdPrefix      string        `flag:"statsd-prefix"`
 	StatsdInterval    time.Duration `flag:"statsd-interval"`
@@ -18,6 +25,8 @@ type nsqadminOptions struct {
 	NSQDHTTPAddresses       []string `flag:"nsqd-http-address" cfg:"nsqd_http_addresses"`
 
 	NotificationHTTPEndpoint string `flag:"notification-http-endpoint"`
+
+	APIAuthToken string `flag:"api-auth-token"`
 }
 
 func NewNSQAdminOptions() *nsqadminOptions {
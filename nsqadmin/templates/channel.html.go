@@ -17,6 +17,11 @@ func init() {
         <blockquote>
             <p>Topic: <strong>{{.Topic}}</strong>
             <p>Channel: <strong>{{.Channel}}</strong>
+            {{if .ChannelStats}}
+            {{range $k, $v := .ChannelStats.Annotations}}
+            <p>{{$k}}: <strong>{{$v}}</strong>
+            {{end}}
+            {{end}}
         </blockquote>
     </div>
 </div>
@@ -76,6 +76,8 @@ $(document).ready(function () {
           <li><a href="/">Streams</a></li>
           <li><a href="/nodes">Nodes</a></li>
           <li><a href="/counter">Counter</a></li>
+          <li><a href="/leaderboard">Leaderboard</a></li>
+          <li><a href="/topology">Topology</a></li>
           <li><a href="/lookup">Lookup</a></li>
           <li class="divider-vertical"></li>
           {{template "graph_options.html" .}}
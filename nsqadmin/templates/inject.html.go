@@ -0,0 +1,65 @@
+package templates
+
+func init() {
+	registerTemplate("inject.html", `
+{{template "header.html" .}}
+
+<ul class="breadcrumb">
+  <li><a href="/">Streams</a> <span class="divider">/</span></li>
+  {{if .Topic}}<li><a href="/topic/{{.Topic}}">{{.Topic}}</a> <span class="divider">/</span></li>{{end}}
+  <li class="active">Inject Message</li>
+</ul>
+
+{{if .RequestError}}
+<div class="alert alert-error">
+    <h4>Error</h4> {{.RequestError}}
+</div>
+{{end}}
+
+{{with .Result}}
+{{if .Error}}
+<div class="alert alert-error">
+    <h4>Publish failed</h4> published {{.Published}} of {{.Count}} to <a href="/node/{{.Node}}">{{.Node}}</a> - {{.Error}}
+</div>
+{{else}}
+<div class="alert alert-success">
+    <h4>Published</h4> {{.Published}} of {{.Count}} to <a href="/node/{{.Node}}">{{.Node}}</a> in {{.Duration}}ms
+</div>
+{{end}}
+{{end}}
+
+<div class="row-fluid">
+    <div class="span6">
+        <form class="form" action="/inject" method="POST">
+            <fieldset>
+                <legend>Inject Message</legend>
+                <div class="alert alert-info">
+                    <p>Publishes a test message to a topic, to smoke test a pipeline.
+                    <p>If <em>Node</em> is empty one of the topic's producers is published to.
+                    The <em>Delay</em> (ie. <code>500ms</code>) is waited before each publish.
+                </div>
+                <label>Topic</label>
+                <input type="text" name="topic" placeholder="Topic Name" value="{{.Topic}}">
+                <label>Node</label>
+                <select name="node">
+                    <option value="">any producer</option>
+                    {{range .Nodes}}
+                    <option value="{{.Address}}" {{if .Selected}}selected{{end}}>{{.Address}}</option>
+                    {{end}}
+                </select>
+                <label>Body</label>
+                <textarea name="body" rows="6" class="input-xxlarge">{{.Body}}</textarea>
+                <label>Delay</label>
+                <input type="text" name="delay" placeholder="0s" value="{{.Delay}}">
+                <label>Count</label>
+                <input type="text" name="count" placeholder="1" value="{{.Count}}"><br/>
+                <button class="btn btn-info" type="submit">Publish</button>
+            </fieldset>
+        </form>
+    </div>
+</div>
+
+{{template "js.html" .}}
+{{template "footer.html" .}}
+`)
+}
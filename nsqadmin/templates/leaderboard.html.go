@@ -0,0 +1,56 @@
+package templates
+
+func init() {
+	registerTemplate("leaderboard.html", `
+{{template "header.html" .}}
+{{$view := .View}}
+{{$sort := .Sort}}
+{{$channels := .Channels}}
+
+<div class="row-fluid"><div class="span12">
+<ul class="nav nav-tabs">
+    <li {{if not $channels}}class="active"{{end}}><a href="/leaderboard?view=topics&sort={{$sort}}">Topics</a></li>
+    <li {{if $channels}}class="active"{{end}}><a href="/leaderboard?view=channels&sort={{$sort}}">Channels</a></li>
+    <li class="pull-right"><a href="/leaderboard?view={{$view}}&sort={{$sort}}&format=csv">Export CSV</a></li>
+</ul>
+</div></div>
+
+<div class="row-fluid"><div class="span12">
+{{if .Interval}}
+<p>rates (per second) across every node over the last {{.Interval}}, reload to refresh</p>
+{{else}}
+<div class="alert"><strong>Sampling</strong> - rates are available once there are two samples, reload in a few seconds</div>
+{{end}}
+</div></div>
+
+<div class="row-fluid"><div class="span12">
+<table class="table table-bordered table-condensed">
+    <tr>
+        <th>Topic</th>
+        {{if $channels}}<th>Channel</th>{{end}}
+        {{range .Columns}}
+        <th>{{if .Sorted}}&#9660; {{end}}<a href="/leaderboard?view={{$view}}&sort={{.Name}}">{{.Title}}</a></th>
+        {{end}}
+        <th>Nodes</th>
+    </tr>
+    {{range .Entries}}
+    <tr>
+        <td><a href="/topic/{{.Topic}}">{{.Topic}}</a></td>
+        {{if $channels}}<td><a href="/topic/{{.Topic}}/{{.Channel}}">{{.Channel}}</a></td>{{end}}
+        <td>{{printf "%.1f" .PublishRate}}</td>
+        <td {{if .Growing}}class="red"{{end}}>{{printf "%+.1f" .DepthRate}}</td>
+        <td>{{printf "%.1f" .RequeueRate}}</td>
+        <td>{{.Depth | commafy}}</td>
+        <td>{{.ClientCount}}</td>
+        <td>{{.Nodes}}</td>
+    </tr>
+    {{else}}
+    <tr><td colspan="8"><i>no {{$view}}</i></td></tr>
+    {{end}}
+</table>
+</div></div>
+
+{{template "js.html" .}}
+{{template "footer.html" .}}
+`)
+}
@@ -20,6 +20,10 @@ func init() {
         {{if $ld}}
         <th>Lookupd Conns.</th>
         {{end}}
+        <th>RSS</th>
+        <th>GC Pause</th>
+        <th>FDs</th>
+        <th>Disk</th>
         <th>Topics</th>
     </tr>
     {{range $p := .Producers }}
@@ -37,6 +41,14 @@ func init() {
             </div>
         </td>
         {{end}}
+        {{with .Resources}}
+        <td>{{.RSSBytes | humanBytes}}</td>
+        <td class="{{.GCPauseClass}}" title="{{.NumGC | commafy}} GCs, {{.GCPauseTotalNs | nanoInt64ToHuman}} total">{{.GCPauseLastNs | nanoInt64ToHuman}}</td>
+        <td class="{{.FDsClass}}">{{.OpenFDs | commafy}}{{if .MaxFDs}} / {{.MaxFDs | commafy}}{{end}}</td>
+        <td class="{{.DiskClass}}" title="{{.DataPath}}">{{if .DiskTotalBytes}}{{.DiskUsedBytes | humanBytes}} / {{.DiskTotalBytes | humanBytes}}{{end}}</td>
+        {{else}}
+        <td colspan="4"><span class="muted">unavailable</span></td>
+        {{end}}
         <td>
         {{if .Topics}}
             <span class="badge">{{.Topics | len}}</span>
@@ -16,6 +16,9 @@ func init() {
     <div class="span6">
         <blockquote>
             <p>Topic: <strong>{{.Topic}}</strong>
+            {{range $k, $v := .GlobalTopicStats.Annotations}}
+            <p>{{$k}}: <strong>{{$v}}</strong>
+            {{end}}
         </blockquote>
     </div>
 </div>
@@ -46,6 +49,9 @@ func init() {
         </form>
         {{end}}
     </div>
+    <div class="span2">
+        <a class="btn btn-medium btn-info" href="/inject?topic={{.Topic}}">Inject Message</a>
+    </div>
 </div>
 
 
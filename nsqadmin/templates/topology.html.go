@@ -0,0 +1,51 @@
+package templates
+
+func init() {
+	registerTemplate("topology.html", `
+{{template "header.html" .}}
+
+<div class="row-fluid"><div class="span12">
+<form class="form-inline" method="GET" action="/topology">
+    <input type="text" name="topic" placeholder="topic" value="{{.Topic}}">
+    <button type="submit" class="btn">Show Pipeline</button>
+    {{if .Topic}}<a href="/topology" class="btn">Show All</a>{{end}}
+</form>
+<p>topics feed their channels, channels feed their consumers (by user agent) and relays
+(<code>nsq_to_nsq</code> and <code>nsq_to_http</code>, by host), <code>nsq_to_nsq</code> feeds the
+topics it publishes to, reload to refresh</p>
+</div></div>
+
+<div class="row-fluid"><div class="span12">
+{{with .Topology}}
+{{$width := .NodeWidth}}
+{{$height := .NodeHeight}}
+{{if .Nodes}}
+<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}">
+    <defs>
+        <marker id="arrow" markerWidth="10" markerHeight="10" refX="9" refY="3" orient="auto">
+            <path d="M0,0 L0,6 L9,3 z" fill="#999"></path>
+        </marker>
+    </defs>
+    {{range .Edges}}
+    <line x1="{{.X1}}" y1="{{.Y1}}" x2="{{.X2}}" y2="{{.Y2}}" stroke="#999" marker-end="url(#arrow)"></line>
+    {{end}}
+    {{range .Nodes}}
+    <g>
+        <title>{{.Kind}} {{.Name}}{{if .Clients}} ({{.Clients}} clients){{end}}</title>
+        <rect x="{{.X}}" y="{{.Y}}" width="{{$width}}" height="{{$height}}" rx="4" ry="4" stroke="#666" fill="{{.Fill}}"></rect>
+        {{if .URL}}<a href="{{.URL}}">{{end}}
+        <text x="{{.X}}" y="{{.Y}}" dx="8" dy="19" font-size="12">{{.Name}}{{if .Depth}} ({{.Depth | commafy}}){{end}}</text>
+        {{if .URL}}</a>{{end}}
+    </g>
+    {{end}}
+</svg>
+{{else}}
+<div class="alert"><strong>Notice</strong> - no topics</div>
+{{end}}
+{{end}}
+</div></div>
+
+{{template "js.html" .}}
+{{template "footer.html" .}}
+`)
+}
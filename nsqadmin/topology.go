@@ -0,0 +1,339 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/bitly/nsq/nsqadmin/templates"
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+// the topology is the flow of messages across the cluster as a DAG: topics
+// feed their channels, channels feed their consumers (grouped by the app
+// named in their user agent, ie. "my_worker/1.2 go-nsq/0.3.7") and relays...
+// a relay is an nsq_to_nsq or nsq_to_http consumer (by host), and nsq_to_nsq
+// in turn feeds the topics that have a TCP producer on the same host
+
+// the apps (by user agent) that republish what they consume
+var relayApps = map[string]bool{
+	"nsq_to_nsq":  true,
+	"nsq_to_http": true,
+}
+
+// the layout of the SVG, in pixels
+const (
+	topologyColumnWidth = 240
+	topologyRowHeight   = 50
+	topologyNodeWidth   = 180
+	topologyNodeHeight  = 30
+	topologyMargin      = 10
+)
+
+type topologyNode struct {
+	ID      string `json:"id"`
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Topic   string `json:"topic,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Depth   int64  `json:"depth"`
+	Clients int    `json:"clients,omitempty"`
+	Rank    int    `json:"rank"`
+
+	// position in the SVG
+	X int `json:"-"`
+	Y int `json:"-"`
+}
+
+// Fill is the color of the node in the SVG
+func (n *topologyNode) Fill() string {
+	switch n.Kind {
+	case "topic":
+		return "#d9edf7"
+	case "channel":
+		return "#dff0d8"
+	case "relay":
+		return "#fcf8e3"
+	}
+	return "#f5f5f5"
+}
+
+// URL links a topic or channel to its page
+func (n *topologyNode) URL() string {
+	switch n.Kind {
+	case "topic":
+		return "/topic/" + n.Topic
+	case "channel":
+		return "/topic/" + n.Topic + "/" + n.Channel
+	}
+	return ""
+}
+
+type topologyEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// endpoints in the SVG
+	X1 int `json:"-"`
+	Y1 int `json:"-"`
+	X2 int `json:"-"`
+	Y2 int `json:"-"`
+}
+
+type topology struct {
+	Nodes []*topologyNode `json:"nodes"`
+	Edges []*topologyEdge `json:"edges"`
+
+	// dimensions of the SVG and of its nodes
+	Width      int `json:"-"`
+	Height     int `json:"-"`
+	NodeWidth  int `json:"-"`
+	NodeHeight int `json:"-"`
+
+	nodes map[string]*topologyNode
+	edges map[string]bool
+}
+
+func (t *topology) addNode(n *topologyNode) *topologyNode {
+	if existing, ok := t.nodes[n.ID]; ok {
+		return existing
+	}
+	t.nodes[n.ID] = n
+	t.Nodes = append(t.Nodes, n)
+	return n
+}
+
+func (t *topology) addEdge(from string, to string) {
+	key := from + "\x00" + to
+	if t.edges[key] {
+		return
+	}
+	t.edges[key] = true
+	t.Edges = append(t.Edges, &topologyEdge{From: from, To: to})
+}
+
+// userAgentApp returns the app a user agent names first (ie. "nsq_to_nsq"
+// for "nsq_to_nsq/0.2.29 go-nsq/0.3.7")
+func userAgentApp(userAgent string) string {
+	fields := strings.Fields(userAgent)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.SplitN(fields[0], "/", 2)[0]
+}
+
+func addressHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// newTopology stitches the cluster's topology together from the stats of
+// every nsqd, optionally only what's upstream or downstream of topicName
+func newTopology(topicStats []*lookupd.TopicStats, channelStats map[string]*lookupd.ChannelStats, topicName string) *topology {
+	t := &topology{
+		NodeWidth:  topologyNodeWidth,
+		NodeHeight: topologyNodeHeight,
+
+		nodes: make(map[string]*topologyNode),
+		edges: make(map[string]bool),
+	}
+
+	for _, ts := range topicStats {
+		n := t.addNode(&topologyNode{ID: "topic:" + ts.TopicName, Kind: "topic", Name: ts.TopicName, Topic: ts.TopicName})
+		n.Depth += ts.Depth
+	}
+
+	// the nsq_to_nsq relays on each host
+	relayHosts := make(map[string][]string)
+	for _, cs := range channelStats {
+		channelID := "channel:" + cs.TopicName + ":" + cs.ChannelName
+		t.addNode(&topologyNode{ID: channelID, Kind: "channel", Name: cs.ChannelName,
+			Topic: cs.TopicName, Channel: cs.ChannelName, Depth: cs.Depth})
+		t.addEdge("topic:"+cs.TopicName, channelID)
+
+		for _, c := range cs.Clients {
+			app := userAgentApp(c.UserAgent)
+			var n *topologyNode
+			if relayApps[app] {
+				host := addressHost(c.RemoteAddress)
+				id := "relay:" + app + "@" + host
+				if _, ok := t.nodes[id]; !ok && app == "nsq_to_nsq" {
+					relayHosts[host] = append(relayHosts[host], id)
+				}
+				n = t.addNode(&topologyNode{ID: id, Kind: "relay", Name: app + "@" + host, Host: host})
+			} else {
+				if app == "" {
+					app = "unknown"
+				}
+				n = t.addNode(&topologyNode{ID: channelID + ":" + app, Kind: "consumer", Name: app,
+					Topic: cs.TopicName, Channel: cs.ChannelName})
+			}
+			n.Clients++
+			t.addEdge(channelID, n.ID)
+		}
+	}
+
+	for _, ts := range topicStats {
+		for _, p := range ts.Producers {
+			if p.Protocol != "tcp" {
+				continue
+			}
+			for _, id := range relayHosts[addressHost(p.Address)] {
+				t.addEdge(id, "topic:"+ts.TopicName)
+			}
+		}
+	}
+
+	if topicName != "" {
+		t.filter("topic:" + topicName)
+	}
+	t.layout()
+	return t
+}
+
+// filter keeps only the nodes upstream or downstream of id
+func (t *topology) filter(id string) {
+	keep := map[string]bool{id: true}
+	for _, downstream := range []bool{true, false} {
+		queue := []string{id}
+		seen := map[string]bool{id: true}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			for _, e := range t.Edges {
+				from, to := e.From, e.To
+				if !downstream {
+					from, to = to, from
+				}
+				if from != current || seen[to] {
+					continue
+				}
+				seen[to] = true
+				keep[to] = true
+				queue = append(queue, to)
+			}
+		}
+	}
+
+	nodes := t.Nodes[:0]
+	for _, n := range t.Nodes {
+		if keep[n.ID] {
+			nodes = append(nodes, n)
+		} else {
+			delete(t.nodes, n.ID)
+		}
+	}
+	t.Nodes = nodes
+
+	edges := t.Edges[:0]
+	for _, e := range t.Edges {
+		if keep[e.From] && keep[e.To] {
+			edges = append(edges, e)
+		}
+	}
+	t.Edges = edges
+}
+
+type topologyNodes []*topologyNode
+
+func (n topologyNodes) Len() int      { return len(n) }
+func (n topologyNodes) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n topologyNodes) Less(i, j int) bool {
+	if n[i].Rank != n[j].Rank {
+		return n[i].Rank < n[j].Rank
+	}
+	return n[i].ID < n[j].ID
+}
+
+// layout ranks every node by the longest path to it (relays can form cycles,
+// so that's bounded by the number of nodes) and positions it in its rank's
+// column
+func (t *topology) layout() {
+	for i := 0; i < len(t.Nodes); i++ {
+		changed := false
+		for _, e := range t.Edges {
+			from, to := t.nodes[e.From], t.nodes[e.To]
+			if to.Rank < from.Rank+1 && from.Rank+1 < len(t.Nodes) {
+				to.Rank = from.Rank + 1
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	sort.Sort(topologyNodes(t.Nodes))
+	rows := make(map[int]int)
+	for _, n := range t.Nodes {
+		n.X = topologyMargin + n.Rank*topologyColumnWidth
+		n.Y = topologyMargin + rows[n.Rank]*topologyRowHeight
+		rows[n.Rank]++
+		if w := n.X + topologyNodeWidth + topologyMargin; w > t.Width {
+			t.Width = w
+		}
+		if h := n.Y + topologyNodeHeight + topologyMargin; h > t.Height {
+			t.Height = h
+		}
+	}
+
+	for _, e := range t.Edges {
+		from, to := t.nodes[e.From], t.nodes[e.To]
+		e.X1, e.Y1 = from.X+topologyNodeWidth, from.Y+topologyNodeHeight/2
+		e.X2, e.Y2 = to.X, to.Y+topologyNodeHeight/2
+	}
+}
+
+func (s *httpServer) topologyHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		http.Error(w, "INVALID_REQUEST", 500)
+		return
+	}
+
+	topicName, _ := reqParams.Get("topic")
+	topicStats, channelStats, _ := lookupd.GetNSQDStats(s.nsqdAddresses(), "")
+
+	p := struct {
+		Title        string
+		Version      string
+		GraphOptions *GraphOptions
+		Topic        string
+		Topology     *topology
+	}{
+		Title:        "NSQ Topology",
+		Version:      util.BINARY_VERSION,
+		GraphOptions: NewGraphOptions(w, req, reqParams, s.context),
+		Topic:        topicName,
+		Topology:     newTopology(topicStats, channelStats, topicName),
+	}
+	err = templates.T.ExecuteTemplate(w, "topology.html", p)
+	if err != nil {
+		log.Printf("Template Error %s", err.Error())
+		http.Error(w, "Template Error", 500)
+	}
+}
+
+func (s *httpServer) apiTopologyHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		util.ApiResponse(w, 405, "METHOD_NOT_ALLOWED", nil)
+		return
+	}
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		util.ApiResponse(w, 400, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, _ := reqParams.Get("topic")
+	topicStats, channelStats, _ := lookupd.GetNSQDStats(s.nsqdAddresses(), "")
+	util.ApiResponse(w, 200, "OK", newTopology(topicStats, channelStats, topicName))
+}
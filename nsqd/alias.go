@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+)
+
+// SetAlias configures alias as a fan-in topic, messages published to it are
+// transparently published to each of topicNames instead
+func (n *NSQD) SetAlias(alias string, topicNames []string) error {
+	if !nsq.IsValidTopicName(alias) {
+		return errors.New("INVALID_ALIAS")
+	}
+
+	if len(topicNames) == 0 {
+		return errors.New("MISSING_ARG_TOPIC")
+	}
+
+	n.RLock()
+	_, exists := n.topicMap[alias]
+	n.RUnlock()
+	if exists || n.Shards(alias) > 0 {
+		return errors.New("TOPIC_EXISTS")
+	}
+
+	for _, topicName := range topicNames {
+		if !nsq.IsValidTopicName(topicName) || topicName == alias {
+			return errors.New("INVALID_ARG_TOPIC")
+		}
+		if n.isAlias(topicName) || n.Shards(topicName) > 0 {
+			// aliases only fan in to concrete topics
+			return errors.New("INVALID_ARG_TOPIC")
+		}
+	}
+
+	// make sure the concrete topics exist (and are registered with lookupd)
+	for _, topicName := range topicNames {
+		n.GetTopic(topicName)
+	}
+
+	n.Lock()
+	n.aliasMap[alias] = topicNames
+	log.Printf("ALIAS(%s): fans in to %v", alias, topicNames)
+	err := n.PersistMetadata()
+	n.Unlock()
+
+	return err
+}
+
+// DeleteAlias removes an alias, the topics it fanned in to are left untouched
+func (n *NSQD) DeleteAlias(alias string) error {
+	n.Lock()
+	defer n.Unlock()
+
+	_, ok := n.aliasMap[alias]
+	if !ok {
+		return errors.New("ALIAS_NOT_FOUND")
+	}
+	delete(n.aliasMap, alias)
+	log.Printf("ALIAS(%s): deleted", alias)
+
+	return n.PersistMetadata()
+}
+
+func (n *NSQD) isAlias(name string) bool {
+	n.RLock()
+	_, ok := n.aliasMap[name]
+	n.RUnlock()
+	return ok
+}
+
+// PutMessages publishes messages to the named topic, creating it if needed,
+// or to every topic it fans in to when topicName is an alias
+func (n *NSQD) PutMessages(topicName string, msgs []*nsq.Message) error {
+	return n.putMessages(topicName, msgs, false)
+}
+
+// PutMessagesDurable is PutMessages except that it only returns once the
+// messages have been fsync'd (see Topic.PutMessagesDurable)
+func (n *NSQD) PutMessagesDurable(topicName string, msgs []*nsq.Message) error {
+	return n.putMessages(topicName, msgs, true)
+}
+
+func (n *NSQD) putMessages(topicName string, msgs []*nsq.Message, durable bool) error {
+	if n.IsReadOnly() {
+		return errReadOnly
+	}
+	if n.IsDraining() {
+		return errDraining
+	}
+
+	err := n.middleware.publish(topicName, msgs)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := n.resolveMessages(topicName, msgs)
+	if err != nil {
+		return err
+	}
+	for _, r := range resolved {
+		if durable {
+			err = r.topic.PutMessagesDurable(r.msgs)
+		} else {
+			err = r.topic.PutMessages(r.msgs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// topicMessages are messages resolved to the concrete topic they're put to
+type topicMessages struct {
+	topic *Topic
+	msgs  []*nsq.Message
+}
+
+// resolveMessages returns the concrete topics that msgs published to
+// topicName are put to, and which of them each gets: an alias fans in to
+// each of its topics, a sharded topic's messages are split between its
+// shards (see sharding.go) and a topic's large message rule diverts or
+// rejects its large messages (see large_message.go)
+//
+// every publish path (PUB, MPUB, TPUB, HTTP...) resolves its messages this
+// way, every topic is created and its schema checked before any of them are
+// put
+func (n *NSQD) resolveMessages(topicName string, msgs []*nsq.Message) ([]*topicMessages, error) {
+	n.RLock()
+	topicNames, ok := n.aliasMap[topicName]
+	n.RUnlock()
+	if !ok {
+		topicNames = []string{topicName}
+	}
+
+	var resolved []*topicMessages
+	for i, name := range topicNames {
+		topicMsgs := msgs
+		if i > 0 {
+			// every topic gets its own copy of the messages (with its own IDs)
+			// since they're tracked independently once published
+			topicMsgs = make([]*nsq.Message, len(msgs))
+			for j, msg := range msgs {
+				topicMsgs[j] = nsq.NewMessage(copyMessageKey(<-n.idChan, msg.Id), msg.Body)
+			}
+		}
+
+		shards := n.Shards(name)
+		if shards == 0 {
+			r, err := n.resolveTopicMessages(name, topicMsgs)
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, r...)
+			continue
+		}
+
+		shardMsgs := n.shardMessages(shards, topicMsgs)
+		for j, shardName := range util.ShardTopicNames(name, shards) {
+			if len(shardMsgs[j]) == 0 {
+				continue
+			}
+			r, err := n.resolveTopicMessages(shardName, shardMsgs[j])
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, r...)
+		}
+	}
+	return resolved, nil
+}
+
+// resolveTopicMessages creates the (concrete) topic and checks msgs against
+// its schema and large message rule
+func (n *NSQD) resolveTopicMessages(topicName string, msgs []*nsq.Message) ([]*topicMessages, error) {
+	topic, err := n.AutoCreateTopic(topicName)
+	if err != nil {
+		return nil, err
+	}
+	err = topic.checkSchema(msgs)
+	if err != nil {
+		return nil, err
+	}
+	return n.resolveLargeMessages(topic, msgs)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+)
+
+// a message can be annotated (ie. with why it failed) when it's REQ'd, the
+// annotations are kept with the message (until it's FIN'd) and sent along with
+// its next attempts, to clients that negotiated annotations, and listed with
+// it when it's stuck
+//
+// clients that send "annotations": true in IDENTIFY follow each REQ with a
+// (possibly empty) annotation:
+//
+//     REQ <message_id> <timeout>\n
+//     [ 4-byte size in bytes ][ N-byte annotation ]
+//
+// and are sent a frameTypeMessageAnnotations frame (the 16-byte message ID
+// then its annotations as JSON) before a message that has annotations
+
+const frameTypeMessageAnnotations int32 = 9
+
+// the biggest annotation, the most kept per message (the latest ones) and the
+// most messages a channel keeps annotations for
+const (
+	maxAnnotationSize        = 256
+	maxAnnotationsPerMessage = 5
+	maxAnnotatedMessages     = 10000
+)
+
+// MessageAnnotation is an annotation of a message, by the client that REQ'd
+// its attempt
+type MessageAnnotation struct {
+	Attempt    uint16 `json:"attempt"`
+	ClientName string `json:"client_name"`
+	Timestamp  int64  `json:"timestamp"`
+	Annotation string `json:"annotation"`
+}
+
+// messageAnnotations are the annotations of a channel's messages
+type messageAnnotations struct {
+	sync.Mutex
+	messages map[nsq.MessageID][]MessageAnnotation
+}
+
+// add annotates an attempt of msg (it's dropped when the channel already
+// keeps the most annotated messages)
+func (a *messageAnnotations) add(msg *nsq.Message, clientName string, annotation string) {
+	a.Lock()
+	defer a.Unlock()
+
+	annotations, ok := a.messages[msg.Id]
+	if !ok {
+		if a.messages == nil {
+			a.messages = make(map[nsq.MessageID][]MessageAnnotation)
+		}
+		if len(a.messages) >= maxAnnotatedMessages {
+			return
+		}
+	}
+	annotations = append(annotations, MessageAnnotation{
+		Attempt:    msg.Attempts,
+		ClientName: clientName,
+		Timestamp:  time.Now().Unix(),
+		Annotation: annotation,
+	})
+	if len(annotations) > maxAnnotationsPerMessage {
+		annotations = annotations[len(annotations)-maxAnnotationsPerMessage:]
+	}
+	a.messages[msg.Id] = annotations
+}
+
+// get returns the annotations of id (oldest first), which mustn't be modified
+func (a *messageAnnotations) get(id nsq.MessageID) []MessageAnnotation {
+	a.Lock()
+	defer a.Unlock()
+	return a.messages[id]
+}
+
+// remove forgets the annotations of id (it was finished or otherwise won't be
+// delivered again)
+func (a *messageAnnotations) remove(id nsq.MessageID) {
+	a.Lock()
+	delete(a.messages, id)
+	a.Unlock()
+}
+
+func (a *messageAnnotations) reset() {
+	a.Lock()
+	a.messages = nil
+	a.Unlock()
+}
+
+// readAnnotation reads the annotation that follows REQ for a client that
+// negotiated annotations ("" for others)
+func (p *ProtocolV2) readAnnotation(client *ClientV2) (string, error) {
+	if atomic.LoadInt32(&client.Annotations) != 1 {
+		return "", nil
+	}
+
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return "", util.NewFatalClientErr(err, "E_INVALID", "REQ failed to read annotation size")
+	}
+
+	if bodyLen < 0 || bodyLen > maxAnnotationSize {
+		return "", util.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("REQ invalid annotation size %d (max %d)", bodyLen, maxAnnotationSize))
+	}
+
+	annotation := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, annotation)
+	if err != nil {
+		return "", util.NewFatalClientErr(err, "E_INVALID", "REQ failed to read annotation")
+	}
+
+	return string(annotation), nil
+}
+
+// sendAnnotations sends the annotations of msg, if any, to a client that
+// negotiated them
+func (p *ProtocolV2) sendAnnotations(client *ClientV2, channel *Channel, msg *nsq.Message, buf *bytes.Buffer) error {
+	if atomic.LoadInt32(&client.Annotations) != 1 {
+		return nil
+	}
+	annotations := channel.annotations.get(msg.Id)
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	if client.debugLogging() {
+		log.Printf("PROTOCOL(V2): writing %d annotations of msg(%s) to client(%s)",
+			len(annotations), msg.Id, client)
+	}
+
+	data, err := json.Marshal(annotations)
+	if err != nil {
+		return err
+	}
+
+	buf.Reset()
+	buf.Write(msg.Id[:])
+	buf.Write(data)
+
+	return p.Send(client, frameTypeMessageAnnotations, buf.Bytes())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestMessageAnnotations(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_annotations" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic.PutMessage(msg)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	data := identify(t, conn, map[string]interface{}{
+		"annotations": true,
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		Annotations bool `json:"annotations"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Annotations, true)
+	sub(t, conn, topicName, "ch")
+
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msgOut, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Id, msg.Id)
+
+	cmd := &nsq.Command{
+		Name:   []byte("REQ"),
+		Params: [][]byte{msgOut.Id[:], []byte("0")},
+		Body:   []byte("timed out talking to db"),
+	}
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+
+	// the annotations are sent just before the message's next attempt
+	resp, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err = nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, frameTypeMessageAnnotations)
+	assert.Equal(t, string(data[:nsq.MsgIDLength]), string(msg.Id[:]))
+	var annotations []MessageAnnotation
+	err = json.Unmarshal(data[nsq.MsgIDLength:], &annotations)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(annotations), 1)
+	assert.Equal(t, annotations[0].Attempt, uint16(1))
+	assert.Equal(t, annotations[0].Annotation, "timed out talking to db")
+
+	resp, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err = nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msgOut, err = nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Id, msg.Id)
+	assert.Equal(t, msgOut.Attempts, uint16(2))
+
+	// FIN forgets them
+	err = nsq.Finish(msgOut.Id).Write(conn)
+	assert.Equal(t, err, nil)
+	time.Sleep(50 * time.Millisecond)
+	channel, _ := topic.GetExistingChannel("ch")
+	assert.Equal(t, len(channel.annotations.get(msg.Id)), 0)
+}
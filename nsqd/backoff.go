@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// frameTypeBackoff frames tell a client (that negotiated backoff) to reduce
+// its RDY count for a duration because its channel is backing off
+const frameTypeBackoff int32 = 6
+
+// backoffSampler is the per client state of checkBackoff
+type backoffSampler struct {
+	finishCount  uint64
+	requeueCount uint64
+
+	// the channel backoff (its backoffUntil) the client was last sent
+	sentUntil int64
+}
+
+// sample returns the number of FIN and REQ since the previous sample
+func (s *backoffSampler) sample(client *ClientV2) (uint64, uint64) {
+	finishCount := atomic.LoadUint64(&client.FinishCount)
+	requeueCount := atomic.LoadUint64(&client.RequeueCount)
+	finished := finishCount - s.finishCount
+	requeued := requeueCount - s.requeueCount
+	s.finishCount = finishCount
+	s.requeueCount = requeueCount
+	return finished, requeued
+}
+
+// Backoff starts the channel backing off for d, unless it already is,
+// returning whether it did
+func (c *Channel) Backoff(d time.Duration) bool {
+	now := time.Now().UnixNano()
+	until := atomic.LoadInt64(&c.backoffUntil)
+	if until > now {
+		return false
+	}
+	if !atomic.CompareAndSwapInt64(&c.backoffUntil, until, now+int64(d)) {
+		return false
+	}
+	atomic.AddUint64(&c.backoffCount, 1)
+	log.Printf("CHANNEL(%s): backing off for %s", c.name, d)
+	return true
+}
+
+// BackoffRemaining returns how much longer the channel is backing off for
+func (c *Channel) BackoffRemaining() time.Duration {
+	remaining := time.Duration(atomic.LoadInt64(&c.backoffUntil) - time.Now().UnixNano())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// checkBackoff runs every --backoff-window for each client, the client's
+// channel starts backing off when at least --backoff-failure-percent of the
+// client's FIN/REQ over the window were REQ
+//
+// so that consumers of a failing channel back off together (rather than each
+// discovering it on its own) every client that negotiated backoff is sent a
+// BACKOFF frame, once per channel backoff, by its next check
+func (p *ProtocolV2) checkBackoff(client *ClientV2, channel *Channel, s *backoffSampler) error {
+	if channel == nil {
+		return nil
+	}
+
+	finished, requeued := s.sample(client)
+	total := finished + requeued
+	if total > 0 && int64(total) >= p.context.nsqd.options.BackoffMinSamples &&
+		requeued*100 >= uint64(p.context.nsqd.options.BackoffFailurePercent)*total {
+		if channel.Backoff(p.context.nsqd.options.BackoffDuration) {
+			log.Printf("PROTOCOL(V2): [%s] REQ %d of %d messages, channel %s backing off",
+				client, requeued, total, channel.name)
+		}
+	}
+
+	if atomic.LoadInt32(&client.Backoff) != 1 {
+		return nil
+	}
+
+	until := atomic.LoadInt64(&channel.backoffUntil)
+	remaining := channel.BackoffRemaining()
+	if remaining <= 0 || until == s.sentUntil {
+		return nil
+	}
+	s.sentUntil = until
+
+	frame, err := json.Marshal(struct {
+		Duration int64 `json:"duration"`
+	}{
+		Duration: int64(remaining / time.Millisecond),
+	})
+	if err != nil {
+		panic("should never happen")
+	}
+
+	if client.debugLogging() {
+		log.Printf("PROTOCOL(V2): [%s] sending BACKOFF %s", client, frame)
+	}
+
+	return p.Send(client, frameTypeBackoff, frame)
+}
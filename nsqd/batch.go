@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/bitly/go-nsq"
+)
+
+// frameTypeMessageBatch frames carry several messages to a client that
+// negotiated batching, the 4-byte message count is followed by each message
+// prefixed by its 4-byte size
+const frameTypeMessageBatch int32 = 5
+
+// messageBatch accumulates the messages of a frameTypeMessageBatch frame
+type messageBatch struct {
+	maxCount int
+	maxBytes int
+	count    int
+	buf      bytes.Buffer
+	msgBuf   bytes.Buffer
+}
+
+func newMessageBatch(maxCount int, maxBytes int) *messageBatch {
+	b := &messageBatch{
+		maxCount: maxCount,
+		maxBytes: maxBytes,
+	}
+	b.reset()
+	return b
+}
+
+func (b *messageBatch) reset() {
+	b.count = 0
+	b.buf.Reset()
+	// room for the count
+	b.buf.Write([]byte{0, 0, 0, 0})
+}
+
+// add appends msg and returns whether the batch is full (and should be sent)
+func (b *messageBatch) add(msg *nsq.Message) (bool, error) {
+	b.msgBuf.Reset()
+	err := msg.Write(&b.msgBuf)
+	if err != nil {
+		return false, err
+	}
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(b.msgBuf.Len()))
+	b.buf.Write(size[:])
+	b.buf.Write(b.msgBuf.Bytes())
+	b.count++
+
+	return b.count >= b.maxCount || b.buf.Len() >= b.maxBytes, nil
+}
+
+// frame returns the frame's data, it is only valid until the next reset
+func (b *messageBatch) frame() []byte {
+	data := b.buf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(b.count))
+	return data
+}
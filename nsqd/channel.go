@@ -3,9 +3,11 @@ package main
 import (
 	"bytes"
 	"container/heap"
+	"encoding/binary"
 	"errors"
 	"log"
 	"math"
+	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -38,15 +40,61 @@ type Consumer interface {
 // messages, timeouts, requeueing, etc.
 type Channel struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	requeueCount uint64
-	messageCount uint64
-	timeoutCount uint64
+	requeueCount  uint64
+	messageCount  uint64
+	timeoutCount  uint64
+	overflowCount uint64
+	droppedCount  uint64
+	skippedCount  uint64
+	backoffCount  uint64
+
+	// messages a mirror skipped because of its max rate (see mirror.go)
+	rateLimitedCount uint64
+	mirrorMaxRate    int64
+
+	// FIN and requeues (REQ or timeout) since the last quarantine check, and
+	// when the channel was quarantined (unix timestamp, 0 if it isn't), see
+	// quarantine.go
+	windowFinishCount  uint64
+	windowRequeueCount uint64
+	quarantinedAt      int64
+
+	// consumers are told to back off until this (unix nanoseconds, see Backoff)
+	backoffUntil int64
+
+	// messages published before this (unix nanoseconds) are skipped (see SetStartAt)
+	startAt int64
+
+	// publishes to the topic are rejected once the channel is this deep (see
+	// SetMaxDepth)
+	maxDepth int64
+
+	// publish timestamp of the message messagePump is delivering (0 if none)
+	pumpTimestamp int64
+
+	// when the counters were last zeroed (unix timestamp, see ResetStats)
+	statsResetAt int64
+
+	// depth watermarks for the depth webhook (0 disables)
+	highWatermark int64
+	lowWatermark  int64
+
+	// minimum nanoseconds between deliveries (see delivery_interval.go)
+	deliveryInterval int64
+
+	// messages in flight across all clients (see channel_max_in_flight.go)
+	maxInFlight int64
+
+	// nanoseconds over which a new client's RDY is ramped up (see
+	// slow_start.go)
+	slowStart int64
 
 	sync.RWMutex
 
-	topicName string
-	name      string
-	context   *Context
+	topicName    string
+	name         string
+	memQueueSize int64
+	context      *Context
 
 	backend BackendQueue
 
@@ -64,6 +112,41 @@ type Channel struct {
 	deleteCallback   func(*Channel)
 	deleter          sync.Once
 
+	// what to do when memoryMsgChan is full (see overflow_policy.go)
+	overflowPolicy int32
+
+	// that of the topic (see sync_policy.go)
+	syncPolicy int32
+
+	// whether the backlog is drained first (see delivery_order.go)
+	deliveryOrder int32
+
+	// partitioned delivery (see SetPartitions)
+	partitionMutex      sync.RWMutex
+	partitions          int
+	partitionConsumers  map[int64]chan *nsq.Message
+	partitionTable      []chan *nsq.Message
+	partitionUpdateChan chan int
+
+	// messages that timed out (see stuck.go)
+	stuck stuckMessages
+
+	// annotations of REQ'd messages (see annotations.go)
+	annotations messageAnnotations
+
+	// owner, description etc. (see meta_annotations.go)
+	meta metaAnnotations
+
+	// the channel this channel is a mirror of (see mirror.go)
+	mirrorLock        sync.Mutex
+	mirrorOf          string
+	mirrorSecond      int64
+	mirrorSecondCount int64
+
+	// HTTP endpoints messages are POSTed to, by URL (see push_consumer.go)
+	pushLock      sync.Mutex
+	pushConsumers map[string]*pushConsumer
+
 	// Stats tracking
 	e2eProcessingLatencyStream *util.Quantile
 
@@ -87,18 +170,24 @@ type inFlightMessage struct {
 
 // NewChannel creates a new instance of the Channel type and returns a pointer
 func NewChannel(topicName string, channelName string, context *Context,
-	deleteCallback func(*Channel)) *Channel {
+	memQueueSize int64, ephemeral bool, deleteCallback func(*Channel)) *Channel {
 
 	c := &Channel{
 		topicName:       topicName,
 		name:            channelName,
+		memQueueSize:    memQueueSize,
 		incomingMsgChan: make(chan *nsq.Message, 1),
-		memoryMsgChan:   make(chan *nsq.Message, context.nsqd.options.MemQueueSize),
+		memoryMsgChan:   make(chan *nsq.Message, memQueueSize),
 		clientMsgChan:   make(chan *nsq.Message),
 		exitChan:        make(chan int),
 		clients:         make(map[int64]Consumer),
 		deleteCallback:  deleteCallback,
 		context:         context,
+
+		partitionConsumers:  make(map[int64]chan *nsq.Message),
+		partitionUpdateChan: make(chan int),
+
+		pushConsumers: make(map[string]*pushConsumer),
 	}
 	if len(context.nsqd.options.E2EProcessingLatencyPercentiles) > 0 {
 		c.e2eProcessingLatencyStream = util.NewQuantile(
@@ -109,17 +198,19 @@ func NewChannel(topicName string, channelName string, context *Context,
 
 	c.initPQ()
 
-	if strings.HasSuffix(channelName, "#ephemeral") {
+	if ephemeral || strings.HasSuffix(channelName, "#ephemeral") {
 		c.ephemeralChannel = true
 		c.backend = NewDummyBackendQueue()
 	} else {
 		// backend names, for uniqueness, automatically include the topic... <topic>:<channel>
 		backendName := topicName + ":" + channelName
-		c.backend = NewDiskQueue(backendName,
+		diskQueue := NewDiskQueue(backendName,
 			context.nsqd.options.DataPath,
 			context.nsqd.options.MaxBytesPerFile,
 			context.nsqd.options.SyncEvery,
-			context.nsqd.options.SyncTimeout)
+			context.nsqd.options.SyncTimeout,
+			context.nsqd.options.WriteBatchWindow)
+		c.backend = newChaosBackend(newEncryptedBackend(diskQueue, topicName, context.nsqd.encryption), context.nsqd.chaos)
 	}
 
 	go c.messagePump()
@@ -134,7 +225,7 @@ func NewChannel(topicName string, channelName string, context *Context,
 }
 
 func (c *Channel) initPQ() {
-	pqSize := int(math.Max(1, float64(c.context.nsqd.options.MemQueueSize)/10))
+	pqSize := int(math.Max(1, float64(c.memQueueSize)/10))
 
 	c.inFlightMessages = make(map[nsq.MessageID]*pqueue.Item)
 	c.deferredMessages = make(map[nsq.MessageID]*pqueue.Item)
@@ -231,9 +322,82 @@ func (c *Channel) Empty() error {
 	}
 
 finish:
+	c.stuck.reset()
+	c.annotations.reset()
 	return c.backend.Empty()
 }
 
+// EmptyFilter selects the messages removed by EmptyMatching, every criteria
+// that is set has to match
+type EmptyFilter struct {
+	OlderThan  time.Time
+	BodyRegexp *regexp.Regexp
+	MaxCount   int64
+
+	count int64
+}
+
+func (f *EmptyFilter) match(msg *nsq.Message) bool {
+	if f.MaxCount > 0 && f.count >= f.MaxCount {
+		return false
+	}
+	if !f.OlderThan.IsZero() && msg.Timestamp >= f.OlderThan.UnixNano() {
+		return false
+	}
+	if f.BodyRegexp != nil && !f.BodyRegexp.Match(msg.Body) {
+		return false
+	}
+	f.count++
+	return true
+}
+
+// EmptyMatching removes the queued messages (on disk, then in memory) that
+// match filter, returning how many were removed, in-flight and deferred
+// messages (and the one messagePump is delivering) are left alone
+func (c *Channel) EmptyMatching(filter *EmptyFilter) (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	removed, err := c.backend.Filter(func(data []byte) bool {
+		data, err := c.context.nsqd.encryption.open(c.topicName, data)
+		if err != nil {
+			return false
+		}
+		msg, err := nsq.DecodeMessage(data)
+		if err != nil {
+			return false
+		}
+		return filter.match(msg)
+	})
+	if err != nil {
+		return removed, err
+	}
+
+	var msgBuf bytes.Buffer
+	for i := len(c.memoryMsgChan); i > 0; i-- {
+		var msg *nsq.Message
+		select {
+		case msg = <-c.memoryMsgChan:
+		default:
+			return removed, nil
+		}
+		if filter.match(msg) {
+			removed++
+			continue
+		}
+		select {
+		case c.memoryMsgChan <- msg:
+		default:
+			err = WriteMessageToBackend(&msgBuf, msg, c.backend)
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	return removed, nil
+}
+
 // flush persists all the messages in internal memory buffers to the backend
 // it does not drain inflight/deferred because it is only called in Close()
 func (c *Channel) flush() error {
@@ -300,6 +464,9 @@ func (c *Channel) doPause(pause bool) error {
 		atomic.StoreInt32(&c.paused, 1)
 	} else {
 		atomic.StoreInt32(&c.paused, 0)
+		if takeInt64(&c.quarantinedAt) > 0 {
+			log.Printf("CHANNEL(%s:%s): released from quarantine", c.topicName, c.name)
+		}
 	}
 
 	c.RLock()
@@ -323,6 +490,60 @@ func (c *Channel) IsPaused() bool {
 	return atomic.LoadInt32(&c.paused) == 1
 }
 
+// SetWatermarks configures the depths at which the depth webhook fires,
+// a high watermark of 0 disables it
+func (c *Channel) SetWatermarks(high int64, low int64) error {
+	if high < 0 || low < 0 || (high > 0 && low >= high) {
+		return errors.New("invalid watermarks")
+	}
+
+	atomic.StoreInt64(&c.highWatermark, high)
+	atomic.StoreInt64(&c.lowWatermark, low)
+
+	c.context.nsqd.Lock()
+	defer c.context.nsqd.Unlock()
+	return c.context.nsqd.PersistMetadata()
+}
+
+func (c *Channel) Watermarks() (int64, int64) {
+	return atomic.LoadInt64(&c.highWatermark), atomic.LoadInt64(&c.lowWatermark)
+}
+
+// oldestTimestamp returns the publish timestamp (ns) of the oldest message
+// known to be waiting for delivery, either the one messagePump is trying to
+// deliver or the head of the diskqueue, 0 if there is none
+func (c *Channel) oldestTimestamp() int64 {
+	oldest := atomic.LoadInt64(&c.pumpTimestamp)
+	head := c.backend.Peek()
+	if head == nil {
+		return oldest
+	}
+	data, err := c.context.nsqd.encryption.open(c.topicName, head)
+	// an encoded message starts with its timestamp
+	if err != nil || len(data) < 8 {
+		return oldest
+	}
+	ts := int64(binary.BigEndian.Uint64(data[:8]))
+	if oldest == 0 || ts < oldest {
+		oldest = ts
+	}
+	return oldest
+}
+
+// Lag returns how long the oldest message waiting for delivery has been
+// waiting since it was published
+func (c *Channel) Lag() time.Duration {
+	oldest := c.oldestTimestamp()
+	if oldest == 0 {
+		return 0
+	}
+	lag := time.Now().Sub(time.Unix(0, oldest))
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
+
 // PutMessage writes to the appropriate incoming message channel
 // (which will be routed asynchronously)
 func (c *Channel) PutMessage(msg *nsq.Message) error {
@@ -331,6 +552,9 @@ func (c *Channel) PutMessage(msg *nsq.Message) error {
 	if atomic.LoadInt32(&c.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
+	if c.skip(msg) || c.rateLimited() {
+		return nil
+	}
 	c.incomingMsgChan <- msg
 	atomic.AddUint64(&c.messageCount, 1)
 	return nil
@@ -368,6 +592,9 @@ func (c *Channel) FinishMessage(clientID int64, id nsq.MessageID) error {
 		return err
 	}
 	c.removeFromInFlightPQ(item)
+	c.stuck.remove(id)
+	c.annotations.remove(id)
+	atomic.AddUint64(&c.windowFinishCount, 1)
 	if c.e2eProcessingLatencyStream != nil {
 		c.e2eProcessingLatencyStream.Insert(item.Value.(*inFlightMessage).msg.Timestamp)
 	}
@@ -382,15 +609,28 @@ func (c *Channel) FinishMessage(clientID int64, id nsq.MessageID) error {
 //     and requeue a message (aka "deferred requeue")
 //
 func (c *Channel) RequeueMessage(clientID int64, id nsq.MessageID, timeout time.Duration) error {
+	return c.RequeueAnnotatedMessage(clientID, id, timeout, "", "")
+}
+
+// RequeueAnnotatedMessage requeues a message like RequeueMessage, annotating
+// its attempt (by clientName) unless annotation is empty
+func (c *Channel) RequeueAnnotatedMessage(clientID int64, id nsq.MessageID, timeout time.Duration,
+	clientName string, annotation string) error {
 	// remove from inflight first
 	item, err := c.popInFlightMessage(clientID, id)
 	if err != nil {
 		return err
 	}
 	c.removeFromInFlightPQ(item)
+	atomic.AddUint64(&c.windowRequeueCount, 1)
 
 	msg := item.Value.(*inFlightMessage).msg
 
+	// before it's requeued, so that it's never delivered without it
+	if annotation != "" {
+		c.annotations.add(msg, clientName, annotation)
+	}
+
 	if timeout == 0 {
 		return c.doRequeue(msg)
 	}
@@ -409,6 +649,7 @@ func (c *Channel) AddClient(clientID int64, client Consumer) {
 		return
 	}
 	c.clients[clientID] = client
+	c.shareInFlight()
 }
 
 // RemoveClient removes a client from the Channel's client list
@@ -421,6 +662,8 @@ func (c *Channel) RemoveClient(clientID int64) {
 		return
 	}
 	delete(c.clients, clientID)
+	c.RemovePartitionConsumer(clientID)
+	c.shareInFlight()
 
 	if len(c.clients) == 0 && c.ephemeralChannel == true {
 		go c.deleter.Do(func() { c.deleteCallback(c) })
@@ -552,14 +795,26 @@ func (c *Channel) addToDeferredPQ(item *pqueue.Item) {
 	heap.Push(&c.deferredPQ, item)
 }
 
+func (c *Channel) removeFromDeferredPQ(item *pqueue.Item) {
+	c.deferredMutex.Lock()
+	defer c.deferredMutex.Unlock()
+
+	if item.Index == -1 {
+		// this item has already been Pop'd off the pqueue
+		return
+	}
+
+	heap.Remove(&c.deferredPQ, item.Index)
+}
+
 // Router handles the muxing of incoming Channel messages, either writing
 // to the in-memory channel or to the backend
 func (c *Channel) router() {
 	var msgBuf bytes.Buffer
 	for msg := range c.incomingMsgChan {
-		select {
-		case c.memoryMsgChan <- msg:
-		default:
+		policy := c.context.nsqd.resolveOverflowPolicy(c.OverflowPolicy())
+		if c.SyncPolicy() == syncAlways || c.drainingBacklog() ||
+			!putMemory(c.memoryMsgChan, msg, policy, c.exitChan, &c.droppedCount) {
 			err := WriteMessageToBackend(&msgBuf, msg, c.backend)
 			if err != nil {
 				log.Printf("CHANNEL(%s) ERROR: failed to write message to backend - %s", c.name, err.Error())
@@ -581,6 +836,7 @@ func (c *Channel) messagePump() {
 	var msg *nsq.Message
 	var buf []byte
 	var err error
+	var lastDelivery time.Time
 
 	for {
 		// do an extra check for closed exit before we select on all the memory/backend/exitChan
@@ -590,10 +846,21 @@ func (c *Channel) messagePump() {
 			goto exit
 		}
 
+		// a nil channel is never selected
+		memoryMsgChan := c.memoryMsgChan
+		if c.drainingBacklog() {
+			memoryMsgChan = nil
+		}
+
 		select {
-		case msg = <-c.memoryMsgChan:
+		case msg = <-memoryMsgChan:
 		case buf = <-c.backend.ReadChan():
-			msg, err = nsq.DecodeMessage(buf)
+			buf, err = c.context.nsqd.encryption.open(c.topicName, buf)
+			if err != nil {
+				log.Printf("CHANNEL(%s) ERROR: failed to decrypt message - %s", c.name, err.Error())
+				continue
+			}
+			msg, err = decodeMessage(buf)
 			if err != nil {
 				log.Printf("ERROR: failed to decode message - %s", err.Error())
 				continue
@@ -602,10 +869,34 @@ func (c *Channel) messagePump() {
 			goto exit
 		}
 
+		// anything queued before the channel's start was set
+		if c.skip(msg) {
+			continue
+		}
+
 		msg.Attempts++
 
+		maxAttempts := c.context.nsqd.options.MaxAttempts
+		if maxAttempts > 0 && int(msg.Attempts) > maxAttempts && c.overflowMessage(msg) {
+			continue
+		}
+
+		if msg.Attempts == 1 {
+			err = c.context.nsqd.middleware.deliver(c.topicName, c.name, msg)
+			if err != nil {
+				log.Printf("CHANNEL(%s): discarding msg(%s) - %s", c.name, msg.Id, err.Error())
+				continue
+			}
+		}
+
 		atomic.StoreInt32(&c.bufferedCount, 1)
-		c.clientMsgChan <- msg
+		atomic.StoreInt64(&c.pumpTimestamp, msg.Timestamp)
+		if !c.throttleDelivery(msg, lastDelivery) {
+			goto exit
+		}
+		c.deliver(msg)
+		lastDelivery = time.Now()
+		atomic.StoreInt64(&c.pumpTimestamp, 0)
 		atomic.StoreInt32(&c.bufferedCount, 0)
 		// the client will call back to mark as in-flight w/ it's info
 	}
@@ -615,6 +906,34 @@ exit:
 	close(c.clientMsgChan)
 }
 
+// overflowMessage moves a message that has already been delivered
+// --max-attempts times to --attempts-overflow-topic (or discards it if there
+// isn't one), it returns false if the message should be delivered anyway
+func (c *Channel) overflowMessage(msg *nsq.Message) bool {
+	overflowTopic := c.context.nsqd.options.AttemptsOverflowTopic
+	if overflowTopic == c.topicName {
+		// don't cycle messages through the overflow topic
+		return false
+	}
+
+	if overflowTopic != "" {
+		overflowMsg := nsq.NewMessage(copyMessageKey(<-c.context.nsqd.idChan, msg.Id), msg.Body)
+		err := c.context.nsqd.PutMessages(overflowTopic, []*nsq.Message{overflowMsg})
+		if err != nil {
+			log.Printf("CHANNEL(%s) ERROR: failed to move msg(%s) to overflow topic %s - %s",
+				c.name, msg.Id, overflowTopic, err.Error())
+			return false
+		}
+	} else {
+		log.Printf("CHANNEL(%s): discarding msg(%s) after %d attempts", c.name, msg.Id, msg.Attempts-1)
+	}
+
+	c.stuck.remove(msg.Id)
+	c.annotations.remove(msg.Id)
+	atomic.AddUint64(&c.overflowCount, 1)
+	return true
+}
+
 func (c *Channel) deferredWorker() {
 	c.pqWorker(&c.deferredPQ, &c.deferredMutex, func(item *pqueue.Item) {
 		msg := item.Value.(*nsq.Message)
@@ -635,10 +954,12 @@ func (c *Channel) inFlightWorker() {
 			return
 		}
 		atomic.AddUint64(&c.timeoutCount, 1)
+		atomic.AddUint64(&c.windowRequeueCount, 1)
 		client, ok := c.clients[clientID]
 		if ok {
 			client.TimedOutMessage()
 		}
+		c.stuck.timedOut(msg, clientID, client)
 		c.doRequeue(msg)
 	})
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync/atomic"
+)
+
+// a channel can be given a ceiling on the messages in flight across all of
+// its clients (whatever their RDY) so that a burst of new consumers can't
+// collectively overwhelm a downstream datastore... the ceiling is shared
+// fairly, each client is allowed max_in_flight/clients messages in flight
+// (the remainder going to the longest connected), recomputed as clients come
+// and go
+//
+// a client whose allowance shrank (ie. because another one subscribed) isn't
+// sent messages until it's back under it, multiplexed clients (and HTTP/push
+// consumers) aren't limited
+
+var errInvalidMaxInFlight = errors.New("invalid max in flight")
+
+// SetMaxInFlight sets the ceiling on the channel's messages in flight, 0
+// doesn't limit it
+func (c *Channel) SetMaxInFlight(max int64) error {
+	if max < 0 {
+		return errInvalidMaxInFlight
+	}
+
+	atomic.StoreInt64(&c.maxInFlight, max)
+	c.Lock()
+	c.shareInFlight()
+	c.Unlock()
+	log.Printf("CHANNEL(%s): max in flight %d", c.name, max)
+
+	c.context.nsqd.Lock()
+	defer c.context.nsqd.Unlock()
+	return c.context.nsqd.PersistMetadata()
+}
+
+func (c *Channel) MaxInFlight() int64 {
+	return atomic.LoadInt64(&c.maxInFlight)
+}
+
+// shareInFlight recomputes the clients' allowances of the max in flight, the
+// channel must be locked
+func (c *Channel) shareInFlight() {
+	max := c.MaxInFlight()
+
+	ids := make([]int64, 0, len(c.clients))
+	for id, consumer := range c.clients {
+		client, ok := consumer.(*ClientV2)
+		if !ok || atomic.LoadInt32(&client.Multiplexed) == 1 {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	// client IDs are sequential, the lowest connected first
+	sort.Sort(int64Slice(ids))
+
+	n := int64(len(ids))
+	for i, id := range ids {
+		allowance := int64(-1)
+		if max > 0 {
+			allowance = max / n
+			if int64(i) < max%n {
+				allowance++
+			}
+		}
+		c.clients[id].(*ClientV2).SetInFlightAllowance(allowance)
+	}
+}
+
+// SetInFlightAllowance sets the messages the client can have in flight
+// whatever its RDY, -1 for no limit
+func (c *ClientV2) SetInFlightAllowance(allowance int64) {
+	atomic.StoreInt64(&c.inFlightAllowance, allowance)
+	c.tryUpdateReadyState()
+}
+
+// InFlightAllowance returns the messages the client can have in flight
+// whatever its RDY, -1 if unlimited
+func (c *ClientV2) InFlightAllowance() int64 {
+	return atomic.LoadInt64(&c.inFlightAllowance)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestChannelMaxInFlight(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_max_in_flight" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/set_channel_max_in_flight?topic=%s&channel=ch&max=3", httpAddr, topicName)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, channel.MaxInFlight(), int64(3))
+	assert.Equal(t, NewChannelStats(channel, nil).MaxInFlight, int64(3))
+
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+
+	conn1, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn1.Close()
+	sub(t, conn1, topicName, "ch")
+
+	conn2, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	sub(t, conn2, topicName, "ch")
+
+	// the first to connect gets the remainder
+	channel.RLock()
+	allowances := make([]int64, 0)
+	for _, id := range []int64{nsqd.clientIDSequence - 1, nsqd.clientIDSequence} {
+		allowances = append(allowances, channel.clients[id].(*ClientV2).InFlightAllowance())
+	}
+	channel.RUnlock()
+	assert.Equal(t, allowances, []int64{2, 1})
+
+	// whatever its RDY, the first client only gets its share
+	err = nsq.Ready(10).Write(conn1)
+	assert.Equal(t, err, nil)
+	for i := 0; i < 2; i++ {
+		resp, err := nsq.ReadResponse(conn1)
+		assert.Equal(t, err, nil)
+		frameType, _, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	}
+	conn1.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = nsq.ReadResponse(conn1)
+	assert.NotEqual(t, err, nil)
+
+	// until the other client leaves
+	conn2.Close()
+	conn1.SetReadDeadline(time.Now().Add(time.Second))
+	resp1, err := nsq.ReadResponse(conn1)
+	assert.Equal(t, err, nil)
+	frameType, _, err := nsq.UnpackResponse(resp1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+
+	url = fmt.Sprintf("http://%s/set_channel_max_in_flight?topic=%s&channel=ch&max=-1", httpAddr, topicName)
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+
+	// without a max it isn't limited
+	url = fmt.Sprintf("http://%s/set_channel_max_in_flight?topic=%s&channel=ch", httpAddr, topicName)
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, channel.MaxInFlight(), int64(0))
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
 	"github.com/bmizerany/assert"
 )
 
@@ -173,3 +177,178 @@ func TestChannelEmptyConsumer(t *testing.T) {
 	}
 
 }
+
+// ensure that a message isn't delivered more than --max-attempts times and
+// is moved to the overflow topic instead
+func TestChannelMaxAttempts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	options := NewNSQDOptions()
+	options.MaxAttempts = 2
+	options.AttemptsOverflowTopic = "test_overflow" + suffix
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	overflowChannel := nsqd.GetTopic(options.AttemptsOverflowTopic).GetChannel("ch")
+	topic := nsqd.GetTopic("test_max_attempts" + suffix)
+	channel := topic.GetChannel("ch")
+
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	topic.PutMessage(msg)
+
+	for i := 1; i <= options.MaxAttempts; i++ {
+		outputMsg := <-channel.clientMsgChan
+		assert.Equal(t, outputMsg.Id, msg.Id)
+		assert.Equal(t, int(outputMsg.Attempts), i)
+		channel.doRequeue(outputMsg)
+	}
+
+	select {
+	case <-channel.clientMsgChan:
+		t.Fatalf("message delivered more than %d times", options.MaxAttempts)
+	case overflowMsg := <-overflowChannel.clientMsgChan:
+		assert.Equal(t, overflowMsg.Body, msg.Body)
+		assert.Equal(t, overflowMsg.Attempts, uint16(1))
+	case <-time.After(time.Second):
+		t.Fatalf("message not moved to overflow topic")
+	}
+	assert.Equal(t, atomic.LoadUint64(&channel.overflowCount), uint64(1))
+}
+
+func TestChannelLag(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	// everything goes through the diskqueues
+	options.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_lag" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	assert.Equal(t, channel.Lag(), time.Duration(0))
+
+	// without clients messagePump holds on to the first message
+	now := time.Now()
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	msg.Timestamp = now.Add(-5 * time.Second).UnixNano()
+	topic.PutMessage(msg)
+	for i := 0; atomic.LoadInt64(&channel.pumpTimestamp) == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, channel.Lag() >= 5*time.Second, true)
+	assert.Equal(t, channel.Lag() < 6*time.Second, true)
+
+	// the head of the diskqueue is older
+	msg = nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	msg.Timestamp = now.Add(-20 * time.Second).UnixNano()
+	topic.PutMessage(msg)
+	for i := 0; channel.backend.Peek() == nil && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, channel.Lag() >= 20*time.Second, true)
+
+	<-channel.clientMsgChan
+	<-channel.clientMsgChan
+	for i := 0; channel.Lag() != 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, channel.Lag(), time.Duration(0))
+}
+
+func TestChannelEmptyMatching(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.MemQueueSize = 2
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_empty_matching" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	// without clients messagePump holds on to the first message
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("first")))
+	for i := 0; atomic.LoadInt64(&channel.pumpTimestamp) == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	old := time.Now().Add(-time.Hour).UnixNano()
+	bodies := []string{"drop 1", "keep 2", "drop 3", "drop 4", "keep 5", "drop 6"}
+	for i, body := range bodies {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte(body))
+		if i < 4 {
+			msg.Timestamp = old
+		}
+		topic.PutMessage(msg)
+	}
+	// in memory and on disk (and the one held by messagePump)
+	assert.Equal(t, waitForChannelDepth(channel, 7), int64(7))
+	assert.Equal(t, channel.backend.Depth() > 0, true)
+
+	endpoint := fmt.Sprintf("http://%s/empty_channel?topic=%s&channel=ch", httpAddr, topicName)
+	olderThan := time.Now().Add(-time.Minute).Unix()
+	data, err := util.ApiRequest(fmt.Sprintf("%s&older_than=%d&body_regex=%s", endpoint, olderThan, "%5Edrop"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data.Get("count").MustInt64(), int64(3))
+	assert.Equal(t, channel.Depth(), int64(4))
+
+	data, err = util.ApiRequest(endpoint + "&body_regex=drop&max_count=5")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data.Get("count").MustInt64(), int64(1))
+
+	_, err = util.ApiRequest(endpoint + "&body_regex=(")
+	assert.NotEqual(t, err, nil)
+
+	assert.Equal(t, string((<-channel.clientMsgChan).Body), "first")
+	var remaining []string
+	for i := 0; i < 2; i++ {
+		remaining = append(remaining, string((<-channel.clientMsgChan).Body))
+	}
+	// memory and disk aren't read in any particular order
+	sort.Strings(remaining)
+	assert.Equal(t, remaining, []string{"keep 2", "keep 5"})
+}
+
+func TestChannelStuckMessages(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.MsgTimeout = 50 * time.Millisecond
+	options.StuckMessageTimeouts = 2
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_stuck_messages" + strconv.Itoa(int(time.Now().Unix())))
+	channel := topic.GetChannel("ch")
+
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	topic.PutMessage(msg)
+
+	for i := 1; i <= options.StuckMessageTimeouts; i++ {
+		assert.Equal(t, len(NewChannelStats(channel, nil).StuckMessages), 0)
+		outputMsg := <-channel.clientMsgChan
+		assert.Equal(t, outputMsg.Id, msg.Id)
+		channel.StartInFlightTimeout(outputMsg, 1, options.MsgTimeout)
+	}
+
+	outputMsg := <-channel.clientMsgChan
+	stuck := NewChannelStats(channel, nil).StuckMessages
+	assert.Equal(t, len(stuck), 1)
+	assert.Equal(t, stuck[0].ID, string(msg.Id[:]))
+	assert.Equal(t, stuck[0].Timeouts, 2)
+	assert.Equal(t, stuck[0].Attempts, uint16(2))
+	assert.Equal(t, stuck[0].ClientID, int64(1))
+
+	// once finished it's no longer stuck
+	channel.StartInFlightTimeout(outputMsg, 1, options.MsgTimeout)
+	channel.FinishMessage(1, outputMsg.Id)
+	assert.Equal(t, len(NewChannelStats(channel, nil).StuckMessages), 0)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// with --chaos nsqd injects faults on demand, for testing how clients (and the
+// rest of a deployment) cope with them... /debug/chaos sets the percentage of
+// FINs silently dropped (the messages time out and are redelivered), a delay
+// before every flush to a client, the percentage of writes to the diskqueue
+// that fail, and kills random client connections
+//
+// every fault is off until it's set, and /debug/chaos doesn't exist without
+// --chaos
+
+var errChaosDiskWrite = errors.New("chaos: injected disk write error")
+
+type chaos struct {
+	dropFINPercent        int32
+	diskWriteErrorPercent int32
+	flushDelay            int64
+}
+
+// chaosSettings are the faults /debug/chaos sets (and responds)
+type chaosSettings struct {
+	DropFINPercent        int32  `json:"drop_fin_percent"`
+	FlushDelay            string `json:"flush_delay"`
+	DiskWriteErrorPercent int32  `json:"disk_write_error_percent"`
+}
+
+func (c *chaos) Settings() chaosSettings {
+	return chaosSettings{
+		DropFINPercent:        atomic.LoadInt32(&c.dropFINPercent),
+		FlushDelay:            time.Duration(atomic.LoadInt64(&c.flushDelay)).String(),
+		DiskWriteErrorPercent: atomic.LoadInt32(&c.diskWriteErrorPercent),
+	}
+}
+
+func (c *chaos) SetDropFINPercent(percent int32) {
+	atomic.StoreInt32(&c.dropFINPercent, percent)
+}
+
+func (c *chaos) SetFlushDelay(delay time.Duration) {
+	atomic.StoreInt64(&c.flushDelay, int64(delay))
+}
+
+func (c *chaos) SetDiskWriteErrorPercent(percent int32) {
+	atomic.StoreInt32(&c.diskWriteErrorPercent, percent)
+}
+
+func (c *chaos) Reset() {
+	c.SetDropFINPercent(0)
+	c.SetFlushDelay(0)
+	c.SetDiskWriteErrorPercent(0)
+}
+
+// DropFIN returns whether to drop a FIN, safe to call on a nil *chaos
+func (c *chaos) DropFIN() bool {
+	if c == nil {
+		return false
+	}
+	return chance(atomic.LoadInt32(&c.dropFINPercent))
+}
+
+// FlushDelay returns how long to wait before a flush, safe to call on a nil
+// *chaos
+func (c *chaos) FlushDelay() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&c.flushDelay))
+}
+
+func chance(percent int32) bool {
+	return percent > 0 && rand.Int31n(100) < percent
+}
+
+// chaosBackend fails the configured percentage of what is Put to a topic's
+// (or one of its channels') BackendQueue
+type chaosBackend struct {
+	BackendQueue
+	chaos *chaos
+}
+
+func newChaosBackend(bq BackendQueue, chaos *chaos) BackendQueue {
+	if bq == nil || chaos == nil {
+		return bq
+	}
+	return &chaosBackend{bq, chaos}
+}
+
+func (b *chaosBackend) Put(data []byte) error {
+	if chance(atomic.LoadInt32(&b.chaos.diskWriteErrorPercent)) {
+		return errChaosDiskWrite
+	}
+	return b.BackendQueue.Put(data)
+}
+
+func (b *chaosBackend) PutMany(batch [][]byte) error {
+	if chance(atomic.LoadInt32(&b.chaos.diskWriteErrorPercent)) {
+		return errChaosDiskWrite
+	}
+	return b.BackendQueue.PutMany(batch)
+}
+
+// killChaosClients closes the connections of (up to) count random subscribed
+// clients, returning their IDs
+func (n *NSQD) killChaosClients(count int) []int64 {
+	clients := make(map[int64]*ClientV2)
+	n.RLock()
+	for _, t := range n.topicMap {
+		t.RLock()
+		for _, c := range t.channelMap {
+			c.RLock()
+			for _, consumer := range c.clients {
+				// multiplexed clients are subscribed to several channels
+				if client, ok := consumer.(*ClientV2); ok {
+					clients[client.ID] = client
+				}
+			}
+			c.RUnlock()
+		}
+		t.RUnlock()
+	}
+	n.RUnlock()
+
+	killed := make([]int64, 0, count)
+	// map iteration order is random
+	for _, client := range clients {
+		if len(killed) == count {
+			break
+		}
+		log.Printf("CHAOS: killing client(%d) [%s]", client.ID, client)
+		client.Close()
+		killed = append(killed, client.ID)
+	}
+	return killed
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestChaos(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.Chaos = true
+	options.HTTPDebug = true
+	options.HTTPDebugAuthToken = "secret"
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	chaos := func(query string, token string) int {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/debug/chaos?%s", httpAddr, query), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, chaos("drop_fin_percent=100", ""), 401)
+	assert.Equal(t, nsqd.chaos.DropFIN(), false)
+
+	assert.Equal(t, chaos("drop_fin_percent=100&flush_delay=10ms&disk_write_error_percent=100", "secret"), 200)
+	assert.Equal(t, nsqd.chaos.Settings(), chaosSettings{100, "10ms", 100})
+
+	assert.Equal(t, chaos("drop_fin_percent=101", "secret"), 500)
+
+	bq := newChaosBackend(NewDummyBackendQueue(), nsqd.chaos)
+	assert.Equal(t, bq.Put([]byte("test body")), errChaosDiskWrite)
+
+	topicName := "test_chaos" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic.PutMessage(msg)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	sub(t, conn, topicName, "ch")
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+
+	resp2, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp2)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msgOut, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Id, msg.Id)
+
+	// the FIN is dropped, the message stays in flight
+	err = nsq.Finish(msgOut.Id).Write(conn)
+	assert.Equal(t, err, nil)
+	time.Sleep(50 * time.Millisecond)
+	channel.inFlightMutex.Lock()
+	assert.Equal(t, len(channel.inFlightMessages), 1)
+	channel.inFlightMutex.Unlock()
+
+	assert.Equal(t, chaos("reset&kill_clients=1", "secret"), 200)
+	assert.Equal(t, nsqd.chaos.Settings(), chaosSettings{0, "0s", 0})
+	assert.Equal(t, bq.Put([]byte("test body")), nil)
+
+	// the client's connection was killed
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = nsq.ReadResponse(conn)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestChaosDisabled(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/debug/chaos?drop_fin_percent=100", httpAddr))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 404)
+	assert.Equal(t, nsqd.chaos.DropFIN(), false)
+}
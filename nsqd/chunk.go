@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+)
+
+// frameTypeMessageChunk frames are pieces of a message bigger than
+// --max-msg-size sent to a client that negotiated chunked_messages, each is
+// prefixed by the 4-byte size of the whole (encoded) message and the 4-byte
+// offset of the piece within it, the client has the message once it has the
+// piece that ends at that size
+const frameTypeMessageChunk int32 = 8
+
+// chunkedPublish is a message being published in pieces (see CHUNK), it's
+// only ever touched by the client's IOLoop
+type chunkedPublish struct {
+	topicName string
+	size      int64
+	body      []byte
+}
+
+// sendChunks sends an encoded message in frameTypeMessageChunk frames of up
+// to --max-msg-size bytes
+func (p *ProtocolV2) sendChunks(client *ClientV2, data []byte) error {
+	chunkSize := int(p.context.nsqd.options.MaxMsgSize)
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		binary.BigEndian.PutUint32(header[4:8], uint32(offset))
+		err := p.sendParts(client, frameTypeMessageChunk, header[:], data[offset:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CHUNK <topic> <size>\n[ 4-byte chunk size ][ chunk ] publishes a message of
+// size bytes (up to --max-chunked-msg-size) in pieces of up to --max-msg-size,
+// only the CHUNK that completes the message is responded to
+func (p *ProtocolV2) CHUNK(client *ClientV2, params [][]byte) ([]byte, error) {
+	if atomic.LoadInt32(&client.ChunkedMessages) != 1 {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "CHUNK chunked_messages not negotiated")
+	}
+
+	if len(params) < 3 {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "CHUNK insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	if !nsq.IsValidTopicName(topicName) {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("CHUNK topic name '%s' is not valid", topicName))
+	}
+
+	size, err := strconv.ParseInt(string(params[2]), 10, 64)
+	if err != nil || size <= 0 {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("CHUNK invalid message size %s", params[2]))
+	}
+	if size > p.context.nsqd.options.MaxChunkedMsgSize {
+		p.context.nsqd.oversizeMessage(topicName)
+		return nil, util.NewFatalClientErr(errMsgTooBig, "E_BAD_MESSAGE",
+			fmt.Sprintf("CHUNK message too big %d > %d", size, p.context.nsqd.options.MaxChunkedMsgSize))
+	}
+
+	publish := client.chunkedPublish
+	if publish == nil {
+		publish = &chunkedPublish{topicName, size, make([]byte, 0, size)}
+		client.chunkedPublish = publish
+	} else if publish.topicName != topicName || publish.size != size {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_CHUNK",
+			fmt.Sprintf("CHUNK %s %d while %s %d is incomplete", topicName, size, publish.topicName, publish.size))
+	}
+
+	chunkLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_CHUNK", "CHUNK failed to read chunk size")
+	}
+	if chunkLen <= 0 || int64(chunkLen) > p.context.nsqd.options.MaxMsgSize ||
+		int64(len(publish.body))+int64(chunkLen) > size {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_CHUNK",
+			fmt.Sprintf("CHUNK invalid chunk size %d", chunkLen))
+	}
+
+	offset := len(publish.body)
+	publish.body = publish.body[:offset+int(chunkLen)]
+	_, err = io.ReadFull(client.Reader, publish.body[offset:])
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_CHUNK", "CHUNK failed to read chunk")
+	}
+	if int64(len(publish.body)) < size {
+		return nil, nil
+	}
+	client.chunkedPublish = nil
+
+	msg := nsq.NewMessage(<-p.context.nsqd.idChan, publish.body)
+	err = p.putMessages(client, topicName, []*nsq.Message{msg})
+	if err == errReadOnly {
+		return nil, util.NewClientErr(err, "E_READ_ONLY", "CHUNK failed "+err.Error())
+	}
+	if err == errDraining {
+		return nil, util.NewClientErr(err, "E_DRAINING", "CHUNK failed "+err.Error())
+	}
+	if err == errReplicaReadOnly {
+		return nil, util.NewClientErr(err, "E_REPLICA_READ_ONLY", "CHUNK failed "+err.Error())
+	}
+	if _, ok := err.(*msgRejectedError); ok {
+		return nil, util.NewClientErr(err, "E_MSG_REJECTED", "CHUNK failed "+err.Error())
+	}
+	if err == errTopicFull {
+		return nil, util.NewClientErr(err, "E_TOPIC_FULL", "CHUNK failed "+err.Error())
+	}
+	if err == errPublishPaused {
+		return nil, util.NewClientErr(err, "E_PUBLISH_PAUSED", "CHUNK failed "+err.Error())
+	}
+	if err == errMsgTooLarge {
+		return nil, util.NewClientErr(err, "E_MSG_TOO_LARGE", "CHUNK failed "+err.Error())
+	}
+	if err == errCreationDenied {
+		return nil, util.NewFatalClientErr(err, "E_CREATION_DENIED",
+			fmt.Sprintf("CHUNK topic '%s' does not exist and cannot be created", topicName))
+	}
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_PUB_FAILED", "CHUNK failed "+err.Error())
+	}
+	p.context.nsqd.producerPublished(topicName, tcpProducer(client), 1)
+
+	return okBytes, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestChunkedMessages(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.MaxMsgSize = 10
+	options.MaxChunkedMsgSize = 100
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_chunked" + strconv.Itoa(int(time.Now().Unix()))
+	body := []byte("0123456789abcdefghijklmno")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	data := identify(t, conn, map[string]interface{}{
+		"chunked_messages": true,
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		ChunkedMessages   bool  `json:"chunked_messages"`
+		MaxChunkedMsgSize int64 `json:"max_chunked_msg_size"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.ChunkedMessages, true)
+	assert.Equal(t, r.MaxChunkedMsgSize, int64(100))
+	sub(t, conn, topicName, "ch")
+
+	// only the last chunk is responded to
+	pubConn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, pubConn, map[string]interface{}{
+		"chunked_messages": true,
+	}, nsq.FrameTypeResponse)
+	for i := 0; i < len(body); i += 10 {
+		end := i + 10
+		if end > len(body) {
+			end = len(body)
+		}
+		cmd := &nsq.Command{Name: []byte("CHUNK"), Params: [][]byte{[]byte(topicName), []byte("25")}, Body: body[i:end]}
+		err = cmd.Write(pubConn)
+		assert.Equal(t, err, nil)
+	}
+	readValidate(t, pubConn, nsq.FrameTypeResponse, "OK")
+
+	// and delivered in chunks of up to --max-msg-size
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+	var encoded []byte
+	for {
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, frameType, frameTypeMessageChunk)
+		assert.Equal(t, int(binary.BigEndian.Uint32(data[4:8])), len(encoded))
+		assert.Equal(t, len(data[8:]) <= 10, true)
+		encoded = append(encoded, data[8:]...)
+		if len(encoded) == int(binary.BigEndian.Uint32(data[0:4])) {
+			break
+		}
+	}
+	msgOut, err := nsq.DecodeMessage(encoded)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Body, body)
+
+	// a chunk of a different message is fatal
+	cmd := &nsq.Command{Name: []byte("CHUNK"), Params: [][]byte{[]byte(topicName), []byte("20")}, Body: body[:10]}
+	err = cmd.Write(pubConn)
+	assert.Equal(t, err, nil)
+	cmd = &nsq.Command{Name: []byte("CHUNK"), Params: [][]byte{[]byte(topicName), []byte("25")}, Body: body[:10]}
+	err = cmd.Write(pubConn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(pubConn)
+	assert.Equal(t, err, nil)
+	frameType, _, _ := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+}
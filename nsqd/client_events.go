@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+)
+
+// client events (connect, identify, sub and disconnect) are POSTed to
+// --client-events-webhook-url and/or published to --client-events-topic so
+// that who consumes what can be audited (and misconfigured consumers
+// detected) outside of nsqd, they're queued so that a slow webhook never
+// holds up a client (and dropped when the queue is full)
+const clientEventsQueueSize = 1024
+
+type clientEvent struct {
+	Event     string      `json:"event"`
+	Node      string      `json:"node"`
+	Topic     string      `json:"topic,omitempty"`
+	Channel   string      `json:"channel,omitempty"`
+	Client    ClientStats `json:"client"`
+	Timestamp int64       `json:"timestamp"`
+}
+
+// clientEvent queues an event for client (channel is that of a sub)
+func (n *NSQD) clientEvent(event string, client *ClientV2, channel *Channel) {
+	if n.clientEventChan == nil {
+		return
+	}
+
+	e := &clientEvent{
+		Event:     event,
+		Node:      net.JoinHostPort(n.options.BroadcastAddress, strconv.Itoa(n.tcpAddr.Port)),
+		Client:    client.Stats(),
+		Timestamp: time.Now().Unix(),
+	}
+	if channel != nil {
+		e.Topic = channel.topicName
+		e.Channel = channel.name
+	}
+
+	select {
+	case n.clientEventChan <- e:
+	default:
+		log.Printf("ERROR: client events queue full, dropping %s of client(%s)", event, client)
+	}
+}
+
+func (n *NSQD) clientEventsLoop() {
+	httpclient := &http.Client{Transport: util.NewDeadlineTransport(2 * time.Second)}
+	for {
+		select {
+		case <-n.exitChan:
+			goto exit
+		case e := <-n.clientEventChan:
+			body, err := json.Marshal(e)
+			if err != nil {
+				panic("should never happen")
+			}
+
+			if n.options.ClientEventsWebhookURL != "" {
+				err = postClientEvent(httpclient, n.options.ClientEventsWebhookURL, body)
+				if err != nil {
+					log.Printf("ERROR: client event webhook failed - %s", err.Error())
+				}
+			}
+
+			if n.options.ClientEventsTopic != "" {
+				msg := nsq.NewMessage(<-n.idChan, body)
+				err = n.PutMessages(n.options.ClientEventsTopic, []*nsq.Message{msg})
+				if err != nil {
+					log.Printf("ERROR: failed to publish client event to %s - %s",
+						n.options.ClientEventsTopic, err.Error())
+				}
+			}
+		}
+	}
+
+exit:
+	log.Printf("CLIENT EVENTS: closing")
+}
+
+func postClientEvent(httpclient *http.Client, endpoint string, body []byte) error {
+	resp, err := httpclient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got response %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestClientEvents(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	webhookChan := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		webhookChan <- body
+	}))
+	defer server.Close()
+
+	options := NewNSQDOptions()
+	options.ClientEventsWebhookURL = server.URL
+	options.ClientEventsTopic = "test_client_events" + strconv.Itoa(int(time.Now().Unix()))
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_client_events_sub" + strconv.Itoa(int(time.Now().Unix()))
+	eventsTopic := nsqd.GetTopic(options.ClientEventsTopic)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn, map[string]interface{}{
+		"user_agent": "test/1.0",
+	}, nsq.FrameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	conn.Close()
+
+	expected := []struct{ event, channel string }{
+		{"connect", ""},
+		{"identify", ""},
+		{"sub", "ch"},
+		{"disconnect", ""},
+	}
+	for _, x := range expected {
+		var body []byte
+		select {
+		case body = <-webhookChan:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s webhook", x.event)
+		}
+		var e clientEvent
+		err = json.Unmarshal(body, &e)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, e.Event, x.event)
+		assert.Equal(t, e.Channel, x.channel)
+		if x.event != "connect" {
+			assert.Equal(t, e.Client.UserAgent, "test/1.0")
+		}
+
+		// and the same event was published
+		msg := <-eventsTopic.memoryMsgChan
+		assert.Equal(t, msg.Body, body)
+	}
+}
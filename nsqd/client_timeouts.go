@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// clients on high latency links (ie. satellite) can outlast the defaults: each
+// write to a client must complete within --client-write-timeout (1s), and a
+// client with heartbeats is disconnected once it has sent nothing for
+// --heartbeat-miss-tolerance (2) heartbeat intervals... a client can IDENTIFY
+// with its own write_timeout (in milliseconds) and heartbeat_miss_tolerance,
+// up to --max-client-write-timeout and --max-heartbeat-miss-tolerance
+
+// the lower bound of the write_timeout a client can IDENTIFY with
+const minClientWriteTimeout = 100 * time.Millisecond
+
+// SetWriteTimeout sets the deadline of each write to the client, in
+// milliseconds (0 keeps the default)
+func (c *ClientV2) SetWriteTimeout(desiredTimeout int) error {
+	switch {
+	case desiredTimeout == 0:
+		// do nothing (use default)
+	case desiredTimeout >= int(minClientWriteTimeout/time.Millisecond) &&
+		desiredTimeout <= int(c.context.nsqd.options.MaxClientWriteTimeout/time.Millisecond):
+		atomic.StoreInt64(&c.writeTimeout, int64(time.Duration(desiredTimeout)*time.Millisecond))
+	default:
+		return fmt.Errorf("write timeout (%d) is invalid", desiredTimeout)
+	}
+	return nil
+}
+
+func (c *ClientV2) WriteTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.writeTimeout))
+}
+
+// SetHeartbeatMissTolerance sets how many heartbeat intervals the client can
+// send nothing for before it's disconnected (0 keeps the default)
+func (c *ClientV2) SetHeartbeatMissTolerance(desiredTolerance int) error {
+	c.Lock()
+	defer c.Unlock()
+
+	switch {
+	case desiredTolerance == 0:
+		// do nothing (use default)
+	case desiredTolerance >= 1 && desiredTolerance <= c.context.nsqd.options.MaxHeartbeatMissTolerance:
+		c.HeartbeatMissTolerance = desiredTolerance
+	default:
+		return fmt.Errorf("heartbeat miss tolerance (%d) is invalid", desiredTolerance)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestClientTimeouts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	data := identify(t, conn, map[string]interface{}{
+		"write_timeout":            5000,
+		"heartbeat_miss_tolerance": 4,
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		WriteTimeout           int64 `json:"write_timeout"`
+		HeartbeatMissTolerance int   `json:"heartbeat_miss_tolerance"`
+		MaxWriteTimeout        int64 `json:"max_write_timeout"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.WriteTimeout, int64(5000))
+	assert.Equal(t, r.HeartbeatMissTolerance, 4)
+	assert.Equal(t, r.MaxWriteTimeout, int64(30000))
+
+	conn2, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn2.Close()
+	data = identify(t, conn2, map[string]interface{}{
+		"heartbeat_miss_tolerance": options.MaxHeartbeatMissTolerance + 1,
+	}, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_BAD_BODY IDENTIFY heartbeat miss tolerance (11) is invalid")
+
+	conn3, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn3.Close()
+	data = identify(t, conn3, map[string]interface{}{
+		"write_timeout": 10,
+	}, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_BAD_BODY IDENTIFY write timeout (10) is invalid")
+}
+
+func TestHeartbeatMissTolerance(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	// without responding, the client is disconnected after 3 heartbeat intervals
+	identify(t, conn, map[string]interface{}{
+		"heartbeat_interval":       1000,
+		"heartbeat_miss_tolerance": 3,
+	}, nsq.FrameTypeResponse)
+
+	start := time.Now()
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = nsq.ReadResponse(conn)
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, time.Since(start) >= 3*time.Second, true)
+}
@@ -32,6 +32,25 @@ type IdentifyDataV2 struct {
 	SampleRate          int32  `json:"sample_rate"`
 	UserAgent           string `json:"user_agent"`
 	MsgTimeout          int    `json:"msg_timeout"`
+	RdyHints            bool   `json:"rdy_hints"`
+	Multiplex           bool   `json:"multiplex"`
+	BatchMaxCount       int    `json:"batch_max_count"`
+	BatchMaxBytes       int    `json:"batch_max_bytes"`
+	BatchTimeout        int    `json:"batch_timeout"`
+	Backoff             bool   `json:"backoff"`
+	DurablePublish      bool   `json:"durable_publish"`
+	MsgDeadlines        bool   `json:"msg_deadlines"`
+	ChunkedMessages     bool   `json:"chunked_messages"`
+	HeartbeatStats      bool   `json:"heartbeat_stats"`
+	ReplicationOrigin   string `json:"replication_origin"`
+	Annotations         bool   `json:"annotations"`
+
+	// for high latency links (see client_timeouts.go)
+	WriteTimeout           int `json:"write_timeout"`
+	HeartbeatMissTolerance int `json:"heartbeat_miss_tolerance"`
+
+	// authorizes SUBs to topic patterns (see wildcard_sub.go)
+	WildcardSubToken string `json:"wildcard_sub_token"`
 }
 
 type IdentifyEvent struct {
@@ -39,6 +58,13 @@ type IdentifyEvent struct {
 	HeartbeatInterval   time.Duration
 	SampleRate          int32
 	MsgTimeout          time.Duration
+	RdyHints            bool
+	Multiplex           bool
+	BatchMaxCount       int
+	BatchMaxBytes       int
+	BatchTimeout        time.Duration
+	Backoff             bool
+	MsgDeadlines        bool
 }
 
 type ClientV2 struct {
@@ -50,6 +76,31 @@ type ClientV2 struct {
 	FinishCount    uint64
 	RequeueCount   uint64
 
+	// heartbeat liveness (UnixNano timestamps, the RTT in nanoseconds)
+	heartbeatSentAt int64
+	lastHeartbeat   int64
+	heartbeatRTT    int64
+
+	// its share of its channel's max in flight, -1 if unlimited (see
+	// channel_max_in_flight.go)
+	inFlightAllowance int64
+
+	// the deadline of every write, in nanoseconds (see client_timeouts.go)
+	writeTimeout int64
+
+	// when the client first subscribed (UnixNano), its RDY is ramped up from
+	// then (see slow_start.go)
+	subscribedAt int64
+
+	// flushes that took longer than the output buffer timeout, in total and
+	// in a row (see slow_consumer.go)
+	slowFlushCount   uint64
+	slowFlushesInRow int32
+	slowConsumer     int32
+
+	// a wake up is due when the slow start ramp next grows
+	slowStartWakeArmed int32
+
 	sync.RWMutex
 
 	ID        int64
@@ -72,8 +123,16 @@ type ClientV2 struct {
 
 	HeartbeatInterval time.Duration
 
+	// heartbeats missed in a row before the client is disconnected
+	HeartbeatMissTolerance int
+
 	MsgTimeout time.Duration
 
+	// message batching (BatchMaxCount is 0 unless negotiated)
+	BatchMaxCount int
+	BatchMaxBytes int
+	BatchTimeout  time.Duration
+
 	State           int32
 	ConnectTime     time.Time
 	Channel         *Channel
@@ -86,13 +145,63 @@ type ClientV2 struct {
 	IdentifyEventChan chan IdentifyEvent
 	SubEventChan      chan *Channel
 
-	TLS     int32
-	Snappy  int32
-	Deflate int32
+	// messages an admin redelivered to this client (see redeliver.go)
+	RedeliverChan chan *nsq.Message
+
+	// every channel this client is subscribed to, indexed by subscription ID
+	// (Channel is the first, and for clients that aren't multiplexed the only, one)
+	Subscriptions []*Channel
+
+	// serializes subscribing (wildcard SUBs subscribe from other goroutines,
+	// see wildcard_sub.go) so that subscription IDs are assigned in the order
+	// messagePump receives them, and none follows the client's exit
+	subscribeMutex sync.Mutex
+	unsubscribed   bool
+	// the pattern each wildcard subscription matched, by subscription ID, and
+	// the number of wildcard SUBs
+	wildcardSubscriptions map[int]string
+	wildcardPatterns      int
+
+	TLS         int32
+	Snappy      int32
+	Deflate     int32
+	RdyHints    int32
+	Multiplexed int32
+	Backoff     int32
+
+	// PUB/MPUB are only acknowledged once fsync'd (see PutMessagesDurable)
+	DurablePublish int32
+
+	// messages are sent with their deadline (see SendDeadlineMessage)
+	MsgDeadlines int32
+
+	// messages bigger than --max-msg-size are published and delivered in
+	// pieces (see CHUNK and sendChunks)
+	ChunkedMessages int32
+
+	// heartbeats carry channel and nsqd stats (see sendHeartbeat)
+	HeartbeatStats int32
+
+	// the cluster of a replicator, what it publishes is replicated from
+	// there (see replication.go)
+	ReplicationOrigin string
+
+	// REQ is followed by an annotation, and messages are preceded by theirs
+	// (see annotations.go)
+	Annotations int32
+
+	// the client presented the --wildcard-sub-token (see wildcard_sub.go)
+	WildcardSub int32
+
+	// delivery to this client alone is paused (see SetDeliveryPaused)
+	deliveryPaused int32
 
 	// re-usable buffer for reading the 4-byte lengths off the wire
 	lenBuf   [4]byte
 	lenSlice []byte
+
+	// the incomplete CHUNK publish (if any)
+	chunkedPublish *chunkedPublish
 }
 
 func NewClientV2(id int64, conn net.Conn, context *Context) *ClientV2 {
@@ -126,11 +235,17 @@ func NewClientV2(id int64, conn net.Conn, context *Context) *ClientV2 {
 
 		SubEventChan:      make(chan *Channel, 1),
 		IdentifyEventChan: make(chan IdentifyEvent, 1),
+		RedeliverChan:     make(chan *nsq.Message, redeliverQueueSize),
 
 		// heartbeats are client configurable but default to 30s
-		HeartbeatInterval: context.nsqd.options.ClientTimeout / 2,
+		HeartbeatInterval:      context.nsqd.options.ClientTimeout / 2,
+		HeartbeatMissTolerance: context.nsqd.options.HeartbeatMissTolerance,
+
+		inFlightAllowance: -1,
+		writeTimeout:      int64(context.nsqd.options.ClientWriteTimeout),
 	}
 	c.lenSlice = c.lenBuf[:]
+	c.lastHeartbeat = c.ConnectTime.UnixNano()
 	return c
 }
 
@@ -150,6 +265,16 @@ func (c *ClientV2) Identify(data IdentifyDataV2) error {
 		return err
 	}
 
+	err = c.SetHeartbeatMissTolerance(data.HeartbeatMissTolerance)
+	if err != nil {
+		return err
+	}
+
+	err = c.SetWriteTimeout(data.WriteTimeout)
+	if err != nil {
+		return err
+	}
+
 	err = c.SetOutputBufferSize(data.OutputBufferSize)
 	if err != nil {
 		return err
@@ -170,11 +295,105 @@ func (c *ClientV2) Identify(data IdentifyDataV2) error {
 		return err
 	}
 
+	// multiplexed subscriptions are a negotiated feature (of nsqd built with
+	// Go 1.1+, see mux_message_pump.go)
+	multiplex := data.FeatureNegotiation && data.Multiplex && multiplexSupported &&
+		c.context.nsqd.options.MaxSubscriptionsPerClient > 0
+	if multiplex {
+		// multiplexed messages have frames of their own and RDY is
+		// connection-wide, so the features that describe a single channel or
+		// change message frames can't be combined with it
+		switch {
+		case data.RdyHints:
+			return errors.New("multiplex can't be combined with rdy_hints")
+		case data.BatchMaxCount > 1:
+			return errors.New("multiplex can't be combined with batch_max_count")
+		case data.Backoff:
+			return errors.New("multiplex can't be combined with backoff")
+		case data.MsgDeadlines:
+			return errors.New("multiplex can't be combined with msg_deadlines")
+		}
+		atomic.StoreInt32(&c.Multiplexed, 1)
+	}
+
+	// RDY hints are a negotiated feature
+	rdyHints := data.FeatureNegotiation && data.RdyHints && c.context.nsqd.options.RdyHintDepth > 0
+	if rdyHints {
+		atomic.StoreInt32(&c.RdyHints, 1)
+	}
+
+	// batching is a negotiated feature
+	if data.FeatureNegotiation && data.BatchMaxCount > 1 && c.context.nsqd.options.MaxBatchCount > 1 {
+		err = c.SetBatch(data.BatchMaxCount, data.BatchMaxBytes, data.BatchTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	// BACKOFF frames are a negotiated feature
+	backoff := data.FeatureNegotiation && data.Backoff && c.context.nsqd.options.BackoffFailurePercent > 0
+	if backoff {
+		atomic.StoreInt32(&c.Backoff, 1)
+	}
+
+	// durable publishes are a negotiated feature
+	if data.FeatureNegotiation && data.DurablePublish {
+		atomic.StoreInt32(&c.DurablePublish, 1)
+	}
+
+	// message deadlines are a negotiated feature (that batched messages, with
+	// frames of their own, don't have)
+	msgDeadlines := data.FeatureNegotiation && data.MsgDeadlines && c.BatchMaxCount <= 1
+	if msgDeadlines {
+		atomic.StoreInt32(&c.MsgDeadlines, 1)
+	}
+
+	// chunked messages are a negotiated feature, only available when nsqd
+	// accepts messages bigger than --max-msg-size
+	if data.FeatureNegotiation && data.ChunkedMessages &&
+		c.context.nsqd.options.MaxChunkedMsgSize > c.context.nsqd.options.MaxMsgSize {
+		atomic.StoreInt32(&c.ChunkedMessages, 1)
+	}
+
+	// heartbeat stats are a negotiated feature
+	if data.FeatureNegotiation && data.HeartbeatStats {
+		atomic.StoreInt32(&c.HeartbeatStats, 1)
+	}
+
+	// replication is a negotiated feature, a replicator of our own cluster
+	// would loop messages
+	if data.FeatureNegotiation && data.ReplicationOrigin != "" {
+		if data.ReplicationOrigin == c.context.nsqd.options.Cluster {
+			return errors.New("replication from this nsqd's own cluster")
+		}
+		c.Lock()
+		c.ReplicationOrigin = data.ReplicationOrigin
+		c.Unlock()
+	}
+
+	// annotations are a negotiated feature (REQ has a body)
+	if data.FeatureNegotiation && data.Annotations {
+		atomic.StoreInt32(&c.Annotations, 1)
+	}
+
+	// wildcard SUBs are a negotiated feature (of multiplexed clients, each
+	// topic a pattern matches is a subscription)
+	if data.FeatureNegotiation && multiplex && c.context.nsqd.wildcardSubAuthorized(data.WildcardSubToken) {
+		atomic.StoreInt32(&c.WildcardSub, 1)
+	}
+
 	ie := IdentifyEvent{
 		OutputBufferTimeout: c.OutputBufferTimeout,
 		HeartbeatInterval:   c.HeartbeatInterval,
 		SampleRate:          c.SampleRate,
 		MsgTimeout:          c.MsgTimeout,
+		RdyHints:            rdyHints,
+		Multiplex:           multiplex,
+		BatchMaxCount:       c.BatchMaxCount,
+		BatchMaxBytes:       c.BatchMaxBytes,
+		BatchTimeout:        c.BatchTimeout,
+		Backoff:             backoff,
+		MsgDeadlines:        msgDeadlines,
 	}
 
 	// update the client's message pump
@@ -190,8 +409,10 @@ func (c *ClientV2) Stats() ClientStats {
 	c.RLock()
 	name := c.ShortIdentifier
 	userAgent := c.UserAgent
+	outputBufferTimeout := c.OutputBufferTimeout
 	c.RUnlock()
 	return ClientStats{
+		ID:            c.ID,
 		Version:       "V2",
 		RemoteAddress: c.RemoteAddr().String(),
 		Name:          name,
@@ -207,11 +428,76 @@ func (c *ClientV2) Stats() ClientStats {
 		TLS:           atomic.LoadInt32(&c.TLS) == 1,
 		Deflate:       atomic.LoadInt32(&c.Deflate) == 1,
 		Snappy:        atomic.LoadInt32(&c.Snappy) == 1,
+		Paused:        c.IsDeliveryPaused(),
+
+		OutputBufferTimeout: int64(outputBufferTimeout / time.Millisecond),
+
+		SlowConsumer:   c.IsSlowConsumer(),
+		SlowFlushCount: atomic.LoadUint64(&c.slowFlushCount),
+
+		HeartbeatRTT:     atomic.LoadInt64(&c.heartbeatRTT),
+		LastHeartbeatAge: time.Now().UnixNano() - atomic.LoadInt64(&c.lastHeartbeat),
+	}
+}
+
+// HeartbeatSent records that a heartbeat was sent, unless the previous one
+// has yet to be responded to (so that its age keeps growing)
+func (c *ClientV2) HeartbeatSent() {
+	atomic.CompareAndSwapInt64(&c.heartbeatSentAt, 0, time.Now().UnixNano())
+}
+
+// HeartbeatResponded records the round-trip time of the outstanding heartbeat,
+// clients respond to heartbeats with a NOP (it returns 0 for unsolicited NOPs)
+func (c *ClientV2) HeartbeatResponded() time.Duration {
+	now := time.Now().UnixNano()
+	var sentAt int64
+	for {
+		sentAt = atomic.LoadInt64(&c.heartbeatSentAt)
+		if sentAt == 0 {
+			return 0
+		}
+		if atomic.CompareAndSwapInt64(&c.heartbeatSentAt, sentAt, 0) {
+			break
+		}
 	}
+	rtt := now - sentAt
+	atomic.StoreInt64(&c.heartbeatRTT, rtt)
+	atomic.StoreInt64(&c.lastHeartbeat, now)
+	return time.Duration(rtt)
+}
+
+// PendingHeartbeat returns how long the outstanding heartbeat has been
+// waiting for a response, 0 if there isn't one
+func (c *ClientV2) PendingHeartbeat() time.Duration {
+	sentAt := atomic.LoadInt64(&c.heartbeatSentAt)
+	if sentAt == 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - sentAt)
+}
+
+// SetDeliveryPaused stops (or resumes) sending messages to this client without
+// changing its RDY count, messages already in-flight are unaffected
+func (c *ClientV2) SetDeliveryPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&c.deliveryPaused, v)
+	c.tryUpdateReadyState()
+}
+
+func (c *ClientV2) IsDeliveryPaused() bool {
+	return atomic.LoadInt32(&c.deliveryPaused) == 1
 }
 
 func (c *ClientV2) IsReadyForMessages() bool {
-	if c.Channel.IsPaused() {
+	if c.IsDeliveryPaused() {
+		return false
+	}
+
+	// multiplexed clients skip paused channels individually
+	if atomic.LoadInt32(&c.Multiplexed) == 0 && c.Channel.IsPaused() {
 		return false
 	}
 
@@ -219,7 +505,7 @@ func (c *ClientV2) IsReadyForMessages() bool {
 	lastReadyCount := atomic.LoadInt64(&c.LastReadyCount)
 	inFlightCount := atomic.LoadInt64(&c.InFlightCount)
 
-	if *verbose {
+	if c.debugLogging() {
 		log.Printf("[%s] state rdy: %4d lastrdy: %4d inflt: %4d", c,
 			readyCount, lastReadyCount, inFlightCount)
 	}
@@ -228,6 +514,15 @@ func (c *ClientV2) IsReadyForMessages() bool {
 		return false
 	}
 
+	if allowance := c.InFlightAllowance(); allowance >= 0 && inFlightCount >= allowance {
+		return false
+	}
+
+	if rampedCount := c.slowStartReadyCount(lastReadyCount); inFlightCount >= rampedCount {
+		c.wakeAfterSlowStartStep(rampedCount, lastReadyCount)
+		return false
+	}
+
 	return true
 }
 
@@ -299,7 +594,7 @@ func (c *ClientV2) SetHeartbeatInterval(desiredInterval int) error {
 		c.HeartbeatInterval = 0
 	case desiredInterval == 0:
 		// do nothing (use default)
-	case desiredInterval >= 1000 &&
+	case desiredInterval >= int(minHeartbeatInterval/time.Millisecond) &&
 		desiredInterval <= int(c.context.nsqd.options.MaxHeartbeatInterval/time.Millisecond):
 		c.HeartbeatInterval = time.Duration(desiredInterval) * time.Millisecond
 	default:
@@ -372,7 +667,7 @@ func (c *ClientV2) SetMsgTimeout(msgTimeout int) error {
 	switch {
 	case msgTimeout == 0:
 		// do nothing (use default)
-	case msgTimeout >= 1000 &&
+	case msgTimeout >= int(minMsgTimeout/time.Millisecond) &&
 		msgTimeout <= int(c.context.nsqd.options.MaxMsgTimeout/time.Millisecond):
 		c.MsgTimeout = time.Duration(msgTimeout) * time.Millisecond
 	default:
@@ -382,11 +677,44 @@ func (c *ClientV2) SetMsgTimeout(msgTimeout int) error {
 	return nil
 }
 
+// SetBatch configures message batching, each limit is capped by nsqd's and
+// defaults to it (or, for the timeout, to the client's output buffer timeout)
+func (c *ClientV2) SetBatch(maxCount int, maxBytes int, timeout int) error {
+	options := c.context.nsqd.options
+
+	if maxBytes < 0 {
+		return errors.New(fmt.Sprintf("batch max bytes (%d) is invalid", maxBytes))
+	}
+	if timeout < 0 {
+		return errors.New(fmt.Sprintf("batch timeout (%d) is invalid", timeout))
+	}
+
+	c.BatchMaxCount = int(options.MaxBatchCount)
+	if int64(maxCount) < options.MaxBatchCount {
+		c.BatchMaxCount = maxCount
+	}
+
+	c.BatchMaxBytes = int(options.MaxBatchBytes)
+	if maxBytes > 0 && int64(maxBytes) < options.MaxBatchBytes {
+		c.BatchMaxBytes = maxBytes
+	}
+
+	c.BatchTimeout = c.OutputBufferTimeout
+	if timeout > 0 {
+		c.BatchTimeout = time.Duration(timeout) * time.Millisecond
+	}
+	if c.BatchTimeout <= 0 || c.BatchTimeout > options.MaxOutputBufferTimeout {
+		c.BatchTimeout = options.MaxOutputBufferTimeout
+	}
+
+	return nil
+}
+
 func (c *ClientV2) UpgradeTLS() error {
 	c.Lock()
 	defer c.Unlock()
 
-	tlsConn := tls.Server(c.Conn, c.context.nsqd.tlsConfig)
+	tlsConn := tls.Server(c.Conn, c.context.nsqd.TLSConfig())
 	err := tlsConn.Handshake()
 	if err != nil {
 		return err
@@ -439,8 +767,22 @@ func (c *ClientV2) UpgradeSnappy() error {
 }
 
 func (c *ClientV2) Flush() error {
-	c.SetWriteDeadline(time.Now().Add(time.Second))
+	if delay := c.context.nsqd.chaos.FlushDelay(); delay > 0 && c.Writer.Buffered() > 0 {
+		time.Sleep(delay)
+	}
+
+	c.SetWriteDeadline(time.Now().Add(c.WriteTimeout()))
+
+	if c.Writer.Buffered() == 0 {
+		return c.flush()
+	}
+	start := time.Now()
+	err := c.flush()
+	c.flushed(time.Since(start), err)
+	return err
+}
 
+func (c *ClientV2) flush() error {
 	err := c.Writer.Flush()
 	if err != nil {
 		return err
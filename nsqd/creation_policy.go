@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/bitly/nsq/util"
+)
+
+var errCreationDenied = errors.New("creation denied by policy")
+
+// creationRule matches topics (or channels) by name, the first rule to match
+// a name decides whether it can be implicitly created and with what defaults
+type creationRule struct {
+	Type            string `json:"type"`
+	Pattern         string `json:"pattern"`
+	Topic           string `json:"topic"`
+	Deny            bool   `json:"deny"`
+	MemQueueSize    *int64 `json:"mem_queue_size"`
+	RetentionPeriod string `json:"retention_period"`
+
+	pattern      *regexp.Regexp
+	topicPattern *regexp.Regexp
+	retention    time.Duration
+}
+
+// creationPolicy decides whether topics and channels that don't exist yet
+// can be created by a SUB or a publish (explicit creation via /create_topic
+// and /create_channel is always allowed)
+//
+// rules are loaded from --creation-policy-file (JSON) ie:
+//
+//	{
+//	    "default_deny": false,
+//	    "rules": [
+//	        {"type": "topic", "pattern": "^test", "deny": true},
+//	        {"type": "topic", "pattern": "^events\\.", "retention_period": "24h"},
+//	        {"type": "channel", "topic": "^events\\.", "pattern": "^archive$", "mem_queue_size": 0}
+//	    ]
+//	}
+//
+// if --creation-hook-url is set, a name the rules allow is then POSTed to it
+// and the response can deny creation or override the defaults
+type creationPolicy struct {
+	DefaultDeny bool            `json:"default_deny"`
+	Rules       []*creationRule `json:"rules"`
+
+	hookURL    string
+	httpclient *http.Client
+}
+
+type creationHookPayload struct {
+	Type    string `json:"type"`
+	Topic   string `json:"topic"`
+	Channel string `json:"channel,omitempty"`
+}
+
+type creationHookResponse struct {
+	Deny            bool   `json:"deny"`
+	MemQueueSize    *int64 `json:"mem_queue_size"`
+	RetentionPeriod string `json:"retention_period"`
+}
+
+// creationDefaults are what an implicitly created topic or channel is created with
+type creationDefaults struct {
+	memQueueSize    int64
+	retentionPeriod time.Duration
+}
+
+func newCreationPolicy(fileName string, hookURL string, hookTimeout time.Duration) (*creationPolicy, error) {
+	p := &creationPolicy{
+		hookURL:    hookURL,
+		httpclient: &http.Client{Transport: util.NewDeadlineTransport(hookTimeout)},
+	}
+	if fileName == "" {
+		return p, nil
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, p)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Type != "topic" && rule.Type != "channel" {
+			return nil, fmt.Errorf("rule %d has invalid type %q", i, rule.Type)
+		}
+		rule.pattern, err = regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d has invalid pattern - %s", i, err.Error())
+		}
+		if rule.Topic != "" {
+			if rule.Type != "channel" {
+				return nil, fmt.Errorf("rule %d has a topic pattern but isn't a channel rule", i)
+			}
+			rule.topicPattern, err = regexp.Compile(rule.Topic)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d has invalid topic pattern - %s", i, err.Error())
+			}
+		}
+		if rule.MemQueueSize != nil && *rule.MemQueueSize < 0 {
+			return nil, fmt.Errorf("rule %d has invalid mem_queue_size %d", i, *rule.MemQueueSize)
+		}
+		if rule.RetentionPeriod != "" {
+			if rule.Type != "topic" {
+				return nil, fmt.Errorf("rule %d has a retention_period but isn't a topic rule", i)
+			}
+			rule.retention, err = time.ParseDuration(rule.RetentionPeriod)
+			if err != nil || rule.retention < 0 {
+				return nil, fmt.Errorf("rule %d has invalid retention_period %q", i, rule.RetentionPeriod)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func (r *creationRule) matches(topicName string, channelName string) bool {
+	if channelName == "" {
+		return r.Type == "topic" && r.pattern.MatchString(topicName)
+	}
+	if r.Type != "channel" {
+		return false
+	}
+	if r.topicPattern != nil && !r.topicPattern.MatchString(topicName) {
+		return false
+	}
+	return r.pattern.MatchString(channelName)
+}
+
+// Check returns the defaults to (implicitly) create a topic (when channelName
+// is empty) or channel with, or errCreationDenied
+func (p *creationPolicy) Check(topicName string, channelName string, defaults *creationDefaults) (*creationDefaults, error) {
+	d := *defaults
+	deny := p.DefaultDeny
+	for _, rule := range p.Rules {
+		if !rule.matches(topicName, channelName) {
+			continue
+		}
+		deny = rule.Deny
+		if rule.MemQueueSize != nil {
+			d.memQueueSize = *rule.MemQueueSize
+		}
+		if rule.retention > 0 {
+			d.retentionPeriod = rule.retention
+		}
+		break
+	}
+
+	if !deny && p.hookURL != "" {
+		deny = p.callHook(topicName, channelName, &d)
+	}
+
+	if deny {
+		if channelName == "" {
+			log.Printf("POLICY: denied creation of topic (%s)", topicName)
+		} else {
+			log.Printf("POLICY: denied creation of channel (%s:%s)", topicName, channelName)
+		}
+		return nil, errCreationDenied
+	}
+	return &d, nil
+}
+
+// callHook POSTs to --creation-hook-url, returning true if creation should be
+// denied... if the hook can't be reached the decision is left to the rules
+func (p *creationPolicy) callHook(topicName string, channelName string, d *creationDefaults) bool {
+	payload := &creationHookPayload{
+		Type:    "topic",
+		Topic:   topicName,
+		Channel: channelName,
+	}
+	if channelName != "" {
+		payload.Type = "channel"
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("ERROR: creation hook failed - %s", err.Error())
+		return false
+	}
+
+	resp, err := p.httpclient.Post(p.hookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("ERROR: creation hook failed - %s", err.Error())
+		return false
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Printf("ERROR: creation hook failed - %s", err.Error())
+		return false
+	}
+
+	if resp.StatusCode == 403 {
+		return true
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Printf("ERROR: creation hook failed - got response %s", resp.Status)
+		return false
+	}
+	if len(bytes.TrimSpace(respBody)) == 0 {
+		return false
+	}
+
+	var hookResp creationHookResponse
+	err = json.Unmarshal(respBody, &hookResp)
+	if err != nil {
+		log.Printf("ERROR: creation hook returned invalid response - %s", err.Error())
+		return false
+	}
+	if hookResp.MemQueueSize != nil && *hookResp.MemQueueSize >= 0 {
+		d.memQueueSize = *hookResp.MemQueueSize
+	}
+	if hookResp.RetentionPeriod != "" {
+		period, err := time.ParseDuration(hookResp.RetentionPeriod)
+		if err != nil || period < 0 {
+			log.Printf("ERROR: creation hook returned invalid retention_period %q", hookResp.RetentionPeriod)
+		} else {
+			d.retentionPeriod = period
+		}
+	}
+	return hookResp.Deny
+}
+
+// AutoCreateTopic returns the named topic, consulting the creation policy
+// if it does not exist yet (this is used where topics are implicitly
+// created, by SUB and publishing)
+func (n *NSQD) AutoCreateTopic(topicName string) (*Topic, error) {
+	n.RLock()
+	t, ok := n.topicMap[topicName]
+	n.RUnlock()
+	if ok {
+		return t, nil
+	}
+
+	d, err := n.creationPolicy.Check(topicName, "", &creationDefaults{
+		memQueueSize: n.options.MemQueueSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t = n.getTopic(topicName, d.memQueueSize)
+	if d.retentionPeriod > 0 && t.RetentionPeriod() == 0 {
+		err = t.SetRetention(d.retentionPeriod)
+		if err != nil {
+			log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+		}
+	}
+	return t, nil
+}
+
+// AutoCreateChannel is the AutoCreateTopic equivalent for channels
+func (t *Topic) AutoCreateChannel(channelName string) (*Channel, error) {
+	return t.AutoCreateChannelWithOptions(channelName, &channelCreateOptions{})
+}
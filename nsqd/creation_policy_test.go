@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestCreationPolicy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var payload creationHookPayload
+		json.NewDecoder(req.Body).Decode(&payload)
+		switch {
+		case payload.Type == "channel" && payload.Channel == "hook_denied":
+			w.WriteHeader(403)
+		case payload.Type == "channel":
+			w.Write([]byte(`{"mem_queue_size": 5}`))
+		}
+	}))
+	defer ts.Close()
+
+	f, err := ioutil.TempFile("", "nsqd-creation-policy")
+	assert.Equal(t, err, nil)
+	defer os.Remove(f.Name())
+	f.Write([]byte(`{
+		"default_deny": true,
+		"rules": [
+			{"type": "topic", "pattern": "^test_creation_typo", "deny": true},
+			{"type": "topic", "pattern": "^test_creation", "mem_queue_size": 10, "retention_period": "1h"},
+			{"type": "channel", "pattern": ".*"}
+		]
+	}`))
+	f.Close()
+
+	options := NewNSQDOptions()
+	options.CreationPolicyFile = f.Name()
+	options.CreationHookURL = ts.URL
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	topicName := "test_creation" + suffix
+
+	// denied by rule (and by default)
+	for _, name := range []string{"test_creation_typo" + suffix, "other" + suffix} {
+		url := fmt.Sprintf("http://%s/put?topic=%s", httpAddr, name)
+		resp, err := http.Post(url, "application/octet-stream", nil)
+		assert.Equal(t, err, nil)
+		resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, 403)
+
+		conn, err := mustConnectNSQD(tcpAddr)
+		assert.Equal(t, err, nil)
+		err = nsq.Publish(name, []byte("test body")).Write(conn)
+		assert.Equal(t, err, nil)
+		resp2, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, _ := nsq.UnpackResponse(resp2)
+		assert.Equal(t, frameType, nsq.FrameTypeError)
+		assert.Equal(t, string(data[:17]), "E_CREATION_DENIED")
+		conn.Close()
+
+		nsqd.RLock()
+		_, ok := nsqd.topicMap[name]
+		nsqd.RUnlock()
+		assert.Equal(t, ok, false)
+	}
+
+	// allowed with per-name defaults
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	topic, err := nsqd.AutoCreateTopic(topicName)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, topic.memQueueSize, int64(10))
+	assert.Equal(t, topic.RetentionPeriod(), time.Hour)
+	channel, err := topic.AutoCreateChannel("ch")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, channel.memQueueSize, int64(5))
+
+	// denied by the hook
+	_, err = topic.AutoCreateChannel("hook_denied")
+	assert.Equal(t, err, errCreationDenied)
+
+	// explicit creation ignores the policy
+	assert.Equal(t, nsqd.GetTopic("other"+suffix).memQueueSize, options.MemQueueSize)
+
+	// defaults survive a restart
+	nsqd.Lock()
+	nsqd.PersistMetadata()
+	nsqd.Unlock()
+	metadata, _ := getMetadata(nsqd)
+	topics := metadata.Get("topics")
+	for i := range topics.MustArray() {
+		topicJs := topics.GetIndex(i)
+		if topicJs.Get("name").MustString() != topicName {
+			continue
+		}
+		assert.Equal(t, topicJs.Get("mem_queue_size").MustInt64(), int64(10))
+		assert.Equal(t, topicJs.Get("channels").GetIndex(0).Get("mem_queue_size").MustInt64(), int64(5))
+	}
+}
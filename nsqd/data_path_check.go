@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// --check-data-path scans every diskqueue in the data path at startup (before
+// any is opened) for what a crash can leave behind, rather than nsqd finding
+// out by way of read errors:
+//
+//  * metadata that's missing or unreadable (it's rebuilt from the files)
+//  * files between the read and write files that are missing (gaps)
+//  * files that end in a partial record (truncation)
+//  * a read position that's past the end of its file or isn't at a record
+//  * complete records past the write position (written after the metadata was
+//    last synced, which would otherwise be overwritten)
+//  * a depth that isn't the number of records left
+//
+// "report" logs them, "repair" also truncates each file to its last complete
+// record and rewrites the metadata so that it describes what's on disk
+
+const (
+	checkDataPathReport = "report"
+	checkDataPathRepair = "repair"
+)
+
+const (
+	diskQueueMetaDataSuffix = ".diskqueue.meta.dat"
+	diskQueueFileInfix      = ".diskqueue."
+)
+
+// diskQueueFileScan is what's in a diskqueue file
+type diskQueueFileScan struct {
+	size int64
+	// the end of the last complete record
+	validEnd int64
+	// the first record boundary at or after the start the file was scanned
+	// from (validEnd if there isn't one)
+	start int64
+	// the complete records from start on
+	records int64
+}
+
+// scanDiskQueueFile reads the records of a diskqueue file from (the record
+// boundary at or after) from, a record is a 4-byte size then that many bytes
+func scanDiskQueueFile(fileName string, from int64) (*diskQueueFileScan, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	scan := &diskQueueFileScan{size: stat.Size(), start: -1}
+	var lenBuf [4]byte
+	var pos int64
+	for {
+		if scan.start < 0 && pos >= from {
+			scan.start = pos
+		}
+		_, err = io.ReadFull(f, lenBuf[:])
+		if err != nil {
+			break
+		}
+		msgSize := int64(int32(binary.BigEndian.Uint32(lenBuf[:])))
+		if msgSize <= 0 || pos+4+msgSize > scan.size {
+			break
+		}
+		_, err = f.Seek(msgSize, 1)
+		if err != nil {
+			return nil, err
+		}
+		pos += 4 + msgSize
+		scan.validEnd = pos
+		if scan.start >= 0 {
+			scan.records++
+		}
+	}
+	if scan.start < 0 {
+		scan.start = scan.validEnd
+	}
+	return scan, nil
+}
+
+// diskQueueFileNums returns the numbers of each diskqueue's files (data path
+// file names are <name>.diskqueue.<number>.dat), diskqueues that only have
+// metadata have none
+func diskQueueFileNums(dataPath string) (map[string][]int64, error) {
+	files, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	queues := make(map[string][]int64)
+	for _, fi := range files {
+		fn := fi.Name()
+		if strings.HasSuffix(fn, diskQueueMetaDataSuffix) {
+			name := fn[:len(fn)-len(diskQueueMetaDataSuffix)]
+			if _, ok := queues[name]; !ok {
+				queues[name] = nil
+			}
+			continue
+		}
+		i := strings.LastIndex(fn, diskQueueFileInfix)
+		if i < 0 || !strings.HasSuffix(fn, ".dat") {
+			continue
+		}
+		fileNum, err := strconv.ParseInt(fn[i+len(diskQueueFileInfix):len(fn)-len(".dat")], 10, 64)
+		if err != nil {
+			continue
+		}
+		queues[fn[:i]] = append(queues[fn[:i]], fileNum)
+	}
+	return queues, nil
+}
+
+// CheckDataPath checks (and with repair, repairs) every diskqueue in the data
+// path, it returns the number of problems found
+func (n *NSQD) CheckDataPath(repair bool) int {
+	dataPath := n.options.DataPath
+	if dataPath == "" {
+		dataPath = "."
+	}
+
+	queues, err := diskQueueFileNums(dataPath)
+	if err != nil {
+		log.Printf("ERROR: failed to check data path %s - %s", dataPath, err.Error())
+		return 1
+	}
+
+	names := make([]string, 0, len(queues))
+	for name := range queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems int
+	for _, name := range names {
+		problems += checkDiskQueue(name, dataPath, queues[name], repair)
+	}
+	log.Printf("DATAPATH: checked %d diskqueues in %s, %d problems", len(names), dataPath, problems)
+	return problems
+}
+
+// checkDiskQueue checks the diskqueue name, whose files are fileNums
+func checkDiskQueue(name string, dataPath string, fileNums []int64, repair bool) int {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	sort.Sort(int64Slice(fileNums))
+
+	d := &DiskQueue{name: name, dataPath: dataPath}
+	err := d.retrieveMetaData()
+	if err != nil {
+		if len(fileNums) == 0 {
+			problem("unreadable metadata %s - %s", d.metaDataFileName(), err.Error())
+			d.readFileNum, d.readPos = 0, 0
+			d.writeFileNum, d.writePos = 0, 0
+			atomic.StoreInt64(&d.depth, -1)
+		} else {
+			if os.IsNotExist(err) {
+				problem("missing metadata %s, it's rebuilt from its %d files (some messages may be delivered again)",
+					d.metaDataFileName(), len(fileNums))
+			} else {
+				problem("unreadable metadata %s - %s, it's rebuilt from its %d files (some messages may be delivered again)",
+					d.metaDataFileName(), err.Error(), len(fileNums))
+			}
+			d.readFileNum = fileNums[0]
+			d.writeFileNum = fileNums[len(fileNums)-1]
+			d.readPos = 0
+			d.writePos = -1
+			atomic.StoreInt64(&d.depth, -1)
+		}
+	}
+
+	for _, fileNum := range fileNums {
+		if fileNum < d.readFileNum {
+			problem("%s was already read", d.fileName(fileNum))
+		} else if fileNum > d.writeFileNum {
+			problem("%s is past the write file", d.fileName(fileNum))
+		}
+	}
+
+	readFileNum, readPos := d.readFileNum, d.readPos
+	writeFileNum, writePos := d.writeFileNum, d.writePos
+	truncate := make(map[int64]int64)
+	var depth int64
+	for fileNum := d.readFileNum; fileNum <= d.writeFileNum; fileNum++ {
+		fileName := d.fileName(fileNum)
+		var from int64
+		if fileNum == d.readFileNum {
+			from = d.readPos
+		}
+
+		scan, err := scanDiskQueueFile(fileName, from)
+		if err != nil {
+			if os.IsNotExist(err) {
+				if fileNum != d.writeFileNum || d.writePos > 0 {
+					problem("%s is missing", fileName)
+				}
+			} else {
+				problem("failed to read %s - %s", fileName, err.Error())
+			}
+			if fileNum == readFileNum {
+				readFileNum, readPos = fileNum+1, 0
+			}
+			if fileNum == d.writeFileNum {
+				writePos = 0
+			}
+			continue
+		}
+
+		if scan.validEnd < scan.size {
+			problem("%s is truncated, its last complete record ends at %d of %d bytes",
+				fileName, scan.validEnd, scan.size)
+			truncate[fileNum] = scan.validEnd
+		}
+
+		if fileNum == d.readFileNum {
+			if d.readPos > scan.validEnd {
+				problem("read position %d is past the end of %s (%d)", d.readPos, fileName, scan.validEnd)
+			} else if scan.start != d.readPos {
+				problem("read position %d of %s isn't at a record (the next one is at %d)",
+					d.readPos, fileName, scan.start)
+			}
+			readPos = scan.start
+		}
+
+		if fileNum == d.writeFileNum {
+			if d.writePos >= 0 && scan.validEnd > d.writePos {
+				// at startup the write file is written to from the write
+				// position, these would be overwritten
+				problem("%s has complete records past the write position (%d to %d), written after the metadata was last synced",
+					fileName, d.writePos, scan.validEnd)
+			} else if d.writePos > scan.validEnd {
+				problem("write position %d is past the end of %s (%d)", d.writePos, fileName, scan.validEnd)
+			}
+			writePos = scan.validEnd
+		}
+
+		depth += scan.records
+	}
+
+	if readFileNum > writeFileNum || (readFileNum == writeFileNum && readPos > writePos) {
+		readFileNum, readPos = writeFileNum, writePos
+	}
+
+	metaDepth := atomic.LoadInt64(&d.depth)
+	if metaDepth >= 0 && metaDepth != depth {
+		problem("depth %d isn't the %d records left", metaDepth, depth)
+	}
+
+	for _, p := range problems {
+		log.Printf("DATAPATH: diskqueue(%s) %s", name, p)
+	}
+	if !repair || len(problems) == 0 {
+		return len(problems)
+	}
+
+	for fileNum, size := range truncate {
+		err := os.Truncate(d.fileName(fileNum), size)
+		if err != nil {
+			log.Printf("ERROR: diskqueue(%s) failed to truncate %s - %s", name, d.fileName(fileNum), err.Error())
+		}
+	}
+
+	d.readFileNum, d.readPos = readFileNum, readPos
+	d.writeFileNum, d.writePos = writeFileNum, writePos
+	atomic.StoreInt64(&d.depth, depth)
+	err = d.persistMetaData()
+	if err != nil {
+		log.Printf("ERROR: diskqueue(%s) failed to persist repaired metadata - %s", name, err.Error())
+		return len(problems)
+	}
+	log.Printf("DATAPATH: diskqueue(%s) repaired, depth %d reading %d,%d writing %d,%d",
+		name, depth, readFileNum, readPos, writeFileNum, writePos)
+
+	return len(problems)
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
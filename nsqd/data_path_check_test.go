@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCheckDataPathRepair(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dataPath, err := ioutil.TempDir("", "nsq-test-check-data-path")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dataPath)
+
+	dqName := "test_check_data_path"
+	dq := NewDiskQueue(dqName, dataPath, 100, 2500, 2*time.Second, 0)
+	msg := []byte("aaaaaaaaaa")
+	for i := 0; i < 10; i++ {
+		err := dq.Put(msg)
+		assert.Equal(t, err, nil)
+	}
+	dq.Close()
+
+	// a record written after the metadata was last synced, then a crash
+	// part way through the next one
+	f, err := os.OpenFile(dq.(*DiskQueue).fileName(1), os.O_WRONLY|os.O_APPEND, 0600)
+	assert.Equal(t, err, nil)
+	binary.Write(f, binary.BigEndian, int32(len(msg)))
+	f.Write(msg)
+	binary.Write(f, binary.BigEndian, int32(len(msg)))
+	f.Write(msg[:3])
+	f.Close()
+
+	options := NewNSQDOptions()
+	options.DataPath = dataPath
+	n := &NSQD{options: options}
+
+	// truncated, records past the write position and the wrong depth
+	assert.Equal(t, n.CheckDataPath(false), 3)
+	assert.Equal(t, n.CheckDataPath(true), 3)
+	assert.Equal(t, n.CheckDataPath(false), 0)
+
+	dq = NewDiskQueue(dqName, dataPath, 100, 2500, 2*time.Second, 0)
+	defer dq.Close()
+	assert.Equal(t, dq.Depth(), int64(11))
+	for i := 0; i < 11; i++ {
+		assert.Equal(t, <-dq.ReadChan(), msg)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// frameTypeDeadlineMessage frames are messages sent to a client that
+// negotiated msg_deadlines, the message is prefixed by the 8-byte deadline
+// (unix nanoseconds) by which it has to be FIN'd, REQ'd or TOUCH'd before it
+// times out (and is requeued), it is taken just before the in-flight timeout
+// starts so that it is never later than the timeout
+const frameTypeDeadlineMessage int32 = 7
+
+func (p *ProtocolV2) SendDeadlineMessage(client *ClientV2, msg *nsq.Message, deadline time.Time, buf *bytes.Buffer) error {
+	if client.debugLogging() {
+		log.Printf("PROTOCOL(V2): writing msg(%s) with deadline %s to client(%s) - %s",
+			msg.Id, deadline, client, msg.Body)
+	}
+
+	buf.Reset()
+	err := binary.Write(buf, binary.BigEndian, deadline.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	writeMessageHeader(buf, msg)
+	return p.sendParts(client, frameTypeDeadlineMessage, buf.Bytes(), msg.Body)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// verbose logging (of the protocol and of clients' state) for --verbose is
+// for everything, which is far too much on a busy nsqd, so it can instead be
+// turned on at runtime (see /debug/logging) for a scope, the clients of a
+// topic, of a channel or a single client, until it expires
+const (
+	defaultDebugLoggingDuration = 5 * time.Minute
+	maxDebugLoggingDuration     = time.Hour
+)
+
+var errInvalidDebugScope = errors.New("invalid debug logging scope")
+
+// debugScope matches the clients of topic/channel/client (an empty field
+// matches anything), client is an address, either host:port or just the host
+type debugScope struct {
+	Topic   string    `json:"topic,omitempty"`
+	Channel string    `json:"channel,omitempty"`
+	Client  string    `json:"client,omitempty"`
+	Expires time.Time `json:"expires"`
+
+	timer *time.Timer
+}
+
+func (s *debugScope) matches(topicName string, channelName string, remoteAddr string) bool {
+	if s.Topic != "" && s.Topic != topicName {
+		return false
+	}
+	if s.Channel != "" && s.Channel != channelName {
+		return false
+	}
+	if s.Client != "" && s.Client != remoteAddr {
+		host, _, _ := net.SplitHostPort(remoteAddr)
+		if s.Client != host {
+			return false
+		}
+	}
+	return true
+}
+
+type debugLogging struct {
+	// the number of scopes, so that the common case (none) doesn't lock
+	count int32
+
+	sync.RWMutex
+	scopes []*debugScope
+}
+
+// Set turns on verbose logging for a scope for duration (renewing it if it's
+// already on), a zero duration turns it off
+func (d *debugLogging) Set(topicName string, channelName string, client string, duration time.Duration) error {
+	if topicName == "" && channelName == "" && client == "" {
+		// that's --verbose
+		return errInvalidDebugScope
+	}
+	if channelName != "" && topicName == "" {
+		return errInvalidDebugScope
+	}
+	if duration < 0 || duration > maxDebugLoggingDuration {
+		return errInvalidDebugScope
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	for i, s := range d.scopes {
+		if s.Topic == topicName && s.Channel == channelName && s.Client == client {
+			s.timer.Stop()
+			d.scopes = append(d.scopes[:i], d.scopes[i+1:]...)
+			break
+		}
+	}
+
+	if duration > 0 {
+		s := &debugScope{
+			Topic:   topicName,
+			Channel: channelName,
+			Client:  client,
+			Expires: time.Now().Add(duration),
+		}
+		s.timer = time.AfterFunc(duration, func() { d.expire(s) })
+		d.scopes = append(d.scopes, s)
+		log.Printf("DEBUG: verbose logging for topic:%q channel:%q client:%q until %s",
+			topicName, channelName, client, s.Expires)
+	} else {
+		log.Printf("DEBUG: verbose logging off for topic:%q channel:%q client:%q",
+			topicName, channelName, client)
+	}
+
+	atomic.StoreInt32(&d.count, int32(len(d.scopes)))
+	return nil
+}
+
+func (d *debugLogging) expire(scope *debugScope) {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, s := range d.scopes {
+		if s == scope {
+			d.scopes = append(d.scopes[:i], d.scopes[i+1:]...)
+			log.Printf("DEBUG: verbose logging expired for topic:%q channel:%q client:%q",
+				s.Topic, s.Channel, s.Client)
+			break
+		}
+	}
+	atomic.StoreInt32(&d.count, int32(len(d.scopes)))
+}
+
+// Scopes returns (a copy of) the scopes verbose logging is on for
+func (d *debugLogging) Scopes() []debugScope {
+	d.RLock()
+	defer d.RUnlock()
+
+	scopes := make([]debugScope, 0, len(d.scopes))
+	for _, s := range d.scopes {
+		scopes = append(scopes, *s)
+	}
+	return scopes
+}
+
+// Enabled returns whether verbose logging is on (by --verbose or for a scope)
+// for a client of remoteAddr subscribed to channelName of topicName
+func (d *debugLogging) Enabled(topicName string, channelName string, remoteAddr string) bool {
+	if *verbose {
+		return true
+	}
+	if atomic.LoadInt32(&d.count) == 0 {
+		return false
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+	for _, s := range d.scopes {
+		if s.matches(topicName, channelName, remoteAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// debugLogging returns whether verbose logging is on for this client
+func (c *ClientV2) debugLogging() bool {
+	var topicName, channelName string
+	if channel := c.Channel; channel != nil {
+		topicName = channel.topicName
+		channelName = channel.name
+	}
+	return c.context.nsqd.debugLogging.Enabled(topicName, channelName, c.String())
+}
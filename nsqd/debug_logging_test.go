@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestDebugLoggingScopes(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	d := &debugLogging{}
+	assert.Equal(t, d.Enabled("events", "archive", "10.0.0.1:4000"), false)
+
+	// nothing, or a channel without its topic, isn't a scope
+	assert.Equal(t, d.Set("", "", "", time.Minute), errInvalidDebugScope)
+	assert.Equal(t, d.Set("", "archive", "", time.Minute), errInvalidDebugScope)
+	assert.Equal(t, d.Set("events", "", "", 2*time.Hour), errInvalidDebugScope)
+
+	err := d.Set("events", "archive", "", time.Minute)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, d.Enabled("events", "archive", "10.0.0.1:4000"), true)
+	assert.Equal(t, d.Enabled("events", "metrics", "10.0.0.1:4000"), false)
+	assert.Equal(t, d.Enabled("", "", "10.0.0.1:4000"), false)
+
+	err = d.Set("", "", "10.0.0.2", 50*time.Millisecond)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, d.Enabled("", "", "10.0.0.2:4000"), true)
+	assert.Equal(t, len(d.Scopes()), 2)
+
+	// scopes expire
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, d.Enabled("", "", "10.0.0.2:4000"), false)
+	assert.Equal(t, len(d.Scopes()), 1)
+
+	// and can be turned off
+	err = d.Set("events", "archive", "", 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, d.Enabled("events", "archive", "10.0.0.1:4000"), false)
+	assert.Equal(t, len(d.Scopes()), 0)
+}
+
+func TestHTTPDebugLogging(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.HTTPDebugAuthToken = "secret"
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	// only with --http-debug
+	url := fmt.Sprintf("http://%s/debug/logging?topic=events&duration=1m", httpAddr)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 404)
+
+	options.HTTPDebug = true
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 401)
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	scopes := nsqd.debugLogging.Scopes()
+	assert.Equal(t, len(scopes), 1)
+	assert.Equal(t, scopes[0].Topic, "events")
+	assert.Equal(t, nsqd.debugLogging.Enabled("events", "archive", "10.0.0.1:4000"), true)
+}
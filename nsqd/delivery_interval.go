@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// a channel can be given a minimum interval between the messages it delivers
+// (whatever the RDY of its clients) so that consumers driving a rate limited
+// third party API can't exceed its limit, ie. an interval of 100ms delivers
+// at most 10 messages per second across all of the channel's clients
+
+var errInvalidDeliveryInterval = errors.New("invalid delivery interval")
+
+// SetDeliveryInterval sets the minimum interval between the channel's
+// deliveries, 0 doesn't throttle it
+func (c *Channel) SetDeliveryInterval(interval time.Duration) error {
+	if interval < 0 {
+		return errInvalidDeliveryInterval
+	}
+
+	atomic.StoreInt64(&c.deliveryInterval, int64(interval))
+	log.Printf("CHANNEL(%s): delivery interval %s", c.name, interval)
+
+	c.context.nsqd.Lock()
+	defer c.context.nsqd.Unlock()
+	return c.context.nsqd.PersistMetadata()
+}
+
+func (c *Channel) DeliveryInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.deliveryInterval))
+}
+
+// throttleDelivery waits (in messagePump) until msg can be delivered
+// according to the delivery interval and the time of the last delivery, it
+// returns false when the channel exits first (msg is then flushed)
+func (c *Channel) throttleDelivery(msg *nsq.Message, lastDelivery time.Time) bool {
+	interval := c.DeliveryInterval()
+	if interval <= 0 || lastDelivery.IsZero() {
+		return true
+	}
+
+	wait := lastDelivery.Add(interval).Sub(time.Now())
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.exitChan:
+		// flush() drains clientMsgChan until we close it
+		c.clientMsgChan <- msg
+		return false
+	}
+	return true
+}
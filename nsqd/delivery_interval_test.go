@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestChannelDeliveryInterval(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_delivery_interval" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/set_channel_delivery_interval?topic=%s&channel=ch&interval=50ms", httpAddr, topicName)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, channel.DeliveryInterval(), 50*time.Millisecond)
+	assert.Equal(t, NewChannelStats(channel, nil).DeliveryInterval, int64(50))
+
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	sub(t, conn, topicName, "ch")
+	err = nsq.Ready(5).Write(conn)
+	assert.Equal(t, err, nil)
+
+	// whatever the RDY, the messages are delivered at least 50ms apart
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, _, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	}
+	assert.Equal(t, time.Since(start) >= 200*time.Millisecond, true)
+
+	url = fmt.Sprintf("http://%s/set_channel_delivery_interval?topic=%s&channel=ch&interval=-1s", httpAddr, topicName)
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+
+	// without an interval it isn't throttled
+	url = fmt.Sprintf("http://%s/set_channel_delivery_interval?topic=%s&channel=ch", httpAddr, topicName)
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, channel.DeliveryInterval(), time.Duration(0))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// by default a channel's messagePump reads from its in-memory queue and its
+// backend (disk) queue as messages become available on either, so once
+// messages have spilled to disk they're delivered interleaved with (newer)
+// messages in memory... a channel with the "fifo" delivery order drains its
+// backlog first: while the backend has a depth, messages are read only from it
+// and new messages are queued behind the backlog (written to the backend), so
+// that ordering is approximately preserved after a spill
+
+// deliveryOrder decides whether a channel drains its backlog first
+type deliveryOrder int32
+
+const (
+	// read from memory and the backend as messages become available
+	deliveryOrderDefault deliveryOrder = iota
+	// drain the backend before reading from memory again
+	deliveryOrderFIFO
+)
+
+func parseDeliveryOrder(s string) (deliveryOrder, error) {
+	switch s {
+	case "", "default":
+		return deliveryOrderDefault, nil
+	case "fifo":
+		return deliveryOrderFIFO, nil
+	}
+	return deliveryOrderDefault, fmt.Errorf("invalid delivery order %q", s)
+}
+
+func (o deliveryOrder) String() string {
+	switch o {
+	case deliveryOrderFIFO:
+		return "fifo"
+	}
+	return "default"
+}
+
+func (c *Channel) SetDeliveryOrder(o deliveryOrder) error {
+	atomic.StoreInt32(&c.deliveryOrder, int32(o))
+	log.Printf("CHANNEL(%s): delivery order %s", c.name, o)
+
+	c.context.nsqd.Lock()
+	defer c.context.nsqd.Unlock()
+	return c.context.nsqd.PersistMetadata()
+}
+
+func (c *Channel) DeliveryOrder() deliveryOrder {
+	return deliveryOrder(atomic.LoadInt32(&c.deliveryOrder))
+}
+
+// drainingBacklog returns whether messages are to be read from (and queued
+// behind) the channel's backlog rather than memory
+func (c *Channel) drainingBacklog() bool {
+	return c.DeliveryOrder() == deliveryOrderFIFO && c.backend.Depth() > 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestChannelDeliveryOrderFIFO(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_delivery_order" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/set_channel_delivery_order?topic=%s&channel=ch&order=fifo", httpAddr, topicName)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, channel.DeliveryOrder(), deliveryOrderFIFO)
+	assert.Equal(t, NewChannelStats(channel, nil).DeliveryOrder, "fifo")
+
+	// a backlog (messagePump holds the first while there's no client)
+	var msgBuf bytes.Buffer
+	var ids []nsq.MessageID
+	for i := 0; i < 2; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+		ids = append(ids, msg.Id)
+		err = WriteMessageToBackend(&msgBuf, msg, channel.backend)
+		assert.Equal(t, err, nil)
+	}
+	for i := 0; i < 100 && channel.backend.Depth() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, channel.backend.Depth(), int64(1))
+
+	// is queued behind it
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	ids = append(ids, msg.Id)
+	channel.PutMessage(msg)
+	for i := 0; i < 100 && channel.backend.Depth() != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, channel.backend.Depth(), int64(2))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	sub(t, conn, topicName, "ch")
+	err = nsq.Ready(3).Write(conn)
+	assert.Equal(t, err, nil)
+
+	for _, id := range ids {
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, frameType, nsq.FrameTypeMessage)
+		msgOut, err := nsq.DecodeMessage(data)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, msgOut.Id, id)
+	}
+
+	_, err = parseDeliveryOrder("lifo")
+	assert.NotEqual(t, err, nil)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bitly/nsq/util"
+)
+
+// the interval at which channel depths are compared against their watermarks
+const depthWebhookCheckInterval = time.Second
+
+type depthWebhookPayload struct {
+	Event     string `json:"event"`
+	Topic     string `json:"topic"`
+	Channel   string `json:"channel"`
+	Depth     int64  `json:"depth"`
+	Watermark int64  `json:"watermark"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// watermarkState tracks, per channel, which side of the watermarks we last
+// reported and when (for debouncing)
+type watermarkState struct {
+	high     bool
+	lastSent time.Time
+}
+
+// depthWebhookLoop periodically compares the depth of each channel that has
+// watermarks configured and POSTs to --depth-webhook-url when a channel
+// crosses its high watermark (or falls back below its low watermark)
+func (n *NSQD) depthWebhookLoop() {
+	states := make(map[*Channel]*watermarkState)
+	httpclient := &http.Client{Transport: util.NewDeadlineTransport(2 * time.Second)}
+	ticker := time.NewTicker(depthWebhookCheckInterval)
+	for {
+		select {
+		case <-n.exitChan:
+			goto exit
+		case <-ticker.C:
+			seen := make(map[*Channel]bool)
+			for _, c := range n.channels() {
+				high, low := c.Watermarks()
+				if high <= 0 || c.MirrorOf() != "" {
+					continue
+				}
+				seen[c] = true
+
+				state, ok := states[c]
+				if !ok {
+					state = &watermarkState{}
+					states[c] = state
+				}
+
+				if time.Now().Sub(state.lastSent) < n.options.DepthWebhookDebounce {
+					continue
+				}
+
+				depth := c.Depth()
+				payload := &depthWebhookPayload{
+					Topic:     c.topicName,
+					Channel:   c.name,
+					Depth:     depth,
+					Timestamp: time.Now().Unix(),
+				}
+				switch {
+				case !state.high && depth >= high:
+					payload.Event = "high_watermark"
+					payload.Watermark = high
+				case state.high && depth <= low:
+					payload.Event = "low_watermark"
+					payload.Watermark = low
+				default:
+					continue
+				}
+
+				err := postWebhook(httpclient, n.options.DepthWebhookURL, payload)
+				if err != nil {
+					log.Printf("ERROR: CHANNEL(%s:%s) depth webhook failed - %s",
+						c.topicName, c.name, err.Error())
+					continue
+				}
+				state.high = !state.high
+				state.lastSent = time.Now()
+			}
+
+			// forget channels that were deleted or had their watermarks cleared
+			for c := range states {
+				if !seen[c] {
+					delete(states, c)
+				}
+			}
+		}
+	}
+
+exit:
+	ticker.Stop()
+}
+
+// postWebhook POSTs payload (as JSON) to endpoint
+func postWebhook(httpclient *http.Client, endpoint string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpclient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got response %s", resp.Status)
+	}
+	return nil
+}
+
+// channels returns a snapshot of every channel across all topics
+func (n *NSQD) channels() []*Channel {
+	channels := make([]*Channel, 0)
+	n.RLock()
+	for _, t := range n.topicMap {
+		t.RLock()
+		for _, c := range t.channelMap {
+			channels = append(channels, c)
+		}
+		t.RUnlock()
+	}
+	n.RUnlock()
+	return channels
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestDepthWebhook(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	payloadChan := make(chan *depthWebhookPayload, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var payload depthWebhookPayload
+		json.NewDecoder(req.Body).Decode(&payload)
+		payloadChan <- &payload
+	}))
+	defer ts.Close()
+
+	options := NewNSQDOptions()
+	options.DepthWebhookURL = ts.URL
+	options.DepthWebhookDebounce = 0
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_depth_webhook" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	err := channel.SetWatermarks(5, 10)
+	assert.NotEqual(t, err, nil)
+	err = channel.SetWatermarks(5, 1)
+	assert.Equal(t, err, nil)
+
+	metadata, err := getMetadata(nsqd)
+	assert.Equal(t, err, nil)
+	channelJs := metadata.Get("topics").GetIndex(0).Get("channels").GetIndex(0)
+	assert.Equal(t, channelJs.Get("high_watermark").MustInt64(), int64(5))
+	assert.Equal(t, channelJs.Get("low_watermark").MustInt64(), int64(1))
+
+	for i := 0; i < 10; i++ {
+		var id nsq.MessageID
+		channel.PutMessage(nsq.NewMessage(id, []byte("test")))
+	}
+
+	var payload *depthWebhookPayload
+	select {
+	case payload = <-payloadChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for high watermark webhook")
+	}
+	assert.Equal(t, payload.Event, "high_watermark")
+	assert.Equal(t, payload.Topic, topicName)
+	assert.Equal(t, payload.Channel, "ch")
+	assert.Equal(t, payload.Watermark, int64(5))
+	assert.Equal(t, payload.Depth >= 5, true)
+
+	channel.Empty()
+
+	select {
+	case payload = <-payloadChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for low watermark webhook")
+	}
+	assert.Equal(t, payload.Event, "low_watermark")
+	assert.Equal(t, payload.Watermark, int64(1))
+	assert.Equal(t, payload.Depth <= 1, true)
+}
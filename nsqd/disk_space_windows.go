@@ -0,0 +1,41 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                = syscall.NewLazyDLL("kernel32.dll")
+	procGetDiskFreeSpaceExW = kernel32.NewProc("GetDiskFreeSpaceExW")
+)
+
+// freeDiskBytes returns the space available (to the calling user) on the
+// volume containing path
+func freeDiskBytes(path string) (uint64, error) {
+	p := syscall.StringToUTF16Ptr(path)
+	var available, total, free uint64
+	r, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&available)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&free)))
+	if r == 0 {
+		return 0, err
+	}
+	return available, nil
+}
+
+// diskUsage returns the total size of, and the space available (to the
+// user) on, the volume containing path
+func diskUsage(path string) (uint64, uint64, error) {
+	p := syscall.StringToUTF16Ptr(path)
+	var available, total, free uint64
+	r, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&available)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&free)))
+	if r == 0 {
+		return 0, 0, err
+	}
+	return total, available, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var errReadOnly = errors.New("nsqd is read-only (low disk space)")
+
+// diskWatchdogLoop periodically checks the free space on the --data-path
+// volume and puts nsqd in read-only mode (publishes are rejected, delivery
+// continues) while it is below --min-free-disk-bytes... running out of space
+// part way through a diskqueue write would corrupt the file
+func (n *NSQD) diskWatchdogLoop() {
+	ticker := time.NewTicker(n.options.DiskCheckInterval)
+	n.checkDiskSpace()
+	for {
+		select {
+		case <-n.exitChan:
+			goto exit
+		case <-ticker.C:
+			n.checkDiskSpace()
+		}
+	}
+
+exit:
+	log.Printf("DISK WATCHDOG: closing")
+	ticker.Stop()
+}
+
+func (n *NSQD) checkDiskSpace() {
+	dataPath := n.options.DataPath
+	if dataPath == "" {
+		dataPath = "."
+	}
+
+	free, err := freeDiskBytes(dataPath)
+	if err != nil {
+		log.Printf("ERROR: failed to get free disk space of %s - %s", dataPath, err.Error())
+		return
+	}
+
+	if free < uint64(n.options.MinFreeDiskBytes) {
+		if atomic.CompareAndSwapInt32(&n.readOnly, 0, 1) {
+			log.Printf("DISK WATCHDOG: %s has %d bytes free (< %d), entering read-only mode",
+				dataPath, free, n.options.MinFreeDiskBytes)
+		}
+	} else if atomic.CompareAndSwapInt32(&n.readOnly, 1, 0) {
+		log.Printf("DISK WATCHDOG: %s has %d bytes free, leaving read-only mode", dataPath, free)
+	}
+}
+
+// IsReadOnly returns whether publishes are currently being rejected because
+// of low disk space
+func (n *NSQD) IsReadOnly() bool {
+	return atomic.LoadInt32(&n.readOnly) == 1
+}
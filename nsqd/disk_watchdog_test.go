@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestDiskWatchdog(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_disk_watchdog" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("before")))
+
+	// (the watchdog loop isn't running, we check by hand)
+	assert.Equal(t, nsqd.IsReadOnly(), false)
+	// no volume has this much free space
+	nsqd.options.MinFreeDiskBytes = math.MaxInt64
+	nsqd.checkDiskSpace()
+	assert.Equal(t, nsqd.IsReadOnly(), true)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+
+	// publishing is rejected, but the connection stays open
+	err = nsq.Publish(topicName, []byte("test body")).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data[:11]), "E_READ_ONLY")
+
+	url := fmt.Sprintf("http://%s/put?topic=%s", httpAddr, topicName)
+	httpResp, err := http.Post(url, "application/octet-stream", strings.NewReader("test body"))
+	assert.Equal(t, err, nil)
+	httpResp.Body.Close()
+	assert.Equal(t, httpResp.StatusCode, 503)
+
+	// delivery continues
+	sub(t, conn, topicName, "ch")
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msg, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msg.Body, []byte("before"))
+
+	// and recovers once there's enough space
+	nsqd.options.MinFreeDiskBytes = 1
+	nsqd.checkDiskSpace()
+	assert.Equal(t, nsqd.IsReadOnly(), false)
+
+	err = nsq.Publish(topicName, []byte("after")).Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeResponse, "OK")
+	assert.Equal(t, channel.Depth()+int64(len(channel.inFlightMessages)), int64(2))
+}
@@ -15,6 +15,14 @@ import (
 	"time"
 )
 
+const (
+	// how much of the read file is buffered (so that reading isn't a syscall
+	// per message when a channel is disk bound)
+	diskQueueReadAheadBytes = 64 * 1024
+	// the most written (for concurrent writers) with a single syscall
+	diskQueueMaxWriteBatchBytes = 1024 * 1024
+)
+
 // DiskQueue implements the BackendQueue interface
 // providing a filesystem backed FIFO queue
 type DiskQueue struct {
@@ -33,8 +41,9 @@ type DiskQueue struct {
 	name            string
 	dataPath        string
 	maxBytesPerFile int64         // currently this cannot change once created
-	syncEvery       int64         // number of writes per fsync
-	syncTimeout     time.Duration // duration of time per fsync
+	syncEvery       int64         // number of writes per fsync (1 fsyncs before a write returns)
+	syncTimeout     time.Duration // duration of time per fsync (0 disables)
+	writeWindow     time.Duration // how long concurrent writes wait for others to batch with (0 only batches those already waiting)
 	exitFlag        int32
 	needSync        bool
 
@@ -43,39 +52,66 @@ type DiskQueue struct {
 	nextReadPos     int64
 	nextReadFileNum int64
 
+	// the data read ahead (exposed via Peek())
+	headMutex sync.Mutex
+	head      []byte
+
 	readFile  *os.File
 	writeFile *os.File
 	reader    *bufio.Reader
 	writeBuf  bytes.Buffer
+	lenBuf    [4]byte
 
 	// exposed via ReadChan()
 	readChan chan []byte
 
 	// internal channels
-	writeChan         chan []byte
-	writeResponseChan chan error
-	emptyChan         chan int
-	emptyResponseChan chan error
-	exitChan          chan int
-	exitSyncChan      chan int
+	writeChan          chan []byte
+	writeManyChan      chan [][]byte
+	writeResponseChan  chan error
+	emptyChan          chan int
+	emptyResponseChan  chan error
+	filterChan         chan func([]byte) bool
+	filterResponseChan chan filterResult
+	skipChan           chan func([]byte) bool
+	skipResponseChan   chan filterResult
+	positionChan       chan int
+	positionResponse   chan diskQueuePosition
+	syncChan           chan int
+	syncResponseChan   chan error
+	setSyncChan        chan diskQueueSyncInterval
+	exitChan           chan int
+	exitSyncChan       chan int
 }
 
 // NewDiskQueue instantiates a new instance of DiskQueue, retrieving metadata
 // from the filesystem and starting the read ahead goroutine
-func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery int64, syncTimeout time.Duration) BackendQueue {
+func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery int64, syncTimeout time.Duration,
+	writeWindow time.Duration) BackendQueue {
 	d := DiskQueue{
-		name:              name,
-		dataPath:          dataPath,
-		maxBytesPerFile:   maxBytesPerFile,
-		readChan:          make(chan []byte),
-		writeChan:         make(chan []byte),
-		writeResponseChan: make(chan error),
-		emptyChan:         make(chan int),
-		emptyResponseChan: make(chan error),
-		exitChan:          make(chan int),
-		exitSyncChan:      make(chan int),
-		syncEvery:         syncEvery,
-		syncTimeout:       syncTimeout,
+		name:               name,
+		dataPath:           dataPath,
+		maxBytesPerFile:    maxBytesPerFile,
+		readChan:           make(chan []byte),
+		writeChan:          make(chan []byte),
+		writeManyChan:      make(chan [][]byte),
+		writeResponseChan:  make(chan error),
+		emptyChan:          make(chan int),
+		emptyResponseChan:  make(chan error),
+		filterChan:         make(chan func([]byte) bool),
+		filterResponseChan: make(chan filterResult),
+		skipChan:           make(chan func([]byte) bool),
+		skipResponseChan:   make(chan filterResult),
+		positionChan:       make(chan int),
+		positionResponse:   make(chan diskQueuePosition),
+		syncChan:           make(chan int),
+		syncResponseChan:   make(chan error),
+		setSyncChan:        make(chan diskQueueSyncInterval),
+		exitChan:           make(chan int),
+		exitSyncChan:       make(chan int),
+		syncEvery:          syncEvery,
+		syncTimeout:        syncTimeout,
+		writeWindow:        writeWindow,
 	}
 
 	// no need to lock here, nothing else could possibly be touching this instance
@@ -99,6 +135,20 @@ func (d *DiskQueue) ReadChan() chan []byte {
 	return d.readChan
 }
 
+// Peek returns the data that will next be sent over ReadChan(), nil if that
+// hasn't been read yet (ie. the queue is empty)
+func (d *DiskQueue) Peek() []byte {
+	d.headMutex.Lock()
+	defer d.headMutex.Unlock()
+	return d.head
+}
+
+func (d *DiskQueue) setHead(data []byte) {
+	d.headMutex.Lock()
+	d.head = data
+	d.headMutex.Unlock()
+}
+
 // Put writes a []byte to the queue
 func (d *DiskQueue) Put(data []byte) error {
 	d.RLock()
@@ -112,13 +162,27 @@ func (d *DiskQueue) Put(data []byte) error {
 	return <-d.writeResponseChan
 }
 
+// PutMany writes a batch of []byte to the queue, none of which is read until
+// the whole batch is written
+func (d *DiskQueue) PutMany(batch [][]byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.writeManyChan <- batch
+	return <-d.writeResponseChan
+}
+
 // Close cleans up the queue and persists metadata
 func (d *DiskQueue) Close() error {
-	err := d.exit(false)
-	if err != nil {
-		return err
-	}
-	return d.sync()
+	return d.exit(false)
 }
 
 func (d *DiskQueue) Delete() error {
@@ -141,6 +205,16 @@ func (d *DiskQueue) exit(deleted bool) error {
 	// ensure that ioLoop has exited
 	<-d.exitSyncChan
 
+	var err error
+	if !deleted {
+		// fsync what was written (and persist our positions) before the
+		// write file is closed, otherwise it's left to the OS to flush
+		err = d.sync()
+		if err != nil {
+			log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+		}
+	}
+
 	if d.readFile != nil {
 		d.readFile.Close()
 		d.readFile = nil
@@ -151,7 +225,7 @@ func (d *DiskQueue) exit(deleted bool) error {
 		d.writeFile = nil
 	}
 
-	return nil
+	return err
 }
 
 // Empty destructively clears out any pending data in the queue
@@ -170,6 +244,225 @@ func (d *DiskQueue) Empty() error {
 	return <-d.emptyResponseChan
 }
 
+type filterResult struct {
+	count int64
+	err   error
+}
+
+// Filter removes the data fn returns true for, returning how many were removed
+func (d *DiskQueue) Filter(fn func([]byte) bool) (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, errors.New("exiting")
+	}
+
+	d.filterChan <- fn
+	result := <-d.filterResponseChan
+	return result.count, result.err
+}
+
+// filter walks the queue once, from the read position (starting with the data
+// already read ahead, if any) to the write position as it was, every record
+// is read and either dropped or re-written at the tail (so order is kept)
+func (d *DiskQueue) filter(fn func([]byte) bool, readAhead []byte) (int64, error) {
+	var removed int64
+
+	log.Printf("DISKQUEUE(%s): filtering", d.name)
+
+	defer d.setHead(nil)
+	// significant state change, schedule a sync on the next iteration
+	d.needSync = true
+
+	depth := atomic.LoadInt64(&d.depth)
+	for i := int64(0); i < depth; i++ {
+		data := readAhead
+		readAhead = nil
+		if data == nil {
+			var err error
+			data, err = d.readOne()
+			if err != nil {
+				return removed, err
+			}
+		}
+		d.moveForward()
+
+		if fn(data) {
+			removed++
+			continue
+		}
+		err := d.writeOne(data)
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// SkipWhile advances the read position past the data at the head of the
+// queue that fn returns true for, returning how many were skipped
+func (d *DiskQueue) SkipWhile(fn func([]byte) bool) (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, errors.New("exiting")
+	}
+
+	d.skipChan <- fn
+	result := <-d.skipResponseChan
+	return result.count, result.err
+}
+
+// skipWhile moves forward (starting with the data already read ahead, if any)
+// until fn returns false, that data is returned as the new read ahead
+func (d *DiskQueue) skipWhile(fn func([]byte) bool, readAhead []byte) (int64, []byte, error) {
+	var skipped int64
+
+	for (d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos) {
+		data := readAhead
+		readAhead = nil
+		if data == nil {
+			var err error
+			data, err = d.readOne()
+			if err != nil {
+				d.setHead(nil)
+				return skipped, nil, err
+			}
+		}
+
+		if !fn(data) {
+			d.setHead(data)
+			return skipped, data, nil
+		}
+		d.moveForward()
+		skipped++
+		// significant state change, schedule a sync on the next iteration
+		d.needSync = true
+	}
+
+	d.setHead(nil)
+	return skipped, nil, nil
+}
+
+// Sync fsyncs what has been written (and the metadata) now
+func (d *DiskQueue) Sync() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.syncChan <- 1
+	return <-d.syncResponseChan
+}
+
+type diskQueueSyncInterval struct {
+	syncEvery   int64
+	syncTimeout time.Duration
+}
+
+// SetSyncInterval changes how often writes are fsync'd, every syncEvery
+// writes (1 fsyncs before each write returns, 0 disables) and every
+// syncTimeout (0 disables)
+func (d *DiskQueue) SetSyncInterval(syncEvery int64, syncTimeout time.Duration) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return
+	}
+
+	d.setSyncChan <- diskQueueSyncInterval{syncEvery, syncTimeout}
+}
+
+// diskQueuePosition is where a DiskQueue is reading and writing
+type diskQueuePosition struct {
+	readFileNum  int64
+	readPos      int64
+	writeFileNum int64
+	writePos     int64
+}
+
+// Snapshot calls fn, in order, for the data queued when it was called
+// without reading it from the queue
+//
+// files are read directly (not by ioLoop) so that the queue can continue to
+// be written and read from, data read from the queue in the meantime may or
+// may not be included
+func (d *DiskQueue) Snapshot(fn func([]byte) error) error {
+	d.RLock()
+	if d.exitFlag == 1 {
+		d.RUnlock()
+		return errors.New("exiting")
+	}
+	d.positionChan <- 1
+	pos := <-d.positionResponse
+	d.RUnlock()
+
+	for fileNum := pos.readFileNum; fileNum <= pos.writeFileNum; fileNum++ {
+		start := int64(0)
+		if fileNum == pos.readFileNum {
+			start = pos.readPos
+		}
+		end := int64(-1)
+		if fileNum == pos.writeFileNum {
+			end = pos.writePos
+		}
+		err := d.snapshotFile(d.fileName(fileNum), start, end, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotFile calls fn for the data in fileName from start until end
+// (or the end of the file when end is -1)
+func (d *DiskQueue) snapshotFile(fileName string, start int64, end int64, fn func([]byte) error) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// it's since been read
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(start, 0)
+	if err != nil {
+		return err
+	}
+
+	var msgSize int32
+	reader := bufio.NewReader(f)
+	for pos := start; end < 0 || pos < end; {
+		err = binary.Read(reader, binary.BigEndian, &msgSize)
+		if err == io.EOF && end < 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data := make([]byte, msgSize)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return err
+		}
+		pos += int64(4 + msgSize)
+
+		err = fn(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *DiskQueue) deleteAllFiles() error {
 	err := d.skipToNextRWFile()
 
@@ -239,15 +532,16 @@ func (d *DiskQueue) readOne() ([]byte, error) {
 			}
 		}
 
-		d.reader = bufio.NewReader(d.readFile)
+		d.reader = bufio.NewReaderSize(d.readFile, diskQueueReadAheadBytes)
 	}
 
-	err = binary.Read(d.reader, binary.BigEndian, &msgSize)
+	_, err = io.ReadFull(d.reader, d.lenBuf[:])
 	if err != nil {
 		d.readFile.Close()
 		d.readFile = nil
 		return nil, err
 	}
+	msgSize = int32(binary.BigEndian.Uint32(d.lenBuf[:]))
 
 	readBuf := make([]byte, msgSize)
 	_, err = io.ReadFull(d.reader, readBuf)
@@ -283,6 +577,41 @@ func (d *DiskQueue) readOne() ([]byte, error) {
 // writeOne performs a low level filesystem write for a single []byte
 // while advancing write positions and rolling files, if necessary
 func (d *DiskQueue) writeOne(data []byte) error {
+	return d.writeMany([][]byte{data})
+}
+
+// writeMany performs low level filesystem writes for a batch of []byte,
+// coalesced into as few writes as the file size allows, while advancing
+// write positions and rolling files, if necessary
+func (d *DiskQueue) writeMany(batch [][]byte) error {
+	var err error
+
+	d.writeBuf.Reset()
+	var count int64
+	for i, data := range batch {
+		binary.BigEndian.PutUint32(d.lenBuf[:], uint32(len(data)))
+		d.writeBuf.Write(d.lenBuf[:])
+		d.writeBuf.Write(data)
+		count++
+
+		// the file is rolled after the write that takes it past maxBytesPerFile
+		if i < len(batch)-1 && d.writePos+int64(d.writeBuf.Len()) <= d.maxBytesPerFile {
+			continue
+		}
+
+		err = d.flushWriteBuf(count)
+		if err != nil {
+			return err
+		}
+		d.writeBuf.Reset()
+		count = 0
+	}
+
+	return nil
+}
+
+// flushWriteBuf writes the count []byte in writeBuf with a single write
+func (d *DiskQueue) flushWriteBuf(count int64) error {
 	var err error
 
 	if d.writeFile == nil {
@@ -304,19 +633,6 @@ func (d *DiskQueue) writeOne(data []byte) error {
 		}
 	}
 
-	dataLen := len(data)
-
-	d.writeBuf.Reset()
-	err = binary.Write(&d.writeBuf, binary.BigEndian, int32(dataLen))
-	if err != nil {
-		return err
-	}
-
-	_, err = d.writeBuf.Write(data)
-	if err != nil {
-		return err
-	}
-
 	// only write to the file once
 	_, err = d.writeFile.Write(d.writeBuf.Bytes())
 	if err != nil {
@@ -325,9 +641,8 @@ func (d *DiskQueue) writeOne(data []byte) error {
 		return err
 	}
 
-	totalBytes := int64(4 + dataLen)
-	d.writePos += totalBytes
-	atomic.AddInt64(&d.depth, 1)
+	d.writePos += int64(d.writeBuf.Len())
+	atomic.AddInt64(&d.depth, count)
 
 	if d.writePos > d.maxBytesPerFile {
 		d.writeFileNum++
@@ -348,6 +663,53 @@ func (d *DiskQueue) writeOne(data []byte) error {
 	return err
 }
 
+// writeBatch writes data together with the writes that are waiting and
+// responds to all of them, it returns how many it wrote
+//
+// only when others are waiting (ie. there are concurrent writers) does it
+// wait up to writeWindow for more, a lone write (ie. from a topic's router,
+// which waits on each write) is written straight away
+func (d *DiskQueue) writeBatch(data []byte) int64 {
+	batch := [][]byte{data}
+	size := 4 + len(data)
+
+	var window <-chan time.Time
+gather:
+	for size < diskQueueMaxWriteBatchBytes {
+		if window == nil {
+			select {
+			case data := <-d.writeChan:
+				batch = append(batch, data)
+				size += 4 + len(data)
+				if d.writeWindow > 0 {
+					timer := time.NewTimer(d.writeWindow)
+					defer timer.Stop()
+					window = timer.C
+				}
+			default:
+				break gather
+			}
+		} else {
+			select {
+			case data := <-d.writeChan:
+				batch = append(batch, data)
+				size += 4 + len(data)
+			case <-window:
+				break gather
+			}
+		}
+	}
+
+	err := d.writeMany(batch)
+	if err == nil && d.syncEvery == 1 {
+		err = d.sync()
+	}
+	for _ = range batch {
+		d.writeResponseChan <- err
+	}
+	return int64(len(batch))
+}
+
 // sync fsyncs the current writeFile and persists metadata
 func (d *DiskQueue) sync() error {
 	if d.writeFile != nil {
@@ -530,13 +892,18 @@ func (d *DiskQueue) ioLoop() {
 	var err error
 	var count int64
 	var r chan []byte
+	var syncTicker *time.Ticker
+	var syncTickerChan <-chan time.Time
 
-	syncTicker := time.NewTicker(d.syncTimeout)
+	if d.syncTimeout > 0 {
+		syncTicker = time.NewTicker(d.syncTimeout)
+		syncTickerChan = syncTicker.C
+	}
 
 	for {
 		count++
 		// dont sync all the time :)
-		if count == d.syncEvery {
+		if d.syncEvery > 0 && count >= d.syncEvery {
 			count = 0
 			d.needSync = true
 		}
@@ -557,6 +924,7 @@ func (d *DiskQueue) ioLoop() {
 					d.handleReadError()
 					continue
 				}
+				d.setHead(dataRead)
 			}
 			r = d.readChan
 		} else {
@@ -567,12 +935,64 @@ func (d *DiskQueue) ioLoop() {
 		// the Go channel spec dictates that nil channel operations (read or write)
 		// in a select are skipped, we set r to d.readChan only when there is data to read
 		case r <- dataRead:
+			d.setHead(nil)
 			d.moveForward()
 		case <-d.emptyChan:
+			d.setHead(nil)
 			d.emptyResponseChan <- d.deleteAllFiles()
+		case fn := <-d.filterChan:
+			if r == nil {
+				dataRead = nil
+			}
+			removed, filterErr := d.filter(fn, dataRead)
+			dataRead = nil
+			d.filterResponseChan <- filterResult{removed, filterErr}
+		case fn := <-d.skipChan:
+			if r == nil {
+				dataRead = nil
+			}
+			var skipped int64
+			var skipErr error
+			skipped, dataRead, skipErr = d.skipWhile(fn, dataRead)
+			if skipErr != nil {
+				log.Printf("ERROR: skipping in diskqueue(%s) at %d of %s - %s",
+					d.name, d.readPos, d.fileName(d.readFileNum), skipErr.Error())
+			}
+			d.skipResponseChan <- filterResult{skipped, skipErr}
+		case <-d.positionChan:
+			d.positionResponse <- diskQueuePosition{
+				readFileNum:  d.readFileNum,
+				readPos:      d.readPos,
+				writeFileNum: d.writeFileNum,
+				writePos:     d.writePos,
+			}
 		case dataWrite := <-d.writeChan:
-			d.writeResponseChan <- d.writeOne(dataWrite)
-		case <-syncTicker.C:
+			// every write in the batch counts towards syncEvery (this one is
+			// counted at the top of the loop)
+			count += d.writeBatch(dataWrite) - 1
+		case batch := <-d.writeManyChan:
+			// (reads only resume once the whole batch is written)
+			err = d.writeMany(batch)
+			if err == nil && d.syncEvery == 1 {
+				err = d.sync()
+			}
+			d.writeResponseChan <- err
+			count += int64(len(batch)) - 1
+		case <-d.syncChan:
+			d.syncResponseChan <- d.sync()
+		case interval := <-d.setSyncChan:
+			d.syncEvery = interval.syncEvery
+			d.syncTimeout = interval.syncTimeout
+			count = 0
+			if syncTicker != nil {
+				syncTicker.Stop()
+				syncTicker, syncTickerChan = nil, nil
+			}
+			if d.syncTimeout > 0 {
+				syncTicker = time.NewTicker(d.syncTimeout)
+				syncTickerChan = syncTicker.C
+			}
+		case <-syncTickerChan:
 			d.needSync = true
 		case <-d.exitChan:
 			goto exit
@@ -581,6 +1001,8 @@ func (d *DiskQueue) ioLoop() {
 
 exit:
 	log.Printf("DISKQUEUE(%s): closing ... ioLoop", d.name)
-	syncTicker.Stop()
+	if syncTicker != nil {
+		syncTicker.Stop()
+	}
 	d.exitSyncChan <- 1
 }
@@ -18,7 +18,7 @@ func TestDiskQueue(t *testing.T) {
 	defer log.SetOutput(os.Stdout)
 
 	dqName := "test_disk_queue" + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 1024, 2500, 2*time.Second)
+	dq := NewDiskQueue(dqName, os.TempDir(), 1024, 2500, 2*time.Second, 0)
 	assert.NotEqual(t, dq, nil)
 	assert.Equal(t, dq.Depth(), int64(0))
 
@@ -36,7 +36,7 @@ func TestDiskQueueRoll(t *testing.T) {
 	defer log.SetOutput(os.Stdout)
 
 	dqName := "test_disk_queue_roll" + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 100, 2500, 2*time.Second)
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 2500, 2*time.Second, 0)
 	assert.NotEqual(t, dq, nil)
 	assert.Equal(t, dq.Depth(), int64(0))
 
@@ -51,6 +51,72 @@ func TestDiskQueueRoll(t *testing.T) {
 	assert.Equal(t, dq.(*DiskQueue).writePos, int64(28))
 }
 
+func TestDiskQueueWriteBatch(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_write_batch" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 1, 2*time.Second, 50*time.Millisecond)
+	assert.NotEqual(t, dq, nil)
+	defer dq.Delete()
+
+	// a lone write doesn't wait for the window
+	start := time.Now()
+	err := dq.Put([]byte("aaaaaaaaaa"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, time.Since(start) < 50*time.Millisecond, true)
+	<-dq.ReadChan()
+
+	// concurrent writes within the window are written (and fsync'd) together,
+	// and still roll files like they would one by one
+	var wg sync.WaitGroup
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := dq.Put([]byte("aaaaaaaaa" + strconv.Itoa(i)))
+			assert.Equal(t, err, nil)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, time.Since(start) < 500*time.Millisecond, true)
+	assert.Equal(t, dq.Depth(), int64(10))
+	assert.Equal(t, dq.(*DiskQueue).writeFileNum, int64(1))
+	assert.Equal(t, dq.(*DiskQueue).writePos, int64(42))
+
+	read := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		read[string(<-dq.ReadChan())] = true
+	}
+	assert.Equal(t, len(read), 10)
+}
+
+func TestDiskQueuePutMany(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_put_many" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 2500, 2*time.Second, 0)
+	assert.NotEqual(t, dq, nil)
+	defer dq.Delete()
+
+	// a batch rolls files like it would one by one
+	var batch [][]byte
+	for i := 0; i < 10; i++ {
+		batch = append(batch, []byte("aaaaaaaaa"+strconv.Itoa(i)))
+	}
+	err := dq.PutMany(batch)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, dq.Depth(), int64(10))
+	assert.Equal(t, dq.(*DiskQueue).writeFileNum, int64(1))
+	assert.Equal(t, dq.(*DiskQueue).writePos, int64(28))
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, <-dq.ReadChan(), batch[i])
+	}
+}
+
 func assertFileNotExist(t *testing.T, fn string) {
 	f, err := os.OpenFile(fn, os.O_RDONLY, 0600)
 	assert.Equal(t, f, (*os.File)(nil))
@@ -62,7 +128,7 @@ func TestDiskQueueEmpty(t *testing.T) {
 	defer log.SetOutput(os.Stdout)
 
 	dqName := "test_disk_queue_empty" + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 100, 2500, 2*time.Second)
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 2500, 2*time.Second, 0)
 	assert.NotEqual(t, dq, nil)
 	assert.Equal(t, dq.Depth(), int64(0))
 
@@ -122,12 +188,117 @@ func TestDiskQueueEmpty(t *testing.T) {
 	assert.Equal(t, dq.(*DiskQueue).nextReadPos, dq.(*DiskQueue).readPos)
 }
 
+func TestDiskQueueFilter(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_filter" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 2500, 2*time.Second, 0)
+	defer dq.Delete()
+
+	for i := 0; i < 20; i++ {
+		err := dq.Put([]byte(strconv.Itoa(i)))
+		assert.Equal(t, err, nil)
+	}
+	<-dq.ReadChan()
+	// the next has been read ahead
+	for i := 0; dq.Peek() == nil && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	removed, err := dq.Filter(func(data []byte) bool {
+		i, _ := strconv.Atoi(string(data))
+		return i%2 == 1
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, removed, int64(10))
+	assert.Equal(t, dq.Depth(), int64(9))
+
+	// in order
+	for i := 2; i < 20; i += 2 {
+		assert.Equal(t, string(<-dq.ReadChan()), strconv.Itoa(i))
+	}
+	for i := 0; dq.Depth() != 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, dq.Depth(), int64(0))
+	assert.Equal(t, dq.(*DiskQueue).readFileNum, dq.(*DiskQueue).writeFileNum)
+	assert.Equal(t, dq.(*DiskQueue).readPos, dq.(*DiskQueue).writePos)
+}
+
+func TestDiskQueueSkipWhile(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_skip_while" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 2500, 2*time.Second, 0)
+	defer dq.Delete()
+
+	for i := 0; i < 20; i++ {
+		err := dq.Put([]byte(strconv.Itoa(i)))
+		assert.Equal(t, err, nil)
+	}
+	// the first has been read ahead
+	for i := 0; dq.Peek() == nil && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	skipped, err := dq.SkipWhile(func(data []byte) bool {
+		i, _ := strconv.Atoi(string(data))
+		return i < 12 || i == 13
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, skipped, int64(12))
+	assert.Equal(t, dq.Depth(), int64(8))
+	assert.Equal(t, string(dq.Peek()), "12")
+
+	for i := 12; i < 20; i++ {
+		assert.Equal(t, string(<-dq.ReadChan()), strconv.Itoa(i))
+	}
+
+	skipped, err = dq.SkipWhile(func(data []byte) bool { return true })
+	assert.Equal(t, err, nil)
+	assert.Equal(t, skipped, int64(0))
+}
+
+func TestDiskQueueSnapshot(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_snapshot" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 2500, 2*time.Second, 0)
+	defer dq.Delete()
+
+	for i := 0; i < 20; i++ {
+		err := dq.Put([]byte(strconv.Itoa(i)))
+		assert.Equal(t, err, nil)
+	}
+	for i := 0; i < 5; i++ {
+		<-dq.ReadChan()
+	}
+
+	var snapshot []string
+	err := dq.Snapshot(func(data []byte) error {
+		snapshot = append(snapshot, string(data))
+		return nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(snapshot), 15)
+	for i, data := range snapshot {
+		assert.Equal(t, data, strconv.Itoa(i+5))
+	}
+
+	// nothing was read
+	assert.Equal(t, dq.Depth(), int64(15))
+	assert.Equal(t, string(<-dq.ReadChan()), "5")
+}
+
 func TestDiskQueueCorruption(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
 	dqName := "test_disk_queue_corruption" + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 1000, 5, 2*time.Second)
+	dq := NewDiskQueue(dqName, os.TempDir(), 1000, 5, 2*time.Second, 0)
 
 	msg := make([]byte, 123)
 	for i := 0; i < 25; i++ {
@@ -160,7 +331,7 @@ func TestDiskQueueTorture(t *testing.T) {
 	var wg sync.WaitGroup
 
 	dqName := "test_disk_queue_torture" + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 262144, 2500, 2*time.Second)
+	dq := NewDiskQueue(dqName, os.TempDir(), 262144, 2500, 2*time.Second, 0)
 	assert.NotEqual(t, dq, nil)
 	assert.Equal(t, dq.Depth(), int64(0))
 
@@ -200,7 +371,7 @@ func TestDiskQueueTorture(t *testing.T) {
 	wg.Wait()
 
 	log.Printf("restarting diskqueue")
-	dq = NewDiskQueue(dqName, os.TempDir(), 262144, 2500, 2*time.Second)
+	dq = NewDiskQueue(dqName, os.TempDir(), 262144, 2500, 2*time.Second, 0)
 	assert.NotEqual(t, dq, nil)
 	assert.Equal(t, dq.Depth(), depth)
 
@@ -244,7 +415,7 @@ func BenchmarkDiskQueuePut(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 	dqName := "bench_disk_queue_put" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 1024, 2500, 2*time.Second)
+	dq := NewDiskQueue(dqName, os.TempDir(), 1024, 2500, 2*time.Second, 0)
 	b.StartTimer()
 
 	for i := 0; i < b.N; i++ {
@@ -260,7 +431,7 @@ func BenchmarkDiskQueueGet(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 	dqName := "bench_disk_queue_get" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 1024768, 2500, 2*time.Second)
+	dq := NewDiskQueue(dqName, os.TempDir(), 1024768, 2500, 2*time.Second, 0)
 	for i := 0; i < b.N; i++ {
 		dq.Put([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaa"))
 	}
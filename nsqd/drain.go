@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/nsq/util"
+)
+
+var errDraining = errors.New("nsqd is draining")
+
+// how often the drain checks whether everything has been consumed (and
+// renews its tombstones, which nsqlookupd expires after --tombstone-lifetime)
+var (
+	drainCheckInterval     = 100 * time.Millisecond
+	drainTombstoneInterval = 15 * time.Second
+)
+
+// IsDraining returns whether a drain (see Drain) has started
+func (n *NSQD) IsDraining() bool {
+	return atomic.LoadInt32(&n.draining) == 1
+}
+
+// Drain prepares this node to be decommissioned, it stops accepting
+// publishes and new subscriptions, tombstones its topics in nsqlookupd (so
+// that consumers stop discovering it) and, once every topic and channel has
+// been consumed or timeout has elapsed, closes drainedChan (on which main
+// exits)
+func (n *NSQD) Drain(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&n.draining, 0, 1) {
+		return errors.New("already draining")
+	}
+
+	log.Printf("DRAIN: starting (timeout %s)", timeout)
+	n.waitGroup.Wrap(func() { n.drainLoop(timeout) })
+	return nil
+}
+
+func (n *NSQD) drainLoop(timeout time.Duration) {
+	deadline := time.After(timeout)
+	checkTicker := time.NewTicker(drainCheckInterval)
+	tombstoneTicker := time.NewTicker(drainTombstoneInterval)
+	defer checkTicker.Stop()
+	defer tombstoneTicker.Stop()
+
+	n.tombstoneTopics()
+	for {
+		select {
+		case <-checkTicker.C:
+			remaining := n.undeliveredCount()
+			if remaining == 0 {
+				log.Printf("DRAIN: complete")
+				close(n.drainedChan)
+				return
+			}
+		case <-tombstoneTicker.C:
+			n.tombstoneTopics()
+		case <-deadline:
+			log.Printf("DRAIN: timed out with %d messages remaining", n.undeliveredCount())
+			close(n.drainedChan)
+			return
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
+// undeliveredCount is the number of messages queued in every topic and
+// channel, including those in-flight and deferred
+func (n *NSQD) undeliveredCount() int64 {
+	var count int64
+	n.RLock()
+	for _, topic := range n.topicMap {
+		count += topic.Depth()
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			count += channel.Depth()
+			channel.inFlightMutex.Lock()
+			count += int64(len(channel.inFlightMessages))
+			channel.inFlightMutex.Unlock()
+			channel.deferredMutex.Lock()
+			count += int64(len(channel.deferredMessages))
+			channel.deferredMutex.Unlock()
+		}
+		topic.RUnlock()
+	}
+	n.RUnlock()
+	return count
+}
+
+// tombstoneTopics tombstones this node as a producer of each of its topics
+// in every nsqlookupd
+func (n *NSQD) tombstoneTopics() {
+	node := net.JoinHostPort(n.options.BroadcastAddress, strconv.Itoa(n.httpAddr.Port))
+
+	var topicNames []string
+	n.RLock()
+	for name := range n.topicMap {
+		topicNames = append(topicNames, name)
+	}
+	n.RUnlock()
+
+	for _, addr := range n.lookupHttpAddrs() {
+		for _, topicName := range topicNames {
+			endpoint := fmt.Sprintf("http://%s/tombstone_topic_producer?topic=%s&node=%s",
+				addr, url.QueryEscape(topicName), url.QueryEscape(node))
+			log.Printf("DRAIN: querying %s", endpoint)
+			_, err := util.ApiRequest(endpoint)
+			if err != nil {
+				log.Printf("DRAIN: ERROR %s - %s", endpoint, err.Error())
+			}
+		}
+	}
+}
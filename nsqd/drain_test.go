@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/nsqlookupd"
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestDrain(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	lookupdOptions := nsqlookupd.NewNSQLookupdOptions()
+	lookupdOptions.TCPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.HTTPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.BroadcastAddress = "127.0.0.1"
+	lookupd := nsqlookupd.NewNSQLookupd(lookupdOptions)
+	lookupd.Main()
+	defer lookupd.Exit()
+
+	options := NewNSQDOptions()
+	options.BroadcastAddress = "127.0.0.1"
+	options.NSQLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_drain" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+
+	// wait for nsqd to register its topic with nsqlookupd
+	for i := 0; len(lookupd.DB.FindProducers("topic", topicName, "")) == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, len(lookupd.DB.FindProducers("topic", topicName, "")), 1)
+
+	_, err := util.ApiRequest(fmt.Sprintf("http://%s/drain", httpAddr))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, nsqd.IsDraining(), true)
+
+	_, err = util.ApiRequest(fmt.Sprintf("http://%s/drain", httpAddr))
+	assert.NotEqual(t, err, nil)
+
+	// tombstoned producers aren't returned by /lookup
+	lookupEndpoint := fmt.Sprintf("http://%s/lookup?topic=%s", lookupd.RealHTTPAddr(), topicName)
+	var found int
+	for i := 0; i < 100; i++ {
+		data, err := util.ApiRequest(lookupEndpoint)
+		assert.Equal(t, err, nil)
+		found = len(data.Get("producers").MustArray())
+		if found == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, found, 0)
+
+	// publishes and new subscriptions are rejected
+	resp, err := http.Post(fmt.Sprintf("http://%s/put?topic=%s", httpAddr, topicName), "",
+		strings.NewReader("test body"))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 503)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	subFail(t, conn, topicName, "ch")
+	conn.Close()
+
+	// what's left is still delivered, once it's gone the drain is complete
+	select {
+	case <-nsqd.drainedChan:
+		t.Fatalf("drained with messages remaining")
+	case <-time.After(200 * time.Millisecond):
+	}
+	<-channel.clientMsgChan
+	select {
+	case <-nsqd.drainedChan:
+	case <-time.After(time.Second):
+		t.Fatalf("not drained")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_drain_timeout" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+
+	err := nsqd.Drain(100 * time.Millisecond)
+	assert.Equal(t, err, nil)
+	select {
+	case <-nsqd.drainedChan:
+	case <-time.After(time.Second):
+		t.Fatalf("drain didn't time out")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sync"
+
+	"github.com/bitly/nsq/util"
+)
+
+// encryptedMagic prefixes every record (an encoded message) that was
+// encrypted before being written to disk, an encoded message starts with its
+// (positive) nanosecond timestamp so can't be mistaken for one
+var encryptedMagic = []byte{0xff, 'N', 'S', 'Q', 'E'}
+
+var errNoTopicKey = errors.New("no encryption key for topic")
+
+// atRestEncryption encrypts (see topicCipher) the messages of topics that have a
+// key, from --encryption-key-file or --encryption-key-url, before they are
+// written to disk (diskqueues, the retention log and staged transactions)
+//
+// the key file is a JSON object of topic name to base64 encoded (16, 24 or
+// 32 byte) key, "*" is used for topics without their own:
+//
+//	{"users": "<base64 key>", "*": "<base64 key>"}
+//
+// the key URL is queried with ?topic=<topic> and expected to respond with
+// {"status_code": 200, "data": {"key": "<base64 key>"}}, an empty key means
+// the topic isn't encrypted
+type atRestEncryption struct {
+	sync.Mutex
+	keys    map[string]string
+	keyURL  string
+	ciphers map[string]*topicCipher
+}
+
+func newAtRestEncryption(keyFile string, keyURL string) (*atRestEncryption, error) {
+	if keyFile == "" && keyURL == "" {
+		return nil, nil
+	}
+	if keyFile != "" && keyURL != "" {
+		return nil, errors.New("use --encryption-key-file or --encryption-key-url not both")
+	}
+
+	e := &atRestEncryption{
+		keyURL:  keyURL,
+		ciphers: make(map[string]*topicCipher),
+	}
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &e.keys)
+		if err != nil {
+			return nil, err
+		}
+		for topicName, key := range e.keys {
+			_, err := newTopicCipher(key)
+			if err != nil {
+				return nil, fmt.Errorf("key for %q - %s", topicName, err.Error())
+			}
+		}
+	}
+	return e, nil
+}
+
+// topicCipher is AES-CTR with an HMAC-SHA256 tag (encrypt-then-MAC), as
+// crypto/cipher's AEAD modes need Go 1.2... the AES and HMAC keys are derived
+// from the topic's key, a sealed record is:
+//
+//	[16-byte IV][ciphertext][32-byte HMAC of the additional data, IV and ciphertext]
+type topicCipher struct {
+	block  cipher.Block
+	macKey []byte
+}
+
+func newTopicCipher(key string) (*topicCipher, error) {
+	rawKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	switch len(rawKey) {
+	case 16, 24, 32:
+	default:
+		return nil, aes.KeySizeError(len(rawKey))
+	}
+	block, err := aes.NewCipher(deriveKey(rawKey, "nsqd encryption")[:len(rawKey)])
+	if err != nil {
+		return nil, err
+	}
+	return &topicCipher{
+		block:  block,
+		macKey: deriveKey(rawKey, "nsqd authentication"),
+	}, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (c *topicCipher) tag(additionalData []byte, ivAndCiphertext []byte) []byte {
+	var lenBuf [8]byte
+	binary.BigEndian.PutUint64(lenBuf[:], uint64(len(additionalData)))
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write(lenBuf[:])
+	mac.Write(additionalData)
+	mac.Write(ivAndCiphertext)
+	return mac.Sum(nil)
+}
+
+// seal appends the sealed plaintext to dst
+func (c *topicCipher) seal(dst []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, make([]byte, aes.BlockSize+len(plaintext))...)
+	iv := dst[start : start+aes.BlockSize]
+	_, err := io.ReadFull(rand.Reader, iv)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCTR(c.block, iv).XORKeyStream(dst[start+aes.BlockSize:], plaintext)
+	return append(dst, c.tag(additionalData, dst[start:])...), nil
+}
+
+func (c *topicCipher) open(sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aes.BlockSize+sha256.Size {
+		return nil, errors.New("encrypted message too short")
+	}
+	body := sealed[:len(sealed)-sha256.Size]
+	if subtle.ConstantTimeCompare(c.tag(additionalData, body), sealed[len(body):]) != 1 {
+		return nil, errors.New("encrypted message failed authentication")
+	}
+	plaintext := make([]byte, len(body)-aes.BlockSize)
+	cipher.NewCTR(c.block, body[:aes.BlockSize]).XORKeyStream(plaintext, body[aes.BlockSize:])
+	return plaintext, nil
+}
+
+// cipherFor returns the topic's cipher (nil if it isn't encrypted), keys fetched
+// from --encryption-key-url are cached for the life of the process
+func (e *atRestEncryption) cipherFor(topicName string) (*topicCipher, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	c, ok := e.ciphers[topicName]
+	if ok {
+		return c, nil
+	}
+
+	var key string
+	if e.keyURL != "" {
+		data, err := util.ApiRequest(fmt.Sprintf("%s?topic=%s", e.keyURL, url.QueryEscape(topicName)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch key for %s - %s", topicName, err.Error())
+		}
+		key, _ = data.Get("key").String()
+	} else {
+		key, ok = e.keys[topicName]
+		if !ok {
+			key = e.keys["*"]
+		}
+	}
+
+	if key != "" {
+		var err error
+		c, err = newTopicCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for %s - %s", topicName, err.Error())
+		}
+	}
+	e.ciphers[topicName] = c
+	return c, nil
+}
+
+// seal encrypts data for topicName, it is returned as is if the topic has no
+// key (or encryption is disabled)
+func (e *atRestEncryption) seal(topicName string, data []byte) ([]byte, error) {
+	if e == nil {
+		return data, nil
+	}
+	c, err := e.cipherFor(topicName)
+	if err != nil || c == nil {
+		return data, err
+	}
+
+	out := make([]byte, len(encryptedMagic), len(encryptedMagic)+aes.BlockSize+len(data)+sha256.Size)
+	copy(out, encryptedMagic)
+	return c.seal(out, data, []byte(topicName))
+}
+
+// open decrypts data that was sealed for topicName, data that wasn't
+// encrypted (ie. written before the topic had a key) is returned as is
+func (e *atRestEncryption) open(topicName string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return data, nil
+	}
+	if e == nil {
+		return nil, errNoTopicKey
+	}
+	c, err := e.cipherFor(topicName)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errNoTopicKey
+	}
+	return c.open(data[len(encryptedMagic):], []byte(topicName))
+}
+
+// encryptedBackend encrypts what is Put to a topic's (or one of its
+// channels') BackendQueue, what is read from it is expected to be open()'d
+type encryptedBackend struct {
+	BackendQueue
+	topicName  string
+	encryption *atRestEncryption
+}
+
+func newEncryptedBackend(bq BackendQueue, topicName string, encryption *atRestEncryption) BackendQueue {
+	if encryption == nil {
+		return bq
+	}
+	return &encryptedBackend{bq, topicName, encryption}
+}
+
+func (b *encryptedBackend) Put(data []byte) error {
+	data, err := b.encryption.seal(b.topicName, data)
+	if err != nil {
+		return err
+	}
+	return b.BackendQueue.Put(data)
+}
+
+func (b *encryptedBackend) PutMany(batch [][]byte) error {
+	sealed := make([][]byte, 0, len(batch))
+	for _, data := range batch {
+		data, err := b.encryption.seal(b.topicName, data)
+		if err != nil {
+			return err
+		}
+		sealed = append(sealed, data)
+	}
+	return b.BackendQueue.PutMany(sealed)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+var testEncryptionKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func TestEncryptionSealOpen(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := ""
+		if req.URL.Query().Get("topic") == "secret" {
+			key = testEncryptionKey
+		}
+		fmt.Fprintf(w, `{"status_code": 200, "status_txt": "OK", "data": {"key": "%s"}}`, key)
+	}))
+	defer ts.Close()
+
+	e, err := newAtRestEncryption("", ts.URL)
+	assert.Equal(t, err, nil)
+
+	sealed, err := e.seal("secret", []byte("plaintext"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, bytes.Contains(sealed, []byte("plaintext")), false)
+	opened, err := e.open("secret", sealed)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, opened, []byte("plaintext"))
+
+	// bound to the topic
+	_, err = e.open("other", sealed)
+	assert.NotEqual(t, err, nil)
+
+	// tampered
+	sealed[len(sealed)-1] ^= 0xff
+	_, err = e.open("secret", sealed)
+	assert.NotEqual(t, err, nil)
+
+	// topics without a key are written as is
+	sealed, err = e.seal("other", []byte("plaintext"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, sealed, []byte("plaintext"))
+	opened, err = e.open("other", sealed)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, opened, []byte("plaintext"))
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "test_encryption" + strconv.Itoa(int(time.Now().Unix()))
+
+	f, err := ioutil.TempFile("", "nsqd-encryption-keys")
+	assert.Equal(t, err, nil)
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, `{"%s": "%s"}`, topicName, testEncryptionKey)
+	f.Close()
+
+	options := NewNSQDOptions()
+	options.EncryptionKeyFile = f.Name()
+	// everything goes to disk
+	options.MemQueueSize = 0
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	body := []byte("social security number")
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, body))
+	for i := 0; topic.backend.Depth() != 1 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, topic.backend.Depth(), int64(1))
+
+	fileNames, _ := filepath.Glob(filepath.Join(options.DataPath, topicName+".diskqueue.*.dat"))
+	assert.Equal(t, len(fileNames), 1)
+	data, err := ioutil.ReadFile(fileNames[0])
+	assert.Equal(t, err, nil)
+	assert.Equal(t, bytes.Contains(data, body), false)
+	assert.Equal(t, bytes.Contains(data, encryptedMagic), true)
+
+	// and through the channel's (also encrypted) diskqueue to a client
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msgOut, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Body, body)
+	conn.Close()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// a topic export is a header (exportMagic and the big endian uint32
+// exportVersion) followed by records, each a type byte, the big endian uint32
+// length of the payload and the payload:
+//
+//	metadata         the exportMetadata JSON, always the first record
+//	topic message    an encoded message queued for the topic
+//	channel message  the big endian uint16 index (in exportMetadata.Channels)
+//	                 of the channel followed by an encoded message queued for it
+//	end              the exportTrailer JSON, always the last record (so that a
+//	                 truncated export is detected)
+//
+// messages are encoded as they are on the wire (and on disk) so their IDs,
+// timestamps and attempts are preserved
+const (
+	exportVersion uint32 = 1
+
+	exportRecordMetadata       byte = 1
+	exportRecordTopicMessage   byte = 2
+	exportRecordChannelMessage byte = 3
+	exportRecordEnd            byte = 4
+)
+
+var exportMagic = []byte("NSQX")
+
+type exportMetadata struct {
+	Topic      string                  `json:"topic"`
+	Paused     bool                    `json:"paused"`
+	ExportedAt int64                   `json:"exported_at"`
+	Channels   []exportChannelMetadata `json:"channels"`
+}
+
+type exportChannelMetadata struct {
+	Name   string `json:"name"`
+	Paused bool   `json:"paused"`
+}
+
+type exportTrailer struct {
+	Count int64 `json:"count"`
+}
+
+type exportWriter struct {
+	w   *bufio.Writer
+	hdr [5]byte
+}
+
+func (e *exportWriter) write(recordType byte, prefix []byte, payload []byte) error {
+	e.hdr[0] = recordType
+	binary.BigEndian.PutUint32(e.hdr[1:], uint32(len(prefix)+len(payload)))
+	_, err := e.w.Write(e.hdr[:])
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(prefix)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(payload)
+	return err
+}
+
+func (e *exportWriter) writeJSON(recordType byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return e.write(recordType, nil, data)
+}
+
+// Export writes the messages on disk for the topic and its (non-ephemeral)
+// channels to w, see Snapshot, returning how many were written
+//
+// messages in memory aren't exported, for a complete export run nsqd with
+// --mem-queue-size=0 or pause (and let drain) the topic and its channels
+func (t *Topic) Export(w io.Writer) (int64, error) {
+	metadata := exportMetadata{
+		Topic:      t.name,
+		Paused:     t.IsPaused(),
+		ExportedAt: time.Now().Unix(),
+	}
+	var channels []*Channel
+	t.RLock()
+	for _, c := range t.channelMap {
+		if c.ephemeralChannel {
+			continue
+		}
+		channels = append(channels, c)
+		metadata.Channels = append(metadata.Channels, exportChannelMetadata{
+			Name:   c.name,
+			Paused: c.IsPaused(),
+		})
+	}
+	t.RUnlock()
+
+	e := &exportWriter{w: bufio.NewWriter(w)}
+	_, err := e.w.Write(exportMagic)
+	if err != nil {
+		return 0, err
+	}
+	err = binary.Write(e.w, binary.BigEndian, exportVersion)
+	if err != nil {
+		return 0, err
+	}
+	err = e.writeJSON(exportRecordMetadata, &metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	encryption := t.context.nsqd.encryption
+	err = t.backend.Snapshot(func(data []byte) error {
+		data, err := encryption.open(t.name, data)
+		if err != nil {
+			return err
+		}
+		count++
+		return e.write(exportRecordTopicMessage, nil, data)
+	})
+	if err != nil {
+		return count, err
+	}
+
+	for i, c := range channels {
+		var index [2]byte
+		binary.BigEndian.PutUint16(index[:], uint16(i))
+		err = c.backend.Snapshot(func(data []byte) error {
+			data, err := encryption.open(t.name, data)
+			if err != nil {
+				return err
+			}
+			count++
+			return e.write(exportRecordChannelMessage, index[:], data)
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+
+	err = e.writeJSON(exportRecordEnd, &exportTrailer{count})
+	if err != nil {
+		return count, err
+	}
+	return count, e.w.Flush()
+}
+
+// ImportTopic loads an export (see Topic.Export) read from r, into topicName
+// if set or the exported topic otherwise, creating the topic and its channels
+// as necessary, returning the topic and how many messages were imported
+func (n *NSQD) ImportTopic(r io.Reader, topicName string) (*Topic, int64, error) {
+	reader := bufio.NewReader(r)
+
+	var magic [4]byte
+	_, err := io.ReadFull(reader, magic[:])
+	if err != nil || string(magic[:]) != string(exportMagic) {
+		return nil, 0, errors.New("not a topic export")
+	}
+	var version uint32
+	err = binary.Read(reader, binary.BigEndian, &version)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version == 0 || version > exportVersion {
+		return nil, 0, fmt.Errorf("unsupported export version %d", version)
+	}
+
+	var hdr [5]byte
+	readRecord := func() (byte, []byte, error) {
+		_, err := io.ReadFull(reader, hdr[:])
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("truncated export")
+			}
+			return 0, nil, err
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+		_, err = io.ReadFull(reader, payload)
+		return hdr[0], payload, err
+	}
+
+	recordType, payload, err := readRecord()
+	if err != nil {
+		return nil, 0, err
+	}
+	if recordType != exportRecordMetadata {
+		return nil, 0, errors.New("export is missing metadata")
+	}
+	var metadata exportMetadata
+	err = json.Unmarshal(payload, &metadata)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if topicName == "" {
+		topicName = metadata.Topic
+	}
+	if !nsq.IsValidTopicName(topicName) {
+		return nil, 0, fmt.Errorf("invalid topic name %q", topicName)
+	}
+	topic := n.GetTopic(topicName)
+	if metadata.Paused {
+		// so that the topic's messages stay queued for it
+		topic.Pause()
+	}
+
+	channels := make([]*Channel, len(metadata.Channels))
+	for i, cm := range metadata.Channels {
+		if !nsq.IsValidChannelName(cm.Name) {
+			return topic, 0, fmt.Errorf("invalid channel name %q", cm.Name)
+		}
+		channels[i] = topic.GetChannel(cm.Name)
+		if cm.Paused {
+			channels[i].Pause()
+		}
+	}
+
+	log.Printf("TOPIC(%s): importing export of %s (version %d, exported at %s)",
+		topicName, metadata.Topic, version, time.Unix(metadata.ExportedAt, 0))
+
+	var count int64
+	for {
+		recordType, payload, err := readRecord()
+		if err != nil {
+			return topic, count, err
+		}
+
+		switch recordType {
+		case exportRecordTopicMessage:
+			msg, err := nsq.DecodeMessage(payload)
+			if err != nil {
+				return topic, count, err
+			}
+			err = topic.PutMessage(msg)
+			if err != nil {
+				return topic, count, err
+			}
+		case exportRecordChannelMessage:
+			if len(payload) < 2 {
+				return topic, count, errors.New("invalid channel message record")
+			}
+			i := int(binary.BigEndian.Uint16(payload))
+			if i >= len(channels) {
+				return topic, count, fmt.Errorf("invalid channel index %d", i)
+			}
+			msg, err := nsq.DecodeMessage(payload[2:])
+			if err != nil {
+				return topic, count, err
+			}
+			err = channels[i].PutMessage(msg)
+			if err != nil {
+				return topic, count, err
+			}
+		case exportRecordEnd:
+			var trailer exportTrailer
+			err = json.Unmarshal(payload, &trailer)
+			if err != nil {
+				return topic, count, err
+			}
+			if trailer.Count != count {
+				return topic, count, fmt.Errorf("imported %d of %d messages", count, trailer.Count)
+			}
+			return topic, count, nil
+		default:
+			return topic, count, fmt.Errorf("invalid record type %d", recordType)
+		}
+		count++
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/go-simplejson"
+	"github.com/bmizerany/assert"
+)
+
+func TestTopicExportImport(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	// everything goes to disk
+	options.MemQueueSize = 0
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_export" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.Pause()
+	channel := topic.GetChannel("ch")
+
+	// the paused topic keeps these
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("topic")))
+	}
+	// without clients messagePump holds on to the first of these
+	var channelMsgs []*nsq.Message
+	for i := 0; i < 3; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("channel"))
+		msg.Timestamp = time.Now().Add(-time.Hour).UnixNano()
+		channel.PutMessage(msg)
+		channelMsgs = append(channelMsgs, msg)
+	}
+	for i := 0; atomic.LoadInt64(&channel.pumpTimestamp) == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; (topic.backend.Depth() != 5 || channel.backend.Depth() != 2) && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/topic/export?topic=%s", httpAddr, topicName))
+	assert.Equal(t, err, nil)
+	export, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	// exporting doesn't consume
+	assert.Equal(t, topic.backend.Depth(), int64(5))
+	assert.Equal(t, channel.backend.Depth(), int64(2))
+
+	dstOptions := NewNSQDOptions()
+	dstOptions.MemQueueSize = 0
+	_, dstHTTPAddr, dstNSQD := mustStartNSQD(dstOptions)
+	defer dstNSQD.Exit()
+
+	importURL := fmt.Sprintf("http://%s/topic/import?topic=%s_imported", dstHTTPAddr, topicName)
+	resp, err = http.Post(importURL, "application/octet-stream", bytes.NewReader(export))
+	assert.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	js, err := simplejson.NewJson(body)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, js.Get("data").Get("count").MustInt64(), int64(7))
+
+	imported, err := dstNSQD.GetExistingTopic(topicName + "_imported")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, imported.IsPaused(), true)
+	importedChannel, err := imported.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+
+	// IDs and timestamps are preserved
+	msg := <-importedChannel.clientMsgChan
+	assert.Equal(t, msg.Id, channelMsgs[1].Id)
+	assert.Equal(t, msg.Timestamp, channelMsgs[1].Timestamp)
+	assert.Equal(t, string(msg.Body), "channel")
+
+	// a truncated export is rejected
+	resp, err = http.Post(importURL, "application/octet-stream", bytes.NewReader(export[:len(export)-10]))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// a handover passes our listening sockets to a newly exec'd nsqd (ie. after
+// the binary was upgraded in place) so that connections queue up in the
+// kernel, rather than being refused, while we drain and exit.
+//
+// the successor finds its inherited fds (starting at 3, as ExtraFiles) by
+// their kind ("tcp" or "http") listed in this environment variable, they are
+// followed by the read end of a pipe that reaches EOF once we have exited
+const handoverEnv = "NSQD_HANDOVER_FDS"
+
+// Handover execs a new nsqd (the same binary path and arguments) passing it
+// our listeners, then stops accepting connections and waits (up to
+// --handover-drain-timeout) for subscribers to finish their in-flight
+// messages. The caller is expected to Exit() afterwards, the successor only
+// loads metadata and starts serving once we have.
+func (n *NSQD) Handover() error {
+	if !atomic.CompareAndSwapInt32(&n.handingOver, 0, 1) {
+		return errors.New("handover already in progress")
+	}
+
+	var kinds []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range n.tcpListeners {
+		f, err := listenerFile(l)
+		if err != nil {
+			atomic.StoreInt32(&n.handingOver, 0)
+			return err
+		}
+		kinds = append(kinds, "tcp")
+		files = append(files, f)
+	}
+	for _, l := range n.httpListeners {
+		f, err := listenerFile(l)
+		if err != nil {
+			atomic.StoreInt32(&n.handingOver, 0)
+			return err
+		}
+		kinds = append(kinds, "http")
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		atomic.StoreInt32(&n.handingOver, 0)
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(handoverEnviron(), fmt.Sprintf("%s=%s", handoverEnv, strings.Join(kinds, ",")))
+	cmd.ExtraFiles = append(files, r)
+	err = cmd.Start()
+	if err != nil {
+		w.Close()
+		atomic.StoreInt32(&n.handingOver, 0)
+		return err
+	}
+	// closed (ie. EOF for the successor) at the end of Exit(), or by the OS
+	// should we die first
+	n.handoverPipe = w
+	log.Printf("HANDOVER: started successor (pid %d)", cmd.Process.Pid)
+
+	// the successor holds its own copy of each listening socket, so closing
+	// ours doesn't refuse new connections (they wait to be accepted by it)
+	for _, l := range n.tcpListeners {
+		l.Close()
+	}
+	for _, l := range n.reusePortListeners {
+		l.Close()
+	}
+	for _, l := range n.httpListeners {
+		l.Close()
+	}
+
+	n.drain(n.options.HandoverDrainTimeout)
+	return nil
+}
+
+// drain stops sending messages to subscribers and waits for their in-flight
+// messages to be FIN'd, REQ'd or timed out
+func (n *NSQD) drain(timeout time.Duration) {
+	clients := n.subscribedClients()
+	for _, client := range clients {
+		client.StartClose()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var inFlight int64
+		for _, client := range clients {
+			inFlight += atomic.LoadInt64(&client.InFlightCount)
+		}
+		if inFlight == 0 {
+			log.Printf("HANDOVER: drained %d clients", len(clients))
+			return
+		}
+		if !time.Now().Before(deadline) {
+			log.Printf("HANDOVER: timed out draining, %d messages still in-flight", inFlight)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (n *NSQD) subscribedClients() []*ClientV2 {
+	var clients []*ClientV2
+	seen := make(map[*ClientV2]bool)
+
+	n.RLock()
+	for _, t := range n.topicMap {
+		t.RLock()
+		for _, c := range t.channelMap {
+			c.RLock()
+			for _, consumer := range c.clients {
+				client, ok := consumer.(*ClientV2)
+				if ok && !seen[client] {
+					seen[client] = true
+					clients = append(clients, client)
+				}
+			}
+			c.RUnlock()
+		}
+		t.RUnlock()
+	}
+	n.RUnlock()
+
+	return clients
+}
+
+func listenerFile(l net.Listener) (*os.File, error) {
+	fl, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("listener %s cannot be handed over", l.Addr())
+	}
+	return fl.File()
+}
+
+// handoverEnviron is our environment without the list of listeners we
+// inherited (if any), our own successor gets its own list
+func handoverEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, handoverEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// inheritHandover picks up the listeners (and the pipe to wait on) passed by
+// the nsqd that started us, if any
+func (n *NSQD) inheritHandover() error {
+	env := os.Getenv(handoverEnv)
+	if env == "" {
+		return nil
+	}
+	kinds := strings.Split(env, ",")
+	for i, kind := range kinds {
+		f := os.NewFile(uintptr(3+i), fmt.Sprintf("%s-listener-%d", kind, i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited %s listener (fd %d) - %s", kind, 3+i, err.Error())
+		}
+		switch kind {
+		case "tcp":
+			n.inheritedTCPListeners = append(n.inheritedTCPListeners, l)
+		case "http":
+			n.inheritedHTTPListeners = append(n.inheritedHTTPListeners, l)
+		default:
+			l.Close()
+			return fmt.Errorf("inherited listener (fd %d) of unknown kind %q", 3+i, kind)
+		}
+	}
+	n.predecessorPipe = os.NewFile(uintptr(3+len(kinds)), "handover-pipe")
+	return nil
+}
+
+// WaitForPredecessor blocks until the nsqd that handed over to us has exited,
+// it is only then that the data path (metadata and diskqueues) is ours
+func (n *NSQD) WaitForPredecessor() {
+	if n.predecessorPipe == nil {
+		return
+	}
+	log.Printf("HANDOVER: waiting for the previous nsqd to exit")
+	ioutil.ReadAll(n.predecessorPipe)
+	n.predecessorPipe.Close()
+	n.predecessorPipe = nil
+}
+
+// listen returns the i'th inherited listener of the kind, if there is one,
+// rather than listening on addr
+func listen(inherited []net.Listener, i int, addr *net.TCPAddr) (net.Listener, error) {
+	if i < len(inherited) {
+		return inherited[i], nil
+	}
+	return net.Listen("tcp", addr.String())
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// handoverSignal triggers an in-place upgrade (see Handover())
+var handoverSignal os.Signal = syscall.SIGUSR2
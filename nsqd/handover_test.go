@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestHandoverInheritedListener(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	// stands in for the socket a predecessor would have passed us
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+
+	options := NewNSQDOptions()
+	options.TCPAddresses = []string{"127.0.0.1:0"}
+	options.HTTPAddresses = []string{"127.0.0.1:0"}
+	options.DataPath = mustTempDataPath()
+	nsqd := NewNSQD(options)
+	nsqd.inheritedTCPListeners = []net.Listener{inherited}
+	nsqd.WaitForPredecessor()
+	nsqd.Main()
+	defer nsqd.Exit()
+
+	assert.Equal(t, nsqd.tcpAddr.String(), inherited.Addr().String())
+
+	conn, err := mustConnectNSQD(nsqd.tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	conn.Close()
+}
+
+func TestHandoverDrain(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "test_handover" + strconv.Itoa(int(time.Now().Unix()))
+
+	options := NewNSQDOptions()
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic(topicName)
+	for i := 0; i < 2; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msg, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+
+	var drained int32
+	go func() {
+		nsqd.drain(5 * time.Second)
+		atomic.StoreInt32(&drained, 1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// still waiting on the in-flight message
+	assert.Equal(t, atomic.LoadInt32(&drained), int32(0))
+
+	err = nsq.Finish(msg.Id).Write(conn)
+	assert.Equal(t, err, nil)
+	for i := 0; atomic.LoadInt32(&drained) == 0 && i < 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, atomic.LoadInt32(&drained), int32(1))
+
+	// the second message is not delivered to the closing client
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, channel.Depth(), int64(1))
+	conn.Close()
+}
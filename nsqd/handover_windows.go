@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os"
+)
+
+// handovers are not supported on Windows, which can't pass sockets to a child
+// process as ExtraFiles
+var handoverSignal os.Signal
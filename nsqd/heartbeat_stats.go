@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/bitly/go-nsq"
+)
+
+// a client that negotiates heartbeat_stats gets, rather than just
+// "_heartbeat_", heartbeats that carry the state of its channel and of nsqd
+// so that it can adapt its RDY without polling /stats:
+//
+//    _heartbeat_ {"depth":1200,"in_flight":50,"clients":3,"goroutines":412}
+//
+// (a client still has to respond with NOP, like for any heartbeat)
+
+type heartbeatStats struct {
+	// of the client's channel (absent for a client that isn't subscribed or
+	// is multiplexed)
+	Depth    *int64 `json:"depth,omitempty"`
+	InFlight *int   `json:"in_flight,omitempty"`
+	Clients  *int   `json:"clients,omitempty"`
+
+	Goroutines int  `json:"goroutines"`
+	ReadOnly   bool `json:"read_only,omitempty"`
+	Draining   bool `json:"draining,omitempty"`
+}
+
+func (p *ProtocolV2) heartbeatStats(channel *Channel) heartbeatStats {
+	stats := heartbeatStats{
+		Goroutines: runtime.NumGoroutine(),
+		ReadOnly:   p.context.nsqd.IsReadOnly(),
+		Draining:   p.context.nsqd.IsDraining(),
+	}
+	if channel == nil {
+		return stats
+	}
+
+	depth := channel.Depth()
+	channel.inFlightMutex.Lock()
+	inFlight := len(channel.inFlightMessages)
+	channel.inFlightMutex.Unlock()
+	channel.RLock()
+	clients := len(channel.clients)
+	channel.RUnlock()
+
+	stats.Depth = &depth
+	stats.InFlight = &inFlight
+	stats.Clients = &clients
+	return stats
+}
+
+// sendHeartbeat sends a heartbeat, with stats if the client negotiated them
+func (p *ProtocolV2) sendHeartbeat(client *ClientV2, channel *Channel) error {
+	if atomic.LoadInt32(&client.HeartbeatStats) != 1 {
+		return p.Send(client, nsq.FrameTypeResponse, heartbeatBytes)
+	}
+
+	stats, err := json.Marshal(p.heartbeatStats(channel))
+	if err != nil {
+		panic("should never happen")
+	}
+	frame := make([]byte, 0, len(heartbeatBytes)+1+len(stats))
+	frame = append(frame, heartbeatBytes...)
+	frame = append(frame, ' ')
+	frame = append(frame, stats...)
+	return p.Send(client, nsq.FrameTypeResponse, frame)
+}
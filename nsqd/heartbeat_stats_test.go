@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestHeartbeatStats(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_heartbeat_stats" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	for i := 0; i < 3; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	data := identify(t, conn, map[string]interface{}{
+		"heartbeat_stats":    true,
+		"heartbeat_interval": 100,
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		HeartbeatStats bool `json:"heartbeat_stats"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.HeartbeatStats, true)
+	sub(t, conn, topicName, "ch")
+
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, bytes.HasPrefix(data, []byte("_heartbeat_ ")), true)
+
+	var stats heartbeatStats
+	err = json.Unmarshal(data[len("_heartbeat_ "):], &stats)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, *stats.Depth, int64(3))
+	assert.Equal(t, *stats.InFlight, 0)
+	assert.Equal(t, *stats.Clients, 1)
+	assert.Equal(t, stats.Goroutines > 0, true)
+
+	err = nsq.Nop().Write(conn)
+	assert.Equal(t, err, nil)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +11,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,8 +20,6 @@ import (
 	"github.com/bitly/nsq/util"
 )
 
-import httpprof "net/http/pprof"
-
 type httpServer struct {
 	context *Context
 }
@@ -28,11 +29,19 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	case "/pub":
 		fallthrough
 	case "/put":
-		s.putHandler(w, req)
+		s.publishOnce(w, req, (*httpServer).putHandler)
 	case "/mpub":
 		fallthrough
 	case "/mput":
-		s.mputHandler(w, req)
+		s.publishOnce(w, req, (*httpServer).mputHandler)
+	case "/subscribe":
+		s.subscribeHandler(w, req)
+	case "/drain":
+		s.drainHandler(w, req)
+	case "/subscribe/fin":
+		fallthrough
+	case "/subscribe/req":
+		s.subscribeCommitHandler(w, req)
 	case "/stats":
 		s.statsHandler(w, req)
 	case "/ping":
@@ -47,6 +56,26 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		s.pauseTopicHandler(w, req)
 	case "/unpause_topic":
 		s.pauseTopicHandler(w, req)
+	case "/pause_topic_publish":
+		s.pauseTopicPublishHandler(w, req)
+	case "/unpause_topic_publish":
+		s.pauseTopicPublishHandler(w, req)
+	case "/set_topic_retention":
+		s.setTopicRetentionHandler(w, req)
+	case "/set_topic_overflow_policy":
+		s.setOverflowPolicyHandler(w, req)
+	case "/set_topic_sync_policy":
+		s.setTopicSyncPolicyHandler(w, req)
+	case "/set_topic_large_messages":
+		s.setTopicLargeMessagesHandler(w, req)
+	case "/annotate_topic", "/annotate_channel":
+		s.annotateHandler(w, req)
+	case "/topic_schema":
+		s.topicSchemaHandler(w, req)
+	case "/set_topic_schema":
+		s.setTopicSchemaHandler(w, req)
+	case "/delete_topic_schema":
+		s.setTopicSchemaHandler(w, req)
 	case "/empty_channel":
 		s.emptyChannelHandler(w, req)
 	case "/delete_channel":
@@ -55,63 +84,111 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		s.pauseChannelHandler(w, req)
 	case "/unpause_channel":
 		s.pauseChannelHandler(w, req)
+	case "/pause_client":
+		s.pauseClientHandler(w, req)
+	case "/unpause_client":
+		s.pauseClientHandler(w, req)
+	case "/set_channel_watermarks":
+		s.setChannelWatermarksHandler(w, req)
+	case "/set_channel_delivery_interval":
+		s.setChannelDeliveryIntervalHandler(w, req)
+	case "/set_channel_delivery_order":
+		s.setChannelDeliveryOrderHandler(w, req)
+	case "/set_channel_max_in_flight":
+		s.setChannelMaxInFlightHandler(w, req)
+	case "/set_channel_slow_start":
+		s.setChannelSlowStartHandler(w, req)
+	case "/set_channel_partitions":
+		s.setChannelPartitionsHandler(w, req)
+	case "/set_channel_mirror":
+		s.setChannelMirrorHandler(w, req)
+	case "/add_push_consumer", "/remove_push_consumer":
+		s.pushConsumerHandler(w, req)
+	case "/set_channel_overflow_policy":
+		s.setOverflowPolicyHandler(w, req)
+	case "/channel/seek":
+		s.channelSeekHandler(w, req)
+	case "/channel/redeliver":
+		s.channelRedeliverHandler(w, req)
+	case "/channel/in_flight":
+		s.channelInFlightHandler(w, req)
+	case "/channel/stats/reset":
+		s.channelStatsResetHandler(w, req)
+	case "/channel/quarantine/release":
+		s.channelQuarantineReleaseHandler(w, req)
+	case "/topic/export":
+		s.topicExportHandler(w, req)
+	case "/topic/import":
+		s.topicImportHandler(w, req)
+	case "/create_alias":
+		s.createAliasHandler(w, req)
+	case "/delete_alias":
+		s.deleteAliasHandler(w, req)
+	case "/create_sharded_topic":
+		s.createShardedTopicHandler(w, req)
+	case "/delete_sharded_topic":
+		s.deleteShardedTopicHandler(w, req)
 	case "/create_topic":
 		s.createTopicHandler(w, req)
 	case "/create_channel":
 		s.createChannelHandler(w, req)
-	case "/debug/pprof":
-		httpprof.Index(w, req)
-	case "/debug/pprof/cmdline":
-		httpprof.Cmdline(w, req)
-	case "/debug/pprof/symbol":
-		httpprof.Symbol(w, req)
-	case "/debug/pprof/heap":
-		httpprof.Handler("heap").ServeHTTP(w, req)
-	case "/debug/pprof/goroutine":
-		httpprof.Handler("goroutine").ServeHTTP(w, req)
-	case "/debug/pprof/profile":
-		httpprof.Profile(w, req)
-	case "/debug/pprof/block":
-		httpprof.Handler("block").ServeHTTP(w, req)
-	case "/debug/pprof/threadcreate":
-		httpprof.Handler("threadcreate").ServeHTTP(w, req)
 	default:
+		if s.context.nsqd.options.HTTPDebug && strings.HasPrefix(req.URL.Path, "/debug/") {
+			switch req.URL.Path {
+			case "/debug/logging":
+				s.debugLoggingHandler(w, req)
+			case "/debug/chaos":
+				s.debugChaosHandler(w, req)
+			default:
+				util.NewDebugHandler(s.context.nsqd.options.HTTPDebugAuthToken).ServeHTTP(w, req)
+			}
+			return
+		}
 		log.Printf("ERROR: 404 %s", req.URL.Path)
 		util.ApiResponse(w, 404, "NOT_FOUND", nil)
 	}
 }
 
 func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Length", "2")
-	io.WriteString(w, "OK")
+	util.OKResponse(w)
 }
 
 func (s *httpServer) infoHandler(w http.ResponseWriter, req *http.Request) {
 	util.ApiResponse(w, 200, "OK", struct {
-		Version string `json:"version"`
+		Version            string         `json:"version"`
+		Resources          *ResourceStats `json:"resources"`
+		WorkerID           int64          `json:"worker_id"`
+		IDGenerator        string         `json:"id_generator"`
+		WorkerIDCollisions []string       `json:"worker_id_collisions"`
+		Limits             ServerLimits   `json:"limits"`
 	}{
-		Version: util.BINARY_VERSION,
+		Version:            util.BINARY_VERSION,
+		Resources:          s.context.nsqd.ResourceStats(),
+		WorkerID:           s.context.nsqd.options.ID,
+		IDGenerator:        s.context.nsqd.options.IDGenerator,
+		WorkerIDCollisions: s.context.nsqd.WorkerIDCollisions(),
+		Limits:             s.context.nsqd.ServerLimits(),
 	})
 }
 
-func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, error) {
+func (s *httpServer) getTopicNameFromQuery(req *http.Request) (url.Values, string, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
 		log.Printf("ERROR: failed to parse request params - %s", err.Error())
-		return nil, nil, errors.New("INVALID_REQUEST")
+		return nil, "", errors.New("INVALID_REQUEST")
 	}
 
 	topicNames, ok := reqParams["topic"]
 	if !ok {
-		return nil, nil, errors.New("MISSING_ARG_TOPIC")
+		return nil, "", errors.New("MISSING_ARG_TOPIC")
 	}
 	topicName := topicNames[0]
 
 	if !nsq.IsValidTopicName(topicName) {
-		return nil, nil, errors.New("INVALID_ARG_TOPIC")
+		return nil, "", errors.New("INVALID_ARG_TOPIC")
 	}
 
-	return reqParams, s.context.nsqd.GetTopic(topicName), nil
+	return reqParams, topicName, nil
 }
 
 func (s *httpServer) putHandler(w http.ResponseWriter, req *http.Request) {
@@ -120,10 +197,17 @@ func (s *httpServer) putHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	reqParams, topicName, err := s.getTopicNameFromQuery(req)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
 	// TODO: one day I'd really like to just error on chunked requests
 	// to be able to fail "too big" requests before we even read
 
 	if req.ContentLength > s.context.nsqd.options.MaxMsgSize {
+		s.context.nsqd.oversizeMessage(topicName)
 		util.ApiResponse(w, 500, "MSG_TOO_BIG", nil)
 		return
 	}
@@ -138,6 +222,7 @@ func (s *httpServer) putHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	if int64(len(body)) == readMax {
 		log.Printf("ERROR: /put hit max message size")
+		s.context.nsqd.oversizeMessage(topicName)
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
@@ -146,21 +231,66 @@ func (s *httpServer) putHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	_, topic, err := s.getTopicFromQuery(req)
+	if reqParams.Get("key") != "" && !s.context.nsqd.keyedMessageIDs() {
+		util.ApiResponse(w, 500, "KEY_UNSUPPORTED", nil)
+		return
+	}
+
+	timestamp, err := s.context.nsqd.publishTimestamp(req)
 	if err != nil {
-		util.ApiResponse(w, 500, err.Error(), nil)
+		util.ApiResponse(w, 500, "INVALID_TIMESTAMP", nil)
 		return
 	}
 
 	msg := nsq.NewMessage(<-s.context.nsqd.idChan, body)
-	err = topic.PutMessage(msg)
+	if key := reqParams.Get("key"); key != "" {
+		msg.Id = keyedMessageID(msg.Id, []byte(key))
+	}
+	if timestamp > 0 {
+		msg.Timestamp = timestamp
+	}
+	err = s.putMessages(reqParams, topicName, []*nsq.Message{msg})
+	if err == errReadOnly {
+		util.ApiResponse(w, 503, "READ_ONLY", nil)
+		return
+	}
+	if err == errDraining {
+		util.ApiResponse(w, 503, "DRAINING", nil)
+		return
+	}
+	if err == errReplicaReadOnly {
+		util.ApiResponse(w, 500, "REPLICA_READ_ONLY", nil)
+		return
+	}
+	if _, ok := err.(*msgRejectedError); ok {
+		util.ApiResponse(w, 500, "MSG_REJECTED", struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	}
+	if err == errTopicFull {
+		util.ApiResponse(w, 503, "TOPIC_FULL", nil)
+		return
+	}
+	if err == errPublishPaused {
+		util.ApiResponse(w, 503, "PUBLISH_PAUSED", nil)
+		return
+	}
+	if err == errMsgTooLarge {
+		util.ApiResponse(w, 500, "MSG_TOO_LARGE", nil)
+		return
+	}
+	if err == errCreationDenied {
+		util.ApiResponse(w, 403, "TOPIC_CREATION_DENIED", nil)
+		return
+	}
 	if err != nil {
 		util.ApiResponse(w, 500, "NOK", nil)
 		return
 	}
+	s.context.nsqd.producerPublished(topicName, httpProducer(req.RemoteAddr, req.UserAgent()), 1)
 
-	w.Header().Set("Content-Length", "2")
-	io.WriteString(w, "OK")
+	util.OKResponse(w)
 }
 
 func (s *httpServer) mputHandler(w http.ResponseWriter, req *http.Request) {
@@ -180,18 +310,32 @@ func (s *httpServer) mputHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	reqParams, topic, err := s.getTopicFromQuery(req)
+	reqParams, topicName, err := s.getTopicNameFromQuery(req)
 	if err != nil {
 		util.ApiResponse(w, 500, err.Error(), nil)
 		return
 	}
 
+	if reqParams.Get("key") != "" && !s.context.nsqd.keyedMessageIDs() {
+		util.ApiResponse(w, 500, "KEY_UNSUPPORTED", nil)
+		return
+	}
+
+	timestamp, err := s.context.nsqd.publishTimestamp(req)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TIMESTAMP", nil)
+		return
+	}
+
 	_, ok := reqParams["binary"]
 	if ok {
 		tmp := make([]byte, 4)
 		msgs, err = readMPUB(req.Body, tmp, s.context.nsqd.idChan,
 			s.context.nsqd.options.MaxMsgSize)
 		if err != nil {
+			if err.(*util.FatalClientErr).ParentErr == errMsgTooBig {
+				s.context.nsqd.oversizeMessage(topicName)
+			}
 			util.ApiResponse(w, 500, err.(*util.FatalClientErr).Code[2:], nil)
 			return
 		}
@@ -227,6 +371,7 @@ func (s *httpServer) mputHandler(w http.ResponseWriter, req *http.Request) {
 			}
 
 			if int64(len(block)) > s.context.nsqd.options.MaxMsgSize {
+				s.context.nsqd.oversizeMessage(topicName)
 				util.ApiResponse(w, 500, "MSG_TOO_BIG", nil)
 				return
 			}
@@ -236,14 +381,59 @@ func (s *httpServer) mputHandler(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	err = topic.PutMessages(msgs)
+	if key := reqParams.Get("key"); key != "" {
+		for _, msg := range msgs {
+			msg.Id = keyedMessageID(msg.Id, []byte(key))
+		}
+	}
+	if timestamp > 0 {
+		for _, msg := range msgs {
+			msg.Timestamp = timestamp
+		}
+	}
+
+	err = s.putMessages(reqParams, topicName, msgs)
+	if err == errReadOnly {
+		util.ApiResponse(w, 503, "READ_ONLY", nil)
+		return
+	}
+	if err == errDraining {
+		util.ApiResponse(w, 503, "DRAINING", nil)
+		return
+	}
+	if err == errReplicaReadOnly {
+		util.ApiResponse(w, 500, "REPLICA_READ_ONLY", nil)
+		return
+	}
+	if _, ok := err.(*msgRejectedError); ok {
+		util.ApiResponse(w, 500, "MSG_REJECTED", struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	}
+	if err == errTopicFull {
+		util.ApiResponse(w, 503, "TOPIC_FULL", nil)
+		return
+	}
+	if err == errPublishPaused {
+		util.ApiResponse(w, 503, "PUBLISH_PAUSED", nil)
+		return
+	}
+	if err == errMsgTooLarge {
+		util.ApiResponse(w, 500, "MSG_TOO_LARGE", nil)
+		return
+	}
+	if err == errCreationDenied {
+		util.ApiResponse(w, 403, "TOPIC_CREATION_DENIED", nil)
+		return
+	}
 	if err != nil {
 		util.ApiResponse(w, 500, "NOK", nil)
 		return
 	}
+	s.context.nsqd.producerPublished(topicName, httpProducer(req.RemoteAddr, req.UserAgent()), len(msgs))
 
-	w.Header().Set("Content-Length", "2")
-	io.WriteString(w, "OK")
+	util.OKResponse(w)
 }
 
 func (s *httpServer) createTopicHandler(w http.ResponseWriter, req *http.Request) {
@@ -269,6 +459,115 @@ func (s *httpServer) createTopicHandler(w http.ResponseWriter, req *http.Request
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
+func (s *httpServer) createAliasHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	alias, err := reqParams.Get("alias")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_ALIAS", nil)
+		return
+	}
+
+	topicNames, err := reqParams.GetAll("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	err = s.context.nsqd.SetAlias(alias, topicNames)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) deleteAliasHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	alias, err := reqParams.Get("alias")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_ALIAS", nil)
+		return
+	}
+
+	err = s.context.nsqd.DeleteAlias(alias)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) createShardedTopicHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	shardsStr, err := reqParams.Get("shards")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_SHARDS", nil)
+		return
+	}
+	shards, err := strconv.Atoi(shardsStr)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_SHARDS", nil)
+		return
+	}
+
+	err = s.context.nsqd.SetShards(topicName, shards)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) deleteShardedTopicHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	err = s.context.nsqd.DeleteShards(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
 func (s *httpServer) emptyTopicHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
@@ -358,7 +657,9 @@ func (s *httpServer) pauseTopicHandler(w http.ResponseWriter, req *http.Request)
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func (s *httpServer) createChannelHandler(w http.ResponseWriter, req *http.Request) {
+// pauseTopicPublishHandler pauses (mode=reject or buffer) or unpauses
+// publishes to a topic (see publish_pause.go)
+func (s *httpServer) pauseTopicPublishHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
 		log.Printf("ERROR: failed to parse request params - %s", err.Error())
@@ -366,9 +667,9 @@ func (s *httpServer) createChannelHandler(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	topicName, err := reqParams.Get("topic")
 	if err != nil {
-		util.ApiResponse(w, 500, err.Error(), nil)
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
 		return
 	}
 
@@ -378,11 +679,25 @@ func (s *httpServer) createChannelHandler(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	topic.GetChannel(channelName)
+	if strings.HasPrefix(req.URL.Path, "/pause") {
+		modeStr, _ := reqParams.Get("mode")
+		mode, err := parsePublishPauseMode(modeStr)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_MODE", nil)
+			return
+		}
+		err = topic.PausePublish(mode)
+	} else {
+		err = topic.UnPausePublish()
+	}
+	if err != nil {
+		log.Printf("ERROR: failure in %s - %s", req.URL.Path, err.Error())
+	}
+
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func (s *httpServer) emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) setTopicRetentionHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
 		log.Printf("ERROR: failed to parse request params - %s", err.Error())
@@ -390,34 +705,38 @@ func (s *httpServer) emptyChannelHandler(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	topicName, err := reqParams.Get("topic")
 	if err != nil {
-		util.ApiResponse(w, 500, err.Error(), nil)
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
 		return
 	}
 
-	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	periodStr, err := reqParams.Get("period")
 	if err != nil {
-		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		util.ApiResponse(w, 500, "MISSING_ARG_PERIOD", nil)
+		return
+	}
+	period, err := time.ParseDuration(periodStr)
+	if err != nil || period < 0 {
+		util.ApiResponse(w, 500, "INVALID_ARG_PERIOD", nil)
 		return
 	}
 
-	channel, err := topic.GetExistingChannel(channelName)
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
 	if err != nil {
-		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
 		return
 	}
 
-	err = channel.Empty()
+	err = topic.SetRetention(period)
 	if err != nil {
-		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
-		return
+		log.Printf("ERROR: failure in %s - %s", req.URL.Path, err.Error())
 	}
 
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) createChannelHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
 		log.Printf("ERROR: failed to parse request params - %s", err.Error())
@@ -437,16 +756,61 @@ func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	err = topic.DeleteExistingChannel(channelName)
+	// start_at (unix timestamp) skips everything published before it,
+	// fast forwarding past any backlog
+	startAtStr, _ := reqParams.Get("start_at")
+	if startAtStr == "" {
+		topic.GetChannel(channelName)
+		util.ApiResponse(w, 200, "OK", nil)
+		return
+	}
+	startAt, err := strconv.ParseInt(startAtStr, 10, 64)
+	if err != nil || startAt <= 0 {
+		util.ApiResponse(w, 500, "INVALID_ARG_START_AT", nil)
+		return
+	}
+
+	_, skipped, err := topic.GetChannelStartingAt(channelName, time.Unix(startAt, 0))
 	if err != nil {
-		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		log.Printf("ERROR: failed to start %s:%s at %d - %s", topicName, channelName, startAt, err.Error())
+		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+		return
+	}
+	util.ApiResponse(w, 200, "OK", struct {
+		Skipped int64 `json:"skipped"`
+	}{skipped})
+}
+
+// drainHandler starts draining this node for decommission (see NSQD.Drain),
+// nsqd exits once it's drained or after timeout (--drain-timeout by default)
+func (s *httpServer) drainHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	timeout := s.context.nsqd.options.DrainTimeout
+	timeoutStr, _ := reqParams.Get("timeout")
+	if timeoutStr != "" {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil || timeout <= 0 {
+			util.ApiResponse(w, 500, "INVALID_ARG_TIMEOUT", nil)
+			return
+		}
+	}
+
+	err = s.context.nsqd.Drain(timeout)
+	if err != nil {
+		util.ApiResponse(w, 500, "ALREADY_DRAINING", nil)
 		return
 	}
 
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func (s *httpServer) pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
 		log.Printf("ERROR: failed to parse request params - %s", err.Error())
@@ -472,19 +836,62 @@ func (s *httpServer) pauseChannelHandler(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	if strings.HasPrefix(req.URL.Path, "/pause") {
-		err = channel.Pause()
-	} else {
-		err = channel.UnPause()
+	// any of older_than (unix timestamp), body_regex or max_count only
+	// empties the messages that match (all) of them
+	var filter EmptyFilter
+	var selective bool
+	olderThanStr, _ := reqParams.Get("older_than")
+	if olderThanStr != "" {
+		olderThan, err := strconv.ParseInt(olderThanStr, 10, 64)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_OLDER_THAN", nil)
+			return
+		}
+		filter.OlderThan = time.Unix(olderThan, 0)
+		selective = true
+	}
+	bodyRegex, _ := reqParams.Get("body_regex")
+	if bodyRegex != "" {
+		filter.BodyRegexp, err = regexp.Compile(bodyRegex)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_BODY_REGEX", nil)
+			return
+		}
+		selective = true
+	}
+	maxCountStr, _ := reqParams.Get("max_count")
+	if maxCountStr != "" {
+		filter.MaxCount, err = strconv.ParseInt(maxCountStr, 10, 64)
+		if err != nil || filter.MaxCount <= 0 {
+			util.ApiResponse(w, 500, "INVALID_ARG_MAX_COUNT", nil)
+			return
+		}
+		selective = true
+	}
+
+	if selective {
+		count, err := channel.EmptyMatching(&filter)
+		if err != nil {
+			log.Printf("ERROR: failed to empty matching messages of %s:%s - %s", topicName, channelName, err.Error())
+			util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+			return
+		}
+		util.ApiResponse(w, 200, "OK", struct {
+			Count int64 `json:"count"`
+		}{count})
+		return
 	}
+
+	err = channel.Empty()
 	if err != nil {
-		log.Printf("ERROR: failure in %s - %s", req.URL.Path, err.Error())
+		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+		return
 	}
 
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func (s *httpServer) statsHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
 		log.Printf("ERROR: failed to parse request params - %s", err.Error())
@@ -492,21 +899,964 @@ func (s *httpServer) statsHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	formatString, _ := reqParams.Get("format")
-	jsonFormat := formatString == "json"
-	now := time.Now()
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
 
-	if !jsonFormat {
-		io.WriteString(w, fmt.Sprintf("%s\n", util.Version("nsqd")))
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
 	}
 
-	stats := s.context.nsqd.getStats()
+	err = topic.DeleteExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	if strings.HasPrefix(req.URL.Path, "/pause") {
+		err = channel.Pause()
+	} else {
+		err = channel.UnPause()
+	}
+	if err != nil {
+		log.Printf("ERROR: failure in %s - %s", req.URL.Path, err.Error())
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+// pauseClientHandler pauses (or resumes) delivery to a single subscribed
+// client, identified by the client_id in /stats, leaving its peers unaffected
+func (s *httpServer) pauseClientHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	clientIDStr, err := reqParams.Get("client_id")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_CLIENT_ID", nil)
+		return
+	}
+	clientID, err := strconv.ParseInt(clientIDStr, 10, 64)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_CLIENT_ID", nil)
+		return
+	}
+
+	client, err := s.context.nsqd.GetSubscribedClient(clientID)
+	if err != nil {
+		util.ApiResponse(w, 404, "CLIENT_NOT_FOUND", nil)
+		return
+	}
+
+	paused := strings.HasPrefix(req.URL.Path, "/pause")
+	client.SetDeliveryPaused(paused)
+	log.Printf("CLIENT(%d): [%s] delivery paused: %t", clientID, client, paused)
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) setChannelWatermarksHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	var high, low int64
+	highStr, _ := reqParams.Get("high")
+	if highStr != "" {
+		high, err = strconv.ParseInt(highStr, 10, 64)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_HIGH", nil)
+			return
+		}
+	}
+	lowStr, _ := reqParams.Get("low")
+	if lowStr != "" {
+		low, err = strconv.ParseInt(lowStr, 10, 64)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_LOW", nil)
+			return
+		}
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	err = channel.SetWatermarks(high, low)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_WATERMARKS", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) setChannelDeliveryIntervalHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	var interval time.Duration
+	intervalStr, _ := reqParams.Get("interval")
+	if intervalStr != "" {
+		interval, err = time.ParseDuration(intervalStr)
+		if err != nil || interval < 0 {
+			util.ApiResponse(w, 500, "INVALID_INTERVAL", nil)
+			return
+		}
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	err = channel.SetDeliveryInterval(interval)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_INTERVAL", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+// setChannelDeliveryOrderHandler sets whether a channel drains its backlog
+// first (order=fifo) or not (order=default)
+func (s *httpServer) setChannelDeliveryOrderHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	orderStr, err := reqParams.Get("order")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_ORDER", nil)
+		return
+	}
+	order, err := parseDeliveryOrder(orderStr)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_ORDER", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	err = channel.SetDeliveryOrder(order)
+	if err != nil {
+		log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+// setChannelSlowStartHandler sets the window over which a channel's newly
+// subscribed clients have their RDY ramped up (window=0 doesn't ramp it)
+func (s *httpServer) setChannelSlowStartHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	var window time.Duration
+	windowStr, _ := reqParams.Get("window")
+	if windowStr != "" {
+		window, err = time.ParseDuration(windowStr)
+		if err != nil || window < 0 {
+			util.ApiResponse(w, 500, "INVALID_WINDOW", nil)
+			return
+		}
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	err = channel.SetSlowStart(window)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_WINDOW", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) setChannelMaxInFlightHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	var max int64
+	maxStr, _ := reqParams.Get("max")
+	if maxStr != "" {
+		max, err = strconv.ParseInt(maxStr, 10, 64)
+		if err != nil || max < 0 {
+			util.ApiResponse(w, 500, "INVALID_MAX", nil)
+			return
+		}
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	err = channel.SetMaxInFlight(max)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_MAX", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+// annotateHandler updates a topic's (/annotate_topic) or channel's
+// (/annotate_channel) annotations from annotation=<key>=<value> (an empty value
+// removes the key), see meta_annotations.go
+func (s *httpServer) annotateHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	var topicName, channelName string
+	if req.URL.Path == "/annotate_channel" {
+		topicName, channelName, err = util.GetTopicChannelArgs(reqParams)
+	} else {
+		topicName, err = reqParams.Get("topic")
+		if err != nil {
+			err = errors.New("MISSING_ARG_TOPIC")
+		}
+	}
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	if len(reqParams.Values["annotation"]) == 0 {
+		util.ApiResponse(w, 500, "MISSING_ARG_ANNOTATION", nil)
+		return
+	}
+	changes, err := util.ParseLabels(reqParams.Values["annotation"])
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_ANNOTATION", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	if channelName == "" {
+		err = topic.Annotate(changes)
+	} else {
+		channel, channelErr := topic.GetExistingChannel(channelName)
+		if channelErr != nil {
+			util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+			return
+		}
+		err = channel.Annotate(changes)
+	}
+	if err == errInvalidMetaAnnotations {
+		util.ApiResponse(w, 500, "INVALID_ARG_ANNOTATION", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failure in %s - %s", req.URL.Path, err.Error())
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) setChannelPartitionsHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	partitionsStr, err := reqParams.Get("partitions")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_PARTITIONS", nil)
+		return
+	}
+	partitions, err := strconv.Atoi(partitionsStr)
+	if err != nil || partitions < 0 || partitions > maxPartitions {
+		util.ApiResponse(w, 500, "INVALID_ARG_PARTITIONS", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	err = channel.SetPartitions(partitions)
+	if err != nil {
+		log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+// setChannelMirrorHandler makes a channel (creating it if needed) a mirror of
+// another (see mirror.go), without a source it's a regular channel again
+func (s *httpServer) setChannelMirrorHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	source, _ := reqParams.Get("source")
+
+	var maxRate int64
+	maxRateStr, err := reqParams.Get("max_rate")
+	if err == nil {
+		maxRate, err = strconv.ParseInt(maxRateStr, 10, 64)
+		if err != nil || maxRate < 0 {
+			util.ApiResponse(w, 500, "INVALID_ARG_MAX_RATE", nil)
+			return
+		}
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	_, err = topic.MirrorChannel(channelName, source, maxRate)
+	if err == errInvalidMirrorSource {
+		util.ApiResponse(w, 500, "INVALID_ARG_SOURCE", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+// pushConsumerHandler adds (or, for /remove_push_consumer, removes) an HTTP
+// endpoint the channel's messages are POSTed to (see push_consumer.go)
+func (s *httpServer) pushConsumerHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	endpoint, err := reqParams.Get("url")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_URL", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	if req.URL.Path == "/remove_push_consumer" {
+		channel, err := topic.GetExistingChannel(channelName)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+			return
+		}
+		err = channel.RemovePushConsumer(endpoint)
+		if err == errInvalidPushURL {
+			util.ApiResponse(w, 500, "INVALID_ARG_URL", nil)
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+		}
+		util.ApiResponse(w, 200, "OK", nil)
+		return
+	}
+
+	concurrency := int64(1)
+	if concurrencyStr, err := reqParams.Get("concurrency"); err == nil {
+		concurrency, err = strconv.ParseInt(concurrencyStr, 10, 64)
+		if err != nil || concurrency < 1 || concurrency > s.context.nsqd.options.MaxRdyCount {
+			util.ApiResponse(w, 500, "INVALID_ARG_CONCURRENCY", nil)
+			return
+		}
+	}
+
+	var maxRate int64
+	if maxRateStr, err := reqParams.Get("max_rate"); err == nil {
+		maxRate, err = strconv.ParseInt(maxRateStr, 10, 64)
+		if err != nil || maxRate < 0 {
+			util.ApiResponse(w, 500, "INVALID_ARG_MAX_RATE", nil)
+			return
+		}
+	}
+
+	if !validPushURL(endpoint) {
+		util.ApiResponse(w, 500, "INVALID_ARG_URL", nil)
+		return
+	}
+
+	err = topic.GetChannel(channelName).AddPushConsumer(endpoint, concurrency, maxRate)
+	if err != nil {
+		log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+// setOverflowPolicyHandler sets the policy of a topic or, for
+// /set_channel_overflow_policy, a channel ("default" reverts to nsqd's)
+func (s *httpServer) setOverflowPolicyHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	policyStr, err := reqParams.Get("policy")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_POLICY", nil)
+		return
+	}
+	policy, err := parseOverflowPolicy(policyStr)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_POLICY", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	if req.URL.Path == "/set_channel_overflow_policy" {
+		channelName, err := reqParams.Get("channel")
+		if err != nil {
+			util.ApiResponse(w, 500, "MISSING_ARG_CHANNEL", nil)
+			return
+		}
+		channel, err := topic.GetExistingChannel(channelName)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+			return
+		}
+		err = channel.SetOverflowPolicy(policy)
+	} else {
+		err = topic.SetOverflowPolicy(policy)
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) setTopicSyncPolicyHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	policyStr, err := reqParams.Get("policy")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_POLICY", nil)
+		return
+	}
+	policy, err := parseSyncPolicy(policyStr)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_POLICY", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	err = topic.SetSyncPolicy(policy)
+	if err != nil {
+		log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) setTopicLargeMessagesHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	sizeStr, err := reqParams.Get("size")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_SIZE", nil)
+		return
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || size < 0 {
+		util.ApiResponse(w, 500, "INVALID_ARG_SIZE", nil)
+		return
+	}
+
+	actionStr, _ := reqParams.Get("action")
+	action, err := parseLargeMessageAction(actionStr)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_ACTION", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+	if action == largeMessageDivert && size > 0 && !nsq.IsValidTopicName(largeTopicName(topicName)) {
+		util.ApiResponse(w, 500, "INVALID_LARGE_TOPIC", nil)
+		return
+	}
+
+	err = topic.SetLargeMessageRule(size, action)
+	if err != nil {
+		log.Printf("ERROR: failure in %s - %s", req.URL.Path, err.Error())
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) topicSchemaHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	schema := topic.Schema()
+	if schema == nil {
+		util.ApiResponse(w, 500, "SCHEMA_NOT_FOUND", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", struct {
+		Mode   string          `json:"mode"`
+		Schema json.RawMessage `json:"schema"`
+	}{schema.mode.String(), json.RawMessage(schema.source)})
+}
+
+// setTopicSchemaHandler registers the schema (the body) for a topic, or
+// removes it (/delete_topic_schema)
+func (s *httpServer) setTopicSchemaHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	var schema *topicSchema
+	if req.URL.Path == "/set_topic_schema" {
+		modeStr, _ := reqParams.Get("mode")
+		mode, err := parseSchemaMode(modeStr)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_MODE", nil)
+			return
+		}
+		schema, err = newTopicSchema(reqParams.Body, mode)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_SCHEMA", struct {
+				Error string `json:"error"`
+			}{err.Error()})
+			return
+		}
+	}
+
+	err = topic.SetSchema(schema)
+	if err != nil {
+		log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+// topicExportHandler streams the topic's on disk backlog (see Topic.Export),
+// an error part way through is only apparent from the missing end record
+func (s *httpServer) topicExportHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.nsqx"`, topicName))
+	count, err := topic.Export(w)
+	if err != nil {
+		log.Printf("ERROR: failed to export topic %s after %d messages - %s", topicName, count, err.Error())
+		return
+	}
+	log.Printf("TOPIC(%s): exported %d messages", topicName, count)
+}
+
+// topicImportHandler loads the export POSTed (see NSQD.ImportTopic), into
+// the exported topic or the topic param
+func (s *httpServer) topicImportHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	// the body is streamed, so only the query is parsed
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+	topicName := reqParams.Get("topic")
+
+	topic, count, err := s.context.nsqd.ImportTopic(req.Body, topicName)
+	if err != nil {
+		log.Printf("ERROR: failed to import topic after %d messages - %s", count, err.Error())
+		util.ApiResponse(w, 500, "IMPORT_FAILED", struct {
+			Count int64 `json:"count"`
+		}{count})
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", struct {
+		Topic string `json:"topic"`
+		Count int64  `json:"count"`
+	}{topic.name, count})
+}
+
+func (s *httpServer) channelSeekHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	toStr, err := reqParams.Get("to")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TO", nil)
+		return
+	}
+	to, err := strconv.ParseInt(toStr, 10, 64)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_TO", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	if topic.RetentionPeriod() == 0 {
+		util.ApiResponse(w, 500, "RETENTION_DISABLED", nil)
+		return
+	}
+
+	count, err := topic.Seek(channel, time.Unix(to, 0))
+	if err != nil {
+		log.Printf("ERROR: failure in %s - %s", req.URL.Path, err.Error())
+		util.ApiResponse(w, 500, "SEEK_FAILED", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", struct {
+		Count int `json:"count"`
+	}{
+		Count: count,
+	})
+}
+
+func (s *httpServer) statsHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	formatString, _ := reqParams.Get("format")
+	// the v1 API only speaks JSON
+	jsonFormat := formatString == "json" || util.IsV1(w)
+	now := time.Now()
+
+	if !jsonFormat {
+		io.WriteString(w, fmt.Sprintf("%s\n", util.Version("nsqd")))
+		if s.context.nsqd.IsReadOnly() {
+			io.WriteString(w, "\nREAD_ONLY (low disk space)\n")
+		}
+		if s.context.nsqd.IsDraining() {
+			io.WriteString(w, "\nDRAINING\n")
+		}
+	}
+
+	stats := s.context.nsqd.getStats()
 
 	if jsonFormat {
+		// the snapshots (see stats_history.go), oldest first
+		var history []StatsSnapshot
+		if historyString, _ := reqParams.Get("history"); historyString == "true" && s.context.nsqd.statsHistory != nil {
+			history = s.context.nsqd.statsHistory.Snapshots()
+		}
 		util.ApiResponse(w, 200, "OK", struct {
-			Topics []TopicStats `json:"topics"`
-		}{stats})
+			ReadOnly  bool            `json:"read_only"`
+			Draining  bool            `json:"draining"`
+			Resources *ResourceStats  `json:"resources"`
+			UDP       *UDPStats       `json:"udp,omitempty"`
+			Topics    []TopicStats    `json:"topics"`
+			History   []StatsSnapshot `json:"history,omitempty"`
+		}{s.context.nsqd.IsReadOnly(), s.context.nsqd.IsDraining(), s.context.nsqd.ResourceStats(),
+			s.context.nsqd.UDPStats(), stats, history})
 	} else {
+		r := s.context.nsqd.ResourceStats()
+		io.WriteString(w, fmt.Sprintf("\nrss: %s heap: %s gc-pause: %s (%d gcs) fds: %d/%d disk: %s/%s free (%s)\n",
+			util.HumanBytes(r.RSSBytes),
+			util.HumanBytes(r.HeapBytes),
+			time.Duration(r.GCPauseLastNs),
+			r.NumGC,
+			r.OpenFDs,
+			r.MaxFDs,
+			util.HumanBytes(r.DiskFreeBytes),
+			util.HumanBytes(r.DiskTotalBytes),
+			r.DataPath))
+		if udp := s.context.nsqd.UDPStats(); udp != nil {
+			io.WriteString(w, fmt.Sprintf("\nUDP accepted: %d dropped: %d\n", udp.Accepted, udp.Dropped))
+		}
 		if len(stats) == 0 {
 			io.WriteString(w, "\nNO_TOPICS\n")
 			return
@@ -525,6 +1875,23 @@ func (s *httpServer) statsHandler(w http.ResponseWriter, req *http.Request) {
 				t.BackendDepth,
 				t.MessageCount,
 				t.E2eProcessingLatency))
+			sizes := make([]string, len(t.MessageSizes))
+			for i, bucket := range t.MessageSizes {
+				sizes[i] = fmt.Sprintf("<=%s:%d", bucket.Le, bucket.Count)
+			}
+			io.WriteString(w, fmt.Sprintf("   %-17s oversize: %-5d msg-sizes: %s\n",
+				"",
+				t.OversizeCount,
+				strings.Join(sizes, " ")))
+			for _, p := range t.Producers {
+				lastPublish := now.Sub(time.Unix(p.LastPublish, 0)) / time.Second * time.Second
+				io.WriteString(w, fmt.Sprintf("      <%s %-21s> msgs: %-8d last-pub: %s ago %s\n",
+					p.Protocol,
+					p.Address,
+					p.MessageCount,
+					lastPublish,
+					p.Name))
+			}
 			for _, c := range t.Channels {
 				if c.Paused {
 					pausedPrefix = "   *P "
@@ -532,7 +1899,7 @@ func (s *httpServer) statsHandler(w http.ResponseWriter, req *http.Request) {
 					pausedPrefix = "      "
 				}
 				io.WriteString(w,
-					fmt.Sprintf("%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d e2e%%: %s\n",
+					fmt.Sprintf("%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d lag: %-6s e2e%%: %s\n",
 						pausedPrefix,
 						c.ChannelName,
 						c.Depth,
@@ -542,13 +1909,20 @@ func (s *httpServer) statsHandler(w http.ResponseWriter, req *http.Request) {
 						c.RequeueCount,
 						c.TimeoutCount,
 						c.MessageCount,
+						time.Duration(c.LagSeconds)*time.Second,
 						c.E2eProcessingLatency))
 				for _, client := range c.Clients {
 					connectTime := time.Unix(client.ConnectTime, 0)
 					// truncate to the second
 					duration := time.Duration(int64(now.Sub(connectTime).Seconds())) * time.Second
 					_, port, _ := net.SplitHostPort(client.RemoteAddress)
-					io.WriteString(w, fmt.Sprintf("        [%s %-21s] state: %d inflt: %-4d rdy: %-4d fin: %-8d re-q: %-8d msgs: %-8d connected: %s\n",
+					if client.Paused {
+						pausedPrefix = "     *P "
+					} else {
+						pausedPrefix = "        "
+					}
+					io.WriteString(w, fmt.Sprintf("%s[%s %-21s] state: %d inflt: %-4d rdy: %-4d fin: %-8d re-q: %-8d msgs: %-8d connected: %s rtt: %s\n",
+						pausedPrefix,
 						client.Version,
 						fmt.Sprintf("%s:%s", client.Name, port),
 						client.State,
@@ -558,9 +1932,361 @@ func (s *httpServer) statsHandler(w http.ResponseWriter, req *http.Request) {
 						client.RequeueCount,
 						client.MessageCount,
 						duration,
+						time.Duration(client.HeartbeatRTT),
 					))
 				}
 			}
 		}
 	}
 }
+
+// debugLoggingHandler turns verbose logging on (for duration, by default 5m) or
+// off (duration=0) for the clients of a topic, channel and/or client address,
+// without any of those it lists what verbose logging is on for
+func (s *httpServer) debugLoggingHandler(w http.ResponseWriter, req *http.Request) {
+	if !util.NewDebugHandler(s.context.nsqd.options.HTTPDebugAuthToken).Authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="debug"`)
+		util.ApiResponse(w, 401, "UNAUTHORIZED", nil)
+		return
+	}
+
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, _ := reqParams.Get("topic")
+	channelName, _ := reqParams.Get("channel")
+	client, _ := reqParams.Get("client")
+	if topicName != "" || channelName != "" || client != "" {
+		duration := defaultDebugLoggingDuration
+		if durationStr, _ := reqParams.Get("duration"); durationStr != "" {
+			duration, err = time.ParseDuration(durationStr)
+			if err != nil {
+				util.ApiResponse(w, 500, "INVALID_ARG_DURATION", nil)
+				return
+			}
+		}
+
+		err = s.context.nsqd.debugLogging.Set(topicName, channelName, client, duration)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_SCOPE", nil)
+			return
+		}
+	}
+
+	util.ApiResponse(w, 200, "OK", struct {
+		Verbose bool         `json:"verbose"`
+		Scopes  []debugScope `json:"scopes"`
+	}{
+		Verbose: *verbose,
+		Scopes:  s.context.nsqd.debugLogging.Scopes(),
+	})
+}
+
+// channelRedeliverHandler redelivers an in-flight or deferred message (id=) to
+// a client (client_id=) subscribed to the channel, see redeliver.go
+func (s *httpServer) channelRedeliverHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	idStr, err := reqParams.Get("id")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_ID", nil)
+		return
+	}
+	if len(idStr) != nsq.MsgIDLength {
+		util.ApiResponse(w, 500, "INVALID_ARG_ID", nil)
+		return
+	}
+	var id nsq.MessageID
+	copy(id[:], idStr)
+
+	clientIDStr, err := reqParams.Get("client_id")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_CLIENT_ID", nil)
+		return
+	}
+	clientID, err := strconv.ParseInt(clientIDStr, 10, 64)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_CLIENT_ID", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	client, err := s.context.nsqd.GetSubscribedClient(clientID)
+	if err != nil {
+		util.ApiResponse(w, 404, "CLIENT_NOT_FOUND", nil)
+		return
+	}
+
+	err = channel.Redeliver(id, client)
+	switch err {
+	case nil:
+		util.ApiResponse(w, 200, "OK", nil)
+	case errRedeliverNotFound:
+		util.ApiResponse(w, 404, "MESSAGE_NOT_FOUND", nil)
+	case errRedeliverClient:
+		util.ApiResponse(w, 500, "INVALID_CLIENT", nil)
+	case errRedeliverFull:
+		util.ApiResponse(w, 500, "CLIENT_BUSY", nil)
+	default:
+		util.ApiResponse(w, 500, "REDELIVER_FAILED", nil)
+	}
+}
+
+// debugChaosHandler sets the faults injected with --chaos (see chaos.go), and
+// kills kill_clients= random clients
+func (s *httpServer) debugChaosHandler(w http.ResponseWriter, req *http.Request) {
+	chaos := s.context.nsqd.chaos
+	if chaos == nil {
+		util.ApiResponse(w, 404, "NOT_FOUND", nil)
+		return
+	}
+
+	if !util.NewDebugHandler(s.context.nsqd.options.HTTPDebugAuthToken).Authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="debug"`)
+		util.ApiResponse(w, 401, "UNAUTHORIZED", nil)
+		return
+	}
+
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	parsePercent := func(key string) (int32, bool, error) {
+		str, _ := reqParams.Get(key)
+		if str == "" {
+			return 0, false, nil
+		}
+		percent, err := strconv.Atoi(str)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, false, errors.New("invalid percent")
+		}
+		return int32(percent), true, nil
+	}
+
+	dropFINPercent, setDropFIN, err := parsePercent("drop_fin_percent")
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_DROP_FIN_PERCENT", nil)
+		return
+	}
+	diskWriteErrorPercent, setDiskWriteError, err := parsePercent("disk_write_error_percent")
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_DISK_WRITE_ERROR_PERCENT", nil)
+		return
+	}
+	var flushDelay time.Duration
+	flushDelayStr, _ := reqParams.Get("flush_delay")
+	if flushDelayStr != "" {
+		flushDelay, err = time.ParseDuration(flushDelayStr)
+		if err != nil || flushDelay < 0 {
+			util.ApiResponse(w, 500, "INVALID_ARG_FLUSH_DELAY", nil)
+			return
+		}
+	}
+	var killClients int
+	killClientsStr, _ := reqParams.Get("kill_clients")
+	if killClientsStr != "" {
+		killClients, err = strconv.Atoi(killClientsStr)
+		if err != nil || killClients < 0 {
+			util.ApiResponse(w, 500, "INVALID_ARG_KILL_CLIENTS", nil)
+			return
+		}
+	}
+
+	if _, err := reqParams.Get("reset"); err == nil {
+		chaos.Reset()
+	}
+	if setDropFIN {
+		chaos.SetDropFINPercent(dropFINPercent)
+	}
+	if setDiskWriteError {
+		chaos.SetDiskWriteErrorPercent(diskWriteErrorPercent)
+	}
+	if flushDelayStr != "" {
+		chaos.SetFlushDelay(flushDelay)
+	}
+	log.Printf("CHAOS: %+v", chaos.Settings())
+
+	var killed []int64
+	if killClients > 0 {
+		killed = s.context.nsqd.killChaosClients(killClients)
+	}
+
+	util.ApiResponse(w, 200, "OK", struct {
+		chaosSettings
+		KilledClients []int64 `json:"killed_clients,omitempty"`
+	}{
+		chaosSettings: chaos.Settings(),
+		KilledClients: killed,
+	})
+}
+
+// channelInFlightHandler lists a channel's in-flight messages (optionally only
+// the one with id=, or those held by client_id=), to tell whether a message
+// is being processed without waiting for it to time out
+func (s *httpServer) channelInFlightHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	filter := &InFlightFilter{}
+	if idStr, err := reqParams.Get("id"); err == nil {
+		if len(idStr) != nsq.MsgIDLength {
+			util.ApiResponse(w, 500, "INVALID_ARG_ID", nil)
+			return
+		}
+		var id nsq.MessageID
+		copy(id[:], idStr)
+		filter.ID = &id
+	}
+	if clientIDStr, err := reqParams.Get("client_id"); err == nil {
+		filter.ClientID, err = strconv.ParseInt(clientIDStr, 10, 64)
+		if err != nil || filter.ClientID < 1 {
+			util.ApiResponse(w, 500, "INVALID_ARG_CLIENT_ID", nil)
+			return
+		}
+	}
+
+	limit := defaultInFlightLimit
+	if limitStr, err := reqParams.Get("limit"); err == nil {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxInFlightLimit {
+			util.ApiResponse(w, 500, "INVALID_ARG_LIMIT", nil)
+			return
+		}
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	count, messages := channel.InFlightMessages(filter, limit)
+	if messages == nil {
+		messages = []InFlightMessageStats{}
+	}
+
+	util.ApiResponse(w, 200, "OK", struct {
+		Count    int                    `json:"count"`
+		Messages []InFlightMessageStats `json:"messages"`
+	}{
+		Count:    count,
+		Messages: messages,
+	})
+}
+
+// channelStatsResetHandler zeroes a channel's counters (see
+// Channel.ResetStats), rather than restarting nsqd to do so
+func (s *httpServer) channelStatsResetHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	channel.ResetStats()
+	util.OKResponse(w)
+}
+
+// channelQuarantineReleaseHandler unpauses a channel quarantined because of a
+// requeue storm (see quarantine.go)
+func (s *httpServer) channelQuarantineReleaseHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	err = channel.ReleaseQuarantine()
+	if err == errNotQuarantined {
+		util.ApiResponse(w, 500, "NOT_QUARANTINED", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failure in %s - %s", req.URL.Path, err.Error())
+	}
+
+	util.OKResponse(w)
+}
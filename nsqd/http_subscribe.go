@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+)
+
+// httpSubscriber is a Consumer that streams a channel's messages in the
+// response to GET /subscribe, it is sent up to maxInFlight messages at a time
+// and they are FIN'd or REQ'd by URL (/subscribe/fin and /subscribe/req)
+type httpSubscriber struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	InFlightCount int64
+	MessageCount  uint64
+	FinishCount   uint64
+	RequeueCount  uint64
+
+	ID            int64
+	RemoteAddress string
+	UserAgent     string
+	ConnectTime   time.Time
+
+	maxInFlight int64
+	channel     *Channel
+
+	// readyStateChan has a buffer of 1 to guarantee that in the event
+	// there is a race the state update is not lost
+	readyStateChan chan int
+	exitChan       chan int
+	closeOnce      sync.Once
+}
+
+func (s *httpSubscriber) String() string {
+	return fmt.Sprintf("HTTP:%s", s.RemoteAddress)
+}
+
+func (s *httpSubscriber) isReady() bool {
+	return !s.channel.IsPaused() && atomic.LoadInt64(&s.InFlightCount) < s.maxInFlight
+}
+
+func (s *httpSubscriber) tryUpdateReadyState() {
+	select {
+	case s.readyStateChan <- 1:
+	default:
+	}
+}
+
+func (s *httpSubscriber) Pause() {
+	s.tryUpdateReadyState()
+}
+
+func (s *httpSubscriber) UnPause() {
+	s.tryUpdateReadyState()
+}
+
+func (s *httpSubscriber) Close() error {
+	s.closeOnce.Do(func() { close(s.exitChan) })
+	return nil
+}
+
+func (s *httpSubscriber) SendingMessage() {
+	atomic.AddInt64(&s.InFlightCount, 1)
+	atomic.AddUint64(&s.MessageCount, 1)
+}
+
+func (s *httpSubscriber) FinishedMessage() {
+	atomic.AddUint64(&s.FinishCount, 1)
+	atomic.AddInt64(&s.InFlightCount, -1)
+	s.tryUpdateReadyState()
+}
+
+func (s *httpSubscriber) RequeuedMessage() {
+	atomic.AddUint64(&s.RequeueCount, 1)
+	atomic.AddInt64(&s.InFlightCount, -1)
+	s.tryUpdateReadyState()
+}
+
+func (s *httpSubscriber) TimedOutMessage() {
+	atomic.AddInt64(&s.InFlightCount, -1)
+	s.tryUpdateReadyState()
+}
+
+func (s *httpSubscriber) Empty() {
+	atomic.StoreInt64(&s.InFlightCount, 0)
+	s.tryUpdateReadyState()
+}
+
+func (s *httpSubscriber) Stats() ClientStats {
+	inFlight := atomic.LoadInt64(&s.InFlightCount)
+	readyCount := s.maxInFlight - inFlight
+	if readyCount < 0 {
+		readyCount = 0
+	}
+	return ClientStats{
+		ID:            s.ID,
+		Version:       "HTTP",
+		RemoteAddress: s.RemoteAddress,
+		Name:          s.RemoteAddress,
+		UserAgent:     s.UserAgent,
+		State:         nsq.StateSubscribed,
+		ReadyCount:    readyCount,
+		InFlightCount: inFlight,
+		MessageCount:  atomic.LoadUint64(&s.MessageCount),
+		FinishCount:   atomic.LoadUint64(&s.FinishCount),
+		RequeueCount:  atomic.LoadUint64(&s.RequeueCount),
+		ConnectTime:   s.ConnectTime.Unix(),
+	}
+}
+
+// sseMessage is the data of each Server-Sent Event
+type sseMessage struct {
+	ID        string `json:"id"`
+	Attempts  uint16 `json:"attempts"`
+	Timestamp int64  `json:"timestamp"`
+	Body      string `json:"body"`
+	FinURL    string `json:"fin_url,omitempty"`
+	ReqURL    string `json:"req_url,omitempty"`
+
+	Annotations []MessageAnnotation `json:"annotations,omitempty"`
+}
+
+// subscribeHandler streams messages from a channel for as long as the request
+// is open, either as Server-Sent Events (format=sse, the default) or as
+// size-prefixed (4 byte big endian) messages encoded as in protocol V2 frames
+// (format=chunked). Unless auto_fin=true each message must be FIN'd or REQ'd
+// before max_in_flight (default 1) is exhausted, or it times out.
+func (s *httpServer) subscribeHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	format, _ := reqParams.Get("format")
+	if format == "" {
+		format = "sse"
+	}
+	if format != "sse" && format != "chunked" {
+		util.ApiResponse(w, 500, "INVALID_ARG_FORMAT", nil)
+		return
+	}
+
+	maxInFlight := int64(1)
+	if maxInFlightStr, err := reqParams.Get("max_in_flight"); err == nil {
+		maxInFlight, err = strconv.ParseInt(maxInFlightStr, 10, 64)
+		if err != nil || maxInFlight < 1 || maxInFlight > s.context.nsqd.options.MaxRdyCount {
+			util.ApiResponse(w, 500, "INVALID_ARG_MAX_IN_FLIGHT", nil)
+			return
+		}
+	}
+
+	autoFin := false
+	if autoFinStr, err := reqParams.Get("auto_fin"); err == nil {
+		autoFin, err = strconv.ParseBool(autoFinStr)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_AUTO_FIN", nil)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		util.ApiResponse(w, 500, "STREAMING_UNSUPPORTED", nil)
+		return
+	}
+
+	if s.context.nsqd.IsDraining() {
+		util.ApiResponse(w, 503, "DRAINING", nil)
+		return
+	}
+
+	topic, err := s.context.nsqd.AutoCreateTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 403, "TOPIC_CREATION_DENIED", nil)
+		return
+	}
+	channel, err := topic.AutoCreateChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 403, "CHANNEL_CREATION_DENIED", nil)
+		return
+	}
+
+	sub := &httpSubscriber{
+		ID:             atomic.AddInt64(&s.context.nsqd.clientIDSequence, 1),
+		RemoteAddress:  req.RemoteAddr,
+		UserAgent:      req.UserAgent(),
+		ConnectTime:    time.Now(),
+		maxInFlight:    maxInFlight,
+		channel:        channel,
+		readyStateChan: make(chan int, 1),
+		exitChan:       make(chan int),
+	}
+	channel.AddClient(sub.ID, sub)
+	defer channel.RemoveClient(sub.ID)
+
+	log.Printf("HTTP: [%s] subscribed to %s:%s", sub, topicName, channelName)
+
+	commitParams := url.Values{}
+	commitParams.Set("topic", topicName)
+	commitParams.Set("channel", channelName)
+	commitParams.Set("subscriber", strconv.FormatInt(sub.ID, 10))
+
+	w.Header().Set("X-NSQ-Subscriber-ID", strconv.FormatInt(sub.ID, 10))
+	if format == "sse" {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	// heartbeats let an idle subscriber (and any proxy in between) know that
+	// the stream is still alive, they are an SSE comment or an empty chunk...
+	// they're also how a subscriber that went away is noticed, as writing to
+	// it fails (http.CloseNotifier needs Go 1.1)
+	heartbeatTicker := time.NewTicker(s.context.nsqd.options.ClientTimeout / 2)
+	defer heartbeatTicker.Stop()
+
+	var buf bytes.Buffer
+	for {
+		var msgChan chan *nsq.Message
+		if sub.isReady() {
+			msgChan = channel.clientMsgChan
+		}
+
+		select {
+		case msg, ok := <-msgChan:
+			if !ok {
+				return
+			}
+			channel.StartInFlightTimeout(msg, sub.ID, s.context.nsqd.options.MsgTimeout)
+			sub.SendingMessage()
+
+			buf.Reset()
+			if format == "sse" {
+				err = writeSSEMessage(&buf, msg, channel.annotations.get(msg.Id), commitParams, autoFin)
+			} else {
+				err = writeChunkedMessage(&buf, msg)
+			}
+			if err == nil {
+				_, err = w.Write(buf.Bytes())
+			}
+			if err != nil {
+				log.Printf("HTTP: [%s] subscribe error - %s", sub, err.Error())
+				return
+			}
+			flusher.Flush()
+
+			if autoFin {
+				if channel.FinishMessage(sub.ID, msg.Id) == nil {
+					sub.FinishedMessage()
+				}
+			}
+		case <-sub.readyStateChan:
+		case <-heartbeatTicker.C:
+			if format == "sse" {
+				_, err = io.WriteString(w, ": _heartbeat_\n\n")
+			} else {
+				_, err = w.Write(make([]byte, 4))
+			}
+			if err != nil {
+				log.Printf("HTTP: [%s] subscriber disconnected", sub)
+				return
+			}
+			flusher.Flush()
+		case <-sub.exitChan:
+			return
+		}
+	}
+}
+
+func writeSSEMessage(w io.Writer, msg *nsq.Message, annotations []MessageAnnotation,
+	commitParams url.Values, autoFin bool) error {
+	id := string(msg.Id[:])
+	data := sseMessage{
+		ID:          id,
+		Attempts:    msg.Attempts,
+		Timestamp:   msg.Timestamp,
+		Body:        string(msg.Body),
+		Annotations: annotations,
+	}
+	if !autoFin {
+		query := commitParams.Encode() + "&id=" + url.QueryEscape(id)
+		data.FinURL = "/subscribe/fin?" + query
+		data.ReqURL = "/subscribe/req?" + query + "&timeout=0"
+	}
+	js, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", id, js)
+	return err
+}
+
+func writeChunkedMessage(w io.Writer, msg *nsq.Message) error {
+	var body bytes.Buffer
+	err := msg.Write(&body)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.BigEndian, int32(body.Len()))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body.Bytes())
+	return err
+}
+
+// subscribeCommitHandler handles /subscribe/fin and /subscribe/req (which
+// takes a timeout in ms, like REQ) for messages sent to an HTTP subscriber
+func (s *httpServer) subscribeCommitHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	subscriberStr, err := reqParams.Get("subscriber")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_SUBSCRIBER", nil)
+		return
+	}
+	subscriberID, err := strconv.ParseInt(subscriberStr, 10, 64)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_SUBSCRIBER", nil)
+		return
+	}
+
+	idStr, err := reqParams.Get("id")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_ID", nil)
+		return
+	}
+	if len(idStr) != nsq.MsgIDLength {
+		util.ApiResponse(w, 500, "INVALID_ARG_ID", nil)
+		return
+	}
+	var id nsq.MessageID
+	copy(id[:], idStr)
+
+	var timeout time.Duration
+	var annotation string
+	requeue := req.URL.Path == "/subscribe/req"
+	if requeue {
+		timeoutStr, err := reqParams.Get("timeout")
+		if err != nil {
+			util.ApiResponse(w, 500, "MISSING_ARG_TIMEOUT", nil)
+			return
+		}
+		timeout, err = parseRequeueTimeout([]byte(timeoutStr), time.Now())
+		if err != nil || timeout < 0 || timeout > s.context.nsqd.options.MaxReqTimeout {
+			util.ApiResponse(w, 500, "INVALID_ARG_TIMEOUT", nil)
+			return
+		}
+		annotation, _ = reqParams.Get("annotation")
+		if len(annotation) > maxAnnotationSize {
+			util.ApiResponse(w, 500, "INVALID_ARG_ANNOTATION", nil)
+			return
+		}
+	}
+
+	topic, err := s.context.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	// the subscriber may have since disconnected
+	channel.RLock()
+	sub, ok := channel.clients[subscriberID].(*httpSubscriber)
+	channel.RUnlock()
+
+	if requeue {
+		clientName := subscriberStr
+		if ok {
+			clientName = sub.String()
+		}
+		err = channel.RequeueAnnotatedMessage(subscriberID, id, timeout, clientName, annotation)
+	} else {
+		err = channel.FinishMessage(subscriberID, id)
+	}
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_MESSAGE", nil)
+		return
+	}
+
+	if ok {
+		if requeue {
+			sub.RequeuedMessage()
+		} else {
+			sub.FinishedMessage()
+		}
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -64,6 +69,127 @@ func TestHTTPputEmpty(t *testing.T) {
 	assert.Equal(t, topic.Depth(), int64(0))
 }
 
+func TestHTTPv1(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_http_v1" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/v1/pub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	assert.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "application/json; charset=utf-8")
+	assert.Equal(t, string(body), `{"status_code":200,"status_txt":"OK","data":null}`)
+	assert.Equal(t, topic.Depth(), int64(1))
+
+	// client errors aren't 500s
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString(""))
+	assert.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 400)
+	assert.Equal(t, string(body), `{"status_code":400,"status_txt":"MSG_EMPTY","data":null}`)
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/v1/empty_topic?topic=does_not_exist", httpAddr))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 404)
+
+	// /stats is JSON
+	resp, err = http.Get(fmt.Sprintf("http://%s/v1/stats", httpAddr))
+	assert.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	var stats struct {
+		StatusTxt string `json:"status_txt"`
+	}
+	assert.Equal(t, json.Unmarshal(body, &stats), nil)
+	assert.Equal(t, stats.StatusTxt, "OK")
+
+	// negotiated on the legacy endpoints
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/ping", httpAddr), nil)
+	req.Header.Set("Accept", "application/vnd.nsq; version=1.0")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("Content-Type"), "application/vnd.nsq; version=1.0")
+	assert.Equal(t, string(body), `{"status_code":200,"status_txt":"OK","data":null}`)
+
+	// which are otherwise unchanged
+	resp, err = http.Get(fmt.Sprintf("http://%s/ping", httpAddr))
+	assert.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, string(body), "OK")
+}
+
+func TestHTTPalias(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	alias := "test_http_alias" + suffix
+	topicA := "test_http_alias_a" + suffix
+	topicB := "test_http_alias_b" + suffix
+
+	url := fmt.Sprintf("http://%s/create_alias?alias=%s&topic=%s&topic=%s", httpAddr, alias, topicA, topicB)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	buf := bytes.NewBuffer([]byte("test message"))
+	url = fmt.Sprintf("http://%s/put?topic=%s", httpAddr, alias)
+	resp, err = http.Post(url, "application/octet-stream", buf)
+	assert.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, string(body), "OK")
+
+	time.Sleep(5 * time.Millisecond)
+
+	a, _ := nsqd.GetExistingTopic(topicA)
+	b, _ := nsqd.GetExistingTopic(topicB)
+	assert.Equal(t, a.Depth(), int64(1))
+	assert.Equal(t, b.Depth(), int64(1))
+	_, err = nsqd.GetExistingTopic(alias)
+	assert.NotEqual(t, err, nil)
+
+	metadata, err := getMetadata(nsqd)
+	assert.Equal(t, err, nil)
+	topicNames, _ := metadata.Get("aliases").Get(alias).StringArray()
+	assert.Equal(t, topicNames, []string{topicA, topicB})
+
+	// an alias can't shadow an existing topic
+	url = fmt.Sprintf("http://%s/create_alias?alias=%s&topic=%s", httpAddr, topicA, topicB)
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	assert.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, string(body), `{"status_code":500,"status_txt":"TOPIC_EXISTS","data":null}`)
+
+	url = fmt.Sprintf("http://%s/delete_alias?alias=%s", httpAddr, alias)
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, nsqd.isAlias(alias), false)
+}
+
 func TestHTTPmput(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
@@ -153,6 +279,151 @@ func TestHTTPmputBinary(t *testing.T) {
 	assert.Equal(t, topic.Depth(), int64(5))
 }
 
+func TestHTTPdebug(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.HTTPDebugAuthToken = "secret"
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	get := func(path string, token string) int {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s%s", httpAddr, path), nil)
+		if token != "" {
+			req.SetBasicAuth("", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// disabled by default
+	assert.Equal(t, get("/debug/gc", "secret"), 404)
+
+	options.HTTPDebug = true
+	assert.Equal(t, get("/debug/gc", ""), 401)
+	assert.Equal(t, get("/debug/gc", "wrong"), 401)
+	assert.Equal(t, get("/debug/gc", "secret"), 200)
+	assert.Equal(t, get("/debug/goroutines", "secret"), 200)
+	assert.Equal(t, get("/debug/pprof/heap", "secret"), 200)
+	assert.Equal(t, get("/debug/pprof/nonexistent", "secret"), 404)
+}
+
+func TestHTTPsubscribe(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_http_sub" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	for _, body := range []string{"first", "second"} {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte(body)))
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/subscribe?topic=%s&channel=ch", httpAddr, topicName))
+	assert.Equal(t, err, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+	rd := bufio.NewReader(resp.Body)
+
+	readEvent := func() sseMessage {
+		var msg sseMessage
+		for {
+			line, err := rd.ReadString('\n')
+			assert.Equal(t, err, nil)
+			if strings.HasPrefix(line, "data: ") {
+				err = json.Unmarshal([]byte(line[len("data: "):]), &msg)
+				assert.Equal(t, err, nil)
+			}
+			if line == "\n" && msg.ID != "" {
+				return msg
+			}
+		}
+		panic("unreachable")
+	}
+
+	msg := readEvent()
+	assert.Equal(t, msg.Body, "first")
+	assert.Equal(t, msg.Attempts, uint16(1))
+
+	// max_in_flight defaults to 1, so nothing more is sent until a FIN
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, channel.Depth(), int64(1))
+
+	finResp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, msg.FinURL))
+	assert.Equal(t, err, nil)
+	finResp.Body.Close()
+	assert.Equal(t, finResp.StatusCode, 200)
+
+	msg = readEvent()
+	assert.Equal(t, msg.Body, "second")
+
+	// REQ puts it back on the channel (to be sent to us again)
+	reqResp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, msg.ReqURL))
+	assert.Equal(t, err, nil)
+	reqResp.Body.Close()
+	assert.Equal(t, reqResp.StatusCode, 200)
+
+	msg = readEvent()
+	assert.Equal(t, msg.Body, "second")
+	assert.Equal(t, msg.Attempts, uint16(2))
+
+	// a message can only be FIN'd once
+	finResp, err = http.Get(fmt.Sprintf("http://%s%s", httpAddr, msg.FinURL))
+	assert.Equal(t, err, nil)
+	finResp.Body.Close()
+	finResp, err = http.Get(fmt.Sprintf("http://%s%s", httpAddr, msg.FinURL))
+	assert.Equal(t, err, nil)
+	finResp.Body.Close()
+	assert.Equal(t, finResp.StatusCode, 500)
+}
+
+func TestHTTPsubscribeChunked(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_http_sub_ch" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	for i := 0; i < 3; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/subscribe?topic=%s&channel=ch&format=chunked&auto_fin=true",
+		httpAddr, topicName))
+	assert.Equal(t, err, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	for i := 0; i < 3; i++ {
+		var size int32
+		err = binary.Read(resp.Body, binary.BigEndian, &size)
+		assert.Equal(t, err, nil)
+		data := make([]byte, size)
+		_, err = io.ReadFull(resp.Body, data)
+		assert.Equal(t, err, nil)
+		msg, err := nsq.DecodeMessage(data)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, msg.Body, []byte("test body"))
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/subscribe?topic=%s&channel=ch&format=xml", httpAddr, topicName))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+}
+
 func BenchmarkHTTPput(b *testing.B) {
 	var wg sync.WaitGroup
 	b.StopTimer()
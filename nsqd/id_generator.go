@@ -0,0 +1,280 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+)
+
+// message IDs are generated by one of (--id-generator):
+//
+//  * snowflake (the default) - a timestamp, --worker-id and a sequence (see
+//    guid.go), IDs are unique across nsqds only as long as worker ids are
+//  * ulid - a millisecond timestamp and 48 random bits (incremented within a
+//    millisecond), it doesn't depend on worker ids at all
+//  * sequencer - blocks of IDs allocated by an external sequencer
+//    (--id-sequencer-url), unique as long as the sequencer's are
+//
+// keyed messages (see partition.go) carry the key in place of the worker id
+// so they're only supported with snowflake IDs
+
+const (
+	idGeneratorSnowflake = "snowflake"
+	idGeneratorULID      = "ulid"
+	idGeneratorSequencer = "sequencer"
+)
+
+type idGenerator interface {
+	NewID() (nsq.MessageID, error)
+}
+
+func newIDGenerator(options *nsqdOptions) (idGenerator, error) {
+	switch options.IDGenerator {
+	case idGeneratorSnowflake:
+		return &snowflakeIDGenerator{workerID: options.ID}, nil
+	case idGeneratorULID:
+		return newULIDGenerator(), nil
+	case idGeneratorSequencer:
+		if options.IDSequencerURL == "" {
+			return nil, errors.New("--id-generator=sequencer requires --id-sequencer-url")
+		}
+		if options.IDSequencerBlockSize < 1 {
+			return nil, errors.New("--id-sequencer-block-size must be at least 1")
+		}
+		endpoint, err := url.Parse(options.IDSequencerURL)
+		if err != nil {
+			return nil, err
+		}
+		return newSequencerIDGenerator(endpoint, options.IDSequencerBlockSize, options.ID), nil
+	}
+	return nil, fmt.Errorf("invalid --id-generator %s (snowflake, ulid or sequencer)", options.IDGenerator)
+}
+
+type snowflakeIDGenerator struct {
+	factory  GUIDFactory
+	workerID int64
+}
+
+func (g *snowflakeIDGenerator) NewID() (nsq.MessageID, error) {
+	guid, err := g.factory.NewGUID(g.workerID)
+	if err != nil {
+		return nsq.MessageID{}, err
+	}
+	return guid.Hex(), nil
+}
+
+// a ULID is 128 bits, more than a 16 byte message ID holds as text, so these
+// are 48 bits of timestamp and 48 of randomness (rather than 80) encoded 6
+// bits per byte with an alphabet in ASCII order so that they sort by time
+const (
+	ulidAlphabet   = "-0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz"
+	ulidRandomBits = 48
+	ulidRandomMask = uint64(1)<<ulidRandomBits - 1
+)
+
+type ulidGenerator struct {
+	rand          *rand.Rand
+	lastTimestamp int64
+	lastRandom    uint64
+}
+
+func newULIDGenerator() *ulidGenerator {
+	var seed int64
+	err := binary.Read(crand.Reader, binary.BigEndian, &seed)
+	if err != nil {
+		seed = time.Now().UnixNano()
+	}
+	return &ulidGenerator{rand: rand.New(rand.NewSource(seed))}
+}
+
+func (g *ulidGenerator) NewID() (nsq.MessageID, error) {
+	ts := time.Now().UnixNano() / 1e6
+
+	if ts < g.lastTimestamp {
+		return nsq.MessageID{}, ErrTimeBackwards
+	}
+
+	// within a millisecond IDs are monotonic, the random bits are incremented
+	if ts == g.lastTimestamp {
+		g.lastRandom = (g.lastRandom + 1) & ulidRandomMask
+		if g.lastRandom == 0 {
+			return nsq.MessageID{}, ErrSequenceExpired
+		}
+	} else {
+		g.lastRandom = uint64(g.rand.Int63()) & ulidRandomMask
+		// leave room to increment
+		g.lastRandom &^= 1 << (ulidRandomBits - 1)
+	}
+
+	g.lastTimestamp = ts
+
+	var id nsq.MessageID
+	putULIDBits(id[:8], uint64(ts))
+	putULIDBits(id[8:], g.lastRandom)
+	return id, nil
+}
+
+// putULIDBits encodes the low 6*len(b) bits of v into b
+func putULIDBits(b []byte, v uint64) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = ulidAlphabet[v&0x3f]
+		v >>= 6
+	}
+}
+
+// the sequencer is asked for blocks with:
+//
+//	GET <--id-sequencer-url>?count=<--id-sequencer-block-size>&worker_id=<--worker-id>
+//
+// and responds (in the usual format) with the block it allocated, which can be
+// smaller than asked for:
+//
+//	{"status_code":200, "status_txt":"OK", "data":{"start":<int>, "count":<int>}}
+//
+// IDs are the hex of each integer (as snowflake IDs are), the next block is
+// fetched once half of the current one is used
+type sequencerIDGenerator struct {
+	endpoint  *url.URL
+	blockSize int64
+	workerID  int64
+
+	next int64
+	end  int64
+
+	pending   chan *idBlock
+	lastError error
+	retryAt   time.Time
+}
+
+type idBlock struct {
+	start int64
+	count int64
+	err   error
+}
+
+var errBadIDBlock = errors.New("sequencer returned an invalid block")
+
+func newSequencerIDGenerator(endpoint *url.URL, blockSize int64, workerID int64) *sequencerIDGenerator {
+	return &sequencerIDGenerator{
+		endpoint:  endpoint,
+		blockSize: blockSize,
+		workerID:  workerID,
+	}
+}
+
+// NewID isn't safe for concurrent use (idPump is its only caller)
+func (g *sequencerIDGenerator) NewID() (nsq.MessageID, error) {
+	if g.next == g.end {
+		if g.pending == nil {
+			// don't hammer a sequencer that's failing
+			if time.Now().Before(g.retryAt) {
+				return nsq.MessageID{}, g.lastError
+			}
+			g.fetch()
+		}
+		block := <-g.pending
+		g.pending = nil
+		if block.err != nil {
+			g.lastError = fmt.Errorf("failed to fetch ID block - %s", block.err.Error())
+			g.retryAt = time.Now().Add(time.Second)
+			return nsq.MessageID{}, g.lastError
+		}
+		g.next, g.end = block.start, block.start+block.count
+	}
+
+	id := GUID(g.next).Hex()
+	g.next++
+
+	if g.pending == nil && g.end-g.next <= g.blockSize/2 {
+		g.fetch()
+	}
+	return id, nil
+}
+
+func (g *sequencerIDGenerator) fetch() {
+	g.pending = make(chan *idBlock, 1)
+	go func(pending chan *idBlock) {
+		pending <- g.requestBlock()
+	}(g.pending)
+}
+
+func (g *sequencerIDGenerator) requestBlock() *idBlock {
+	endpoint := *g.endpoint
+	params := endpoint.Query()
+	params.Set("count", strconv.FormatInt(g.blockSize, 10))
+	params.Set("worker_id", strconv.FormatInt(g.workerID, 10))
+	endpoint.RawQuery = params.Encode()
+
+	data, err := util.ApiRequest(endpoint.String())
+	if err != nil {
+		return &idBlock{err: err}
+	}
+	start, err := data.Get("start").Int64()
+	if err != nil {
+		return &idBlock{err: err}
+	}
+	count, err := data.Get("count").Int64()
+	if err != nil {
+		return &idBlock{err: err}
+	}
+	// the top bit of an ID marks it as keyed
+	if start < 0 || count < 1 || start > math.MaxInt64-count {
+		return &idBlock{err: errBadIDBlock}
+	}
+	return &idBlock{start: start, count: count}
+}
+
+// keyedMessageIDs returns whether message IDs can carry a key (see
+// partition.go)
+func (n *NSQD) keyedMessageIDs() bool {
+	_, ok := n.idGenerator.(*snowflakeIDGenerator)
+	return ok
+}
+
+// setWorkerIDCollisions records the producers lookupd reported (on IDENTIFY)
+// as sharing our worker id
+func (n *NSQD) setWorkerIDCollisions(lookupd string, addresses []string) {
+	if len(addresses) > 0 {
+		log.Printf("ERROR: LOOKUPD(%s): worker id %d collides with %s, message IDs aren't unique",
+			lookupd, n.options.ID, strings.Join(addresses, ", "))
+	}
+
+	n.workerIDCollisionsMutex.Lock()
+	defer n.workerIDCollisionsMutex.Unlock()
+	if len(addresses) == 0 {
+		delete(n.workerIDCollisions, lookupd)
+		return
+	}
+	n.workerIDCollisions[lookupd] = addresses
+}
+
+// WorkerIDCollisions returns the producers any lookupd reported as sharing our
+// worker id
+func (n *NSQD) WorkerIDCollisions() []string {
+	n.workerIDCollisionsMutex.Lock()
+	defer n.workerIDCollisionsMutex.Unlock()
+	seen := make(map[string]bool)
+	addresses := make([]string, 0)
+	for _, lookupdAddresses := range n.workerIDCollisions {
+		for _, address := range lookupdAddresses {
+			if !seen[address] {
+				seen[address] = true
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestULIDGenerator(t *testing.T) {
+	g := newULIDGenerator()
+	var last nsq.MessageID
+	seen := make(map[nsq.MessageID]bool)
+	for i := 0; i < 100000; i++ {
+		id, err := g.NewID()
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, seen[id], false)
+		seen[id] = true
+		// they sort by time (and are monotonic within a millisecond)
+		assert.Equal(t, string(id[:]) > string(last[:]), true)
+		last = id
+		// and don't have the keyed bit
+		_, keyed := messageKeyHash(id)
+		assert.Equal(t, keyed, false)
+	}
+}
+
+func TestSequencerIDGenerator(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	var mutex sync.Mutex
+	var next int64 = 1000
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, req.URL.Query().Get("worker_id"), "878")
+		assert.Equal(t, req.URL.Query().Get("token"), "secret")
+		count, _ := strconv.ParseInt(req.URL.Query().Get("count"), 10, 64)
+		mutex.Lock()
+		start := next
+		next += count + 500
+		requests++
+		mutex.Unlock()
+		fmt.Fprintf(w, `{"status_code":200,"status_txt":"OK","data":{"start":%d,"count":%d}}`, start, count)
+	}))
+	defer ts.Close()
+
+	options := NewNSQDOptions()
+	options.IDGenerator = idGeneratorSequencer
+	options.IDSequencerURL = ts.URL + "/allocate?token=secret"
+	options.IDSequencerBlockSize = 100
+	g, err := newIDGenerator(options)
+	assert.Equal(t, err, nil)
+
+	// blocks are used in order, skipping the gaps between them
+	for i := int64(0); i < 240; i++ {
+		id, err := g.NewID()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, id, GUID(1000+i/100*600+i%100).Hex())
+	}
+	mutex.Lock()
+	assert.Equal(t, requests, 3)
+	mutex.Unlock()
+
+	options.IDSequencerURL = ""
+	_, err = newIDGenerator(options)
+	assert.NotEqual(t, err, nil)
+
+	options.IDGenerator = "uuid"
+	_, err = newIDGenerator(options)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestSequencerIDGeneratorFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"status_code":500,"status_txt":"INTERNAL_ERROR","data":null}`))
+	}))
+	defer ts.Close()
+
+	options := NewNSQDOptions()
+	options.IDGenerator = idGeneratorSequencer
+	options.IDSequencerURL = ts.URL
+	g, err := newIDGenerator(options)
+	assert.Equal(t, err, nil)
+
+	_, err = g.NewID()
+	assert.NotEqual(t, err, nil)
+	// isn't retried straight away
+	_, err2 := g.NewID()
+	assert.Equal(t, err2, err)
+}
+
+func TestKeyedPublishRequiresSnowflake(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.IDGenerator = idGeneratorULID
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_keyed_ulid"
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/put?topic=%s&key=user1", httpAddr, topicName),
+		"application/octet-stream", nil)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	cmd := nsq.Publish(topicName, []byte("test body"))
+	cmd.Params = append(cmd.Params, []byte("user1"))
+	cmd.Write(conn)
+	readValidate(t, conn, nsq.FrameTypeError, "E_INVALID PUB keys require --id-generator=snowflake")
+
+	// unkeyed publishes are fine
+	resp, err = http.Post(fmt.Sprintf("http://%s/put?topic=%s", httpAddr, topicName),
+		"application/octet-stream", strings.NewReader("test body"))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// the default (and most) in-flight messages /channel/in_flight lists
+const (
+	defaultInFlightLimit = 100
+	maxInFlightLimit     = 10000
+)
+
+// InFlightMessageStats describes a message that has been sent to a client
+// and not yet FIN'd, REQ'd or timed out
+type InFlightMessageStats struct {
+	ID        string `json:"id"`
+	Attempts  uint16 `json:"attempts"`
+	Timestamp int64  `json:"timestamp"`
+	// ms since it was sent, and until it times out
+	Age     int64 `json:"age"`
+	Timeout int64 `json:"timeout"`
+
+	ClientID      int64  `json:"client_id"`
+	ClientAddress string `json:"client_address"`
+	ClientName    string `json:"client_name"`
+
+	// what it was REQ'd with (see annotations.go)
+	Annotations []MessageAnnotation `json:"annotations,omitempty"`
+}
+
+// InFlightFilter selects in-flight messages, by ID and/or the client holding
+// them (empty fields match every message)
+type InFlightFilter struct {
+	ID       *nsq.MessageID
+	ClientID int64
+}
+
+// InFlightMessages returns the number of the channel's in-flight messages
+// that match filter and (up to limit of) them, those sent longest ago first
+func (c *Channel) InFlightMessages(filter *InFlightFilter, limit int) (int, []InFlightMessageStats) {
+	now := time.Now()
+
+	c.inFlightMutex.Lock()
+	var stats []InFlightMessageStats
+	for id, item := range c.inFlightMessages {
+		if filter.ID != nil && *filter.ID != id {
+			continue
+		}
+		m := item.Value.(*inFlightMessage)
+		if filter.ClientID != 0 && filter.ClientID != m.clientID {
+			continue
+		}
+		stats = append(stats, InFlightMessageStats{
+			ID:        string(id[:]),
+			Attempts:  m.msg.Attempts,
+			Timestamp: m.msg.Timestamp,
+			Age:       int64(now.Sub(m.ts) / time.Millisecond),
+			Timeout:   int64(time.Duration(item.Priority-now.UnixNano()) / time.Millisecond),
+			ClientID:  m.clientID,
+		})
+	}
+	c.inFlightMutex.Unlock()
+
+	count := len(stats)
+	sort.Sort(InFlightMessagesByAge(stats))
+	if len(stats) > limit {
+		stats = stats[:limit]
+	}
+
+	// the client may have since disconnected (its messages time out)
+	clients := make(map[int64]Consumer)
+	c.RLock()
+	for i := range stats {
+		clients[stats[i].ClientID] = c.clients[stats[i].ClientID]
+	}
+	c.RUnlock()
+
+	clientStats := make(map[int64]ClientStats)
+	for clientID, client := range clients {
+		if client != nil {
+			clientStats[clientID] = client.Stats()
+		}
+	}
+	for i := range stats {
+		if s, ok := clientStats[stats[i].ClientID]; ok {
+			stats[i].ClientAddress = s.RemoteAddress
+			stats[i].ClientName = s.Name
+		}
+		var id nsq.MessageID
+		copy(id[:], stats[i].ID)
+		stats[i].Annotations = c.annotations.get(id)
+	}
+
+	return count, stats
+}
+
+type InFlightMessagesByAge []InFlightMessageStats
+
+func (s InFlightMessagesByAge) Len() int {
+	return len(s)
+}
+
+func (s InFlightMessagesByAge) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s InFlightMessagesByAge) Less(i, j int) bool {
+	return s[i].Age > s[j].Age
+}
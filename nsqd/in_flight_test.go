@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestChannelInFlight(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_in_flight" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	for i := 0; i < 2; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+
+	err = nsq.Ready(2).Write(conn)
+	assert.Equal(t, err, nil)
+	var ids []nsq.MessageID
+	for i := 0; i < 2; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		_, data, _ := nsq.UnpackResponse(resp)
+		msg, err := nsq.DecodeMessage(data)
+		assert.Equal(t, err, nil)
+		ids = append(ids, msg.Id)
+	}
+
+	inFlight := func(query string) (int, []interface{}) {
+		endpoint := fmt.Sprintf("http://%s/channel/in_flight?topic=%s&channel=ch%s", httpAddr, topicName, query)
+		data, err := util.ApiRequest(endpoint)
+		assert.Equal(t, err, nil)
+		return int(data.Get("count").MustInt64()), data.Get("messages").MustArray()
+	}
+
+	count, messages := inFlight("")
+	assert.Equal(t, count, 2)
+	assert.Equal(t, len(messages), 2)
+	m := messages[0].(map[string]interface{})
+	assert.Equal(t, m["client_name"], "test")
+	assert.NotEqual(t, m["client_id"], float64(0))
+
+	count, messages = inFlight("&limit=1")
+	assert.Equal(t, count, 2)
+	assert.Equal(t, len(messages), 1)
+
+	count, messages = inFlight("&id=" + url.QueryEscape(string(ids[1][:])))
+	assert.Equal(t, count, 1)
+	assert.Equal(t, messages[0].(map[string]interface{})["id"], string(ids[1][:]))
+
+	// it's no longer in flight once FIN'd
+	err = nsq.Finish(ids[1]).Write(conn)
+	assert.Equal(t, err, nil)
+	for i := 0; i < 100; i++ {
+		if count, _ = inFlight(""); count == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	count, _ = inFlight("&id=" + url.QueryEscape(string(ids[1][:])))
+	assert.Equal(t, count, 0)
+}
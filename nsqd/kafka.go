@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+)
+
+// --kafka-address speaks a minimal subset of the Kafka protocol, ApiVersions,
+// Metadata and Produce (the versions before flexible encodings), so that
+// services that only have a Kafka producer library can publish to nsqd.
+//
+// a Kafka topic is the nsqd topic of the same name, with a single partition
+// (0) led by this nsqd (broker 0). A record's key becomes the message's key
+// (see partition.go), its timestamp and headers are dropped. There are no
+// offsets, produce responses report -1. Compressed and transactional batches
+// aren't supported and nothing can be consumed.
+const (
+	kafkaProduce     = 0
+	kafkaMetadata    = 3
+	kafkaAPIVersions = 18
+
+	// like Kafka's connections.max.idle.ms
+	kafkaIdleTimeout = 10 * time.Minute
+)
+
+// Kafka error codes
+const (
+	kafkaErrUnknown                 = -1
+	kafkaErrNone                    = 0
+	kafkaErrCorruptMessage          = 2
+	kafkaErrUnknownTopicOrPartition = 3
+	kafkaErrMessageTooLarge         = 10
+	kafkaErrInvalidTopic            = 17
+	kafkaErrNotEnoughReplicas       = 19
+	kafkaErrTopicAuthorization      = 29
+	kafkaErrUnsupportedVersion      = 35
+	kafkaErrUnsupportedCompression  = 76
+)
+
+type kafkaAPI struct {
+	key        int16
+	minVersion int16
+	maxVersion int16
+}
+
+// the API versions supported, as reported by ApiVersions
+var kafkaAPIs = []kafkaAPI{
+	{kafkaProduce, 0, 3},
+	{kafkaMetadata, 0, 1},
+	{kafkaAPIVersions, 0, 2},
+}
+
+var errKafkaShortRequest = errors.New("request is too short")
+
+func kafkaSupported(key int16, version int16) bool {
+	for _, api := range kafkaAPIs {
+		if api.key == key {
+			return version >= api.minVersion && version <= api.maxVersion
+		}
+	}
+	return false
+}
+
+func (n *NSQD) listenKafka() {
+	listener, err := net.Listen("tcp", n.options.KafkaAddress)
+	if err != nil {
+		log.Fatalf("FATAL: listen (%s) failed - %s", n.options.KafkaAddress, err.Error())
+	}
+	n.kafkaListener = listener
+	kafkaServer := &kafkaServer{context: &Context{n}}
+	n.waitGroup.Wrap(func() { util.TCPServer(listener, kafkaServer) })
+}
+
+type kafkaServer struct {
+	context *Context
+}
+
+func (s *kafkaServer) Handle(conn net.Conn) {
+	log.Printf("KAFKA: new client(%s)", conn.RemoteAddr())
+	defer conn.Close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(kafkaIdleTimeout))
+		var size int32
+		err := binary.Read(conn, binary.BigEndian, &size)
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("KAFKA: client(%s) - %s", conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+		if size < 0 || int64(size) > s.context.nsqd.options.MaxBodySize {
+			log.Printf("KAFKA: client(%s) - request of %d bytes is too big", conn.RemoteAddr(), size)
+			return
+		}
+
+		request := make([]byte, size)
+		_, err = io.ReadFull(conn, request)
+		if err != nil {
+			log.Printf("KAFKA: client(%s) - %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+
+		response, err := s.handleRequest(request, conn.RemoteAddr().String())
+		if err != nil {
+			// like Kafka, the connection is closed for requests it can't handle
+			log.Printf("KAFKA: client(%s) - %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+		if response == nil {
+			continue
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_, err = conn.Write(response)
+		if err != nil {
+			log.Printf("KAFKA: client(%s) - %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+	}
+}
+
+// handleRequest returns the response to a request (nil for a produce request
+// with acks=0, which has none)
+func (s *kafkaServer) handleRequest(request []byte, remoteAddr string) ([]byte, error) {
+	d := &kafkaDecoder{buf: request}
+	key := d.int16()
+	version := d.int16()
+	correlationID := d.int32()
+	clientID := d.string()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	e := &kafkaEncoder{}
+	e.int32(0) // the size, set below
+	e.int32(correlationID)
+
+	if !kafkaSupported(key, version) {
+		if key != kafkaAPIVersions {
+			return nil, fmt.Errorf("unsupported API %d version %d", key, version)
+		}
+		// the client retries with a version it finds in the (v0) response
+		s.apiVersions(e, 0, kafkaErrUnsupportedVersion)
+		return e.finish(), nil
+	}
+
+	switch key {
+	case kafkaAPIVersions:
+		s.apiVersions(e, version, kafkaErrNone)
+	case kafkaMetadata:
+		err := s.metadata(d, e, version)
+		if err != nil {
+			return nil, err
+		}
+	case kafkaProduce:
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		acks, err := s.produce(d, e, version, producerID{"kafka", host, clientID})
+		if err != nil {
+			return nil, err
+		}
+		if acks == 0 {
+			return nil, nil
+		}
+	}
+
+	return e.finish(), nil
+}
+
+func (s *kafkaServer) apiVersions(e *kafkaEncoder, version int16, errorCode int16) {
+	e.int16(errorCode)
+	e.int32(int32(len(kafkaAPIs)))
+	for _, api := range kafkaAPIs {
+		e.int16(api.key)
+		e.int16(api.minVersion)
+		e.int16(api.maxVersion)
+	}
+	if version >= 1 {
+		e.int32(0) // throttle_time_ms
+	}
+}
+
+func (s *kafkaServer) metadata(d *kafkaDecoder, e *kafkaEncoder, version int16) error {
+	n := s.context.nsqd
+
+	count := d.arrayLen()
+	topicNames := make([]string, 0)
+	for i := 0; i < count; i++ {
+		topicNames = append(topicNames, d.string())
+	}
+	if d.err != nil {
+		return d.err
+	}
+	// all topics is an empty list in v0 and a null one since
+	if count < 0 || (count == 0 && version == 0) {
+		n.RLock()
+		for topicName := range n.topicMap {
+			topicNames = append(topicNames, topicName)
+		}
+		n.RUnlock()
+		sort.Strings(topicNames)
+	}
+
+	// brokers, just us
+	e.int32(1)
+	e.int32(0)
+	e.string(n.options.BroadcastAddress)
+	e.int32(int32(n.kafkaListener.Addr().(*net.TCPAddr).Port))
+	if version >= 1 {
+		e.int16(-1) // rack
+		e.int32(0)  // controller_id
+	}
+
+	e.int32(int32(len(topicNames)))
+	for _, topicName := range topicNames {
+		// topics don't need to exist, they're created when published to
+		valid := nsq.IsValidTopicName(topicName)
+		if valid {
+			e.int16(kafkaErrNone)
+		} else {
+			e.int16(kafkaErrInvalidTopic)
+		}
+		e.string(topicName)
+		if version >= 1 {
+			e.int8(0) // is_internal
+		}
+		if !valid {
+			e.int32(0)
+			continue
+		}
+		e.int32(1)
+		e.int16(kafkaErrNone)
+		e.int32(0) // partition_index
+		e.int32(0) // leader_id
+		e.int32(1) // replica_nodes, just us
+		e.int32(0)
+		e.int32(1) // isr_nodes
+		e.int32(0)
+	}
+	return nil
+}
+
+// produce publishes the records of a produce request, returning its acks
+func (s *kafkaServer) produce(d *kafkaDecoder, e *kafkaEncoder, version int16, producer producerID) (int16, error) {
+	if version >= 3 {
+		d.string() // transactional_id
+	}
+	acks := d.int16()
+	d.int32() // timeout_ms
+
+	topics := d.arrayLen()
+	e.int32(int32(topics))
+	for i := 0; i < topics; i++ {
+		topicName := d.string()
+		partitions := d.arrayLen()
+		e.string(topicName)
+		e.int32(int32(partitions))
+		for j := 0; j < partitions; j++ {
+			partition := d.int32()
+			records := d.bytes()
+			if d.err != nil {
+				return 0, d.err
+			}
+			// with acks=all the messages have to be fsync'd
+			e.int32(partition)
+			e.int16(s.publish(topicName, partition, records, acks == -1, producer))
+			e.int64(-1) // base_offset
+			if version >= 2 {
+				e.int64(-1) // log_append_time_ms
+			}
+		}
+	}
+	if version >= 1 {
+		e.int32(0) // throttle_time_ms
+	}
+	return acks, d.err
+}
+
+// publish publishes records to topicName, returning the Kafka error code
+func (s *kafkaServer) publish(topicName string, partition int32, records []byte, durable bool, producer producerID) int16 {
+	n := s.context.nsqd
+
+	if !nsq.IsValidTopicName(topicName) {
+		return kafkaErrInvalidTopic
+	}
+	if partition != 0 {
+		return kafkaErrUnknownTopicOrPartition
+	}
+
+	msgs, errorCode := n.decodeKafkaRecords(records)
+	if errorCode == kafkaErrMessageTooLarge {
+		n.oversizeMessage(topicName)
+	}
+	if errorCode != kafkaErrNone || len(msgs) == 0 {
+		return errorCode
+	}
+
+	err := n.checkReplica(topicName, "")
+	if err == nil {
+		start := time.Now()
+		if durable {
+			err = n.PutMessagesDurable(topicName, msgs)
+		} else {
+			err = n.PutMessages(topicName, msgs)
+		}
+		if err == nil {
+			n.recordPublishLatency(topicName, start)
+		}
+	}
+	switch err {
+	case nil:
+	case errReadOnly, errDraining, errTopicFull, errPublishPaused:
+		// retriable
+		return kafkaErrNotEnoughReplicas
+	case errCreationDenied, errReplicaReadOnly:
+		return kafkaErrTopicAuthorization
+	case errMsgTooLarge:
+		return kafkaErrMessageTooLarge
+	default:
+		if _, ok := err.(*msgRejectedError); ok {
+			return kafkaErrCorruptMessage
+		}
+		log.Printf("KAFKA: failed to publish to %s - %s", topicName, err.Error())
+		return kafkaErrUnknown
+	}
+
+	n.producerPublished(topicName, producer, len(msgs))
+	return kafkaErrNone
+}
+
+// decodeKafkaRecords decodes a message set (magic 0 and 1) or record batches
+// (magic 2) into messages
+func (n *NSQD) decodeKafkaRecords(records []byte) ([]*nsq.Message, int16) {
+	var msgs []*nsq.Message
+	addMessage := func(key []byte, value []byte) int16 {
+		if len(value) == 0 {
+			// a tombstone (a null value) only means something to a compacted
+			// Kafka topic and NSQ messages can't be empty, it's acknowledged
+			// but there's nothing to publish
+			return kafkaErrNone
+		}
+		if int64(len(value)) > n.options.MaxMsgSize {
+			return kafkaErrMessageTooLarge
+		}
+		// the request buffer isn't reused
+		msg := nsq.NewMessage(<-n.idChan, value)
+		if len(key) > 0 && n.keyedMessageIDs() {
+			msg.Id = keyedMessageID(msg.Id, key)
+		}
+		msgs = append(msgs, msg)
+		return kafkaErrNone
+	}
+
+	d := &kafkaDecoder{buf: records}
+	// a producer may send a partial message at the end, which is ignored
+	for len(d.buf) >= 17 {
+		d.int64() // offset
+		size := d.int32()
+		entry := &kafkaDecoder{buf: d.next(int(size))}
+		if d.err != nil {
+			break
+		}
+
+		// a record batch's magic is where a message's is, after its
+		// partition_leader_epoch rather than its crc
+		if len(entry.buf) > 4 && entry.buf[4] == 2 {
+			entry.next(4 + 1 + 4) // partition_leader_epoch, magic, crc
+			attributes := entry.int16()
+			entry.next(4 + 8 + 8 + 8 + 2 + 4) // last_offset_delta ... base_sequence
+			count := entry.int32()
+			if attributes&0x07 != 0 {
+				return nil, kafkaErrUnsupportedCompression
+			}
+			if attributes&0x30 != 0 {
+				// transactional and control batches
+				return nil, kafkaErrCorruptMessage
+			}
+			for i := int32(0); i < count; i++ {
+				record := &kafkaDecoder{buf: entry.next(int(entry.varint()))}
+				record.int8()   // attributes
+				record.varint() // timestamp_delta
+				record.varint() // offset_delta
+				key := record.varbytes()
+				value := record.varbytes()
+				if entry.err != nil || record.err != nil {
+					return nil, kafkaErrCorruptMessage
+				}
+				if errorCode := addMessage(key, value); errorCode != kafkaErrNone {
+					return nil, errorCode
+				}
+			}
+			if entry.err != nil {
+				return nil, kafkaErrCorruptMessage
+			}
+			continue
+		}
+
+		entry.int32() // crc
+		magic := entry.int8()
+		attributes := entry.int8()
+		if magic == 1 {
+			entry.int64() // timestamp
+		}
+		key := entry.bytes()
+		value := entry.bytes()
+		if entry.err != nil || magic > 1 {
+			return nil, kafkaErrCorruptMessage
+		}
+		if attributes&0x07 != 0 {
+			return nil, kafkaErrUnsupportedCompression
+		}
+		if errorCode := addMessage(key, value); errorCode != kafkaErrNone {
+			return nil, errorCode
+		}
+	}
+
+	return msgs, kafkaErrNone
+}
+
+// kafkaDecoder reads big-endian fields from buf, once a read fails (the
+// buffer is too short) err is set and all further reads return zero values
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(size int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if size < 0 || size > len(d.buf) {
+		d.err = errKafkaShortRequest
+		return nil
+	}
+	b := d.buf[:size]
+	d.buf = d.buf[size:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return int8(b[0])
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// varint reads a zig-zag encoded varint (as are record fields)
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, size := binary.Varint(d.buf)
+	if size <= 0 {
+		d.err = errKafkaShortRequest
+		return 0
+	}
+	d.buf = d.buf[size:]
+	return v
+}
+
+// string reads a (nullable) string, null is ""
+func (d *kafkaDecoder) string() string {
+	size := d.int16()
+	if size < 0 {
+		return ""
+	}
+	return string(d.next(int(size)))
+}
+
+// bytes reads (nullable) bytes, null is nil
+func (d *kafkaDecoder) bytes() []byte {
+	size := d.int32()
+	if size < 0 {
+		return nil
+	}
+	return d.next(int(size))
+}
+
+// varbytes reads (nullable) bytes with a varint length, as in a record
+// batch's records, null (ie. a record without a key) is nil
+func (d *kafkaDecoder) varbytes() []byte {
+	size := d.varint()
+	if size < 0 {
+		return nil
+	}
+	return d.next(int(size))
+}
+
+// arrayLen reads the length of an array, -1 for null
+func (d *kafkaDecoder) arrayLen() int {
+	size := int(d.int32())
+	// every element is at least a byte
+	if size > len(d.buf) {
+		d.err = errKafkaShortRequest
+		return 0
+	}
+	return size
+}
+
+// kafkaEncoder writes big-endian fields, its first 4 bytes are the size
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.WriteString(v)
+}
+
+// finish sets the size and returns the response
+func (e *kafkaEncoder) finish() []byte {
+	b := e.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func kafkaRequest(t *testing.T, conn net.Conn, key int16, version int16, body []byte) *kafkaDecoder {
+	e := &kafkaEncoder{}
+	e.int32(0)
+	e.int16(key)
+	e.int16(version)
+	e.int32(42) // correlation_id
+	e.string("test")
+	e.Write(body)
+	_, err := conn.Write(e.finish())
+	assert.Equal(t, err, nil)
+
+	var size int32
+	err = binary.Read(conn, binary.BigEndian, &size)
+	assert.Equal(t, err, nil)
+	response := make([]byte, size)
+	_, err = io.ReadFull(conn, response)
+	assert.Equal(t, err, nil)
+
+	d := &kafkaDecoder{buf: response}
+	assert.Equal(t, d.int32(), int32(42))
+	return d
+}
+
+func TestKafkaProduce(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.KafkaAddress = "127.0.0.1:0"
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_kafka" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := net.DialTimeout("tcp", nsqd.kafkaListener.Addr().String(), time.Second)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	// a version we don't support gets the versions we do
+	d := kafkaRequest(t, conn, kafkaAPIVersions, 3, nil)
+	assert.Equal(t, d.int16(), int16(kafkaErrUnsupportedVersion))
+	d = kafkaRequest(t, conn, kafkaAPIVersions, 0, nil)
+	assert.Equal(t, d.int16(), int16(kafkaErrNone))
+	assert.Equal(t, d.arrayLen(), len(kafkaAPIs))
+
+	e := &kafkaEncoder{}
+	e.int32(1)
+	e.string(topicName)
+	d = kafkaRequest(t, conn, kafkaMetadata, 0, e.Bytes())
+	assert.Equal(t, d.arrayLen(), 1)
+	assert.Equal(t, d.int32(), int32(0))
+	assert.Equal(t, d.string(), nsqd.options.BroadcastAddress)
+	assert.Equal(t, int(d.int32()), nsqd.kafkaListener.Addr().(*net.TCPAddr).Port)
+	assert.Equal(t, d.arrayLen(), 1)
+	assert.Equal(t, d.int16(), int16(kafkaErrNone))
+	assert.Equal(t, d.string(), topicName)
+	assert.Equal(t, d.arrayLen(), 1)
+
+	produce := func(version int16, records []byte) int16 {
+		e := &kafkaEncoder{}
+		if version >= 3 {
+			e.int16(-1) // transactional_id
+		}
+		e.int16(1)    // acks
+		e.int32(1000) // timeout_ms
+		e.int32(1)
+		e.string(topicName)
+		e.int32(1)
+		e.int32(0)
+		e.int32(int32(len(records)))
+		e.Write(records)
+
+		d := kafkaRequest(t, conn, kafkaProduce, version, e.Bytes())
+		assert.Equal(t, d.arrayLen(), 1)
+		assert.Equal(t, d.string(), topicName)
+		assert.Equal(t, d.arrayLen(), 1)
+		assert.Equal(t, d.int32(), int32(0))
+		return d.int16()
+	}
+
+	// a (v1) message set of one message
+	message := &kafkaEncoder{}
+	message.int32(0) // crc
+	message.int8(1)  // magic
+	message.int8(0)  // attributes
+	message.int64(time.Now().UnixNano() / int64(time.Millisecond))
+	message.int32(3)
+	message.WriteString("key")
+	message.int32(9)
+	message.WriteString("test body")
+	messageSet := &kafkaEncoder{}
+	messageSet.int64(0)
+	messageSet.int32(int32(message.Len()))
+	messageSet.Write(message.Bytes())
+	assert.Equal(t, produce(2, messageSet.Bytes()), int16(kafkaErrNone))
+
+	// a record batch of two records, and two tombstones that aren't published
+	varint := func(e *kafkaEncoder, v int64) {
+		b := make([]byte, binary.MaxVarintLen64)
+		e.Write(b[:binary.PutVarint(b, v)])
+	}
+	batch := &kafkaEncoder{}
+	batch.int32(0) // partition_leader_epoch
+	batch.int8(2)  // magic
+	batch.int32(0) // crc
+	batch.int16(0) // attributes
+	batch.Write(make([]byte, 4+8+8+8+2+4))
+	batch.int32(4)
+	for _, value := range [][]byte{[]byte("a"), []byte("b"), nil, {}} {
+		record := &kafkaEncoder{}
+		record.int8(0)
+		varint(record, 0)  // timestamp_delta
+		varint(record, 0)  // offset_delta
+		varint(record, -1) // key
+		if value == nil {
+			varint(record, -1)
+		} else {
+			varint(record, int64(len(value)))
+			record.Write(value)
+		}
+		varint(record, 0) // headers
+		varint(batch, int64(record.Len()))
+		batch.Write(record.Bytes())
+	}
+	batches := &kafkaEncoder{}
+	batches.int64(0)
+	batches.int32(int32(batch.Len()))
+	batches.Write(batch.Bytes())
+	assert.Equal(t, produce(3, batches.Bytes()), int16(kafkaErrNone))
+
+	topic, err := nsqd.GetExistingTopic(topicName)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, topic.Depth(), int64(3))
+
+	// compressed batches aren't supported
+	b := batches.Bytes()
+	b[12+4+1+4+1] = 1
+	assert.Equal(t, produce(3, b), int16(kafkaErrUnsupportedCompression))
+	assert.Equal(t, topic.Depth(), int64(3))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// setKeepAlivePeriod sets how long a connection is idle before it's probed,
+// and how often, through the socket's fd ((*net.TCPConn).SetKeepAlivePeriod
+// needs Go 1.2)
+func setKeepAlivePeriod(tcpConn *net.TCPConn, interval time.Duration) error {
+	f, err := tcpConn.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	// File() leaves the socket (which the dup'd fd shares) in blocking mode
+	defer syscall.SetNonblock(fd, true)
+
+	secs := int(interval / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, secs)
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
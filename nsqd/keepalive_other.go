@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAlivePeriod leaves the OS default period, elsewhere than linux the
+// socket options to set it differ (and (*net.TCPConn).SetKeepAlivePeriod
+// needs Go 1.2)
+func setKeepAlivePeriod(tcpConn *net.TCPConn, interval time.Duration) error {
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/bitly/go-nsq"
+)
+
+// a topic's large message rule keeps huge payloads from stalling its
+// latency-sensitive consumers, messages with a body over the rule's size are:
+//
+//  * divert published to the companion <topic>.large topic instead (created
+//    as needed, it's an ordinary topic with its own channels)
+//  * reject failed (E_MSG_TOO_LARGE, MSG_TOO_LARGE over HTTP), an MPUB with
+//    any of them fails as a whole
+//
+// unlike --max-msg-size this is per topic and doesn't disconnect the client
+
+type largeMessageAction int32
+
+const (
+	largeMessageNone largeMessageAction = iota
+	largeMessageDivert
+	largeMessageReject
+)
+
+const largeTopicSuffix = ".large"
+
+var errMsgTooLarge = errors.New("message is over the topic's large message size")
+
+func (a largeMessageAction) String() string {
+	switch a {
+	case largeMessageDivert:
+		return "divert"
+	case largeMessageReject:
+		return "reject"
+	}
+	return ""
+}
+
+func parseLargeMessageAction(s string) (largeMessageAction, error) {
+	switch s {
+	case "", "divert":
+		return largeMessageDivert, nil
+	case "reject":
+		return largeMessageReject, nil
+	}
+	return largeMessageNone, fmt.Errorf("invalid large message action %s (divert or reject)", s)
+}
+
+func largeTopicName(topicName string) string {
+	return topicName + largeTopicSuffix
+}
+
+// SetLargeMessageRule sets what happens to messages published to the topic
+// with a body over size bytes, a size of 0 removes the rule
+func (t *Topic) SetLargeMessageRule(size int64, action largeMessageAction) error {
+	if size <= 0 {
+		size = 0
+		action = largeMessageNone
+	}
+	atomic.StoreInt32(&t.largeMessageAction, int32(action))
+	atomic.StoreInt64(&t.largeMessageSize, size)
+	if size > 0 {
+		log.Printf("TOPIC(%s): %s messages over %d bytes", t.name, action, size)
+	} else {
+		log.Printf("TOPIC(%s): no large message rule", t.name)
+	}
+
+	t.context.nsqd.Lock()
+	defer t.context.nsqd.Unlock()
+	return t.context.nsqd.PersistMetadata()
+}
+
+// LargeMessageRule returns the size and action set on the topic (0 and
+// largeMessageNone when it has no rule)
+func (t *Topic) LargeMessageRule() (int64, largeMessageAction) {
+	return atomic.LoadInt64(&t.largeMessageSize), largeMessageAction(atomic.LoadInt32(&t.largeMessageAction))
+}
+
+// checkLargeMessages returns errMsgTooLarge when the topic rejects any of msgs
+func (t *Topic) checkLargeMessages(msgs []*nsq.Message) error {
+	size, action := t.LargeMessageRule()
+	if action != largeMessageReject {
+		return nil
+	}
+	for _, msg := range msgs {
+		if int64(len(msg.Body)) > size {
+			atomic.AddUint64(&t.largeMessageCount, 1)
+			return errMsgTooLarge
+		}
+	}
+	return nil
+}
+
+// splitLargeMessages returns the msgs that go to the topic itself and those
+// that are diverted to its .large topic
+func (t *Topic) splitLargeMessages(msgs []*nsq.Message) ([]*nsq.Message, []*nsq.Message) {
+	size, action := t.LargeMessageRule()
+	if action != largeMessageDivert {
+		return msgs, nil
+	}
+	var small, large []*nsq.Message
+	for _, msg := range msgs {
+		if int64(len(msg.Body)) > size {
+			large = append(large, msg)
+		} else {
+			small = append(small, msg)
+		}
+	}
+	if len(large) == 0 {
+		return msgs, nil
+	}
+	atomic.AddUint64(&t.largeMessageCount, uint64(len(large)))
+	return small, large
+}
+
+// resolveLargeMessages returns msgs resolved to topic, or its .large topic,
+// as the topic's large message rule says
+func (n *NSQD) resolveLargeMessages(topic *Topic, msgs []*nsq.Message) ([]*topicMessages, error) {
+	err := topic.checkLargeMessages(msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolved []*topicMessages
+	msgs, large := topic.splitLargeMessages(msgs)
+	if len(large) > 0 {
+		largeTopic, err := n.AutoCreateTopic(largeTopicName(topic.name))
+		if err != nil {
+			return nil, err
+		}
+		err = largeTopic.checkSchema(large)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, &topicMessages{largeTopic, large})
+	}
+	if len(msgs) > 0 {
+		resolved = append(resolved, &topicMessages{topic, msgs})
+	}
+	return resolved, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestLargeMessageRule(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_large" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/set_topic_large_messages?topic=%s&size=10&action=divert", httpAddr, topicName)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	small := nsq.NewMessage(<-nsqd.idChan, []byte("small"))
+	large := nsq.NewMessage(<-nsqd.idChan, bytes.Repeat([]byte("a"), 11))
+	err = nsqd.PutMessages(topicName, []*nsq.Message{small, large})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, topic.Depth(), int64(1))
+
+	largeTopic, err := nsqd.GetExistingTopic(topicName + ".large")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, largeTopic.Depth(), int64(1))
+	assert.Equal(t, NewTopicStats(topic, nil).LargeMessageCount, uint64(1))
+
+	err = topic.SetLargeMessageRule(10, largeMessageReject)
+	assert.Equal(t, err, nil)
+	large = nsq.NewMessage(<-nsqd.idChan, bytes.Repeat([]byte("a"), 11))
+	small = nsq.NewMessage(<-nsqd.idChan, []byte("small"))
+	err = nsqd.PutMessages(topicName, []*nsq.Message{small, large})
+	assert.Equal(t, err, errMsgTooLarge)
+	assert.Equal(t, topic.Depth(), int64(1))
+
+	url = fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBuffer(bytes.Repeat([]byte("a"), 11)))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+
+	url = fmt.Sprintf("http://%s/set_topic_large_messages?topic=%s&size=-1", httpAddr, topicName)
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+}
+
+func TestLargeMessageRuleShardsAndTransactions(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+
+	// each shard's own rule applies to what's published to the sharded topic
+	shardedTopic := "test_lg_shard" + suffix
+	err := nsqd.SetShards(shardedTopic, 1)
+	assert.Equal(t, err, nil)
+	shardName := util.ShardTopicNames(shardedTopic, 1)[0]
+	shard := nsqd.GetTopic(shardName)
+	err = shard.SetLargeMessageRule(10, largeMessageDivert)
+	assert.Equal(t, err, nil)
+
+	large := nsq.NewMessage(<-nsqd.idChan, bytes.Repeat([]byte("a"), 11))
+	err = nsqd.PutMessages(shardedTopic, []*nsq.Message{large})
+	assert.Equal(t, err, nil)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, shard.Depth(), int64(0))
+	largeShard, err := nsqd.GetExistingTopic(shardName + ".large")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, largeShard.Depth(), int64(1))
+
+	// a transaction is diverted the same way, or fails as a whole
+	txTopic := "test_large_tx" + suffix
+	topic := nsqd.GetTopic(txTopic)
+	err = topic.SetLargeMessageRule(10, largeMessageDivert)
+	assert.Equal(t, err, nil)
+	err = nsqd.PutTransaction([]*txMessage{
+		{txTopic, nsq.NewMessage(<-nsqd.idChan, []byte("small"))},
+		{txTopic, nsq.NewMessage(<-nsqd.idChan, bytes.Repeat([]byte("a"), 11))},
+	})
+	assert.Equal(t, err, nil)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, topic.Depth(), int64(1))
+	largeTopic, err := nsqd.GetExistingTopic(txTopic + ".large")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, largeTopic.Depth(), int64(1))
+
+	err = topic.SetLargeMessageRule(10, largeMessageReject)
+	assert.Equal(t, err, nil)
+	err = nsqd.PutTransaction([]*txMessage{
+		{txTopic, nsq.NewMessage(<-nsqd.idChan, []byte("small"))},
+		{txTopic, nsq.NewMessage(<-nsqd.idChan, bytes.Repeat([]byte("a"), 11))},
+	})
+	assert.Equal(t, err, errMsgTooLarge)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, topic.Depth(), int64(1))
+}
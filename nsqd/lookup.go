@@ -21,42 +21,34 @@ func (n *NSQD) lookupLoop() {
 		log.Fatalf("ERROR: failed to get hostname - %s", err.Error())
 	}
 
-	for _, host := range n.options.NSQLookupdTCPAddresses {
-		log.Printf("LOOKUP: adding peer %s", host)
-		lookupPeer := NewLookupPeer(host, func(lp *LookupPeer) {
-			ci := make(map[string]interface{})
-			ci["version"] = util.BINARY_VERSION
-			ci["tcp_port"] = n.tcpAddr.Port
-			ci["http_port"] = n.httpAddr.Port
-			ci["hostname"] = hostname
-			ci["broadcast_address"] = n.options.BroadcastAddress
-
-			cmd, err := nsq.Identify(ci)
-			if err != nil {
-				lp.Close()
-				return
-			}
-			resp, err := lp.Command(cmd)
+	connectCallback := func(lp *LookupPeer) {
+		cmd, err := nsq.Identify(n.identifyInfo(hostname))
+		if err != nil {
+			lp.Close()
+			return
+		}
+		resp, err := lp.Command(cmd)
+		if err != nil {
+			log.Printf("LOOKUPD(%s): ERROR %s - %s", lp, cmd, err.Error())
+		} else if bytes.Equal(resp, []byte("E_INVALID")) {
+			log.Printf("LOOKUPD(%s): lookupd returned %s", lp, resp)
+		} else {
+			lp.Info.WorkerIDCollisions = nil
+			err = json.Unmarshal(resp, &lp.Info)
 			if err != nil {
-				log.Printf("LOOKUPD(%s): ERROR %s - %s", lp, cmd, err.Error())
-			} else if bytes.Equal(resp, []byte("E_INVALID")) {
-				log.Printf("LOOKUPD(%s): lookupd returned %s", lp, resp)
+				log.Printf("LOOKUPD(%s): ERROR parsing response - %v", lp, resp)
 			} else {
-				err = json.Unmarshal(resp, &lp.Info)
-				if err != nil {
-					log.Printf("LOOKUPD(%s): ERROR parsing response - %v", lp, resp)
-				} else {
-					log.Printf("LOOKUPD(%s): peer info %+v", lp, lp.Info)
-				}
+				log.Printf("LOOKUPD(%s): peer info %+v", lp, lp.Info)
 			}
+			n.setWorkerIDCollisions(lp.String(), lp.Info.WorkerIDCollisions)
+			n.renewWorkerIDLease(lp)
+		}
 
-			go func() {
-				syncTopicChan <- lp
-			}()
-		})
-		lookupPeer.Command(nil) // start the connection
-		n.lookupPeers = append(n.lookupPeers, lookupPeer)
+		go func() {
+			syncTopicChan <- lp
+		}()
 	}
+	n.updateLookupPeers(n.options.NSQLookupdTCPAddresses, connectCallback)
 
 	// for announcements, lookupd determines the host automatically
 	ticker := time.Tick(15 * time.Second)
@@ -64,19 +56,38 @@ func (n *NSQD) lookupLoop() {
 		select {
 		case <-ticker:
 			// send a heartbeat and read a response (read detects closed conns)
+			depthCmd := n.depthCommand()
 			for _, lookupPeer := range n.lookupPeers {
 				log.Printf("LOOKUPD(%s): sending heartbeat", lookupPeer)
 				cmd := nsq.Ping()
 				_, err := lookupPeer.Command(cmd)
 				if err != nil {
 					log.Printf("LOOKUPD(%s): ERROR %s - %s", lookupPeer, cmd, err.Error())
+					continue
 				}
+				n.sendDepth(lookupPeer, depthCmd)
+				n.renewWorkerIDLease(lookupPeer)
 			}
 		case val := <-n.notifyChan:
 			var cmd *nsq.Command
 			var branch string
 
+			// lookupds registered with over HTTP are sent everything again
+			n.syncHTTPLookupPeers()
+
 			switch val.(type) {
+			case shardsChanged:
+				shardsCmd := n.shardsCommand()
+				for _, lookupPeer := range n.lookupPeers {
+					n.sendShards(lookupPeer, shardsCmd)
+				}
+				continue
+			case metaAnnotationsChanged:
+				annotationsCmd := n.metaAnnotationsCommand()
+				for _, lookupPeer := range n.lookupPeers {
+					n.sendMetaAnnotations(lookupPeer, annotationsCmd)
+				}
+				continue
 			case *Channel:
 				// notify all nsqlookupds that a new channel exists, or that it's removed
 				branch = "channel"
@@ -104,7 +115,19 @@ func (n *NSQD) lookupLoop() {
 					log.Printf("LOOKUPD(%s): ERROR %s - %s", lookupPeer, cmd, err.Error())
 				}
 			}
+			if topic, ok := val.(*Topic); ok && topic.ReplicaOf() != "" {
+				replicasCmd := n.replicasCommand()
+				for _, lookupPeer := range n.lookupPeers {
+					n.sendReplicas(lookupPeer, replicasCmd)
+				}
+			}
+		case addrs := <-n.lookupdAddrsChan:
+			n.updateLookupPeers(addrs, connectCallback)
 		case lookupPeer := <-syncTopicChan:
+			if !n.isLookupPeer(lookupPeer) {
+				// it was removed (by a config reload) since it connected
+				continue
+			}
 			commands := make([]*nsq.Command, 0)
 			// build all the commands first so we exit the lock(s) as fast as possible
 			n.RLock()
@@ -129,6 +152,11 @@ func (n *NSQD) lookupLoop() {
 					break
 				}
 			}
+			n.sendDepth(lookupPeer, n.depthCommand())
+			n.sendReplicas(lookupPeer, n.replicasCommand())
+			n.sendShards(lookupPeer, n.shardsCommand())
+			n.sendMetaAnnotations(lookupPeer, n.metaAnnotationsCommand())
+			n.syncTopicConfigs()
 		case <-n.exitChan:
 			goto exit
 		}
@@ -138,7 +166,113 @@ exit:
 	log.Printf("LOOKUP: closing")
 }
 
+// identifyInfo is what nsqd IDENTIFYs itself to nsqlookupd with
+func (n *NSQD) identifyInfo(hostname string) map[string]interface{} {
+	ci := make(map[string]interface{})
+	ci["version"] = util.BINARY_VERSION
+	ci["tcp_port"] = n.tcpAddr.Port
+	ci["http_port"] = n.httpAddr.Port
+	ci["hostname"] = hostname
+	ci["broadcast_address"] = n.options.BroadcastAddress
+	ci["worker_id"] = n.options.ID
+	ci["id_generator"] = n.options.IDGenerator
+	if len(n.options.BroadcastAddresses) > 0 {
+		ci["broadcast_addresses"] = append([]string{n.options.BroadcastAddress},
+			n.options.BroadcastAddresses...)
+	}
+	if len(n.labels) > 0 {
+		ci["labels"] = n.labels
+	}
+	return ci
+}
+
+// depthCommand builds a DEPTH command reporting the number of messages
+// waiting in each topic (including its channels, in-flight and deferred)
+func (n *NSQD) depthCommand() *nsq.Command {
+	depths := make(map[string]int64)
+	n.RLock()
+	for _, topic := range n.topicMap {
+		depth := topic.Depth()
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			depth += channel.Depth() + int64(len(channel.inFlightMessages)+len(channel.deferredMessages))
+		}
+		topic.RUnlock()
+		depths[topic.name] = depth
+	}
+	n.RUnlock()
+
+	body, err := json.Marshal(depths)
+	if err != nil {
+		log.Printf("ERROR: failed to marshal depths - %s", err.Error())
+		return nil
+	}
+	return &nsq.Command{Name: []byte("DEPTH"), Body: body}
+}
+
+// sendDepth sends cmd to lookupPeer if it supports it (older nsqlookupd
+// would close the connection)
+func (n *NSQD) sendDepth(lookupPeer *LookupPeer, cmd *nsq.Command) {
+	if cmd == nil || !lookupPeer.Info.DepthReports {
+		return
+	}
+	_, err := lookupPeer.Command(cmd)
+	if err != nil {
+		log.Printf("LOOKUPD(%s): ERROR %s - %s", lookupPeer, cmd, err.Error())
+	}
+}
+
+// updateLookupPeers adds a peer for each of addrs there isn't one for and
+// closes those that aren't in addrs (lookupd then unregisters us)
+func (n *NSQD) updateLookupPeers(addrs []string, connectCallback func(*LookupPeer)) {
+	existing := make(map[string]*LookupPeer)
+	for _, lp := range n.lookupPeers {
+		existing[lp.String()] = lp
+	}
+
+	added := make(map[string]bool)
+	lookupPeers := make([]*LookupPeer, 0, len(addrs))
+	for _, host := range addrs {
+		if added[host] {
+			continue
+		}
+		added[host] = true
+		lp, ok := existing[host]
+		if ok {
+			delete(existing, host)
+		} else {
+			log.Printf("LOOKUP: adding peer %s", host)
+			lp = NewLookupPeer(host, connectCallback)
+			lp.Command(nil) // start the connection
+		}
+		lookupPeers = append(lookupPeers, lp)
+	}
+
+	for host, lp := range existing {
+		log.Printf("LOOKUP: removing peer %s", host)
+		if lp.state == nsq.StateConnected {
+			lp.Close()
+		}
+	}
+
+	n.lookupPeersMutex.Lock()
+	n.lookupPeers = lookupPeers
+	n.lookupPeersMutex.Unlock()
+}
+
+func (n *NSQD) isLookupPeer(lookupPeer *LookupPeer) bool {
+	for _, lp := range n.lookupPeers {
+		if lp == lookupPeer {
+			return true
+		}
+	}
+	return false
+}
+
 func (n *NSQD) lookupHttpAddrs() []string {
+	n.lookupPeersMutex.RLock()
+	defer n.lookupPeersMutex.RUnlock()
+
 	var lookupHttpAddrs []string
 	for _, lp := range n.lookupPeers {
 		if len(lp.Info.BroadcastAddress) <= 0 {
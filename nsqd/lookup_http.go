@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bitly/nsq/util"
+)
+
+// with --lookupd-http-address nsqd registers with nsqlookupd over HTTP(S)
+// rather than the TCP protocol, for networks that only allow HTTP(S) egress...
+// every 15s (the heartbeat), and whenever a topic or channel is created or
+// deleted, it POSTs everything it would otherwise send over TCP to
+// /producer/register, and POSTs to /producer/unregister when it exits
+//
+// the address is a URL (ie. https://lookupd.example.com), http:// is assumed
+// when there's no scheme
+
+// normalizeLookupdHTTPAddress returns the URL of --lookupd-http-address addr
+func normalizeLookupdHTTPAddress(addr string) (string, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("must be an http:// or https:// URL")
+	}
+	return strings.TrimRight(u.String(), "/"), nil
+}
+
+// syncHTTPLookupPeers has httpLookupLoop POST to every lookupd now rather than
+// at the next heartbeat
+func (n *NSQD) syncHTTPLookupPeers() {
+	select {
+	case n.httpLookupSyncChan <- 1:
+	default:
+	}
+}
+
+func (n *NSQD) httpLookupLoop() {
+	httpclient := &http.Client{Transport: util.NewDeadlineTransport(5 * time.Second)}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("ERROR: failed to get hostname - %s", err.Error())
+	}
+
+	ticker := time.NewTicker(15 * time.Second)
+	n.registerHTTPLookupPeers(httpclient, hostname)
+	for {
+		select {
+		case <-ticker.C:
+			n.registerHTTPLookupPeers(httpclient, hostname)
+		case <-n.httpLookupSyncChan:
+			n.registerHTTPLookupPeers(httpclient, hostname)
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	ticker.Stop()
+	body, err := json.Marshal(n.identifyInfo(hostname))
+	if err == nil {
+		for _, addr := range n.options.NSQLookupdHTTPAddresses {
+			endpoint := addr + "/producer/unregister"
+			log.Printf("LOOKUPD(%s): unregistering", addr)
+			_, err = postLookupd(httpclient, endpoint, body)
+			if err != nil {
+				log.Printf("LOOKUPD(%s): ERROR unregistering - %s", addr, err.Error())
+			}
+		}
+	}
+	log.Printf("LOOKUP(HTTP): closing")
+}
+
+// registerHTTPLookupPeers POSTs nsqd's IDENTIFY info, topics and channels,
+// depths, replicas, shards and annotations to every --lookupd-http-address
+func (n *NSQD) registerHTTPLookupPeers(httpclient *http.Client, hostname string) {
+	reg := n.identifyInfo(hostname)
+
+	topics := make(map[string][]string)
+	n.RLock()
+	for _, topic := range n.topicMap {
+		topic.RLock()
+		channels := make([]string, 0, len(topic.channelMap))
+		for _, channel := range topic.channelMap {
+			channels = append(channels, channel.name)
+		}
+		topic.RUnlock()
+		topics[topic.name] = channels
+	}
+	n.RUnlock()
+	reg["topics"] = topics
+
+	// the bodies of the TCP protocol's commands
+	if cmd := n.depthCommand(); cmd != nil {
+		reg["depths"] = json.RawMessage(cmd.Body)
+	}
+	if cmd := n.replicasCommand(); cmd != nil {
+		reg["replicas"] = json.RawMessage(cmd.Body)
+	}
+	if cmd := n.shardsCommand(); cmd != nil {
+		reg["shards"] = json.RawMessage(cmd.Body)
+	}
+	if cmd := n.metaAnnotationsCommand(); cmd != nil {
+		reg["annotations"] = json.RawMessage(cmd.Body)
+	}
+
+	body, err := json.Marshal(reg)
+	if err != nil {
+		log.Printf("ERROR: failed to marshal lookupd registration - %s", err.Error())
+		return
+	}
+
+	for _, addr := range n.options.NSQLookupdHTTPAddresses {
+		log.Printf("LOOKUPD(%s): registering", addr)
+		info, err := postLookupd(httpclient, addr+"/producer/register", body)
+		if err != nil {
+			log.Printf("LOOKUPD(%s): ERROR registering - %s", addr, err.Error())
+			continue
+		}
+		n.setWorkerIDCollisions(addr, info.WorkerIDCollisions)
+	}
+}
+
+// postLookupd POSTs body to endpoint, returning the lookupd's PeerInfo
+func postLookupd(httpclient *http.Client, endpoint string, body []byte) (*PeerInfo, error) {
+	resp, err := httpclient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		StatusCode int      `json:"status_code"`
+		StatusTxt  string   `json:"status_txt"`
+		Data       PeerInfo `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != 200 {
+		return nil, fmt.Errorf("response status_code = %d, status_txt = %s", r.StatusCode, r.StatusTxt)
+	}
+	return &r.Data, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/bitly/nsq/nsqlookupd"
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestLookupdHTTPRegistration(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	lookupdOptions := nsqlookupd.NewNSQLookupdOptions()
+	lookupdOptions.TCPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.HTTPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.BroadcastAddress = "127.0.0.1"
+	lookupd := nsqlookupd.NewNSQLookupd(lookupdOptions)
+	lookupd.Main()
+	defer lookupd.Exit()
+
+	options := NewNSQDOptions()
+	options.BroadcastAddress = "127.0.0.1"
+	options.NSQLookupdHTTPAddresses = []string{lookupd.RealHTTPAddr().String()}
+	_, _, nsqd := mustStartNSQD(options)
+	assert.Equal(t, options.NSQLookupdHTTPAddresses[0], "http://"+lookupd.RealHTTPAddr().String())
+
+	topicName := "test_lookupd_http" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", lookupd.RealHTTPAddr(), topicName)
+	lookup := func() *simplejson.Json {
+		data, err := util.ApiRequest(endpoint)
+		if err != nil {
+			return nil
+		}
+		return data
+	}
+
+	var data *simplejson.Json
+	for i := 0; i < 100; i++ {
+		data = lookup()
+		if data != nil && len(data.Get("channels").MustArray()) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotEqual(t, data, nil)
+	assert.Equal(t, data.Get("channels").GetIndex(0).MustString(), "ch")
+	producer := data.Get("producers").GetIndex(0)
+	assert.Equal(t, producer.Get("tcp_port").MustInt(), nsqd.tcpAddr.Port)
+
+	// it's unregistered when nsqd exits
+	nsqd.Exit()
+	data = lookup()
+	assert.Equal(t, data == nil || len(data.Get("producers").MustArray()) == 0, true)
+}
+
+func TestNormalizeLookupdHTTPAddress(t *testing.T) {
+	addr, err := normalizeLookupdHTTPAddress("127.0.0.1:4161")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, addr, "http://127.0.0.1:4161")
+
+	addr, err = normalizeLookupdHTTPAddress("https://lookupd.example.com/")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, addr, "https://lookupd.example.com")
+
+	_, err = normalizeLookupdHTTPAddress("ftp://lookupd.example.com")
+	assert.NotEqual(t, err, nil)
+}
@@ -27,6 +27,19 @@ type PeerInfo struct {
 	HttpPort         int    `json:"http_port"`
 	Version          string `json:"version"`
 	BroadcastAddress string `json:"broadcast_address"`
+	// DepthReports is set by nsqlookupd that accept DEPTH
+	DepthReports bool `json:"depth_reports"`
+	// ReplicaReports is set by nsqlookupd that accept REPLICAS
+	ReplicaReports bool `json:"replica_reports"`
+	// ShardReports is set by nsqlookupd that accept SHARDS
+	ShardReports bool `json:"shard_reports"`
+	// AnnotationReports is set by nsqlookupd that accept ANNOTATIONS
+	AnnotationReports bool `json:"annotation_reports"`
+	// WorkerIDLeases is set by nsqlookupd that accept LEASE_WORKER_ID
+	WorkerIDLeases bool `json:"worker_id_leases"`
+	// WorkerIDCollisions are the other producers nsqlookupd knows of that
+	// share our worker id
+	WorkerIDCollisions []string `json:"worker_id_collisions"`
 }
 
 // NewLookupPeer creates a new LookupPeer instance connecting to the supplied address.
@@ -23,38 +23,159 @@ var (
 	showVersion      = flagSet.Bool("version", false, "print version string")
 	verbose          = flagSet.Bool("verbose", false, "enable verbose logging")
 	workerId         = flagSet.Int64("worker-id", 0, "unique identifier (int) for this worker (will default to a hash of hostname)")
-	httpAddress      = flagSet.String("http-address", "0.0.0.0:4151", "<addr>:<port> to listen on for HTTP clients")
-	tcpAddress       = flagSet.String("tcp-address", "0.0.0.0:4150", "<addr>:<port> to listen on for TCP clients")
+	workerIdLease    = flagSet.Bool("worker-id-lease", false, "lease --worker-id from nsqlookupd (at startup)")
+	httpAddrs        = util.StringArray{}
+	tcpAddrs         = util.StringArray{}
 	broadcastAddress = flagSet.String("broadcast-address", "", "address that will be registered with lookupd (defaults to the OS hostname)")
+	extraBroadcast   = util.StringArray{}
 	lookupdTCPAddrs  = util.StringArray{}
+	lookupdHTTPAddrs = util.StringArray{}
+	labels           = util.StringArray{}
+
+	// message IDs
+	messageIDGenerator          = flagSet.String("id-generator", "snowflake", "how message IDs are generated: snowflake (a timestamp and --worker-id), ulid (a timestamp and random bits) or sequencer (blocks allocated by --id-sequencer-url)")
+	messageIDSequencerURL       = flagSet.String("id-sequencer-url", "", "HTTP endpoint that allocates blocks of message IDs (for --id-generator=sequencer)")
+	messageIDSequencerBlockSize = flagSet.Int64("id-sequencer-block-size", 10000, "number of message IDs to request from --id-sequencer-url at a time")
+
+	// cross-cluster replication
+	cluster         = flagSet.String("cluster", "", "name of this nsqd's cluster, replicated messages are tagged with it (required by --replicate-topic)")
+	replicateTopics = util.StringArray{}
+	replicateTo     = util.StringArray{}
+
+	// fire-and-forget publishing
+	udpAddress = flagSet.String("udp-address", "", "<addr>:<port> to listen on for UDP datagrams (\"<topic> <body>\") to publish (disabled by default)")
+
+	// Kafka produce protocol bridge
+	kafkaAddress = flagSet.String("kafka-address", "", "<addr>:<port> to listen on for Kafka producers (a subset of the Kafka protocol, disabled by default)")
+
+	// message transformation
+	middlewares = util.StringArray{}
+
+	// multiple SO_REUSEPORT acceptors per TCP address
+	tcpReusePort = flagSet.Bool("tcp-reuseport", false, "listen on each TCP address with multiple SO_REUSEPORT sockets (each with its own accept loop)")
+	tcpAcceptors = flagSet.Int("tcp-acceptors", 0, "number of SO_REUSEPORT acceptors per TCP address with --tcp-reuseport (defaults to GOMAXPROCS)")
 
 	// diskqueue options
-	dataPath        = flagSet.String("data-path", "", "path to store disk-backed messages")
-	memQueueSize    = flagSet.Int64("mem-queue-size", 10000, "number of messages to keep in memory (per topic/channel)")
-	maxBytesPerFile = flagSet.Int64("max-bytes-per-file", 104857600, "number of bytes per diskqueue file before rolling")
-	syncEvery       = flagSet.Int64("sync-every", 2500, "number of messages per diskqueue fsync")
-	syncTimeout     = flagSet.Duration("sync-timeout", 2*time.Second, "duration of time per diskqueue fsync")
+	dataPath               = flagSet.String("data-path", "", "path to store disk-backed messages")
+	memQueueSize           = flagSet.Int64("mem-queue-size", 10000, "number of messages to keep in memory (per topic/channel)")
+	memQueueOverflowPolicy = flagSet.String("mem-queue-overflow-policy", "spill", "what to do when a topic/channel's in-memory queue is full: spill (to disk), block (the publisher) or drop-oldest")
+	maxBytesPerFile        = flagSet.Int64("max-bytes-per-file", 104857600, "number of bytes per diskqueue file before rolling")
+	syncEvery              = flagSet.Int64("sync-every", 2500, "number of messages per diskqueue fsync")
+	syncTimeout            = flagSet.Duration("sync-timeout", 2*time.Second, "duration of time per diskqueue fsync")
+	writeBatchWindow       = flagSet.Duration("write-batch-window", 0, "duration concurrent diskqueue writes wait for others to be written (and fsync'd) with them in a single syscall (0 only batches writes that are already waiting)")
+	checkDataPath          = flagSet.String("check-data-path", "", "at startup check every diskqueue's files and metadata for gaps and truncation: report (logs them) or repair (truncates to the last complete record and rewrites the metadata)")
+	recoverMetadata        = flagSet.Bool("recover-metadata", false, "at startup load the previous generation of corrupt topic/channel metadata (or none) rather than refusing to start")
+
+	// disk space watchdog
+	minFreeDiskBytes  = flagSet.Int64("min-free-disk-bytes", 0, "reject publishes (read-only mode) while the --data-path volume has less free space than this (0 disables)")
+	diskCheckInterval = flagSet.Duration("disk-check-interval", 5*time.Second, "interval at which --data-path free space is checked (for --min-free-disk-bytes)")
+
+	// implicit topic/channel creation policy
+	creationPolicyFile  = flagSet.String("creation-policy-file", "", "path to a JSON file of rules deciding which topics/channels SUB and publishing can create")
+	creationHookURL     = flagSet.String("creation-hook-url", "", "HTTP endpoint to POST to before SUB or publishing creates a topic/channel (403 denies)")
+	creationHookTimeout = flagSet.Duration("creation-hook-timeout", 2*time.Second, "timeout for --creation-hook-url requests")
+
+	// parallel copying of messages to a topic's channels
+	topicFanoutThreshold = flagSet.Int("topic-fanout-threshold", 32, "number of channels from which a topic copies messages to them in parallel (0 disables)")
+	topicFanoutWorkers   = flagSet.Int("topic-fanout-workers", 0, "number of goroutines a topic copies messages to its channels with in parallel (0 is GOMAXPROCS)")
+
+	// in-place upgrade (listener handover)
+	handoverDrainTimeout = flagSet.Duration("handover-drain-timeout", 10*time.Second, "on SIGUSR2, how long to wait for subscribers' in-flight messages to finish before handing over to the new process")
+
+	// decommission (/drain)
+	drainTimeout = flagSet.Duration("drain-timeout", 10*time.Minute, "maximum duration of time /drain waits for every topic and channel to be consumed before nsqd exits")
+
+	// retry-safe HTTP publishing
+	publishRequestIDTTL = flagSet.Duration("publish-request-id-ttl", 5*time.Minute, "how long the X-NSQ-Request-ID of a successful /put or /mput is remembered so that a retry isn't published again (0 to disable)")
+
+	// per topic encryption at rest
+	encryptionKeyFile = flagSet.String("encryption-key-file", "", "path to a JSON file of topic name (or \"*\") to base64 AES key, messages of those topics are encrypted before being written to disk")
+	encryptionKeyURL  = flagSet.String("encryption-key-url", "", "HTTP endpoint queried (with ?topic=) for a topic's base64 AES key, as an alternative to --encryption-key-file")
 
 	// msg and command options
 	msgTimeout    = flagSet.String("msg-timeout", "60s", "duration to wait before auto-requeing a message")
 	maxMsgTimeout = flagSet.Duration("max-msg-timeout", 15*time.Minute, "maximum duration before a message will timeout")
+	maxReqTimeout = flagSet.Duration("max-req-timeout", time.Hour, "maximum duration a message can be REQ'd for (or, with an absolute timestamp, into the future)")
 	maxMsgSize    = flagSet.Int64("max-msg-size", 1024768, "maximum size of a single message in bytes")
 	// remove, deprecated
 	maxMessageSize = flagSet.Int64("max-message-size", 1024768, "(deprecated use --max-msg-size) maximum size of a single message in bytes")
 	maxBodySize    = flagSet.Int64("max-body-size", 5*1024768, "maximum size of a single command body")
 
+	maxPublishTimestampAge = flagSet.Duration("max-publish-timestamp-age", 30*24*time.Hour, "how old the timestamp a message is published with (PUB timestamp=, X-NSQ-Timestamp) can be (0 for no limit)")
+
+	maxChunkedMsgSize = flagSet.Int64("max-chunked-msg-size", 0, "maximum size of a message published/delivered in chunks to clients that negotiate chunked_messages (0 disables)")
+
+	// delivery attempt ceiling
+	maxAttempts           = flagSet.Int("max-attempts", 0, "maximum number of times a message is delivered before it is moved to --attempts-overflow-topic (0 disables)")
+	attemptsOverflowTopic = flagSet.String("attempts-overflow-topic", "", "topic to move messages that exceed --max-attempts to (if empty they are discarded)")
+
+	// stuck (repeatedly timed out) message detection
+	stuckMessageTimeouts = flagSet.Int("stuck-message-timeouts", 3, "number of times a message has to time out to be listed as stuck in a channel's stats (0 disables)")
+
 	// client overridable configuration options
 	maxHeartbeatInterval   = flagSet.Duration("max-heartbeat-interval", 60*time.Second, "maximum client configurable duration of time between client heartbeats")
+	maxHeartbeatRTT        = flagSet.Duration("max-heartbeat-rtt", 0, "disconnect clients that take longer than this to respond to a heartbeat (0 to disable)")
+	tcpKeepAliveInterval   = flagSet.Duration("tcp-keepalive-interval", 0, "TCP keepalive probe interval for client connections, required for clients to SUB with heartbeats disabled (0 leaves the OS default)")
+	idleClientTimeout      = flagSet.Duration("idle-client-timeout", 0, "disconnect clients with heartbeats disabled that send nothing for this long (0 to disable)")
+	slowConsumerFlushes    = flagSet.Int("slow-consumer-flushes", 5, "number of flushes in a row taking longer than a client's output buffer timeout that make it a slow consumer (0 to disable)")
+	slowConsumerDisconnect = flagSet.Bool("slow-consumer-disconnect", false, "disconnect slow consumers (their in-flight messages are requeued)")
 	maxRdyCount            = flagSet.Int64("max-rdy-count", 2500, "maximum RDY count for a client")
 	maxOutputBufferSize    = flagSet.Int64("max-output-buffer-size", 64*1024, "maximum client configurable size (in bytes) for a client output buffer")
 	maxOutputBufferTimeout = flagSet.Duration("max-output-buffer-timeout", 1*time.Second, "maximum client configurable duration of time between flushing to a client")
 
+	outputBufferTimeoutAdaptive = flagSet.Bool("output-buffer-timeout-adaptive", false, "tune each client's output buffer timeout to its throughput (between --min-output-buffer-timeout and --max-output-buffer-timeout)")
+	minOutputBufferTimeout      = flagSet.Duration("min-output-buffer-timeout", 5*time.Millisecond, "minimum output buffer timeout a client's is tuned to (with --output-buffer-timeout-adaptive)")
+
+	// client write deadline and heartbeat miss tolerance
+	clientWriteTimeout        = flagSet.Duration("client-write-timeout", time.Second, "deadline of each write to a client (client configurable up to --max-client-write-timeout)")
+	maxClientWriteTimeout     = flagSet.Duration("max-client-write-timeout", 30*time.Second, "maximum client configurable deadline of each write to a client")
+	heartbeatMissTolerance    = flagSet.Int("heartbeat-miss-tolerance", 2, "number of heartbeat intervals without a response before a client is disconnected (client configurable up to --max-heartbeat-miss-tolerance)")
+	maxHeartbeatMissTolerance = flagSet.Int("max-heartbeat-miss-tolerance", 10, "maximum client configurable number of heartbeat intervals without a response before a client is disconnected")
+
+	// multiplexed subscriptions
+	maxSubscriptionsPerClient = flagSet.Int64("max-subscriptions-per-client", 128, "maximum number of topic/channel subscriptions for a client that negotiated multiplex (0 disables multiplexing)")
+
+	// SUBs to topic patterns
+	wildcardSubToken = flagSet.String("wildcard-sub-token", "", "token a multiplexed client IDENTIFYs with (as wildcard_sub_token) to SUB to topic patterns (ie. orders.*)")
+
+	// message batching
+	maxBatchCount = flagSet.Int64("max-batch-count", 100, "maximum number of messages in a batch for a client that negotiated batching (<= 1 disables batching)")
+	maxBatchBytes = flagSet.Int64("max-batch-bytes", 64*1024, "maximum size (in bytes) of a batch of messages (a batch is sent once it reaches this size)")
+
+	// RDY redistribution hints
+	rdyHintDepth    = flagSet.Int64("rdy-hint-depth", 1000, "channel depth at which clients (that negotiated rdy_hints) with RDY 0 are sent a RDY hint (0 disables)")
+	rdyHintInterval = flagSet.Duration("rdy-hint-interval", 5*time.Second, "duration between checks for sending RDY hints to a client")
+
+	// server-side backoff signaling
+	backoffFailurePercent = flagSet.Int("backoff-failure-percent", 50, "percentage of a client's FIN/REQ (over --backoff-window) that are REQ at which its channel backs off (0 disables)")
+	backoffMinSamples     = flagSet.Int64("backoff-min-samples", 10, "minimum number of FIN/REQ (over --backoff-window) before a client's failure percentage is considered")
+	backoffWindow         = flagSet.Duration("backoff-window", 5*time.Second, "duration over which a client's FIN/REQ are counted (and between checks for sending BACKOFF frames)")
+	backoffDuration       = flagSet.Duration("backoff-duration", 10*time.Second, "duration clients (that negotiated backoff) of a channel backing off are told to reduce their RDY count for")
+
 	// statsd integration options
 	statsdAddress  = flagSet.String("statsd-address", "", "UDP <addr>:<port> of a statsd daemon for pushing stats")
 	statsdInterval = flagSet.String("statsd-interval", "60s", "duration between pushing to statsd")
 	statsdMemStats = flagSet.Bool("statsd-mem-stats", true, "toggle sending memory and GC stats to statsd")
 	statsdPrefix   = flagSet.String("statsd-prefix", "nsq.%s", "prefix used for keys sent to statsd (%s for host replacement)")
 
+	// stats snapshots
+	statsHistoryInterval = flagSet.Duration("stats-history-interval", 60*time.Second, "duration between stats snapshots (see /stats?history=true)")
+	statsHistorySize     = flagSet.Int("stats-history-size", 10, "number of stats snapshots to keep (0 disables)")
+
+	// channel depth webhook
+	depthWebhookURL      = flagSet.String("depth-webhook-url", "", "HTTP endpoint to POST to when a channel crosses its depth watermarks (see /set_channel_watermarks)")
+	depthWebhookDebounce = flagSet.Duration("depth-webhook-debounce", 30*time.Second, "minimum duration between depth webhooks for the same channel")
+
+	// requeue storm quarantine
+	quarantineRequeuePercent = flagSet.Int("quarantine-requeue-percent", 0, "pause (quarantine) channels with at least this percent of messages requeued or timed out over --quarantine-window (0 disables)")
+	quarantineWindow         = flagSet.Duration("quarantine-window", 60*time.Second, "duration over which channels' requeues are compared to their FINs")
+	quarantineMinMessages    = flagSet.Int64("quarantine-min-messages", 100, "minimum number of messages FIN'd or requeued over --quarantine-window for a channel to be quarantined")
+	quarantineWebhookURL     = flagSet.String("quarantine-webhook-url", "", "HTTP endpoint to POST to when a channel is quarantined")
+
+	// client events
+	clientEventsWebhookURL = flagSet.String("client-events-webhook-url", "", "HTTP endpoint to POST client connect, IDENTIFY, SUB and disconnect events to")
+	clientEventsTopic      = flagSet.String("client-events-topic", "", "topic to publish client connect, IDENTIFY, SUB and disconnect events to")
+
 	// End to end percentile flags
 	e2eProcessingLatencyPercentiles = util.FloatArray{}
 	e2eProcessingLatencyWindowTime  = flagSet.Duration("e2e-processing-latency-window-time", 10*time.Minute, "calculate end to end latency quantiles for this duration of time (ie: 60s would only show quantile calculations from the past 60 seconds)")
@@ -67,11 +188,26 @@ var (
 	deflateEnabled  = flagSet.Bool("deflate", true, "enable deflate feature negotiation (client compression)")
 	maxDeflateLevel = flagSet.Int("max-deflate-level", 6, "max deflate compression level a client can negotiate (> values == > nsqd CPU usage)")
 	snappyEnabled   = flagSet.Bool("snappy", true, "enable snappy feature negotiation (client compression)")
+
+	// runtime diagnostics
+	httpDebug          = flagSet.Bool("http-debug", false, "enable the /debug/ HTTP endpoints (pprof, trace, goroutine dump, forced GC), requires --http-debug-auth-token")
+	httpDebugAuthToken = flagSet.String("http-debug-auth-token", "", "token required (as a bearer token or basic auth password) to access /debug/ HTTP endpoints")
+
+	// fault injection for testing (do not enable in production)
+	chaosEnabled = flagSet.Bool("chaos", false, "enable the /debug/chaos HTTP endpoint to inject faults (dropped FINs, delayed flushes, disk write errors, killed clients) for testing, requires --http-debug")
 )
 
 func init() {
+	flagSet.Var(&httpAddrs, "http-address", "<addr>:<port> to listen on for HTTP clients, IPv6 as [<addr>]:<port> (may be given multiple times, default 0.0.0.0:4151)")
+	flagSet.Var(&tcpAddrs, "tcp-address", "<addr>:<port> to listen on for TCP clients, IPv6 as [<addr>]:<port> (may be given multiple times, default 0.0.0.0:4150)")
+	flagSet.Var(&extraBroadcast, "extra-broadcast-address", "additional address (ie. of another address family) that will be registered with lookupd (may be given multiple times)")
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
-	flagSet.Var(&e2eProcessingLatencyPercentiles, "e2e-processing-latency-percentile", "message processing time percentiles to keep track of (can be specified multiple times or comma separated, default none)")
+	flagSet.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP(S) URL (ie. https://lookupd.example.com) to register with over HTTP rather than TCP (may be given multiple times)")
+	flagSet.Var(&labels, "label", "<key>=<value> label (ie. region=us-east) registered with lookupd, which /lookup can filter producers by (may be given multiple times)")
+	flagSet.Var(&replicateTopics, "replicate-topic", "topic owned by this cluster that is replicated to --replicate-to (may be given multiple times)")
+	flagSet.Var(&replicateTo, "replicate-to", "TCP address of a remote cluster's nsqd that --replicate-topic topics are replicated to (may be given multiple times, they're failed over in order)")
+	flagSet.Var(&middlewares, "middleware", "<name>[:<arg>] of a compiled in middleware (validate-json, redact:<regexp>) run on publish/delivery (may be given multiple times, run in order)")
+	flagSet.Var(&e2eProcessingLatencyPercentiles, "e2e-processing-latency-percentile", "message processing time (and topic publish latency) percentiles to keep track of (can be specified multiple times or comma separated, default none)")
 }
 
 func main() {
@@ -92,27 +228,86 @@ func main() {
 	}()
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
-	var cfg map[string]interface{}
-	if *config != "" {
-		_, err := toml.DecodeFile(*config, &cfg)
-		if err != nil {
-			log.Fatalf("ERROR: failed to load config file %s - %s", *config, err.Error())
-		}
+	handoverChan := make(chan os.Signal, 1)
+	if handoverSignal != nil {
+		signal.Notify(handoverChan, handoverSignal)
 	}
 
-	opts := NewNSQDOptions()
-	options.Resolve(opts, flagSet, cfg)
+	// when started by the Windows service control manager a stop (or system
+	// shutdown) is delivered on exitChan too
+	isService := startService(exitChan)
+
+	// on SIGHUP the config file is re-read (see reload.go)
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	opts, err := loadOptions()
+	if err != nil {
+		log.Fatalf("ERROR: %s", err.Error())
+	}
+	*verbose = opts.Verbose
 	nsqd := NewNSQD(opts)
 
 	log.Println(util.Version("nsqd"))
-	log.Printf("worker id %d", opts.ID)
+	log.Printf("worker id %d (%s message IDs)", opts.ID, opts.IDGenerator)
+
+	// when started by a handover the previous nsqd still owns the data path
+	nsqd.WaitForPredecessor()
+
+	if opts.CheckDataPath != "" {
+		nsqd.CheckDataPath(opts.CheckDataPath == checkDataPathRepair)
+	}
 
 	nsqd.LoadMetadata()
-	err := nsqd.PersistMetadata()
+	nsqd.RecoverTransactions()
+	err = nsqd.PersistMetadata()
 	if err != nil {
 		log.Fatalf("ERROR: failed to persist metadata - %s", err.Error())
 	}
 	nsqd.Main()
-	<-exitChan
+	for exiting := false; !exiting; {
+		select {
+		case <-exitChan:
+			exiting = true
+		case <-nsqd.drainedChan:
+			exiting = true
+		case <-reloadChan:
+			opts, err := loadOptions()
+			if err == nil {
+				err = nsqd.Reload(opts)
+			}
+			if err != nil {
+				log.Printf("ERROR: reload failed - %s", err.Error())
+			}
+		case <-handoverChan:
+			err := nsqd.Handover()
+			if err != nil {
+				log.Printf("ERROR: handover failed - %s", err.Error())
+				continue
+			}
+			exiting = true
+		}
+	}
 	nsqd.Exit()
+
+	if isService {
+		stopService()
+	}
+}
+
+// loadOptions resolves the options from the flags and the --config file
+func loadOptions() (*nsqdOptions, error) {
+	var cfg map[string]interface{}
+	if *config != "" {
+		_, err := toml.DecodeFile(*config, &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config file %s - %s", *config, err.Error())
+		}
+	}
+
+	util.UpgradeConfigKeys(cfg, util.ListenAddressConfigKeys)
+
+	opts := NewNSQDOptions()
+	options.Resolve(opts, flagSet, cfg)
+	return opts, nil
 }
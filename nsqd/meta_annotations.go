@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/bitly/go-nsq"
+)
+
+// topics and channels can be annotated with free-form <key>=<value> metadata
+// (ie. owner, description, runbook) so that whoever is paged when one backs up
+// can tell whose it is, not to be confused with the annotations of REQ'd
+// messages (see annotations.go). They're persisted with the metadata, in
+// /stats and reported to nsqlookupd (with ANNOTATIONS).
+
+// the most annotations a topic or channel has and the longest key and value
+const (
+	maxMetaAnnotations         = 16
+	maxMetaAnnotationKeySize   = 64
+	maxMetaAnnotationValueSize = 1024
+)
+
+var errInvalidMetaAnnotations = errors.New("invalid annotations")
+
+// metaAnnotationsChanged is sent (as the topic name) to lookupLoop when a
+// topic's, or one of its channels', annotations change
+type metaAnnotationsChanged string
+
+type metaAnnotations struct {
+	sync.RWMutex
+	m map[string]string
+}
+
+// update sets each of changes' keys, an empty value removes the key
+func (a *metaAnnotations) update(changes map[string]string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	m := make(map[string]string, len(a.m)+len(changes))
+	for k, v := range a.m {
+		m[k] = v
+	}
+	for k, v := range changes {
+		if k == "" || len(k) > maxMetaAnnotationKeySize || len(v) > maxMetaAnnotationValueSize {
+			return errInvalidMetaAnnotations
+		}
+		if v == "" {
+			delete(m, k)
+			continue
+		}
+		m[k] = v
+	}
+	if len(m) > maxMetaAnnotations {
+		return errInvalidMetaAnnotations
+	}
+
+	a.m = m
+	return nil
+}
+
+// get returns a copy of the annotations (nil if there aren't any)
+func (a *metaAnnotations) get() map[string]string {
+	a.RLock()
+	defer a.RUnlock()
+	if len(a.m) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(a.m))
+	for k, v := range a.m {
+		m[k] = v
+	}
+	return m
+}
+
+// stringMap converts the (string) values of annotations parsed from the
+// metadata, skipping any that aren't strings
+func stringMap(m map[string]interface{}) map[string]string {
+	s := make(map[string]string, len(m))
+	for k, v := range m {
+		if str, ok := v.(string); ok {
+			s[k] = str
+		}
+	}
+	return s
+}
+
+// Annotate updates the topic's annotations (an empty value removes the key)
+func (t *Topic) Annotate(changes map[string]string) error {
+	err := t.meta.update(changes)
+	if err != nil {
+		return err
+	}
+	log.Printf("TOPIC(%s): annotations %v", t.name, t.meta.get())
+
+	go t.context.nsqd.Notify(metaAnnotationsChanged(t.name))
+
+	t.context.nsqd.Lock()
+	defer t.context.nsqd.Unlock()
+	return t.context.nsqd.PersistMetadata()
+}
+
+func (t *Topic) MetaAnnotations() map[string]string {
+	return t.meta.get()
+}
+
+// Annotate updates the channel's annotations (an empty value removes the key)
+func (c *Channel) Annotate(changes map[string]string) error {
+	err := c.meta.update(changes)
+	if err != nil {
+		return err
+	}
+	log.Printf("CHANNEL(%s): annotations %v", c.name, c.meta.get())
+
+	go c.context.nsqd.Notify(metaAnnotationsChanged(c.topicName))
+
+	c.context.nsqd.Lock()
+	defer c.context.nsqd.Unlock()
+	return c.context.nsqd.PersistMetadata()
+}
+
+func (c *Channel) MetaAnnotations() map[string]string {
+	return c.meta.get()
+}
+
+// topicMetaAnnotations is how a topic's annotations and those of its channels
+// are reported to nsqlookupd
+type topicMetaAnnotations struct {
+	Annotations map[string]string            `json:"annotations,omitempty"`
+	Channels    map[string]map[string]string `json:"channels,omitempty"`
+}
+
+// metaAnnotationsCommand builds an ANNOTATIONS command reporting the
+// annotations of every topic that has any (or has a channel that has any)
+func (n *NSQD) metaAnnotationsCommand() *nsq.Command {
+	topics := make(map[string]*topicMetaAnnotations)
+	n.RLock()
+	for _, topic := range n.topicMap {
+		a := &topicMetaAnnotations{
+			Annotations: topic.MetaAnnotations(),
+			Channels:    make(map[string]map[string]string),
+		}
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			if m := channel.MetaAnnotations(); m != nil {
+				a.Channels[channel.name] = m
+			}
+		}
+		topic.RUnlock()
+		if a.Annotations != nil || len(a.Channels) > 0 {
+			topics[topic.name] = a
+		}
+	}
+	n.RUnlock()
+
+	body, err := json.Marshal(topics)
+	if err != nil {
+		log.Printf("ERROR: failed to marshal annotations - %s", err.Error())
+		return nil
+	}
+	return &nsq.Command{Name: []byte("ANNOTATIONS"), Body: body}
+}
+
+// sendMetaAnnotations sends cmd to lookupPeer if it supports it (older
+// nsqlookupd would close the connection)
+func (n *NSQD) sendMetaAnnotations(lookupPeer *LookupPeer, cmd *nsq.Command) {
+	if cmd == nil || !lookupPeer.Info.AnnotationReports {
+		return
+	}
+	_, err := lookupPeer.Command(cmd)
+	if err != nil {
+		log.Printf("LOOKUPD(%s): ERROR %s - %s", lookupPeer, cmd, err.Error())
+	}
+}
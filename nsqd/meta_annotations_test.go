@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/nsq/nsqlookupd"
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestMetaAnnotations(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	lookupdOptions := nsqlookupd.NewNSQLookupdOptions()
+	lookupdOptions.TCPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.HTTPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.BroadcastAddress = "127.0.0.1"
+	lookupd := nsqlookupd.NewNSQLookupd(lookupdOptions)
+	lookupd.Main()
+	defer lookupd.Exit()
+
+	options := NewNSQDOptions()
+	options.NSQLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	for i := 0; len(lookupd.DB.FindProducers("client", "", "")) == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	topicName := "test_meta_annotations" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	runbook := "http://wiki/runbooks?topic=" + topicName
+	endpoint := fmt.Sprintf("http://%s/annotate_topic?topic=%s&annotation=owner=search&annotation=%s",
+		httpAddr, topicName, url.QueryEscape("runbook="+runbook))
+	_, err := util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	endpoint = fmt.Sprintf("http://%s/annotate_channel?topic=%s&channel=ch&annotation=owner=indexer",
+		httpAddr, topicName)
+	_, err = util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, topic.MetaAnnotations(), map[string]string{"owner": "search", "runbook": runbook})
+	assert.Equal(t, channel.MetaAnnotations(), map[string]string{"owner": "indexer"})
+
+	// an empty value removes the key
+	endpoint = fmt.Sprintf("http://%s/annotate_topic?topic=%s&annotation=runbook=", httpAddr, topicName)
+	_, err = util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, topic.MetaAnnotations(), map[string]string{"owner": "search"})
+
+	endpoint = fmt.Sprintf("http://%s/annotate_topic?topic=%s&annotation=owner", httpAddr, topicName)
+	_, err = util.ApiRequest(endpoint)
+	assert.NotEqual(t, err, nil)
+
+	data, err := util.ApiRequest(fmt.Sprintf("http://%s/stats?format=json", httpAddr))
+	assert.Equal(t, err, nil)
+	topicStats := data.Get("topics").GetIndex(0)
+	assert.Equal(t, topicStats.Get("annotations").Get("owner").MustString(), "search")
+	assert.Equal(t, topicStats.Get("channels").GetIndex(0).Get("annotations").Get("owner").MustString(), "indexer")
+
+	// reported to nsqlookupd
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s", lookupd.RealHTTPAddr(), topicName)
+	for i := 0; i < 100; i++ {
+		data, err = util.ApiRequest(endpoint)
+		if err == nil && data.Get("annotations").Get("owner").MustString() == "search" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data.Get("annotations").Get("owner").MustString(), "search")
+	assert.Equal(t, data.Get("channel_annotations").Get("ch").Get("owner").MustString(), "indexer")
+
+	nsqd.DeleteExistingTopic(topicName)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/bitly/go-simplejson"
+)
+
+// nsqd.<id>.dat is a versioned envelope around the metadata, with its
+// checksum... it's written to a temporary file that's synced and renamed over
+// it, after the previous generation is kept as nsqd.<id>.dat.prev, so a crash
+// while persisting leaves at least one generation intact
+//
+// a metadata file that can't be loaded (it doesn't parse or fails its
+// checksum) stops nsqd from starting, rather than it starting (and persisting)
+// without its topics and channels... with --recover-metadata the previous
+// generation is loaded instead, and the corrupt file is kept aside as .corrupt
+
+const metadataFormatVersion = 2
+
+var errMetadataChecksum = errors.New("metadata checksum mismatch")
+
+type metadataEnvelope struct {
+	FormatVersion int             `json:"format_version"`
+	Checksum      uint32          `json:"checksum"`
+	Metadata      json.RawMessage `json:"metadata"`
+}
+
+func metadataFileName(dataPath string, id int64) string {
+	return fmt.Sprintf(path.Join(dataPath, "nsqd.%d.dat"), id)
+}
+
+// readMetadataFile reads and verifies a metadata file, files written before
+// metadata was versioned are the metadata itself
+func readMetadataFile(fileName string) (*simplejson.Json, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope metadataEnvelope
+	err = json.Unmarshal(data, &envelope)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case envelope.FormatVersion == 0:
+		return simplejson.NewJson(data)
+	case envelope.FormatVersion > metadataFormatVersion:
+		return nil, fmt.Errorf("unsupported metadata format version %d", envelope.FormatVersion)
+	}
+
+	if crc32.ChecksumIEEE(envelope.Metadata) != envelope.Checksum {
+		return nil, errMetadataChecksum
+	}
+	return simplejson.NewJson(envelope.Metadata)
+}
+
+// writeMetadataFile atomically replaces fileName with metadata (which must be
+// compact JSON), keeping the previous generation
+func writeMetadataFile(fileName string, metadata []byte) error {
+	data, err := json.Marshal(&metadataEnvelope{
+		FormatVersion: metadataFormatVersion,
+		Checksum:      crc32.ChecksumIEEE(metadata),
+		Metadata:      metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(fileName, fileName+".prev")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		return err
+	}
+
+	// make the renames durable
+	return syncDir(path.Dir(fileName))
+}
+
+// readMetadata returns the metadata to load at startup, nil if there is none
+// (or none could be recovered)
+func (n *NSQD) readMetadata() *simplejson.Json {
+	fileName := metadataFileName(n.options.DataPath, n.options.ID)
+	prevFileName := fileName + ".prev"
+
+	js, err := readMetadataFile(fileName)
+	if err == nil {
+		return js
+	}
+	if os.IsNotExist(err) {
+		// a crash between keeping the previous generation and renaming the
+		// new one over it
+		js, err = readMetadataFile(prevFileName)
+		if err == nil {
+			log.Printf("WARNING: %s is missing, loading the previous generation", fileName)
+			return js
+		}
+		if os.IsNotExist(err) {
+			return nil
+		}
+		fileName = prevFileName
+	}
+
+	if !n.options.RecoverMetadata {
+		log.Fatalf("ERROR: failed to load metadata from %s - %s (--recover-metadata loads the previous generation)",
+			fileName, err.Error())
+	}
+
+	log.Printf("ERROR: failed to load metadata from %s - %s, recovering", fileName, err.Error())
+	os.Rename(fileName, fileName+".corrupt")
+	if fileName != prevFileName {
+		js, err = readMetadataFile(prevFileName)
+		if err == nil {
+			log.Printf("NSQ: recovered metadata from %s", prevFileName)
+			return js
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: failed to load metadata from %s - %s", prevFileName, err.Error())
+			os.Rename(prevFileName, prevFileName+".corrupt")
+		}
+	}
+	log.Printf("WARNING: no metadata could be recovered, starting without topics and channels")
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestMetadataFile(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dataPath, err := ioutil.TempDir("", "nsq-test-metadata")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dataPath)
+	fileName := metadataFileName(dataPath, 0)
+
+	err = writeMetadataFile(fileName, []byte(`{"topics":[{"name":"a"}]}`))
+	assert.Equal(t, err, nil)
+	err = writeMetadataFile(fileName, []byte(`{"topics":[{"name":"b"}]}`))
+	assert.Equal(t, err, nil)
+
+	js, err := readMetadataFile(fileName)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, js.Get("topics").GetIndex(0).Get("name").MustString(), "b")
+	js, err = readMetadataFile(fileName + ".prev")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, js.Get("topics").GetIndex(0).Get("name").MustString(), "a")
+
+	// a torn write
+	data, _ := ioutil.ReadFile(fileName)
+	ioutil.WriteFile(fileName, append(data[:len(data)-10], []byte(`"c"}]}}`)...), 0600)
+	_, err = readMetadataFile(fileName)
+	assert.NotEqual(t, err, nil)
+
+	// written before metadata was versioned
+	legacy := path.Join(dataPath, "legacy.dat")
+	ioutil.WriteFile(legacy, []byte(`{"version":"0.2.28","topics":[{"name":"d"}]}`), 0600)
+	js, err = readMetadataFile(legacy)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, js.Get("topics").GetIndex(0).Get("name").MustString(), "d")
+}
+
+func TestRecoverMetadata(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.RecoverMetadata = true
+	options.DataPath = mustTempDataPath()
+	defer os.RemoveAll(options.DataPath)
+	fileName := metadataFileName(options.DataPath, options.ID)
+
+	err := writeMetadataFile(fileName, []byte(`{"topics":[{"name":"test_recover_metadata","channels":[]}]}`))
+	assert.Equal(t, err, nil)
+	err = writeMetadataFile(fileName, []byte(`{"topics":[]}`))
+	assert.Equal(t, err, nil)
+	ioutil.WriteFile(fileName, []byte(`{"format_version":2,"checksum":1,"metadata":{"topics":[]}}`), 0600)
+
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+	nsqd.LoadMetadata()
+
+	_, err = nsqd.GetExistingTopic("test_recover_metadata")
+	assert.Equal(t, err, nil)
+	_, err = os.Stat(fileName + ".corrupt")
+	assert.Equal(t, err, nil)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bitly/go-nsq"
+)
+
+// Middleware transforms (or validates) messages inside nsqd, either method
+// may modify msg by replacing its Body (which is shared between channels and
+// must not be modified in place)
+type Middleware interface {
+	// OnPublish is called for every message published to topicName before
+	// it is queued, an error rejects the publish
+	OnPublish(topicName string, msg *nsq.Message) error
+
+	// OnDeliver is called the first time a message is delivered from a
+	// channel (so changes persist across requeues), an error discards it
+	OnDeliver(topicName string, channelName string, msg *nsq.Message) error
+}
+
+// middlewareFactories are the compiled in middlewares, they're enabled (and
+// run in the order given) with --middleware=<name>[:<arg>], others can be
+// compiled in by adding their constructor here from an init() in their own file
+var middlewareFactories = map[string]func(arg string) (Middleware, error){
+	"validate-json": newValidateJSONMiddleware,
+	"redact":        newRedactMiddleware,
+}
+
+// msgRejectedError is returned for publishes rejected by a middleware
+type msgRejectedError struct {
+	name string
+	err  error
+}
+
+func (e *msgRejectedError) Error() string {
+	return fmt.Sprintf("rejected by %s - %s", e.name, e.err.Error())
+}
+
+type namedMiddleware struct {
+	name string
+	Middleware
+}
+
+type middlewareChain []namedMiddleware
+
+func newMiddlewareChain(specs []string) (middlewareChain, error) {
+	var chain middlewareChain
+	for _, spec := range specs {
+		name := spec
+		var arg string
+		if i := strings.Index(spec, ":"); i != -1 {
+			name, arg = spec[:i], spec[i+1:]
+		}
+		factory, ok := middlewareFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		m, err := factory(arg)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s - %s", name, err.Error())
+		}
+		chain = append(chain, namedMiddleware{name, m})
+	}
+	return chain, nil
+}
+
+func (mc middlewareChain) publish(topicName string, msgs []*nsq.Message) error {
+	for _, m := range mc {
+		for _, msg := range msgs {
+			err := m.OnPublish(topicName, msg)
+			if err != nil {
+				return &msgRejectedError{m.name, err}
+			}
+		}
+	}
+	return nil
+}
+
+func (mc middlewareChain) deliver(topicName string, channelName string, msg *nsq.Message) error {
+	for _, m := range mc {
+		err := m.OnDeliver(topicName, channelName, msg)
+		if err != nil {
+			return &msgRejectedError{m.name, err}
+		}
+	}
+	return nil
+}
+
+// validateJSONMiddleware rejects publishes that aren't valid JSON
+type validateJSONMiddleware struct{}
+
+func newValidateJSONMiddleware(arg string) (Middleware, error) {
+	return validateJSONMiddleware{}, nil
+}
+
+func (validateJSONMiddleware) OnPublish(topicName string, msg *nsq.Message) error {
+	var v interface{}
+	err := json.Unmarshal(msg.Body, &v)
+	if err != nil {
+		return errors.New("invalid JSON")
+	}
+	return nil
+}
+
+func (validateJSONMiddleware) OnDeliver(topicName string, channelName string, msg *nsq.Message) error {
+	return nil
+}
+
+// redactMiddleware replaces what matches its regexp (the argument) in the
+// body of published messages, before they're ever written to disk
+type redactMiddleware struct {
+	re *regexp.Regexp
+}
+
+var redactedBytes = []byte("[REDACTED]")
+
+func newRedactMiddleware(arg string) (Middleware, error) {
+	if arg == "" {
+		return nil, errors.New("a regexp is required (redact:<regexp>)")
+	}
+	re, err := regexp.Compile(arg)
+	if err != nil {
+		return nil, err
+	}
+	return &redactMiddleware{re}, nil
+}
+
+func (r *redactMiddleware) OnPublish(topicName string, msg *nsq.Message) error {
+	msg.Body = r.re.ReplaceAllLiteral(msg.Body, redactedBytes)
+	return nil
+}
+
+func (r *redactMiddleware) OnDeliver(topicName string, channelName string, msg *nsq.Message) error {
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+type deliverMiddleware struct{}
+
+func (deliverMiddleware) OnPublish(topicName string, msg *nsq.Message) error {
+	return nil
+}
+
+func (deliverMiddleware) OnDeliver(topicName string, channelName string, msg *nsq.Message) error {
+	if string(msg.Body) == `"drop"` {
+		return errors.New("dropped")
+	}
+	msg.Body = append(append([]byte{}, msg.Body...), []byte(" "+channelName)...)
+	return nil
+}
+
+func TestMiddleware(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	middlewareFactories["test-deliver"] = func(arg string) (Middleware, error) {
+		return deliverMiddleware{}, nil
+	}
+	defer delete(middlewareFactories, "test-deliver")
+
+	_, err := newMiddlewareChain([]string{"unknown"})
+	assert.NotEqual(t, err, nil)
+	_, err = newMiddlewareChain([]string{"redact"})
+	assert.NotEqual(t, err, nil)
+
+	options := NewNSQDOptions()
+	options.Middleware = []string{"validate-json", `redact:\d{4}-\d{4}`, "test-deliver"}
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_middleware" + strconv.Itoa(int(time.Now().Unix()))
+	channel := nsqd.GetTopic(topicName).GetChannel("ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+
+	// rejected on publish
+	err = nsq.Publish(topicName, []byte("not json")).Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeError, "E_MSG_REJECTED PUB failed rejected by validate-json - invalid JSON")
+
+	// dropped on delivery
+	err = nsq.Publish(topicName, []byte(`"drop"`)).Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeResponse, "OK")
+
+	// redacted on publish, enriched on delivery
+	err = nsq.Publish(topicName, []byte(`"card 1234-5678"`)).Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeResponse, "OK")
+
+	msg := <-channel.clientMsgChan
+	assert.Equal(t, string(msg.Body), `"card [REDACTED]" ch`)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// a mirror channel is a shadow of another (its source) for canary consumers,
+// like any channel it gets a copy of every message published to the topic but
+//
+//  * it can be capped to a number of messages per second, those over the cap
+//    are skipped (and counted)
+//  * it doesn't count towards the topic's max depth, fire the depth webhook or
+//    report its stats to statsd as a channel (topic.<topic>.mirror.<channel>.*
+//    instead of topic.<topic>.channel.<channel>.*), so that a misbehaving
+//    canary can neither hold up nor page for the production consumers
+
+var errInvalidMirrorSource = errors.New("invalid mirror source")
+
+// MirrorChannel returns the (potentially new) channel after making it a mirror
+// of source (an empty source makes it a regular channel again), maxRate caps
+// how many messages per second it gets (0 is uncapped)
+func (t *Topic) MirrorChannel(channelName string, source string, maxRate int64) (*Channel, error) {
+	if source != "" {
+		if source == channelName {
+			return nil, errInvalidMirrorSource
+		}
+		sourceChannel, err := t.GetExistingChannel(source)
+		if err != nil || sourceChannel.MirrorOf() != "" {
+			// mirrors aren't chained
+			return nil, errInvalidMirrorSource
+		}
+	}
+
+	channel := t.GetChannel(channelName)
+	channel.setMirror(source, maxRate)
+
+	t.context.nsqd.Lock()
+	defer t.context.nsqd.Unlock()
+	return channel, t.context.nsqd.PersistMetadata()
+}
+
+func (c *Channel) setMirror(source string, maxRate int64) {
+	if source == "" {
+		maxRate = 0
+	}
+
+	c.mirrorLock.Lock()
+	c.mirrorOf = source
+	c.mirrorLock.Unlock()
+	atomic.StoreInt64(&c.mirrorMaxRate, maxRate)
+
+	if source == "" {
+		log.Printf("CHANNEL(%s): not a mirror", c.name)
+	} else {
+		log.Printf("CHANNEL(%s): mirror of %s (max rate %d/s)", c.name, source, maxRate)
+	}
+}
+
+// MirrorOf returns the name of the channel this channel mirrors (if any)
+func (c *Channel) MirrorOf() string {
+	c.mirrorLock.Lock()
+	defer c.mirrorLock.Unlock()
+	return c.mirrorOf
+}
+
+// MirrorMaxRate returns the mirror's cap in messages per second (0 if none)
+func (c *Channel) MirrorMaxRate() int64 {
+	return atomic.LoadInt64(&c.mirrorMaxRate)
+}
+
+// rateLimited reports (and counts) whether a message would exceed the mirror's
+// cap for the current second
+func (c *Channel) rateLimited() bool {
+	maxRate := atomic.LoadInt64(&c.mirrorMaxRate)
+	if maxRate <= 0 {
+		return false
+	}
+
+	now := time.Now().Unix()
+	c.mirrorLock.Lock()
+	defer c.mirrorLock.Unlock()
+	if now != c.mirrorSecond {
+		c.mirrorSecond = now
+		c.mirrorSecondCount = 0
+	}
+	if c.mirrorSecondCount >= maxRate {
+		atomic.AddUint64(&c.rateLimitedCount, 1)
+		return true
+	}
+	c.mirrorSecondCount++
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestChannelMirror(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_mirror" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	prod := topic.GetChannel("prod")
+
+	url := fmt.Sprintf("http://%s/set_channel_mirror?topic=%s&channel=canary&source=prod&max_rate=2", httpAddr, topicName)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	canary, err := topic.GetExistingChannel("canary")
+	assert.Equal(t, err, nil)
+	stats := NewChannelStats(canary, nil)
+	assert.Equal(t, stats.MirrorOf, "prod")
+	assert.Equal(t, stats.MirrorMaxRate, int64(2))
+
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+	for i := 0; i < 100; i++ {
+		if atomic.LoadUint64(&prod.messageCount) == 5 &&
+			atomic.LoadUint64(&canary.messageCount)+atomic.LoadUint64(&canary.rateLimitedCount) == 5 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the mirror gets the same messages, up to its max rate
+	stats = NewChannelStats(canary, nil)
+	assert.Equal(t, NewChannelStats(prod, nil).MessageCount, uint64(5))
+	assert.Equal(t, stats.MessageCount+stats.RateLimitedCount, uint64(5))
+	assert.NotEqual(t, stats.RateLimitedCount, uint64(0))
+
+	// mirrors aren't chained and need an existing source
+	for _, source := range []string{"canary", "nonexistent"} {
+		url = fmt.Sprintf("http://%s/set_channel_mirror?topic=%s&channel=canary2&source=%s", httpAddr, topicName, source)
+		resp, err = http.Get(url)
+		assert.Equal(t, err, nil)
+		resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, 500)
+	}
+
+	// without a source it's a regular channel again
+	url = fmt.Sprintf("http://%s/set_channel_mirror?topic=%s&channel=canary", httpAddr, topicName)
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, canary.MirrorOf(), "")
+	assert.Equal(t, canary.MirrorMaxRate(), int64(0))
+}
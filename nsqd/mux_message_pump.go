@@ -0,0 +1,147 @@
+//go:build go1.1
+// +build go1.1
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// multiplexed subscriptions need reflect.Select (Go 1.1), they aren't
+// negotiated otherwise (see mux_message_pump_other.go)
+const multiplexSupported = true
+
+// muxMessagePump is the messagePump for clients that negotiated multiplex, it
+// selects over the clientMsgChan of every subscription (the number of which
+// is only known at runtime, hence reflect.Select) while the connection-wide
+// RDY count allows
+func (p *ProtocolV2) muxMessagePump(client *ClientV2, subChannel *Channel, outputBufferTicker *time.Ticker,
+	heartbeatChan <-chan time.Time, sampleRate int32, msgTimeout time.Duration) error {
+	const (
+		flusherCase = iota
+		readyStateCase
+		subEventCase
+		heartbeatCase
+		exitCase
+		numStaticCases
+	)
+
+	var err error
+	var buf bytes.Buffer
+	// subscription IDs are assigned in SUB order, as are the events we receive
+	var subs []*Channel
+	// whether each subscription is a topic a wildcard SUB matched
+	var wildcards []bool
+
+	cases := make([]reflect.SelectCase, numStaticCases)
+	for i := range cases {
+		cases[i].Dir = reflect.SelectRecv
+	}
+	cases[readyStateCase].Chan = reflect.ValueOf(client.ReadyStateChan)
+	cases[subEventCase].Chan = reflect.ValueOf(client.SubEventChan)
+	if heartbeatChan != nil {
+		cases[heartbeatCase].Chan = reflect.ValueOf(heartbeatChan)
+	}
+	cases[exitCase].Chan = reflect.ValueOf(client.ExitChan)
+
+	// the first SUB can race the IDENTIFY event to messagePump
+	if subChannel != nil {
+		subs = append(subs, subChannel)
+		wildcards = append(wildcards, client.isWildcardSubscription(0))
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv})
+	}
+
+	flushed := true
+
+	for {
+		ready := len(subs) > 0 && client.IsReadyForMessages()
+		if !ready {
+			// force flush
+			client.Lock()
+			err = client.Flush()
+			client.Unlock()
+			if err != nil {
+				return err
+			}
+			flushed = true
+		}
+
+		if ready && !flushed {
+			cases[flusherCase].Chan = reflect.ValueOf(outputBufferTicker.C)
+		} else {
+			cases[flusherCase].Chan = reflect.Value{}
+		}
+
+		// a zero Value disables the case
+		for i, channel := range subs {
+			if ready && channel != nil && !channel.IsPaused() {
+				cases[numStaticCases+i].Chan = reflect.ValueOf(channel.clientMsgChan)
+			} else {
+				cases[numStaticCases+i].Chan = reflect.Value{}
+			}
+		}
+
+		chosen, recv, recvOK := reflect.Select(cases)
+		switch chosen {
+		case flusherCase:
+			client.Lock()
+			err = client.Flush()
+			client.Unlock()
+			if err != nil {
+				return err
+			}
+			flushed = true
+		case readyStateCase:
+		case subEventCase:
+			subs = append(subs, recv.Interface().(*Channel))
+			wildcards = append(wildcards, client.isWildcardSubscription(len(subs)-1))
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv})
+		case heartbeatCase:
+			err = p.checkHeartbeat(client)
+			if err != nil {
+				return err
+			}
+			err = p.sendHeartbeat(client, nil)
+			if err != nil {
+				return err
+			}
+			client.HeartbeatSent()
+		case exitCase:
+			return nil
+		default:
+			subID := chosen - numStaticCases
+			channel := subs[subID]
+			if !recvOK {
+				// the channel was deleted, the rest of the subscriptions carry on
+				subs[subID] = nil
+				continue
+			}
+
+			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
+				continue
+			}
+
+			msg := recv.Interface().(*nsq.Message)
+			channel.StartInFlightTimeout(msg, client.ID, msgTimeout)
+			client.SendingMessage()
+			err = p.sendAnnotations(client, channel, msg, &buf)
+			if err != nil {
+				return err
+			}
+			if wildcards[subID] {
+				err = p.SendTopicMessage(client, int32(subID), channel.topicName, msg, &buf)
+			} else {
+				err = p.SendMultiplexedMessage(client, int32(subID), msg, &buf)
+			}
+			if err != nil {
+				return err
+			}
+			flushed = false
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !go1.1
+// +build !go1.1
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// multiplexed subscriptions need reflect.Select (Go 1.1), so IDENTIFY never
+// negotiates them
+const multiplexSupported = false
+
+func (p *ProtocolV2) muxMessagePump(client *ClientV2, subChannel *Channel, outputBufferTicker *time.Ticker,
+	heartbeatChan <-chan time.Time, sampleRate int32, msgTimeout time.Duration) error {
+	return errors.New("multiplex needs Go 1.1")
+}
@@ -0,0 +1,129 @@
+//go:build go1.1
+// +build go1.1
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestMultiplexedSubscriptions(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.MaxSubscriptionsPerClient = 2
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicNames := []string{
+		"test_mux_a" + strconv.Itoa(int(time.Now().Unix())),
+		"test_mux_b" + strconv.Itoa(int(time.Now().Unix())),
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	data := identify(t, conn, map[string]interface{}{
+		"multiplex": true,
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		Multiplex        bool  `json:"multiplex"`
+		MaxSubscriptions int64 `json:"max_subscriptions"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Multiplex, true)
+	assert.Equal(t, r.MaxSubscriptions, int64(2))
+
+	for i, topicName := range topicNames {
+		err = nsq.Subscribe(topicName, "ch").Write(conn)
+		assert.Equal(t, err, nil)
+		readValidate(t, conn, nsq.FrameTypeResponse, fmt.Sprintf("OK %d", i))
+	}
+
+	// the connection is limited to --max-subscriptions-per-client
+	err = nsq.Subscribe("test_mux_c", "ch").Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, strings.HasPrefix(string(data), "E_SUB_FAILED"), true)
+
+	for _, topicName := range topicNames {
+		topic := nsqd.GetTopic(topicName)
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte(topicName)))
+	}
+
+	err = nsq.Ready(2).Write(conn)
+	assert.Equal(t, err, nil)
+
+	for i := 0; i < len(topicNames); i++ {
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, frameType, frameTypeMultiplexedMessage)
+
+		subID := int32(binary.BigEndian.Uint32(data[:4]))
+		msg, err := nsq.DecodeMessage(data[4:])
+		assert.Equal(t, err, nil)
+		assert.Equal(t, string(msg.Body), topicNames[subID])
+
+		// FIN identifies the subscription the message was delivered on
+		cmd := &nsq.Command{
+			Name:   []byte("FIN"),
+			Params: [][]byte{msg.Id[:], []byte(strconv.Itoa(int(subID)))},
+		}
+		err = cmd.Write(conn)
+		assert.Equal(t, err, nil)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	for _, topicName := range topicNames {
+		topic, _ := nsqd.GetExistingTopic(topicName)
+		channel, _ := topic.GetExistingChannel("ch")
+		assert.Equal(t, len(channel.inFlightMessages), 0)
+		assert.Equal(t, len(channel.clients), 1)
+	}
+}
+
+func TestMultiplexedFeatureConflicts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.MaxSubscriptionsPerClient = 2
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	// features a multiplexed client couldn't be given are refused, rather
+	// than silently dropped
+	for _, feature := range []map[string]interface{}{
+		{"rdy_hints": true},
+		{"batch_max_count": 10},
+		{"backoff": true},
+		{"msg_deadlines": true},
+	} {
+		feature["multiplex"] = true
+		conn, err := mustConnectNSQD(tcpAddr)
+		assert.Equal(t, err, nil)
+		data := identify(t, conn, feature, nsq.FrameTypeError)
+		assert.Equal(t, strings.HasPrefix(string(data), "E_BAD_BODY"), true)
+		conn.Close()
+	}
+}
@@ -5,19 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"os"
-	"path"
 	"runtime"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/bitly/go-nsq"
-	"github.com/bitly/go-simplejson"
 	"github.com/bitly/nsq/util"
 	"github.com/bitly/nsq/util/lookupd"
 )
@@ -25,75 +21,327 @@ import (
 type NSQD struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	clientIDSequence int64
+	udpAcceptedCount uint64
+	udpDroppedCount  uint64
+	// round-robins unkeyed messages across a sharded topic's shards
+	shardSequence uint64
+
+	// set by the disk watchdog while publishes are rejected
+	readOnly int32
+	// set once a handover to a new process has started
+	handingOver int32
+	// set once a drain (see drain.go) has started
+	draining int32
 
 	sync.RWMutex
 
 	options *nsqdOptions
 
 	topicMap map[string]*Topic
-
-	lookupPeers []*LookupPeer
-
-	tcpAddr      *net.TCPAddr
-	httpAddr     *net.TCPAddr
-	tcpListener  net.Listener
-	httpListener net.Listener
-	tlsConfig    *tls.Config
+	aliasMap map[string][]string
+	shardMap map[string]int
+
+	// lookupLoop's peers, replaced (under lookupPeersMutex) when a config
+	// reload changes --lookupd-tcp-address
+	lookupPeersMutex sync.RWMutex
+	lookupPeers      []*LookupPeer
+	lookupdAddrsChan chan []string
+
+	// has httpLookupLoop register with --lookupd-http-address now (see
+	// lookup_http.go)
+	httpLookupSyncChan chan int
+
+	// tcpAddr and httpAddr are the addresses of the first TCP and HTTP
+	// listeners, their ports are what gets advertised to lookupd
+	tcpAddr       *net.TCPAddr
+	httpAddr      *net.TCPAddr
+	tcpAddrs      []*net.TCPAddr
+	httpAddrs     []*net.TCPAddr
+	tcpListeners  []net.Listener
+	httpListeners []net.Listener
+	udpConn       *net.UDPConn
+	kafkaListener net.Listener
+
+	// what a config reload (see reload.go) can change
+	reloadMutex sync.RWMutex
+	statsd      statsdOptions
+	tlsConfig   *tls.Config
+
+	// --label labels, registered with lookupd
+	labels map[string]string
+
+	// the additional --tcp-reuseport acceptors (see reuseport.go)
+	reusePortListeners []net.Listener
+
+	// listening sockets passed to us by a handover (see handover.go)
+	inheritedTCPListeners  []net.Listener
+	inheritedHTTPListeners []net.Listener
+	predecessorPipe        *os.File
+	handoverPipe           *os.File
+
+	creationPolicy *creationPolicy
+	overflowPolicy overflowPolicy
+	encryption     *atRestEncryption
+	middleware     middlewareChain
+
+	// the last --stats-history-size stats snapshots, nil when disabled
+	statsHistory *statsHistory
+
+	// runtime scoped verbose logging (see debug_logging.go)
+	debugLogging *debugLogging
+
+	// injected faults (see chaos.go), nil without --chaos
+	chaos *chaos
+
+	// SUBs to topic patterns, matched against every topic created (see
+	// wildcard_sub.go)
+	wildcardSubsMutex sync.RWMutex
+	wildcardSubs      []*wildcardSub
+
+	// queued client events (see client_events.go), nil when disabled
+	clientEventChan chan *clientEvent
+
+	// X-NSQ-Request-IDs of recent publishes (see request_id.go), nil when
+	// disabled
+	publishRequestIDs *publishRequestIDs
+
+	// generates the message IDs idPump feeds idChan (see id_generator.go)
+	idGenerator idGenerator
+
+	// other producers nsqlookupd reported as sharing our worker id, by
+	// nsqlookupd
+	workerIDCollisionsMutex sync.Mutex
+	workerIDCollisions      map[string][]string
 
 	idChan     chan nsq.MessageID
 	notifyChan chan interface{}
 	exitChan   chan int
 	waitGroup  util.WaitGroupWrapper
+
+	// closed when a drain completes (or times out)
+	drainedChan chan int
 }
 
 func NewNSQD(options *nsqdOptions) *NSQD {
-	var tlsConfig *tls.Config
-
 	if options.MaxDeflateLevel < 1 || options.MaxDeflateLevel > 9 {
 		log.Fatalf("--max-deflate-level must be [1,9]")
 	}
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", options.TCPAddress)
-	if err != nil {
-		log.Fatal(err)
+	if options.TCPAcceptors < 0 {
+		log.Fatalf("--tcp-acceptors must be >= 0")
+	}
+
+	if options.MaxReqTimeout <= 0 {
+		log.Fatalf("--max-req-timeout must be > 0")
+	}
+
+	if options.TCPKeepAliveInterval < 0 || options.IdleClientTimeout < 0 {
+		log.Fatalf("--tcp-keepalive-interval and --idle-client-timeout must be >= 0")
+	}
+
+	if options.StatsdInterval <= 0 {
+		log.Fatalf("--statsd-interval must be > 0")
+	}
+
+	if options.StatsHistorySize > 0 && options.StatsHistoryInterval <= 0 {
+		log.Fatalf("--stats-history-interval must be > 0")
+	}
+
+	if options.OutputBufferTimeoutAdaptive &&
+		(options.MinOutputBufferTimeout <= 0 || options.MinOutputBufferTimeout > options.MaxOutputBufferTimeout) {
+		log.Fatalf("--min-output-buffer-timeout must be > 0 and <= --max-output-buffer-timeout")
+	}
+
+	if options.ClientWriteTimeout < minClientWriteTimeout || options.ClientWriteTimeout > options.MaxClientWriteTimeout {
+		log.Fatalf("--client-write-timeout must be >= %s and <= --max-client-write-timeout", minClientWriteTimeout)
+	}
+
+	if options.HeartbeatMissTolerance < 1 || options.HeartbeatMissTolerance > options.MaxHeartbeatMissTolerance {
+		log.Fatalf("--heartbeat-miss-tolerance must be >= 1 and <= --max-heartbeat-miss-tolerance")
+	}
+
+	if options.QuarantineRequeuePercent < 0 || options.QuarantineRequeuePercent > 100 {
+		log.Fatalf("--quarantine-requeue-percent must be [0,100]")
+	}
+	if options.QuarantineRequeuePercent > 0 && options.QuarantineWindow <= 0 {
+		log.Fatalf("--quarantine-window must be > 0")
+	}
+
+	if options.TopicFanoutThreshold < 0 || options.TopicFanoutWorkers < 0 {
+		log.Fatalf("--topic-fanout-threshold and --topic-fanout-workers must be >= 0")
+	}
+
+	if options.MaxPublishTimestampAge < 0 {
+		log.Fatalf("--max-publish-timestamp-age must be >= 0")
+	}
+
+	if options.SlowConsumerFlushes < 0 {
+		log.Fatalf("--slow-consumer-flushes must be >= 0")
 	}
 
-	httpAddr, err := net.ResolveTCPAddr("tcp", options.HTTPAddress)
+	if options.BackoffFailurePercent < 0 || options.BackoffFailurePercent > 100 {
+		log.Fatalf("--backoff-failure-percent must be [0,100]")
+	}
+
+	if options.MaxAttempts < 0 || options.MaxAttempts > math.MaxUint16 {
+		log.Fatalf("--max-attempts must be [0,%d]", math.MaxUint16)
+	}
+
+	if options.AttemptsOverflowTopic != "" && !nsq.IsValidTopicName(options.AttemptsOverflowTopic) {
+		log.Fatalf("--attempts-overflow-topic (%s) is not a valid topic name", options.AttemptsOverflowTopic)
+	}
+
+	labels, err := util.ParseLabels(options.Labels)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("FATAL: --label %s", err.Error())
+	}
+
+	if options.ClientEventsTopic != "" && !nsq.IsValidTopicName(options.ClientEventsTopic) {
+		log.Fatalf("--client-events-topic (%s) is not a valid topic name", options.ClientEventsTopic)
 	}
 
-	if options.StatsdPrefix != "" {
-		statsdHostKey := util.StatsdHostKey(net.JoinHostPort(options.BroadcastAddress,
-			strconv.Itoa(httpAddr.Port)))
-		prefixWithHost := strings.Replace(options.StatsdPrefix, "%s", statsdHostKey, -1)
-		if prefixWithHost[len(prefixWithHost)-1] != '.' {
-			prefixWithHost += "."
+	if len(options.ReplicateTopics) > 0 {
+		if options.Cluster == "" || len(options.ReplicateTo) == 0 {
+			log.Fatalf("--replicate-topic requires --cluster and --replicate-to")
+		}
+		for _, topicName := range options.ReplicateTopics {
+			if !nsq.IsValidTopicName(topicName) {
+				log.Fatalf("--replicate-topic (%s) is not a valid topic name", topicName)
+			}
 		}
-		options.StatsdPrefix = prefixWithHost
 	}
 
+	tcpAddrs, err := resolveTCPAddrs(options.TCPAddresses)
+	if err != nil {
+		log.Fatalf("FATAL: --tcp-address %s", err.Error())
+	}
+
+	httpAddrs, err := resolveTCPAddrs(options.HTTPAddresses)
+	if err != nil {
+		log.Fatalf("FATAL: --http-address %s", err.Error())
+	}
+
+	var tlsConfig *tls.Config
 	if options.TLSCert != "" || options.TLSKey != "" {
 		cert, err := tls.LoadX509KeyPair(options.TLSCert, options.TLSKey)
 		if err != nil {
 			log.Fatalf("ERROR: failed to LoadX509KeyPair %s", err.Error())
 		}
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   tls.VerifyClientCertIfGiven,
+		tlsConfig = newTLSConfig(cert)
+	}
+
+	creationPolicy, err := newCreationPolicy(options.CreationPolicyFile,
+		options.CreationHookURL, options.CreationHookTimeout)
+	if err != nil {
+		log.Fatalf("FATAL: --creation-policy-file %s", err.Error())
+	}
+
+	encryption, err := newAtRestEncryption(options.EncryptionKeyFile, options.EncryptionKeyURL)
+	if err != nil {
+		log.Fatalf("FATAL: encryption at rest %s", err.Error())
+	}
+
+	middleware, err := newMiddlewareChain(options.Middleware)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	overflowPolicy, err := parseOverflowPolicy(options.MemQueueOverflowPolicy)
+	if err != nil || overflowPolicy == overflowDefault {
+		log.Fatalf("--mem-queue-overflow-policy must be one of spill, block or drop-oldest")
+	}
+
+	if options.CheckDataPath != "" && options.CheckDataPath != checkDataPathReport &&
+		options.CheckDataPath != checkDataPathRepair {
+		log.Fatalf("--check-data-path must be one of report or repair")
+	}
+
+	if options.HTTPDebug && options.HTTPDebugAuthToken == "" {
+		log.Fatalf("--http-debug requires --http-debug-auth-token")
+	}
+
+	for i, addr := range options.NSQLookupdHTTPAddresses {
+		lookupdURL, err := normalizeLookupdHTTPAddress(addr)
+		if err != nil {
+			log.Fatalf("--lookupd-http-address %s %s", addr, err.Error())
+		}
+		options.NSQLookupdHTTPAddresses[i] = lookupdURL
+	}
+
+	if options.WorkerIDLease {
+		if len(options.NSQLookupdTCPAddresses) == 0 {
+			log.Fatalf("--worker-id-lease requires --lookupd-tcp-address")
+		}
+		workerID, err := leaseWorkerID(options)
+		if err != nil {
+			log.Fatalf("FATAL: failed to lease a worker id - %s", err.Error())
 		}
-		tlsConfig.BuildNameToCertificate()
+		log.Printf("leased worker id %d", workerID)
+		options.ID = workerID
+	}
+
+	generator, err := newIDGenerator(options)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+	if options.IDGenerator == idGeneratorSnowflake && (options.ID < 0 || options.ID >= 1<<workerIdBits) {
+		log.Printf("WARNING: --worker-id %d is outside [0,%d), snowflake message IDs can collide",
+			options.ID, 1<<workerIdBits)
 	}
 
 	n := &NSQD{
 		options:    options,
-		tcpAddr:    tcpAddr,
-		httpAddr:   httpAddr,
+		tcpAddr:    tcpAddrs[0],
+		httpAddr:   httpAddrs[0],
+		tcpAddrs:   tcpAddrs,
+		httpAddrs:  httpAddrs,
 		topicMap:   make(map[string]*Topic),
+		aliasMap:   make(map[string][]string),
+		shardMap:   make(map[string]int),
 		idChan:     make(chan nsq.MessageID, 4096),
 		exitChan:   make(chan int),
 		notifyChan: make(chan interface{}),
-		tlsConfig:  tlsConfig,
+		labels:     labels,
+
+		statsd:           newStatsdOptions(options, httpAddrs[0].Port),
+		tlsConfig:        tlsConfig,
+		lookupdAddrsChan: make(chan []string),
+
+		httpLookupSyncChan: make(chan int, 1),
+
+		creationPolicy: creationPolicy,
+		overflowPolicy: overflowPolicy,
+		encryption:     encryption,
+		middleware:     middleware,
+
+		debugLogging: &debugLogging{},
+
+		idGenerator:        generator,
+		workerIDCollisions: make(map[string][]string),
+
+		drainedChan: make(chan int),
+	}
+
+	if options.ClientEventsWebhookURL != "" || options.ClientEventsTopic != "" {
+		n.clientEventChan = make(chan *clientEvent, clientEventsQueueSize)
+	}
+
+	if options.StatsHistorySize > 0 {
+		n.statsHistory = newStatsHistory(options.StatsHistorySize)
+	}
+
+	if options.Chaos {
+		log.Printf("WARNING: --chaos is enabled, /debug/chaos can inject faults")
+		n.chaos = &chaos{}
+	}
+
+	if options.PublishRequestIDTTL > 0 {
+		n.publishRequestIDs = newPublishRequestIDs(options.PublishRequestIDTTL)
+	}
+
+	err = n.inheritHandover()
+	if err != nil {
+		log.Fatalf("FATAL: handover failed - %s", err.Error())
 	}
 
 	n.waitGroup.Wrap(func() { n.idPump() })
@@ -101,46 +349,137 @@ func NewNSQD(options *nsqdOptions) *NSQD {
 	return n
 }
 
+// resolveTCPAddrs resolves a list of <addr>:<port> strings (IPv4 or IPv6)
+// and requires that at least one is given
+func resolveTCPAddrs(addrs []string) ([]*net.TCPAddr, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("at least one address is required")
+	}
+	tcpAddrs := make([]*net.TCPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address (%s) - %s", addr, err.Error())
+		}
+		tcpAddrs = append(tcpAddrs, tcpAddr)
+	}
+	return tcpAddrs, nil
+}
+
 func (n *NSQD) Main() {
 	context := &Context{n}
 
+	tcpServer := &tcpServer{context: context}
+	for i, addr := range n.tcpAddrs {
+		var tcpListener net.Listener
+		var err error
+		if n.options.TCPReusePort && i >= len(n.inheritedTCPListeners) {
+			tcpListener, err = listenReusePort(addr.String())
+		} else {
+			tcpListener, err = listen(n.inheritedTCPListeners, i, addr)
+		}
+		if err != nil {
+			log.Fatalf("FATAL: listen (%s) failed - %s", addr, err.Error())
+		}
+		if i == 0 {
+			n.tcpAddr = tcpListener.Addr().(*net.TCPAddr)
+		}
+		n.tcpListeners = append(n.tcpListeners, tcpListener)
+		if n.options.TCPReusePort {
+			n.startReusePortAcceptors(tcpListener, tcpServer)
+		} else {
+			n.waitGroup.Wrap(func() { util.TCPServer(tcpListener, tcpServer) })
+		}
+	}
+
+	// the legacy endpoints are also served as the v1 API (see util.V1Handler)
+	httpServer := util.V1Handler(&httpServer{context: context})
+	for i, addr := range n.httpAddrs {
+		httpListener, err := listen(n.inheritedHTTPListeners, i, addr)
+		if err != nil {
+			log.Fatalf("FATAL: listen (%s) failed - %s", addr, err.Error())
+		}
+		if i == 0 {
+			n.httpAddr = httpListener.Addr().(*net.TCPAddr)
+		}
+		n.httpListeners = append(n.httpListeners, httpListener)
+		n.waitGroup.Wrap(func() { util.HTTPServer(httpListener, httpServer) })
+	}
+
+	// a predecessor may have had more listeners than we are configured with
+	for i := len(n.tcpAddrs); i < len(n.inheritedTCPListeners); i++ {
+		n.inheritedTCPListeners[i].Close()
+	}
+	for i := len(n.httpAddrs); i < len(n.inheritedHTTPListeners); i++ {
+		n.inheritedHTTPListeners[i].Close()
+	}
+
+	if n.options.UDPAddress != "" {
+		n.listenUDP()
+	}
+
+	if n.options.KafkaAddress != "" {
+		n.listenKafka()
+	}
+
 	n.waitGroup.Wrap(func() { n.lookupLoop() })
 
-	tcpListener, err := net.Listen("tcp", n.tcpAddr.String())
-	if err != nil {
-		log.Fatalf("FATAL: listen (%s) failed - %s", n.tcpAddr, err.Error())
+	if len(n.options.NSQLookupdHTTPAddresses) > 0 {
+		n.waitGroup.Wrap(func() { n.httpLookupLoop() })
 	}
-	n.tcpListener = tcpListener
-	tcpServer := &tcpServer{context: context}
-	n.waitGroup.Wrap(func() { util.TCPServer(n.tcpListener, tcpServer) })
 
-	httpListener, err := net.Listen("tcp", n.httpAddr.String())
-	if err != nil {
-		log.Fatalf("FATAL: listen (%s) failed - %s", n.httpAddr, err.Error())
+	n.waitGroup.Wrap(func() { n.statsdLoop() })
+
+	if n.statsHistory != nil {
+		n.waitGroup.Wrap(func() { n.statsHistoryLoop() })
+	}
+
+	if n.options.DepthWebhookURL != "" {
+		n.waitGroup.Wrap(func() { n.depthWebhookLoop() })
 	}
-	n.httpListener = httpListener
-	httpServer := &httpServer{context: context}
-	n.waitGroup.Wrap(func() { util.HTTPServer(n.httpListener, httpServer) })
 
-	if n.options.StatsdAddress != "" {
-		n.waitGroup.Wrap(func() { n.statsdLoop() })
+	if n.options.MinFreeDiskBytes > 0 {
+		n.waitGroup.Wrap(func() { n.diskWatchdogLoop() })
+	}
+
+	if n.options.QuarantineRequeuePercent > 0 {
+		n.waitGroup.Wrap(func() { n.quarantineLoop() })
+	}
+
+	if n.clientEventChan != nil {
+		n.waitGroup.Wrap(func() { n.clientEventsLoop() })
+	}
+
+	for _, topicName := range n.options.ReplicateTopics {
+		r := n.newReplicator(topicName)
+		n.waitGroup.Wrap(func() { r.loop() })
 	}
 }
 
 func (n *NSQD) LoadMetadata() {
-	fn := fmt.Sprintf(path.Join(n.options.DataPath, "nsqd.%d.dat"), n.options.ID)
-	data, err := ioutil.ReadFile(fn)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("ERROR: failed to read channel metadata from %s - %s", fn, err.Error())
-		}
+	js := n.readMetadata()
+	if js == nil {
 		return
 	}
 
-	js, err := simplejson.NewJson(data)
-	if err != nil {
-		log.Printf("ERROR: failed to parse metadata - %s", err.Error())
-		return
+	aliases, _ := js.Get("aliases").Map()
+	for alias := range aliases {
+		topicNames, err := js.Get("aliases").Get(alias).StringArray()
+		if err != nil {
+			log.Printf("ERROR: failed to parse metadata - %s", err.Error())
+			return
+		}
+		n.aliasMap[alias] = topicNames
+	}
+
+	shards, _ := js.Get("shards").Map()
+	for topicName := range shards {
+		count, err := js.Get("shards").Get(topicName).Int()
+		if err != nil {
+			log.Printf("ERROR: failed to parse metadata - %s", err.Error())
+			return
+		}
+		n.shardMap[topicName] = count
 	}
 
 	topics, err := js.Get("topics").Array()
@@ -161,13 +500,69 @@ func (n *NSQD) LoadMetadata() {
 			log.Printf("WARNING: skipping creation of invalid topic %s", topicName)
 			continue
 		}
-		topic := n.GetTopic(topicName)
+		memQueueSize, err := topicJs.Get("mem_queue_size").Int64()
+		if err != nil {
+			memQueueSize = n.options.MemQueueSize
+		}
+		topic := n.getTopic(topicName, memQueueSize)
 
 		paused, _ := topicJs.Get("paused").Bool()
 		if paused {
 			topic.Pause()
 		}
 
+		publishPausedStr, _ := topicJs.Get("publish_paused").String()
+		if publishPausedStr != "" {
+			if mode, err := parsePublishPauseMode(publishPausedStr); err == nil {
+				topic.PausePublish(mode)
+			}
+		}
+
+		retentionPeriod, _ := topicJs.Get("retention_period").Int64()
+		if retentionPeriod > 0 {
+			topic.SetRetention(time.Duration(retentionPeriod))
+		}
+
+		overflowPolicyStr, _ := topicJs.Get("overflow_policy").String()
+		if policy, err := parseOverflowPolicy(overflowPolicyStr); err == nil && policy != overflowDefault {
+			topic.SetOverflowPolicy(policy)
+		}
+
+		syncPolicyStr, _ := topicJs.Get("sync_policy").String()
+		if policy, err := parseSyncPolicy(syncPolicyStr); err == nil && policy != syncDefault {
+			topic.SetSyncPolicy(policy)
+		}
+
+		largeMessageSize, _ := topicJs.Get("large_message_size").Int64()
+		if largeMessageSize > 0 {
+			largeMessageActionStr, _ := topicJs.Get("large_message_action").String()
+			if action, err := parseLargeMessageAction(largeMessageActionStr); err == nil {
+				topic.SetLargeMessageRule(largeMessageSize, action)
+			}
+		}
+
+		replicaOf, _ := topicJs.Get("replica_of").String()
+		if replicaOf != "" {
+			topic.setReplicaOf(replicaOf)
+		}
+
+		schemaStr, _ := topicJs.Get("schema").String()
+		if schemaStr != "" {
+			schemaModeStr, _ := topicJs.Get("schema_mode").String()
+			mode, _ := parseSchemaMode(schemaModeStr)
+			schema, err := newTopicSchema([]byte(schemaStr), mode)
+			if err != nil {
+				log.Printf("ERROR: failed to load schema for topic %s - %s", topicName, err.Error())
+			} else {
+				topic.SetSchema(schema)
+			}
+		}
+
+		topicAnnotations, _ := topicJs.Get("annotations").Map()
+		if len(topicAnnotations) > 0 {
+			topic.meta.update(stringMap(topicAnnotations))
+		}
+
 		channels, err := topicJs.Get("channels").Array()
 		if err != nil {
 			log.Printf("ERROR: failed to parse metadata - %s", err.Error())
@@ -186,12 +581,88 @@ func (n *NSQD) LoadMetadata() {
 				log.Printf("WARNING: skipping creation of invalid channel %s", channelName)
 				continue
 			}
-			channel := topic.GetChannel(channelName)
+			memQueueSize, err := channelJs.Get("mem_queue_size").Int64()
+			if err != nil {
+				memQueueSize = n.options.MemQueueSize
+			}
+			channel := topic.getChannel(channelName, memQueueSize)
 
 			paused, _ = channelJs.Get("paused").Bool()
 			if paused {
+				quarantinedAt, _ := channelJs.Get("quarantined_at").Int64()
+				channel.setQuarantinedAt(quarantinedAt)
 				channel.Pause()
 			}
+
+			highWatermark, _ := channelJs.Get("high_watermark").Int64()
+			lowWatermark, _ := channelJs.Get("low_watermark").Int64()
+			if highWatermark > 0 {
+				channel.SetWatermarks(highWatermark, lowWatermark)
+			}
+
+			partitions, _ := channelJs.Get("partitions").Int()
+			if partitions > 0 {
+				channel.SetPartitions(partitions)
+			}
+
+			mirrorOf, _ := channelJs.Get("mirror_of").String()
+			if mirrorOf != "" {
+				mirrorMaxRate, _ := channelJs.Get("mirror_max_rate").Int64()
+				channel.setMirror(mirrorOf, mirrorMaxRate)
+			}
+
+			pushConsumers, _ := channelJs.Get("push_consumers").Array()
+			for pi := range pushConsumers {
+				pushJs := channelJs.Get("push_consumers").GetIndex(pi)
+				endpoint, _ := pushJs.Get("url").String()
+				concurrency, _ := pushJs.Get("concurrency").Int64()
+				maxRate, _ := pushJs.Get("max_rate").Int64()
+				if !validPushURL(endpoint) || concurrency < 1 {
+					log.Printf("WARNING: skipping invalid push consumer %s of %s:%s", endpoint, topicName, channelName)
+					continue
+				}
+				channel.addPushConsumer(endpoint, concurrency, maxRate)
+			}
+
+			overflowPolicyStr, _ := channelJs.Get("overflow_policy").String()
+			if policy, err := parseOverflowPolicy(overflowPolicyStr); err == nil && policy != overflowDefault {
+				channel.SetOverflowPolicy(policy)
+			}
+
+			startAt, _ := channelJs.Get("start_at").Int64()
+			if startAt > 0 {
+				channel.SetStartAt(time.Unix(0, startAt))
+			}
+
+			deliveryOrderStr, _ := channelJs.Get("delivery_order").String()
+			if order, err := parseDeliveryOrder(deliveryOrderStr); err == nil && order != deliveryOrderDefault {
+				channel.SetDeliveryOrder(order)
+			}
+
+			deliveryInterval, _ := channelJs.Get("delivery_interval").Int64()
+			if deliveryInterval > 0 {
+				channel.SetDeliveryInterval(time.Duration(deliveryInterval))
+			}
+
+			maxInFlight, _ := channelJs.Get("max_in_flight").Int64()
+			if maxInFlight > 0 {
+				channel.SetMaxInFlight(maxInFlight)
+			}
+
+			slowStart, _ := channelJs.Get("slow_start").Int64()
+			if slowStart > 0 {
+				channel.SetSlowStart(time.Duration(slowStart))
+			}
+
+			maxDepth, _ := channelJs.Get("max_depth").Int64()
+			if maxDepth > 0 {
+				channel.SetMaxDepth(maxDepth)
+			}
+
+			channelAnnotations, _ := channelJs.Get("annotations").Map()
+			if len(channelAnnotations) > 0 {
+				channel.meta.update(stringMap(channelAnnotations))
+			}
 		}
 	}
 }
@@ -199,7 +670,7 @@ func (n *NSQD) LoadMetadata() {
 func (n *NSQD) PersistMetadata() error {
 	// persist metadata about what topics/channels we have
 	// so that upon restart we can get back to the same state
-	fileName := fmt.Sprintf(path.Join(n.options.DataPath, "nsqd.%d.dat"), n.options.ID)
+	fileName := metadataFileName(n.options.DataPath, n.options.ID)
 	log.Printf("NSQ: persisting topic/channel metadata to %s", fileName)
 
 	js := make(map[string]interface{})
@@ -208,6 +679,33 @@ func (n *NSQD) PersistMetadata() error {
 		topicData := make(map[string]interface{})
 		topicData["name"] = topic.name
 		topicData["paused"] = topic.IsPaused()
+		if mode := topic.PublishPaused(); mode != publishPauseNone {
+			topicData["publish_paused"] = mode.String()
+		}
+		topicData["mem_queue_size"] = topic.memQueueSize
+		if period := topic.RetentionPeriod(); period > 0 {
+			topicData["retention_period"] = int64(period)
+		}
+		if policy := topic.OverflowPolicy(); policy != overflowDefault {
+			topicData["overflow_policy"] = policy.String()
+		}
+		if policy := topic.SyncPolicy(); policy != syncDefault {
+			topicData["sync_policy"] = policy.String()
+		}
+		if size, action := topic.LargeMessageRule(); size > 0 {
+			topicData["large_message_size"] = size
+			topicData["large_message_action"] = action.String()
+		}
+		if replicaOf := topic.ReplicaOf(); replicaOf != "" {
+			topicData["replica_of"] = replicaOf
+		}
+		if schema := topic.Schema(); schema != nil {
+			topicData["schema"] = string(schema.source)
+			topicData["schema_mode"] = schema.mode.String()
+		}
+		if annotations := topic.MetaAnnotations(); annotations != nil {
+			topicData["annotations"] = annotations
+		}
 		channels := make([]interface{}, 0)
 		topic.Lock()
 		for _, channel := range topic.channelMap {
@@ -216,6 +714,48 @@ func (n *NSQD) PersistMetadata() error {
 				channelData := make(map[string]interface{})
 				channelData["name"] = channel.name
 				channelData["paused"] = channel.IsPaused()
+				if quarantinedAt := channel.QuarantinedAt(); quarantinedAt > 0 {
+					channelData["quarantined_at"] = quarantinedAt
+				}
+				channelData["mem_queue_size"] = channel.memQueueSize
+				if high, low := channel.Watermarks(); high > 0 {
+					channelData["high_watermark"] = high
+					channelData["low_watermark"] = low
+				}
+				if partitions := channel.Partitions(); partitions > 0 {
+					channelData["partitions"] = partitions
+				}
+				if mirrorOf := channel.MirrorOf(); mirrorOf != "" {
+					channelData["mirror_of"] = mirrorOf
+					channelData["mirror_max_rate"] = channel.MirrorMaxRate()
+				}
+				if pushConsumers := channel.PushConsumers(); len(pushConsumers) > 0 {
+					channelData["push_consumers"] = pushConsumers
+				}
+				if policy := channel.OverflowPolicy(); policy != overflowDefault {
+					channelData["overflow_policy"] = policy.String()
+				}
+				if startAt := channel.StartAt(); !startAt.IsZero() {
+					channelData["start_at"] = startAt.UnixNano()
+				}
+				if order := channel.DeliveryOrder(); order != deliveryOrderDefault {
+					channelData["delivery_order"] = order.String()
+				}
+				if interval := channel.DeliveryInterval(); interval > 0 {
+					channelData["delivery_interval"] = int64(interval)
+				}
+				if maxInFlight := channel.MaxInFlight(); maxInFlight > 0 {
+					channelData["max_in_flight"] = maxInFlight
+				}
+				if window := channel.SlowStart(); window > 0 {
+					channelData["slow_start"] = int64(window)
+				}
+				if maxDepth := channel.MaxDepth(); maxDepth > 0 {
+					channelData["max_depth"] = maxDepth
+				}
+				if annotations := channel.MetaAnnotations(); annotations != nil {
+					channelData["annotations"] = annotations
+				}
 				channels = append(channels, channelData)
 			}
 			channel.Unlock()
@@ -226,41 +766,36 @@ func (n *NSQD) PersistMetadata() error {
 	}
 	js["version"] = util.BINARY_VERSION
 	js["topics"] = topics
+	js["aliases"] = n.aliasMap
+	js["shards"] = n.shardMap
 
 	data, err := json.Marshal(&js)
 	if err != nil {
 		return err
 	}
 
-	tmpFileName := fileName + ".tmp"
-	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
+	return writeMetadataFile(fileName, data)
+}
 
-	_, err = f.Write(data)
-	if err != nil {
-		f.Close()
-		return err
+func (n *NSQD) Exit() {
+	for _, tcpListener := range n.tcpListeners {
+		tcpListener.Close()
 	}
-	f.Sync()
-	f.Close()
 
-	err = os.Rename(tmpFileName, fileName)
-	if err != nil {
-		return err
+	for _, tcpListener := range n.reusePortListeners {
+		tcpListener.Close()
 	}
 
-	return nil
-}
+	for _, httpListener := range n.httpListeners {
+		httpListener.Close()
+	}
 
-func (n *NSQD) Exit() {
-	if n.tcpListener != nil {
-		n.tcpListener.Close()
+	if n.udpConn != nil {
+		n.udpConn.Close()
 	}
 
-	if n.httpListener != nil {
-		n.httpListener.Close()
+	if n.kafkaListener != nil {
+		n.kafkaListener.Close()
 	}
 
 	n.Lock()
@@ -278,18 +813,28 @@ func (n *NSQD) Exit() {
 	// could potentially starve items in process and deadlock)
 	close(n.exitChan)
 	n.waitGroup.Wait()
+
+	// let the successor (if we handed over) know the data path is now its
+	if n.handoverPipe != nil {
+		n.handoverPipe.Close()
+	}
 }
 
 // GetTopic performs a thread safe operation
 // to return a pointer to a Topic object (potentially new)
 func (n *NSQD) GetTopic(topicName string) *Topic {
+	return n.getTopic(topicName, n.options.MemQueueSize)
+}
+
+// getTopic creates the topic (if it does not exist) with the given in-memory queue size
+func (n *NSQD) getTopic(topicName string, memQueueSize int64) *Topic {
 	n.Lock()
 	t, ok := n.topicMap[topicName]
 	if ok {
 		n.Unlock()
 		return t
 	} else {
-		t = NewTopic(topicName, &Context{n})
+		t = NewTopic(topicName, &Context{n}, memQueueSize)
 		n.topicMap[topicName] = t
 
 		log.Printf("TOPIC(%s): created", t.name)
@@ -300,13 +845,29 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 		n.Unlock()
 		// if using lookupd, make a blocking call to get the topics, and immediately create them.
 		// this makes sure that any message received is buffered to the right channels
-		if len(n.lookupPeers) > 0 {
-			channelNames, _ := lookupd.GetLookupdTopicChannels(t.name, n.lookupHttpAddrs())
+		// the topic's cluster-wide configuration is applied first so that it
+		// covers these channels too
+		var cfg *lookupd.TopicConfig
+		if lookupdHTTPAddrs := n.lookupHttpAddrs(); len(lookupdHTTPAddrs) > 0 {
+			var err error
+			cfg, err = lookupd.GetLookupdTopicConfig(t.name, lookupdHTTPAddrs)
+			if err == nil {
+				t.setConfig(cfg)
+			}
+			channelNames, _ := lookupd.GetLookupdTopicChannels(t.name, lookupdHTTPAddrs)
 			for _, channelName := range channelNames {
-				t.getOrCreateChannel(channelName)
+				// these are implicitly created, so the creation policy applies
+				d, err := n.creationPolicy.Check(t.name, channelName, &creationDefaults{
+					memQueueSize: n.options.MemQueueSize,
+				})
+				if err != nil {
+					continue
+				}
+				t.getOrCreateChannel(channelName, d.memQueueSize, nil)
 			}
 		}
 		t.Unlock()
+		t.applyRetentionConfig(cfg)
 
 		// NOTE: I would prefer for this to only happen in topic.GetChannel() but we're special
 		// casing the code above so that we can control the locks such that it is impossible
@@ -318,10 +879,42 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 		case t.channelUpdateChan <- 1:
 		case <-t.exitChan:
 		}
+
+		n.matchWildcardSubs(t)
 	}
 	return t
 }
 
+// oversizeMessage records a publish that was rejected for exceeding
+// --max-msg-size (only against topics that already exist)
+func (n *NSQD) oversizeMessage(topicName string) {
+	topic, err := n.GetExistingTopic(topicName)
+	if err == nil {
+		topic.OversizeMessage()
+	}
+}
+
+// GetSubscribedClient returns the (protocol V2) client with the given ID,
+// only clients subscribed to a channel can be found
+func (n *NSQD) GetSubscribedClient(clientID int64) (*ClientV2, error) {
+	n.RLock()
+	defer n.RUnlock()
+	for _, t := range n.topicMap {
+		t.RLock()
+		for _, c := range t.channelMap {
+			c.RLock()
+			client, ok := c.clients[clientID].(*ClientV2)
+			c.RUnlock()
+			if ok {
+				t.RUnlock()
+				return client, nil
+			}
+		}
+		t.RUnlock()
+	}
+	return nil, errors.New("client does not exist")
+}
+
 // GetExistingTopic gets a topic only if it exists
 func (n *NSQD) GetExistingTopic(topicName string) (*Topic, error) {
 	n.RLock()
@@ -359,10 +952,9 @@ func (n *NSQD) DeleteExistingTopic(topicName string) error {
 }
 
 func (n *NSQD) idPump() {
-	factory := &GUIDFactory{}
 	lastError := time.Now()
 	for {
-		id, err := factory.NewGUID(n.options.ID)
+		id, err := n.idGenerator.NewID()
 		if err != nil {
 			now := time.Now()
 			if now.Sub(lastError) > time.Second {
@@ -374,7 +966,7 @@ func (n *NSQD) idPump() {
 			continue
 		}
 		select {
-		case n.idChan <- id.Hex():
+		case n.idChan <- id:
 		case <-n.exitChan:
 			goto exit
 		}
@@ -4,8 +4,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
-	"path"
 	"strconv"
 	"testing"
 	"time"
@@ -16,18 +17,10 @@ import (
 )
 
 func getMetadata(n *NSQD) (*simplejson.Json, error) {
-	fn := fmt.Sprintf(path.Join(n.options.DataPath, "nsqd.%d.dat"), n.options.ID)
-	data, err := ioutil.ReadFile(fn)
+	fn := metadataFileName(n.options.DataPath, n.options.ID)
+	js, err := readMetadataFile(fn)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("ERROR: failed to read channel metadata from %s - %s", fn, err.Error())
-		}
-		return nil, err
-	}
-
-	js, err := simplejson.NewJson(data)
-	if err != nil {
-		log.Printf("ERROR: failed to parse metadata - %s", err.Error())
+		log.Printf("ERROR: failed to read metadata from %s - %s", fn, err.Error())
 		return nil, err
 	}
 	return js, nil
@@ -44,6 +37,7 @@ func TestStartup(t *testing.T) {
 	options.MemQueueSize = 100
 	options.MaxBytesPerFile = 10240
 	_, _, nsqd := mustStartNSQD(options)
+	dataPath := options.DataPath
 
 	topicName := "nsqd_test" + strconv.Itoa(int(time.Now().Unix()))
 
@@ -105,6 +99,7 @@ func TestStartup(t *testing.T) {
 	options = NewNSQDOptions()
 	options.MemQueueSize = 100
 	options.MaxBytesPerFile = 10240
+	options.DataPath = dataPath
 	_, _, nsqd = mustStartNSQD(options)
 
 	go func() {
@@ -217,3 +212,34 @@ func TestPauseMetadata(t *testing.T) {
 	b, _ = metadataForChannel(nsqd, 0, 0).Get("paused").Bool()
 	assert.Equal(t, b, false)
 }
+
+func TestMultipleListenAddresses(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.DataPath = mustTempDataPath()
+	options.TCPAddresses = []string{"127.0.0.1:0", "127.0.0.1:0"}
+	options.HTTPAddresses = []string{"127.0.0.1:0", "127.0.0.1:0"}
+	nsqd := NewNSQD(options)
+	nsqd.Main()
+	defer nsqd.Exit()
+
+	assert.Equal(t, len(nsqd.tcpListeners), 2)
+	assert.Equal(t, len(nsqd.httpListeners), 2)
+	assert.Equal(t, nsqd.tcpAddr.String(), nsqd.tcpListeners[0].Addr().String())
+
+	for _, l := range nsqd.tcpListeners {
+		conn, err := mustConnectNSQD(l.Addr().(*net.TCPAddr))
+		assert.Equal(t, err, nil)
+		identify(t, conn, nil, nsq.FrameTypeResponse)
+		conn.Close()
+	}
+
+	for _, l := range nsqd.httpListeners {
+		resp, err := http.Get(fmt.Sprintf("http://%s/ping", l.Addr()))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, resp.StatusCode, 200)
+		resp.Body.Close()
+	}
+}
@@ -11,38 +11,169 @@ import (
 
 type nsqdOptions struct {
 	// basic options
+	Verbose                bool     `flag:"verbose"`
 	ID                     int64    `flag:"worker-id" cfg:"id"`
-	TCPAddress             string   `flag:"tcp-address"`
-	HTTPAddress            string   `flag:"http-address"`
+	TCPAddresses           []string `flag:"tcp-address" cfg:"tcp_addresses"`
+	HTTPAddresses          []string `flag:"http-address" cfg:"http_addresses"`
 	BroadcastAddress       string   `flag:"broadcast-address"`
+	BroadcastAddresses     []string `flag:"extra-broadcast-address" cfg:"extra_broadcast_addresses"`
 	NSQLookupdTCPAddresses []string `flag:"lookupd-tcp-address" cfg:"nsqlookupd_tcp_addresses"`
+	Labels                 []string `flag:"label" cfg:"labels"`
+
+	// lookupds registered with over HTTP(S) (see lookup_http.go)
+	NSQLookupdHTTPAddresses []string `flag:"lookupd-http-address" cfg:"nsqlookupd_http_addresses"`
+
+	// message IDs (see id_generator.go)
+	IDGenerator          string `flag:"id-generator"`
+	WorkerIDLease        bool   `flag:"worker-id-lease"`
+	IDSequencerURL       string `flag:"id-sequencer-url"`
+	IDSequencerBlockSize int64  `flag:"id-sequencer-block-size"`
+
+	// fire-and-forget publishing (see udp.go)
+	UDPAddress string `flag:"udp-address"`
+
+	// Kafka produce protocol bridge (see kafka.go)
+	KafkaAddress string `flag:"kafka-address"`
+
+	// multiple SO_REUSEPORT acceptors per TCP address
+	TCPReusePort bool `flag:"tcp-reuseport"`
+	TCPAcceptors int  `flag:"tcp-acceptors"`
 
 	// diskqueue options
-	DataPath        string        `flag:"data-path"`
-	MemQueueSize    int64         `flag:"mem-queue-size"`
-	MaxBytesPerFile int64         `flag:"max-bytes-per-file"`
-	SyncEvery       int64         `flag:"sync-every"`
-	SyncTimeout     time.Duration `flag:"sync-timeout"`
+	DataPath               string        `flag:"data-path"`
+	MemQueueSize           int64         `flag:"mem-queue-size"`
+	MemQueueOverflowPolicy string        `flag:"mem-queue-overflow-policy"`
+	MaxBytesPerFile        int64         `flag:"max-bytes-per-file"`
+	SyncEvery              int64         `flag:"sync-every"`
+	SyncTimeout            time.Duration `flag:"sync-timeout"`
+	WriteBatchWindow       time.Duration `flag:"write-batch-window"`
+
+	// startup check (and repair) of the diskqueues (see data_path_check.go)
+	CheckDataPath string `flag:"check-data-path"`
+
+	// load the previous generation of corrupt metadata (see metadata_file.go)
+	RecoverMetadata bool `flag:"recover-metadata"`
+
+	// disk space watchdog
+	MinFreeDiskBytes  int64         `flag:"min-free-disk-bytes"`
+	DiskCheckInterval time.Duration `flag:"disk-check-interval"`
+
+	// implicit topic/channel creation policy
+	CreationPolicyFile  string        `flag:"creation-policy-file"`
+	CreationHookURL     string        `flag:"creation-hook-url"`
+	CreationHookTimeout time.Duration `flag:"creation-hook-timeout"`
+
+	// parallel copying of messages to a topic's channels (see topic_fanout.go)
+	TopicFanoutThreshold int `flag:"topic-fanout-threshold"`
+	TopicFanoutWorkers   int `flag:"topic-fanout-workers"`
+
+	// in-place upgrade (listener handover)
+	HandoverDrainTimeout time.Duration `flag:"handover-drain-timeout"`
+
+	// decommission (/drain)
+	DrainTimeout time.Duration `flag:"drain-timeout"`
+
+	// retry-safe HTTP publishing (see request_id.go)
+	PublishRequestIDTTL time.Duration `flag:"publish-request-id-ttl"`
+
+	// cross-cluster replication (see replication.go)
+	Cluster         string   `flag:"cluster"`
+	ReplicateTopics []string `flag:"replicate-topic" cfg:"replicate_topics"`
+	ReplicateTo     []string `flag:"replicate-to" cfg:"replicate_to"`
+
+	// message transformation (see middleware.go)
+	Middleware []string `flag:"middleware" cfg:"middleware"`
+
+	// per topic encryption at rest
+	EncryptionKeyFile string `flag:"encryption-key-file"`
+	EncryptionKeyURL  string `flag:"encryption-key-url"`
 
 	// msg and command options
 	MsgTimeout    time.Duration `flag:"msg-timeout" arg:"1ms"`
 	MaxMsgTimeout time.Duration `flag:"max-msg-timeout"`
+	MaxReqTimeout time.Duration `flag:"max-req-timeout"`
 	MaxMsgSize    int64         `flag:"max-msg-size" deprecated:"max-message-size" cfg:"max_msg_size"`
 	MaxBodySize   int64         `flag:"max-body-size"`
 	ClientTimeout time.Duration
 
+	// how old a published timestamp can be (see publish_timestamp.go)
+	MaxPublishTimestampAge time.Duration `flag:"max-publish-timestamp-age"`
+
+	// messages bigger than --max-msg-size for clients that negotiate chunked_messages
+	MaxChunkedMsgSize int64 `flag:"max-chunked-msg-size"`
+
+	// delivery attempt ceiling
+	MaxAttempts           int    `flag:"max-attempts"`
+	AttemptsOverflowTopic string `flag:"attempts-overflow-topic"`
+
+	// stuck (repeatedly timed out) message detection
+	StuckMessageTimeouts int `flag:"stuck-message-timeouts"`
+
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
+	MaxHeartbeatRTT        time.Duration `flag:"max-heartbeat-rtt"`
+	TCPKeepAliveInterval   time.Duration `flag:"tcp-keepalive-interval"`
+	IdleClientTimeout      time.Duration `flag:"idle-client-timeout"`
+	SlowConsumerFlushes    int           `flag:"slow-consumer-flushes"`
+	SlowConsumerDisconnect bool          `flag:"slow-consumer-disconnect"`
 	MaxRdyCount            int64         `flag:"max-rdy-count"`
 	MaxOutputBufferSize    int64         `flag:"max-output-buffer-size"`
 	MaxOutputBufferTimeout time.Duration `flag:"max-output-buffer-timeout"`
 
+	// output buffer timeout tuning (see output_buffer_tuning.go)
+	OutputBufferTimeoutAdaptive bool          `flag:"output-buffer-timeout-adaptive"`
+	MinOutputBufferTimeout      time.Duration `flag:"min-output-buffer-timeout"`
+
+	// client write deadline and heartbeat miss tolerance (see client_timeouts.go)
+	ClientWriteTimeout        time.Duration `flag:"client-write-timeout"`
+	MaxClientWriteTimeout     time.Duration `flag:"max-client-write-timeout"`
+	HeartbeatMissTolerance    int           `flag:"heartbeat-miss-tolerance"`
+	MaxHeartbeatMissTolerance int           `flag:"max-heartbeat-miss-tolerance"`
+
+	// multiplexed subscriptions
+	MaxSubscriptionsPerClient int64 `flag:"max-subscriptions-per-client"`
+
+	// SUBs to topic patterns (see wildcard_sub.go)
+	WildcardSubToken string `flag:"wildcard-sub-token"`
+
+	// message batching
+	MaxBatchCount int64 `flag:"max-batch-count"`
+	MaxBatchBytes int64 `flag:"max-batch-bytes"`
+
+	// RDY redistribution hints
+	RdyHintDepth    int64         `flag:"rdy-hint-depth"`
+	RdyHintInterval time.Duration `flag:"rdy-hint-interval"`
+
+	// server-side backoff signaling
+	BackoffFailurePercent int           `flag:"backoff-failure-percent"`
+	BackoffMinSamples     int64         `flag:"backoff-min-samples"`
+	BackoffWindow         time.Duration `flag:"backoff-window"`
+	BackoffDuration       time.Duration `flag:"backoff-duration"`
+
 	// statsd integration
 	StatsdAddress  string        `flag:"statsd-address"`
 	StatsdPrefix   string        `flag:"statsd-prefix"`
 	StatsdInterval time.Duration `flag:"statsd-interval" arg:"1s"`
 	StatsdMemStats bool          `flag:"statsd-mem-stats"`
 
+	// stats snapshots for /stats?history=true
+	StatsHistoryInterval time.Duration `flag:"stats-history-interval"`
+	StatsHistorySize     int           `flag:"stats-history-size"`
+
+	// channel depth webhook
+	DepthWebhookURL      string        `flag:"depth-webhook-url"`
+	DepthWebhookDebounce time.Duration `flag:"depth-webhook-debounce"`
+
+	// requeue storm quarantine (see quarantine.go)
+	QuarantineRequeuePercent int           `flag:"quarantine-requeue-percent"`
+	QuarantineWindow         time.Duration `flag:"quarantine-window"`
+	QuarantineMinMessages    int64         `flag:"quarantine-min-messages"`
+	QuarantineWebhookURL     string        `flag:"quarantine-webhook-url"`
+
+	// client connect/identify/sub/disconnect events
+	ClientEventsWebhookURL string `flag:"client-events-webhook-url"`
+	ClientEventsTopic      string `flag:"client-events-topic"`
+
 	// e2e message latency
 	E2EProcessingLatencyWindowTime  time.Duration `flag:"e2e-processing-latency-window-time"`
 	E2EProcessingLatencyPercentiles []float64     `flag:"e2e-processing-latency-percentile" cfg:"e2e_processing_latency_percentiles"`
@@ -55,6 +186,13 @@ type nsqdOptions struct {
 	DeflateEnabled  bool `flag:"deflate"`
 	MaxDeflateLevel int  `flag:"max-deflate-level"`
 	SnappyEnabled   bool `flag:"snappy"`
+
+	// runtime diagnostics (/debug/...)
+	HTTPDebug          bool   `flag:"http-debug"`
+	HTTPDebugAuthToken string `flag:"http-debug-auth-token"`
+
+	// fault injection for testing (see chaos.go)
+	Chaos bool `flag:"chaos"`
 }
 
 func NewNSQDOptions() *nsqdOptions {
@@ -64,30 +202,80 @@ func NewNSQDOptions() *nsqdOptions {
 	}
 
 	o := &nsqdOptions{
-		TCPAddress:       "0.0.0.0:4150",
-		HTTPAddress:      "0.0.0.0:4151",
+		TCPAddresses:     []string{"0.0.0.0:4150"},
+		HTTPAddresses:    []string{"0.0.0.0:4151"},
 		BroadcastAddress: hostname,
 
-		MemQueueSize:    10000,
-		MaxBytesPerFile: 104857600,
-		SyncEvery:       2500,
-		SyncTimeout:     2 * time.Second,
+		IDGenerator:          idGeneratorSnowflake,
+		IDSequencerBlockSize: 10000,
+
+		MemQueueSize:           10000,
+		MemQueueOverflowPolicy: "spill",
+		MaxBytesPerFile:        104857600,
+		SyncEvery:              2500,
+		SyncTimeout:            2 * time.Second,
+
+		DiskCheckInterval: 5 * time.Second,
+
+		CreationHookTimeout: 2 * time.Second,
+
+		TopicFanoutThreshold: 32,
+
+		HandoverDrainTimeout: 10 * time.Second,
+
+		DrainTimeout: 10 * time.Minute,
+
+		PublishRequestIDTTL: 5 * time.Minute,
+
+		StuckMessageTimeouts: 3,
 
 		MsgTimeout:    60 * time.Second,
 		MaxMsgTimeout: 15 * time.Minute,
+		MaxReqTimeout: time.Hour,
 		MaxMsgSize:    1024768,
 		MaxBodySize:   5 * 1024768,
 		ClientTimeout: 60 * time.Second,
 
+		MaxPublishTimestampAge: 30 * 24 * time.Hour,
+
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
 		MaxOutputBufferSize:    64 * 1024,
 		MaxOutputBufferTimeout: 1 * time.Second,
+		SlowConsumerFlushes:    5,
+
+		MinOutputBufferTimeout: 5 * time.Millisecond,
+
+		ClientWriteTimeout:        time.Second,
+		MaxClientWriteTimeout:     30 * time.Second,
+		HeartbeatMissTolerance:    2,
+		MaxHeartbeatMissTolerance: 10,
+
+		MaxSubscriptionsPerClient: 128,
+
+		MaxBatchCount: 100,
+		MaxBatchBytes: 64 * 1024,
+
+		RdyHintDepth:    1000,
+		RdyHintInterval: 5 * time.Second,
+
+		BackoffFailurePercent: 50,
+		BackoffMinSamples:     10,
+		BackoffWindow:         5 * time.Second,
+		BackoffDuration:       10 * time.Second,
 
 		StatsdPrefix:   "nsq.%s",
 		StatsdInterval: 60 * time.Second,
 		StatsdMemStats: true,
 
+		StatsHistoryInterval: 60 * time.Second,
+		StatsHistorySize:     10,
+
+		DepthWebhookDebounce: 30 * time.Second,
+
+		QuarantineWindow:      60 * time.Second,
+		QuarantineMinMessages: 100,
+
 		E2EProcessingLatencyWindowTime: time.Duration(10 * time.Minute),
 
 		DeflateEnabled:  true,
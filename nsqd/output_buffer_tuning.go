@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+)
+
+// with --output-buffer-timeout-adaptive a client's output buffer timeout (how
+// long what's buffered for it waits to be flushed) is tuned to how much it's
+// sent... a client whose flushes only carry a message or so is waited on for
+// nothing, its timeout is halved (down to --min-output-buffer-timeout) to
+// deliver sooner, a client whose flushes carry many is worth batching more,
+// its timeout is doubled (up to --max-output-buffer-timeout) to flush less
+//
+// the timeout the client asked for (or the default) is where tuning starts,
+// clients that disabled output buffering (or multiplex) aren't tuned
+
+// how often a client's output buffer timeout is tuned
+const outputBufferTuneInterval = time.Second
+
+// the messages per flush at (or under) which the timeout is halved and at (or
+// over) which it's doubled
+const (
+	outputBufferTuneLowMessages  = 1
+	outputBufferTuneHighMessages = 16
+)
+
+type outputBufferTuner struct {
+	min      time.Duration
+	max      time.Duration
+	timeout  time.Duration
+	messages int
+	flushes  int
+}
+
+func newOutputBufferTuner(timeout time.Duration, min time.Duration, max time.Duration) *outputBufferTuner {
+	t := &outputBufferTuner{min: min, max: max}
+	t.timeout = t.clamp(timeout)
+	return t
+}
+
+func (t *outputBufferTuner) clamp(timeout time.Duration) time.Duration {
+	if timeout < t.min {
+		return t.min
+	}
+	if timeout > t.max {
+		return t.max
+	}
+	return timeout
+}
+
+// sent records that a message was buffered for the client
+func (t *outputBufferTuner) sent() {
+	t.messages++
+}
+
+// flushed records a flush of what was buffered
+func (t *outputBufferTuner) flushed() {
+	t.flushes++
+}
+
+// tune returns the timeout for the next interval, and whether it changed,
+// given the messages and flushes of the last one
+func (t *outputBufferTuner) tune() (time.Duration, bool) {
+	messages, flushes := t.messages, t.flushes
+	t.messages, t.flushes = 0, 0
+
+	timeout := t.timeout
+	switch {
+	case messages == 0:
+		// idle, there's nothing to go on
+	case flushes == 0 || messages/flushes >= outputBufferTuneHighMessages:
+		// (without flushes the buffer filled up, and was written, by itself)
+		timeout = t.clamp(timeout * 2)
+	case messages/flushes <= outputBufferTuneLowMessages:
+		timeout = t.clamp(timeout / 2)
+	}
+
+	changed := timeout != t.timeout
+	t.timeout = timeout
+	return timeout, changed
+}
+
+// clientOutputBufferTuner returns a tuner starting at timeout, nil when tuning is
+// disabled or so is output buffering
+func (p *ProtocolV2) clientOutputBufferTuner(timeout time.Duration) *outputBufferTuner {
+	options := p.context.nsqd.options
+	if !options.OutputBufferTimeoutAdaptive || timeout <= 0 {
+		return nil
+	}
+	return newOutputBufferTuner(timeout, options.MinOutputBufferTimeout, options.MaxOutputBufferTimeout)
+}
+
+// SetTunedOutputBufferTimeout records the client's tuned output buffer timeout
+func (c *ClientV2) SetTunedOutputBufferTimeout(timeout time.Duration) {
+	c.Lock()
+	c.OutputBufferTimeout = timeout
+	c.Unlock()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestOutputBufferTuner(t *testing.T) {
+	tuner := newOutputBufferTuner(250*time.Millisecond, 5*time.Millisecond, time.Second)
+
+	// idle
+	timeout, changed := tuner.tune()
+	assert.Equal(t, changed, false)
+	assert.Equal(t, timeout, 250*time.Millisecond)
+
+	// a message per flush
+	for i := 0; i < 10; i++ {
+		tuner.sent()
+		tuner.flushed()
+	}
+	timeout, changed = tuner.tune()
+	assert.Equal(t, changed, true)
+	assert.Equal(t, timeout, 125*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		tuner.sent()
+		tuner.flushed()
+		tuner.tune()
+	}
+	assert.Equal(t, tuner.timeout, 5*time.Millisecond)
+
+	// many messages per flush
+	for i := 0; i < 100; i++ {
+		tuner.sent()
+	}
+	tuner.flushed()
+	timeout, changed = tuner.tune()
+	assert.Equal(t, changed, true)
+	assert.Equal(t, timeout, 10*time.Millisecond)
+
+	// in between
+	for i := 0; i < 4; i++ {
+		tuner.sent()
+	}
+	tuner.flushed()
+	_, changed = tuner.tune()
+	assert.Equal(t, changed, false)
+
+	for i := 0; i < 10; i++ {
+		tuner.sent()
+		tuner.tune()
+	}
+	assert.Equal(t, tuner.timeout, time.Second)
+
+	// starts within the bounds
+	tuner = newOutputBufferTuner(time.Millisecond, 5*time.Millisecond, time.Second)
+	assert.Equal(t, tuner.timeout, 5*time.Millisecond)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/bitly/go-nsq"
+)
+
+// overflowPolicy decides what happens to a message routed to a topic or
+// channel whose in-memory queue is full
+type overflowPolicy int32
+
+const (
+	// use the nsqd wide --mem-queue-overflow-policy
+	overflowDefault overflowPolicy = iota
+	// write the message to the backend (disk) queue
+	overflowSpill
+	// wait for room, which pushes back on publishers
+	overflowBlock
+	// discard the oldest message in memory to make room
+	overflowDropOldest
+)
+
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	switch s {
+	case "", "default":
+		return overflowDefault, nil
+	case "spill":
+		return overflowSpill, nil
+	case "block":
+		return overflowBlock, nil
+	case "drop-oldest":
+		return overflowDropOldest, nil
+	}
+	return overflowDefault, fmt.Errorf("invalid overflow policy %q", s)
+}
+
+func (p overflowPolicy) String() string {
+	switch p {
+	case overflowSpill:
+		return "spill"
+	case overflowBlock:
+		return "block"
+	case overflowDropOldest:
+		return "drop-oldest"
+	}
+	return "default"
+}
+
+// putMemory puts msg in memoryMsgChan following policy, it returns false when
+// the message should be written to the backend instead
+//
+// blocking gives up (and spills) once exitChan is closed so that an exiting
+// topic or channel still persists what it was handed
+func putMemory(memoryMsgChan chan *nsq.Message, msg *nsq.Message, policy overflowPolicy,
+	exitChan chan int, droppedCount *uint64) bool {
+	select {
+	case memoryMsgChan <- msg:
+		return true
+	default:
+	}
+
+	switch policy {
+	case overflowBlock:
+		select {
+		case memoryMsgChan <- msg:
+			return true
+		case <-exitChan:
+		}
+	case overflowDropOldest:
+		if cap(memoryMsgChan) == 0 {
+			break
+		}
+		for {
+			select {
+			case memoryMsgChan <- msg:
+				return true
+			default:
+			}
+			select {
+			case dropped := <-memoryMsgChan:
+				atomic.AddUint64(droppedCount, 1)
+				log.Printf("WARNING: mem queue full, dropping oldest msg(%s)", dropped.Id)
+			default:
+			}
+		}
+	}
+	return false
+}
+
+func (n *NSQD) resolveOverflowPolicy(p overflowPolicy) overflowPolicy {
+	if p == overflowDefault {
+		return n.overflowPolicy
+	}
+	return p
+}
+
+// SetOverflowPolicy sets what happens to messages published once the topic's
+// in-memory queue is full (overflowDefault reverts to the nsqd wide policy)
+func (t *Topic) SetOverflowPolicy(p overflowPolicy) error {
+	atomic.StoreInt32(&t.overflowPolicy, int32(p))
+	log.Printf("TOPIC(%s): overflow policy %s", t.name, p)
+
+	t.context.nsqd.Lock()
+	defer t.context.nsqd.Unlock()
+	return t.context.nsqd.PersistMetadata()
+}
+
+// OverflowPolicy returns the policy explicitly set on the topic, if any
+func (t *Topic) OverflowPolicy() overflowPolicy {
+	return overflowPolicy(atomic.LoadInt32(&t.overflowPolicy))
+}
+
+// SetOverflowPolicy sets what happens to messages routed to the channel once
+// its in-memory queue is full (overflowDefault reverts to the nsqd wide policy)
+func (c *Channel) SetOverflowPolicy(p overflowPolicy) error {
+	atomic.StoreInt32(&c.overflowPolicy, int32(p))
+	log.Printf("CHANNEL(%s): overflow policy %s", c.name, p)
+
+	c.context.nsqd.Lock()
+	defer c.context.nsqd.Unlock()
+	return c.context.nsqd.PersistMetadata()
+}
+
+// OverflowPolicy returns the policy explicitly set on the channel, if any
+func (c *Channel) OverflowPolicy() overflowPolicy {
+	return overflowPolicy(atomic.LoadInt32(&c.overflowPolicy))
+}
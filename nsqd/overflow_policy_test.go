@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func waitForTopicDepth(topic *Topic, depth int64) int64 {
+	for i := 0; i < 100; i++ {
+		if topic.Depth() == depth {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return topic.Depth()
+}
+
+func TestOverflowPolicySpill(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	// without channels nothing is read from the topic's mem queue
+	topicName := "test_overflow_spill" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.getTopic(topicName, 2)
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+
+	assert.Equal(t, waitForTopicDepth(topic, 5), int64(5))
+	assert.Equal(t, len(topic.memoryMsgChan), 2)
+	assert.Equal(t, topic.backend.Depth(), int64(3))
+	assert.Equal(t, NewTopicStats(topic, nil).OverflowPolicy, "spill")
+}
+
+func TestOverflowPolicyDropOldest(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_overflow_drop" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.getTopic(topicName, 2)
+
+	url := fmt.Sprintf("http://%s/set_topic_overflow_policy?topic=%s&policy=drop-oldest", httpAddr, topicName)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, topic.OverflowPolicy(), overflowDropOldest)
+
+	metadata, _ := getMetadata(nsqd)
+	topicJs := metadata.Get("topics").GetIndex(0)
+	assert.Equal(t, topicJs.Get("overflow_policy").MustString(), "drop-oldest")
+
+	var ids []nsq.MessageID
+	for i := 0; i < 5; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+		ids = append(ids, msg.Id)
+		topic.PutMessage(msg)
+	}
+
+	for i := 0; atomic.LoadUint64(&topic.droppedCount) < 3 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, atomic.LoadUint64(&topic.droppedCount), uint64(3))
+	assert.Equal(t, topic.backend.Depth(), int64(0))
+	// the newest are kept
+	assert.Equal(t, (<-topic.memoryMsgChan).Id, ids[3])
+	assert.Equal(t, (<-topic.memoryMsgChan).Id, ids[4])
+
+	url = fmt.Sprintf("http://%s/set_topic_overflow_policy?topic=%s&policy=bogus", httpAddr, topicName)
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+}
+
+func TestOverflowPolicyBlock(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.MemQueueOverflowPolicy = "block"
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_overflow_block" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.getTopic(topicName, 2)
+
+	var published int32
+	go func() {
+		for i := 0; i < 5; i++ {
+			topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+			atomic.AddInt32(&published, 1)
+		}
+	}()
+
+	// 2 in memory, 1 held by the router and 1 buffered in incomingMsgChan
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, atomic.LoadInt32(&published), int32(4))
+	assert.Equal(t, len(topic.memoryMsgChan), 2)
+	assert.Equal(t, topic.backend.Depth(), int64(0))
+
+	for i := 0; i < 3; i++ {
+		<-topic.memoryMsgChan
+	}
+	for i := 0; atomic.LoadInt32(&published) < 5 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, atomic.LoadInt32(&published), int32(5))
+	assert.Equal(t, waitForTopicDepth(topic, 2), int64(2))
+	assert.Equal(t, topic.backend.Depth(), int64(0))
+}
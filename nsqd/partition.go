@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"log"
+	"sort"
+
+	"github.com/bitly/go-nsq"
+)
+
+// messages published with a key carry (a hash of) it in their ID, in place of
+// the worker id bits, so that it survives a trip through the backend... IDs
+// only need to be unique per nsqd and the (otherwise unused) top bit keeps
+// them from colliding with unkeyed IDs
+const (
+	keyedMessageFlag   = uint64(1) << 63
+	messageKeyHashMask = uint64(1)<<workerIdBits - 1
+
+	// a channel can't have more partitions than there are key hashes
+	maxPartitions = 1 << workerIdBits
+)
+
+func messageIDToUint64(id nsq.MessageID) uint64 {
+	var b [8]byte
+	hex.Decode(b[:], id[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// keyedMessageID returns id with key's hash embedded in it
+func keyedMessageID(id nsq.MessageID, key []byte) nsq.MessageID {
+	h := fnv.New32a()
+	h.Write(key)
+	g := messageIDToUint64(id) &^ (messageKeyHashMask << workerIdShift)
+	g |= keyedMessageFlag | (uint64(h.Sum32())&messageKeyHashMask)<<workerIdShift
+	return GUID(g).Hex()
+}
+
+// messageKeyHash returns the key hash embedded in id and whether there is one
+func messageKeyHash(id nsq.MessageID) (uint32, bool) {
+	g := messageIDToUint64(id)
+	if g&keyedMessageFlag == 0 {
+		return 0, false
+	}
+	return uint32((g >> workerIdShift) & messageKeyHashMask), true
+}
+
+// copyMessageKey embeds the key hash of from (if any) into id, this is used
+// wherever a message is copied with a new ID (ie. aliases)
+func copyMessageKey(id nsq.MessageID, from nsq.MessageID) nsq.MessageID {
+	g := messageIDToUint64(from)
+	if g&keyedMessageFlag == 0 {
+		return id
+	}
+	mask := keyedMessageFlag | messageKeyHashMask<<workerIdShift
+	return GUID((messageIDToUint64(id) &^ mask) | (g & mask)).Hex()
+}
+
+// SetPartitions enables partitioned delivery, keyed messages are hashed to
+// one of n partitions and each partition is assigned to a single consumer
+// (ordering is preserved per key as long as consumers have RDY 1)
+//
+// assignment is sticky (rendezvous hashing), when consumers come and go only
+// the partitions that have to move do... a value of 0 disables partitioning
+//
+// NOTE: a consumer that isn't ready blocks delivery of the whole channel
+// while it holds the next message
+func (c *Channel) SetPartitions(n int) error {
+	if n < 0 || n > maxPartitions {
+		return errors.New("invalid number of partitions")
+	}
+
+	c.partitionMutex.Lock()
+	c.partitions = n
+	c.updatePartitionTable()
+	c.partitionMutex.Unlock()
+
+	log.Printf("CHANNEL(%s:%s): %d partitions", c.topicName, c.name, n)
+
+	c.context.nsqd.Lock()
+	defer c.context.nsqd.Unlock()
+	return c.context.nsqd.PersistMetadata()
+}
+
+func (c *Channel) Partitions() int {
+	c.partitionMutex.RLock()
+	defer c.partitionMutex.RUnlock()
+	return c.partitions
+}
+
+// AddPartitionConsumer registers a client to be assigned partitions, keyed
+// messages for those partitions are sent to the returned go channel (rather
+// than clientMsgChan)
+func (c *Channel) AddPartitionConsumer(clientID int64) chan *nsq.Message {
+	c.partitionMutex.Lock()
+	defer c.partitionMutex.Unlock()
+
+	msgChan, ok := c.partitionConsumers[clientID]
+	if !ok {
+		msgChan = make(chan *nsq.Message)
+		c.partitionConsumers[clientID] = msgChan
+		c.updatePartitionTable()
+	}
+	return msgChan
+}
+
+func (c *Channel) RemovePartitionConsumer(clientID int64) {
+	c.partitionMutex.Lock()
+	defer c.partitionMutex.Unlock()
+
+	_, ok := c.partitionConsumers[clientID]
+	if !ok {
+		return
+	}
+	delete(c.partitionConsumers, clientID)
+	c.updatePartitionTable()
+}
+
+// updatePartitionTable re-assigns partitions to consumers and wakes up a
+// messagePump waiting on the previous assignment,
+// this expects the caller to handle locking
+func (c *Channel) updatePartitionTable() {
+	close(c.partitionUpdateChan)
+	c.partitionUpdateChan = make(chan int)
+
+	if c.partitions == 0 || len(c.partitionConsumers) == 0 {
+		c.partitionTable = nil
+		return
+	}
+
+	clientIDs := make([]int64, 0, len(c.partitionConsumers))
+	for clientID := range c.partitionConsumers {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Sort(Int64Slice(clientIDs))
+
+	c.partitionTable = make([]chan *nsq.Message, c.partitions)
+	for p := range c.partitionTable {
+		var best int64
+		var bestWeight uint32
+		for i, clientID := range clientIDs {
+			weight := partitionWeight(p, clientID)
+			if i == 0 || weight > bestWeight {
+				best = clientID
+				bestWeight = weight
+			}
+		}
+		c.partitionTable[p] = c.partitionConsumers[best]
+	}
+}
+
+func partitionWeight(partition int, clientID int64) uint32 {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(partition))
+	binary.BigEndian.PutUint64(b[4:], uint64(clientID))
+	h := fnv.New32a()
+	h.Write(b[:])
+	return h.Sum32()
+}
+
+// deliver hands msg to a client, on a partitioned channel a keyed message
+// waits for the consumer its partition is assigned to
+func (c *Channel) deliver(msg *nsq.Message) {
+	hash, keyed := messageKeyHash(msg.Id)
+	for {
+		c.partitionMutex.RLock()
+		table := c.partitionTable
+		updateChan := c.partitionUpdateChan
+		c.partitionMutex.RUnlock()
+
+		if !keyed || table == nil {
+			select {
+			case c.clientMsgChan <- msg:
+				return
+			case <-updateChan:
+				continue
+			}
+		}
+
+		select {
+		case table[int(hash)%len(table)] <- msg:
+			return
+		case <-updateChan:
+		case <-c.exitChan:
+			// flush() drains clientMsgChan until we close it
+			c.clientMsgChan <- msg
+			return
+		}
+	}
+}
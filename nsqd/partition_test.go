@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestKeyedMessageID(t *testing.T) {
+	factory := &GUIDFactory{}
+	guid, _ := factory.NewGUID(123)
+	id := guid.Hex()
+
+	_, keyed := messageKeyHash(id)
+	assert.Equal(t, keyed, false)
+
+	keyedID := keyedMessageID(id, []byte("user_1"))
+	assert.NotEqual(t, keyedID, id)
+	hash, keyed := messageKeyHash(keyedID)
+	assert.Equal(t, keyed, true)
+
+	// the same key always hashes the same, regardless of ID
+	guid2, _ := factory.NewGUID(123)
+	hash2, _ := messageKeyHash(keyedMessageID(guid2.Hex(), []byte("user_1")))
+	assert.Equal(t, hash2, hash)
+
+	copiedID := copyMessageKey(guid2.Hex(), keyedID)
+	hash3, keyed := messageKeyHash(copiedID)
+	assert.Equal(t, keyed, true)
+	assert.Equal(t, hash3, hash)
+	assert.Equal(t, copyMessageKey(guid2.Hex(), id), guid2.Hex())
+}
+
+func TestPartitionedDelivery(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_partitions" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	err := channel.SetPartitions(16)
+	assert.Equal(t, err, nil)
+
+	numMessages := 100
+	var mutex sync.Mutex
+	received := make(map[string][]int)
+	keysByConn := make(map[int]map[string]bool)
+	var wg sync.WaitGroup
+	var total int32
+
+	conns := make([]net.Conn, 2)
+	for i := range conns {
+		conn, err := mustConnectNSQD(tcpAddr)
+		assert.Equal(t, err, nil)
+		defer conn.Close()
+		identify(t, conn, nil, nsq.FrameTypeResponse)
+		sub(t, conn, topicName, "ch")
+		err = nsq.Ready(numMessages).Write(conn)
+		assert.Equal(t, err, nil)
+		conns[i] = conn
+		keysByConn[i] = make(map[string]bool)
+	}
+
+	// wait for both clients' messagePumps to be assigned partitions
+	for i := 0; i < 100; i++ {
+		channel.partitionMutex.RLock()
+		n := len(channel.partitionConsumers)
+		channel.partitionMutex.RUnlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+			for {
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				resp, err := nsq.ReadResponse(conn)
+				if err != nil {
+					return
+				}
+				frameType, data, _ := nsq.UnpackResponse(resp)
+				if frameType != nsq.FrameTypeMessage {
+					continue
+				}
+				msg, _ := nsq.DecodeMessage(data)
+				var key string
+				var seq int
+				fmt.Sscanf(string(msg.Body), "%s %d", &key, &seq)
+
+				mutex.Lock()
+				received[key] = append(received[key], seq)
+				keysByConn[i][key] = true
+				total++
+				done := int(total) == numMessages
+				mutex.Unlock()
+				if done {
+					return
+				}
+			}
+		}(i, conn)
+	}
+
+	for i := 0; i < numMessages; i++ {
+		key := fmt.Sprintf("user_%d", i%10)
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte(fmt.Sprintf("%s %d", key, i)))
+		msg.Id = keyedMessageID(msg.Id, []byte(key))
+		topic.PutMessage(msg)
+	}
+
+	wg.Wait()
+	assert.Equal(t, int(total), numMessages)
+
+	// every key is delivered, in order, to a single consumer
+	for key, seqs := range received {
+		assert.Equal(t, keysByConn[0][key] && keysByConn[1][key], false)
+		for j := 1; j < len(seqs); j++ {
+			assert.Equal(t, seqs[j] > seqs[j-1], true)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxProducersPerTopic bounds how many producers a topic tracks, the one that
+// published least recently is forgotten to make room for a new one
+const maxProducersPerTopic = 100
+
+// producerID identifies who published to a topic, a TCP client connection
+// (by remote address) or, for /put and /mput, the source IP
+type producerID struct {
+	Protocol string
+	Address  string
+	Name     string
+}
+
+func tcpProducer(client *ClientV2) producerID {
+	client.RLock()
+	name := client.ShortIdentifier
+	client.RUnlock()
+	return producerID{"tcp", client.String(), name}
+}
+
+func httpProducer(remoteAddr string, userAgent string) producerID {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return producerID{"http", host, userAgent}
+}
+
+type topicProducers struct {
+	sync.Mutex
+	producers map[producerID]*ProducerStats
+}
+
+func (tp *topicProducers) published(id producerID, count int) {
+	now := time.Now().Unix()
+
+	tp.Lock()
+	defer tp.Unlock()
+
+	if tp.producers == nil {
+		tp.producers = make(map[producerID]*ProducerStats)
+	}
+	p, ok := tp.producers[id]
+	if !ok {
+		if len(tp.producers) >= maxProducersPerTopic {
+			tp.evictOldest()
+		}
+		p = &ProducerStats{
+			Protocol: id.Protocol,
+			Address:  id.Address,
+			Name:     id.Name,
+		}
+		tp.producers[id] = p
+	}
+	p.MessageCount += uint64(count)
+	p.LastPublish = now
+}
+
+// this expects the caller to hold the lock
+func (tp *topicProducers) evictOldest() {
+	var oldestID producerID
+	var oldest *ProducerStats
+	for id, p := range tp.producers {
+		if oldest == nil || p.LastPublish < oldest.LastPublish {
+			oldestID = id
+			oldest = p
+		}
+	}
+	delete(tp.producers, oldestID)
+}
+
+// Stats returns a copy of the producers' stats, busiest first
+func (tp *topicProducers) Stats() []ProducerStats {
+	tp.Lock()
+	stats := make([]ProducerStats, 0, len(tp.producers))
+	for _, p := range tp.producers {
+		stats = append(stats, *p)
+	}
+	tp.Unlock()
+
+	sort.Sort(ProducersByMessageCount{stats})
+	return stats
+}
+
+// producerPublished records count messages published by id to topicName (or
+// to each topic it is an alias of), it is only called once they have been
+func (n *NSQD) producerPublished(topicName string, id producerID, count int) {
+	n.RLock()
+	topicNames, ok := n.aliasMap[topicName]
+	n.RUnlock()
+	if !ok {
+		topicNames = []string{topicName}
+	}
+
+	for _, name := range topicNames {
+		topic, err := n.GetExistingTopic(name)
+		if err == nil {
+			topic.producers.published(id, count)
+		}
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -18,12 +20,25 @@ import (
 	"github.com/bitly/nsq/util"
 )
 
-const maxTimeout = time.Hour
+// maxPingTokenLength bounds the token a client can have echoed by PING
+const maxPingTokenLength = 64
 
 var separatorBytes = []byte(" ")
 var heartbeatBytes = []byte("_heartbeat_")
 var okBytes = []byte("OK")
 
+// frameTypeRdyHint frames advise a client (that negotiated rdy_hints) with
+// RDY 0 that its channel has a large backlog
+const frameTypeRdyHint int32 = 3
+
+// frameTypeMultiplexedMessage frames are messages sent to a client that
+// negotiated multiplex, the message is prefixed by the 4-byte subscription ID
+// it was delivered on
+const frameTypeMultiplexedMessage int32 = 4
+
+// errMsgTooBig is the parent of errors for messages exceeding --max-msg-size
+var errMsgTooBig = errors.New("message too big")
+
 type ProtocolV2 struct {
 	context *Context
 }
@@ -35,6 +50,7 @@ func (p *ProtocolV2) IOLoop(conn net.Conn) error {
 
 	clientID := atomic.AddInt64(&p.context.nsqd.clientIDSequence, 1)
 	client := NewClientV2(clientID, conn, p.context)
+	p.context.nsqd.clientEvent("connect", client, nil)
 
 	// synchronize the startup of messagePump in order
 	// to guarantee that it gets a chance to initialize
@@ -47,7 +63,11 @@ func (p *ProtocolV2) IOLoop(conn net.Conn) error {
 
 	for {
 		if client.HeartbeatInterval > 0 {
-			client.SetReadDeadline(time.Now().Add(client.HeartbeatInterval * 2))
+			client.SetReadDeadline(time.Now().Add(client.HeartbeatInterval * time.Duration(client.HeartbeatMissTolerance)))
+		} else if idleTimeout := p.context.nsqd.options.IdleClientTimeout; idleTimeout > 0 {
+			// without heartbeats nothing else reaps a client that went away
+			// (unless TCP keepalive notices)
+			client.SetReadDeadline(time.Now().Add(idleTimeout))
 		} else {
 			client.SetReadDeadline(zeroTime)
 		}
@@ -67,11 +87,15 @@ func (p *ProtocolV2) IOLoop(conn net.Conn) error {
 		}
 		params := bytes.Split(line, separatorBytes)
 
-		if *verbose {
+		if client.debugLogging() {
 			log.Printf("PROTOCOL(V2): [%s] %s", client, params)
 		}
 
 		response, err := p.Exec(client, params)
+		if err == nil && bytes.Equal(params[0], []byte("IDENTIFY")) {
+			// once TLS/compression have been negotiated
+			p.context.nsqd.clientEvent("identify", client, nil)
+		}
 		if err != nil {
 			context := ""
 			if parentErr := err.(util.ChildErr).Parent(); parentErr != nil {
@@ -102,44 +126,85 @@ func (p *ProtocolV2) IOLoop(conn net.Conn) error {
 	log.Printf("PROTOCOL(V2): [%s] exiting ioloop", client)
 	conn.Close()
 	close(client.ExitChan)
-	if client.Channel != nil {
-		client.Channel.RemoveClient(client.ID)
+	p.context.nsqd.removeWildcardSubs(client)
+	for _, channel := range client.unsubscribe() {
+		channel.RemoveClient(client.ID)
 	}
+	p.context.nsqd.clientEvent("disconnect", client, nil)
 
 	return err
 }
 
 func (p *ProtocolV2) SendMessage(client *ClientV2, msg *nsq.Message, buf *bytes.Buffer) error {
-	if *verbose {
+	if client.debugLogging() {
 		log.Printf("PROTOCOL(V2): writing msg(%s) to client(%s) - %s",
 			msg.Id, client, msg.Body)
 	}
 
+	if atomic.LoadInt32(&client.ChunkedMessages) == 1 &&
+		int64(messageHeaderSize+len(msg.Body)) > p.context.nsqd.options.MaxMsgSize {
+		buf.Reset()
+		err := msg.Write(buf)
+		if err != nil {
+			return err
+		}
+		return p.sendChunks(client, buf.Bytes())
+	}
+
 	buf.Reset()
-	err := msg.Write(buf)
-	if err != nil {
-		return err
+	writeMessageHeader(buf, msg)
+	return p.sendParts(client, nsq.FrameTypeMessage, buf.Bytes(), msg.Body)
+}
+
+func (p *ProtocolV2) SendMultiplexedMessage(client *ClientV2, subID int32, msg *nsq.Message, buf *bytes.Buffer) error {
+	if client.debugLogging() {
+		log.Printf("PROTOCOL(V2): writing msg(%s) on subscription %d to client(%s) - %s",
+			msg.Id, subID, client, msg.Body)
 	}
 
-	err = p.Send(client, nsq.FrameTypeMessage, buf.Bytes())
+	buf.Reset()
+	err := binary.Write(buf, binary.BigEndian, subID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	writeMessageHeader(buf, msg)
+	return p.sendParts(client, frameTypeMultiplexedMessage, buf.Bytes(), msg.Body)
+}
+
+// SendBatch sends (and resets) the client's pending batch of messages
+func (p *ProtocolV2) SendBatch(client *ClientV2, batch *messageBatch) error {
+	if batch.count == 0 {
+		return nil
+	}
+
+	if client.debugLogging() {
+		log.Printf("PROTOCOL(V2): writing batch of %d msgs to client(%s)", batch.count, client)
+	}
+
+	err := p.Send(client, frameTypeMessageBatch, batch.frame())
+	batch.reset()
+	return err
 }
 
 func (p *ProtocolV2) Send(client *ClientV2, frameType int32, data []byte) error {
+	return p.sendParts(client, frameType, data)
+}
+
+// sendParts is Send for a frame whose data is in parts (see zero_copy.go)
+func (p *ProtocolV2) sendParts(client *ClientV2, frameType int32, parts ...[]byte) error {
 	client.Lock()
 
-	client.SetWriteDeadline(time.Now().Add(time.Second))
-	_, err := util.SendFramedResponse(client.Writer, frameType, data)
+	client.SetWriteDeadline(time.Now().Add(client.WriteTimeout()))
+	_, err := util.SendFramedResponseParts(client.Writer, frameType, parts...)
 	if err != nil {
 		client.Unlock()
 		return err
 	}
 
-	if frameType != nsq.FrameTypeMessage {
+	if frameType != nsq.FrameTypeMessage && frameType != frameTypeMultiplexedMessage &&
+		frameType != frameTypeMessageBatch && frameType != frameTypeDeadlineMessage &&
+		frameType != frameTypeMessageChunk && frameType != frameTypeTopicMessage {
 		err = client.Flush()
 	}
 
@@ -160,8 +225,14 @@ func (p *ProtocolV2) Exec(client *ClientV2, params [][]byte) ([]byte, error) {
 		return p.PUB(client, params)
 	case bytes.Equal(params[0], []byte("MPUB")):
 		return p.MPUB(client, params)
+	case bytes.Equal(params[0], []byte("CHUNK")):
+		return p.CHUNK(client, params)
+	case bytes.Equal(params[0], []byte("TPUB")):
+		return p.TPUB(client, params)
 	case bytes.Equal(params[0], []byte("NOP")):
 		return p.NOP(client, params)
+	case bytes.Equal(params[0], []byte("PING")):
+		return p.PING(client, params)
 	case bytes.Equal(params[0], []byte("TOUCH")):
 		return p.TOUCH(client, params)
 	case bytes.Equal(params[0], []byte("IDENTIFY")):
@@ -170,27 +241,70 @@ func (p *ProtocolV2) Exec(client *ClientV2, params [][]byte) ([]byte, error) {
 		return p.SUB(client, params)
 	case bytes.Equal(params[0], []byte("CLS")):
 		return p.CLS(client, params)
+	case bytes.Equal(params[0], []byte("XPAUSE")):
+		return p.XPAUSE(client, params)
 	}
 	return nil, util.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
 
+// pumpDelivery is how messagePump sends a client messages (see deliver), as
+// negotiated in IDENTIFY
+type pumpDelivery struct {
+	buf        bytes.Buffer
+	msgTimeout time.Duration
+	// messages are batched (once negotiated) until the batch is full, the
+	// batch timeout fires or the client can't be sent any more
+	batch          *messageBatch
+	batchTimeout   time.Duration
+	batchTimer     *time.Timer
+	batchTimerChan <-chan time.Time
+	// messages are sent with their deadline (once negotiated)
+	msgDeadlines bool
+}
+
 func (p *ProtocolV2) messagePump(client *ClientV2, startedChan chan bool) {
 	var err error
-	var buf bytes.Buffer
+	var d pumpDelivery
 	var clientMsgChan chan *nsq.Message
+	var partitionMsgChan chan *nsq.Message
+	var assignedMsgChan chan *nsq.Message
 	var subChannel *Channel
 	// NOTE: `flusherChan` is used to bound message latency for
 	// the pathological case of a channel on a low volume topic
 	// with >1 clients having >1 RDY counts
 	var flusherChan <-chan time.Time
 	var sampleRate int32
+	var rdyHintTicker *time.Ticker
+	var rdyHintChan <-chan time.Time
+	// every client's failure ratio is checked (when enabled), only clients
+	// that negotiated backoff are sent BACKOFF frames
+	var backoffTicker *time.Ticker
+	var backoffChan <-chan time.Time
+	var backoffState backoffSampler
+	// the output buffer timeout is tuned (when enabled, see
+	// output_buffer_tuning.go)
+	var tuneTicker *time.Ticker
+	var tuneChan <-chan time.Time
 
 	subEventChan := client.SubEventChan
 	identifyEventChan := client.IdentifyEventChan
+	tuner := p.clientOutputBufferTuner(client.OutputBufferTimeout)
 	outputBufferTicker := time.NewTicker(client.OutputBufferTimeout)
+	if tuner != nil {
+		outputBufferTicker.Stop()
+		outputBufferTicker = time.NewTicker(tuner.timeout)
+		client.SetTunedOutputBufferTimeout(tuner.timeout)
+		tuneTicker = time.NewTicker(outputBufferTuneInterval)
+		tuneChan = tuneTicker.C
+	}
 	heartbeatTicker := time.NewTicker(client.HeartbeatInterval)
 	heartbeatChan := heartbeatTicker.C
-	msgTimeout := client.MsgTimeout
+	d.msgTimeout = client.MsgTimeout
+
+	if p.context.nsqd.options.BackoffFailurePercent > 0 {
+		backoffTicker = time.NewTicker(p.context.nsqd.options.BackoffWindow)
+		backoffChan = backoffTicker.C
+	}
 
 	// v2 opportunistically buffers data to clients to reduce write system calls
 	// we force flush in two cases:
@@ -208,7 +322,17 @@ func (p *ProtocolV2) messagePump(client *ClientV2, startedChan chan bool) {
 		if subChannel == nil || !client.IsReadyForMessages() {
 			// the client is not ready to receive messages...
 			clientMsgChan = nil
+			partitionMsgChan = nil
 			flusherChan = nil
+			// the client won't be sent more until it has the pending batch
+			if d.batch != nil && d.batch.count > 0 {
+				d.batchTimer.Stop()
+				d.batchTimerChan = nil
+				err = p.SendBatch(client, d.batch)
+				if err != nil {
+					goto exit
+				}
+			}
 			// force flush
 			client.Lock()
 			err = client.Flush()
@@ -216,16 +340,21 @@ func (p *ProtocolV2) messagePump(client *ClientV2, startedChan chan bool) {
 			if err != nil {
 				goto exit
 			}
+			if tuner != nil && !flushed {
+				tuner.flushed()
+			}
 			flushed = true
 		} else if flushed {
 			// last iteration we flushed...
 			// do not select on the flusher ticker channel
 			clientMsgChan = subChannel.clientMsgChan
+			partitionMsgChan = assignedMsgChan
 			flusherChan = nil
 		} else {
 			// we're buffered (if there isn't any more data we should flush)...
 			// select on the flusher ticker channel, too
 			clientMsgChan = subChannel.clientMsgChan
+			partitionMsgChan = assignedMsgChan
 			flusherChan = outputBufferTicker.C
 		}
 
@@ -240,17 +369,34 @@ func (p *ProtocolV2) messagePump(client *ClientV2, startedChan chan bool) {
 			if err != nil {
 				goto exit
 			}
+			if tuner != nil {
+				tuner.flushed()
+			}
 			flushed = true
+		case <-tuneChan:
+			if tuner == nil {
+				continue
+			}
+			if timeout, changed := tuner.tune(); changed {
+				outputBufferTicker.Stop()
+				outputBufferTicker = time.NewTicker(timeout)
+				client.SetTunedOutputBufferTimeout(timeout)
+			}
 		case <-client.ReadyStateChan:
 		case subChannel = <-subEventChan:
 			// you can't SUB anymore
 			subEventChan = nil
+			assignedMsgChan = subChannel.AddPartitionConsumer(client.ID)
 		case identifyData := <-identifyEventChan:
 			// you can't IDENTIFY anymore
 			identifyEventChan = nil
 
 			outputBufferTicker.Stop()
-			if identifyData.OutputBufferTimeout > 0 {
+			tuner = p.clientOutputBufferTuner(identifyData.OutputBufferTimeout)
+			if tuner != nil {
+				outputBufferTicker = time.NewTicker(tuner.timeout)
+				client.SetTunedOutputBufferTimeout(tuner.timeout)
+			} else if identifyData.OutputBufferTimeout > 0 {
 				outputBufferTicker = time.NewTicker(identifyData.OutputBufferTimeout)
 			}
 
@@ -265,12 +411,89 @@ func (p *ProtocolV2) messagePump(client *ClientV2, startedChan chan bool) {
 				sampleRate = identifyData.SampleRate
 			}
 
-			msgTimeout = identifyData.MsgTimeout
+			d.msgTimeout = identifyData.MsgTimeout
+
+			if identifyData.BatchMaxCount > 1 {
+				d.batch = newMessageBatch(identifyData.BatchMaxCount, identifyData.BatchMaxBytes)
+				d.batchTimeout = identifyData.BatchTimeout
+			}
+
+			d.msgDeadlines = identifyData.MsgDeadlines
+
+			if identifyData.RdyHints {
+				rdyHintTicker = time.NewTicker(p.context.nsqd.options.RdyHintInterval)
+				rdyHintChan = rdyHintTicker.C
+			}
+
+			if identifyData.Multiplex {
+				// multiplexed clients aren't assigned partitions
+				if subChannel != nil {
+					subChannel.RemovePartitionConsumer(client.ID)
+				}
+				// nor is their output buffer timeout tuned
+				if tuneTicker != nil {
+					tuneTicker.Stop()
+					tuneTicker = nil
+				}
+				if tuner != nil {
+					tuner = nil
+					outputBufferTicker.Stop()
+					outputBufferTicker = time.NewTicker(identifyData.OutputBufferTimeout)
+					client.SetTunedOutputBufferTimeout(identifyData.OutputBufferTimeout)
+				}
+				// the remainder of this client's life is spent multiplexing
+				err = p.muxMessagePump(client, subChannel, outputBufferTicker, heartbeatChan, sampleRate, d.msgTimeout)
+				goto exit
+			}
+		case <-d.batchTimerChan:
+			d.batchTimerChan = nil
+			err = p.SendBatch(client, d.batch)
+			if err != nil {
+				goto exit
+			}
+			flushed = false
+		case <-rdyHintChan:
+			err = p.maybeSendRdyHint(client, subChannel)
+			if err != nil {
+				goto exit
+			}
+		case <-backoffChan:
+			err = p.checkBackoff(client, subChannel, &backoffState)
+			if err != nil {
+				goto exit
+			}
 		case <-heartbeatChan:
-			err = p.Send(client, nsq.FrameTypeResponse, heartbeatBytes)
+			err = p.checkHeartbeat(client)
 			if err != nil {
 				goto exit
 			}
+			err = p.sendHeartbeat(client, subChannel)
+			if err != nil {
+				goto exit
+			}
+			client.HeartbeatSent()
+		case msg := <-partitionMsgChan:
+			// a keyed message for a partition we've been assigned (these
+			// aren't sampled, that would drop every message for the key)
+			err = p.deliver(client, subChannel, msg, false, &d)
+			if err != nil {
+				goto exit
+			}
+			if tuner != nil {
+				tuner.sent()
+			}
+			flushed = false
+		case msg := <-client.RedeliverChan:
+			// a message an admin redelivered to this client, it's already in
+			// flight (whatever the client's RDY, see redeliver.go)
+			err = p.deliver(client, subChannel, msg, true, &d)
+			if err != nil {
+				goto exit
+			}
+			if tuner != nil {
+				tuner.sent()
+			}
+			flushed = false
 		case msg, ok := <-clientMsgChan:
 			if !ok {
 				goto exit
@@ -280,12 +503,13 @@ func (p *ProtocolV2) messagePump(client *ClientV2, startedChan chan bool) {
 				continue
 			}
 
-			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
-			client.SendingMessage()
-			err = p.SendMessage(client, msg, &buf)
+			err = p.deliver(client, subChannel, msg, false, &d)
 			if err != nil {
 				goto exit
 			}
+			if tuner != nil {
+				tuner.sent()
+			}
 			flushed = false
 		case <-client.ExitChan:
 			goto exit
@@ -296,11 +520,108 @@ exit:
 	log.Printf("PROTOCOL(V2): [%s] exiting messagePump", client)
 	heartbeatTicker.Stop()
 	outputBufferTicker.Stop()
+	if tuneTicker != nil {
+		tuneTicker.Stop()
+	}
+	if rdyHintTicker != nil {
+		rdyHintTicker.Stop()
+	}
+	if backoffTicker != nil {
+		backoffTicker.Stop()
+	}
+	if d.batchTimer != nil {
+		d.batchTimer.Stop()
+	}
+	if subChannel != nil {
+		subChannel.RemovePartitionConsumer(client.ID)
+	}
 	if err != nil {
 		log.Printf("PROTOCOL(V2): [%s] messagePump error - %s", client, err.Error())
 	}
 }
 
+// deliver sends msg, from channel, to the client (batched or with its deadline
+// when negotiated), it's put in flight first unless it already is (ie. it was
+// redelivered)
+func (p *ProtocolV2) deliver(client *ClientV2, channel *Channel, msg *nsq.Message, inFlight bool, d *pumpDelivery) error {
+	deadline := time.Now().Add(d.msgTimeout)
+	if !inFlight {
+		channel.StartInFlightTimeout(msg, client.ID, d.msgTimeout)
+		client.SendingMessage()
+	}
+
+	err := p.sendAnnotations(client, channel, msg, &d.buf)
+	if err != nil {
+		return err
+	}
+	if d.batch != nil {
+		return p.batchMessage(client, d.batch, msg, d.batchTimeout, &d.batchTimer, &d.batchTimerChan)
+	}
+	if d.msgDeadlines {
+		return p.SendDeadlineMessage(client, msg, deadline, &d.buf)
+	}
+	return p.SendMessage(client, msg, &d.buf)
+}
+
+// batchMessage adds msg to the client's batch, sending it once it's full, the
+// batch timer is started by the first message of a batch
+func (p *ProtocolV2) batchMessage(client *ClientV2, batch *messageBatch, msg *nsq.Message,
+	timeout time.Duration, timer **time.Timer, timerChan *<-chan time.Time) error {
+	full, err := batch.add(msg)
+	if err != nil {
+		return err
+	}
+
+	if full {
+		if *timerChan != nil {
+			(*timer).Stop()
+			*timerChan = nil
+		}
+		return p.SendBatch(client, batch)
+	}
+
+	if *timerChan == nil {
+		*timer = time.NewTimer(timeout)
+		*timerChan = (*timer).C
+	}
+	return nil
+}
+
+// maybeSendRdyHint advises a subscribed client with RDY 0 that its channel has
+// a backlog of at least --rdy-hint-depth so that it can redistribute its
+// max-in-flight across connections
+func (p *ProtocolV2) maybeSendRdyHint(client *ClientV2, channel *Channel) error {
+	if channel == nil || atomic.LoadInt64(&client.ReadyCount) > 0 {
+		return nil
+	}
+
+	depth := channel.Depth()
+	if depth < p.context.nsqd.options.RdyHintDepth {
+		return nil
+	}
+
+	channel.RLock()
+	numClients := len(channel.clients)
+	channel.RUnlock()
+
+	hint, err := json.Marshal(struct {
+		Depth   int64 `json:"depth"`
+		Clients int   `json:"clients"`
+	}{
+		Depth:   depth,
+		Clients: numClients,
+	})
+	if err != nil {
+		panic("should never happen")
+	}
+
+	if client.debugLogging() {
+		log.Printf("PROTOCOL(V2): [%s] sending RDY hint %s", client, hint)
+	}
+
+	return p.Send(client, frameTypeRdyHint, hint)
+}
+
 func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error) {
 	var err error
 
@@ -331,7 +652,7 @@ func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error)
 		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to decode JSON body")
 	}
 
-	if *verbose {
+	if client.debugLogging() {
 		log.Printf("PROTOCOL(V2): [%s] %+v", client, identifyData)
 	}
 
@@ -345,7 +666,7 @@ func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error)
 		return okBytes, nil
 	}
 
-	tlsv1 := p.context.nsqd.tlsConfig != nil && identifyData.TLSv1
+	tlsv1 := p.context.nsqd.TLSConfig() != nil && identifyData.TLSv1
 	deflate := p.context.nsqd.options.DeflateEnabled && identifyData.Deflate
 	deflateLevel := 0
 	if deflate {
@@ -361,27 +682,67 @@ func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error)
 	}
 
 	resp, err := json.Marshal(struct {
-		MaxRdyCount     int64  `json:"max_rdy_count"`
-		Version         string `json:"version"`
-		MaxMsgTimeout   int64  `json:"max_msg_timeout"`
-		MsgTimeout      int64  `json:"msg_timeout"`
-		TLSv1           bool   `json:"tls_v1"`
-		Deflate         bool   `json:"deflate"`
-		DeflateLevel    int    `json:"deflate_level"`
-		MaxDeflateLevel int    `json:"max_deflate_level"`
-		Snappy          bool   `json:"snappy"`
-		SampleRate      int32  `json:"sample_rate"`
+		MaxRdyCount      int64  `json:"max_rdy_count"`
+		Version          string `json:"version"`
+		MaxMsgTimeout    int64  `json:"max_msg_timeout"`
+		MsgTimeout       int64  `json:"msg_timeout"`
+		TLSv1            bool   `json:"tls_v1"`
+		Deflate          bool   `json:"deflate"`
+		DeflateLevel     int    `json:"deflate_level"`
+		MaxDeflateLevel  int    `json:"max_deflate_level"`
+		Snappy           bool   `json:"snappy"`
+		SampleRate       int32  `json:"sample_rate"`
+		RdyHints         bool   `json:"rdy_hints"`
+		Multiplex        bool   `json:"multiplex"`
+		MaxSubscriptions int64  `json:"max_subscriptions"`
+		BatchMaxCount    int    `json:"batch_max_count"`
+		BatchMaxBytes    int    `json:"batch_max_bytes"`
+		BatchTimeout     int64  `json:"batch_timeout"`
+		Backoff          bool   `json:"backoff"`
+		DurablePublish   bool   `json:"durable_publish"`
+		MsgDeadlines     bool   `json:"msg_deadlines"`
+		ChunkedMessages  bool   `json:"chunked_messages"`
+		MaxChunkedSize   int64  `json:"max_chunked_msg_size"`
+		HeartbeatStats   bool   `json:"heartbeat_stats"`
+		Replication      bool   `json:"replication"`
+		Annotations      bool   `json:"annotations"`
+		TCPKeepAlive     int64  `json:"tcp_keepalive_interval"`
+		IdleTimeout      int64  `json:"idle_client_timeout"`
+		WriteTimeout     int64  `json:"write_timeout"`
+		HeartbeatMisses  int    `json:"heartbeat_miss_tolerance"`
+		WildcardSub      bool   `json:"wildcard_sub"`
+		ServerLimits
 	}{
-		MaxRdyCount:     p.context.nsqd.options.MaxRdyCount,
-		Version:         util.BINARY_VERSION,
-		MaxMsgTimeout:   int64(p.context.nsqd.options.MaxMsgTimeout / time.Millisecond),
-		MsgTimeout:      int64(p.context.nsqd.options.MsgTimeout / time.Millisecond),
-		TLSv1:           tlsv1,
-		Deflate:         deflate,
-		DeflateLevel:    deflateLevel,
-		MaxDeflateLevel: p.context.nsqd.options.MaxDeflateLevel,
-		Snappy:          snappy,
-		SampleRate:      client.SampleRate,
+		MaxRdyCount:      p.context.nsqd.options.MaxRdyCount,
+		Version:          util.BINARY_VERSION,
+		MaxMsgTimeout:    int64(p.context.nsqd.options.MaxMsgTimeout / time.Millisecond),
+		MsgTimeout:       int64(p.context.nsqd.options.MsgTimeout / time.Millisecond),
+		TLSv1:            tlsv1,
+		Deflate:          deflate,
+		DeflateLevel:     deflateLevel,
+		MaxDeflateLevel:  p.context.nsqd.options.MaxDeflateLevel,
+		Snappy:           snappy,
+		SampleRate:       client.SampleRate,
+		RdyHints:         atomic.LoadInt32(&client.RdyHints) == 1,
+		Multiplex:        atomic.LoadInt32(&client.Multiplexed) == 1,
+		MaxSubscriptions: p.context.nsqd.options.MaxSubscriptionsPerClient,
+		BatchMaxCount:    client.BatchMaxCount,
+		BatchMaxBytes:    client.BatchMaxBytes,
+		BatchTimeout:     int64(client.BatchTimeout / time.Millisecond),
+		Backoff:          atomic.LoadInt32(&client.Backoff) == 1,
+		DurablePublish:   atomic.LoadInt32(&client.DurablePublish) == 1,
+		MsgDeadlines:     atomic.LoadInt32(&client.MsgDeadlines) == 1,
+		ChunkedMessages:  atomic.LoadInt32(&client.ChunkedMessages) == 1,
+		MaxChunkedSize:   p.context.nsqd.options.MaxChunkedMsgSize,
+		HeartbeatStats:   atomic.LoadInt32(&client.HeartbeatStats) == 1,
+		Replication:      client.ReplicationOrigin != "",
+		Annotations:      atomic.LoadInt32(&client.Annotations) == 1,
+		TCPKeepAlive:     int64(p.context.nsqd.options.TCPKeepAliveInterval / time.Millisecond),
+		IdleTimeout:      int64(p.context.nsqd.options.IdleClientTimeout / time.Millisecond),
+		WriteTimeout:     int64(client.WriteTimeout() / time.Millisecond),
+		HeartbeatMisses:  client.HeartbeatMissTolerance,
+		WildcardSub:      atomic.LoadInt32(&client.WildcardSub) == 1,
+		ServerLimits:     p.context.nsqd.ServerLimits(),
 	})
 	if err != nil {
 		panic("should never happen")
@@ -435,12 +796,18 @@ func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error)
 }
 
 func (p *ProtocolV2) SUB(client *ClientV2, params [][]byte) ([]byte, error) {
-	if atomic.LoadInt32(&client.State) != nsq.StateInit {
+	// multiplexed clients can continue to SUB once subscribed
+	multiplexed := atomic.LoadInt32(&client.Multiplexed) == 1
+	state := atomic.LoadInt32(&client.State)
+	if state != nsq.StateInit && !(multiplexed && state == nsq.StateSubscribed) {
 		return nil, util.NewFatalClientErr(nil, "E_INVALID", "cannot SUB in current state")
 	}
 
-	if client.HeartbeatInterval <= 0 {
-		return nil, util.NewFatalClientErr(nil, "E_INVALID", "cannot SUB with heartbeats disabled")
+	// without heartbeats only TCP keepalive notices a consumer that went away
+	// (holding on to its in-flight messages until they time out)
+	if client.HeartbeatInterval <= 0 && p.context.nsqd.options.TCPKeepAliveInterval <= 0 {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID",
+			"cannot SUB with heartbeats disabled (without --tcp-keepalive-interval)")
 	}
 
 	if len(params) < 3 {
@@ -448,7 +815,17 @@ func (p *ProtocolV2) SUB(client *ClientV2, params [][]byte) ([]byte, error) {
 	}
 
 	topicName := string(params[1])
-	if !nsq.IsValidTopicName(topicName) {
+	wildcard := isTopicPattern(topicName)
+	if wildcard {
+		if atomic.LoadInt32(&client.WildcardSub) == 0 {
+			return nil, util.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+				fmt.Sprintf("SUB to topic pattern '%s' is not authorized", topicName))
+		}
+		if !isValidTopicPattern(topicName) {
+			return nil, util.NewFatalClientErr(nil, "E_BAD_TOPIC",
+				fmt.Sprintf("SUB topic pattern '%s' is not valid", topicName))
+		}
+	} else if !nsq.IsValidTopicName(topicName) {
 		return nil, util.NewFatalClientErr(nil, "E_BAD_TOPIC",
 			fmt.Sprintf("SUB topic name '%s' is not valid", topicName))
 	}
@@ -459,18 +836,87 @@ func (p *ProtocolV2) SUB(client *ClientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("SUB channel name '%s' is not valid", channelName))
 	}
 
-	topic := p.context.nsqd.GetTopic(topicName)
-	channel := topic.GetChannel(channelName)
-	channel.AddClient(client.ID, client)
+	// options for the channel, should this SUB create it (see sub_options.go)
+	createOptions, err := parseChannelCreateOptions(params[3:])
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_INVALID", "SUB "+err.Error())
+	}
+
+	if multiplexed && client.subscriptionCount() >= p.context.nsqd.options.MaxSubscriptionsPerClient {
+		return nil, util.NewClientErr(nil, "E_SUB_FAILED",
+			fmt.Sprintf("SUB exceeds max subscriptions %d", p.context.nsqd.options.MaxSubscriptionsPerClient))
+	}
+
+	// consumers should go elsewhere
+	if p.context.nsqd.IsDraining() {
+		return nil, util.NewFatalClientErr(nil, "E_DRAINING", "SUB failed nsqd is draining")
+	}
+
+	if wildcard {
+		client.Lock()
+		client.wildcardPatterns++
+		client.Unlock()
+		atomic.StoreInt32(&client.State, nsq.StateSubscribed)
+		p.context.nsqd.addWildcardSub(&wildcardSub{
+			client:        client,
+			pattern:       topicName,
+			channelName:   channelName,
+			createOptions: createOptions,
+		})
+		return okBytes, nil
+	}
 
+	topic, err := p.context.nsqd.AutoCreateTopic(topicName)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_CREATION_DENIED",
+			fmt.Sprintf("SUB topic '%s' does not exist and cannot be created", topicName))
+	}
+	channel, err := topic.AutoCreateChannelWithOptions(channelName, createOptions)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_CREATION_DENIED",
+			fmt.Sprintf("SUB channel '%s' does not exist and cannot be created", channelName))
+	}
+	subID, err := client.subscribe(channel, "")
+	if err != nil {
+		return nil, util.NewClientErr(nil, "E_SUB_FAILED",
+			fmt.Sprintf("SUB already subscribed to %s:%s", topicName, channelName))
+	}
 	atomic.StoreInt32(&client.State, nsq.StateSubscribed)
-	client.Channel = channel
-	// update message pump
-	client.SubEventChan <- channel
+	p.context.nsqd.clientEvent("sub", client, channel)
 
+	if multiplexed {
+		return []byte(fmt.Sprintf("OK %d", subID)), nil
+	}
 	return okBytes, nil
 }
 
+// subscribedChannel returns the channel a FIN/REQ/TOUCH refers to, multiplexed
+// clients must identify the subscription with the param at index i
+func (p *ProtocolV2) subscribedChannel(client *ClientV2, params [][]byte, i int) (*Channel, error) {
+	if atomic.LoadInt32(&client.Multiplexed) == 0 {
+		return client.Channel, nil
+	}
+
+	if len(params) <= i {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("%s insufficient number of params", params[0]))
+	}
+
+	subID, err := util.ByteToBase10(params[i])
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_INVALID",
+			fmt.Sprintf("%s could not parse subscription ID %s", params[0], params[i]))
+	}
+
+	client.RLock()
+	defer client.RUnlock()
+	if subID >= uint64(len(client.Subscriptions)) {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("%s invalid subscription ID %d", params[0], subID))
+	}
+	return client.Subscriptions[subID], nil
+}
+
 func (p *ProtocolV2) RDY(client *ClientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 
@@ -516,8 +962,17 @@ func (p *ProtocolV2) FIN(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, util.NewFatalClientErr(nil, "E_INVALID", "FIN insufficient number of params")
 	}
 
+	channel, err := p.subscribedChannel(client, params, 2)
+	if err != nil {
+		return nil, err
+	}
+
 	id := *(*nsq.MessageID)(unsafe.Pointer(&params[1][0]))
-	err := client.Channel.FinishMessage(client.ID, id)
+	if p.context.nsqd.chaos.DropFIN() {
+		log.Printf("CHAOS: [%s] dropping FIN %s", client, id)
+		return nil, nil
+	}
+	err = channel.FinishMessage(client.ID, id)
 	if err != nil {
 		return nil, util.NewClientErr(err, "E_FIN_FAILED",
 			fmt.Sprintf("FIN %s failed %s", id, err.Error()))
@@ -539,19 +994,29 @@ func (p *ProtocolV2) REQ(client *ClientV2, params [][]byte) ([]byte, error) {
 	}
 
 	id := *(*nsq.MessageID)(unsafe.Pointer(&params[1][0]))
-	timeoutMs, err := util.ByteToBase10(params[2])
+	timeoutDuration, err := parseRequeueTimeout(params[2], time.Now())
 	if err != nil {
 		return nil, util.NewFatalClientErr(err, "E_INVALID",
 			fmt.Sprintf("REQ could not parse timeout %s", params[2]))
 	}
-	timeoutDuration := time.Duration(timeoutMs) * time.Millisecond
 
-	if timeoutDuration < 0 || timeoutDuration > maxTimeout {
+	maxReqTimeout := p.context.nsqd.options.MaxReqTimeout
+	if timeoutDuration < 0 || timeoutDuration > maxReqTimeout {
 		return nil, util.NewFatalClientErr(nil, "E_INVALID",
-			fmt.Sprintf("REQ timeout %d out of range 0-%d", timeoutDuration, maxTimeout))
+			fmt.Sprintf("REQ timeout %d out of range 0-%d", timeoutDuration, maxReqTimeout))
+	}
+
+	annotation, err := p.readAnnotation(client)
+	if err != nil {
+		return nil, err
 	}
 
-	err = client.Channel.RequeueMessage(client.ID, id, timeoutDuration)
+	channel, err := p.subscribedChannel(client, params, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	err = channel.RequeueAnnotatedMessage(client.ID, id, timeoutDuration, client.String(), annotation)
 	if err != nil {
 		return nil, util.NewClientErr(err, "E_REQ_FAILED",
 			fmt.Sprintf("REQ %s failed %s", id, err.Error()))
@@ -562,6 +1027,31 @@ func (p *ProtocolV2) REQ(client *ClientV2, params [][]byte) ([]byte, error) {
 	return nil, nil
 }
 
+// parseRequeueTimeout parses a REQ timeout, either a delay in ms or, prefixed
+// with @, the unix time in ms to redeliver at (which, once past, is no delay)
+// so that schedulers don't have to compute a delay that drifts
+func parseRequeueTimeout(b []byte, now time.Time) (time.Duration, error) {
+	absolute := len(b) > 0 && b[0] == '@'
+	if absolute {
+		b = b[1:]
+	}
+	ms, err := util.ByteToBase10(b)
+	if err != nil {
+		return 0, err
+	}
+	if ms > math.MaxInt64/uint64(time.Millisecond) {
+		return 0, errors.New("timeout out of range")
+	}
+	if !absolute {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	timeout := time.Unix(0, int64(ms)*int64(time.Millisecond)).Sub(now)
+	if timeout < 0 {
+		timeout = 0
+	}
+	return timeout, nil
+}
+
 func (p *ProtocolV2) CLS(client *ClientV2, params [][]byte) ([]byte, error) {
 	if atomic.LoadInt32(&client.State) != nsq.StateSubscribed {
 		return nil, util.NewFatalClientErr(nil, "E_INVALID", "cannot CLS in current state")
@@ -572,10 +1062,74 @@ func (p *ProtocolV2) CLS(client *ClientV2, params [][]byte) ([]byte, error) {
 	return []byte("CLOSE_WAIT"), nil
 }
 
+// XPAUSE pauses (XPAUSE 1) or resumes (XPAUSE 0) delivery to this client
+// without changing its RDY count
+func (p *ProtocolV2) XPAUSE(client *ClientV2, params [][]byte) ([]byte, error) {
+	if atomic.LoadInt32(&client.State) != nsq.StateSubscribed {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "cannot XPAUSE in current state")
+	}
+
+	if len(params) < 2 {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "XPAUSE insufficient number of params")
+	}
+
+	switch {
+	case bytes.Equal(params[1], []byte("1")):
+		client.SetDeliveryPaused(true)
+	case bytes.Equal(params[1], []byte("0")):
+		client.SetDeliveryPaused(false)
+	default:
+		return nil, util.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("XPAUSE invalid param %s (must be 0 or 1)", params[1]))
+	}
+
+	return okBytes, nil
+}
+
 func (p *ProtocolV2) NOP(client *ClientV2, params [][]byte) ([]byte, error) {
+	rtt := client.HeartbeatResponded()
+	maxRTT := p.context.nsqd.options.MaxHeartbeatRTT
+	if maxRTT > 0 && rtt > maxRTT {
+		return nil, util.NewFatalClientErr(nil, "E_HEARTBEAT_RTT",
+			fmt.Sprintf("heartbeat round-trip time %s exceeds %s", rtt, maxRTT))
+	}
 	return nil, nil
 }
 
+// PING responds PONG <unix nanoseconds> (or PONG <token> <unix nanoseconds>
+// to PING <token>), a client can measure its round-trip time and check the
+// connection is alive at any time, in any state
+func (p *ProtocolV2) PING(client *ClientV2, params [][]byte) ([]byte, error) {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if len(params) < 2 {
+		return []byte("PONG " + now), nil
+	}
+
+	token := params[1]
+	if len(token) > maxPingTokenLength {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("PING token longer than %d", maxPingTokenLength))
+	}
+	return []byte("PONG " + string(token) + " " + now), nil
+}
+
+// checkHeartbeat disconnects the client if its previous heartbeat has gone
+// unanswered for longer than --max-heartbeat-rtt (a half-dead client might
+// never send the NOP that would be measured)
+func (p *ProtocolV2) checkHeartbeat(client *ClientV2) error {
+	maxRTT := p.context.nsqd.options.MaxHeartbeatRTT
+	if maxRTT <= 0 {
+		return nil
+	}
+	pending := client.PendingHeartbeat()
+	if pending <= maxRTT {
+		return nil
+	}
+	log.Printf("PROTOCOL(V2): [%s] heartbeat unanswered for %s, disconnecting", client, pending)
+	client.Close()
+	return fmt.Errorf("heartbeat unanswered for %s", pending)
+}
+
 func (p *ProtocolV2) PUB(client *ClientV2, params [][]byte) ([]byte, error) {
 	var err error
 
@@ -600,7 +1154,8 @@ func (p *ProtocolV2) PUB(client *ClientV2, params [][]byte) ([]byte, error) {
 	}
 
 	if int64(bodyLen) > p.context.nsqd.options.MaxMsgSize {
-		return nil, util.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+		p.context.nsqd.oversizeMessage(topicName)
+		return nil, util.NewFatalClientErr(errMsgTooBig, "E_BAD_MESSAGE",
 			fmt.Sprintf("PUB message too big %d > %d", bodyLen, p.context.nsqd.options.MaxMsgSize))
 	}
 
@@ -610,12 +1165,63 @@ func (p *ProtocolV2) PUB(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE", "PUB failed to read message body")
 	}
 
-	topic := p.context.nsqd.GetTopic(topicName)
+	// an optional key (PUB <topic> <key>) routes the message on partitioned
+	// channels, an optional timestamp=<unix ns> replaces the message's (see
+	// publish_timestamp.go)
+	var key []byte
+	var timestamp int64
+	for _, param := range params[2:] {
+		if !bytes.HasPrefix(param, timestampParam) {
+			key = param
+			continue
+		}
+		timestamp, err = p.context.nsqd.parsePublishTimestamp(string(param[len(timestampParam):]))
+		if err != nil {
+			return nil, util.NewClientErr(err, "E_BAD_TIMESTAMP", "PUB "+err.Error())
+		}
+	}
+
+	if key != nil && !p.context.nsqd.keyedMessageIDs() {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "PUB keys require --id-generator=snowflake")
+	}
+
 	msg := nsq.NewMessage(<-p.context.nsqd.idChan, messageBody)
-	err = topic.PutMessage(msg)
+	if key != nil {
+		msg.Id = keyedMessageID(msg.Id, key)
+	}
+	if timestamp > 0 {
+		msg.Timestamp = timestamp
+	}
+	err = p.putMessages(client, topicName, []*nsq.Message{msg})
+	if err == errReadOnly {
+		return nil, util.NewClientErr(err, "E_READ_ONLY", "PUB failed "+err.Error())
+	}
+	if err == errDraining {
+		return nil, util.NewClientErr(err, "E_DRAINING", "PUB failed "+err.Error())
+	}
+	if err == errReplicaReadOnly {
+		return nil, util.NewClientErr(err, "E_REPLICA_READ_ONLY", "PUB failed "+err.Error())
+	}
+	if _, ok := err.(*msgRejectedError); ok {
+		return nil, util.NewClientErr(err, "E_MSG_REJECTED", "PUB failed "+err.Error())
+	}
+	if err == errTopicFull {
+		return nil, util.NewClientErr(err, "E_TOPIC_FULL", "PUB failed "+err.Error())
+	}
+	if err == errPublishPaused {
+		return nil, util.NewClientErr(err, "E_PUBLISH_PAUSED", "PUB failed "+err.Error())
+	}
+	if err == errMsgTooLarge {
+		return nil, util.NewClientErr(err, "E_MSG_TOO_LARGE", "PUB failed "+err.Error())
+	}
+	if err == errCreationDenied {
+		return nil, util.NewFatalClientErr(err, "E_CREATION_DENIED",
+			fmt.Sprintf("PUB topic '%s' does not exist and cannot be created", topicName))
+	}
 	if err != nil {
 		return nil, util.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed "+err.Error())
 	}
+	p.context.nsqd.producerPublished(topicName, tcpProducer(client), 1)
 
 	return okBytes, nil
 }
@@ -648,20 +1254,170 @@ func (p *ProtocolV2) MPUB(client *ClientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("MPUB body too big %d > %d", bodyLen, p.context.nsqd.options.MaxBodySize))
 	}
 
+	if len(params) > 2 && !p.context.nsqd.keyedMessageIDs() {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "MPUB keys require --id-generator=snowflake")
+	}
+
 	messages, err := readMPUB(client.Reader, client.lenSlice, p.context.nsqd.idChan,
 		p.context.nsqd.options.MaxMsgSize)
 	if err != nil {
+		if err.(*util.FatalClientErr).ParentErr == errMsgTooBig {
+			p.context.nsqd.oversizeMessage(topicName)
+		}
 		return nil, err
 	}
-	topic := p.context.nsqd.GetTopic(topicName)
-
+	if len(params) > 2 {
+		for _, msg := range messages {
+			msg.Id = keyedMessageID(msg.Id, params[2])
+		}
+	}
 	// if we've made it this far we've validated all the input,
 	// the only possible error is that the topic is exiting during
 	// this next call (and no messages will be queued in that case)
-	err = topic.PutMessages(messages)
+	err = p.putMessages(client, topicName, messages)
+	if err == errReadOnly {
+		return nil, util.NewClientErr(err, "E_READ_ONLY", "MPUB failed "+err.Error())
+	}
+	if err == errDraining {
+		return nil, util.NewClientErr(err, "E_DRAINING", "MPUB failed "+err.Error())
+	}
+	if err == errReplicaReadOnly {
+		return nil, util.NewClientErr(err, "E_REPLICA_READ_ONLY", "MPUB failed "+err.Error())
+	}
+	if _, ok := err.(*msgRejectedError); ok {
+		return nil, util.NewClientErr(err, "E_MSG_REJECTED", "MPUB failed "+err.Error())
+	}
+	if err == errTopicFull {
+		return nil, util.NewClientErr(err, "E_TOPIC_FULL", "MPUB failed "+err.Error())
+	}
+	if err == errPublishPaused {
+		return nil, util.NewClientErr(err, "E_PUBLISH_PAUSED", "MPUB failed "+err.Error())
+	}
+	if err == errMsgTooLarge {
+		return nil, util.NewClientErr(err, "E_MSG_TOO_LARGE", "MPUB failed "+err.Error())
+	}
+	if err == errCreationDenied {
+		return nil, util.NewFatalClientErr(err, "E_CREATION_DENIED",
+			fmt.Sprintf("MPUB topic '%s' does not exist and cannot be created", topicName))
+	}
 	if err != nil {
 		return nil, util.NewFatalClientErr(err, "E_MPUB_FAILED", "MPUB failed "+err.Error())
 	}
+	p.context.nsqd.producerPublished(topicName, tcpProducer(client), len(messages))
+
+	return okBytes, nil
+}
+
+// TPUB publishes messages to multiple topics atomically, the body is the
+// number of messages followed by, for each, a topic name and a message:
+//
+//	[ 4-byte num messages ]([ 4-byte topic size ][ topic ][ 4-byte message size ][ message ])...
+func (p *ProtocolV2) TPUB(client *ClientV2, params [][]byte) ([]byte, error) {
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "TPUB failed to read body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("TPUB invalid body size %d", bodyLen))
+	}
+
+	if int64(bodyLen) > p.context.nsqd.options.MaxBodySize {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("TPUB body too big %d > %d", bodyLen, p.context.nsqd.options.MaxBodySize))
+	}
+
+	r := &io.LimitedReader{R: client.Reader, N: int64(bodyLen)}
+	numMessages, err := readLen(r, client.lenSlice)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "TPUB failed to read message count")
+	}
+
+	if numMessages <= 0 {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("TPUB invalid message count %d", numMessages))
+	}
+
+	txMsgs := make([]*txMessage, 0, numMessages)
+	for i := int32(0); i < numMessages; i++ {
+		topicSize, err := readLen(r, client.lenSlice)
+		if err != nil || topicSize <= 0 || topicSize > bodyLen {
+			return nil, util.NewFatalClientErr(err, "E_BAD_BODY",
+				fmt.Sprintf("TPUB failed to read message(%d) topic", i))
+		}
+		topicName := make([]byte, topicSize)
+		_, err = io.ReadFull(r, topicName)
+		if err != nil {
+			return nil, util.NewFatalClientErr(err, "E_BAD_BODY",
+				fmt.Sprintf("TPUB failed to read message(%d) topic", i))
+		}
+		if !nsq.IsValidTopicName(string(topicName)) {
+			return nil, util.NewFatalClientErr(nil, "E_BAD_TOPIC",
+				fmt.Sprintf("TPUB topic name '%s' is not valid", topicName))
+		}
+
+		msg, err := readMPUBMessage(r, client.lenSlice, p.context.nsqd.idChan,
+			p.context.nsqd.options.MaxMsgSize, i)
+		if err != nil {
+			return nil, err
+		}
+		txMsgs = append(txMsgs, &txMessage{string(topicName), msg})
+	}
+
+	if r.N != 0 {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("TPUB body size %d does not match its messages", bodyLen))
+	}
+
+	client.RLock()
+	origin := client.ReplicationOrigin
+	client.RUnlock()
+	for _, txMsg := range txMsgs {
+		err = p.context.nsqd.checkReplica(txMsg.topicName, origin)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = p.context.nsqd.PutTransaction(txMsgs)
+	}
+	if err == errReadOnly {
+		return nil, util.NewClientErr(err, "E_READ_ONLY", "TPUB failed "+err.Error())
+	}
+	if err == errDraining {
+		return nil, util.NewClientErr(err, "E_DRAINING", "TPUB failed "+err.Error())
+	}
+	if err == errReplicaReadOnly {
+		return nil, util.NewClientErr(err, "E_REPLICA_READ_ONLY", "TPUB failed "+err.Error())
+	}
+	if _, ok := err.(*msgRejectedError); ok {
+		return nil, util.NewClientErr(err, "E_MSG_REJECTED", "TPUB failed "+err.Error())
+	}
+	if err == errTopicFull {
+		return nil, util.NewClientErr(err, "E_TOPIC_FULL", "TPUB failed "+err.Error())
+	}
+	if err == errPublishPaused {
+		return nil, util.NewClientErr(err, "E_PUBLISH_PAUSED", "TPUB failed "+err.Error())
+	}
+	if err == errMsgTooLarge {
+		return nil, util.NewClientErr(err, "E_MSG_TOO_LARGE", "TPUB failed "+err.Error())
+	}
+	if err == errCreationDenied {
+		return nil, util.NewFatalClientErr(err, "E_CREATION_DENIED",
+			"TPUB topic does not exist and cannot be created")
+	}
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_TPUB_FAILED", "TPUB failed "+err.Error())
+	}
+	topicCounts := make(map[string]int)
+	for _, txMsg := range txMsgs {
+		topicCounts[txMsg.topicName]++
+	}
+	producer := tcpProducer(client)
+	for topicName, count := range topicCounts {
+		p.context.nsqd.producerPublished(topicName, producer, count)
+	}
 
 	return okBytes, nil
 }
@@ -676,8 +1432,13 @@ func (p *ProtocolV2) TOUCH(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, util.NewFatalClientErr(nil, "E_INVALID", "TOUCH insufficient number of params")
 	}
 
+	channel, err := p.subscribedChannel(client, params, 2)
+	if err != nil {
+		return nil, err
+	}
+
 	id := *(*nsq.MessageID)(unsafe.Pointer(&params[1][0]))
-	err := client.Channel.TouchMessage(client.ID, id)
+	err = channel.TouchMessage(client.ID, id)
 	if err != nil {
 		return nil, util.NewClientErr(err, "E_TOUCH_FAILED",
 			fmt.Sprintf("TOUCH %s failed %s", id, err.Error()))
@@ -699,32 +1460,41 @@ func readMPUB(r io.Reader, tmp []byte, idChan chan nsq.MessageID, maxMessageSize
 
 	messages := make([]*nsq.Message, 0, numMessages)
 	for i := int32(0); i < numMessages; i++ {
-		messageSize, err := readLen(r, tmp)
+		msg, err := readMPUBMessage(r, tmp, idChan, maxMessageSize, i)
 		if err != nil {
-			return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE",
-				fmt.Sprintf("MPUB failed to read message(%d) body size", i))
+			return nil, err
 		}
+		messages = append(messages, msg)
+	}
 
-		if messageSize <= 0 {
-			return nil, util.NewFatalClientErr(nil, "E_BAD_MESSAGE",
-				fmt.Sprintf("MPUB invalid message(%d) body size %d", i, messageSize))
-		}
+	return messages, nil
+}
 
-		if int64(messageSize) > maxMessageSize {
-			return nil, util.NewFatalClientErr(nil, "E_BAD_MESSAGE",
-				fmt.Sprintf("MPUB message too big %d > %d", messageSize, maxMessageSize))
-		}
+// readMPUBMessage reads the i'th size prefixed message of an MPUB (or TPUB) body
+func readMPUBMessage(r io.Reader, tmp []byte, idChan chan nsq.MessageID, maxMessageSize int64, i int32) (*nsq.Message, error) {
+	messageSize, err := readLen(r, tmp)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE",
+			fmt.Sprintf("MPUB failed to read message(%d) body size", i))
+	}
 
-		msgBody := make([]byte, messageSize)
-		_, err = io.ReadFull(r, msgBody)
-		if err != nil {
-			return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE", "MPUB failed to read message body")
-		}
+	if messageSize <= 0 {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("MPUB invalid message(%d) body size %d", i, messageSize))
+	}
 
-		messages = append(messages, nsq.NewMessage(<-idChan, msgBody))
+	if int64(messageSize) > maxMessageSize {
+		return nil, util.NewFatalClientErr(errMsgTooBig, "E_BAD_MESSAGE",
+			fmt.Sprintf("MPUB message too big %d > %d", messageSize, maxMessageSize))
 	}
 
-	return messages, nil
+	msgBody := make([]byte, messageSize)
+	_, err = io.ReadFull(r, msgBody)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE", "MPUB failed to read message body")
+	}
+
+	return nsq.NewMessage(<-idChan, msgBody), nil
 }
 
 func readLen(r io.Reader, tmp []byte) (int32, error) {
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"compress/flate"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,27 +14,41 @@ import (
 	"math"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
 	"github.com/bmizerany/assert"
 	"github.com/mreiferson/go-snappystream"
 )
 
+// mustStartNSQD starts nsqd on ephemeral ports and, unless options has one,
+// its own data path so that tests' metadata and disk queues don't collide
 func mustStartNSQD(options *nsqdOptions) (*net.TCPAddr, *net.TCPAddr, *NSQD) {
-	tcpAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	httpAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	options.DataPath = os.TempDir()
+	options.TCPAddresses = []string{"127.0.0.1:0"}
+	options.HTTPAddresses = []string{"127.0.0.1:0"}
+	if options.DataPath == "" {
+		options.DataPath = mustTempDataPath()
+	}
 	nsqd := NewNSQD(options)
-	nsqd.tcpAddr = tcpAddr
-	nsqd.httpAddr = httpAddr
 	nsqd.Main()
-	return nsqd.tcpListener.Addr().(*net.TCPAddr), nsqd.httpListener.Addr().(*net.TCPAddr), nsqd
+	return nsqd.tcpAddr, nsqd.httpAddr, nsqd
+}
+
+func mustTempDataPath() string {
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	if err != nil {
+		panic(err)
+	}
+	return dataPath
 }
 
 func mustConnectNSQD(tcpAddr *net.TCPAddr) (net.Conn, error) {
@@ -254,6 +269,168 @@ func TestClientHeartbeat(t *testing.T) {
 	assert.Equal(t, err, nil)
 }
 
+func TestClientHeartbeatRTT(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "test_hb_rtt" + strconv.Itoa(int(time.Now().Unix()))
+
+	options := NewNSQDOptions()
+	options.ClientTimeout = 400 * time.Millisecond
+	options.MaxHeartbeatRTT = 50 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	readValidate(t, conn, nsq.FrameTypeResponse, "_heartbeat_")
+	time.Sleep(10 * time.Millisecond)
+	err = nsq.Nop().Write(conn)
+	assert.Equal(t, err, nil)
+	time.Sleep(10 * time.Millisecond)
+
+	channel, err := nsqd.GetTopic(topicName).GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	channel.RLock()
+	for _, c := range channel.clients {
+		stats := c.Stats()
+		assert.Equal(t, stats.HeartbeatRTT >= int64(10*time.Millisecond), true)
+		assert.Equal(t, stats.HeartbeatRTT < int64(options.MaxHeartbeatRTT), true)
+		assert.Equal(t, stats.LastHeartbeatAge < int64(options.ClientTimeout), true)
+	}
+	channel.RUnlock()
+
+	// responding too slowly gets us disconnected
+	readValidate(t, conn, nsq.FrameTypeResponse, "_heartbeat_")
+	time.Sleep(70 * time.Millisecond)
+	err = nsq.Nop().Write(conn)
+	assert.Equal(t, err, nil)
+	resp, _ := nsq.ReadResponse(conn)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, strings.HasPrefix(string(data), "E_HEARTBEAT_RTT"), true)
+	_, err = nsq.ReadResponse(conn)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestClientDeliveryPause(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "test_client_pause" + strconv.Itoa(int(time.Now().Unix()))
+
+	options := NewNSQDOptions()
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	// pause ourselves (our RDY count is left as is)
+	cmd := &nsq.Command{Name: []byte("XPAUSE"), Params: [][]byte{[]byte("1")}}
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeResponse, "OK")
+	err = nsq.Ready(10).Write(conn)
+	assert.Equal(t, err, nil)
+
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = nsq.ReadResponse(conn)
+	assert.NotEqual(t, err, nil)
+	conn.SetReadDeadline(time.Time{})
+
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	var client ClientStats
+	channel.RLock()
+	for _, c := range channel.clients {
+		client = c.Stats()
+	}
+	channel.RUnlock()
+	assert.Equal(t, client.Paused, true)
+	assert.Equal(t, client.ReadyCount, int64(10))
+
+	// an operator resumes delivery to the client
+	resp, err := http.Get(fmt.Sprintf("http://%s/unpause_client?client_id=%d", httpAddr, client.ID))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	resp2, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp2)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msg, err := nsq.DecodeMessage(data)
+	assert.Equal(t, msg.Body, []byte("test body"))
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/pause_client?client_id=%d", httpAddr, client.ID))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	c, err := nsqd.GetSubscribedClient(client.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, c.IsDeliveryPaused(), true)
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/pause_client?client_id=%d", httpAddr, client.ID+1000))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 404)
+}
+
+func TestPing(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	// PING is allowed before IDENTIFY
+	before := time.Now().UnixNano()
+	err = (&nsq.Command{Name: []byte("PING")}).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	parts := strings.Split(string(data), " ")
+	assert.Equal(t, len(parts), 2)
+	assert.Equal(t, parts[0], "PONG")
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ts >= before, true)
+
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+
+	// the token is echoed so a client can match PONGs to PINGs
+	err = (&nsq.Command{Name: []byte("PING"), Params: [][]byte{[]byte("abc123")}}).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err = nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, strings.HasPrefix(string(data), "PONG abc123 "), true)
+
+	err = (&nsq.Command{Name: []byte("PING"), Params: [][]byte{bytes.Repeat([]byte("a"), 65)}}).Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeError, "E_INVALID PING token longer than 64")
+}
+
 func TestClientHeartbeatDisableSUB(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
@@ -297,6 +474,53 @@ func TestClientHeartbeatDisable(t *testing.T) {
 	assert.Equal(t, err, nil)
 }
 
+func TestClientHeartbeatDisableKeepAlive(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "test_hb_keepalive" + strconv.Itoa(int(time.Now().Unix()))
+
+	options := NewNSQDOptions()
+	options.ClientTimeout = 100 * time.Millisecond
+	options.TCPKeepAliveInterval = time.Second
+	options.IdleClientTimeout = 200 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	// with TCP keepalive enforced clients can SUB without heartbeats
+	data := identify(t, conn, map[string]interface{}{
+		"heartbeat_interval": -1,
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		TCPKeepAlive int64 `json:"tcp_keepalive_interval"`
+		IdleTimeout  int64 `json:"idle_client_timeout"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.TCPKeepAlive, int64(1000))
+	assert.Equal(t, r.IdleTimeout, int64(200))
+	sub(t, conn, topicName, "ch")
+
+	// they aren't sent heartbeats, and a NOP keeps them from being idle
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		err = nsq.Nop().Write(conn)
+		assert.Equal(t, err, nil)
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = nsq.ReadResponse(conn)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, err.(net.Error).Timeout(), true)
+
+	// until they go quiet for --idle-client-timeout
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, io.EOF)
+}
+
 func TestMaxHeartbeatIntervalValid(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
@@ -574,6 +798,81 @@ func TestTouch(t *testing.T) {
 	assert.Equal(t, channel.timeoutCount, uint64(0))
 }
 
+func TestReqAbsoluteTimestamp(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.MaxReqTimeout = time.Second
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_req_at" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic.PutMessage(msg)
+
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+
+	readMsg := func() *nsq.Message {
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, frameType, nsq.FrameTypeMessage)
+		msgOut, _ := nsq.DecodeMessage(data)
+		return msgOut
+	}
+	assert.Equal(t, readMsg().Id, msg.Id)
+
+	// redelivered at the timestamp
+	at := time.Now().Add(200 * time.Millisecond)
+	_, err = fmt.Fprintf(conn, "REQ %s @%d\n", msg.Id[:], at.UnixNano()/int64(time.Millisecond))
+	assert.Equal(t, err, nil)
+	msgOut := readMsg()
+	assert.Equal(t, msgOut.Id, msg.Id)
+	assert.Equal(t, msgOut.Attempts, uint16(2))
+	assert.Equal(t, time.Now().After(at.Add(-10*time.Millisecond)), true)
+
+	// but no further in the future than --max-req-timeout
+	at = time.Now().Add(time.Minute)
+	_, err = fmt.Fprintf(conn, "REQ %s @%d\n", msg.Id[:], at.UnixNano()/int64(time.Millisecond))
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, _, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+}
+
+func TestParseRequeueTimeout(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	timeout, err := parseRequeueTimeout([]byte("1500"), now)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, timeout, 1500*time.Millisecond)
+
+	timeout, err = parseRequeueTimeout([]byte("@1002500"), now)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, timeout, 2500*time.Millisecond)
+
+	// timestamps in the past are redelivered straight away
+	timeout, err = parseRequeueTimeout([]byte("@999000"), now)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, timeout, time.Duration(0))
+
+	for _, s := range []string{"-1", "@abc", "9223372036854775807"} {
+		_, err = parseRequeueTimeout([]byte(s), now)
+		assert.NotEqual(t, err, nil)
+	}
+}
+
 func TestMaxRdyCount(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
@@ -1074,6 +1373,370 @@ func TestClientMsgTimeout(t *testing.T) {
 		fmt.Sprintf("E_FIN_FAILED FIN %s failed ID not in flight", msgOut.Id))
 }
 
+func TestRdyHints(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.RdyHintDepth = 2
+	options.RdyHintInterval = 50 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_rdy_hints" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	data := identify(t, conn, map[string]interface{}{
+		"rdy_hints": true,
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		RdyHints bool `json:"rdy_hints"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.RdyHints, true)
+
+	sub(t, conn, topicName, "ch")
+
+	// RDY 0 with a backlog should result in a hint
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, frameTypeRdyHint)
+	hint := struct {
+		Depth   int64 `json:"depth"`
+		Clients int   `json:"clients"`
+	}{}
+	err = json.Unmarshal(data, &hint)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hint.Depth >= 2, true)
+	assert.Equal(t, hint.Clients, 1)
+}
+
+func TestBackoffSignaling(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.BackoffFailurePercent = 50
+	options.BackoffMinSamples = 3
+	options.BackoffWindow = 50 * time.Millisecond
+	options.BackoffDuration = time.Minute
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_backoff" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 3; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+
+	// a consumer that negotiated backoff (but isn't failing)
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	data := identify(t, conn, map[string]interface{}{
+		"backoff": true,
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		Backoff bool `json:"backoff"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Backoff, true)
+	sub(t, conn, topicName, "ch")
+
+	// a consumer that requeues everything
+	failingConn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, failingConn, nil, nsq.FrameTypeResponse)
+	sub(t, failingConn, topicName, "ch")
+	err = nsq.Ready(1).Write(failingConn)
+	assert.Equal(t, err, nil)
+	for i := 0; i < 3; i++ {
+		resp, err := nsq.ReadResponse(failingConn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, frameType, nsq.FrameTypeMessage)
+		msg, err := nsq.DecodeMessage(data)
+		assert.Equal(t, err, nil)
+		cmd := &nsq.Command{Name: []byte("REQ"), Params: [][]byte{msg.Id[:], []byte("60000")}}
+		err = cmd.Write(failingConn)
+		assert.Equal(t, err, nil)
+	}
+
+	// the other consumer is told to back off
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, frameTypeBackoff)
+	backoff := struct {
+		Duration int64 `json:"duration"`
+	}{}
+	err = json.Unmarshal(data, &backoff)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, backoff.Duration > 0 && backoff.Duration <= int64(time.Minute/time.Millisecond), true)
+	assert.Equal(t, atomic.LoadUint64(&channel.backoffCount), uint64(1))
+}
+
+func TestMsgDeadlines(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, _, nsqd := mustStartNSQD(NewNSQDOptions())
+	defer nsqd.Exit()
+
+	topicName := "test_msg_deadlines" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic.PutMessage(msg)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	data := identify(t, conn, map[string]interface{}{
+		"msg_deadlines": true,
+		"msg_timeout":   5000,
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		MsgDeadlines bool `json:"msg_deadlines"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.MsgDeadlines, true)
+	sub(t, conn, topicName, "ch")
+
+	before := time.Now()
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, frameTypeDeadlineMessage)
+
+	deadline := time.Unix(0, int64(binary.BigEndian.Uint64(data[:8])))
+	assert.Equal(t, deadline.Before(before.Add(5*time.Second)), false)
+	assert.Equal(t, deadline.After(time.Now().Add(5*time.Second)), false)
+	msgOut, err := nsq.DecodeMessage(data[8:])
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Id, msg.Id)
+}
+
+func tpubBody(txMsgs []*txMessage) []byte {
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, int32(len(txMsgs)))
+	for _, txMsg := range txMsgs {
+		binary.Write(&body, binary.BigEndian, int32(len(txMsg.topicName)))
+		body.WriteString(txMsg.topicName)
+		binary.Write(&body, binary.BigEndian, int32(len(txMsg.msg.Body)))
+		body.Write(txMsg.msg.Body)
+	}
+	return body.Bytes()
+}
+
+func readBatch(t *testing.T, conn io.Reader) []*nsq.Message {
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, frameTypeMessageBatch)
+
+	var msgs []*nsq.Message
+	count := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	for i := uint32(0); i < count; i++ {
+		size := binary.BigEndian.Uint32(data)
+		msg, err := nsq.DecodeMessage(data[4 : 4+size])
+		assert.Equal(t, err, nil)
+		msgs = append(msgs, msg)
+		data = data[4+size:]
+	}
+	assert.Equal(t, len(data), 0)
+	return msgs
+}
+
+func TestMessageBatching(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_batching" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body "+strconv.Itoa(i))))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	data := identify(t, conn, map[string]interface{}{
+		"batch_max_count": 3,
+		"batch_timeout":   5000,
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		BatchMaxCount int   `json:"batch_max_count"`
+		BatchMaxBytes int   `json:"batch_max_bytes"`
+		BatchTimeout  int64 `json:"batch_timeout"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.BatchMaxCount, 3)
+	assert.Equal(t, r.BatchMaxBytes, 64*1024)
+	// capped by --max-output-buffer-timeout
+	assert.Equal(t, r.BatchTimeout, int64(1000))
+
+	sub(t, conn, topicName, "ch")
+	err = nsq.Ready(4).Write(conn)
+	assert.Equal(t, err, nil)
+
+	// a full batch, then (once RDY is exhausted) what's pending
+	msgs := readBatch(t, conn)
+	assert.Equal(t, len(msgs), 3)
+	msgs = append(msgs, readBatch(t, conn)...)
+	assert.Equal(t, len(msgs), 4)
+	for i, msg := range msgs {
+		assert.Equal(t, string(msg.Body), "test body "+strconv.Itoa(i))
+	}
+
+	// a partial batch is sent after the batch timeout
+	for _, msg := range msgs {
+		err = nsq.Finish(msg.Id).Write(conn)
+		assert.Equal(t, err, nil)
+	}
+	err = nsq.Ready(4).Write(conn)
+	assert.Equal(t, err, nil)
+	start := time.Now()
+	msgs = readBatch(t, conn)
+	assert.Equal(t, len(msgs), 1)
+	assert.Equal(t, string(msgs[0].Body), "test body 4")
+	assert.Equal(t, time.Since(start) >= 900*time.Millisecond, true)
+}
+
+func TestTPUB(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	eventTopic := "test_tpub_event" + suffix
+	effectTopic := "test_tpub_effect" + suffix
+
+	tpub := func(conn net.Conn, txMsgs []*txMessage) (int32, string) {
+		body := tpubBody(txMsgs)
+		var buf bytes.Buffer
+		buf.WriteString("TPUB\n")
+		binary.Write(&buf, binary.BigEndian, int32(len(body)))
+		buf.Write(body)
+		_, err := conn.Write(buf.Bytes())
+		assert.Equal(t, err, nil)
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		return frameType, string(data)
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	frameType, data := tpub(conn, []*txMessage{
+		{eventTopic, nsq.NewMessage(nsq.MessageID{}, []byte("event"))},
+		{effectTopic, nsq.NewMessage(nsq.MessageID{}, []byte("effect 1"))},
+		{effectTopic, nsq.NewMessage(nsq.MessageID{}, []byte("effect 2"))},
+	})
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, data, "OK")
+
+	time.Sleep(5 * time.Millisecond)
+	eventDepth := nsqd.GetTopic(eventTopic).Depth()
+	assert.Equal(t, eventDepth, int64(1))
+	assert.Equal(t, nsqd.GetTopic(effectTopic).Depth(), int64(2))
+
+	// nothing is published if any part of the transaction is invalid
+	conn2, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn2.Close()
+	frameType, data = tpub(conn2, []*txMessage{
+		{eventTopic, nsq.NewMessage(nsq.MessageID{}, []byte("event"))},
+		{"bad/topic", nsq.NewMessage(nsq.MessageID{}, []byte("effect"))},
+	})
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, strings.HasPrefix(data, "E_BAD_TOPIC"), true)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, nsqd.GetTopic(eventTopic).Depth(), eventDepth)
+
+	// a sharded topic's messages go to its shards, as they do when published
+	shardedTopic := "test_tpub_shard" + suffix
+	err = nsqd.SetShards(shardedTopic, 2)
+	assert.Equal(t, err, nil)
+	frameType, data = tpub(conn, []*txMessage{
+		{shardedTopic, nsq.NewMessage(nsq.MessageID{}, []byte("sharded"))},
+	})
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	time.Sleep(5 * time.Millisecond)
+	_, err = nsqd.GetExistingTopic(shardedTopic)
+	assert.NotEqual(t, err, nil)
+	var shardedDepth int64
+	for _, name := range util.ShardTopicNames(shardedTopic, 2) {
+		shardedDepth += nsqd.GetTopic(name).Depth()
+	}
+	assert.Equal(t, shardedDepth, int64(1))
+
+	// committed transactions are replayed on startup, uncommitted are discarded
+	recoverTopic := "test_tpub_recover" + suffix
+	committed := []*txMessage{{recoverTopic, nsq.NewMessage(<-nsqd.idChan, []byte("committed"))}}
+	err = writeTransaction(nsqd.txFileName(committed[0].msg.Id, "commit"), committed, nil)
+	assert.Equal(t, err, nil)
+	staged := []*txMessage{{recoverTopic, nsq.NewMessage(<-nsqd.idChan, []byte("staged"))}}
+	err = writeTransaction(nsqd.txFileName(staged[0].msg.Id, "staged"), staged, nil)
+	assert.Equal(t, err, nil)
+
+	nsqd.RecoverTransactions()
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, nsqd.GetTopic(recoverTopic).Depth(), int64(1))
+	_, err = os.Stat(nsqd.txFileName(committed[0].msg.Id, "commit"))
+	assert.Equal(t, os.IsNotExist(err), true)
+	_, err = os.Stat(nsqd.txFileName(staged[0].msg.Id, "staged"))
+	assert.Equal(t, os.IsNotExist(err), true)
+
+	// a transaction for a topic the creation policy won't allow is quarantined
+	deniedTopic := "test_tpub_denied" + suffix
+	denied := []*txMessage{{deniedTopic, nsq.NewMessage(<-nsqd.idChan, []byte("denied"))}}
+	err = writeTransaction(nsqd.txFileName(denied[0].msg.Id, "commit"), denied, nil)
+	assert.Equal(t, err, nil)
+	nsqd.creationPolicy = &creationPolicy{DefaultDeny: true}
+
+	nsqd.RecoverTransactions()
+	_, err = nsqd.GetExistingTopic(deniedTopic)
+	assert.NotEqual(t, err, nil)
+	_, err = os.Stat(nsqd.txFileName(denied[0].msg.Id, "commit"))
+	assert.Equal(t, os.IsNotExist(err), true)
+	_, err = os.Stat(nsqd.txFileName(denied[0].msg.Id, txQuarantinedSuffix))
+	assert.Equal(t, err, nil)
+
+	// and left alone from then on
+	nsqd.RecoverTransactions()
+	_, err = os.Stat(nsqd.txFileName(denied[0].msg.Id, txQuarantinedSuffix))
+	assert.Equal(t, err, nil)
+}
+
 func BenchmarkProtocolV2Exec(b *testing.B) {
 	b.StopTimer()
 	log.SetOutput(ioutil.Discard)
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// pausing a topic's publishes stops new messages getting to its channels,
+// which keep delivering what they already have (unlike pausing a channel,
+// which stops delivery), to stop the bleeding at the producers' side:
+//
+//  * reject fails publishes to the topic (E_PUBLISH_PAUSED, a 503 over HTTP)
+//  * buffer accepts them but keeps them in the topic (as pausing the topic
+//    does) until publishes are unpaused
+//
+// it's independent of pausing the topic, unpausing publishes doesn't unpause a
+// paused topic (or the other way around)
+
+type publishPauseMode int32
+
+const (
+	publishPauseNone publishPauseMode = iota
+	publishPauseReject
+	publishPauseBuffer
+)
+
+var errPublishPaused = errors.New("publishing is paused")
+
+func (m publishPauseMode) String() string {
+	switch m {
+	case publishPauseReject:
+		return "reject"
+	case publishPauseBuffer:
+		return "buffer"
+	}
+	return ""
+}
+
+func parsePublishPauseMode(s string) (publishPauseMode, error) {
+	switch s {
+	case "", "reject":
+		return publishPauseReject, nil
+	case "buffer":
+		return publishPauseBuffer, nil
+	}
+	return publishPauseNone, fmt.Errorf("invalid publish pause mode %s (reject or buffer)", s)
+}
+
+// PausePublish pauses publishes to the topic (see publishPauseMode)
+func (t *Topic) PausePublish(mode publishPauseMode) error {
+	return t.doPausePublish(mode)
+}
+
+func (t *Topic) UnPausePublish() error {
+	return t.doPausePublish(publishPauseNone)
+}
+
+func (t *Topic) doPausePublish(mode publishPauseMode) error {
+	atomic.StoreInt32(&t.publishPaused, int32(mode))
+
+	// messagePump holds messages when the topic is paused or buffering
+	select {
+	case t.pauseChan <- t.pumpPaused():
+		t.context.nsqd.Lock()
+		defer t.context.nsqd.Unlock()
+		return t.context.nsqd.PersistMetadata()
+	case <-t.exitChan:
+	}
+
+	return nil
+}
+
+func (t *Topic) PublishPaused() publishPauseMode {
+	return publishPauseMode(atomic.LoadInt32(&t.publishPaused))
+}
+
+// checkPublish returns why a publish to the topic fails, if it does, this
+// expects the caller to hold the (read) lock
+func (t *Topic) checkPublish() error {
+	if t.PublishPaused() == publishPauseReject {
+		return errPublishPaused
+	}
+	if t.full() {
+		return errTopicFull
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestPublishPause(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_publish_pause" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("before")))
+
+	url := fmt.Sprintf("http://%s/pause_topic_publish?topic=%s&mode=reject", httpAddr, topicName)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, topic.PublishPaused(), publishPauseReject)
+	assert.Equal(t, NewTopicStats(topic, nil).PublishPaused, "reject")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	err = nsq.Publish(topicName, []byte("rejected")).Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeError, "E_PUBLISH_PAUSED PUB failed publishing is paused")
+
+	url = fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("rejected"))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 503)
+
+	// what the channel has is still delivered
+	assert.Equal(t, channel.Depth(), int64(1))
+	subConn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	sub(t, subConn, topicName, "ch")
+	err = nsq.Ready(1).Write(subConn)
+	assert.Equal(t, err, nil)
+	r, err := nsq.ReadResponse(subConn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msg, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(msg.Body), "before")
+
+	// buffered publishes are kept in the topic until publishes are unpaused
+	err = topic.PausePublish(publishPauseBuffer)
+	assert.Equal(t, err, nil)
+	err = nsqd.PutMessages(topicName, []*nsq.Message{nsq.NewMessage(<-nsqd.idChan, []byte("buffered"))})
+	assert.Equal(t, err, nil)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, topic.Depth(), int64(1))
+
+	err = topic.UnPausePublish()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, topic.PublishPaused(), publishPauseNone)
+	r, err = nsq.ReadResponse(subConn)
+	assert.Equal(t, err, nil)
+	frameType, data, err = nsq.UnpackResponse(r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msg, err = nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(msg.Body), "buffered")
+
+	_, err = parsePublishPauseMode("drop")
+	assert.NotEqual(t, err, nil)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// replay tooling can publish a message with its original timestamp (PUB's
+// timestamp=<unix ns> or /put and /mput's X-NSQ-Timestamp header) so that
+// what's derived from it (ie. its age, consumers' lag) stays meaningful during
+// a backfill... a timestamp can't be in the future (beyond clock skew) nor
+// older than --max-publish-timestamp-age
+
+// how far in the future a published timestamp can be (clock skew between the
+// publisher and nsqd)
+const publishTimestampSkew = time.Minute
+
+// timestampParam prefixes PUB's timestamp parameter
+var timestampParam = []byte("timestamp=")
+
+var (
+	errInvalidTimestamp = errors.New("invalid timestamp")
+	errFutureTimestamp  = errors.New("timestamp is in the future")
+	errExpiredTimestamp = errors.New("timestamp is older than --max-publish-timestamp-age")
+)
+
+// parsePublishTimestamp parses (and sanity checks) a published timestamp, in
+// unix nanoseconds
+func (n *NSQD) parsePublishTimestamp(s string) (int64, error) {
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ts <= 0 {
+		return 0, errInvalidTimestamp
+	}
+
+	now := time.Now()
+	if ts > now.Add(publishTimestampSkew).UnixNano() {
+		return 0, errFutureTimestamp
+	}
+	maxAge := n.options.MaxPublishTimestampAge
+	if maxAge > 0 && ts < now.Add(-maxAge).UnixNano() {
+		return 0, errExpiredTimestamp
+	}
+	return ts, nil
+}
+
+// publishTimestamp returns the X-NSQ-Timestamp of an HTTP publish, 0 without
+// one
+func (n *NSQD) publishTimestamp(req *http.Request) (int64, error) {
+	ts := req.Header.Get("X-NSQ-Timestamp")
+	if ts == "" {
+		return 0, nil
+	}
+	return n.parsePublishTimestamp(ts)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestPublishTimestamp(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.MaxPublishTimestampAge = 24 * time.Hour
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	now := time.Now()
+	_, err := nsqd.parsePublishTimestamp("abc")
+	assert.Equal(t, err, errInvalidTimestamp)
+	_, err = nsqd.parsePublishTimestamp(strconv.FormatInt(now.Add(time.Hour).UnixNano(), 10))
+	assert.Equal(t, err, errFutureTimestamp)
+	_, err = nsqd.parsePublishTimestamp(strconv.FormatInt(now.Add(-48*time.Hour).UnixNano(), 10))
+	assert.Equal(t, err, errExpiredTimestamp)
+
+	topicName := "test_publish_timestamp" + strconv.Itoa(int(time.Now().Unix()))
+	ts := now.Add(-time.Hour).UnixNano()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+
+	cmd := &nsq.Command{
+		Name:   []byte("PUB"),
+		Params: [][]byte{[]byte(topicName), []byte("timestamp=" + strconv.FormatInt(ts, 10))},
+		Body:   []byte("test body"),
+	}
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeResponse, "OK")
+
+	// one in the future is refused
+	cmd.Params[1] = []byte("timestamp=" + strconv.FormatInt(now.Add(time.Hour).UnixNano(), 10))
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, _, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+
+	endpoint := fmt.Sprintf("http://%s/put?topic=%s", httpAddr, topicName)
+	req, _ := http.NewRequest("POST", endpoint, bytes.NewBufferString("test body"))
+	req.Header.Set("X-NSQ-Timestamp", strconv.FormatInt(ts+1, 10))
+	httpResp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, err, nil)
+	httpResp.Body.Close()
+	assert.Equal(t, httpResp.StatusCode, 200)
+
+	sub(t, conn, topicName, "ch")
+	err = nsq.Ready(2).Write(conn)
+	assert.Equal(t, err, nil)
+	for i := int64(0); i < 2; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, frameType, nsq.FrameTypeMessage)
+		msg, err := nsq.DecodeMessage(data)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, msg.Timestamp, ts+i)
+	}
+}
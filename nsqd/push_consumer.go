@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+)
+
+// a push consumer is an HTTP endpoint a channel's messages are POSTed to (by
+// nsqd, rather than the endpoint subscribing), with:
+//
+//	X-NSQ-Message-ID, X-NSQ-Attempts, X-NSQ-Timestamp (ns)
+//	X-NSQ-Topic, X-NSQ-Channel
+//
+// headers and the message as the body. A 2xx response FINs the message,
+// anything else (or no response within --msg-timeout) REQs it and backs the
+// consumer off, for 1s doubling with each failure in a row up to
+// pushMaxBackoff. Up to concurrency messages are POSTed at a time and, with a
+// max rate, no more than that many per second.
+//
+// push consumers are added to a channel like any other client (so they show in
+// its stats and are closed with it) and persisted in the metadata
+
+const pushMaxBackoff = 2 * time.Minute
+
+var errInvalidPushURL = errors.New("invalid push consumer URL")
+
+type pushConsumer struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	InFlightCount int64
+	MessageCount  uint64
+	FinishCount   uint64
+	RequeueCount  uint64
+
+	// it isn't sent messages until this (unix nanoseconds) after a failure
+	backoffUntil int64
+	failures     int64
+
+	ID          int64
+	URL         string
+	Concurrency int64
+	MaxRate     int64
+	ConnectTime time.Time
+
+	channel    *Channel
+	httpclient *http.Client
+
+	// only messagePump touches these
+	rateSecond int64
+	rateCount  int64
+
+	// readyStateChan has a buffer of 1 to guarantee that in the event
+	// there is a race the state update is not lost
+	readyStateChan chan int
+	exitChan       chan int
+	closeOnce      sync.Once
+	waitGroup      util.WaitGroupWrapper
+}
+
+// pushConsumerConfig is how a push consumer is persisted (and listed)
+type pushConsumerConfig struct {
+	URL         string `json:"url"`
+	Concurrency int64  `json:"concurrency"`
+	MaxRate     int64  `json:"max_rate"`
+}
+
+func newPushConsumer(channel *Channel, endpoint string, concurrency int64, maxRate int64) *pushConsumer {
+	p := &pushConsumer{
+		ID:             atomic.AddInt64(&channel.context.nsqd.clientIDSequence, 1),
+		URL:            endpoint,
+		Concurrency:    concurrency,
+		MaxRate:        maxRate,
+		ConnectTime:    time.Now(),
+		channel:        channel,
+		httpclient:     &http.Client{Transport: util.NewDeadlineTransport(channel.context.nsqd.options.MsgTimeout)},
+		readyStateChan: make(chan int, 1),
+		exitChan:       make(chan int),
+	}
+	go p.messagePump()
+	return p
+}
+
+func (p *pushConsumer) String() string {
+	return fmt.Sprintf("PUSH:%s", p.URL)
+}
+
+func (p *pushConsumer) isReady() bool {
+	return !p.channel.IsPaused() && atomic.LoadInt64(&p.InFlightCount) < p.Concurrency
+}
+
+// wait returns how long until it can be sent another message, because it's
+// backing off or is at its max rate
+func (p *pushConsumer) wait() time.Duration {
+	now := time.Now()
+	if until := atomic.LoadInt64(&p.backoffUntil); until > now.UnixNano() {
+		return time.Duration(until - now.UnixNano())
+	}
+	if p.MaxRate > 0 {
+		if now.Unix() != p.rateSecond {
+			p.rateSecond = now.Unix()
+			p.rateCount = 0
+		}
+		if p.rateCount >= p.MaxRate {
+			return time.Unix(p.rateSecond+1, 0).Sub(now)
+		}
+	}
+	return 0
+}
+
+func (p *pushConsumer) messagePump() {
+	for {
+		var msgChan chan *nsq.Message
+		var waitChan <-chan time.Time
+		if wait := p.wait(); wait > 0 {
+			waitChan = time.After(wait)
+		} else if p.isReady() {
+			msgChan = p.channel.clientMsgChan
+		}
+
+		select {
+		case msg, ok := <-msgChan:
+			if !ok {
+				goto exit
+			}
+			p.channel.StartInFlightTimeout(msg, p.ID, p.channel.context.nsqd.options.MsgTimeout)
+			p.SendingMessage()
+			p.rateCount++
+			p.waitGroup.Wrap(func() { p.push(msg) })
+		case <-waitChan:
+		case <-p.readyStateChan:
+		case <-p.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	p.waitGroup.Wait()
+	log.Printf("PUSH: [%s] exiting messagePump", p)
+}
+
+func (p *pushConsumer) push(msg *nsq.Message) {
+	err := p.post(msg)
+	if err == nil {
+		atomic.StoreInt64(&p.failures, 0)
+		if p.channel.FinishMessage(p.ID, msg.Id) == nil {
+			p.FinishedMessage()
+		}
+		return
+	}
+
+	backoff := p.backoff()
+	log.Printf("PUSH: [%s] failed to push %s (backing off %s) - %s", p, msg.Id, backoff, err.Error())
+	if p.channel.RequeueMessage(p.ID, msg.Id, backoff) == nil {
+		p.RequeuedMessage()
+	}
+}
+
+func (p *pushConsumer) post(msg *nsq.Message) error {
+	req, err := http.NewRequest("POST", p.URL, bytes.NewReader(msg.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-NSQ-Message-ID", string(msg.Id[:]))
+	req.Header.Set("X-NSQ-Attempts", strconv.Itoa(int(msg.Attempts)))
+	req.Header.Set("X-NSQ-Timestamp", strconv.FormatInt(msg.Timestamp, 10))
+	req.Header.Set("X-NSQ-Topic", p.channel.topicName)
+	req.Header.Set("X-NSQ-Channel", p.channel.name)
+
+	resp, err := p.httpclient.Do(req)
+	if err != nil {
+		return err
+	}
+	// read (some of) the body so that the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got response %s", resp.Status)
+	}
+	return nil
+}
+
+// backoff counts a failure and returns how long the consumer (and the failed
+// message) backs off for
+func (p *pushConsumer) backoff() time.Duration {
+	failures := atomic.AddInt64(&p.failures, 1)
+	backoff := pushMaxBackoff
+	if failures < 8 {
+		backoff = time.Second << uint(failures-1)
+		if backoff > pushMaxBackoff {
+			backoff = pushMaxBackoff
+		}
+	}
+	atomic.StoreInt64(&p.backoffUntil, time.Now().Add(backoff).UnixNano())
+	p.tryUpdateReadyState()
+	return backoff
+}
+
+func (p *pushConsumer) tryUpdateReadyState() {
+	select {
+	case p.readyStateChan <- 1:
+	default:
+	}
+}
+
+func (p *pushConsumer) Pause() {
+	p.tryUpdateReadyState()
+}
+
+func (p *pushConsumer) UnPause() {
+	p.tryUpdateReadyState()
+}
+
+func (p *pushConsumer) Close() error {
+	p.closeOnce.Do(func() { close(p.exitChan) })
+	return nil
+}
+
+func (p *pushConsumer) SendingMessage() {
+	atomic.AddInt64(&p.InFlightCount, 1)
+	atomic.AddUint64(&p.MessageCount, 1)
+}
+
+func (p *pushConsumer) FinishedMessage() {
+	atomic.AddUint64(&p.FinishCount, 1)
+	atomic.AddInt64(&p.InFlightCount, -1)
+	p.tryUpdateReadyState()
+}
+
+func (p *pushConsumer) RequeuedMessage() {
+	atomic.AddUint64(&p.RequeueCount, 1)
+	atomic.AddInt64(&p.InFlightCount, -1)
+	p.tryUpdateReadyState()
+}
+
+func (p *pushConsumer) TimedOutMessage() {
+	atomic.AddInt64(&p.InFlightCount, -1)
+	p.tryUpdateReadyState()
+}
+
+func (p *pushConsumer) Empty() {
+	atomic.StoreInt64(&p.InFlightCount, 0)
+	p.tryUpdateReadyState()
+}
+
+func (p *pushConsumer) Stats() ClientStats {
+	inFlight := atomic.LoadInt64(&p.InFlightCount)
+	readyCount := p.Concurrency - inFlight
+	if readyCount < 0 || atomic.LoadInt64(&p.backoffUntil) > time.Now().UnixNano() {
+		readyCount = 0
+	}
+	remoteAddress := p.URL
+	if u, err := url.Parse(p.URL); err == nil {
+		remoteAddress = u.Host
+	}
+	return ClientStats{
+		ID:            p.ID,
+		Version:       "PUSH",
+		RemoteAddress: remoteAddress,
+		Name:          p.URL,
+		State:         nsq.StateSubscribed,
+		ReadyCount:    readyCount,
+		InFlightCount: inFlight,
+		MessageCount:  atomic.LoadUint64(&p.MessageCount),
+		FinishCount:   atomic.LoadUint64(&p.FinishCount),
+		RequeueCount:  atomic.LoadUint64(&p.RequeueCount),
+		ConnectTime:   p.ConnectTime.Unix(),
+	}
+}
+
+func validPushURL(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// AddPushConsumer has the channel's messages POSTed to endpoint, adding it
+// again replaces its concurrency and max rate (0 is uncapped)
+func (c *Channel) AddPushConsumer(endpoint string, concurrency int64, maxRate int64) error {
+	if !validPushURL(endpoint) {
+		return errInvalidPushURL
+	}
+
+	c.addPushConsumer(endpoint, concurrency, maxRate)
+
+	c.context.nsqd.Lock()
+	defer c.context.nsqd.Unlock()
+	return c.context.nsqd.PersistMetadata()
+}
+
+func (c *Channel) addPushConsumer(endpoint string, concurrency int64, maxRate int64) {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+
+	old, ok := c.pushConsumers[endpoint]
+
+	p := newPushConsumer(c, endpoint, concurrency, maxRate)
+	c.pushConsumers[endpoint] = p
+	c.AddClient(p.ID, p)
+
+	// (after adding its replacement, so an ephemeral channel isn't deleted)
+	if ok {
+		old.Close()
+		c.RemoveClient(old.ID)
+	}
+
+	log.Printf("CHANNEL(%s): pushing to %s (concurrency %d, max rate %d/s)",
+		c.name, endpoint, concurrency, maxRate)
+}
+
+// RemovePushConsumer stops POSTing the channel's messages to endpoint, its in
+// flight messages time out as any disconnected client's do
+func (c *Channel) RemovePushConsumer(endpoint string) error {
+	c.pushLock.Lock()
+	p, ok := c.pushConsumers[endpoint]
+	if ok {
+		delete(c.pushConsumers, endpoint)
+	}
+	c.pushLock.Unlock()
+	if !ok {
+		return errInvalidPushURL
+	}
+
+	p.Close()
+	c.RemoveClient(p.ID)
+	log.Printf("CHANNEL(%s): not pushing to %s", c.name, endpoint)
+
+	c.context.nsqd.Lock()
+	defer c.context.nsqd.Unlock()
+	return c.context.nsqd.PersistMetadata()
+}
+
+// PushConsumers returns the channel's push consumers, by URL
+func (c *Channel) PushConsumers() []pushConsumerConfig {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+
+	configs := make([]pushConsumerConfig, 0, len(c.pushConsumers))
+	for _, p := range c.pushConsumers {
+		configs = append(configs, pushConsumerConfig{p.URL, p.Concurrency, p.MaxRate})
+	}
+	sort.Sort(pushConsumerConfigsByURL(configs))
+	return configs
+}
+
+type pushConsumerConfigsByURL []pushConsumerConfig
+
+func (s pushConsumerConfigsByURL) Len() int           { return len(s) }
+func (s pushConsumerConfigsByURL) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s pushConsumerConfigsByURL) Less(i, j int) bool { return s[i].URL < s[j].URL }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestPushConsumer(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	var mutex sync.Mutex
+	var attempts []string
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mutex.Lock()
+		attempts = append(attempts, req.Header.Get("X-NSQ-Attempts"))
+		bodies = append(bodies, string(body))
+		failed := len(attempts) == 1
+		mutex.Unlock()
+		// the first attempt fails
+		if failed {
+			w.WriteHeader(503)
+		}
+	}))
+	defer ts.Close()
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_push" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	endpoint := fmt.Sprintf("http://%s/add_push_consumer?topic=%s&channel=ch&url=%s&concurrency=2",
+		httpAddr, topicName, url.QueryEscape(ts.URL))
+	resp, err := http.Get(endpoint)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, channel.PushConsumers(), []pushConsumerConfig{{ts.URL, 2, 0}})
+
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+
+	// a 5xx REQs the message, which is pushed again after backing off
+	var stats []ClientStats
+	for i := 0; i < 300; i++ {
+		stats = NewChannelStats(channel, nil).Clients
+		if len(stats) == 1 && stats[0].FinishCount == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, len(stats), 1)
+	assert.Equal(t, stats[0].Version, "PUSH")
+	assert.Equal(t, stats[0].RequeueCount, uint64(1))
+	assert.Equal(t, stats[0].FinishCount, uint64(1))
+	mutex.Lock()
+	assert.Equal(t, attempts, []string{"1", "2"})
+	assert.Equal(t, bodies, []string{"test body", "test body"})
+	mutex.Unlock()
+
+	// it has to be an http(s) URL
+	endpoint = fmt.Sprintf("http://%s/add_push_consumer?topic=%s&channel=ch&url=ftp://example.com",
+		httpAddr, topicName)
+	resp, err = http.Get(endpoint)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+
+	endpoint = fmt.Sprintf("http://%s/remove_push_consumer?topic=%s&channel=ch&url=%s",
+		httpAddr, topicName, url.QueryEscape(ts.URL))
+	resp, err = http.Get(endpoint)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, len(channel.PushConsumers()), 0)
+	assert.Equal(t, len(NewChannelStats(channel, nil).Clients), 0)
+}
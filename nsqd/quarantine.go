@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/nsq/util"
+)
+
+// a consumer fleet that's crash looping (or failing every message) keeps its
+// channel redelivering the same messages forever, burning CPU and disk... with
+// --quarantine-requeue-percent a channel whose messages were mostly requeued
+// (REQ'd or timed out rather than FIN'd) over a --quarantine-window is
+// quarantined: it's paused, an error is logged and --quarantine-webhook-url is
+// POSTed to. It stays paused until it's released (/channel/quarantine/release
+// or /unpause_channel).
+
+var errNotQuarantined = errors.New("channel is not quarantined")
+
+type quarantineWebhookPayload struct {
+	Event     string `json:"event"`
+	Topic     string `json:"topic"`
+	Channel   string `json:"channel"`
+	Finished  uint64 `json:"finished"`
+	Requeued  uint64 `json:"requeued"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// quarantineLoop checks every channel's FIN/requeues every --quarantine-window
+func (n *NSQD) quarantineLoop() {
+	httpclient := &http.Client{Transport: util.NewDeadlineTransport(2 * time.Second)}
+	ticker := time.NewTicker(n.options.QuarantineWindow)
+	for {
+		select {
+		case <-n.exitChan:
+			goto exit
+		case <-ticker.C:
+			for _, c := range n.channels() {
+				finished := takeUint64(&c.windowFinishCount)
+				requeued := takeUint64(&c.windowRequeueCount)
+				if !n.requeueStorm(finished, requeued) || c.IsQuarantined() || c.IsPaused() {
+					continue
+				}
+				c.Quarantine(finished, requeued)
+				n.postQuarantineWebhook(httpclient, c, "quarantined", finished, requeued)
+			}
+		}
+	}
+
+exit:
+	ticker.Stop()
+}
+
+// takeUint64 atomically zeroes *addr, returning what it was (atomic.Swap*
+// needs Go 1.2)
+func takeUint64(addr *uint64) uint64 {
+	val := atomic.LoadUint64(addr)
+	for !atomic.CompareAndSwapUint64(addr, val, 0) {
+		val = atomic.LoadUint64(addr)
+	}
+	return val
+}
+
+// takeInt64 is takeUint64 for an int64
+func takeInt64(addr *int64) int64 {
+	val := atomic.LoadInt64(addr)
+	for !atomic.CompareAndSwapInt64(addr, val, 0) {
+		val = atomic.LoadInt64(addr)
+	}
+	return val
+}
+
+// requeueStorm returns whether at least --quarantine-requeue-percent of (at
+// least --quarantine-min-messages) messages were requeued
+func (n *NSQD) requeueStorm(finished uint64, requeued uint64) bool {
+	total := finished + requeued
+	if total == 0 || total < uint64(n.options.QuarantineMinMessages) {
+		return false
+	}
+	return requeued*100 >= total*uint64(n.options.QuarantineRequeuePercent)
+}
+
+func (n *NSQD) postQuarantineWebhook(httpclient *http.Client, c *Channel, event string,
+	finished uint64, requeued uint64) {
+	if n.options.QuarantineWebhookURL == "" {
+		return
+	}
+	err := postWebhook(httpclient, n.options.QuarantineWebhookURL, &quarantineWebhookPayload{
+		Event:     event,
+		Topic:     c.topicName,
+		Channel:   c.name,
+		Finished:  finished,
+		Requeued:  requeued,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		log.Printf("ERROR: CHANNEL(%s:%s) quarantine webhook failed - %s", c.topicName, c.name, err.Error())
+	}
+}
+
+// Quarantine pauses the channel because of a requeue storm
+func (c *Channel) Quarantine(finished uint64, requeued uint64) error {
+	c.setQuarantinedAt(time.Now().Unix())
+	log.Printf("ERROR: CHANNEL(%s:%s) quarantined, %d of %d messages requeued", c.topicName, c.name,
+		requeued, finished+requeued)
+	return c.Pause()
+}
+
+// ReleaseQuarantine unpauses a quarantined channel
+func (c *Channel) ReleaseQuarantine() error {
+	if !c.IsQuarantined() {
+		return errNotQuarantined
+	}
+	return c.UnPause()
+}
+
+// IsQuarantined returns whether the channel is paused because of a requeue
+// storm
+func (c *Channel) IsQuarantined() bool {
+	return c.QuarantinedAt() > 0
+}
+
+// QuarantinedAt returns the unix timestamp the channel was quarantined at, 0
+// if it isn't
+func (c *Channel) QuarantinedAt() int64 {
+	return atomic.LoadInt64(&c.quarantinedAt)
+}
+
+func (c *Channel) setQuarantinedAt(ts int64) {
+	atomic.StoreInt64(&c.quarantinedAt, ts)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestQuarantine(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.QuarantineRequeuePercent = 50
+	options.QuarantineWindow = 50 * time.Millisecond
+	// (the window can end part way through the FIN/REQs below)
+	options.QuarantineMinMessages = 1
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	assert.Equal(t, nsqd.requeueStorm(0, 0), false)
+	assert.Equal(t, nsqd.requeueStorm(1, 1), true)
+	assert.Equal(t, nsqd.requeueStorm(2, 1), false)
+
+	topicName := "test_quarantine" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	for i := 0; i < 4; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+		err := channel.StartInFlightTimeout(msg, 0, time.Minute)
+		assert.Equal(t, err, nil)
+		if i == 0 {
+			err = channel.FinishMessage(0, msg.Id)
+		} else {
+			err = channel.RequeueMessage(0, msg.Id, 0)
+		}
+		assert.Equal(t, err, nil)
+	}
+
+	for i := 0; !channel.IsQuarantined() && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, channel.IsQuarantined(), true)
+	assert.Equal(t, channel.IsPaused(), true)
+
+	data, err := util.ApiRequest(fmt.Sprintf("http://%s/stats?format=json", httpAddr))
+	assert.Equal(t, err, nil)
+	channelStats := data.Get("topics").GetIndex(0).Get("channels").GetIndex(0)
+	assert.Equal(t, channelStats.Get("quarantined").MustBool(), true)
+	assert.NotEqual(t, channelStats.Get("quarantined_at").MustInt64(), int64(0))
+
+	endpoint := fmt.Sprintf("http://%s/channel/quarantine/release?topic=%s&channel=ch", httpAddr, topicName)
+	_, err = util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, channel.IsQuarantined(), false)
+	assert.Equal(t, channel.IsPaused(), false)
+
+	_, err = util.ApiRequest(endpoint)
+	assert.NotEqual(t, err, nil)
+
+	nsqd.DeleteExistingTopic(topicName)
+}
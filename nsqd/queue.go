@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"time"
 
 	"github.com/bitly/go-nsq"
 )
@@ -10,11 +11,18 @@ import (
 // storage system
 type BackendQueue interface {
 	Put([]byte) error
-	ReadChan() chan []byte // this is expected to be an *unbuffered* channel
+	PutMany([][]byte) error // writes the []byte together, none are read until all are written
+	ReadChan() chan []byte  // this is expected to be an *unbuffered* channel
+	Peek() []byte           // what will next be read, if known
 	Close() error
 	Delete() error
 	Depth() int64
 	Empty() error
+	Filter(func([]byte) bool) (int64, error)    // removes (and counts) the data the func returns true for
+	SkipWhile(func([]byte) bool) (int64, error) // advances past (and counts) the data at the head the func returns true for
+	Snapshot(func([]byte) error) error          // calls the func for the data queued, without reading it from the queue
+	Sync() error                                // makes what has been Put durable now
+	SetSyncInterval(int64, time.Duration)       // how often what is Put is made durable (every N puts and/or duration)
 }
 
 type DummyBackendQueue struct {
@@ -29,10 +37,18 @@ func (d *DummyBackendQueue) Put([]byte) error {
 	return nil
 }
 
+func (d *DummyBackendQueue) PutMany([][]byte) error {
+	return nil
+}
+
 func (d *DummyBackendQueue) ReadChan() chan []byte {
 	return d.readChan
 }
 
+func (d *DummyBackendQueue) Peek() []byte {
+	return nil
+}
+
 func (d *DummyBackendQueue) Close() error {
 	return nil
 }
@@ -49,6 +65,25 @@ func (d *DummyBackendQueue) Empty() error {
 	return nil
 }
 
+func (d *DummyBackendQueue) Filter(func([]byte) bool) (int64, error) {
+	return 0, nil
+}
+
+func (d *DummyBackendQueue) SkipWhile(func([]byte) bool) (int64, error) {
+	return 0, nil
+}
+
+func (d *DummyBackendQueue) Snapshot(func([]byte) error) error {
+	return nil
+}
+
+func (d *DummyBackendQueue) Sync() error {
+	return nil
+}
+
+func (d *DummyBackendQueue) SetSyncInterval(int64, time.Duration) {
+}
+
 func WriteMessageToBackend(buf *bytes.Buffer, msg *nsq.Message, bq BackendQueue) error {
 	buf.Reset()
 	err := msg.Write(buf)
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+
+	"github.com/bitly/go-nsq"
+)
+
+// a developer can capture a problematic message in a controlled environment
+// (ie. a debug consumer) by redelivering it to that client rather than
+// emptying the channel or peeking blindly... the message is taken from wherever
+// it is (in flight to another client, which is told it timed out, or deferred
+// by a REQ) and put in flight to the client, whatever its RDY
+//
+// messages queued in memory or on disk can't be looked up by ID, only those in
+// flight or deferred can be redelivered
+
+// the messages that can be waiting to be redelivered to a client
+const redeliverQueueSize = 16
+
+var (
+	errRedeliverNotFound = errors.New("message is not in flight or deferred")
+	errRedeliverClient   = errors.New("client is not subscribed to the channel")
+	errRedeliverFull     = errors.New("client has too many messages being redelivered")
+)
+
+// Redeliver takes the in-flight or deferred message id and delivers it to
+// client, which must be subscribed to the channel (and not multiplexed)
+func (c *Channel) Redeliver(id nsq.MessageID, client *ClientV2) error {
+	client.RLock()
+	subscribed := client.Channel == c
+	msgTimeout := client.MsgTimeout
+	client.RUnlock()
+	if !subscribed || atomic.LoadInt32(&client.Multiplexed) == 1 {
+		return errRedeliverClient
+	}
+
+	msg, err := c.takeMessage(id)
+	if err != nil {
+		return err
+	}
+
+	msg.Attempts++
+	err = c.StartInFlightTimeout(msg, client.ID, msgTimeout)
+	if err != nil {
+		c.doRequeue(msg)
+		return err
+	}
+	client.SendingRedeliveredMessage()
+
+	select {
+	case client.RedeliverChan <- msg:
+	default:
+		// it was never sent, it goes back to the channel
+		c.RequeueMessage(client.ID, msg.Id, 0)
+		client.TimedOutMessage()
+		return errRedeliverFull
+	}
+
+	log.Printf("CHANNEL(%s): msg(%s) redelivered to [%s]", c.name, msg.Id, client)
+	return nil
+}
+
+// takeMessage removes the message id from the channel's in-flight (the client
+// it's in flight to is told it timed out) or deferred messages
+func (c *Channel) takeMessage(id nsq.MessageID) (*nsq.Message, error) {
+	c.RLock()
+	item, ok := c.inFlightMessages[id]
+	c.RUnlock()
+	if ok {
+		clientID := item.Value.(*inFlightMessage).clientID
+		// (it may have since been FIN'd, REQ'd or timed out)
+		item, err := c.popInFlightMessage(clientID, id)
+		if err == nil {
+			c.removeFromInFlightPQ(item)
+			c.RLock()
+			client, ok := c.clients[clientID]
+			c.RUnlock()
+			if ok {
+				client.TimedOutMessage()
+			}
+			return item.Value.(*inFlightMessage).msg, nil
+		}
+	}
+
+	item, err := c.popDeferredMessage(id)
+	if err != nil {
+		return nil, errRedeliverNotFound
+	}
+	c.removeFromDeferredPQ(item)
+	return item.Value.(*nsq.Message), nil
+}
+
+// SendingRedeliveredMessage counts a message redelivered to the client, which
+// (unlike SendingMessage) doesn't use up its RDY
+func (c *ClientV2) SendingRedeliveredMessage() {
+	atomic.AddInt64(&c.InFlightCount, 1)
+	atomic.AddUint64(&c.MessageCount, 1)
+}
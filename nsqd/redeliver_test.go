@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestRedeliver(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_redeliver" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic.PutMessage(msg)
+
+	conn1, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn1.Close()
+	sub(t, conn1, topicName, "ch")
+	err = nsq.Ready(1).Write(conn1)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn1)
+	assert.Equal(t, err, nil)
+	_, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	msgOut, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Id, msg.Id)
+
+	// a debug consumer, with RDY 0
+	conn2, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn2.Close()
+	sub(t, conn2, topicName, "ch")
+	debugClientID := nsqd.clientIDSequence
+
+	redeliver := func(id string) int {
+		endpoint := fmt.Sprintf("http://%s/channel/redeliver?topic=%s&channel=ch&id=%s&client_id=%d",
+			httpAddr, topicName, url.QueryEscape(id), debugClientID)
+		resp, err := http.Get(endpoint)
+		assert.Equal(t, err, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, redeliver(string(msg.Id[:])), 200)
+
+	resp, err = nsq.ReadResponse(conn2)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msgOut, err = nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Id, msg.Id)
+	assert.Equal(t, msgOut.Attempts, uint16(2))
+
+	// it's no longer in flight to the first client
+	channel.RLock()
+	client1 := channel.clients[debugClientID-1].(*ClientV2)
+	item := channel.inFlightMessages[msg.Id]
+	channel.RUnlock()
+	assert.Equal(t, atomic.LoadInt64(&client1.InFlightCount), int64(0))
+	assert.Equal(t, item.Value.(*inFlightMessage).clientID, debugClientID)
+
+	err = nsq.Finish(msg.Id).Write(conn2)
+	assert.Equal(t, err, nil)
+
+	// it's neither in flight nor deferred anymore
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, redeliver(string(msg.Id[:])), 404)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"reflect"
+)
+
+// on SIGHUP the config file is re-read and the options that can be changed
+// at runtime applied, without restarting (or dropping any clients):
+//
+//	--lookupd-tcp-address  peers are added and removed
+//	--statsd-*             from the next push
+//	--tls-cert, --tls-key  for new TLS connections
+//	--verbose
+//
+// changes to any other option are logged as requiring a restart, as is
+// enabling or disabling TLS
+var reloadableOptions = map[string]bool{
+	"NSQLookupdTCPAddresses": true,
+	"StatsdAddress":          true,
+	"StatsdPrefix":           true,
+	"StatsdInterval":         true,
+	"StatsdMemStats":         true,
+	"TLSCert":                true,
+	"TLSKey":                 true,
+	"Verbose":                true,
+}
+
+// Reload applies the reloadable options of opts
+func (n *NSQD) Reload(opts *nsqdOptions) error {
+	if opts.StatsdInterval <= 0 {
+		return errors.New("--statsd-interval must be > 0")
+	}
+
+	log.Printf("RELOAD: applying configuration")
+
+	old := reflect.ValueOf(n.options).Elem()
+	updated := reflect.ValueOf(opts).Elem()
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		if reloadableOptions[field.Name] {
+			continue
+		}
+		if !reflect.DeepEqual(old.Field(i).Interface(), updated.Field(i).Interface()) {
+			log.Printf("WARNING: changing --%s requires a restart", field.Tag.Get("flag"))
+		}
+	}
+
+	*verbose = opts.Verbose
+
+	n.setStatsdOptions(newStatsdOptions(opts, n.httpAddr.Port))
+
+	n.reloadTLSCert(opts.TLSCert, opts.TLSKey)
+
+	select {
+	case n.lookupdAddrsChan <- opts.NSQLookupdTCPAddresses:
+	case <-n.exitChan:
+	}
+
+	return nil
+}
+
+// reloadTLSCert replaces the certificate new TLS connections are served with,
+// keeping the current one if the new one fails to load
+func (n *NSQD) reloadTLSCert(certFile string, keyFile string) {
+	enabled := certFile != "" || keyFile != ""
+	if enabled != (n.TLSConfig() != nil) {
+		log.Printf("WARNING: enabling or disabling TLS requires a restart")
+		return
+	}
+	if !enabled {
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Printf("ERROR: failed to reload TLS certificate - %s", err.Error())
+		return
+	}
+
+	// connections already upgraded keep the config they were served with
+	n.reloadMutex.Lock()
+	n.tlsConfig = newTLSConfig(cert)
+	n.reloadMutex.Unlock()
+	log.Printf("RELOAD: TLS certificate %s", certFile)
+}
+
+func newTLSConfig(cert tls.Certificate) *tls.Config {
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	tlsConfig.BuildNameToCertificate()
+	return tlsConfig
+}
+
+// TLSConfig returns the config new TLS connections are served with (nil when
+// TLS isn't enabled), a reload replaces it rather than changing it
+func (n *NSQD) TLSConfig() *tls.Config {
+	n.reloadMutex.RLock()
+	defer n.reloadMutex.RUnlock()
+	return n.tlsConfig
+}
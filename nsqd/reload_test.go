@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bitly/nsq/nsqlookupd"
+	"github.com/bmizerany/assert"
+)
+
+func TestReload(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	lookupdOptions := nsqlookupd.NewNSQLookupdOptions()
+	lookupdOptions.TCPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.HTTPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.BroadcastAddress = "127.0.0.1"
+	lookupd := nsqlookupd.NewNSQLookupd(lookupdOptions)
+	lookupd.Main()
+	defer lookupd.Exit()
+
+	options := NewNSQDOptions()
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	producers := func() int {
+		return len(lookupd.DB.FindProducers("client", "", ""))
+	}
+
+	// a lookupd peer is added...
+	reloaded := NewNSQDOptions()
+	reloaded.DataPath = options.DataPath
+	reloaded.NSQLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+	reloaded.StatsdAddress = "127.0.0.1:8125"
+	err := nsqd.Reload(reloaded)
+	assert.Equal(t, err, nil)
+	for i := 0; producers() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, producers(), 1)
+	assert.Equal(t, nsqd.getStatsdOptions().address, "127.0.0.1:8125")
+
+	// ...and removed, which lookupd notices as the connection closing
+	reloaded = NewNSQDOptions()
+	reloaded.DataPath = options.DataPath
+	err = nsqd.Reload(reloaded)
+	assert.Equal(t, err, nil)
+	for i := 0; producers() == 1 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, producers(), 0)
+	assert.Equal(t, len(nsqd.lookupHttpAddrs()), 0)
+	assert.Equal(t, nsqd.getStatsdOptions().address, "")
+
+	reloaded.StatsdInterval = 0
+	assert.NotEqual(t, nsqd.Reload(reloaded), nil)
+}
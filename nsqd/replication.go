@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+)
+
+// each --replicate-topic topic is owned by this --cluster and streamed, from
+// a channel of its own, to a remote cluster's nsqd (--replicate-to, failed
+// over in order) over the standard protocol (IDENTIFY then MPUB)
+//
+// the replicator IDENTIFYs with "replication_origin": <cluster>, which tags
+// what it publishes as replicated from that cluster, the remote nsqd then
+// marks the topic as a replica of it:
+//
+//  * a replica only accepts publishes from its origin's replicators (so
+//    publishers can't fork it), nsqlookupd reports its producers as read_only
+//    for the topic
+//  * a replica is never replicated, and a topic owned by the remote cluster
+//    (one of its --replicate-topic) refuses to become a replica, so topics
+//    can't loop between clusters
+//  * a replicator is refused by an nsqd of its own cluster
+
+const (
+	replicationChannel  = "nsqd_replication"
+	replicationMaxBatch = 100
+	replicationTimeout  = 10 * time.Second
+	replicationBackoff  = 5 * time.Second
+)
+
+var errReplicaReadOnly = errors.New("topic is a replica")
+var errReplicationConflict = errors.New("topic is owned by this cluster")
+
+// ReplicaOf returns the cluster the topic is replicated from ("" if none)
+func (t *Topic) ReplicaOf() string {
+	t.replicaLock.RLock()
+	defer t.replicaLock.RUnlock()
+	return t.replicaOf
+}
+
+// setReplicaOf makes the topic a replica of a cluster, it returns whether
+// that changed
+func (t *Topic) setReplicaOf(cluster string) bool {
+	t.replicaLock.Lock()
+	defer t.replicaLock.Unlock()
+	if t.replicaOf == cluster {
+		return false
+	}
+	log.Printf("TOPIC(%s): replica of %s", t.name, cluster)
+	t.replicaOf = cluster
+	return true
+}
+
+func (n *NSQD) ownsTopic(topicName string) bool {
+	for _, name := range n.options.ReplicateTopics {
+		if name == topicName {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReplica checks whether a publish (replicated from origin, "" for
+// a regular publish) is allowed to the topic, a replicated publish makes it
+// a replica of origin
+func (n *NSQD) checkReplica(topicName string, origin string) error {
+	if origin == "" {
+		topic, err := n.GetExistingTopic(topicName)
+		if err == nil && topic.ReplicaOf() != "" {
+			return errReplicaReadOnly
+		}
+		return nil
+	}
+
+	if n.ownsTopic(topicName) {
+		return errReplicationConflict
+	}
+	topic, err := n.AutoCreateTopic(topicName)
+	if err != nil {
+		return err
+	}
+	if topic.setReplicaOf(origin) {
+		// re-registers it with lookupd, which is told that it's a replica
+		// (and persists it)
+		n.Notify(topic)
+	}
+	return nil
+}
+
+// replicasCommand builds a REPLICAS command reporting the cluster each
+// replica topic is replicated from
+func (n *NSQD) replicasCommand() *nsq.Command {
+	replicas := make(map[string]string)
+	n.RLock()
+	for _, topic := range n.topicMap {
+		if origin := topic.ReplicaOf(); origin != "" {
+			replicas[topic.name] = origin
+		}
+	}
+	n.RUnlock()
+
+	body, err := json.Marshal(replicas)
+	if err != nil {
+		log.Printf("ERROR: failed to marshal replicas - %s", err.Error())
+		return nil
+	}
+	return &nsq.Command{Name: []byte("REPLICAS"), Body: body}
+}
+
+// sendReplicas sends cmd to lookupPeer if it supports it (older nsqlookupd
+// would close the connection)
+func (n *NSQD) sendReplicas(lookupPeer *LookupPeer, cmd *nsq.Command) {
+	if cmd == nil || !lookupPeer.Info.ReplicaReports {
+		return
+	}
+	_, err := lookupPeer.Command(cmd)
+	if err != nil {
+		log.Printf("LOOKUPD(%s): ERROR %s - %s", lookupPeer, cmd, err.Error())
+	}
+}
+
+// replicator is the Consumer of a topic's replication channel that publishes
+// its messages to the remote cluster
+type replicator struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	InFlightCount int64
+	MessageCount  uint64
+	FinishCount   uint64
+	RequeueCount  uint64
+
+	ID          int64
+	ConnectTime time.Time
+
+	sync.Mutex
+	remoteAddress string
+
+	context   *Context
+	topicName string
+	channel   *Channel
+
+	// readyStateChan has a buffer of 1 to guarantee that in the event
+	// there is a race the state update is not lost
+	readyStateChan chan int
+	exitChan       chan int
+	closeOnce      sync.Once
+}
+
+func (n *NSQD) newReplicator(topicName string) *replicator {
+	topic := n.GetTopic(topicName)
+	if topic.ReplicaOf() != "" {
+		log.Printf("ERROR: not replicating topic %s, it's a replica of %s", topicName, topic.ReplicaOf())
+	}
+	return &replicator{
+		ID:             atomic.AddInt64(&n.clientIDSequence, 1),
+		ConnectTime:    time.Now(),
+		context:        &Context{n},
+		topicName:      topicName,
+		channel:        topic.GetChannel(replicationChannel),
+		readyStateChan: make(chan int, 1),
+		exitChan:       make(chan int),
+	}
+}
+
+func (r *replicator) String() string {
+	return fmt.Sprintf("REPLICATOR(%s)", r.topicName)
+}
+
+func (r *replicator) tryUpdateReadyState() {
+	select {
+	case r.readyStateChan <- 1:
+	default:
+	}
+}
+
+func (r *replicator) Pause() {
+	r.tryUpdateReadyState()
+}
+
+func (r *replicator) UnPause() {
+	r.tryUpdateReadyState()
+}
+
+func (r *replicator) Close() error {
+	r.closeOnce.Do(func() { close(r.exitChan) })
+	return nil
+}
+
+func (r *replicator) TimedOutMessage() {
+	atomic.AddInt64(&r.InFlightCount, -1)
+}
+
+func (r *replicator) Empty() {
+	atomic.StoreInt64(&r.InFlightCount, 0)
+}
+
+func (r *replicator) Stats() ClientStats {
+	r.Lock()
+	remoteAddress := r.remoteAddress
+	r.Unlock()
+	return ClientStats{
+		ID:            r.ID,
+		Version:       "V2",
+		RemoteAddress: remoteAddress,
+		Name:          r.String(),
+		UserAgent:     "nsqd/" + util.BINARY_VERSION + " replicator",
+		State:         nsq.StateSubscribed,
+		InFlightCount: atomic.LoadInt64(&r.InFlightCount),
+		MessageCount:  atomic.LoadUint64(&r.MessageCount),
+		FinishCount:   atomic.LoadUint64(&r.FinishCount),
+		RequeueCount:  atomic.LoadUint64(&r.RequeueCount),
+		ConnectTime:   r.ConnectTime.Unix(),
+	}
+}
+
+func (r *replicator) loop() {
+	var conn net.Conn
+	var err error
+	var addrIndex int
+
+	r.channel.AddClient(r.ID, r)
+	log.Printf("%s: replicating to %v", r, r.context.nsqd.options.ReplicateTo)
+
+	for {
+		if r.channel.IsPaused() || r.context.nsqd.getTopicReplicaOf(r.topicName) != "" {
+			select {
+			case <-r.readyStateChan:
+			case <-time.After(replicationBackoff):
+			case <-r.exitChan:
+				goto exit
+			case <-r.context.nsqd.exitChan:
+				goto exit
+			}
+			continue
+		}
+
+		if conn == nil {
+			addr := r.context.nsqd.options.ReplicateTo[addrIndex]
+			conn, err = r.connect(addr)
+			if err != nil {
+				log.Printf("%s: ERROR failed to connect to %s - %s", r, addr, err.Error())
+				addrIndex = (addrIndex + 1) % len(r.context.nsqd.options.ReplicateTo)
+				select {
+				case <-time.After(replicationBackoff):
+				case <-r.exitChan:
+					goto exit
+				case <-r.context.nsqd.exitChan:
+					goto exit
+				}
+				continue
+			}
+		}
+
+		var batch []*nsq.Message
+		select {
+		case msg, ok := <-r.channel.clientMsgChan:
+			if !ok {
+				goto exit
+			}
+			batch = append(batch, msg)
+		case <-r.readyStateChan:
+			continue
+		case <-r.exitChan:
+			goto exit
+		case <-r.context.nsqd.exitChan:
+			goto exit
+		}
+	more:
+		for len(batch) < replicationMaxBatch {
+			select {
+			case msg, ok := <-r.channel.clientMsgChan:
+				if !ok {
+					break more
+				}
+				batch = append(batch, msg)
+			default:
+				break more
+			}
+		}
+
+		for _, msg := range batch {
+			r.channel.StartInFlightTimeout(msg, r.ID, r.context.nsqd.options.MsgTimeout)
+			atomic.AddInt64(&r.InFlightCount, 1)
+			atomic.AddUint64(&r.MessageCount, 1)
+		}
+
+		err = r.publish(conn, batch)
+		for _, msg := range batch {
+			if err != nil {
+				if r.channel.RequeueMessage(r.ID, msg.Id, 0) == nil {
+					atomic.AddUint64(&r.RequeueCount, 1)
+					atomic.AddInt64(&r.InFlightCount, -1)
+				}
+			} else if r.channel.FinishMessage(r.ID, msg.Id) == nil {
+				atomic.AddUint64(&r.FinishCount, 1)
+				atomic.AddInt64(&r.InFlightCount, -1)
+			}
+		}
+		if err != nil {
+			log.Printf("%s: ERROR failed to replicate %d messages - %s", r, len(batch), err.Error())
+			conn.Close()
+			conn = nil
+			addrIndex = (addrIndex + 1) % len(r.context.nsqd.options.ReplicateTo)
+		}
+	}
+
+exit:
+	log.Printf("%s: closing", r)
+	if conn != nil {
+		conn.Close()
+	}
+	r.channel.RemoveClient(r.ID)
+}
+
+// connect connects and IDENTIFYs to a remote nsqd, which must support
+// replication
+func (r *replicator) connect(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, replicationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+
+	_, err = conn.Write(nsq.MagicV2)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	cmd, err := nsq.Identify(map[string]interface{}{
+		"short_id":            r.context.nsqd.options.BroadcastAddress,
+		"long_id":             r.context.nsqd.options.BroadcastAddress,
+		"user_agent":          "nsqd/" + util.BINARY_VERSION + " replicator",
+		"feature_negotiation": true,
+		// a publish-only connection, no heartbeats to respond to
+		"heartbeat_interval": -1,
+		"replication_origin": r.context.nsqd.options.Cluster,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	data, err := replicationCommand(conn, cmd)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp := struct {
+		Replication bool `json:"replication"`
+	}{}
+	err = json.Unmarshal(data, &resp)
+	if err != nil || !resp.Replication {
+		conn.Close()
+		return nil, errors.New("nsqd does not support replication")
+	}
+
+	r.Lock()
+	r.remoteAddress = addr
+	r.Unlock()
+	log.Printf("%s: connected to %s", r, addr)
+	return conn, nil
+}
+
+func (r *replicator) publish(conn net.Conn, batch []*nsq.Message) error {
+	bodies := make([][]byte, len(batch))
+	for i, msg := range batch {
+		bodies[i] = msg.Body
+	}
+	cmd, err := nsq.MultiPublish(r.topicName, bodies)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	_, err = replicationCommand(conn, cmd)
+	return err
+}
+
+// replicationCommand sends cmd to a remote nsqd and returns its response
+func replicationCommand(conn net.Conn, cmd *nsq.Command) ([]byte, error) {
+	err := cmd.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := nsq.ReadResponse(conn)
+	if err != nil {
+		return nil, err
+	}
+	frameType, data, err := nsq.UnpackResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if frameType == nsq.FrameTypeError {
+		return nil, errors.New(string(data))
+	}
+	return data, nil
+}
+
+func (n *NSQD) getTopicReplicaOf(topicName string) string {
+	topic, err := n.GetExistingTopic(topicName)
+	if err != nil {
+		return ""
+	}
+	return topic.ReplicaOf()
+}
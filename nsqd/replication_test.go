@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestReplication(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "test_replication" + strconv.Itoa(int(time.Now().Unix()))
+
+	remoteOptions := NewNSQDOptions()
+	remoteOptions.Cluster = "dr"
+	remoteTCPAddr, remoteHTTPAddr, remote := mustStartNSQD(remoteOptions)
+	defer remote.Exit()
+
+	options := NewNSQDOptions()
+	options.Cluster = "main"
+	options.ReplicateTopics = []string{topicName}
+	options.ReplicateTo = []string{remoteTCPAddr.String()}
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	url := fmt.Sprintf("http://%s/put?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", strings.NewReader("test body"))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	var replica *Topic
+	for i := 0; i < 100; i++ {
+		replica, err = remote.GetExistingTopic(topicName)
+		if err == nil && replica.Depth() == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, err, nil)
+	assert.Equal(t, replica.Depth(), int64(1))
+	assert.Equal(t, replica.ReplicaOf(), "main")
+	assert.Equal(t, NewTopicStats(replica, nil).ReplicaOf, "main")
+
+	// a replica is read-only for publishers
+	url = fmt.Sprintf("http://%s/put?topic=%s", remoteHTTPAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", strings.NewReader("test body"))
+	assert.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+	assert.Equal(t, string(body), `{"status_code":500,"status_txt":"REPLICA_READ_ONLY","data":null}`)
+
+	// a replicator of the nsqd's own cluster is refused
+	conn, err := mustConnectNSQD(remoteTCPAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"replication_origin": "dr",
+	}, nsq.FrameTypeError)
+
+	// and a topic owned by this cluster can't become a replica
+	conn, err = mustConnectNSQD(nsqd.tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"replication_origin": "dr",
+	}, nsq.FrameTypeResponse)
+	err = nsq.Publish(topicName, []byte("test body")).Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeError, "E_PUB_FAILED PUB failed topic is owned by this cluster")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// a /put or /mput with an X-NSQ-Request-ID header is published at most once
+// per --publish-request-id-ttl, so that a client can safely retry a publish
+// whose response it never got (ie. a load balancer's 502), a retry of a
+// successful publish is sent the original response (with
+// X-NSQ-Request-ID-Replayed: true) and a retry of one that's still in
+// progress waits for it
+//
+// only successful publishes are remembered, a failed one can be retried
+
+// the most request IDs remembered, the oldest are forgotten first
+const maxPublishRequestIDs = 100000
+
+type publishRequest struct {
+	key     string
+	expires time.Time
+	elem    *list.Element
+
+	// closed once the publish is done, then the response is set (when it
+	// succeeded)
+	done   chan struct{}
+	ok     bool
+	header http.Header
+	body   []byte
+}
+
+type publishRequestIDs struct {
+	sync.Mutex
+	ttl      time.Duration
+	requests map[string]*publishRequest
+	// oldest first
+	order *list.List
+}
+
+func newPublishRequestIDs(ttl time.Duration) *publishRequestIDs {
+	return &publishRequestIDs{
+		ttl:      ttl,
+		requests: make(map[string]*publishRequest),
+		order:    list.New(),
+	}
+}
+
+// begin returns the request of key, and whether it was already seen (in
+// which case it's the caller's to wait for), otherwise the caller has to end
+// it
+func (p *publishRequestIDs) begin(key string) (*publishRequest, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	for e := p.order.Front(); e != nil; e = p.order.Front() {
+		r := e.Value.(*publishRequest)
+		if len(p.requests) <= maxPublishRequestIDs && r.expires.After(now) {
+			break
+		}
+		p.remove(r)
+	}
+
+	if r, ok := p.requests[key]; ok {
+		return r, true
+	}
+
+	r := &publishRequest{
+		key:     key,
+		expires: now.Add(p.ttl),
+		done:    make(chan struct{}),
+	}
+	r.elem = p.order.PushBack(r)
+	p.requests[key] = r
+	return r, false
+}
+
+// end records the response of a request, a failed one is forgotten
+func (p *publishRequestIDs) end(r *publishRequest, ok bool, header http.Header, body []byte) {
+	p.Lock()
+	if ok {
+		r.ok = true
+		r.header = header
+		r.body = body
+	} else {
+		p.remove(r)
+	}
+	p.Unlock()
+	close(r.done)
+}
+
+func (p *publishRequestIDs) remove(r *publishRequest) {
+	if p.requests[r.key] == r {
+		delete(p.requests, r.key)
+	}
+	p.order.Remove(r.elem)
+}
+
+// recordingResponseWriter keeps a copy of a response
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// publishOnce runs a publish handler unless the request's X-NSQ-Request-ID
+// was already published (to the same topic)
+func (s *httpServer) publishOnce(w http.ResponseWriter, req *http.Request,
+	handler func(*httpServer, http.ResponseWriter, *http.Request)) {
+	requests := s.context.nsqd.publishRequestIDs
+	requestID := req.Header.Get("X-NSQ-Request-ID")
+	if requests == nil || requestID == "" {
+		handler(s, w, req)
+		return
+	}
+
+	// an invalid (or missing) topic fails in handler
+	reqParams, _ := url.ParseQuery(req.URL.RawQuery)
+	key := reqParams.Get("topic") + "\x00" + requestID
+
+	for {
+		r, seen := requests.begin(key)
+		if !seen {
+			rw := &recordingResponseWriter{ResponseWriter: w}
+			handler(s, rw, req)
+			requests.end(r, rw.status == 200, w.Header(), rw.body.Bytes())
+			return
+		}
+
+		<-r.done
+		if r.ok {
+			for k, v := range r.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("X-NSQ-Request-ID-Replayed", "true")
+			w.WriteHeader(200)
+			w.Write(r.body)
+			return
+		}
+		// the publish it retried failed, so this one is attempted
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestPublishRequestID(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_publish_request_id" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	publish := func(endpoint string, requestID string, body string) (*http.Response, string) {
+		url := fmt.Sprintf("http://%s/%s?topic=%s", httpAddr, endpoint, topicName)
+		req, err := http.NewRequest("POST", url, strings.NewReader(body))
+		assert.Equal(t, err, nil)
+		req.Header.Set("X-NSQ-Request-ID", requestID)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	resp, body := publish("put", "a", "test message")
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, body, "OK")
+	assert.Equal(t, resp.Header.Get("X-NSQ-Request-ID-Replayed"), "")
+	assert.Equal(t, topic.Depth(), int64(1))
+
+	// a retry isn't published again
+	resp, body = publish("put", "a", "test message")
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, body, "OK")
+	assert.Equal(t, resp.Header.Get("X-NSQ-Request-ID-Replayed"), "true")
+	assert.Equal(t, topic.Depth(), int64(1))
+
+	resp, _ = publish("mput", "b", "one\ntwo\n")
+	assert.Equal(t, resp.StatusCode, 200)
+	resp, _ = publish("mput", "b", "one\ntwo\n")
+	assert.Equal(t, resp.Header.Get("X-NSQ-Request-ID-Replayed"), "true")
+	assert.Equal(t, topic.Depth(), int64(3))
+
+	// a failed publish isn't remembered
+	resp, _ = publish("put", "c", "")
+	assert.Equal(t, resp.StatusCode, 500)
+	resp, _ = publish("put", "c", "test message")
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, resp.Header.Get("X-NSQ-Request-ID-Replayed"), "")
+	assert.Equal(t, topic.Depth(), int64(4))
+}
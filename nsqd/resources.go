@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"runtime"
+)
+
+// ResourceStats is this process' (and its --data-path volume's) use of
+// resources, process figures that aren't available on a platform are 0
+type ResourceStats struct {
+	RSSBytes  uint64 `json:"rss_bytes"`
+	HeapBytes uint64 `json:"heap_bytes"`
+
+	NumGC          uint32 `json:"num_gc"`
+	GCPauseTotalNs uint64 `json:"gc_pause_total_ns"`
+	GCPauseLastNs  uint64 `json:"gc_pause_last_ns"`
+
+	OpenFDs int    `json:"open_fds"`
+	MaxFDs  uint64 `json:"max_fds"`
+
+	DataPath       string `json:"data_path"`
+	DiskTotalBytes uint64 `json:"disk_total_bytes"`
+	DiskFreeBytes  uint64 `json:"disk_free_bytes"`
+}
+
+func (n *NSQD) ResourceStats() *ResourceStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	stats := &ResourceStats{
+		RSSBytes:       processRSSBytes(),
+		HeapBytes:      ms.HeapAlloc,
+		NumGC:          ms.NumGC,
+		GCPauseTotalNs: ms.PauseTotalNs,
+		OpenFDs:        processOpenFDs(),
+		MaxFDs:         processMaxFDs(),
+		DataPath:       n.options.DataPath,
+	}
+	if ms.NumGC > 0 {
+		stats.GCPauseLastNs = ms.PauseNs[(ms.NumGC+255)%256]
+	}
+
+	if stats.DataPath == "" {
+		stats.DataPath = "."
+	}
+	total, free, err := diskUsage(stats.DataPath)
+	if err != nil {
+		log.Printf("ERROR: failed to get disk usage of %s - %s", stats.DataPath, err.Error())
+	}
+	stats.DiskTotalBytes = total
+	stats.DiskFreeBytes = free
+
+	return stats
+}
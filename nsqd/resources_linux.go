@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+func processRSSBytes() uint64 {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	var size, resident uint64
+	_, err = fmt.Sscanf(string(data), "%d %d", &size, &resident)
+	if err != nil {
+		return 0
+	}
+	return resident * uint64(os.Getpagesize())
+}
+
+func processOpenFDs() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	return len(fds)
+}
+
+func processMaxFDs() uint64 {
+	var rlimit syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit)
+	if err != nil {
+		return 0
+	}
+	return rlimit.Cur
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func processRSSBytes() uint64 {
+	return 0
+}
+
+func processOpenFDs() int {
+	return 0
+}
+
+func processMaxFDs() uint64 {
+	return 0
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestResourceStats(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.DataPath = mustTempDataPath()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	for _, endpoint := range []string{"info", "stats?format=json"} {
+		data, err := util.ApiRequest(fmt.Sprintf("http://127.0.0.1:%d/%s", httpAddr.Port, endpoint))
+		assert.Equal(t, err, nil)
+
+		r := data.Get("resources")
+		assert.Equal(t, r.Get("heap_bytes").MustInt64() > 0, true)
+		assert.Equal(t, r.Get("data_path").MustString(), options.DataPath)
+		assert.Equal(t, r.Get("disk_total_bytes").MustInt64() > 0, true)
+		assert.Equal(t, r.Get("disk_free_bytes").MustInt64() <= r.Get("disk_total_bytes").MustInt64(), true)
+		if runtime.GOOS == "linux" {
+			assert.Equal(t, r.Get("rss_bytes").MustInt64() > 0, true)
+			assert.Equal(t, r.Get("open_fds").MustInt64() > 0, true)
+			assert.Equal(t, r.Get("max_fds").MustInt64() >= r.Get("open_fds").MustInt64(), true)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// retained messages are grouped into files spanning this much (message) time,
+// expired files are removed whole
+const retentionSegmentDuration = time.Hour
+
+// retentionLog is an append-only, time segmented record of every message
+// published to a topic, kept for period regardless of whether channels
+// have consumed them
+//
+// each record is a 4 byte (big endian) length followed by the encoded message
+type retentionLog struct {
+	sync.Mutex
+
+	name     string
+	dataPath string
+	period   time.Duration
+
+	file      *os.File
+	fileStart int64
+	buf       bytes.Buffer
+
+	encryption *atRestEncryption
+}
+
+func newRetentionLog(name string, dataPath string, period time.Duration, encryption *atRestEncryption) *retentionLog {
+	return &retentionLog{
+		name:       name,
+		dataPath:   dataPath,
+		period:     period,
+		encryption: encryption,
+	}
+}
+
+func (r *retentionLog) fileName(start int64) string {
+	return fmt.Sprintf(path.Join(r.dataPath, "%s.retention.%d.dat"), r.name, start)
+}
+
+// segments returns the start (in unix nanoseconds) of every file on disk, oldest first
+func (r *retentionLog) segments() []int64 {
+	prefix := fmt.Sprintf("%s.retention.", r.name)
+	matches, _ := filepath.Glob(path.Join(r.dataPath, prefix+"*.dat"))
+
+	starts := make([]int64, 0, len(matches))
+	for _, match := range matches {
+		base := path.Base(match)
+		start, err := strconv.ParseInt(base[len(prefix):len(base)-len(".dat")], 10, 64)
+		if err != nil {
+			continue
+		}
+		starts = append(starts, start)
+	}
+	sort.Sort(Int64Slice(starts))
+	return starts
+}
+
+func (r *retentionLog) SetPeriod(period time.Duration) {
+	r.Lock()
+	r.period = period
+	r.prune()
+	r.Unlock()
+}
+
+func (r *retentionLog) Put(msg *nsq.Message) error {
+	r.Lock()
+	defer r.Unlock()
+
+	start := msg.Timestamp - msg.Timestamp%int64(retentionSegmentDuration)
+	if r.file == nil || start != r.fileStart {
+		if r.file != nil {
+			r.file.Close()
+			r.file = nil
+		}
+
+		f, err := os.OpenFile(r.fileName(start), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		r.file = f
+		r.fileStart = start
+		r.prune()
+	}
+
+	r.buf.Reset()
+	r.buf.Write([]byte{0, 0, 0, 0})
+	err := msg.Write(&r.buf)
+	if err != nil {
+		return err
+	}
+	record := r.buf.Bytes()
+	if r.encryption != nil {
+		data, err := r.encryption.seal(r.name, record[4:])
+		if err != nil {
+			return err
+		}
+		record = append(record[:4], data...)
+	}
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+
+	_, err = r.file.Write(record)
+	return err
+}
+
+// prune removes files whose messages are all older than period,
+// this expects the caller to handle locking
+func (r *retentionLog) prune() {
+	cutoff := time.Now().Add(-r.period).UnixNano()
+	for _, start := range r.segments() {
+		if start+int64(retentionSegmentDuration) > cutoff {
+			break
+		}
+		if r.file != nil && start == r.fileStart {
+			continue
+		}
+		fn := r.fileName(start)
+		log.Printf("RETENTION(%s): removing expired %s", r.name, fn)
+		err := os.Remove(fn)
+		if err != nil {
+			log.Printf("ERROR: RETENTION(%s) failed to remove %s - %s", r.name, fn, err.Error())
+		}
+	}
+}
+
+// Replay calls fn, in order, for every retained message published at or after since
+//
+// files are only ever appended to, so (other than listing them) this does not
+// need to block concurrent writes
+func (r *retentionLog) Replay(since time.Time, fn func(*nsq.Message) error) (int, error) {
+	r.Lock()
+	r.prune()
+	starts := r.segments()
+	r.Unlock()
+
+	var count int
+	for _, start := range starts {
+		if start+int64(retentionSegmentDuration) <= since.UnixNano() {
+			continue
+		}
+		n, err := r.replayFile(r.fileName(start), since.UnixNano(), fn)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (r *retentionLog) replayFile(fn string, since int64, cb func(*nsq.Message) error) (int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// expired while we were replaying
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	var count int
+	var size uint32
+	reader := bufio.NewReader(f)
+	for {
+		err = binary.Read(reader, binary.BigEndian, &size)
+		if err != nil {
+			break
+		}
+		buf := make([]byte, size)
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			break
+		}
+
+		buf, err = r.encryption.open(r.name, buf)
+		if err != nil {
+			return count, err
+		}
+		msg, err := nsq.DecodeMessage(buf)
+		if err != nil {
+			return count, err
+		}
+		if msg.Timestamp < since {
+			continue
+		}
+		err = cb(msg)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	// a short read means we've caught up with a concurrent write
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return count, err
+	}
+	return count, nil
+}
+
+func (r *retentionLog) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Delete closes and removes every retained message
+func (r *retentionLog) Delete() error {
+	r.Close()
+
+	r.Lock()
+	defer r.Unlock()
+	for _, start := range r.segments() {
+		err := os.Remove(r.fileName(start))
+		if err != nil {
+			log.Printf("ERROR: RETENTION(%s) failed to remove %s - %s", r.name, r.fileName(start), err.Error())
+		}
+	}
+	return nil
+}
+
+// SetRetention keeps every message published to this topic on disk for
+// period (even once consumed) so that channels can be rewound with Seek,
+// a period of 0 disables retention and discards what was retained
+func (t *Topic) SetRetention(period time.Duration) error {
+	if period < 0 {
+		return errors.New("invalid retention period")
+	}
+
+	t.Lock()
+	switch {
+	case period == 0 && t.retention != nil:
+		t.retention.Delete()
+		t.retention = nil
+	case period > 0 && t.retention == nil:
+		t.retention = newRetentionLog(t.name, t.context.nsqd.options.DataPath, period,
+			t.context.nsqd.encryption)
+	case period > 0:
+		t.retention.SetPeriod(period)
+	}
+	t.Unlock()
+
+	log.Printf("TOPIC(%s): retention period %s", t.name, period)
+
+	t.context.nsqd.Lock()
+	defer t.context.nsqd.Unlock()
+	return t.context.nsqd.PersistMetadata()
+}
+
+func (t *Topic) RetentionPeriod() time.Duration {
+	t.RLock()
+	defer t.RUnlock()
+	if t.retention == nil {
+		return 0
+	}
+	t.retention.Lock()
+	defer t.retention.Unlock()
+	return t.retention.period
+}
+
+var errRetentionNotEnabled = errors.New("retention not enabled")
+
+// Seek rewinds (or fast forwards) channel so that it next delivers the
+// messages retained since the given time, anything it currently has queued
+// is discarded
+func (t *Topic) Seek(channel *Channel, since time.Time) (int, error) {
+	t.RLock()
+	retention := t.retention
+	t.RUnlock()
+	if retention == nil {
+		return 0, errRetentionNotEnabled
+	}
+
+	err := channel.Empty()
+	if err != nil {
+		return 0, err
+	}
+
+	return retention.Replay(since, func(msg *nsq.Message) error {
+		// these are redeliveries, they need new IDs so they don't collide
+		// with anything that might still be in flight
+		chanMsg := nsq.NewMessage(copyMessageKey(<-t.context.nsqd.idChan, msg.Id), msg.Body)
+		chanMsg.Timestamp = msg.Timestamp
+		return channel.PutMessage(chanMsg)
+	})
+}
+
+type Int64Slice []int64
+
+func (s Int64Slice) Len() int {
+	return len(s)
+}
+
+func (s Int64Slice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s Int64Slice) Less(i, j int) bool {
+	return s[i] < s[j]
+}
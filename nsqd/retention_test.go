@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/go-simplejson"
+	"github.com/bmizerany/assert"
+)
+
+func waitForChannelDepth(channel *Channel, depth int64) int64 {
+	for i := 0; i < 100; i++ {
+		if channel.Depth() == depth {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return channel.Depth()
+}
+
+func TestRetentionSeek(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_retention" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/set_topic_retention?topic=%s&period=24h", httpAddr, topicName)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, topic.RetentionPeriod(), 24*time.Hour)
+
+	metadata, _ := getMetadata(nsqd)
+	topicJs := metadata.Get("topics").GetIndex(0)
+	assert.Equal(t, topicJs.Get("retention_period").MustInt64(), int64(24*time.Hour))
+
+	now := time.Now()
+	for _, ago := range []time.Duration{3 * time.Hour, 2 * time.Hour, 0} {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+		msg.Timestamp = now.Add(-ago).UnixNano()
+		topic.PutMessage(msg)
+	}
+	assert.Equal(t, waitForChannelDepth(channel, 3), int64(3))
+
+	seek := func(to time.Time) int64 {
+		url := fmt.Sprintf("http://%s/channel/seek?topic=%s&channel=ch&to=%d", httpAddr, topicName, to.Unix())
+		resp, err := http.Get(url)
+		assert.Equal(t, err, nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, 200)
+		js, err := simplejson.NewJson(body)
+		assert.Equal(t, err, nil)
+		return js.Get("data").Get("count").MustInt64()
+	}
+
+	assert.Equal(t, seek(now.Add(-150*time.Minute)), int64(2))
+	assert.Equal(t, seek(now.Add(-4*time.Hour)), int64(3))
+	assert.Equal(t, seek(now.Add(time.Hour)), int64(0))
+
+	// disabling retention removes the retained messages
+	url = fmt.Sprintf("http://%s/set_topic_retention?topic=%s&period=0", httpAddr, topicName)
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, topic.RetentionPeriod(), time.Duration(0))
+
+	url = fmt.Sprintf("http://%s/channel/seek?topic=%s&channel=ch&to=0", httpAddr, topicName)
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net"
+	"runtime"
+
+	"github.com/bitly/nsq/util"
+)
+
+// with --tcp-reuseport every TCP address is listened on by several sockets
+// bound with SO_REUSEPORT, each with its own accept loop locked to an OS
+// thread, so that the kernel spreads incoming connections between them
+// rather than them all contending on a single listener
+
+func (n *NSQD) tcpAcceptors() int {
+	if n.options.TCPAcceptors > 0 {
+		return n.options.TCPAcceptors
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// startReusePortAcceptors opens the remaining acceptors for the address that
+// first is (already) listening on
+func (n *NSQD) startReusePortAcceptors(first net.Listener, handler util.TCPHandler) {
+	n.waitGroup.Wrap(func() { reusePortServer(first, handler) })
+
+	addr := first.Addr().String()
+	for i := 1; i < n.tcpAcceptors(); i++ {
+		l, err := listenReusePort(addr)
+		if err != nil {
+			// ie. an inherited listener that wasn't bound with SO_REUSEPORT
+			log.Printf("WARNING: failed to open acceptor %d for %s - %s", i, addr, err.Error())
+			return
+		}
+		n.reusePortListeners = append(n.reusePortListeners, l)
+		n.waitGroup.Wrap(func() { reusePortServer(l, handler) })
+	}
+}
+
+func reusePortServer(l net.Listener, handler util.TCPHandler) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	util.TCPServer(l, handler)
+}
@@ -0,0 +1,8 @@
+//go:build linux && (386 || amd64 || arm)
+// +build linux
+// +build 386 amd64 arm
+
+package main
+
+// syscall doesn't define SO_REUSEPORT for these
+const soReusePort = 0xf
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func listenReusePort(addr string) (net.Listener, error) {
+	return nil, errors.New("SO_REUSEPORT is not supported on this platform")
+}
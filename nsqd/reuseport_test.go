@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestReusePortAcceptors(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.TCPReusePort = true
+	options.TCPAcceptors = 3
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	assert.Equal(t, len(nsqd.reusePortListeners), 2)
+	for _, l := range nsqd.reusePortListeners {
+		assert.Equal(t, l.Addr().String(), tcpAddr.String())
+	}
+
+	// whichever acceptor the kernel picks, the connection is served
+	for i := 0; i < 10; i++ {
+		conn, err := mustConnectNSQD(tcpAddr)
+		assert.Equal(t, err, nil)
+		identify(t, conn, nil, nsq.FrameTypeResponse)
+		conn.Close()
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bitly/go-nsq"
+)
+
+// schemaMode decides what happens to messages published to a topic that don't
+// conform to its schema, either way they're counted
+type schemaMode int32
+
+const (
+	// rejected (the publish fails)
+	schemaEnforce schemaMode = iota
+	// logged and published anyway
+	schemaWarn
+)
+
+func parseSchemaMode(s string) (schemaMode, error) {
+	switch s {
+	case "", "enforce":
+		return schemaEnforce, nil
+	case "warn":
+		return schemaWarn, nil
+	}
+	return schemaEnforce, fmt.Errorf("invalid schema mode %q", s)
+}
+
+func (m schemaMode) String() string {
+	if m == schemaWarn {
+		return "warn"
+	}
+	return "enforce"
+}
+
+// topicSchema is a (JSON Schema) schema registered for a topic
+type topicSchema struct {
+	mode   schemaMode
+	source []byte
+	root   *jsonSchema
+}
+
+func newTopicSchema(source []byte, mode schemaMode) (*topicSchema, error) {
+	root, err := compileJSONSchema(source)
+	if err != nil {
+		return nil, err
+	}
+	return &topicSchema{mode, source, root}, nil
+}
+
+// jsonSchema is the subset of JSON Schema (draft 4) that's supported, other
+// keywords are ignored
+type jsonSchema struct {
+	Type                 interface{}            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+
+	types   []string
+	pattern *regexp.Regexp
+}
+
+var jsonSchemaTypes = []string{"array", "boolean", "integer", "null", "number", "object", "string"}
+
+func compileJSONSchema(source []byte) (*jsonSchema, error) {
+	var s jsonSchema
+	err := json.Unmarshal(source, &s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema - %s", err.Error())
+	}
+	err = s.compile("$")
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *jsonSchema) compile(path string) error {
+	switch t := s.Type.(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("%s: invalid type %v", path, v)
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return fmt.Errorf("%s: invalid type %v", path, t)
+	}
+	for _, name := range s.types {
+		i := sort.SearchStrings(jsonSchemaTypes, name)
+		if i == len(jsonSchemaTypes) || jsonSchemaTypes[i] != name {
+			return fmt.Errorf("%s: unknown type %q", path, name)
+		}
+	}
+
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern - %s", path, err.Error())
+		}
+		s.pattern = re
+	}
+
+	for name, p := range s.Properties {
+		err := p.compile(path + "." + name)
+		if err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + "[]")
+	}
+	return nil
+}
+
+// validate returns a description of the first way in which v (decoded JSON)
+// doesn't conform to the schema
+func (s *jsonSchema) validate(path string, v interface{}) error {
+	if len(s.types) > 0 && !s.hasType(v) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(s.types, " or "), jsonType(v))
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: not one of the allowed values", path)
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		// in a consistent order so that the same message gets the same error
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			err := p.validate(path+"."+name, v[name])
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: fewer than %d items", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: more than %d items", path, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s: shorter than %d", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s: longer than %d", path, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: does not match %q", path, s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s: less than %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s: greater than %v", path, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) hasType(v interface{}) bool {
+	actual := jsonType(v)
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// validate returns an error describing why body doesn't conform to the schema
+func (ts *topicSchema) validate(body []byte) error {
+	var v interface{}
+	err := json.Unmarshal(body, &v)
+	if err != nil {
+		return errors.New("invalid JSON")
+	}
+	return ts.root.validate("$", v)
+}
+
+// SetSchema registers the schema messages published to the topic are
+// validated against, nil removes it
+func (t *Topic) SetSchema(schema *topicSchema) error {
+	t.schemaLock.Lock()
+	t.schema = schema
+	t.schemaLock.Unlock()
+	if schema == nil {
+		log.Printf("TOPIC(%s): schema removed", t.name)
+	} else {
+		log.Printf("TOPIC(%s): schema set (%s)", t.name, schema.mode)
+	}
+
+	t.context.nsqd.Lock()
+	defer t.context.nsqd.Unlock()
+	return t.context.nsqd.PersistMetadata()
+}
+
+// Schema returns the topic's schema (nil if it doesn't have one)
+func (t *Topic) Schema() *topicSchema {
+	t.schemaLock.RLock()
+	defer t.schemaLock.RUnlock()
+	return t.schema
+}
+
+// checkSchema validates msgs against the topic's schema, messages that don't
+// conform are counted (and logged) and, when the schema is enforced, reject
+// the publish
+func (t *Topic) checkSchema(msgs []*nsq.Message) error {
+	schema := t.Schema()
+	if schema == nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		err := schema.validate(msg.Body)
+		if err == nil {
+			continue
+		}
+		atomic.AddUint64(&t.schemaViolationCount, 1)
+		if schema.mode == schemaEnforce {
+			return &msgRejectedError{"schema", err}
+		}
+		log.Printf("TOPIC(%s): WARNING msg(%s) does not conform to schema - %s",
+			t.name, msg.Id, err.Error())
+	}
+	return nil
+}
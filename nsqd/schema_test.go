@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["id", "kind"],
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"kind": {"enum": ["click", "view"]},
+		"tags": {"type": "array", "items": {"type": "string", "maxLength": 8}}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := newTopicSchema([]byte(testSchema), schemaEnforce)
+	assert.Equal(t, err, nil)
+
+	tests := []struct {
+		body string
+		err  string
+	}{
+		{`{"id": 1, "kind": "click"}`, ""},
+		{`{"id": 1, "kind": "view", "tags": ["a", "b"], "other": true}`, ""},
+		{`not json`, "invalid JSON"},
+		{`[]`, "$: expected object, got array"},
+		{`{"kind": "click"}`, `$: missing required property "id"`},
+		{`{"id": "1", "kind": "click"}`, "$.id: expected integer, got string"},
+		{`{"id": 1.5, "kind": "click"}`, "$.id: expected integer, got number"},
+		{`{"id": 0, "kind": "click"}`, "$.id: less than 1"},
+		{`{"id": 1, "kind": "buy"}`, "$.kind: not one of the allowed values"},
+		{`{"id": 1, "kind": "click", "tags": ["a", 2]}`, "$.tags[1]: expected string, got integer"},
+		{`{"id": 1, "kind": "click", "tags": ["abcdefghi"]}`, "$.tags[0]: longer than 8"},
+	}
+	for _, tt := range tests {
+		err := schema.validate([]byte(tt.body))
+		if tt.err == "" {
+			assert.Equal(t, err, nil)
+			continue
+		}
+		assert.NotEqual(t, err, nil)
+		assert.Equal(t, err.Error(), tt.err)
+	}
+
+	_, err = newTopicSchema([]byte(`{"type": "thing"}`), schemaEnforce)
+	assert.Equal(t, err.Error(), `$: unknown type "thing"`)
+	_, err = newTopicSchema([]byte(`{"properties": {"a": {"pattern": "("}}}`), schemaEnforce)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestTopicSchema(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_schema" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/set_topic_schema?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(testSchema))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, NewTopicStats(topic, nil).SchemaMode, "enforce")
+
+	err = nsqd.PutMessages(topicName, []*nsq.Message{
+		nsq.NewMessage(<-nsqd.idChan, []byte(`{"id": 1, "kind": "click"}`)),
+	})
+	assert.Equal(t, err, nil)
+
+	// a message that doesn't conform rejects the whole publish
+	url = fmt.Sprintf("http://%s/mpub?topic=%s", httpAddr, topicName)
+	body := "{\"id\": 2, \"kind\": \"view\"}\n{\"id\": \"3\", \"kind\": \"view\"}"
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString(body))
+	assert.Equal(t, err, nil)
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+	assert.Equal(t, bytes.Contains(data, []byte("$.id: expected integer, got string")), true)
+	assert.Equal(t, topic.messageCount, uint64(1))
+	assert.Equal(t, NewTopicStats(topic, nil).SchemaViolations, uint64(1))
+
+	// in warn mode it's only counted
+	url = fmt.Sprintf("http://%s/set_topic_schema?topic=%s&mode=warn", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", bytes.NewBufferString(testSchema))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	err = nsqd.PutMessages(topicName, []*nsq.Message{
+		nsq.NewMessage(<-nsqd.idChan, []byte(`garbage`)),
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, topic.messageCount, uint64(2))
+	assert.Equal(t, NewTopicStats(topic, nil).SchemaViolations, uint64(2))
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/delete_topic_schema?topic=%s", httpAddr, topicName))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, topic.Schema() == nil, true)
+
+	resp, err = http.Post(fmt.Sprintf("http://%s/set_topic_schema?topic=%s", httpAddr, topicName),
+		"application/json", bytes.NewBufferString(`{"type": 1}`))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+}
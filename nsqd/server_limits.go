@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+)
+
+// the bounds of the msg_timeout and heartbeat_interval a client can IDENTIFY
+// with (the upper bounds are --max-msg-timeout and --max-heartbeat-interval)
+const (
+	minMsgTimeout        = time.Second
+	minHeartbeatInterval = time.Second
+)
+
+// ServerLimits are nsqd's limits and the features it supports, sent in the
+// IDENTIFY response (to clients that negotiate features) and in /info, so
+// that client libraries can configure themselves rather than duplicate nsqd's
+// flags... durations are in milliseconds
+type ServerLimits struct {
+	MaxMsgSize             int64    `json:"max_msg_size"`
+	MaxBodySize            int64    `json:"max_body_size"`
+	MinMsgTimeout          int64    `json:"min_msg_timeout"`
+	MaxReqTimeout          int64    `json:"max_req_timeout"`
+	MinHeartbeatInterval   int64    `json:"min_heartbeat_interval"`
+	MaxHeartbeatInterval   int64    `json:"max_heartbeat_interval"`
+	MinWriteTimeout        int64    `json:"min_write_timeout"`
+	MaxWriteTimeout        int64    `json:"max_write_timeout"`
+	MaxHeartbeatMisses     int      `json:"max_heartbeat_miss_tolerance"`
+	MaxOutputBufferSize    int64    `json:"max_output_buffer_size"`
+	MaxOutputBufferTimeout int64    `json:"max_output_buffer_timeout"`
+	MaxBatchCount          int64    `json:"max_batch_count"`
+	MaxBatchBytes          int64    `json:"max_batch_bytes"`
+	Compressions           []string `json:"compressions"`
+	TLSAvailable           bool     `json:"tls_available"`
+	// nsqd doesn't support AUTH, it's never required
+	AuthRequired bool `json:"auth_required"`
+}
+
+func (n *NSQD) ServerLimits() ServerLimits {
+	compressions := make([]string, 0, 3)
+	if n.options.DeflateEnabled {
+		compressions = append(compressions, "deflate")
+	}
+	if n.options.SnappyEnabled {
+		compressions = append(compressions, "snappy")
+	}
+
+	return ServerLimits{
+		MaxMsgSize:             n.options.MaxMsgSize,
+		MaxBodySize:            n.options.MaxBodySize,
+		MinMsgTimeout:          int64(minMsgTimeout / time.Millisecond),
+		MaxReqTimeout:          int64(n.options.MaxReqTimeout / time.Millisecond),
+		MinHeartbeatInterval:   int64(minHeartbeatInterval / time.Millisecond),
+		MaxHeartbeatInterval:   int64(n.options.MaxHeartbeatInterval / time.Millisecond),
+		MinWriteTimeout:        int64(minClientWriteTimeout / time.Millisecond),
+		MaxWriteTimeout:        int64(n.options.MaxClientWriteTimeout / time.Millisecond),
+		MaxHeartbeatMisses:     n.options.MaxHeartbeatMissTolerance,
+		MaxOutputBufferSize:    n.options.MaxOutputBufferSize,
+		MaxOutputBufferTimeout: int64(n.options.MaxOutputBufferTimeout / time.Millisecond),
+		MaxBatchCount:          n.options.MaxBatchCount,
+		MaxBatchBytes:          n.options.MaxBatchBytes,
+		Compressions:           compressions,
+		TLSAvailable:           n.TLSConfig() != nil,
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestServerLimits(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.MaxMsgSize = 4096
+	options.SnappyEnabled = true
+	options.DeflateEnabled = false
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	data := identify(t, conn, nil, nsq.FrameTypeResponse)
+	var r ServerLimits
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.MaxMsgSize, int64(4096))
+	assert.Equal(t, r.MinMsgTimeout, int64(1000))
+	assert.Equal(t, r.MaxHeartbeatInterval, int64(options.MaxHeartbeatInterval/1e6))
+	assert.Equal(t, r.TLSAvailable, false)
+	assert.Equal(t, r.AuthRequired, false)
+	for _, c := range r.Compressions {
+		assert.NotEqual(t, c, "deflate")
+	}
+	assert.Equal(t, r.Compressions[0], "snappy")
+
+	info, err := util.ApiRequest(fmt.Sprintf("http://%s/info", httpAddr))
+	assert.Equal(t, err, nil)
+	limits := info.Get("limits")
+	assert.Equal(t, limits.Get("max_msg_size").MustInt64(), int64(4096))
+	assert.Equal(t, limits.Get("max_body_size").MustInt64(), options.MaxBodySize)
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// startService is only meaningful on Windows (see service_windows.go)
+func startService(exitChan chan int) bool {
+	return false
+}
+
+func stopService() {}
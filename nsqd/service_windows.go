@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// service control manager constants (see winsvc.h)
+const (
+	serviceWin32OwnProcess = 0x00000010
+
+	serviceStopped     = 0x00000001
+	serviceStopPending = 0x00000003
+	serviceRunning     = 0x00000004
+
+	serviceAcceptStop     = 0x00000001
+	serviceAcceptShutdown = 0x00000004
+
+	serviceControlStop        = 0x00000001
+	serviceControlInterrogate = 0x00000004
+	serviceControlShutdown    = 0x00000005
+
+	errorCallNotImplemented             = 120
+	errorFailedServiceControllerConnect = 1063
+
+	// how long the service control manager should wait for nsqd.Exit()
+	// (flushing in-memory messages to disk) before considering us hung
+	serviceStopWaitHint = 60000
+)
+
+var (
+	advapi32                          = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+)
+
+type serviceTableEntry struct {
+	serviceName *uint16
+	serviceProc uintptr
+}
+
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+var service struct {
+	handle      uintptr
+	exitChan    chan int
+	startedChan chan bool
+	stopChan    chan int
+	stoppedChan chan int
+}
+
+// startService connects to the Windows service control manager when nsqd
+// was started as a service (returning false when run from a console), after
+// which stop and shutdown requests are delivered on exitChan
+func startService(exitChan chan int) bool {
+	service.exitChan = exitChan
+	service.startedChan = make(chan bool, 1)
+	service.stopChan = make(chan int)
+	service.stoppedChan = make(chan int)
+
+	go func() {
+		// the dispatcher blocks this thread until the service has stopped
+		runtime.LockOSThread()
+
+		name := syscall.StringToUTF16Ptr("nsqd")
+		table := []serviceTableEntry{
+			{name, syscall.NewCallback(serviceMain)},
+			{nil, 0},
+		}
+		r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+		if r == 0 {
+			if errno, ok := err.(syscall.Errno); !ok || errno != errorFailedServiceControllerConnect {
+				log.Printf("ERROR: failed to start service control dispatcher - %s", err)
+			}
+			service.startedChan <- false
+		}
+	}()
+
+	return <-service.startedChan
+}
+
+// stopService reports to the service control manager that we've stopped,
+// it must be called (after nsqd.Exit()) if startService returned true
+func stopService() {
+	close(service.stopChan)
+	<-service.stoppedChan
+}
+
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	name := syscall.StringToUTF16Ptr("nsqd")
+	h, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(name)),
+		syscall.NewCallback(serviceCtrlHandler), 0)
+	if h == 0 {
+		log.Printf("ERROR: failed to register service control handler - %s", err)
+		service.startedChan <- false
+		return 0
+	}
+	service.handle = h
+
+	setServiceStatus(serviceRunning, serviceAcceptStop|serviceAcceptShutdown, 0)
+	log.Printf("SERVICE: running")
+	service.startedChan <- true
+
+	<-service.stopChan
+
+	setServiceStatus(serviceStopped, 0, 0)
+	log.Printf("SERVICE: stopped")
+	close(service.stoppedChan)
+	return 0
+}
+
+func serviceCtrlHandler(control uint32, eventType uint32, eventData uintptr, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		log.Printf("SERVICE: received stop request (%d)", control)
+		setServiceStatus(serviceStopPending, 0, serviceStopWaitHint)
+		go func() {
+			service.exitChan <- 1
+		}()
+		return 0
+	case serviceControlInterrogate:
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+func setServiceStatus(state uint32, accepts uint32, waitHint uint32) {
+	status := &serviceStatus{
+		serviceType:      serviceWin32OwnProcess,
+		currentState:     state,
+		controlsAccepted: accepts,
+		waitHint:         waitHint,
+	}
+	r, _, err := procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(status)))
+	if r == 0 {
+		log.Printf("ERROR: failed to set service status %d - %s", state, err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync/atomic"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+)
+
+// a sharded topic is a logical topic split into concrete ones, orders with 16
+// shards is orders.0 to orders.15... messages published to it go to the shard
+// their key hashes to (see partition.go) so every producer partitions the
+// same way, unkeyed messages go to each shard in turn. Consumers subscribe to
+// the shards, nsqlookupd's /lookup of the sharded topic lists them (nsqd
+// reports its sharded topics with SHARDS).
+//
+// changing the number of shards moves keys to other shards, shards that are
+// no longer published to are left to be drained
+
+// shardsChanged is sent (as the topic name) to lookupLoop when a sharded
+// topic is created or deleted
+type shardsChanged string
+
+// SetShards configures topicName as a sharded topic with shards shards,
+// creating any that don't exist
+func (n *NSQD) SetShards(topicName string, shards int) error {
+	if !nsq.IsValidTopicName(topicName) {
+		return errors.New("INVALID_TOPIC")
+	}
+
+	// a key's shard is its hash modulo the number of shards
+	if shards < 1 || shards > maxPartitions {
+		return errors.New("INVALID_ARG_SHARDS")
+	}
+
+	topicNames := util.ShardTopicNames(topicName, shards)
+	if !nsq.IsValidTopicName(topicNames[shards-1]) {
+		return errors.New("INVALID_TOPIC")
+	}
+
+	n.RLock()
+	_, exists := n.topicMap[topicName]
+	n.RUnlock()
+	if exists || n.isAlias(topicName) {
+		return errors.New("TOPIC_EXISTS")
+	}
+
+	for _, name := range topicNames {
+		if n.isAlias(name) || n.Shards(name) > 0 {
+			// shards are concrete topics
+			return errors.New("INVALID_ARG_SHARDS")
+		}
+	}
+
+	// make sure the shards exist (and are registered with lookupd)
+	for _, name := range topicNames {
+		n.GetTopic(name)
+	}
+
+	n.Lock()
+	n.shardMap[topicName] = shards
+	log.Printf("SHARDS(%s): sharded %d ways", topicName, shards)
+	err := n.PersistMetadata()
+	n.Unlock()
+
+	go n.Notify(shardsChanged(topicName))
+
+	return err
+}
+
+// DeleteShards makes topicName no longer a sharded topic, its shards are left
+// untouched
+func (n *NSQD) DeleteShards(topicName string) error {
+	n.Lock()
+	defer n.Unlock()
+
+	_, ok := n.shardMap[topicName]
+	if !ok {
+		return errors.New("SHARDS_NOT_FOUND")
+	}
+	delete(n.shardMap, topicName)
+	log.Printf("SHARDS(%s): deleted", topicName)
+
+	go n.Notify(shardsChanged(topicName))
+
+	return n.PersistMetadata()
+}
+
+// Shards returns the number of shards of topicName (0 if it isn't sharded)
+func (n *NSQD) Shards(topicName string) int {
+	n.RLock()
+	defer n.RUnlock()
+	return n.shardMap[topicName]
+}
+
+// shardMessages splits msgs between shards shards, by their key's hash (or,
+// when they have none, each shard in turn)
+func (n *NSQD) shardMessages(shards int, msgs []*nsq.Message) [][]*nsq.Message {
+	shardMsgs := make([][]*nsq.Message, shards)
+	for _, msg := range msgs {
+		var shard int
+		if hash, ok := messageKeyHash(msg.Id); ok {
+			shard = int(hash) % shards
+		} else {
+			shard = int(atomic.AddUint64(&n.shardSequence, 1) % uint64(shards))
+		}
+		shardMsgs[shard] = append(shardMsgs[shard], msg)
+	}
+	return shardMsgs
+}
+
+// shardsCommand builds a SHARDS command reporting the number of shards of
+// each sharded topic
+func (n *NSQD) shardsCommand() *nsq.Command {
+	n.RLock()
+	body, err := json.Marshal(n.shardMap)
+	n.RUnlock()
+	if err != nil {
+		log.Printf("ERROR: failed to marshal shards - %s", err.Error())
+		return nil
+	}
+	return &nsq.Command{Name: []byte("SHARDS"), Body: body}
+}
+
+// sendShards sends cmd to lookupPeer if it supports it (older nsqlookupd
+// would close the connection)
+func (n *NSQD) sendShards(lookupPeer *LookupPeer, cmd *nsq.Command) {
+	if cmd == nil || !lookupPeer.Info.ShardReports {
+		return
+	}
+	_, err := lookupPeer.Command(cmd)
+	if err != nil {
+		log.Printf("LOOKUPD(%s): ERROR %s - %s", lookupPeer, cmd, err.Error())
+	}
+}
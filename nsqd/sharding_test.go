@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestShardedTopic(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_shards" + strconv.Itoa(int(time.Now().Unix()))
+
+	post := func(endpoint string, body string) int {
+		resp, err := http.Post(fmt.Sprintf("http://%s%s", httpAddr, endpoint),
+			"application/octet-stream", strings.NewReader(body))
+		assert.Equal(t, err, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, post("/create_sharded_topic?topic="+topicName+"&shards=4", ""), 200)
+	assert.Equal(t, nsqd.Shards(topicName), 4)
+	shards := make([]*Topic, 4)
+	for i, name := range util.ShardTopicNames(topicName, 4) {
+		topic, err := nsqd.GetExistingTopic(name)
+		assert.Equal(t, err, nil)
+		shards[i] = topic
+	}
+	_, err := nsqd.GetExistingTopic(topicName)
+	assert.NotEqual(t, err, nil)
+
+	depths := func() []int64 {
+		d := make([]int64, len(shards))
+		for i, topic := range shards {
+			d[i] = topic.Depth()
+		}
+		return d
+	}
+
+	// messages with the same key go to the same shard
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, post("/put?topic="+topicName+"&key=user1", "test body"), 200)
+	}
+	var keyed int
+	for i, depth := range depths() {
+		if depth > 0 {
+			assert.Equal(t, depth, int64(3))
+			keyed = i
+		}
+	}
+
+	// and unkeyed messages to each shard in turn
+	assert.Equal(t, post("/mput?topic="+topicName, "a\nb\nc\nd"), 200)
+	for i, depth := range depths() {
+		if i == keyed {
+			assert.Equal(t, depth, int64(4))
+		} else {
+			assert.Equal(t, depth, int64(1))
+		}
+	}
+
+	metadata, err := getMetadata(nsqd)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, metadata.Get("shards").Get(topicName).MustInt64(), int64(4))
+
+	// a sharded topic can't shadow an existing topic
+	assert.Equal(t, post("/create_sharded_topic?topic="+shards[0].name+"&shards=2", ""), 500)
+	assert.Equal(t, post("/create_sharded_topic?topic="+topicName+"x&shards=0", ""), 500)
+
+	// deleting it leaves the shards
+	assert.Equal(t, post("/delete_sharded_topic?topic="+topicName, ""), 200)
+	assert.Equal(t, nsqd.Shards(topicName), 0)
+	assert.Equal(t, shards[0].Exiting(), false)
+}
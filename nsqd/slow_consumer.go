@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// a consumer that can't keep up with what it's sent (ie. a broken NIC) holds
+// on to in-flight messages until they time out, to be redelivered... it's
+// spotted by its flushes, --slow-consumer-flushes in a row that take longer
+// than its output buffer timeout (or that miss the write deadline) make it a
+// slow consumer until one doesn't
+//
+// slow consumers are reported in /stats and, with --slow-consumer-disconnect,
+// disconnected (which requeues their in-flight messages straight away)
+
+// flushed records how long a flush of buffered data took
+func (c *ClientV2) flushed(took time.Duration, err error) {
+	threshold := c.context.nsqd.options.SlowConsumerFlushes
+	if threshold <= 0 {
+		return
+	}
+
+	timeout := c.OutputBufferTimeout
+	if timeout <= 0 {
+		// output buffering is disabled
+		timeout = c.context.nsqd.options.MaxOutputBufferTimeout
+	}
+
+	deadlineMissed := false
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		deadlineMissed = true
+	} else if err != nil {
+		// the connection is broken (ie. closed) rather than slow
+		return
+	}
+
+	if !deadlineMissed && took <= timeout {
+		atomic.StoreInt32(&c.slowFlushesInRow, 0)
+		if atomic.CompareAndSwapInt32(&c.slowConsumer, 1, 0) {
+			log.Printf("PROTOCOL(V2): [%s] no longer a slow consumer", c)
+		}
+		return
+	}
+
+	atomic.AddUint64(&c.slowFlushCount, 1)
+	inRow := atomic.AddInt32(&c.slowFlushesInRow, 1)
+	// a missed deadline leaves the connection unusable
+	if inRow < int32(threshold) && !deadlineMissed {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&c.slowConsumer, 0, 1) {
+		log.Printf("PROTOCOL(V2): [%s] slow consumer, %d flushes in a row over %s (last took %s)",
+			c, inRow, timeout, took)
+	}
+	if c.context.nsqd.options.SlowConsumerDisconnect {
+		log.Printf("PROTOCOL(V2): [%s] disconnecting slow consumer", c)
+		c.Close()
+	}
+}
+
+func (c *ClientV2) IsSlowConsumer() bool {
+	return atomic.LoadInt32(&c.slowConsumer) == 1
+}
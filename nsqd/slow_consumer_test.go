@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// slowConn is a connection whose writes take delay
+type slowConn struct {
+	net.Conn
+	delay  int64
+	closed int32
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(atomic.LoadInt64(&c.delay)))
+	return len(b), nil
+}
+
+func (c *slowConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.Conn.Close()
+}
+
+func TestSlowConsumer(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.SlowConsumerFlushes = 3
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	sc := &slowConn{Conn: conn, delay: int64(20 * time.Millisecond)}
+	client := NewClientV2(0, sc, &Context{nsqd})
+	client.OutputBufferTimeout = 10 * time.Millisecond
+
+	flush := func() {
+		client.Writer.Write([]byte("data"))
+		client.Flush()
+	}
+
+	flush()
+	flush()
+	assert.Equal(t, client.Stats().SlowConsumer, false)
+	flush()
+	stats := client.Stats()
+	assert.Equal(t, stats.SlowConsumer, true)
+	assert.Equal(t, stats.SlowFlushCount, uint64(3))
+	assert.Equal(t, atomic.LoadInt32(&sc.closed), int32(0))
+
+	// a flush within the timeout clears it
+	atomic.StoreInt64(&sc.delay, 0)
+	flush()
+	stats = client.Stats()
+	assert.Equal(t, stats.SlowConsumer, false)
+	assert.Equal(t, stats.SlowFlushCount, uint64(3))
+
+	// flushing nothing doesn't count
+	atomic.StoreInt64(&sc.delay, int64(20*time.Millisecond))
+	for i := 0; i < 3; i++ {
+		client.Flush()
+	}
+	assert.Equal(t, client.Stats().SlowConsumer, false)
+
+	nsqd.options.SlowConsumerDisconnect = true
+	for i := 0; i < 3; i++ {
+		flush()
+	}
+	assert.Equal(t, client.Stats().SlowConsumer, true)
+	assert.Equal(t, atomic.LoadInt32(&sc.closed), int32(1))
+}
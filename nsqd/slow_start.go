@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// a channel can be given a slow start window so that a fleet of consumers
+// reconnecting at once (ie. after a deploy) doesn't hit downstream systems
+// with its full RDY... over the window following its SUB a client's
+// effective RDY ramps linearly from 1 to the RDY it asked for, whatever that
+// is (it isn't told, it's just sent messages no faster)
+//
+// multiplexed clients (and HTTP/push consumers) aren't ramped
+
+var errInvalidSlowStart = errors.New("invalid slow start window")
+
+// SetSlowStart sets the window over which a newly subscribed client's RDY is
+// ramped up, 0 doesn't ramp it
+func (c *Channel) SetSlowStart(window time.Duration) error {
+	if window < 0 {
+		return errInvalidSlowStart
+	}
+
+	atomic.StoreInt64(&c.slowStart, int64(window))
+	log.Printf("CHANNEL(%s): slow start %s", c.name, window)
+
+	c.context.nsqd.Lock()
+	defer c.context.nsqd.Unlock()
+	return c.context.nsqd.PersistMetadata()
+}
+
+func (c *Channel) SlowStart() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.slowStart))
+}
+
+// slowStartReadyCount returns the client's RDY as ramped by its channel's slow
+// start (readyCount once the window has passed)
+func (c *ClientV2) slowStartReadyCount(readyCount int64) int64 {
+	subscribedAt := atomic.LoadInt64(&c.subscribedAt)
+	if readyCount <= 1 || subscribedAt == 0 || atomic.LoadInt32(&c.Multiplexed) == 1 {
+		return readyCount
+	}
+
+	window := int64(c.Channel.SlowStart())
+	elapsed := time.Now().UnixNano() - subscribedAt
+	if window <= 0 || elapsed >= window {
+		return readyCount
+	}
+	return 1 + (readyCount-1)*elapsed/window
+}
+
+// wakeAfterSlowStartStep has messagePump re-check the client's readiness
+// once its ramped RDY next grows past rampedCount (it would otherwise only
+// do so once a message is finished)
+func (c *ClientV2) wakeAfterSlowStartStep(rampedCount int64, readyCount int64) {
+	if !atomic.CompareAndSwapInt32(&c.slowStartWakeArmed, 0, 1) {
+		return
+	}
+
+	window := int64(c.Channel.SlowStart())
+	next := atomic.LoadInt64(&c.subscribedAt) + rampedCount*window/(readyCount-1)
+	time.AfterFunc(time.Duration(next-time.Now().UnixNano())+time.Millisecond, func() {
+		atomic.StoreInt32(&c.slowStartWakeArmed, 0)
+		c.tryUpdateReadyState()
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestChannelSlowStart(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_slow_start" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/set_channel_slow_start?topic=%s&channel=ch&window=1s", httpAddr, topicName)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, channel.SlowStart(), time.Second)
+	assert.Equal(t, NewChannelStats(channel, nil).SlowStart, int64(1000))
+
+	for i := 0; i < 20; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	sub(t, conn, topicName, "ch")
+	err = nsq.Ready(20).Write(conn)
+	assert.Equal(t, err, nil)
+
+	// a fraction of the RDY at first (1 + 19 * 0.25s / 1s)...
+	received := readMessagesUntil(t, conn, time.Now().Add(250*time.Millisecond))
+	assert.Equal(t, received >= 1 && received <= 6, true)
+
+	// ...all of it once the window has passed
+	received += readMessagesUntil(t, conn, time.Now().Add(time.Second))
+	assert.Equal(t, received, 20)
+
+	url = fmt.Sprintf("http://%s/set_channel_slow_start?topic=%s&channel=ch&window=-1s", httpAddr, topicName)
+	resp, err = http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+}
+
+// readMessagesUntil counts the messages read off conn until deadline
+func readMessagesUntil(t *testing.T, conn net.Conn, deadline time.Time) int {
+	var count int
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		resp, err := nsq.ReadResponse(conn)
+		if err != nil {
+			break
+		}
+		frameType, _, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, err, nil)
+		if frameType == nsq.FrameTypeMessage {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// publishedBefore returns a BackendQueue.SkipWhile func for data (of topicName)
+// published before ts, anything that can't be decoded stops the skip
+func publishedBefore(encryption *atRestEncryption, topicName string, ts int64) func([]byte) bool {
+	return func(data []byte) bool {
+		data, err := encryption.open(topicName, data)
+		if err != nil {
+			return false
+		}
+		msg, err := nsq.DecodeMessage(data)
+		if err != nil {
+			return false
+		}
+		return msg.Timestamp < ts
+	}
+}
+
+// SetStartAt makes the channel skip every message published before startAt
+// (a zero time disables it), the backlog on disk is fast forwarded past
+// them, returning how many were skipped
+func (c *Channel) SetStartAt(startAt time.Time) (int64, error) {
+	var ts int64
+	if !startAt.IsZero() {
+		ts = startAt.UnixNano()
+	}
+	atomic.StoreInt64(&c.startAt, ts)
+	if ts == 0 {
+		return 0, nil
+	}
+
+	log.Printf("CHANNEL(%s): starting at %s", c.name, startAt)
+
+	skipped, err := c.backend.SkipWhile(publishedBefore(c.context.nsqd.encryption, c.topicName, ts))
+	atomic.AddUint64(&c.skippedCount, uint64(skipped))
+	return skipped, err
+}
+
+// StartAt returns the time before which published messages are skipped (if any)
+func (c *Channel) StartAt() time.Time {
+	ts := atomic.LoadInt64(&c.startAt)
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ts)
+}
+
+// skip reports (and counts) whether msg was published before the channel's start
+func (c *Channel) skip(msg *nsq.Message) bool {
+	if msg.Timestamp >= atomic.LoadInt64(&c.startAt) {
+		return false
+	}
+	atomic.AddUint64(&c.skippedCount, 1)
+	return true
+}
+
+// GetChannelStartingAt returns the (potentially new) channel after setting its
+// start (see Channel.SetStartAt), when it's the topic's only channel the topic's
+// own backlog is fast forwarded as well
+func (t *Topic) GetChannelStartingAt(channelName string, startAt time.Time) (*Channel, int64, error) {
+	channel := t.GetChannel(channelName)
+	skipped, err := channel.SetStartAt(startAt)
+	if err != nil || startAt.IsZero() {
+		return channel, skipped, err
+	}
+
+	t.RLock()
+	only := len(t.channelMap) == 1 && t.channelMap[channelName] == channel
+	t.RUnlock()
+	if only {
+		n, err := t.backend.SkipWhile(publishedBefore(t.context.nsqd.encryption, t.name, startAt.UnixNano()))
+		atomic.AddUint64(&channel.skippedCount, uint64(n))
+		skipped += n
+		if err != nil {
+			return channel, skipped, err
+		}
+	}
+
+	t.context.nsqd.Lock()
+	defer t.context.nsqd.Unlock()
+	return channel, skipped, t.context.nsqd.PersistMetadata()
+}
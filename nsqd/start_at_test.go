@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestChannelStartAt(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	// everything goes to disk
+	options.MemQueueSize = 0
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_start_at" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	old := time.Now().Add(-time.Hour).UnixNano()
+	for i := 0; i < 5; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte(strconv.Itoa(i)))
+		if i < 3 {
+			msg.Timestamp = old
+		}
+		topic.PutMessage(msg)
+	}
+	for i := 0; topic.Depth() != 5 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, topic.Depth(), int64(5))
+
+	endpoint := fmt.Sprintf("http://%s/create_channel?topic=%s&channel=ch", httpAddr, topicName)
+	_, err := util.ApiRequest(endpoint + "&start_at=abc")
+	assert.NotEqual(t, err, nil)
+
+	startAt := time.Now().Add(-time.Minute)
+	_, err = util.ApiRequest(fmt.Sprintf("%s&start_at=%d", endpoint, startAt.Unix()))
+	assert.Equal(t, err, nil)
+
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, channel.StartAt().Unix(), startAt.Unix())
+
+	// whatever the topic already routed is skipped by the channel
+	assert.Equal(t, string((<-channel.clientMsgChan).Body), "3")
+	assert.Equal(t, string((<-channel.clientMsgChan).Body), "4")
+	assert.Equal(t, atomic.LoadUint64(&channel.skippedCount), uint64(3))
+
+	metadata, _ := getMetadata(nsqd)
+	channelJs := metadata.Get("topics").GetIndex(0).Get("channels").GetIndex(0)
+	assert.Equal(t, channelJs.Get("start_at").MustInt64(), time.Unix(startAt.Unix(), 0).UnixNano())
+}
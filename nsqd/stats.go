@@ -2,6 +2,9 @@ package main
 
 import (
 	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/bitly/nsq/util"
 )
@@ -14,10 +17,75 @@ type TopicStats struct {
 	MessageCount uint64         `json:"message_count"`
 	Paused       bool           `json:"paused"`
 
+	// PublishPaused is reject or buffer when publishes are paused
+	PublishPaused string `json:"publish_paused,omitempty"`
+
+	OverflowPolicy string `json:"overflow_policy"`
+	DroppedCount   uint64 `json:"dropped_count"`
+
+	SyncPolicy string `json:"sync_policy"`
+
+	// LargeMessageAction is divert or reject when the topic has a large
+	// message rule, LargeMessageCount is how many messages it has applied to
+	LargeMessageSize   int64  `json:"large_message_size,omitempty"`
+	LargeMessageAction string `json:"large_message_action,omitempty"`
+	LargeMessageCount  uint64 `json:"large_message_count"`
+
+	// SchemaMode is empty when the topic has no schema
+	SchemaMode       string `json:"schema_mode,omitempty"`
+	SchemaViolations uint64 `json:"schema_violations"`
+
+	// ReplicaOf is the cluster the topic is replicated from (see replication.go)
+	ReplicaOf string `json:"replica_of,omitempty"`
+
+	// Annotations are the topic's owner, description etc. (see meta_annotations.go)
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	MessageBytes  uint64              `json:"message_bytes"`
+	OversizeCount uint64              `json:"oversize_count"`
+	MessageSizes  []MessageSizeBucket `json:"message_sizes"`
+
+	Producers []ProducerStats `json:"producers"`
+
+	PublishLatency       *util.PercentileResult `json:"publish_latency"`
 	E2eProcessingLatency *util.PercentileResult `json:"e2e_processing_latency"`
 }
 
+// MessageSizeBucket is a single bucket of a topic's published message size
+// histogram, Le is the bucket's upper bound in bytes (or "inf")
+type MessageSizeBucket struct {
+	Le    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// ProducerStats describes a TCP client connection, or the source IP of HTTP
+// publishes, that has published to a topic (LastPublish is a unix timestamp)
+type ProducerStats struct {
+	Protocol     string `json:"protocol"`
+	Address      string `json:"address"`
+	Name         string `json:"name"`
+	MessageCount uint64 `json:"message_count"`
+	LastPublish  int64  `json:"last_publish"`
+}
+
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
+	counts := t.MessageSizeCounts()
+	sizes := make([]MessageSizeBucket, len(counts))
+	for i, count := range counts {
+		le := "inf"
+		if i < len(messageSizeBuckets) {
+			le = strconv.Itoa(messageSizeBuckets[i])
+		}
+		sizes[i] = MessageSizeBucket{le, count}
+	}
+
+	var schemaMode string
+	if schema := t.Schema(); schema != nil {
+		schemaMode = schema.mode.String()
+	}
+
+	largeMessageSize, largeMessageAction := t.LargeMessageRule()
+
 	return TopicStats{
 		TopicName:    t.name,
 		Channels:     channels,
@@ -26,6 +94,31 @@ func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
 		MessageCount: t.messageCount,
 		Paused:       t.IsPaused(),
 
+		PublishPaused: t.PublishPaused().String(),
+
+		OverflowPolicy: t.context.nsqd.resolveOverflowPolicy(t.OverflowPolicy()).String(),
+		DroppedCount:   atomic.LoadUint64(&t.droppedCount),
+
+		SyncPolicy: t.SyncPolicy().String(),
+
+		LargeMessageSize:   largeMessageSize,
+		LargeMessageAction: largeMessageAction.String(),
+		LargeMessageCount:  atomic.LoadUint64(&t.largeMessageCount),
+
+		SchemaMode:       schemaMode,
+		SchemaViolations: atomic.LoadUint64(&t.schemaViolationCount),
+
+		ReplicaOf: t.ReplicaOf(),
+
+		Annotations: t.MetaAnnotations(),
+
+		MessageBytes:  atomic.LoadUint64(&t.messageBytes),
+		OversizeCount: atomic.LoadUint64(&t.oversizeCount),
+		MessageSizes:  sizes,
+
+		Producers: t.producers.Stats(),
+
+		PublishLatency:       t.publishLatencyStream.PercentileResult(),
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().PercentileResult(),
 	}
 }
@@ -39,8 +132,58 @@ type ChannelStats struct {
 	MessageCount  uint64        `json:"message_count"`
 	RequeueCount  uint64        `json:"requeue_count"`
 	TimeoutCount  uint64        `json:"timeout_count"`
+	OverflowCount uint64        `json:"overflow_count"`
 	Clients       []ClientStats `json:"clients"`
 	Paused        bool          `json:"paused"`
+	Partitions    int           `json:"partitions"`
+
+	OverflowPolicy string `json:"overflow_policy"`
+	DroppedCount   uint64 `json:"dropped_count"`
+
+	// StartAt is the unix timestamp before which published messages are skipped
+	StartAt      int64  `json:"start_at,omitempty"`
+	SkippedCount uint64 `json:"skipped_count"`
+
+	BackoffCount uint64 `json:"backoff_count"`
+
+	// DeliveryOrder is "fifo" when the backlog is drained first (see delivery_order.go)
+	DeliveryOrder string `json:"delivery_order"`
+
+	// DeliveryInterval is the minimum milliseconds between deliveries (see delivery_interval.go)
+	DeliveryInterval int64 `json:"delivery_interval,omitempty"`
+
+	// MaxInFlight is the ceiling on messages in flight across all clients (see
+	// channel_max_in_flight.go)
+	MaxInFlight int64 `json:"max_in_flight,omitempty"`
+
+	// SlowStart is the milliseconds over which a new client's RDY is ramped
+	// up (see slow_start.go)
+	SlowStart int64 `json:"slow_start,omitempty"`
+
+	// MaxDepth is the channel's own max depth (see sub_options.go)
+	MaxDepth int64 `json:"max_depth,omitempty"`
+
+	// MirrorOf is the channel this is a mirror of (see mirror.go)
+	MirrorOf         string `json:"mirror_of,omitempty"`
+	MirrorMaxRate    int64  `json:"mirror_max_rate,omitempty"`
+	RateLimitedCount uint64 `json:"rate_limited_count"`
+
+	// StatsResetAt is the unix timestamp the counters were last reset at
+	StatsResetAt int64 `json:"stats_reset_at,omitempty"`
+
+	// Quarantined is set while the channel is paused because of a requeue storm
+	// (see quarantine.go), since the unix timestamp QuarantinedAt
+	Quarantined   bool  `json:"quarantined"`
+	QuarantinedAt int64 `json:"quarantined_at,omitempty"`
+
+	// Annotations are the channel's owner, description etc. (see meta_annotations.go)
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// StuckMessages are the messages that timed out --stuck-message-timeouts times
+	StuckMessages []StuckMessageStats `json:"stuck_messages"`
+
+	// LagSeconds is the age of the oldest message waiting to be delivered
+	LagSeconds float64 `json:"lag_seconds"`
 
 	E2eProcessingLatency *util.PercentileResult `json:"e2e_processing_latency"`
 }
@@ -55,14 +198,50 @@ func NewChannelStats(c *Channel, clients []ClientStats) ChannelStats {
 		MessageCount:  c.messageCount,
 		RequeueCount:  c.requeueCount,
 		TimeoutCount:  c.timeoutCount,
+		OverflowCount: atomic.LoadUint64(&c.overflowCount),
 		Clients:       clients,
 		Paused:        c.IsPaused(),
+		Partitions:    c.Partitions(),
+
+		OverflowPolicy: c.context.nsqd.resolveOverflowPolicy(c.OverflowPolicy()).String(),
+		DroppedCount:   atomic.LoadUint64(&c.droppedCount),
+
+		StartAt:      atomic.LoadInt64(&c.startAt) / int64(time.Second),
+		SkippedCount: atomic.LoadUint64(&c.skippedCount),
+
+		BackoffCount: atomic.LoadUint64(&c.backoffCount),
+
+		DeliveryOrder: c.DeliveryOrder().String(),
+
+		DeliveryInterval: int64(c.DeliveryInterval() / time.Millisecond),
+
+		MaxInFlight: c.MaxInFlight(),
+
+		SlowStart: int64(c.SlowStart() / time.Millisecond),
+
+		MaxDepth: c.MaxDepth(),
+
+		MirrorOf:         c.MirrorOf(),
+		MirrorMaxRate:    c.MirrorMaxRate(),
+		RateLimitedCount: atomic.LoadUint64(&c.rateLimitedCount),
+
+		StatsResetAt: atomic.LoadInt64(&c.statsResetAt),
+
+		Quarantined:   c.IsQuarantined(),
+		QuarantinedAt: c.QuarantinedAt(),
+
+		Annotations: c.MetaAnnotations(),
+
+		StuckMessages: c.stuckMessageStats(),
+
+		LagSeconds: c.Lag().Seconds(),
 
 		E2eProcessingLatency: c.e2eProcessingLatencyStream.PercentileResult(),
 	}
 }
 
 type ClientStats struct {
+	ID            int64  `json:"client_id"`
 	Version       string `json:"version"`
 	RemoteAddress string `json:"remote_address"`
 	Name          string `json:"name"`
@@ -78,6 +257,21 @@ type ClientStats struct {
 	Deflate       bool   `json:"deflate"`
 	Snappy        bool   `json:"snappy"`
 	UserAgent     string `json:"user_agent"`
+	Paused        bool   `json:"paused"`
+
+	// OutputBufferTimeout is the client's (possibly tuned, see
+	// output_buffer_tuning.go) output buffer timeout in milliseconds
+	OutputBufferTimeout int64 `json:"output_buffer_timeout"`
+
+	// HeartbeatRTT is the round-trip time (ns) of the last heartbeat the client
+	// responded to and LastHeartbeatAge how long ago (ns) that was
+	HeartbeatRTT     int64 `json:"heartbeat_rtt"`
+	LastHeartbeatAge int64 `json:"last_heartbeat_age"`
+
+	// SlowConsumer is set while the client's flushes consistently take
+	// longer than its output buffer timeout, SlowFlushCount counts them
+	SlowConsumer   bool   `json:"slow_consumer"`
+	SlowFlushCount uint64 `json:"slow_flush_count"`
 }
 
 type Topics []*Topic
@@ -102,6 +296,20 @@ type ChannelsByName struct {
 
 func (c ChannelsByName) Less(i, j int) bool { return c.Channels[i].name < c.Channels[j].name }
 
+type Producers []ProducerStats
+
+func (p Producers) Len() int      { return len(p) }
+func (p Producers) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// ProducersByMessageCount sorts the busiest producers first
+type ProducersByMessageCount struct {
+	Producers
+}
+
+func (p ProducersByMessageCount) Less(i, j int) bool {
+	return p.Producers[i].MessageCount > p.Producers[j].MessageCount
+}
+
 func (n *NSQD) getStats() []TopicStats {
 	n.RLock()
 	defer n.RUnlock()
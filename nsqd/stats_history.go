@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the stats are snapshotted every --stats-history-interval and the last
+// --stats-history-size kept for /stats?history=true, so that a short-lived
+// monitoring script can compute deltas (ie. messages per second) from a
+// single request rather than keeping its own state between runs
+
+// StatsSnapshot is the topics' (and channels') stats at Timestamp, without
+// their clients and producers
+type StatsSnapshot struct {
+	Timestamp int64        `json:"timestamp"`
+	Topics    []TopicStats `json:"topics"`
+}
+
+type statsHistory struct {
+	sync.RWMutex
+	size      int
+	snapshots []StatsSnapshot
+}
+
+func newStatsHistory(size int) *statsHistory {
+	return &statsHistory{size: size}
+}
+
+func (h *statsHistory) add(snapshot StatsSnapshot) {
+	h.Lock()
+	defer h.Unlock()
+	h.snapshots = append(h.snapshots, snapshot)
+	if len(h.snapshots) > h.size {
+		h.snapshots = h.snapshots[len(h.snapshots)-h.size:]
+	}
+}
+
+// Snapshots returns the snapshots, oldest first
+func (h *statsHistory) Snapshots() []StatsSnapshot {
+	h.RLock()
+	defer h.RUnlock()
+	snapshots := make([]StatsSnapshot, len(h.snapshots))
+	copy(snapshots, h.snapshots)
+	return snapshots
+}
+
+func (n *NSQD) statsHistoryLoop() {
+	ticker := time.NewTicker(n.options.StatsHistoryInterval)
+	for {
+		select {
+		case <-n.exitChan:
+			goto exit
+		case <-ticker.C:
+			n.snapshotStats()
+		}
+	}
+
+exit:
+	ticker.Stop()
+}
+
+func (n *NSQD) snapshotStats() {
+	stats := n.getStats()
+	for i := range stats {
+		stats[i].Producers = nil
+		for j := range stats[i].Channels {
+			stats[i].Channels[j].Clients = nil
+		}
+	}
+	n.statsHistory.add(StatsSnapshot{
+		Timestamp: time.Now().Unix(),
+		Topics:    stats,
+	})
+}
+
+// ResetStats zeroes the channel's counters, its ChannelStats.StatsResetAt
+// tells whoever is computing deltas that they went backwards because of it
+func (c *Channel) ResetStats() {
+	for _, count := range []*uint64{
+		&c.messageCount,
+		&c.requeueCount,
+		&c.timeoutCount,
+		&c.overflowCount,
+		&c.droppedCount,
+		&c.skippedCount,
+		&c.backoffCount,
+		&c.rateLimitedCount,
+	} {
+		atomic.StoreUint64(count, 0)
+	}
+	atomic.StoreInt64(&c.statsResetAt, time.Now().Unix())
+	log.Printf("CHANNEL(%s): stats reset", c.name)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/assert"
+)
+
+func TestStatsHistory(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.StatsHistorySize = 2
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_stats_history" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	channel.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	nsqd.snapshotStats()
+
+	endpoint := fmt.Sprintf("http://%s/channel/stats/reset?topic=%s&channel=ch", httpAddr, topicName)
+	_, err := util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	nsqd.snapshotStats()
+	nsqd.snapshotStats()
+
+	data, err := util.ApiRequest(fmt.Sprintf("http://%s/stats?format=json&history=true", httpAddr))
+	assert.Equal(t, err, nil)
+	channelStats := data.Get("topics").GetIndex(0).Get("channels").GetIndex(0)
+	assert.Equal(t, channelStats.Get("message_count").MustInt64(), int64(0))
+	assert.NotEqual(t, channelStats.Get("stats_reset_at").MustInt64(), int64(0))
+
+	// only the last 2 are kept, both since the reset
+	history := data.Get("history")
+	assert.Equal(t, len(history.MustArray()), 2)
+	channelStats = history.GetIndex(0).Get("topics").GetIndex(0).Get("channels").GetIndex(0)
+	assert.Equal(t, channelStats.Get("message_count").MustInt64(), int64(0))
+
+	data, err = util.ApiRequest(fmt.Sprintf("http://%s/stats?format=json", httpAddr))
+	assert.Equal(t, err, nil)
+	_, ok := data.CheckGet("history")
+	assert.Equal(t, ok, false)
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"strconv"
 	"testing"
@@ -88,3 +90,125 @@ func TestClientAttributes(t *testing.T) {
 	assert.Equal(t, client.Get("user_agent").MustString(), userAgent)
 	assert.Equal(t, client.Get("snappy").MustBool(), true)
 }
+
+func TestMessageSizeStats(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.MaxMsgSize = 2048
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_msg_size_stats" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, make([]byte, 10)))
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, make([]byte, 256)))
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, make([]byte, 1500)))
+
+	url := fmt.Sprintf("http://%s/put?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer(make([]byte, 4096)))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+
+	stats := nsqd.getStats()
+	assert.Equal(t, len(stats), 1)
+	assert.Equal(t, stats[0].OversizeCount, uint64(1))
+	assert.Equal(t, len(stats[0].MessageSizes), len(messageSizeBuckets)+1)
+	assert.Equal(t, stats[0].MessageSizes[0], MessageSizeBucket{"256", 2})
+	assert.Equal(t, stats[0].MessageSizes[1], MessageSizeBucket{"1024", 0})
+	assert.Equal(t, stats[0].MessageSizes[2], MessageSizeBucket{"4096", 1})
+	assert.Equal(t, stats[0].MessageSizes[len(messageSizeBuckets)], MessageSizeBucket{"inf", 0})
+}
+
+func TestPublishStats(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.E2EProcessingLatencyPercentiles = []float64{1.0, 0.99}
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_publish_stats" + strconv.Itoa(int(time.Now().Unix()))
+	url := fmt.Sprintf("http://%s/put?topic=%s", httpAddr, topicName)
+	for _, size := range []int{10, 100} {
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer(make([]byte, size)))
+		assert.Equal(t, err, nil)
+		resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, 200)
+	}
+
+	stats := nsqd.getStats()
+	assert.Equal(t, len(stats), 1)
+	assert.Equal(t, stats[0].MessageBytes, uint64(110))
+	assert.Equal(t, stats[0].PublishLatency.Count, 2)
+	assert.Equal(t, len(stats[0].PublishLatency.Percentiles), 2)
+
+	assert.Equal(t, intervalDiff(110, 10), uint64(100))
+	// the topic was re-created
+	assert.Equal(t, intervalDiff(10, 110), uint64(10))
+}
+
+func TestProducerStats(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_producer_stats" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn, map[string]interface{}{"short_id": "publisher"}, nsq.FrameTypeResponse)
+	for i := 0; i < 3; i++ {
+		err = nsq.Publish(topicName, []byte("test body")).Write(conn)
+		assert.Equal(t, err, nil)
+		readValidate(t, conn, nsq.FrameTypeResponse, "OK")
+	}
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("http://%s/put?topic=%s", httpAddr, topicName),
+		bytes.NewBufferString("test body"))
+	req.Header.Set("User-Agent", "test-agent")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	stats := nsqd.getStats()
+	assert.Equal(t, len(stats), 1)
+	producers := stats[0].Producers
+	assert.Equal(t, len(producers), 2)
+
+	// busiest first
+	assert.Equal(t, producers[0].Protocol, "tcp")
+	assert.Equal(t, producers[0].Address, conn.LocalAddr().String())
+	assert.Equal(t, producers[0].Name, "publisher")
+	assert.Equal(t, producers[0].MessageCount, uint64(3))
+	assert.Equal(t, producers[0].LastPublish > 0, true)
+
+	assert.Equal(t, producers[1].Protocol, "http")
+	assert.Equal(t, producers[1].Address, "127.0.0.1")
+	assert.Equal(t, producers[1].Name, "test-agent")
+	assert.Equal(t, producers[1].MessageCount, uint64(1))
+	conn.Close()
+}
+
+func TestProducerStatsEviction(t *testing.T) {
+	var tp topicProducers
+	for i := 0; i < maxProducersPerTopic; i++ {
+		tp.published(producerID{"http", strconv.Itoa(i), ""}, 1)
+		tp.producers[producerID{"http", strconv.Itoa(i), ""}].LastPublish = int64(i + 1)
+	}
+	tp.published(producerID{"tcp", "new", ""}, 1)
+
+	stats := tp.Stats()
+	assert.Equal(t, len(stats), maxProducersPerTopic)
+	for _, p := range stats {
+		// the least recent publisher was forgotten
+		assert.NotEqual(t, p.Address, "0")
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bitly/nsq/util"
@@ -25,16 +28,69 @@ func (s Uint64Slice) Less(i, j int) bool {
 	return s[i] < s[j]
 }
 
+// statsdOptions are the --statsd-* options, which a config reload (see
+// reload.go) can change
+type statsdOptions struct {
+	address  string
+	prefix   string
+	interval time.Duration
+	memStats bool
+}
+
+// newStatsdOptions returns opts' statsd options, with the %s in the prefix
+// replaced by this nsqd's address
+func newStatsdOptions(opts *nsqdOptions, httpPort int) statsdOptions {
+	prefix := opts.StatsdPrefix
+	if prefix != "" {
+		statsdHostKey := util.StatsdHostKey(net.JoinHostPort(opts.BroadcastAddress,
+			strconv.Itoa(httpPort)))
+		prefix = strings.Replace(prefix, "%s", statsdHostKey, -1)
+		if prefix[len(prefix)-1] != '.' {
+			prefix += "."
+		}
+	}
+	return statsdOptions{
+		address:  opts.StatsdAddress,
+		prefix:   prefix,
+		interval: opts.StatsdInterval,
+		memStats: opts.StatsdMemStats,
+	}
+}
+
+func (n *NSQD) getStatsdOptions() statsdOptions {
+	n.reloadMutex.RLock()
+	defer n.reloadMutex.RUnlock()
+	return n.statsd
+}
+
+func (n *NSQD) setStatsdOptions(s statsdOptions) {
+	n.reloadMutex.Lock()
+	n.statsd = s
+	n.reloadMutex.Unlock()
+}
+
+// statsdLoop runs even without --statsd-address, a config reload can set one
 func (n *NSQD) statsdLoop() {
 	var lastMemStats runtime.MemStats
 	lastStats := make([]TopicStats, 0)
-	ticker := time.NewTicker(n.options.StatsdInterval)
+	interval := n.getStatsdOptions().interval
+	ticker := time.NewTicker(interval)
 	for {
 		select {
 		case <-n.exitChan:
 			goto exit
 		case <-ticker.C:
-			statsd := util.NewStatsdClient(n.options.StatsdAddress, n.options.StatsdPrefix)
+			options := n.getStatsdOptions()
+			if options.interval != interval {
+				interval = options.interval
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+			}
+			if options.address == "" {
+				continue
+			}
+
+			statsd := util.NewStatsdClient(options.address, options.prefix)
 			err := statsd.CreateSocket()
 			if err != nil {
 				log.Printf("ERROR: failed to create UDP socket to statsd(%s)", statsd)
@@ -57,12 +113,43 @@ func (n *NSQD) statsdLoop() {
 				stat := fmt.Sprintf("topic.%s.message_count", topic.TopicName)
 				statsd.Incr(stat, int64(diff))
 
+				// what was published over the interval, as gauges (rather
+				// than counters to take the derivative of) that don't break
+				// across restarts, a topic that was since re-created starts over
+				stat = fmt.Sprintf("topic.%s.messages_per_interval", topic.TopicName)
+				statsd.Gauge(stat, int64(intervalDiff(topic.MessageCount, lastTopic.MessageCount)))
+
+				diff = topic.MessageBytes - lastTopic.MessageBytes
+				stat = fmt.Sprintf("topic.%s.message_bytes", topic.TopicName)
+				statsd.Incr(stat, int64(diff))
+
+				stat = fmt.Sprintf("topic.%s.bytes_per_interval", topic.TopicName)
+				statsd.Gauge(stat, int64(intervalDiff(topic.MessageBytes, lastTopic.MessageBytes)))
+
 				stat = fmt.Sprintf("topic.%s.depth", topic.TopicName)
 				statsd.Gauge(stat, topic.Depth)
 
 				stat = fmt.Sprintf("topic.%s.backend_depth", topic.TopicName)
 				statsd.Gauge(stat, topic.BackendDepth)
 
+				diff = topic.OversizeCount - lastTopic.OversizeCount
+				stat = fmt.Sprintf("topic.%s.oversize_count", topic.TopicName)
+				statsd.Incr(stat, int64(diff))
+
+				for i, bucket := range topic.MessageSizes {
+					var lastCount uint64
+					if i < len(lastTopic.MessageSizes) {
+						lastCount = lastTopic.MessageSizes[i].Count
+					}
+					stat = fmt.Sprintf("topic.%s.message_size_le_%s", topic.TopicName, bucket.Le)
+					statsd.Incr(stat, int64(bucket.Count-lastCount))
+				}
+
+				for _, item := range topic.PublishLatency.Percentiles {
+					stat = fmt.Sprintf("topic.%s.publish_latency_%.0f", topic.TopicName, item["quantile"]*100.0)
+					statsd.Gauge(stat, int64(item["value"]))
+				}
+
 				for _, item := range topic.E2eProcessingLatency.Percentiles {
 					stat = fmt.Sprintf("topic.%s.e2e_processing_latency_%.0f", topic.TopicName, item["quantile"]*100.0)
 					// We can cast the value to int64 since a value of 1 is the
@@ -80,42 +167,56 @@ func (n *NSQD) statsdLoop() {
 							break
 						}
 					}
+					// mirrors are kept apart so they're not mistaken for (and
+					// don't alert as) production channels
+					kind := "channel"
+					if channel.MirrorOf != "" {
+						kind = "mirror"
+					}
+
 					diff := channel.MessageCount - lastChannel.MessageCount
-					stat := fmt.Sprintf("topic.%s.channel.%s.message_count", topic.TopicName, channel.ChannelName)
+					stat := fmt.Sprintf("topic.%s.%s.%s.message_count", topic.TopicName, kind, channel.ChannelName)
 					statsd.Incr(stat, int64(diff))
 
-					stat = fmt.Sprintf("topic.%s.channel.%s.depth", topic.TopicName, channel.ChannelName)
+					stat = fmt.Sprintf("topic.%s.%s.%s.depth", topic.TopicName, kind, channel.ChannelName)
 					statsd.Gauge(stat, channel.Depth)
 
-					stat = fmt.Sprintf("topic.%s.channel.%s.backend_depth", topic.TopicName, channel.ChannelName)
+					stat = fmt.Sprintf("topic.%s.%s.%s.backend_depth", topic.TopicName, kind, channel.ChannelName)
 					statsd.Gauge(stat, channel.BackendDepth)
 
-					stat = fmt.Sprintf("topic.%s.channel.%s.in_flight_count", topic.TopicName, channel.ChannelName)
+					stat = fmt.Sprintf("topic.%s.%s.%s.in_flight_count", topic.TopicName, kind, channel.ChannelName)
 					statsd.Gauge(stat, int64(channel.InFlightCount))
 
-					stat = fmt.Sprintf("topic.%s.channel.%s.deferred_count", topic.TopicName, channel.ChannelName)
+					stat = fmt.Sprintf("topic.%s.%s.%s.deferred_count", topic.TopicName, kind, channel.ChannelName)
 					statsd.Gauge(stat, int64(channel.DeferredCount))
 
+					stat = fmt.Sprintf("topic.%s.%s.%s.lag_seconds", topic.TopicName, kind, channel.ChannelName)
+					statsd.Gauge(stat, int64(channel.LagSeconds))
+
 					diff = channel.RequeueCount - lastChannel.RequeueCount
-					stat = fmt.Sprintf("topic.%s.channel.%s.requeue_count", topic.TopicName, channel.ChannelName)
+					stat = fmt.Sprintf("topic.%s.%s.%s.requeue_count", topic.TopicName, kind, channel.ChannelName)
 					statsd.Incr(stat, int64(diff))
 
 					diff = channel.TimeoutCount - lastChannel.TimeoutCount
-					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", topic.TopicName, channel.ChannelName)
+					stat = fmt.Sprintf("topic.%s.%s.%s.timeout_count", topic.TopicName, kind, channel.ChannelName)
+					statsd.Incr(stat, int64(diff))
+
+					diff = channel.OverflowCount - lastChannel.OverflowCount
+					stat = fmt.Sprintf("topic.%s.%s.%s.overflow_count", topic.TopicName, kind, channel.ChannelName)
 					statsd.Incr(stat, int64(diff))
 
-					stat = fmt.Sprintf("topic.%s.channel.%s.clients", topic.TopicName, channel.ChannelName)
+					stat = fmt.Sprintf("topic.%s.%s.%s.clients", topic.TopicName, kind, channel.ChannelName)
 					statsd.Gauge(stat, int64(len(channel.Clients)))
 
 					for _, item := range channel.E2eProcessingLatency.Percentiles {
-						stat = fmt.Sprintf("topic.%s.channel.%s.e2e_processing_latency_%.0f", topic.TopicName, channel.ChannelName, item["quantile"]*100.0)
+						stat = fmt.Sprintf("topic.%s.%s.%s.e2e_processing_latency_%.0f", topic.TopicName, kind, channel.ChannelName, item["quantile"]*100.0)
 						statsd.Gauge(stat, int64(item["value"]))
 					}
 				}
 			}
 			lastStats = stats
 
-			if n.options.StatsdMemStats {
+			if options.memStats {
 				var memStats runtime.MemStats
 				runtime.ReadMemStats(&memStats)
 
@@ -149,6 +250,15 @@ exit:
 	ticker.Stop()
 }
 
+// intervalDiff is how much a counter grew since its last value, all of it
+// when it was reset since
+func intervalDiff(value uint64, last uint64) uint64 {
+	if value < last {
+		return value
+	}
+	return value - last
+}
+
 func percentile(perc float64, arr []uint64, length int) uint64 {
 	indexOfPerc := int(math.Ceil(((perc / 100.0) * float64(length)) + 0.5))
 	if indexOfPerc >= length {
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// the most messages a channel tracks timeouts for, and lists as stuck
+const (
+	maxTimedOutMessages = 10000
+	maxStuckMessages    = 100
+)
+
+// timedOutMessage is what's known about a message that has timed out
+type timedOutMessage struct {
+	id          nsq.MessageID
+	attempts    uint16
+	timeouts    int
+	lastTimeout time.Time
+
+	clientID      int64
+	clientAddress string
+	clientName    string
+}
+
+// stuckMessages tracks the in-flight timeouts of a channel's messages (until
+// they're finished) so that the ones that keep timing out can be listed
+type stuckMessages struct {
+	sync.Mutex
+	messages map[nsq.MessageID]*timedOutMessage
+}
+
+// timedOut records that msg, held by clientID (client, if still connected),
+// timed out
+func (s *stuckMessages) timedOut(msg *nsq.Message, clientID int64, client Consumer) {
+	s.Lock()
+	defer s.Unlock()
+
+	m, ok := s.messages[msg.Id]
+	if !ok {
+		if s.messages == nil {
+			s.messages = make(map[nsq.MessageID]*timedOutMessage)
+		}
+		if len(s.messages) >= maxTimedOutMessages {
+			return
+		}
+		m = &timedOutMessage{id: msg.Id}
+		s.messages[msg.Id] = m
+	}
+	m.attempts = msg.Attempts
+	m.timeouts++
+	m.lastTimeout = time.Now()
+	m.clientID = clientID
+	m.clientAddress = ""
+	m.clientName = ""
+	if client != nil {
+		stats := client.Stats()
+		m.clientAddress = stats.RemoteAddress
+		m.clientName = stats.Name
+	}
+}
+
+// remove stops tracking id (it was finished or otherwise won't be delivered again)
+func (s *stuckMessages) remove(id nsq.MessageID) {
+	s.Lock()
+	delete(s.messages, id)
+	s.Unlock()
+}
+
+func (s *stuckMessages) reset() {
+	s.Lock()
+	s.messages = nil
+	s.Unlock()
+}
+
+// Stats returns the messages that timed out at least minTimeouts times,
+// those that timed out most often first
+func (s *stuckMessages) Stats(minTimeouts int) []StuckMessageStats {
+	if minTimeouts <= 0 {
+		return nil
+	}
+
+	s.Lock()
+	var stats []StuckMessageStats
+	for _, m := range s.messages {
+		if m.timeouts < minTimeouts {
+			continue
+		}
+		stats = append(stats, StuckMessageStats{
+			ID:            string(m.id[:]),
+			Attempts:      m.attempts,
+			Timeouts:      m.timeouts,
+			LastTimeout:   m.lastTimeout.Unix(),
+			ClientID:      m.clientID,
+			ClientAddress: m.clientAddress,
+			ClientName:    m.clientName,
+		})
+	}
+	s.Unlock()
+
+	sort.Sort(StuckMessagesByTimeouts(stats))
+	if len(stats) > maxStuckMessages {
+		stats = stats[:maxStuckMessages]
+	}
+	return stats
+}
+
+// StuckMessageStats describes a message that keeps timing out, the client
+// fields are of the client that held it when it last timed out
+type StuckMessageStats struct {
+	ID            string `json:"id"`
+	Attempts      uint16 `json:"attempts"`
+	Timeouts      int    `json:"timeouts"`
+	LastTimeout   int64  `json:"last_timeout"`
+	ClientID      int64  `json:"client_id"`
+	ClientAddress string `json:"client_address"`
+	ClientName    string `json:"client_name"`
+
+	// what it was REQ'd with (see annotations.go)
+	Annotations []MessageAnnotation `json:"annotations,omitempty"`
+}
+
+// stuckMessageStats lists the channel's stuck messages with their annotations
+func (c *Channel) stuckMessageStats() []StuckMessageStats {
+	stats := c.stuck.Stats(c.context.nsqd.options.StuckMessageTimeouts)
+	for i := range stats {
+		var id nsq.MessageID
+		copy(id[:], stats[i].ID)
+		stats[i].Annotations = c.annotations.get(id)
+	}
+	return stats
+}
+
+type StuckMessagesByTimeouts []StuckMessageStats
+
+func (s StuckMessagesByTimeouts) Len() int {
+	return len(s)
+}
+
+func (s StuckMessagesByTimeouts) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s StuckMessagesByTimeouts) Less(i, j int) bool {
+	if s[i].Timeouts == s[j].Timeouts {
+		return s[i].LastTimeout > s[j].LastTimeout
+	}
+	return s[i].Timeouts > s[j].Timeouts
+}
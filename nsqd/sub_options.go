@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// a SUB can declare how its channel is created, so that consumers don't need
+// the channel provisioned (via HTTP) beforehand, the options only apply when
+// it's that SUB that creates the channel, an existing channel is left as it is:
+//
+//     SUB <topic_name> <channel_name> [ephemeral=<true|false>] [start=<end|beginning>] [max_depth=<n>]
+//
+//  * ephemeral overrides whether the topic's channels are ephemeral (a
+//    #ephemeral channel always is)
+//  * start=end skips what was published before the channel was created,
+//    start=beginning delivers everything the topic retains (see Seek)
+//  * max_depth makes publishes to the topic fail once the channel is that
+//    deep (like a topic's max depth, for this channel alone)
+
+// channelCreateOptions are the options of a SUB
+type channelCreateOptions struct {
+	ephemeral *bool
+	start     string
+	maxDepth  int64
+}
+
+// parseChannelCreateOptions parses the <key>=<value> params of a SUB
+func parseChannelCreateOptions(params [][]byte) (*channelCreateOptions, error) {
+	opts := &channelCreateOptions{}
+	for _, param := range params {
+		kv := bytes.SplitN(param, []byte("="), 2)
+		if len(kv) != 2 {
+			// older clients follow the channel with their short and long IDs
+			continue
+		}
+		value := string(kv[1])
+		switch string(kv[0]) {
+		case "ephemeral":
+			ephemeral, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ephemeral %s", value)
+			}
+			opts.ephemeral = &ephemeral
+		case "start":
+			if value != "end" && value != "beginning" {
+				return nil, fmt.Errorf("invalid start %s (end or beginning)", value)
+			}
+			opts.start = value
+		case "max_depth":
+			maxDepth, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || maxDepth < 0 {
+				return nil, fmt.Errorf("invalid max_depth %s", value)
+			}
+			opts.maxDepth = maxDepth
+		default:
+			return nil, fmt.Errorf("unknown option %s", kv[0])
+		}
+	}
+	return opts, nil
+}
+
+// AutoCreateChannelWithOptions is AutoCreateChannel, applying opts when the
+// channel is created by this call
+func (t *Topic) AutoCreateChannelWithOptions(channelName string, opts *channelCreateOptions) (*Channel, error) {
+	t.RLock()
+	c, ok := t.channelMap[channelName]
+	t.RUnlock()
+	if ok {
+		return c, nil
+	}
+
+	d, err := t.context.nsqd.creationPolicy.Check(t.name, channelName, &creationDefaults{
+		memQueueSize: t.context.nsqd.options.MemQueueSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c, isNew := t.createChannel(channelName, d.memQueueSize, opts.ephemeral)
+	if !isNew || *opts == (channelCreateOptions{}) {
+		return c, nil
+	}
+
+	log.Printf("CHANNEL(%s): created with ephemeral=%t start=%s max_depth=%d",
+		c.name, c.ephemeralChannel, opts.start, opts.maxDepth)
+	if opts.maxDepth > 0 {
+		c.SetMaxDepth(opts.maxDepth)
+	}
+	switch opts.start {
+	case "end":
+		_, err = c.SetStartAt(time.Now())
+	case "beginning":
+		_, err = t.Seek(c, time.Unix(0, 0))
+		if err == errRetentionNotEnabled {
+			// nothing older than what's queued is kept
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Printf("CHANNEL(%s) ERROR: failed to start at the %s - %s", c.name, opts.start, err.Error())
+	}
+
+	t.context.nsqd.Lock()
+	err = t.context.nsqd.PersistMetadata()
+	t.context.nsqd.Unlock()
+	if err != nil {
+		log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+	}
+	return c, nil
+}
+
+// SetMaxDepth sets the depth at which the channel rejects publishes to its
+// topic (0 disables it)
+func (c *Channel) SetMaxDepth(maxDepth int64) {
+	atomic.StoreInt64(&c.maxDepth, maxDepth)
+}
+
+func (c *Channel) MaxDepth() int64 {
+	return atomic.LoadInt64(&c.maxDepth)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestSubChannelCreateOptions(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_sub_options" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("before")))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	cmd := &nsq.Command{
+		Name:   []byte("SUB"),
+		Params: [][]byte{[]byte(topicName), []byte("ch"), []byte("ephemeral=true"), []byte("start=end"), []byte("max_depth=3")},
+	}
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeResponse, "OK")
+
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, channel.ephemeralChannel, true)
+	assert.Equal(t, channel.MaxDepth(), int64(3))
+	assert.Equal(t, channel.StartAt().IsZero(), false)
+
+	// the channel is full at 3 (counting the message that's to be skipped)
+	for i := 0; i < 2; i++ {
+		err = nsqd.PutMessages(topicName, []*nsq.Message{nsq.NewMessage(<-nsqd.idChan, []byte("after"))})
+		assert.Equal(t, err, nil)
+	}
+	time.Sleep(50 * time.Millisecond)
+	err = nsqd.PutMessages(topicName, []*nsq.Message{nsq.NewMessage(<-nsqd.idChan, []byte("after"))})
+	assert.Equal(t, err, errTopicFull)
+
+	// the options of a SUB to an existing channel are ignored
+	conn2, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn2, nil, nsq.FrameTypeResponse)
+	cmd.Params[4] = []byte("max_depth=10")
+	err = cmd.Write(conn2)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn2, nsq.FrameTypeResponse, "OK")
+	assert.Equal(t, channel.MaxDepth(), int64(3))
+
+	// the message published before the channel was created is skipped
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msg, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(msg.Body), "after")
+
+	conn3, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn3, nil, nsq.FrameTypeResponse)
+	cmd.Params = [][]byte{[]byte(topicName), []byte("ch2"), []byte("start=middle")}
+	err = cmd.Write(conn3)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn3, nsq.FrameTypeError, "E_INVALID SUB invalid start middle (end or beginning)")
+}
@@ -0,0 +1,7 @@
+package main
+
+// syncDir is a no-op, Windows doesn't support fsync'ing a directory (its
+// renames are journaled by NTFS)
+func syncDir(dirName string) error {
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// syncPolicy decides how often a topic's (and its channels') disk queues are
+// fsync'd, a publisher can always ask for its messages to be fsync'd before
+// they're acknowledged (see PutMessagesDurable)
+type syncPolicy int32
+
+const (
+	// every --sync-every messages and every --sync-timeout
+	syncDefault syncPolicy = iota
+	// every message, before it's acknowledged (which means messages are
+	// always written to disk, never only kept in memory)
+	syncAlways
+	// only when a publisher asks for it
+	syncOnRequest
+)
+
+func parseSyncPolicy(s string) (syncPolicy, error) {
+	switch s {
+	case "", "default":
+		return syncDefault, nil
+	case "always":
+		return syncAlways, nil
+	case "on-request":
+		return syncOnRequest, nil
+	}
+	return syncDefault, fmt.Errorf("invalid sync policy %q", s)
+}
+
+func (p syncPolicy) String() string {
+	switch p {
+	case syncAlways:
+		return "always"
+	case syncOnRequest:
+		return "on-request"
+	}
+	return "default"
+}
+
+// applySyncPolicy sets the sync interval of bq that implements p
+func (n *NSQD) applySyncPolicy(p syncPolicy, bq BackendQueue) {
+	switch p {
+	case syncAlways:
+		bq.SetSyncInterval(1, n.options.SyncTimeout)
+	case syncOnRequest:
+		bq.SetSyncInterval(0, 0)
+	default:
+		bq.SetSyncInterval(n.options.SyncEvery, n.options.SyncTimeout)
+	}
+}
+
+// SetSyncPolicy sets how often the topic's, and its channels', disk queues
+// are fsync'd (syncDefault reverts to --sync-every and --sync-timeout)
+func (t *Topic) SetSyncPolicy(p syncPolicy) error {
+	atomic.StoreInt32(&t.syncPolicy, int32(p))
+	t.context.nsqd.applySyncPolicy(p, t.backend)
+
+	t.RLock()
+	for _, c := range t.channelMap {
+		c.setSyncPolicy(p)
+	}
+	t.RUnlock()
+	log.Printf("TOPIC(%s): sync policy %s", t.name, p)
+
+	t.context.nsqd.Lock()
+	defer t.context.nsqd.Unlock()
+	return t.context.nsqd.PersistMetadata()
+}
+
+// SyncPolicy returns the policy set on the topic
+func (t *Topic) SyncPolicy() syncPolicy {
+	return syncPolicy(atomic.LoadInt32(&t.syncPolicy))
+}
+
+// setSyncPolicy applies the policy of the channel's topic
+func (c *Channel) setSyncPolicy(p syncPolicy) {
+	atomic.StoreInt32(&c.syncPolicy, int32(p))
+	c.context.nsqd.applySyncPolicy(p, c.backend)
+}
+
+func (c *Channel) SyncPolicy() syncPolicy {
+	return syncPolicy(atomic.LoadInt32(&c.syncPolicy))
+}
+
+// putMessages publishes for client, durably if it negotiated durable_publish
+func (p *ProtocolV2) putMessages(client *ClientV2, topicName string, msgs []*nsq.Message) error {
+	client.RLock()
+	origin := client.ReplicationOrigin
+	client.RUnlock()
+	err := p.context.nsqd.checkReplica(topicName, origin)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if atomic.LoadInt32(&client.DurablePublish) == 1 {
+		err = p.context.nsqd.PutMessagesDurable(topicName, msgs)
+	} else {
+		err = p.context.nsqd.PutMessages(topicName, msgs)
+	}
+	if err == nil {
+		p.context.nsqd.recordPublishLatency(topicName, start)
+	}
+	return err
+}
+
+// putMessages publishes for an HTTP request, durably if it has the durable
+// parameter
+func (s *httpServer) putMessages(reqParams url.Values, topicName string, msgs []*nsq.Message) error {
+	err := s.context.nsqd.checkReplica(topicName, "")
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if _, ok := reqParams["durable"]; ok {
+		err = s.context.nsqd.PutMessagesDurable(topicName, msgs)
+	} else {
+		err = s.context.nsqd.PutMessages(topicName, msgs)
+	}
+	if err == nil {
+		s.context.nsqd.recordPublishLatency(topicName, start)
+	}
+	return err
+}
+
+// recordPublishLatency records how long a publish to a topic, that started
+// at start, took to be queued (for an alias, it isn't recorded)
+func (n *NSQD) recordPublishLatency(topicName string, start time.Time) {
+	topic, err := n.GetExistingTopic(topicName)
+	if err != nil || topic.publishLatencyStream == nil {
+		return
+	}
+	topic.publishLatencyStream.Insert(start.UnixNano())
+}
+
+// durablePut is a durable publish waiting on the topic's router
+type durablePut struct {
+	msgs []*nsq.Message
+	done chan error
+}
+
+// PutMessagesDurable hands the messages to the topic's router, which writes
+// them to the disk queue and fsyncs it before this returns, whatever the
+// topic's sync policy
+func (t *Topic) PutMessagesDurable(messages []*nsq.Message) error {
+	t.RLock()
+	if atomic.LoadInt32(&t.exitFlag) == 1 {
+		t.RUnlock()
+		return errors.New("exiting")
+	}
+	if err := t.checkPublish(); err != nil {
+		t.RUnlock()
+		return err
+	}
+	put := t.putMessagesDurable(messages)
+	t.RUnlock()
+
+	return <-put.done
+}
+
+// putMessagesDurable hands the messages to the topic's router, the returned
+// durablePut is done once they're written and fsync'd
+//
+// this expects the caller to hold the (read) lock and to have checked
+// that the topic is accepting messages
+func (t *Topic) putMessagesDurable(messages []*nsq.Message) *durablePut {
+	for _, msg := range messages {
+		t.retain(msg)
+		atomic.AddUint64(&t.messageCount, 1)
+		t.recordMessageSize(len(msg.Body))
+	}
+	put := &durablePut{msgs: messages, done: make(chan error, 1)}
+	t.durableChan <- put
+	return put
+}
+
+// writeDurable writes a durable publish to the disk queue, as one batch that
+// isn't read until all of it is written, and fsyncs it, this is only called
+// by router so that it's ordered with the topic's other publishes
+func (t *Topic) writeDurable(msgBuf *bytes.Buffer, messages []*nsq.Message) error {
+	msgBuf.Reset()
+	ends := make([]int, 0, len(messages))
+	for _, msg := range messages {
+		err := msg.Write(msgBuf)
+		if err != nil {
+			return err
+		}
+		ends = append(ends, msgBuf.Len())
+	}
+
+	data := msgBuf.Bytes()
+	batch := make([][]byte, 0, len(messages))
+	start := 0
+	for _, end := range ends {
+		batch = append(batch, data[start:end])
+		start = end
+	}
+	err := t.backend.PutMany(batch)
+	if err != nil {
+		return err
+	}
+	return t.backend.Sync()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestSyncPolicyAlways(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_sync_always" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/set_topic_sync_policy?topic=%s&policy=always", httpAddr, topicName)
+	resp, err := http.Get(url)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, topic.SyncPolicy(), syncAlways)
+	assert.Equal(t, NewTopicStats(topic, nil).SyncPolicy, "always")
+
+	// every message goes to disk, even though there's room in memory
+	for i := 0; i < 3; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	}
+	assert.Equal(t, waitForTopicDepth(topic, 3), int64(3))
+	assert.Equal(t, len(topic.memoryMsgChan), 0)
+	assert.Equal(t, topic.backend.Depth(), int64(3))
+
+	// channels follow their topic
+	channel := topic.GetChannel("ch")
+	assert.Equal(t, channel.SyncPolicy(), syncAlways)
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/set_topic_sync_policy?topic=%s&policy=sometimes", httpAddr, topicName))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 500)
+}
+
+func TestDurablePublish(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_durable_pub" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	// a durable publish is on disk by the time it's acknowledged
+	url := fmt.Sprintf("http://%s/pub?topic=%s&durable", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	assert.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, string(body), "OK")
+	assert.Equal(t, topic.backend.Depth(), int64(1))
+	assert.Equal(t, topic.messageCount, uint64(1))
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/bitly/nsq/util"
@@ -16,6 +17,13 @@ type tcpServer struct {
 func (p *tcpServer) Handle(clientConn net.Conn) {
 	log.Printf("TCP: new client(%s)", clientConn.RemoteAddr())
 
+	if interval := p.context.nsqd.options.TCPKeepAliveInterval; interval > 0 {
+		err := setKeepAlive(clientConn, interval)
+		if err != nil {
+			log.Printf("ERROR: client(%s) failed to enable TCP keepalive - %s", clientConn.RemoteAddr(), err.Error())
+		}
+	}
+
 	// The client should initialize itself by sending a 4 byte sequence indicating
 	// the version of the protocol that it intends to communicate, this will allow us
 	// to gracefully upgrade the protocol away from text/line oriented to whatever...
@@ -46,3 +54,17 @@ func (p *tcpServer) Handle(clientConn net.Conn) {
 		return
 	}
 }
+
+// setKeepAlive has the OS probe an otherwise silent connection every interval
+// (clients that disable heartbeats, ie. behind NAT, rely on it)
+func setKeepAlive(conn net.Conn, interval time.Duration) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	err := tcpConn.SetKeepAlive(true)
+	if err != nil {
+		return err
+	}
+	return setKeepAlivePeriod(tcpConn, interval)
+}
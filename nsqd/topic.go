@@ -11,16 +11,28 @@ import (
 	"github.com/bitly/nsq/util"
 )
 
+// messageSizeBuckets are the (inclusive) upper bounds, in bytes, of the
+// published message size histogram, the last bucket counts anything larger
+var messageSizeBuckets = []int{256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
 type Topic struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	messageCount uint64
+	messageCount         uint64
+	messageBytes         uint64
+	oversizeCount        uint64
+	messageSizeCounts    [8]uint64
+	maxDepth             int64
+	droppedCount         uint64
+	schemaViolationCount uint64
 
 	sync.RWMutex
 
 	name              string
+	memQueueSize      int64
 	channelMap        map[string]*Channel
 	backend           BackendQueue
 	incomingMsgChan   chan *nsq.Message
+	durableChan       chan *durablePut
 	memoryMsgChan     chan *nsq.Message
 	exitChan          chan int
 	channelUpdateChan chan int
@@ -30,29 +42,77 @@ type Topic struct {
 	paused    int32
 	pauseChan chan bool
 
+	// a publishPauseMode (see publish_pause.go)
+	publishPaused int32
+
+	// what to do when memoryMsgChan is full (see overflow_policy.go)
+	overflowPolicy int32
+
+	// how often the topic's disk queues are fsync'd (see sync_policy.go)
+	syncPolicy int32
+
+	// messages over largeMessageSize are diverted or rejected (see
+	// large_message.go)
+	largeMessageSize   int64
+	largeMessageAction int32
+	largeMessageCount  uint64
+
+	// set from the topic's cluster-wide configuration (see setConfig)
+	ephemeralChannels int32
+
+	// non-nil when messages are being retained (see SetRetention)
+	retention *retentionLog
+
+	// who has been publishing to the topic
+	producers topicProducers
+
+	// what published messages are validated against (see schema.go)
+	schemaLock sync.RWMutex
+	schema     *topicSchema
+
+	// the cluster this topic is replicated from (see replication.go), a
+	// replica only accepts publishes from that cluster's replicators
+	replicaLock sync.RWMutex
+	replicaOf   string
+
+	// owner, description etc. (see meta_annotations.go)
+	meta metaAnnotations
+
+	// how long publishes take to be queued (see recordPublishLatency)
+	publishLatencyStream *util.Quantile
+
 	options *nsqdOptions
 	context *Context
 }
 
 // Topic constructor
-func NewTopic(topicName string, context *Context) *Topic {
+func NewTopic(topicName string, context *Context, memQueueSize int64) *Topic {
 	diskQueue := NewDiskQueue(topicName,
 		context.nsqd.options.DataPath,
 		context.nsqd.options.MaxBytesPerFile,
 		context.nsqd.options.SyncEvery,
-		context.nsqd.options.SyncTimeout)
+		context.nsqd.options.SyncTimeout,
+		context.nsqd.options.WriteBatchWindow)
 
 	t := &Topic{
 		name:              topicName,
+		memQueueSize:      memQueueSize,
 		channelMap:        make(map[string]*Channel),
-		backend:           diskQueue,
+		backend:           newChaosBackend(newEncryptedBackend(diskQueue, topicName, context.nsqd.encryption), context.nsqd.chaos),
 		incomingMsgChan:   make(chan *nsq.Message, 1),
-		memoryMsgChan:     make(chan *nsq.Message, context.nsqd.options.MemQueueSize),
+		durableChan:       make(chan *durablePut),
+		memoryMsgChan:     make(chan *nsq.Message, memQueueSize),
 		exitChan:          make(chan int),
 		channelUpdateChan: make(chan int),
 		context:           context,
 		pauseChan:         make(chan bool),
 	}
+	if len(context.nsqd.options.E2EProcessingLatencyPercentiles) > 0 {
+		t.publishLatencyStream = util.NewQuantile(
+			context.nsqd.options.E2EProcessingLatencyWindowTime,
+			context.nsqd.options.E2EProcessingLatencyPercentiles,
+		)
+	}
 
 	t.waitGroup.Wrap(func() { t.router() })
 	t.waitGroup.Wrap(func() { t.messagePump() })
@@ -71,8 +131,20 @@ func (t *Topic) Exiting() bool {
 // to return a pointer to a Channel object (potentially new)
 // for the given Topic
 func (t *Topic) GetChannel(channelName string) *Channel {
+	return t.getChannel(channelName, t.context.nsqd.options.MemQueueSize)
+}
+
+// getChannel creates the channel (if it does not exist) with the given in-memory queue size
+func (t *Topic) getChannel(channelName string, memQueueSize int64) *Channel {
+	channel, _ := t.createChannel(channelName, memQueueSize, nil)
+	return channel
+}
+
+// createChannel is getChannel, also returning whether the channel was created,
+// ephemeral (if not nil) overrides whether the topic's channels are ephemeral
+func (t *Topic) createChannel(channelName string, memQueueSize int64, ephemeral *bool) (*Channel, bool) {
 	t.Lock()
-	channel, isNew := t.getOrCreateChannel(channelName)
+	channel, isNew := t.getOrCreateChannel(channelName, memQueueSize, ephemeral)
 	t.Unlock()
 
 	if isNew {
@@ -83,17 +155,24 @@ func (t *Topic) GetChannel(channelName string) *Channel {
 		}
 	}
 
-	return channel
+	return channel, isNew
 }
 
 // this expects the caller to handle locking
-func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
+func (t *Topic) getOrCreateChannel(channelName string, memQueueSize int64, ephemeralOverride *bool) (*Channel, bool) {
 	channel, ok := t.channelMap[channelName]
 	if !ok {
 		deleteCallback := func(c *Channel) {
 			t.DeleteExistingChannel(c.name)
 		}
-		channel = NewChannel(t.name, channelName, t.context, deleteCallback)
+		ephemeral := atomic.LoadInt32(&t.ephemeralChannels) == 1
+		if ephemeralOverride != nil {
+			ephemeral = *ephemeralOverride
+		}
+		channel = NewChannel(t.name, channelName, t.context, memQueueSize, ephemeral, deleteCallback)
+		if policy := t.SyncPolicy(); policy != syncDefault {
+			channel.setSyncPolicy(policy)
+		}
 		t.channelMap[channelName] = channel
 		log.Printf("TOPIC(%s): new channel(%s)", t.name, channel.name)
 		return channel, true
@@ -145,8 +224,10 @@ func (t *Topic) PutMessage(msg *nsq.Message) error {
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
-	t.incomingMsgChan <- msg
-	atomic.AddUint64(&t.messageCount, 1)
+	if err := t.checkPublish(); err != nil {
+		return err
+	}
+	t.putMessage(msg)
 	return nil
 }
 
@@ -156,13 +237,63 @@ func (t *Topic) PutMessages(messages []*nsq.Message) error {
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
+	if err := t.checkPublish(); err != nil {
+		return err
+	}
 	for _, m := range messages {
-		t.incomingMsgChan <- m
-		atomic.AddUint64(&t.messageCount, 1)
+		t.putMessage(m)
 	}
 	return nil
 }
 
+// this expects the caller to hold the (read) lock and to have checked
+// that the topic isn't exiting
+func (t *Topic) putMessage(msg *nsq.Message) {
+	t.retain(msg)
+	t.incomingMsgChan <- msg
+	atomic.AddUint64(&t.messageCount, 1)
+	t.recordMessageSize(len(msg.Body))
+}
+
+// recordMessageSize records a published message's size, in the histogram and
+// the topic's total bytes
+func (t *Topic) recordMessageSize(size int) {
+	atomic.AddUint64(&t.messageBytes, uint64(size))
+	i := 0
+	for i < len(messageSizeBuckets) && size > messageSizeBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&t.messageSizeCounts[i], 1)
+}
+
+// MessageSizeCounts returns a snapshot of the message size histogram,
+// one count per messageSizeBuckets entry plus one for larger messages
+func (t *Topic) MessageSizeCounts() []uint64 {
+	counts := make([]uint64, len(t.messageSizeCounts))
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&t.messageSizeCounts[i])
+	}
+	return counts
+}
+
+// OversizeMessage records that a publish to this topic was rejected
+// for exceeding --max-msg-size
+func (t *Topic) OversizeMessage() {
+	atomic.AddUint64(&t.oversizeCount, 1)
+}
+
+// retain records msg in the retention log (if enabled),
+// this expects the caller to handle locking
+func (t *Topic) retain(msg *nsq.Message) {
+	if t.retention == nil {
+		return
+	}
+	err := t.retention.Put(msg)
+	if err != nil {
+		log.Printf("TOPIC(%s) ERROR: failed to retain msg(%s) - %s", t.name, msg.Id, err.Error())
+	}
+}
+
 func (t *Topic) Depth() int64 {
 	return int64(len(t.memoryMsgChan)) + t.backend.Depth()
 }
@@ -176,12 +307,16 @@ func (t *Topic) messagePump() {
 	var chans []*Channel
 	var memoryMsgChan chan *nsq.Message
 	var backendChan chan []byte
+	// copies to many channels in parallel, nil when chans are few enough to
+	// be copied to serially (see topic_fanout.go)
+	var fanout *topicFanout
 
 	t.RLock()
 	for _, c := range t.channelMap {
 		chans = append(chans, c)
 	}
 	t.RUnlock()
+	fanout = t.updateFanout(fanout, chans)
 
 	if len(chans) > 0 {
 		memoryMsgChan = t.memoryMsgChan
@@ -192,7 +327,12 @@ func (t *Topic) messagePump() {
 		select {
 		case msg = <-memoryMsgChan:
 		case buf = <-backendChan:
-			msg, err = nsq.DecodeMessage(buf)
+			buf, err = t.context.nsqd.encryption.open(t.name, buf)
+			if err != nil {
+				log.Printf("ERROR: TOPIC(%s) failed to decrypt message - %s", t.name, err.Error())
+				continue
+			}
+			msg, err = decodeMessage(buf)
 			if err != nil {
 				log.Printf("ERROR: failed to decode message - %s", err.Error())
 				continue
@@ -204,7 +344,8 @@ func (t *Topic) messagePump() {
 				chans = append(chans, c)
 			}
 			t.RUnlock()
-			if len(chans) == 0 || t.IsPaused() {
+			fanout = t.updateFanout(fanout, chans)
+			if len(chans) == 0 || t.pumpPaused() {
 				memoryMsgChan = nil
 				backendChan = nil
 			} else {
@@ -225,6 +366,11 @@ func (t *Topic) messagePump() {
 			goto exit
 		}
 
+		if fanout != nil {
+			fanout.put(msg)
+			continue
+		}
+
 		for i, channel := range chans {
 			chanMsg := msg
 			// copy the message because each channel
@@ -243,6 +389,9 @@ func (t *Topic) messagePump() {
 	}
 
 exit:
+	if fanout != nil {
+		fanout.stop()
+	}
 	log.Printf("TOPIC(%s): closing ... messagePump", t.name)
 }
 
@@ -250,22 +399,39 @@ exit:
 // proxying messages to memory or backend
 func (t *Topic) router() {
 	var msgBuf bytes.Buffer
-	for msg := range t.incomingMsgChan {
+	for {
 		select {
-		case t.memoryMsgChan <- msg:
-		default:
-			err := WriteMessageToBackend(&msgBuf, msg, t.backend)
-			if err != nil {
-				log.Printf("ERROR: failed to write message to backend - %s", err.Error())
-				// theres not really much we can do at this point, you're certainly
-				// going to lose messages...
+		case msg, ok := <-t.incomingMsgChan:
+			if !ok {
+				goto exit
+			}
+			t.routeMessage(&msgBuf, msg)
+		case put := <-t.durableChan:
+			// whatever is already queued was published first
+			for i := len(t.incomingMsgChan); i > 0; i-- {
+				t.routeMessage(&msgBuf, <-t.incomingMsgChan)
 			}
+			put.done <- t.writeDurable(&msgBuf, put.msgs)
 		}
 	}
 
+exit:
 	log.Printf("TOPIC(%s): closing ... router", t.name)
 }
 
+func (t *Topic) routeMessage(msgBuf *bytes.Buffer, msg *nsq.Message) {
+	policy := t.context.nsqd.resolveOverflowPolicy(t.OverflowPolicy())
+	if t.SyncPolicy() == syncAlways ||
+		!putMemory(t.memoryMsgChan, msg, policy, t.exitChan, &t.droppedCount) {
+		err := WriteMessageToBackend(msgBuf, msg, t.backend)
+		if err != nil {
+			log.Printf("ERROR: failed to write message to backend - %s", err.Error())
+			// theres not really much we can do at this point, you're certainly
+			// going to lose messages...
+		}
+	}
+}
+
 // Delete empties the topic and all its channels and closes
 func (t *Topic) Delete() error {
 	return t.exit(true)
@@ -308,6 +474,10 @@ func (t *Topic) exit(deleted bool) error {
 		}
 		t.Unlock()
 
+		if t.retention != nil {
+			t.retention.Delete()
+		}
+
 		// empty the queue (deletes the backend files, too)
 		t.Empty()
 		return t.backend.Delete()
@@ -322,6 +492,10 @@ func (t *Topic) exit(deleted bool) error {
 		}
 	}
 
+	if t.retention != nil {
+		t.retention.Close()
+	}
+
 	// write anything leftover to disk
 	t.flush()
 	return t.backend.Close()
@@ -395,7 +569,7 @@ func (t *Topic) doPause(pause bool) error {
 	}
 
 	select {
-	case t.pauseChan <- pause:
+	case t.pauseChan <- t.pumpPaused():
 		t.context.nsqd.Lock()
 		defer t.context.nsqd.Unlock()
 		// pro-actively persist metadata so in case of process failure
@@ -410,3 +584,9 @@ func (t *Topic) doPause(pause bool) error {
 func (t *Topic) IsPaused() bool {
 	return atomic.LoadInt32(&t.paused) == 1
 }
+
+// pumpPaused returns whether messagePump holds messages, because the topic is
+// paused or its publishes are being buffered
+func (t *Topic) pumpPaused() bool {
+	return t.IsPaused() || t.PublishPaused() == publishPauseBuffer
+}
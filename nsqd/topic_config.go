@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+var errTopicFull = errors.New("topic is full")
+
+// setConfig applies the max depth and ephemeral channels of the topic's
+// cluster-wide configuration (from nsqlookupd), a nil cfg resets them
+func (t *Topic) setConfig(cfg *lookupd.TopicConfig) {
+	var maxDepth int64
+	var ephemeral int32
+	if cfg != nil {
+		maxDepth = cfg.MaxDepth
+		if cfg.EphemeralChannels {
+			ephemeral = 1
+		}
+	}
+	atomic.StoreInt64(&t.maxDepth, maxDepth)
+	atomic.StoreInt32(&t.ephemeralChannels, ephemeral)
+}
+
+// applyRetentionConfig applies the retention period of the topic's
+// cluster-wide configuration, if it has one (this takes the topic lock)
+func (t *Topic) applyRetentionConfig(cfg *lookupd.TopicConfig) {
+	if cfg == nil || cfg.RetentionPeriod == "" {
+		return
+	}
+	period, err := time.ParseDuration(cfg.RetentionPeriod)
+	if err != nil || period < 0 {
+		log.Printf("TOPIC(%s) ERROR: invalid retention_period %q in config", t.name, cfg.RetentionPeriod)
+		return
+	}
+	if period == t.RetentionPeriod() {
+		return
+	}
+	err = t.SetRetention(period)
+	if err != nil {
+		log.Printf("ERROR: failed to persist metadata - %s", err.Error())
+	}
+}
+
+// full returns whether the topic, or any of its (non-mirror) channels, has
+// reached the configured max depth (or, for a channel, its own max depth), this
+// expects the caller to hold the (read) lock
+func (t *Topic) full() bool {
+	maxDepth := atomic.LoadInt64(&t.maxDepth)
+	if maxDepth > 0 && t.Depth() >= maxDepth {
+		return true
+	}
+	for _, c := range t.channelMap {
+		if c.MirrorOf() != "" {
+			continue
+		}
+		if maxDepth > 0 && c.Depth() >= maxDepth {
+			return true
+		}
+		if channelMaxDepth := c.MaxDepth(); channelMaxDepth > 0 && c.Depth() >= channelMaxDepth {
+			return true
+		}
+	}
+	return false
+}
+
+// syncTopicConfigs re-applies every topic's cluster-wide configuration, this
+// is done whenever we (re)connect to nsqlookupd since topics loaded from
+// metadata on startup are created before we know its HTTP address
+func (n *NSQD) syncTopicConfigs() {
+	lookupdHTTPAddrs := n.lookupHttpAddrs()
+	if len(lookupdHTTPAddrs) == 0 {
+		return
+	}
+
+	n.RLock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.RUnlock()
+
+	for _, t := range topics {
+		cfg, err := lookupd.GetLookupdTopicConfig(t.name, lookupdHTTPAddrs)
+		if err != nil {
+			continue
+		}
+		t.setConfig(cfg)
+		t.applyRetentionConfig(cfg)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/nsqlookupd"
+	"github.com/bmizerany/assert"
+)
+
+func TestTopicConfig(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	configuredTopic := "test_config" + strconv.Itoa(int(time.Now().Unix()))
+	otherTopic := "test_noconfig" + strconv.Itoa(int(time.Now().Unix()))
+
+	lookupdOptions := nsqlookupd.NewNSQLookupdOptions()
+	lookupdOptions.TCPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.HTTPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.BroadcastAddress = "127.0.0.1"
+	lookupd := nsqlookupd.NewNSQLookupd(lookupdOptions)
+	lookupd.Main()
+	defer lookupd.Exit()
+
+	lookupd.TopicConfigs.Set(configuredTopic, &nsqlookupd.TopicConfig{
+		RetentionPeriod:   "1h",
+		MaxDepth:          2,
+		EphemeralChannels: true,
+	})
+	for _, topicName := range []string{configuredTopic, otherTopic} {
+		lookupd.DB.AddRegistration(nsqlookupd.Registration{Category: "channel", Key: topicName, SubKey: "ch"})
+	}
+
+	options := NewNSQDOptions()
+	options.NSQLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+	_, httpAddr, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	// wait for nsqd to identify with (and sync to) nsqlookupd
+	for i := 0; len(lookupd.DB.FindProducers("client", "", "")) == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	topic := nsqd.GetTopic(configuredTopic)
+	assert.Equal(t, topic.RetentionPeriod(), time.Hour)
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, channel.ephemeralChannel, true)
+
+	for i := 0; i < 2; i++ {
+		err := topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test")))
+		assert.Equal(t, err, nil)
+	}
+	for i := 0; channel.Depth() < 2 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test")))
+	assert.Equal(t, err, errTopicFull)
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/put?topic=%s", httpAddr, configuredTopic),
+		"application/octet-stream", strings.NewReader("test"))
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 503)
+
+	// topics without a configuration are unaffected
+	topic = nsqd.GetTopic(otherTopic)
+	assert.Equal(t, topic.RetentionPeriod(), time.Duration(0))
+	channel, err = topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, channel.ephemeralChannel, false)
+	for i := 0; i < 3; i++ {
+		err := topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test")))
+		assert.Equal(t, err, nil)
+	}
+
+	nsqd.DeleteExistingTopic(configuredTopic)
+	nsqd.DeleteExistingTopic(otherTopic)
+}
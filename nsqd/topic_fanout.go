@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync"
+
+	"github.com/bitly/go-nsq"
+)
+
+// messagePump copies each message to every one of the topic's channels, which
+// makes it the ceiling on the throughput of a topic with hundreds of them...
+// a topic with at least --topic-fanout-threshold channels copies each message
+// in parallel instead, from --topic-fanout-workers (GOMAXPROCS by default)
+// workers that each put it to a shard of the channels
+//
+// messagePump waits for every worker to have put a message before the next
+// one, so each channel still receives the topic's messages in order (and
+// nothing is left with the workers when the topic exits)
+
+type topicFanout struct {
+	topic    *Topic
+	shards   [][]*Channel
+	msgChans []chan *nsq.Message
+	wg       sync.WaitGroup
+}
+
+// updateFanout returns the fanout for chans (starting, resizing or stopping
+// f as needed), nil when they're few enough to be copied to serially
+func (t *Topic) updateFanout(f *topicFanout, chans []*Channel) *topicFanout {
+	threshold := t.context.nsqd.options.TopicFanoutThreshold
+	workers := t.context.nsqd.options.TopicFanoutWorkers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(chans) {
+		workers = len(chans)
+	}
+
+	if threshold == 0 || len(chans) < threshold || workers < 2 {
+		if f != nil {
+			f.stop()
+		}
+		return nil
+	}
+
+	if f != nil && len(f.msgChans) != workers {
+		f.stop()
+		f = nil
+	}
+	if f == nil {
+		log.Printf("TOPIC(%s): copying messages to %d channels with %d workers", t.name, len(chans), workers)
+		f = newTopicFanout(t, workers)
+	}
+	f.setChannels(chans)
+	return f
+}
+
+func newTopicFanout(t *Topic, workers int) *topicFanout {
+	f := &topicFanout{
+		topic:    t,
+		shards:   make([][]*Channel, workers),
+		msgChans: make([]chan *nsq.Message, workers),
+	}
+	for i := range f.msgChans {
+		f.msgChans[i] = make(chan *nsq.Message)
+		go f.worker(i)
+	}
+	return f
+}
+
+// setChannels shards chans across the workers, it's only called between puts
+// (the workers are idle)
+func (f *topicFanout) setChannels(chans []*Channel) {
+	shards := make([][]*Channel, len(f.msgChans))
+	for i, channel := range chans {
+		shards[i%len(shards)] = append(shards[i%len(shards)], channel)
+	}
+	f.shards = shards
+}
+
+// put copies msg to every channel, returning once it has
+func (f *topicFanout) put(msg *nsq.Message) {
+	f.wg.Add(len(f.msgChans))
+	for _, msgChan := range f.msgChans {
+		msgChan <- msg
+	}
+	f.wg.Wait()
+}
+
+func (f *topicFanout) worker(i int) {
+	for msg := range f.msgChans[i] {
+		for _, channel := range f.shards[i] {
+			// every channel needs a unique instance, the original is shared
+			// by the workers
+			chanMsg := nsq.NewMessage(msg.Id, msg.Body)
+			chanMsg.Timestamp = msg.Timestamp
+			err := channel.PutMessage(chanMsg)
+			if err != nil {
+				log.Printf("TOPIC(%s) ERROR: failed to put msg(%s) to channel(%s) - %s",
+					f.topic.name, msg.Id, channel.name, err.Error())
+			}
+		}
+		f.wg.Done()
+	}
+}
+
+func (f *topicFanout) stop() {
+	for _, msgChan := range f.msgChans {
+		close(msgChan)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestTopicFanout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.TopicFanoutThreshold = 4
+	options.TopicFanoutWorkers = 3
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_fanout" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	var channels []*Channel
+	for i := 0; i < 10; i++ {
+		channels = append(channels, topic.GetChannel(fmt.Sprintf("ch%d", i)))
+	}
+
+	for i := 0; i < 50; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte(strconv.Itoa(i))))
+	}
+
+	// every channel gets its own copy of every message, in order
+	seen := make(map[*nsq.Message]bool)
+	for _, channel := range channels {
+		for i := 0; i < 50; i++ {
+			msg := <-channel.clientMsgChan
+			assert.Equal(t, string(msg.Body), strconv.Itoa(i))
+			assert.Equal(t, seen[msg], false)
+			seen[msg] = true
+		}
+	}
+}
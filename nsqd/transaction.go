@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bitly/go-nsq"
+)
+
+var errTransactionAborted = errors.New("transaction aborted")
+
+// a committed transaction is quarantined (rather than replayed) on startup
+// when the creation policy won't allow one of its topics
+const txQuarantinedSuffix = "quarantined"
+
+// txMessage is a message destined for a topic as part of a transaction
+type txMessage struct {
+	topicName string
+	msg       *nsq.Message
+}
+
+func (n *NSQD) txFileName(id nsq.MessageID, suffix string) string {
+	return fmt.Sprintf(path.Join(n.options.DataPath, "nsqd.%d.tx.%s.%s"), n.options.ID, id, suffix)
+}
+
+// PutTransaction publishes messages to multiple topics atomically, either
+// every topic gets its messages or (if any of them can't be published to)
+// none do
+//
+// the transaction is first staged to disk and committed with a rename, so
+// that if we crash (or fail to write to a topic) part way through publishing
+// it is replayed (in full) on startup by RecoverTransactions
+func (n *NSQD) PutTransaction(txMsgs []*txMessage) error {
+	if len(txMsgs) == 0 {
+		return nil
+	}
+
+	if n.IsReadOnly() {
+		return errReadOnly
+	}
+	if n.IsDraining() {
+		return errDraining
+	}
+
+	for _, txMsg := range txMsgs {
+		err := n.middleware.publish(txMsg.topicName, []*nsq.Message{txMsg.msg})
+		if err != nil {
+			return err
+		}
+	}
+
+	// resolve each message as it would be if it were published on its own
+	// (aliases, shards, large message rules...)
+	topics := make(map[string]*Topic)
+	expanded := make([]*txMessage, 0, len(txMsgs))
+	for _, txMsg := range txMsgs {
+		resolved, err := n.resolveMessages(txMsg.topicName, []*nsq.Message{txMsg.msg})
+		if err != nil {
+			return err
+		}
+		for _, r := range resolved {
+			topics[r.topic.name] = r.topic
+			for _, msg := range r.msgs {
+				expanded = append(expanded, &txMessage{r.topic.name, msg})
+			}
+		}
+	}
+
+	stagedFileName := n.txFileName(expanded[0].msg.Id, "staged")
+	commitFileName := n.txFileName(expanded[0].msg.Id, "commit")
+	err := writeTransaction(stagedFileName, expanded, n.encryption)
+	if err != nil {
+		os.Remove(stagedFileName)
+		return err
+	}
+	err = os.Rename(stagedFileName, commitFileName)
+	if err != nil {
+		os.Remove(stagedFileName)
+		return err
+	}
+	// make the commit durable
+	err = syncDir(path.Dir(commitFileName))
+	if err != nil {
+		os.Remove(commitFileName)
+		return err
+	}
+
+	written, err := applyTransaction(topics, expanded)
+	if err != nil {
+		if written {
+			log.Printf("ERROR: transaction %s failed part way, it will be replayed on startup - %s",
+				commitFileName, err.Error())
+		} else {
+			os.Remove(commitFileName)
+		}
+		return err
+	}
+
+	err = os.Remove(commitFileName)
+	if err != nil {
+		log.Printf("ERROR: failed to remove %s - %s", commitFileName, err.Error())
+	}
+	return nil
+}
+
+// applyTransaction publishes each topic's messages as one batch, written
+// (and fsync'd) by its router, so that none of them is read until all of them
+// are written... written is false when the transaction was refused before
+// anything was written
+func applyTransaction(topics map[string]*Topic, txMsgs []*txMessage) (bool, error) {
+	puts, err := queueTransaction(topics, txMsgs)
+	if err != nil {
+		return false, err
+	}
+	for _, put := range puts {
+		putErr := <-put.done
+		if putErr != nil && err == nil {
+			err = putErr
+		}
+	}
+	return true, err
+}
+
+// queueTransaction holds every topic's lock while handing over the batches so
+// that none of them can begin exiting once we've checked they're all
+// accepting messages
+func queueTransaction(topics map[string]*Topic, txMsgs []*txMessage) ([]*durablePut, error) {
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+	// always lock in the same order
+	sort.Strings(names)
+	for _, name := range names {
+		topics[name].RLock()
+		defer topics[name].RUnlock()
+	}
+
+	for _, name := range names {
+		if topics[name].Exiting() {
+			return nil, errTransactionAborted
+		}
+		if err := topics[name].checkPublish(); err != nil {
+			return nil, err
+		}
+	}
+
+	msgs := make(map[string][]*nsq.Message)
+	for _, txMsg := range txMsgs {
+		msgs[txMsg.topicName] = append(msgs[txMsg.topicName], txMsg.msg)
+	}
+	puts := make([]*durablePut, 0, len(names))
+	for _, name := range names {
+		puts = append(puts, topics[name].putMessagesDurable(msgs[name]))
+	}
+	return puts, nil
+}
+
+// each record is a 4 byte (big endian) topic name length, the topic name,
+// a 4 byte message length and the encoded (and possibly encrypted) message
+func writeTransaction(fileName string, txMsgs []*txMessage, encryption *atRestEncryption) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	var lenBuf [4]byte
+	w := bufio.NewWriter(f)
+	for _, txMsg := range txMsgs {
+		buf.Reset()
+		err = txMsg.msg.Write(&buf)
+		if err != nil {
+			return err
+		}
+		data, err := encryption.seal(txMsg.topicName, buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(txMsg.topicName)))
+		w.Write(lenBuf[:])
+		w.WriteString(txMsg.topicName)
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+		w.Write(lenBuf[:])
+		w.Write(data)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readTransaction(fileName string, encryption *atRestEncryption) ([]*txMessage, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var txMsgs []*txMessage
+	var size uint32
+	r := bufio.NewReader(f)
+	for {
+		err = binary.Read(r, binary.BigEndian, &size)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		topicName := make([]byte, size)
+		_, err = io.ReadFull(r, topicName)
+		if err != nil {
+			return nil, err
+		}
+
+		err = binary.Read(r, binary.BigEndian, &size)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		buf, err = encryption.open(string(topicName), buf)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := nsq.DecodeMessage(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		txMsgs = append(txMsgs, &txMessage{string(topicName), msg})
+	}
+	return txMsgs, nil
+}
+
+// RecoverTransactions publishes transactions that were committed but not
+// (known to be) fully published before nsqd last exited, and discards those
+// that were never committed
+//
+// their topics are created subject to the creation policy, a transaction
+// with a topic that isn't allowed is quarantined instead (renamed, so that
+// it can be inspected and replayed by hand)
+func (n *NSQD) RecoverTransactions() {
+	pattern := fmt.Sprintf(path.Join(n.options.DataPath, "nsqd.%d.tx.*"), n.options.ID)
+	fileNames, _ := filepath.Glob(pattern)
+	for _, fileName := range fileNames {
+		if strings.HasSuffix(fileName, "."+txQuarantinedSuffix) {
+			continue
+		}
+		if !strings.HasSuffix(fileName, ".commit") {
+			log.Printf("NSQ: discarding uncommitted transaction %s", fileName)
+			os.Remove(fileName)
+			continue
+		}
+
+		txMsgs, err := readTransaction(fileName, n.encryption)
+		if err != nil {
+			log.Printf("ERROR: failed to read transaction %s - %s", fileName, err.Error())
+			continue
+		}
+
+		topics := make(map[string]*Topic)
+		for _, txMsg := range txMsgs {
+			if _, ok := topics[txMsg.topicName]; ok {
+				continue
+			}
+			topic, err := n.AutoCreateTopic(txMsg.topicName)
+			if err != nil {
+				n.quarantineTransaction(fileName, txMsg.topicName, err)
+				topics = nil
+				break
+			}
+			topics[txMsg.topicName] = topic
+		}
+		if topics == nil {
+			continue
+		}
+
+		log.Printf("NSQ: recovering committed transaction %s (%d messages)", fileName, len(txMsgs))
+		_, err = applyTransaction(topics, txMsgs)
+		if err != nil {
+			log.Printf("ERROR: failed to recover transaction %s - %s", fileName, err.Error())
+			continue
+		}
+		os.Remove(fileName)
+	}
+}
+
+// quarantineTransaction sets aside a committed transaction that can't be
+// replayed because topicName couldn't be created
+func (n *NSQD) quarantineTransaction(fileName string, topicName string, err error) {
+	quarantinedFileName := fileName[:len(fileName)-len("commit")] + txQuarantinedSuffix
+	log.Printf("ERROR: quarantining transaction %s as %s, topic (%s) can't be created - %s",
+		fileName, quarantinedFileName, topicName, err.Error())
+	err = os.Rename(fileName, quarantinedFileName)
+	if err != nil {
+		log.Printf("ERROR: failed to quarantine transaction %s - %s", fileName, err.Error())
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bitly/go-nsq"
+)
+
+// a UDP datagram publishes a single message, it's the topic name, a space and
+// the message body (ie. "metrics cpu=0.25"), there is no response so datagrams
+// that can't be published are only counted (see UDPStats)
+const maxUDPTopicLength = 64
+
+// UDPStats counts the datagrams received on --udp-address
+type UDPStats struct {
+	Accepted uint64 `json:"accepted"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+func (n *NSQD) listenUDP() {
+	addr, err := net.ResolveUDPAddr("udp", n.options.UDPAddress)
+	if err != nil {
+		log.Fatalf("FATAL: --udp-address invalid address (%s) - %s", n.options.UDPAddress, err.Error())
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalf("FATAL: listen (%s) failed - %s", addr, err.Error())
+	}
+	n.udpConn = conn
+	n.waitGroup.Wrap(func() { n.udpLoop(conn) })
+}
+
+func (n *NSQD) udpLoop(conn *net.UDPConn) {
+	log.Printf("UDP: listening on %s", conn.LocalAddr())
+
+	buf := make([]byte, n.options.MaxMsgSize+maxUDPTopicLength+1)
+	for {
+		size, remoteAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("ERROR: UDP read - %s", err.Error())
+			}
+			break
+		}
+
+		err = n.publishDatagram(buf[:size], remoteAddr)
+		if err != nil {
+			atomic.AddUint64(&n.udpDroppedCount, 1)
+			if *verbose {
+				log.Printf("UDP: dropped datagram from %s - %s", remoteAddr, err.Error())
+			}
+			continue
+		}
+		atomic.AddUint64(&n.udpAcceptedCount, 1)
+	}
+
+	log.Printf("UDP: closing %s", conn.LocalAddr())
+}
+
+func (n *NSQD) publishDatagram(datagram []byte, remoteAddr *net.UDPAddr) error {
+	i := bytes.IndexByte(datagram, ' ')
+	if i == -1 {
+		return errors.New("missing topic")
+	}
+	topicName := string(datagram[:i])
+	if !nsq.IsValidTopicName(topicName) {
+		return fmt.Errorf("invalid topic name %q", topicName)
+	}
+	body := datagram[i+1:]
+	if len(body) == 0 {
+		return errors.New("empty message")
+	}
+	if int64(len(body)) > n.options.MaxMsgSize {
+		return errMsgTooBig
+	}
+
+	// the read buffer is reused for the next datagram
+	msgBody := make([]byte, len(body))
+	copy(msgBody, body)
+	msg := nsq.NewMessage(<-n.idChan, msgBody)
+	err := n.PutMessages(topicName, []*nsq.Message{msg})
+	if err != nil {
+		return err
+	}
+	n.producerPublished(topicName, producerID{"udp", remoteAddr.IP.String(), ""}, 1)
+	return nil
+}
+
+// UDPStats returns the UDP datagram counters (nil when --udp-address isn't set)
+func (n *NSQD) UDPStats() *UDPStats {
+	if n.options.UDPAddress == "" {
+		return nil
+	}
+	return &UDPStats{
+		Accepted: atomic.LoadUint64(&n.udpAcceptedCount),
+		Dropped:  atomic.LoadUint64(&n.udpDroppedCount),
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestUDPPublish(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.UDPAddress = "127.0.0.1:0"
+	options.MaxMsgSize = 100
+	_, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_udp" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	conn, err := net.DialUDP("udp", nil, nsqd.udpConn.LocalAddr().(*net.UDPAddr))
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	datagrams := []string{
+		topicName + " cpu=0.25",
+		topicName + " mem=512 swap=0",
+		"no_body_separator",
+		"bad/topic body",
+		topicName + " ",
+		topicName + " " + string(make([]byte, 101)),
+	}
+	for _, d := range datagrams {
+		_, err = conn.Write([]byte(d))
+		assert.Equal(t, err, nil)
+	}
+
+	// datagrams aren't acknowledged
+	for i := 0; i < 100; i++ {
+		stats := nsqd.UDPStats()
+		if stats.Accepted+stats.Dropped == uint64(len(datagrams)) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, *nsqd.UDPStats(), UDPStats{Accepted: 2, Dropped: 4})
+	assert.Equal(t, topic.messageCount, uint64(2))
+
+	msg := <-topic.memoryMsgChan
+	assert.Equal(t, string(msg.Body), "cpu=0.25")
+	assert.Equal(t, topic.producers.Stats()[0].Protocol, "udp")
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"log"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// a multiplexed client that IDENTIFYs with the --wildcard-sub-token can SUB
+// to a topic pattern (ie. "SUB orders.* audit"), which subscribes it to the
+// channel of every topic the pattern matches, those that exist and those
+// created while it's connected, so that audit and archival consumers don't
+// need to be told about every new topic
+//
+// each topic matched is a subscription of its own (they don't count towards
+// --max-subscriptions-per-client, the SUB does), its messages are sent as
+// frameTypeTopicMessage frames naming the topic and FIN/REQ/TOUCH identify
+// the subscription as usual
+
+// frameTypeTopicMessage frames are messages delivered on a wildcard
+// subscription, the message is prefixed by the 4-byte subscription ID, the
+// 2-byte length of the topic name and the topic name
+const frameTypeTopicMessage int32 = 10
+
+var errAlreadySubscribed = errors.New("already subscribed")
+var errUnsubscribed = errors.New("client has exited")
+
+type wildcardSub struct {
+	client        *ClientV2
+	pattern       string
+	channelName   string
+	createOptions *channelCreateOptions
+}
+
+func isTopicPattern(name string) bool {
+	return strings.Contains(name, "*")
+}
+
+// isValidTopicPattern returns whether every topic name the pattern could
+// match is valid, "*" is the only wildcard
+func isValidTopicPattern(pattern string) bool {
+	return nsq.IsValidTopicName(strings.Replace(pattern, "*", "_", -1))
+}
+
+func (s *wildcardSub) matches(topicName string) bool {
+	// topic names can't contain the separator, so * matches any run of
+	// characters
+	ok, _ := path.Match(s.pattern, topicName)
+	return ok
+}
+
+// subscribe subscribes the client to the channel of a matching topic
+func (s *wildcardSub) subscribe(t *Topic) {
+	if atomic.LoadInt32(&s.client.State) == nsq.StateClosing {
+		return
+	}
+
+	channel, err := t.AutoCreateChannelWithOptions(s.channelName, s.createOptions)
+	if err != nil {
+		log.Printf("ERROR: [%s] failed to SUB %s:%s (matching %s) - %s",
+			s.client, t.name, s.channelName, s.pattern, err.Error())
+		return
+	}
+
+	_, err = s.client.subscribe(channel, s.pattern)
+	if err != nil {
+		return
+	}
+	log.Printf("PROTOCOL(V2): [%s] subscribed to %s:%s (matching %s)", s.client, t.name, s.channelName, s.pattern)
+	t.context.nsqd.clientEvent("sub", s.client, channel)
+}
+
+func (n *NSQD) wildcardSubAuthorized(token string) bool {
+	authToken := n.options.WildcardSubToken
+	return authToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) == 1
+}
+
+// addWildcardSub subscribes to the matching topics that exist, getTopic
+// subscribes to those created from then on
+func (n *NSQD) addWildcardSub(s *wildcardSub) {
+	n.wildcardSubsMutex.Lock()
+	n.wildcardSubs = append(n.wildcardSubs, s)
+	n.wildcardSubsMutex.Unlock()
+
+	var topics []*Topic
+	n.RLock()
+	for topicName, t := range n.topicMap {
+		if s.matches(topicName) {
+			topics = append(topics, t)
+		}
+	}
+	n.RUnlock()
+
+	// (a topic created meanwhile is subscribed to once)
+	for _, t := range topics {
+		s.subscribe(t)
+	}
+}
+
+func (n *NSQD) removeWildcardSubs(client *ClientV2) {
+	n.wildcardSubsMutex.Lock()
+	defer n.wildcardSubsMutex.Unlock()
+	subs := n.wildcardSubs[:0]
+	for _, s := range n.wildcardSubs {
+		if s.client != client {
+			subs = append(subs, s)
+		}
+	}
+	for i := len(subs); i < len(n.wildcardSubs); i++ {
+		n.wildcardSubs[i] = nil
+	}
+	n.wildcardSubs = subs
+}
+
+// matchWildcardSubs subscribes the wildcard SUBs that match to a new topic
+func (n *NSQD) matchWildcardSubs(t *Topic) {
+	var matches []*wildcardSub
+	n.wildcardSubsMutex.RLock()
+	for _, s := range n.wildcardSubs {
+		if s.matches(t.name) {
+			matches = append(matches, s)
+		}
+	}
+	n.wildcardSubsMutex.RUnlock()
+
+	for _, s := range matches {
+		s.subscribe(t)
+	}
+}
+
+// subscribe adds a subscription to the channel, returning its ID, pattern is
+// the wildcard SUB it matched ("" for a SUB to the topic)
+func (c *ClientV2) subscribe(channel *Channel, pattern string) (int, error) {
+	c.subscribeMutex.Lock()
+	defer c.subscribeMutex.Unlock()
+
+	if c.unsubscribed {
+		return 0, errUnsubscribed
+	}
+	for _, existing := range c.Subscriptions {
+		if existing == channel {
+			return 0, errAlreadySubscribed
+		}
+	}
+	channel.AddClient(c.ID, c)
+
+	c.Lock()
+	subID := len(c.Subscriptions)
+	if c.Channel == nil {
+		c.Channel = channel
+		atomic.StoreInt64(&c.subscribedAt, time.Now().UnixNano())
+	}
+	c.Subscriptions = append(c.Subscriptions, channel)
+	if pattern != "" {
+		if c.wildcardSubscriptions == nil {
+			c.wildcardSubscriptions = make(map[int]string)
+		}
+		c.wildcardSubscriptions[subID] = pattern
+	}
+	c.Unlock()
+
+	// update message pump
+	select {
+	case c.SubEventChan <- channel:
+	case <-c.ExitChan:
+	}
+	return subID, nil
+}
+
+// unsubscribe prevents any further subscriptions once the client has exited,
+// returning the channels it was subscribed to
+func (c *ClientV2) unsubscribe() []*Channel {
+	c.subscribeMutex.Lock()
+	defer c.subscribeMutex.Unlock()
+	c.unsubscribed = true
+	return c.Subscriptions
+}
+
+// subscriptionCount is the number of subscriptions that count towards
+// --max-subscriptions-per-client, a wildcard SUB counts once
+func (c *ClientV2) subscriptionCount() int64 {
+	c.RLock()
+	defer c.RUnlock()
+	return int64(len(c.Subscriptions) - len(c.wildcardSubscriptions) + c.wildcardPatterns)
+}
+
+// isWildcardSubscription returns whether the subscription was a topic a
+// wildcard SUB matched
+func (c *ClientV2) isWildcardSubscription(subID int) bool {
+	c.RLock()
+	defer c.RUnlock()
+	_, ok := c.wildcardSubscriptions[subID]
+	return ok
+}
+
+func (p *ProtocolV2) SendTopicMessage(client *ClientV2, subID int32, topicName string, msg *nsq.Message, buf *bytes.Buffer) error {
+	if client.debugLogging() {
+		log.Printf("PROTOCOL(V2): writing msg(%s) from %s on subscription %d to client(%s) - %s",
+			msg.Id, topicName, subID, client, msg.Body)
+	}
+
+	buf.Reset()
+	binary.Write(buf, binary.BigEndian, subID)
+	binary.Write(buf, binary.BigEndian, uint16(len(topicName)))
+	buf.WriteString(topicName)
+	writeMessageHeader(buf, msg)
+	return p.sendParts(client, frameTypeTopicMessage, buf.Bytes(), msg.Body)
+}
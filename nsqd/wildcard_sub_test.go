@@ -0,0 +1,124 @@
+//go:build go1.1
+// +build go1.1
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestWildcardSub(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.WildcardSubToken = "secret"
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	prefix := "test_wc" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(prefix + ".a")
+	nsqd.GetTopic(prefix + "_unmatched")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	data := identify(t, conn, map[string]interface{}{
+		"multiplex":          true,
+		"wildcard_sub_token": "secret",
+	}, nsq.FrameTypeResponse)
+	r := struct {
+		WildcardSub bool `json:"wildcard_sub"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.WildcardSub, true)
+
+	err = nsq.Subscribe(prefix+".*", "audit").Write(conn)
+	assert.Equal(t, err, nil)
+	readValidate(t, conn, nsq.FrameTypeResponse, "OK")
+
+	// a topic created after the SUB is subscribed to, too
+	topicNames := []string{prefix + ".a", prefix + ".b"}
+	for _, topicName := range topicNames {
+		topic := nsqd.GetTopic(topicName)
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte(topicName)))
+	}
+	unmatched, _ := nsqd.GetExistingTopic(prefix + "_unmatched")
+	_, err = unmatched.GetExistingChannel("audit")
+	assert.NotEqual(t, err, nil)
+
+	err = nsq.Ready(2).Write(conn)
+	assert.Equal(t, err, nil)
+
+	for i := 0; i < len(topicNames); i++ {
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, frameType, frameTypeTopicMessage)
+
+		subID := int32(binary.BigEndian.Uint32(data[:4]))
+		topicNameLen := int(binary.BigEndian.Uint16(data[4:6]))
+		topicName := string(data[6 : 6+topicNameLen])
+		msg, err := nsq.DecodeMessage(data[6+topicNameLen:])
+		assert.Equal(t, err, nil)
+		assert.Equal(t, string(msg.Body), topicName)
+		assert.Equal(t, topicName, topicNames[subID])
+
+		cmd := &nsq.Command{
+			Name:   []byte("FIN"),
+			Params: [][]byte{msg.Id[:], []byte(strconv.Itoa(int(subID)))},
+		}
+		err = cmd.Write(conn)
+		assert.Equal(t, err, nil)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	for _, topicName := range topicNames {
+		topic, _ := nsqd.GetExistingTopic(topicName)
+		channel, _ := topic.GetExistingChannel("audit")
+		assert.Equal(t, len(channel.inFlightMessages), 0)
+		assert.Equal(t, len(channel.clients), 1)
+	}
+}
+
+func TestWildcardSubUnauthorized(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	options.WildcardSubToken = "secret"
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	identify(t, conn, map[string]interface{}{
+		"multiplex":          true,
+		"wildcard_sub_token": "guess",
+	}, nsq.FrameTypeResponse)
+
+	err = nsq.Subscribe("orders.*", "audit").Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, strings.HasPrefix(string(data), "E_UNAUTHORIZED"), true)
+}
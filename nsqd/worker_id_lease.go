@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bitly/go-nsq"
+)
+
+// with --worker-id-lease nsqd leases its worker id from nsqlookupd (see
+// nsqlookupd's worker_id_lease.go) at startup rather than it being assigned by
+// hand, so that autoscaled nsqd don't mint colliding message IDs. The same id
+// is leased from each nsqlookupd and renewed while connected to them.
+//
+// the last id leased is remembered (in the data path) and asked for again on
+// restart, as the metadata file is named after it
+
+// how many rounds of asking every nsqlookupd for the same id before giving up
+const workerIDLeaseAttempts = 10
+
+type workerIDLeaseRequest struct {
+	Owner       string `json:"owner"`
+	WorkerID    int64  `json:"worker_id"`
+	MaxWorkerID int64  `json:"max_worker_id"`
+	Exact       bool   `json:"exact"`
+}
+
+type workerIDLeaseResponse struct {
+	WorkerID int64 `json:"worker_id"`
+	TTL      int64 `json:"ttl"`
+}
+
+// workerIDLeaseOwner identifies this nsqd to nsqlookupd, a restarted nsqd is
+// the same owner
+func workerIDLeaseOwner(options *nsqdOptions) string {
+	_, port, err := net.SplitHostPort(options.TCPAddresses[0])
+	if err != nil {
+		port = options.TCPAddresses[0]
+	}
+	return net.JoinHostPort(options.BroadcastAddress, port)
+}
+
+func workerIDFileName(dataPath string) string {
+	return path.Join(dataPath, "nsqd.worker_id")
+}
+
+// leaseWorkerID leases the same worker id from every (reachable) nsqlookupd
+func leaseWorkerID(options *nsqdOptions) (int64, error) {
+	owner := workerIDLeaseOwner(options)
+
+	remembered := int64(-1)
+	data, err := ioutil.ReadFile(workerIDFileName(options.DataPath))
+	if err == nil {
+		remembered, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			remembered = -1
+		}
+	}
+
+	// an nsqlookupd that can't lease the candidate leases another (free)
+	// one, which becomes the candidate the others are asked for
+	candidate := remembered
+	for attempt := 0; attempt < workerIDLeaseAttempts; attempt++ {
+		agreed := true
+		leased := 0
+		for _, addr := range options.NSQLookupdTCPAddresses {
+			lp := NewLookupPeer(addr, func(*LookupPeer) {})
+			workerID, err := requestWorkerIDLease(lp, owner, candidate, false)
+			if lp.state == nsq.StateConnected {
+				lp.Close()
+			}
+			if err != nil {
+				log.Printf("LOOKUPD(%s): ERROR leasing a worker id - %s", addr, err.Error())
+				continue
+			}
+			leased++
+			if workerID != candidate {
+				candidate = workerID
+				agreed = false
+				break
+			}
+		}
+		if leased == 0 {
+			return 0, errors.New("no nsqlookupd leased a worker id")
+		}
+		if agreed {
+			rememberWorkerID(options.DataPath, remembered, candidate)
+			return candidate, nil
+		}
+	}
+
+	return 0, errors.New("nsqlookupd didn't agree on a worker id")
+}
+
+// rememberWorkerID writes the leased worker id to the data path, moving the
+// metadata of the one leased last time if they differ
+func rememberWorkerID(dataPath string, remembered int64, workerID int64) {
+	if remembered >= 0 && remembered != workerID {
+		log.Printf("WARNING: leased worker id %d rather than %d", workerID, remembered)
+		from := metadataFileName(dataPath, remembered)
+		to := metadataFileName(dataPath, workerID)
+		if _, err := os.Stat(to); os.IsNotExist(err) {
+			os.Rename(from, to)
+			os.Rename(from+".prev", to+".prev")
+		}
+	}
+
+	err := ioutil.WriteFile(workerIDFileName(dataPath), []byte(strconv.FormatInt(workerID, 10)), 0600)
+	if err != nil {
+		log.Printf("ERROR: failed to write %s - %s", workerIDFileName(dataPath), err.Error())
+	}
+}
+
+func requestWorkerIDLease(lp *LookupPeer, owner string, workerID int64, exact bool) (int64, error) {
+	body, err := json.Marshal(&workerIDLeaseRequest{
+		Owner:       owner,
+		WorkerID:    workerID,
+		MaxWorkerID: 1 << workerIdBits,
+		Exact:       exact,
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := lp.Command(&nsq.Command{Name: []byte("LEASE_WORKER_ID"), Body: body})
+	if err != nil {
+		return 0, err
+	}
+	if bytes.HasPrefix(resp, []byte("E_")) {
+		return 0, errors.New(string(resp))
+	}
+	var lease workerIDLeaseResponse
+	err = json.Unmarshal(resp, &lease)
+	if err != nil {
+		return 0, err
+	}
+	return lease.WorkerID, nil
+}
+
+// renewWorkerIDLease renews our worker id's lease with lookupPeer (if it
+// supports it), it can't be changed so a conflict is only logged
+func (n *NSQD) renewWorkerIDLease(lookupPeer *LookupPeer) {
+	if !n.options.WorkerIDLease || !lookupPeer.Info.WorkerIDLeases {
+		return
+	}
+	_, err := requestWorkerIDLease(lookupPeer, workerIDLeaseOwner(n.options), n.options.ID, true)
+	if err != nil {
+		log.Printf("LOOKUPD(%s): ERROR renewing worker id %d lease - %s", lookupPeer, n.options.ID, err.Error())
+	}
+}
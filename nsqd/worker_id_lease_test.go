@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/bitly/nsq/nsqlookupd"
+	"github.com/bmizerany/assert"
+)
+
+func TestWorkerIDLease(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	lookupdOptions := nsqlookupd.NewNSQLookupdOptions()
+	lookupdOptions.TCPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.HTTPAddresses = []string{"127.0.0.1:0"}
+	lookupdOptions.BroadcastAddress = "127.0.0.1"
+	lookupd := nsqlookupd.NewNSQLookupd(lookupdOptions)
+	lookupd.Main()
+	defer lookupd.Exit()
+
+	newOptions := func(broadcastAddress string) *nsqdOptions {
+		dataPath, err := ioutil.TempDir("", "nsqd_worker_id_lease")
+		assert.Equal(t, err, nil)
+		options := NewNSQDOptions()
+		options.BroadcastAddress = broadcastAddress
+		options.TCPAddresses = []string{"127.0.0.1:4150"}
+		options.DataPath = dataPath
+		options.NSQLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+		return options
+	}
+
+	optionsA := newOptions("nsqd-a")
+	defer os.RemoveAll(optionsA.DataPath)
+	optionsB := newOptions("nsqd-b")
+	defer os.RemoveAll(optionsB.DataPath)
+
+	idA, err := leaseWorkerID(optionsA)
+	assert.Equal(t, err, nil)
+	idB, err := leaseWorkerID(optionsB)
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, idA, idB)
+
+	data, err := ioutil.ReadFile(path.Join(optionsA.DataPath, "nsqd.worker_id"))
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, len(data), 0)
+
+	// a restarted nsqd gets its id back
+	id, err := leaseWorkerID(optionsA)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, id, idA)
+
+	// someone else's id is a conflict when renewing
+	lp := NewLookupPeer(lookupd.RealTCPAddr().String(), func(*LookupPeer) {})
+	defer lp.Close()
+	_, err = requestWorkerIDLease(lp, workerIDLeaseOwner(optionsB), idA, true)
+	assert.NotEqual(t, err, nil)
+	id, err = requestWorkerIDLease(lp, workerIDLeaseOwner(optionsB), idB, true)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, id, idB)
+}
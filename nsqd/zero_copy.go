@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/bitly/go-nsq"
+)
+
+// a message's body is never copied on its way from the backend to the
+// consumer (for large messages that's most of the CPU nsqd spends delivering
+// them):
+//
+//  * decodeMessage slices the body out of what the backend read (which is
+//    never reused) rather than copying it
+//  * the message frames are sent in parts, the frame and message headers then
+//    the body as it is (see sendParts), and a bufio.Writer writes a body
+//    larger than its buffer straight to the connection (or the TLS/compression
+//    writer) rather than copying it in
+//
+// what's left is the read from disk (straight into the message buffer when
+// it's larger than the read-ahead buffer) and the write to the connection
+
+// messageHeaderSize is the size of an encoded message without its body, the
+// timestamp, attempts and id
+const messageHeaderSize = 8 + 2 + nsq.MsgIDLength
+
+var errMessageTooShort = errors.New("message too short")
+
+// writeMessageHeader writes what msg.Write would, without the body
+func writeMessageHeader(buf *bytes.Buffer, msg *nsq.Message) {
+	var header [messageHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(msg.Timestamp))
+	binary.BigEndian.PutUint16(header[8:10], msg.Attempts)
+	copy(header[10:], msg.Id[:])
+	buf.Write(header[:])
+}
+
+// decodeMessage is nsq.DecodeMessage without copying the body, the message's
+// body is (part of) b so b mustn't be modified afterwards
+func decodeMessage(b []byte) (*nsq.Message, error) {
+	if len(b) < messageHeaderSize {
+		return nil, errMessageTooShort
+	}
+	var id nsq.MessageID
+	copy(id[:], b[10:messageHeaderSize])
+	msg := nsq.NewMessage(id, b[messageHeaderSize:])
+	msg.Timestamp = int64(binary.BigEndian.Uint64(b[0:8]))
+	msg.Attempts = binary.BigEndian.Uint16(b[8:10])
+	return msg, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+)
+
+func TestLargeMessageDelivery(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQDOptions()
+	// so that the message is read back from the diskqueue
+	options.MemQueueSize = 0
+	tcpAddr, _, nsqd := mustStartNSQD(options)
+	defer nsqd.Exit()
+
+	topicName := "test_large_message" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	body := bytes.Repeat([]byte("0123456789abcdef"), 32*1024)
+	msg := nsq.NewMessage(<-nsqd.idChan, body)
+	msg.Attempts = 3
+	topic.PutMessage(msg)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn, nil, nsq.FrameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msgOut, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Id, msg.Id)
+	assert.Equal(t, msgOut.Timestamp, msg.Timestamp)
+	// delivering it is an attempt
+	assert.Equal(t, msgOut.Attempts, uint16(4))
+	assert.Equal(t, bytes.Equal(msgOut.Body, body), true)
+}
+
+func TestDecodeMessage(t *testing.T) {
+	msg := nsq.NewMessage(nsq.MessageID{'a', 'b', 'c'}, []byte("test body"))
+	msg.Attempts = 2
+	var buf bytes.Buffer
+	err := msg.Write(&buf)
+	assert.Equal(t, err, nil)
+
+	decoded, err := decodeMessage(buf.Bytes())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded.Id, msg.Id)
+	assert.Equal(t, decoded.Timestamp, msg.Timestamp)
+	assert.Equal(t, decoded.Attempts, msg.Attempts)
+	assert.Equal(t, decoded.Body, msg.Body)
+
+	var header bytes.Buffer
+	writeMessageHeader(&header, msg)
+	assert.Equal(t, append(header.Bytes(), msg.Body...), buf.Bytes())
+
+	_, err = decodeMessage(buf.Bytes()[:messageHeaderSize-1])
+	assert.Equal(t, err, errMessageTooShort)
+}
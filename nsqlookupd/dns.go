@@ -0,0 +1,393 @@
+package nsqlookupd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// --dns-address serves a topic's producers over DNS (UDP and TCP), for
+// infrastructure that discovers services with DNS rather than /lookup (ie.
+// HAProxy, Kubernetes, legacy apps), under --dns-domain:
+//
+//     _nsqd._tcp.<topic>.<domain>        SRV  each producer's TCP port
+//     _nsqd-http._tcp.<topic>.<domain>   SRV  each producer's HTTP port
+//     <topic>.<domain>                   A/AAAA  each producer's IP address
+//
+// the producers are those /lookup returns (active and not stale). A producer
+// whose broadcast address is a hostname is the SRV target as it is, one whose
+// broadcast address is an IP is the target ip-<address>.<domain> (the IP with
+// '.' or ':' as '-') which resolves to it, and is in the additional section.
+//
+// DNS names aren't case sensitive, topic names are matched regardless of case
+// (the first in sort order wins when two only differ by case)
+
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeAAAA uint16 = 28
+	dnsTypeSRV  uint16 = 33
+	dnsTypeANY  uint16 = 255
+
+	dnsClassIN  uint16 = 1
+	dnsClassANY uint16 = 255
+
+	dnsRcodeSuccess  uint16 = 0
+	dnsRcodeFormErr  uint16 = 1
+	dnsRcodeNXDomain uint16 = 3
+	dnsRcodeNotImp   uint16 = 4
+	dnsRcodeRefused  uint16 = 5
+
+	dnsFlagResponse      uint16 = 1 << 15
+	dnsFlagAuthoritative uint16 = 1 << 10
+	dnsFlagTruncated     uint16 = 1 << 9
+	dnsFlagRecursion     uint16 = 1 << 8
+	dnsOpcodeMask        uint16 = 0xf << 11
+
+	dnsHeaderSize = 12
+	// maxDNSUDPSize is the largest response sent over UDP, larger ones are
+	// truncated so that the client retries over TCP
+	maxDNSUDPSize = 512
+	maxDNSTCPSize = 65535
+
+	dnsTCPTimeout = 10 * time.Second
+)
+
+var (
+	errDNSFormat      = errors.New("malformed DNS message")
+	dnsIPLabelEscaper = strings.NewReplacer(".", "-", ":", "-")
+)
+
+// dnsQuestion is the (single) question of a DNS query
+type dnsQuestion struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// dnsRR is a resource record of a DNS response
+type dnsRR struct {
+	name   string
+	rrtype uint16
+	ttl    uint32
+	rdata  []byte
+}
+
+// readDNSName reads the (possibly compressed) name at off in msg, it returns
+// the name (lower case, with the trailing '.') and the offset after it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSFormat
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")) + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDNSFormat
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:])) & 0x3fff
+			jumps++
+		case n&0xc0 != 0:
+			return "", 0, errDNSFormat
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSFormat
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	panic("unreachable")
+}
+
+// appendDNSName appends name (with the trailing '.') uncompressed
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func (rr *dnsRR) appendTo(b []byte) []byte {
+	b = appendDNSName(b, rr.name)
+	b = appendUint16(b, rr.rrtype)
+	b = appendUint16(b, dnsClassIN)
+	b = append(b, byte(rr.ttl>>24), byte(rr.ttl>>16), byte(rr.ttl>>8), byte(rr.ttl))
+	b = appendUint16(b, uint16(len(rr.rdata)))
+	return append(b, rr.rdata...)
+}
+
+func newDNSAddrRR(name string, ip net.IP, ttl uint32) *dnsRR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dnsRR{name, dnsTypeA, ttl, []byte(ip4)}
+	}
+	return &dnsRR{name, dnsTypeAAAA, ttl, []byte(ip.To16())}
+}
+
+func newDNSSRVRR(name string, port int, target string, ttl uint32) *dnsRR {
+	rdata := make([]byte, 0, 6+len(target)+2)
+	rdata = appendUint16(rdata, 0) // priority
+	rdata = appendUint16(rdata, 1) // weight
+	rdata = appendUint16(rdata, uint16(port))
+	rdata = appendDNSName(rdata, target)
+	return &dnsRR{name, dnsTypeSRV, ttl, rdata}
+}
+
+// dnsTypeMatches returns whether a record of rrtype answers a question of qtype
+func dnsTypeMatches(qtype uint16, rrtype uint16) bool {
+	return qtype == rrtype || qtype == dnsTypeANY
+}
+
+// dnsResponse answers the DNS query msg, the response is at most maxSize bytes
+// (truncated otherwise), it returns nil when msg isn't a query worth answering
+func (l *NSQLookupd) dnsResponse(msg []byte, maxSize int) []byte {
+	if len(msg) < dnsHeaderSize {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(msg[0:])
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&dnsFlagResponse != 0 {
+		return nil
+	}
+
+	l.metrics.queried("dns")
+
+	var rcode uint16
+	var q dnsQuestion
+	var questionEnd int
+	var answers, additional []*dnsRR
+	if flags&dnsOpcodeMask != 0 {
+		rcode = dnsRcodeNotImp
+	} else if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		rcode = dnsRcodeFormErr
+	} else {
+		var err error
+		q.name, questionEnd, err = readDNSName(msg, dnsHeaderSize)
+		if err != nil || questionEnd+4 > len(msg) {
+			rcode = dnsRcodeFormErr
+		} else {
+			q.qtype = binary.BigEndian.Uint16(msg[questionEnd:])
+			q.qclass = binary.BigEndian.Uint16(msg[questionEnd+2:])
+			questionEnd += 4
+			rcode, answers, additional = l.dnsAnswer(q)
+		}
+	}
+
+	b := make([]byte, dnsHeaderSize, maxDNSUDPSize)
+	binary.BigEndian.PutUint16(b[0:], id)
+	flags = dnsFlagResponse | dnsFlagAuthoritative | flags&(dnsOpcodeMask|dnsFlagRecursion) | rcode
+	if questionEnd > 0 {
+		binary.BigEndian.PutUint16(b[4:], 1)
+		b = append(b, msg[dnsHeaderSize:questionEnd]...)
+	}
+	withQuestion := len(b)
+	for _, rr := range answers {
+		b = rr.appendTo(b)
+	}
+	for _, rr := range additional {
+		b = rr.appendTo(b)
+	}
+	if len(b) > maxSize {
+		b = b[:withQuestion]
+		answers, additional = nil, nil
+		flags |= dnsFlagTruncated
+	}
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(additional)))
+	return b
+}
+
+// dnsAnswer looks up the answer (and additional records) to q
+func (l *NSQLookupd) dnsAnswer(q dnsQuestion) (uint16, []*dnsRR, []*dnsRR) {
+	domain := l.options.DNSDomain
+	if q.qclass != dnsClassIN && q.qclass != dnsClassANY {
+		return dnsRcodeRefused, nil, nil
+	}
+	if !strings.HasSuffix(q.name, "."+domain) {
+		if q.name == domain {
+			return dnsRcodeSuccess, nil, nil
+		}
+		return dnsRcodeRefused, nil, nil
+	}
+	name := q.name[:len(q.name)-len("."+domain)]
+	ttl := uint32(l.options.DNSTTL / time.Second)
+
+	service := ""
+	for _, prefix := range []string{"_nsqd._tcp.", "_nsqd-http._tcp."} {
+		if strings.HasPrefix(name, prefix) {
+			service = prefix
+			name = name[len(prefix):]
+			break
+		}
+	}
+
+	topicName := l.dnsTopic(name)
+	if topicName == "" {
+		if service == "" && strings.HasPrefix(name, "ip-") && !strings.Contains(name, ".") {
+			ip := dnsLabelIP(name)
+			if ip != nil {
+				rr := newDNSAddrRR(q.name, ip, ttl)
+				if dnsTypeMatches(q.qtype, rr.rrtype) {
+					return dnsRcodeSuccess, []*dnsRR{rr}, nil
+				}
+				return dnsRcodeSuccess, nil, nil
+			}
+		}
+		return dnsRcodeNXDomain, nil, nil
+	}
+
+	producers := l.DB.FindProducers("topic", topicName, "")
+	producers = producers.FilterByActive(l.options.InactiveProducerTimeout, l.options.TombstoneLifetime)
+	producers = producers.FilterByHealth(l.options.ProducerHeartbeatInterval, l.options.StaleProducerHeartbeats)
+
+	var answers, additional []*dnsRR
+	for _, p := range producers {
+		info := p.peerInfo
+		addresses := info.BroadcastAddresses
+		if len(addresses) == 0 {
+			addresses = []string{info.BroadcastAddress}
+		}
+		switch service {
+		case "":
+			for _, address := range addresses {
+				ip := net.ParseIP(address)
+				if ip == nil {
+					continue
+				}
+				rr := newDNSAddrRR(q.name, ip, ttl)
+				if dnsTypeMatches(q.qtype, rr.rrtype) {
+					answers = append(answers, rr)
+				}
+			}
+		default:
+			if !dnsTypeMatches(q.qtype, dnsTypeSRV) {
+				continue
+			}
+			port := info.TcpPort
+			if service == "_nsqd-http._tcp." {
+				port = info.HttpPort
+			}
+			target := strings.ToLower(strings.TrimRight(info.BroadcastAddress, ".")) + "."
+			if ip := net.ParseIP(info.BroadcastAddress); ip != nil {
+				target = "ip-" + dnsIPLabelEscaper.Replace(ip.String()) + "." + domain
+				additional = append(additional, newDNSAddrRR(target, ip, ttl))
+			}
+			answers = append(answers, newDNSSRVRR(q.name, port, target, ttl))
+		}
+	}
+	return dnsRcodeSuccess, answers, additional
+}
+
+// dnsTopic returns the registered topic whose name is name (regardless of
+// case), or "" when there isn't one
+func (l *NSQLookupd) dnsTopic(name string) string {
+	if name == "" {
+		return ""
+	}
+	var topicName string
+	for _, key := range l.DB.FindRegistrations("topic", "*", "").Keys() {
+		if strings.EqualFold(key, name) && (topicName == "" || key < topicName) {
+			topicName = key
+		}
+	}
+	return topicName
+}
+
+// dnsLabelIP returns the IP of an ip-<address> label, or nil
+func dnsLabelIP(label string) net.IP {
+	if !strings.HasPrefix(label, "ip-") {
+		return nil
+	}
+	address := label[len("ip-"):]
+	if ip := net.ParseIP(strings.Replace(address, "-", ".", -1)); ip != nil {
+		return ip
+	}
+	return net.ParseIP(strings.Replace(address, "-", ":", -1))
+}
+
+// dnsUDPLoop answers the DNS queries sent to conn until it's closed
+func (l *NSQLookupd) dnsUDPLoop(conn *net.UDPConn) {
+	log.Printf("DNS: listening on %s (udp)", conn.LocalAddr().String())
+
+	buf := make([]byte, maxDNSTCPSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				runtime.Gosched()
+				continue
+			}
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("ERROR: DNS read - %s", err.Error())
+			}
+			break
+		}
+		resp := l.dnsResponse(buf[:n], maxDNSUDPSize)
+		if resp == nil {
+			continue
+		}
+		_, err = conn.WriteToUDP(resp, addr)
+		if err != nil {
+			log.Printf("ERROR: DNS write to %s - %s", addr, err.Error())
+		}
+	}
+
+	log.Printf("DNS: closing %s (udp)", conn.LocalAddr().String())
+}
+
+type dnsTCPServer struct {
+	context *Context
+}
+
+// Handle answers the (2-byte length prefixed) DNS queries of a TCP connection
+func (s *dnsTCPServer) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	var lenBuf [2]byte
+	buf := make([]byte, maxDNSTCPSize)
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPTimeout))
+		_, err := io.ReadFull(conn, lenBuf[:])
+		if err != nil {
+			return
+		}
+		msg := buf[:binary.BigEndian.Uint16(lenBuf[:])]
+		_, err = io.ReadFull(conn, msg)
+		if err != nil {
+			return
+		}
+		resp := s.context.nsqlookupd.dnsResponse(msg, maxDNSTCPSize)
+		if resp == nil {
+			return
+		}
+		binary.BigEndian.PutUint16(lenBuf[:], uint16(len(resp)))
+		_, err = conn.Write(append(lenBuf[:], resp...))
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package nsqlookupd
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// evictionLoop periodically removes producers that have missed
+// --evict-producer-heartbeats consecutive heartbeats from every registration,
+// ie. nsqd that died (or hung) without closing their connection
+func (l *NSQLookupd) evictionLoop() {
+	ticker := time.NewTicker(l.options.ProducerHeartbeatInterval)
+	for {
+		select {
+		case <-l.exitChan:
+			goto exit
+		case <-ticker.C:
+			l.evictStaleProducers()
+		}
+	}
+
+exit:
+	ticker.Stop()
+}
+
+func (l *NSQLookupd) evictStaleProducers() {
+	producers := l.DB.FindProducers("client", "", "")
+	for _, p := range producers {
+		missed := p.peerInfo.MissedHeartbeats(l.options.ProducerHeartbeatInterval)
+		if missed < l.options.EvictProducerHeartbeats {
+			continue
+		}
+
+		log.Printf("DB: client(%s) EVICTED after %d missed heartbeats", p.peerInfo.id, missed)
+		// the connection is closed the next time the producer is heard from
+		// so that it reconnects and re-registers
+		atomic.StoreInt32(&p.peerInfo.evicted, 1)
+		l.metrics.evicted()
+		for _, r := range l.DB.LookupRegistrations(p.peerInfo.id) {
+			if removed, _ := l.DB.RemoveProducer(r, p.peerInfo.id); removed {
+				log.Printf("DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
+					p.peerInfo.id, r.Category, r.Key, r.SubKey)
+			}
+		}
+	}
+}
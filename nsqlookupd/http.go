@@ -1,10 +1,11 @@
 package nsqlookupd
 
 import (
-	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/bitly/nsq/util"
@@ -15,6 +16,10 @@ type httpServer struct {
 }
 
 func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if queryEndpoints[req.URL.Path] {
+		s.context.nsqlookupd.metrics.queried(req.URL.Path[1:])
+	}
+
 	switch req.URL.Path {
 	case "/ping":
 		s.pingHandler(w, req)
@@ -28,6 +33,8 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		s.channelsHandler(w, req)
 	case "/nodes":
 		s.nodesHandler(w, req)
+	case "/producers":
+		s.producersHandler(w, req)
 	case "/delete_topic":
 		s.deleteTopicHandler(w, req)
 	case "/delete_channel":
@@ -38,16 +45,94 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		s.createTopicHandler(w, req)
 	case "/create_channel":
 		s.createChannelHandler(w, req)
+	case "/topic_config":
+		s.topicConfigHandler(w, req)
+	case "/topic_configs":
+		s.topicConfigsHandler(w, req)
+	case "/set_topic_config":
+		s.setTopicConfigHandler(w, req)
+	case "/delete_topic_config":
+		s.deleteTopicConfigHandler(w, req)
+	case "/producer/register":
+		s.producerRegisterHandler(w, req)
+	case "/producer/unregister":
+		s.producerUnregisterHandler(w, req)
 	case "/debug":
 		s.debugHandler(w, req)
+	case "/metrics":
+		s.metricsHandler(w, req)
 	default:
+		if s.context.nsqlookupd.options.HTTPDebug && strings.HasPrefix(req.URL.Path, "/debug/") {
+			util.NewDebugHandler(s.context.nsqlookupd.options.HTTPDebugAuthToken).ServeHTTP(w, req)
+			return
+		}
 		util.ApiResponse(w, 404, "NOT_FOUND", nil)
 	}
 }
 
 func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Length", "2")
-	io.WriteString(w, "OK")
+	util.OKResponse(w)
+}
+
+// producerRegisterHandler registers (and heartbeats) a producer over HTTP, the
+// body is its PeerInfo and HTTPRegistration (see http_registration.go)
+func (s *httpServer) producerRegisterHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	peerInfo, reg, err := parseHTTPRegistration(reqParams.Body, req.RemoteAddr)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_BODY", nil)
+		return
+	}
+
+	// require all fields
+	if peerInfo.BroadcastAddress == "" || peerInfo.TcpPort == 0 || peerInfo.HttpPort == 0 || peerInfo.Version == "" {
+		util.ApiResponse(w, 500, "MISSING_FIELDS", nil)
+		return
+	}
+
+	for topicName, channelNames := range reg.Topics {
+		if !nsq.IsValidTopicName(topicName) {
+			util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+			return
+		}
+		for _, channelName := range channelNames {
+			if !nsq.IsValidChannelName(channelName) {
+				util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+				return
+			}
+		}
+	}
+
+	peerInfo = s.context.nsqlookupd.registerHTTPProducer(peerInfo, reg)
+	util.ApiResponse(w, 200, "OK", s.context.nsqlookupd.httpRegistrationResponse(peerInfo))
+}
+
+// producerUnregisterHandler unregisters a producer registered over HTTP, the
+// body is its PeerInfo (only broadcast_address and tcp_port are required)
+func (s *httpServer) producerUnregisterHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	peerInfo, _, err := parseHTTPRegistration(reqParams.Body, req.RemoteAddr)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_BODY", nil)
+		return
+	}
+
+	if !s.context.nsqlookupd.unregisterHTTPProducer(peerInfo.id) {
+		util.ApiResponse(w, 404, "PRODUCER_NOT_FOUND", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
 }
 
 func (s *httpServer) topicsHandler(w http.ResponseWriter, req *http.Request) {
@@ -91,22 +176,119 @@ func (s *httpServer) lookupHandler(w http.ResponseWriter, req *http.Request) {
 
 	registration := s.context.nsqlookupd.DB.FindRegistrations("topic", topicName, "")
 
-	if len(registration) == 0 {
+	// a sharded topic isn't registered itself, the producers that have it
+	// report it (with SHARDS)
+	shardProducers := s.context.nsqlookupd.DB.FindProducers("client", "", "").FilterBySharded(topicName)
+	shardProducers = shardProducers.FilterByActive(s.context.nsqlookupd.options.InactiveProducerTimeout,
+		s.context.nsqlookupd.options.TombstoneLifetime)
+
+	if len(registration) == 0 && len(shardProducers) == 0 {
 		util.ApiResponse(w, 500, "INVALID_ARG_TOPIC", nil)
 		return
 	}
 
 	channels := s.context.nsqlookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
 	producers := s.context.nsqlookupd.DB.FindProducers("topic", topicName, "")
+	if len(registration) == 0 {
+		// the sharded topic is published to through any producer that has it
+		producers = shardProducers
+	}
 	producers = producers.FilterByActive(s.context.nsqlookupd.options.InactiveProducerTimeout,
 		s.context.nsqlookupd.options.TombstoneLifetime)
+	producers = producers.FilterByHealth(s.context.nsqlookupd.options.ProducerHeartbeatInterval,
+		s.context.nsqlookupd.options.StaleProducerHeartbeats)
+	// only return producers that (last reported that they) have messages for the topic,
+	// so that consumers don't bother connecting to idle ones
+	if hasMessages, _ := reqParams.Get("has_messages"); hasMessages == "true" || hasMessages == "1" {
+		producers = producers.FilterByMessages(topicName)
+	}
+	// only producers with every label= (<key>=<value>), and preferably those
+	// with every prefer_label= (ie. of the consumer's region) when there are any
+	labels, err := util.ParseLabels(reqParams.Values["label"])
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_LABEL", nil)
+		return
+	}
+	preferLabels, err := util.ParseLabels(reqParams.Values["prefer_label"])
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_PREFER_LABEL", nil)
+		return
+	}
+	producers = producers.FilterByLabels(labels)
+	if preferred := producers.FilterByLabels(preferLabels); len(preferred) > 0 {
+		producers = preferred
+	}
+	// publishers only want producers whose topic isn't a (read-only) replica
+	if writable, _ := reqParams.Get("writable"); writable == "true" || writable == "1" {
+		producers = producers.FilterByWritable(topicName)
+	}
 	data := make(map[string]interface{})
 	data["channels"] = channels
-	data["producers"] = producers.PeerInfo()
+	data["producers"] = producers.TopicPeerInfo(topicName)
+	if len(shardProducers) > 0 {
+		data["shards"] = shardMap(topicName, shardProducers)
+	}
+	if annotations := topicAnnotations(topicName, producers); annotations != nil {
+		data["annotations"] = annotations.Annotations
+		data["channel_annotations"] = annotations.Channels
+	}
 
 	util.ApiResponse(w, 200, "OK", data)
 }
 
+// shardMap describes a sharded topic for /lookup, producers only disagree on
+// the number of shards while it's being resharded so every shard of the
+// largest number is listed (consumers have to drain the old ones)
+func shardMap(topicName string, producers Producers) map[string]interface{} {
+	count := 0
+	for _, p := range producers {
+		if shards := p.peerInfo.Shards(topicName); shards > count {
+			count = shards
+		}
+	}
+	return map[string]interface{}{
+		"count":  count,
+		"topics": util.ShardTopicNames(topicName, count),
+	}
+}
+
+// topicAnnotations merges the annotations producers reported for topicName
+// (and its channels), they only differ while one is being annotated... the
+// first producer's value of each key wins
+func topicAnnotations(topicName string, producers Producers) *TopicAnnotations {
+	var merged *TopicAnnotations
+	for _, p := range producers {
+		annotations := p.peerInfo.TopicAnnotations(topicName)
+		if annotations == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &TopicAnnotations{
+				Annotations: make(map[string]string),
+				Channels:    make(map[string]map[string]string),
+			}
+		}
+		for k, v := range annotations.Annotations {
+			if _, ok := merged.Annotations[k]; !ok {
+				merged.Annotations[k] = v
+			}
+		}
+		for channelName, channelAnnotations := range annotations.Channels {
+			m, ok := merged.Channels[channelName]
+			if !ok {
+				m = make(map[string]string)
+				merged.Channels[channelName] = m
+			}
+			for k, v := range channelAnnotations {
+				if _, ok := m[k]; !ok {
+					m[k] = v
+				}
+			}
+		}
+	}
+	return merged
+}
+
 func (s *httpServer) createTopicHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
@@ -182,9 +364,11 @@ func (s *httpServer) tombstoneTopicProducerHandler(w http.ResponseWriter, req *h
 	log.Printf("DB: setting tombstone for producer@%s of topic(%s)", node, topicName)
 	producers := s.context.nsqlookupd.DB.FindProducers("topic", topicName, "")
 	for _, p := range producers {
-		thisNode := fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HttpPort)
-		if thisNode == node {
-			p.Tombstone()
+		for _, thisNode := range p.peerInfo.HTTPAddresses() {
+			if thisNode == node {
+				p.Tombstone()
+				break
+			}
 		}
 	}
 
@@ -244,14 +428,19 @@ func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Reque
 
 // note: we can't embed the *Producer here because embeded objects are ignored for json marshalling
 type node struct {
-	RemoteAddress    string   `json:"remote_address"`
-	Hostname         string   `json:"hostname"`
-	BroadcastAddress string   `json:"broadcast_address"`
-	TcpPort          int      `json:"tcp_port"`
-	HttpPort         int      `json:"http_port"`
-	Version          string   `json:"version"`
-	Tombstones       []bool   `json:"tombstones"`
-	Topics           []string `json:"topics"`
+	RemoteAddress      string   `json:"remote_address"`
+	Hostname           string   `json:"hostname"`
+	BroadcastAddress   string   `json:"broadcast_address"`
+	BroadcastAddresses []string `json:"broadcast_addresses,omitempty"`
+	TcpPort            int      `json:"tcp_port"`
+	HttpPort           int      `json:"http_port"`
+	Version            string   `json:"version"`
+	Tombstones         []bool   `json:"tombstones"`
+	Topics             []string `json:"topics"`
+	WorkerID           int64    `json:"worker_id"`
+	IDGenerator        string   `json:"id_generator,omitempty"`
+	// WorkerIDCollisions are the producers minting the same message IDs
+	WorkerIDCollisions []string `json:"worker_id_collisions,omitempty"`
 }
 
 func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request) {
@@ -275,14 +464,18 @@ func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request) {
 		}
 
 		nodes[i] = &node{
-			RemoteAddress:    p.peerInfo.RemoteAddress,
-			Hostname:         p.peerInfo.Hostname,
-			BroadcastAddress: p.peerInfo.BroadcastAddress,
-			TcpPort:          p.peerInfo.TcpPort,
-			HttpPort:         p.peerInfo.HttpPort,
-			Version:          p.peerInfo.Version,
-			Tombstones:       tombstones,
-			Topics:           topics,
+			RemoteAddress:      p.peerInfo.RemoteAddress,
+			Hostname:           p.peerInfo.Hostname,
+			BroadcastAddress:   p.peerInfo.BroadcastAddress,
+			BroadcastAddresses: p.peerInfo.BroadcastAddresses,
+			TcpPort:            p.peerInfo.TcpPort,
+			HttpPort:           p.peerInfo.HttpPort,
+			Version:            p.peerInfo.Version,
+			Tombstones:         tombstones,
+			Topics:             topics,
+			WorkerID:           p.peerInfo.WorkerID,
+			IDGenerator:        p.peerInfo.IDGenerator,
+			WorkerIDCollisions: s.context.nsqlookupd.workerIDCollisions(p.peerInfo),
 		}
 	}
 
@@ -291,6 +484,173 @@ func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request) {
 	util.ApiResponse(w, 200, "OK", data)
 }
 
+type producerHealth struct {
+	RemoteAddress      string   `json:"remote_address"`
+	Hostname           string   `json:"hostname"`
+	BroadcastAddress   string   `json:"broadcast_address"`
+	BroadcastAddresses []string `json:"broadcast_addresses,omitempty"`
+	TcpPort            int      `json:"tcp_port"`
+	HttpPort           int      `json:"http_port"`
+	Version            string   `json:"version"`
+	LastUpdate         int64    `json:"last_update"`
+	MissedHeartbeats   int      `json:"missed_heartbeats"`
+	Status             string   `json:"status"`
+}
+
+// producersHandler lists every connected producer along with its health,
+// optionally only those with the given status (healthy, degraded or stale)
+func (s *httpServer) producersHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	status, _ := reqParams.Get("status")
+	switch status {
+	case "", "healthy", "degraded", "stale":
+	default:
+		util.ApiResponse(w, 500, "INVALID_ARG_STATUS", nil)
+		return
+	}
+
+	interval := s.context.nsqlookupd.options.ProducerHeartbeatInterval
+	staleHeartbeats := s.context.nsqlookupd.options.StaleProducerHeartbeats
+
+	producers := make([]*producerHealth, 0)
+	for _, p := range s.context.nsqlookupd.DB.FindProducers("client", "", "") {
+		health := p.peerInfo.Health(interval, staleHeartbeats)
+		if status != "" && health != status {
+			continue
+		}
+		producers = append(producers, &producerHealth{
+			RemoteAddress:      p.peerInfo.RemoteAddress,
+			Hostname:           p.peerInfo.Hostname,
+			BroadcastAddress:   p.peerInfo.BroadcastAddress,
+			BroadcastAddresses: p.peerInfo.BroadcastAddresses,
+			TcpPort:            p.peerInfo.TcpPort,
+			HttpPort:           p.peerInfo.HttpPort,
+			Version:            p.peerInfo.Version,
+			LastUpdate:         p.peerInfo.lastUpdate.UnixNano(),
+			MissedHeartbeats:   p.peerInfo.MissedHeartbeats(interval),
+			Status:             health,
+		})
+	}
+
+	data := make(map[string]interface{})
+	data["producers"] = producers
+	util.ApiResponse(w, 200, "OK", data)
+}
+
+// topicConfigHandler returns the configuration of a topic, which is null if
+// it has none (nsqd queries this whenever it creates a topic)
+func (s *httpServer) topicConfigHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["config"] = s.context.nsqlookupd.TopicConfigs.Get(topicName)
+	util.ApiResponse(w, 200, "OK", data)
+}
+
+func (s *httpServer) topicConfigsHandler(w http.ResponseWriter, req *http.Request) {
+	data := make(map[string]interface{})
+	data["configs"] = s.context.nsqlookupd.TopicConfigs.All()
+	util.ApiResponse(w, 200, "OK", data)
+}
+
+// setTopicConfigHandler replaces the configuration of a topic with the given
+// retention_period, max_depth and ephemeral_channels (those not given are unset)
+func (s *httpServer) setTopicConfigHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	if !nsq.IsValidTopicName(topicName) {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	cfg := &TopicConfig{}
+	if period, err := reqParams.Get("retention_period"); err == nil {
+		d, err := time.ParseDuration(period)
+		if err != nil || d < 0 {
+			util.ApiResponse(w, 500, "INVALID_ARG_RETENTION_PERIOD", nil)
+			return
+		}
+		cfg.RetentionPeriod = period
+	}
+	if maxDepth, err := reqParams.Get("max_depth"); err == nil {
+		cfg.MaxDepth, err = strconv.ParseInt(maxDepth, 10, 64)
+		if err != nil || cfg.MaxDepth < 0 {
+			util.ApiResponse(w, 500, "INVALID_ARG_MAX_DEPTH", nil)
+			return
+		}
+	}
+	if ephemeral, err := reqParams.Get("ephemeral_channels"); err == nil {
+		cfg.EphemeralChannels, err = strconv.ParseBool(ephemeral)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_EPHEMERAL_CHANNELS", nil)
+			return
+		}
+	}
+
+	log.Printf("DB: setting config of topic(%s) %+v", topicName, cfg)
+	err = s.context.nsqlookupd.TopicConfigs.Set(topicName, cfg)
+	if err != nil {
+		log.Printf("ERROR: failed to persist topic config - %s", err.Error())
+		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) deleteTopicConfigHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	found, err := s.context.nsqlookupd.TopicConfigs.Delete(topicName)
+	if err != nil {
+		log.Printf("ERROR: failed to persist topic config - %s", err.Error())
+		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+		return
+	}
+	if !found {
+		util.ApiResponse(w, 404, "NOT_FOUND", nil)
+		return
+	}
+
+	log.Printf("DB: removed config of topic(%s)", topicName)
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
 func (s *httpServer) infoHandler(w http.ResponseWriter, req *http.Request) {
 	util.ApiResponse(w, 200, "OK", struct {
 		Version string `json:"version"`
@@ -312,6 +672,7 @@ func (s *httpServer) debugHandler(w http.ResponseWriter, req *http.Request) {
 			m["id"] = p.peerInfo.id
 			m["hostname"] = p.peerInfo.Hostname
 			m["broadcast_address"] = p.peerInfo.BroadcastAddress
+			m["broadcast_addresses"] = p.peerInfo.BroadcastAddresses
 			m["tcp_port"] = p.peerInfo.TcpPort
 			m["http_port"] = p.peerInfo.HttpPort
 			m["version"] = p.peerInfo.Version
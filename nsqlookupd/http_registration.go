@@ -0,0 +1,212 @@
+package nsqlookupd
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/nsq/util"
+)
+
+// nsqd that can only reach nsqlookupd over HTTP(S) (ie. through a firewall
+// that only allows HTTPS egress) register with POST /producer/register rather
+// than over the TCP protocol... each POST (every heartbeat, and whenever the
+// producer's topics or channels change) carries its IDENTIFY fields and
+// everything it would otherwise send over TCP, the producer's registrations
+// are replaced by the topics and channels it lists
+//
+// there's no connection to close when the producer goes away, it's
+// unregistered when it POSTs to /producer/unregister or once it hasn't POSTed
+// for --http-producer-timeout
+
+// HTTPRegistration is the body of a POST /producer/register (alongside the
+// PeerInfo fields)
+type HTTPRegistration struct {
+	// Topics are the producer's topics and their channels
+	Topics      map[string][]string          `json:"topics"`
+	Depths      map[string]int64             `json:"depths,omitempty"`
+	Replicas    map[string]string            `json:"replicas,omitempty"`
+	Shards      map[string]int               `json:"shards,omitempty"`
+	Annotations map[string]*TopicAnnotations `json:"annotations,omitempty"`
+}
+
+// httpProducers are the producers registered over HTTP, by id
+type httpProducers struct {
+	sync.Mutex
+	m map[string]*PeerInfo
+}
+
+func newHTTPProducers() *httpProducers {
+	return &httpProducers{m: make(map[string]*PeerInfo)}
+}
+
+// httpProducerID identifies a producer registered over HTTP, as there's no
+// connection to identify it by
+func httpProducerID(peerInfo *PeerInfo) string {
+	return "http:" + net.JoinHostPort(peerInfo.BroadcastAddress, strconv.Itoa(peerInfo.TcpPort))
+}
+
+// parseHTTPRegistration decodes a POST /producer/register (or unregister) body
+func parseHTTPRegistration(body []byte, remoteAddr string) (*PeerInfo, *HTTPRegistration, error) {
+	peerInfo := &PeerInfo{}
+	err := json.Unmarshal(body, peerInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+	reg := &HTTPRegistration{}
+	err = json.Unmarshal(body, reg)
+	if err != nil {
+		return nil, nil, err
+	}
+	peerInfo.id = httpProducerID(peerInfo)
+	peerInfo.RemoteAddress = remoteAddr
+	return peerInfo, reg, nil
+}
+
+// registerHTTPProducer records a POST /producer/register, returning the
+// producer's PeerInfo (that of its first POST unless it has since changed,
+// been evicted or timed out)
+func (l *NSQLookupd) registerHTTPProducer(peerInfo *PeerInfo, reg *HTTPRegistration) *PeerInfo {
+	l.httpProducers.Lock()
+	defer l.httpProducers.Unlock()
+
+	existing, ok := l.httpProducers.m[peerInfo.id]
+	if ok && (atomic.LoadInt32(&existing.evicted) == 1 || !sameHTTPProducer(existing, peerInfo)) {
+		l.unregisterProducer(existing)
+		ok = false
+	}
+	if !ok {
+		log.Printf("HTTP: producer(%s) REGISTER Address:%s TCP:%d HTTP:%d Version:%s Labels:%v WorkerID:%d",
+			peerInfo.id, peerInfo.BroadcastAddress, peerInfo.TcpPort, peerInfo.HttpPort, peerInfo.Version,
+			peerInfo.Labels, peerInfo.WorkerID)
+		existing = peerInfo
+		l.httpProducers.m[peerInfo.id] = existing
+		if l.DB.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: existing}) {
+			log.Printf("DB: client(%s) REGISTER category:%s key:%s subkey:%s", existing.id, "client", "", "")
+		}
+	}
+	existing.lastUpdate = time.Now()
+
+	existing.SetTopicDepths(reg.Depths)
+	existing.SetReplicaTopics(reg.Replicas)
+	existing.SetShardedTopics(reg.Shards)
+	existing.SetTopicAnnotations(reg.Annotations)
+
+	registered := make(map[Registration]bool)
+	for topic, channels := range reg.Topics {
+		registered[Registration{"topic", topic, ""}] = true
+		for _, channel := range channels {
+			registered[Registration{"channel", topic, channel}] = true
+		}
+	}
+	for _, r := range l.DB.LookupRegistrations(existing.id) {
+		if r.Category == "client" || registered[r] {
+			continue
+		}
+		l.unregister(existing, r)
+	}
+	for r := range registered {
+		if l.DB.AddProducer(r, &Producer{peerInfo: existing}) {
+			log.Printf("DB: client(%s) REGISTER category:%s key:%s subkey:%s",
+				existing.id, r.Category, r.Key, r.SubKey)
+		}
+	}
+
+	return existing
+}
+
+// unregisterHTTPProducer records a POST /producer/unregister, returning
+// whether the producer was registered
+func (l *NSQLookupd) unregisterHTTPProducer(id string) bool {
+	l.httpProducers.Lock()
+	defer l.httpProducers.Unlock()
+
+	peerInfo, ok := l.httpProducers.m[id]
+	if ok {
+		l.unregisterProducer(peerInfo)
+	}
+	return ok
+}
+
+// unregisterProducer removes a producer registered over HTTP from every
+// registration, l.httpProducers must be locked
+func (l *NSQLookupd) unregisterProducer(peerInfo *PeerInfo) {
+	delete(l.httpProducers.m, peerInfo.id)
+	for _, r := range l.DB.LookupRegistrations(peerInfo.id) {
+		l.unregister(peerInfo, r)
+	}
+}
+
+func (l *NSQLookupd) unregister(peerInfo *PeerInfo, r Registration) {
+	removed, left := l.DB.RemoveProducer(r, peerInfo.id)
+	if removed {
+		log.Printf("DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
+			peerInfo.id, r.Category, r.Key, r.SubKey)
+	}
+	// for ephemeral channels, remove the channel as well if it has no producers
+	if left == 0 && r.Category == "channel" && strings.HasSuffix(r.SubKey, "#ephemeral") {
+		l.DB.RemoveRegistration(r)
+	}
+}
+
+// sameHTTPProducer returns whether b identifies itself as a does (the
+// producer has been restarted with other options otherwise)
+func sameHTTPProducer(a *PeerInfo, b *PeerInfo) bool {
+	ja, _ := json.Marshal(a)
+	// the remote address changes from one POST to the next
+	remoteAddress := b.RemoteAddress
+	b.RemoteAddress = a.RemoteAddress
+	jb, _ := json.Marshal(b)
+	b.RemoteAddress = remoteAddress
+	return string(ja) == string(jb)
+}
+
+// httpProducerLoop unregisters the producers registered over HTTP that
+// haven't POSTed for --http-producer-timeout
+func (l *NSQLookupd) httpProducerLoop() {
+	ticker := time.NewTicker(l.options.ProducerHeartbeatInterval)
+	for {
+		select {
+		case <-l.exitChan:
+			goto exit
+		case <-ticker.C:
+			l.httpProducers.Lock()
+			for id, peerInfo := range l.httpProducers.m {
+				if time.Now().Sub(peerInfo.lastUpdate) < l.options.HTTPProducerTimeout {
+					continue
+				}
+				log.Printf("HTTP: producer(%s) timed out", id)
+				l.unregisterProducer(peerInfo)
+			}
+			l.httpProducers.Unlock()
+		}
+	}
+
+exit:
+	ticker.Stop()
+}
+
+// httpRegistrationResponse is the response to a POST /producer/register, what
+// the TCP protocol's IDENTIFY responds
+func (l *NSQLookupd) httpRegistrationResponse(peerInfo *PeerInfo) map[string]interface{} {
+	data := make(map[string]interface{})
+	data["tcp_port"] = l.tcpAddr.Port
+	data["http_port"] = l.httpAddr.Port
+	data["version"] = util.BINARY_VERSION
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("ERROR: unable to get hostname %s", err.Error())
+	}
+	data["broadcast_address"] = l.options.BroadcastAddress
+	data["hostname"] = hostname
+	if collisions := l.workerIDCollisions(peerInfo); len(collisions) > 0 {
+		data["worker_id_collisions"] = collisions
+	}
+	return data
+}
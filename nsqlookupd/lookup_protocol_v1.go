@@ -10,12 +10,17 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/bitly/nsq/util"
 )
 
+// maxDepthBodySize bounds the body of a DEPTH (or REPLICAS, SHARDS or
+// ANNOTATIONS) command
+const maxDepthBodySize = 16 * 1024 * 1024
+
 type LookupProtocolV1 struct {
 	context *Context
 }
@@ -44,8 +49,8 @@ func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
 			}
 			log.Printf("ERROR: [%s] - %s%s", client, err.Error(), context)
 
-			_, err = util.SendResponse(client, []byte(err.Error()))
-			if err != nil {
+			_, sendErr := util.SendResponse(client, []byte(err.Error()))
+			if sendErr != nil {
 				break
 			}
 
@@ -65,6 +70,7 @@ func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
 	}
 
 	log.Printf("CLIENT(%s): closing", client)
+	conn.Close()
 	if client.peerInfo != nil {
 		registrations := p.context.nsqlookupd.DB.LookupRegistrations(client.peerInfo.id)
 		for _, r := range registrations {
@@ -78,6 +84,11 @@ func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
 }
 
 func (p *LookupProtocolV1) Exec(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.peerInfo != nil && atomic.LoadInt32(&client.peerInfo.evicted) == 1 {
+		// force the producer to reconnect and re-register
+		return nil, util.NewFatalClientErr(nil, "E_EVICTED", "producer was evicted for missing heartbeats")
+	}
+
 	switch params[0] {
 	case "PING":
 		return p.PING(client, params)
@@ -87,6 +98,16 @@ func (p *LookupProtocolV1) Exec(client *ClientV1, reader *bufio.Reader, params [
 		return p.REGISTER(client, reader, params[1:])
 	case "UNREGISTER":
 		return p.UNREGISTER(client, reader, params[1:])
+	case "DEPTH":
+		return p.DEPTH(client, reader, params[1:])
+	case "REPLICAS":
+		return p.REPLICAS(client, reader, params[1:])
+	case "SHARDS":
+		return p.SHARDS(client, reader, params[1:])
+	case "ANNOTATIONS":
+		return p.ANNOTATIONS(client, reader, params[1:])
+	case "LEASE_WORKER_ID":
+		return p.LEASE_WORKER_ID(client, reader, params[1:])
 	}
 	return nil, util.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
@@ -218,14 +239,23 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 
 	peerInfo.lastUpdate = time.Now()
 
-	log.Printf("CLIENT(%s): IDENTIFY Address:%s TCP:%d HTTP:%d Version:%s",
-		client, peerInfo.BroadcastAddress, peerInfo.TcpPort, peerInfo.HttpPort, peerInfo.Version)
+	log.Printf("CLIENT(%s): IDENTIFY Address:%s TCP:%d HTTP:%d Version:%s Labels:%v WorkerID:%d",
+		client, peerInfo.BroadcastAddress, peerInfo.TcpPort, peerInfo.HttpPort, peerInfo.Version, peerInfo.Labels,
+		peerInfo.WorkerID)
 
 	client.peerInfo = &peerInfo
 	if p.context.nsqlookupd.DB.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: client.peerInfo}) {
 		log.Printf("DB: client(%s) REGISTER category:%s key:%s subkey:%s", client, "client", "", "")
 	}
 
+	// producers that share a worker id mint the same message IDs, this can't
+	// be refused (they're already publishing) but the producer is told
+	collisions := p.context.nsqlookupd.workerIDCollisions(client.peerInfo)
+	if len(collisions) > 0 {
+		log.Printf("WARNING: CLIENT(%s): worker id %d collides with %s",
+			client, peerInfo.WorkerID, strings.Join(collisions, ", "))
+	}
+
 	// build a response
 	data := make(map[string]interface{})
 	data["tcp_port"] = p.context.nsqlookupd.tcpAddr.Port
@@ -237,6 +267,19 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	}
 	data["broadcast_address"] = p.context.nsqlookupd.options.BroadcastAddress
 	data["hostname"] = hostname
+	// let the producer know it can send DEPTH
+	data["depth_reports"] = true
+	// and REPLICAS
+	data["replica_reports"] = true
+	// and SHARDS
+	data["shard_reports"] = true
+	// and ANNOTATIONS
+	data["annotation_reports"] = true
+	// and renew its worker id lease
+	data["worker_id_leases"] = true
+	if len(collisions) > 0 {
+		data["worker_id_collisions"] = collisions
+	}
 
 	response, err := json.Marshal(data)
 	if err != nil {
@@ -246,6 +289,212 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	return response, nil
 }
 
+// DEPTH records the producer's current depth for each of its topics, the body
+// is a JSON object of topic name to depth (this is what /lookup?has_messages=true
+// filters on)
+func (p *LookupProtocolV1) DEPTH(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	var err error
+
+	if client.peerInfo == nil {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	var bodyLen int32
+	err = binary.Read(reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "DEPTH failed to read body size")
+	}
+
+	if bodyLen <= 0 || bodyLen > maxDepthBodySize {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("DEPTH invalid body size %d", bodyLen))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "DEPTH failed to read body")
+	}
+
+	var depths map[string]int64
+	err = json.Unmarshal(body, &depths)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "DEPTH failed to decode JSON body")
+	}
+	if depths == nil {
+		depths = make(map[string]int64)
+	}
+
+	client.peerInfo.SetTopicDepths(depths)
+
+	return []byte("OK"), nil
+}
+
+// REPLICAS records which of the producer's topics are replicas (and the
+// cluster each is replicated from), the body is a JSON object of topic name
+// to cluster, /lookup reports the producer as read_only for those topics
+func (p *LookupProtocolV1) REPLICAS(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	var err error
+
+	if client.peerInfo == nil {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	var bodyLen int32
+	err = binary.Read(reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "REPLICAS failed to read body size")
+	}
+
+	if bodyLen <= 0 || bodyLen > maxDepthBodySize {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("REPLICAS invalid body size %d", bodyLen))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "REPLICAS failed to read body")
+	}
+
+	var replicas map[string]string
+	err = json.Unmarshal(body, &replicas)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "REPLICAS failed to decode JSON body")
+	}
+
+	client.peerInfo.SetReplicaTopics(replicas)
+
+	return []byte("OK"), nil
+}
+
+// SHARDS records the producer's sharded topics, the body is a JSON object of
+// topic name to number of shards, /lookup of a sharded topic lists its shards
+func (p *LookupProtocolV1) SHARDS(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	var err error
+
+	if client.peerInfo == nil {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	var bodyLen int32
+	err = binary.Read(reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "SHARDS failed to read body size")
+	}
+
+	if bodyLen <= 0 || bodyLen > maxDepthBodySize {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("SHARDS invalid body size %d", bodyLen))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "SHARDS failed to read body")
+	}
+
+	var shards map[string]int
+	err = json.Unmarshal(body, &shards)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "SHARDS failed to decode JSON body")
+	}
+
+	client.peerInfo.SetShardedTopics(shards)
+
+	return []byte("OK"), nil
+}
+
+// ANNOTATIONS records the annotations (owner, description etc.) of the
+// producer's topics and their channels, the body is a JSON object of topic name
+// to {"annotations": {...}, "channels": {<channel name>: {...}}}, /lookup
+// returns them
+func (p *LookupProtocolV1) ANNOTATIONS(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	var err error
+
+	if client.peerInfo == nil {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	var bodyLen int32
+	err = binary.Read(reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "ANNOTATIONS failed to read body size")
+	}
+
+	if bodyLen <= 0 || bodyLen > maxDepthBodySize {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("ANNOTATIONS invalid body size %d", bodyLen))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "ANNOTATIONS failed to read body")
+	}
+
+	var annotations map[string]*TopicAnnotations
+	err = json.Unmarshal(body, &annotations)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "ANNOTATIONS failed to decode JSON body")
+	}
+
+	client.peerInfo.SetTopicAnnotations(annotations)
+
+	return []byte("OK"), nil
+}
+
+// LEASE_WORKER_ID leases a worker id (see worker_id_lease.go), the body is a
+// JSON WorkerIDLeaseRequest... it doesn't require IDENTIFY, nsqd leases its
+// worker id before it starts
+func (p *LookupProtocolV1) LEASE_WORKER_ID(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	var err error
+
+	var bodyLen int32
+	err = binary.Read(reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "LEASE_WORKER_ID failed to read body size")
+	}
+
+	if bodyLen <= 0 || bodyLen > maxDepthBodySize {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("LEASE_WORKER_ID invalid body size %d", bodyLen))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "LEASE_WORKER_ID failed to read body")
+	}
+
+	var req WorkerIDLeaseRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "LEASE_WORKER_ID failed to decode JSON body")
+	}
+	if req.Owner == "" || req.MaxWorkerID <= 0 {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY", "LEASE_WORKER_ID missing fields")
+	}
+
+	ttl := p.context.nsqlookupd.options.WorkerIDLeaseTTL
+	workerID, err := p.context.nsqlookupd.workerIDLeases.Lease(&req,
+		p.context.nsqlookupd.workerIDsInUse(), ttl)
+	if err == errWorkerIDsExhausted {
+		return nil, util.NewClientErr(err, "E_WORKER_IDS_EXHAUSTED", "LEASE_WORKER_ID no free worker ids")
+	}
+	if err != nil {
+		return nil, util.NewClientErr(nil, "E_WORKER_ID_CONFLICT", err.Error())
+	}
+	if req.WorkerID != workerID {
+		log.Printf("CLIENT(%s): leased worker id %d to %s", client, workerID, req.Owner)
+	}
+
+	return json.Marshal(struct {
+		WorkerID int64 `json:"worker_id"`
+		TTL      int64 `json:"ttl"`
+	}{workerID, int64(ttl / time.Millisecond)})
+}
+
 func (p *LookupProtocolV1) PING(client *ClientV1, params []string) ([]byte, error) {
 	if client.peerInfo != nil {
 		// we could get a PING before other commands on the same client connection
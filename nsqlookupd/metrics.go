@@ -0,0 +1,117 @@
+package nsqlookupd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// queryEndpoints are the HTTP endpoints counted as (discovery) queries
+var queryEndpoints = map[string]bool{
+	"/lookup":    true,
+	"/topics":    true,
+	"/channels":  true,
+	"/nodes":     true,
+	"/producers": true,
+}
+
+type lookupdMetrics struct {
+	sync.Mutex
+	queryCounts   map[string]uint64
+	evictionCount uint64
+}
+
+func (m *lookupdMetrics) queried(endpoint string) {
+	m.Lock()
+	if m.queryCounts == nil {
+		m.queryCounts = make(map[string]uint64)
+	}
+	m.queryCounts[endpoint]++
+	m.Unlock()
+}
+
+func (m *lookupdMetrics) evicted() {
+	m.Lock()
+	m.evictionCount++
+	m.Unlock()
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter writes metrics in the Prometheus text exposition format
+type promWriter struct {
+	bytes.Buffer
+}
+
+func (w *promWriter) header(name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w *promWriter) value(name string, labelName string, labelValue string, value uint64) {
+	if labelName == "" {
+		fmt.Fprintf(w, "%s %d\n", name, value)
+		return
+	}
+	fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, labelName, promLabelEscaper.Replace(labelValue), value)
+}
+
+func (w *promWriter) labelled(name string, labelName string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w.value(name, labelName, k, values[k])
+	}
+}
+
+// metricsHandler exposes registration churn, query counts and producers per
+// topic for Prometheus to scrape
+func (s *httpServer) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	l := s.context.nsqlookupd
+	var pw promWriter
+
+	registers, unregisters := l.DB.ChurnCounts()
+	pw.header("nsqlookupd_registrations_total", "counter",
+		"Producers added to a registration (REGISTER), by category.")
+	pw.labelled("nsqlookupd_registrations_total", "category", registers)
+	pw.header("nsqlookupd_unregistrations_total", "counter",
+		"Producers removed from a registration (UNREGISTER, disconnect or eviction), by category.")
+	pw.labelled("nsqlookupd_unregistrations_total", "category", unregisters)
+
+	l.metrics.Lock()
+	queries := make(map[string]uint64, len(l.metrics.queryCounts))
+	for endpoint, count := range l.metrics.queryCounts {
+		queries[endpoint] = count
+	}
+	evictions := l.metrics.evictionCount
+	l.metrics.Unlock()
+
+	pw.header("nsqlookupd_evictions_total", "counter",
+		"Producers evicted after missing --evict-producer-heartbeats heartbeats.")
+	pw.value("nsqlookupd_evictions_total", "", "", evictions)
+	pw.header("nsqlookupd_queries_total", "counter", "Discovery queries served, by HTTP endpoint.")
+	pw.labelled("nsqlookupd_queries_total", "endpoint", queries)
+
+	topics := l.DB.FindRegistrations("topic", "*", "").Keys()
+	pw.header("nsqlookupd_topics", "gauge", "Topics registered.")
+	pw.value("nsqlookupd_topics", "", "", uint64(len(topics)))
+	pw.header("nsqlookupd_channels", "gauge", "Channels registered.")
+	pw.value("nsqlookupd_channels", "", "", uint64(len(l.DB.FindRegistrations("channel", "*", "*"))))
+	pw.header("nsqlookupd_producers", "gauge", "nsqd connected and identified.")
+	pw.value("nsqlookupd_producers", "", "", uint64(len(l.DB.FindProducers("client", "", ""))))
+
+	topicProducers := make(map[string]uint64, len(topics))
+	for _, topic := range topics {
+		topicProducers[topic] = uint64(len(l.DB.FindProducers("topic", topic, "")))
+	}
+	pw.header("nsqlookupd_topic_producers", "gauge", "nsqd registered as producers of each topic.")
+	pw.labelled("nsqlookupd_topic_producers", "topic", topicProducers)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(pw.Bytes())
+}
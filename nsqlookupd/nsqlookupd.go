@@ -1,68 +1,213 @@
 package nsqlookupd
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/bitly/nsq/util"
 )
 
 type NSQLookupd struct {
-	options      *nsqlookupdOptions
-	tcpAddr      *net.TCPAddr
-	httpAddr     *net.TCPAddr
-	tcpListener  net.Listener
-	httpListener net.Listener
-	waitGroup    util.WaitGroupWrapper
-	DB           *RegistrationDB
+	options *nsqlookupdOptions
+	// tcpAddr and httpAddr are the addresses of the first TCP and HTTP
+	// listeners, their ports are what gets reported to peers
+	tcpAddr       *net.TCPAddr
+	httpAddr      *net.TCPAddr
+	tcpAddrs      []*net.TCPAddr
+	httpAddrs     []*net.TCPAddr
+	tcpListeners  []net.Listener
+	httpListeners []net.Listener
+	// dnsAddr is the address of the DNS listeners (UDP and TCP on the same
+	// port), nil when --dns-address isn't set
+	dnsAddr        *net.UDPAddr
+	dnsConn        *net.UDPConn
+	dnsTCPListener net.Listener
+	waitGroup      util.WaitGroupWrapper
+	exitChan       chan int
+	DB             *RegistrationDB
+	TopicConfigs   *TopicConfigDB
+	metrics        lookupdMetrics
+
+	// nsqd's --worker-id-lease leases (see worker_id_lease.go)
+	workerIDLeases *workerIDLeases
+
+	// producers registered over HTTP (see http_registration.go)
+	httpProducers *httpProducers
 }
 
 func NewNSQLookupd(options *nsqlookupdOptions) *NSQLookupd {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", options.TCPAddress)
+	tcpAddrs, err := resolveTCPAddrs(options.TCPAddresses)
+	if err != nil {
+		log.Fatalf("FATAL: --tcp-address %s", err.Error())
+	}
+
+	httpAddrs, err := resolveTCPAddrs(options.HTTPAddresses)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("FATAL: --http-address %s", err.Error())
+	}
+
+	var dnsAddr *net.UDPAddr
+	if options.DNSAddress != "" {
+		dnsAddr, err = net.ResolveUDPAddr("udp", options.DNSAddress)
+		if err != nil {
+			log.Fatalf("FATAL: --dns-address invalid address (%s) - %s", options.DNSAddress, err.Error())
+		}
+		options.DNSDomain = strings.ToLower(strings.Trim(options.DNSDomain, ".")) + "."
+		if options.DNSDomain == "." {
+			log.Fatalf("FATAL: --dns-domain is required with --dns-address")
+		}
+	}
+
+	if options.HTTPDebug && options.HTTPDebugAuthToken == "" {
+		log.Fatalf("FATAL: --http-debug requires --http-debug-auth-token")
+	}
+
+	if options.WorkerIDLeaseTTL <= 0 {
+		log.Fatalf("FATAL: --worker-id-lease-ttl must be > 0")
+	}
+
+	if options.HTTPProducerTimeout <= 0 {
+		log.Fatalf("FATAL: --http-producer-timeout must be > 0")
 	}
 
-	httpAddr, err := net.ResolveTCPAddr("tcp", options.HTTPAddress)
+	topicConfigs, err := NewTopicConfigDB(options.TopicConfigFile)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("FATAL: failed to load --topic-config-file %s - %s", options.TopicConfigFile, err.Error())
 	}
 
 	return &NSQLookupd{
-		options:  options,
-		tcpAddr:  tcpAddr,
-		httpAddr: httpAddr,
-		DB:       NewRegistrationDB(),
+		options:      options,
+		tcpAddr:      tcpAddrs[0],
+		httpAddr:     httpAddrs[0],
+		tcpAddrs:     tcpAddrs,
+		httpAddrs:    httpAddrs,
+		dnsAddr:      dnsAddr,
+		exitChan:     make(chan int),
+		DB:           NewRegistrationDB(),
+		TopicConfigs: topicConfigs,
+
+		workerIDLeases: newWorkerIDLeases(),
+		httpProducers:  newHTTPProducers(),
+	}
+}
+
+// resolveTCPAddrs resolves a list of <addr>:<port> strings (IPv4 or IPv6)
+// and requires that at least one is given
+func resolveTCPAddrs(addrs []string) ([]*net.TCPAddr, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("at least one address is required")
+	}
+	tcpAddrs := make([]*net.TCPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address (%s) - %s", addr, err.Error())
+		}
+		tcpAddrs = append(tcpAddrs, tcpAddr)
 	}
+	return tcpAddrs, nil
 }
 
 func (l *NSQLookupd) Main() {
 	context := &Context{l}
 
-	tcpListener, err := net.Listen("tcp", l.tcpAddr.String())
-	if err != nil {
-		log.Fatalf("FATAL: listen (%s) failed - %s", l.tcpAddr, err.Error())
-	}
-	l.tcpListener = tcpListener
 	tcpServer := &tcpServer{context: context}
-	l.waitGroup.Wrap(func() { util.TCPServer(tcpListener, tcpServer) })
+	for i, addr := range l.tcpAddrs {
+		tcpListener, err := net.Listen("tcp", addr.String())
+		if err != nil {
+			log.Fatalf("FATAL: listen (%s) failed - %s", addr, err.Error())
+		}
+		if i == 0 {
+			l.tcpAddr = tcpListener.Addr().(*net.TCPAddr)
+		}
+		l.tcpListeners = append(l.tcpListeners, tcpListener)
+		l.waitGroup.Wrap(func() { util.TCPServer(tcpListener, tcpServer) })
+	}
 
-	httpListener, err := net.Listen("tcp", l.httpAddr.String())
-	if err != nil {
-		log.Fatalf("FATAL: listen (%s) failed - %s", l.httpAddr, err.Error())
+	// the legacy endpoints are also served as the v1 API (see util.V1Handler)
+	httpServer := util.V1Handler(&httpServer{context: context})
+	for i, addr := range l.httpAddrs {
+		httpListener, err := net.Listen("tcp", addr.String())
+		if err != nil {
+			log.Fatalf("FATAL: listen (%s) failed - %s", addr, err.Error())
+		}
+		if i == 0 {
+			l.httpAddr = httpListener.Addr().(*net.TCPAddr)
+		}
+		l.httpListeners = append(l.httpListeners, httpListener)
+		l.waitGroup.Wrap(func() { util.HTTPServer(httpListener, httpServer) })
+	}
+
+	if l.dnsAddr != nil {
+		dnsConn, err := net.ListenUDP("udp", l.dnsAddr)
+		if err != nil {
+			log.Fatalf("FATAL: listen (%s) failed - %s", l.dnsAddr, err.Error())
+		}
+		// TCP on the same port, for the responses too large for UDP
+		l.dnsAddr = dnsConn.LocalAddr().(*net.UDPAddr)
+		dnsTCPListener, err := net.Listen("tcp", l.dnsAddr.String())
+		if err != nil {
+			log.Fatalf("FATAL: listen (%s) failed - %s", l.dnsAddr, err.Error())
+		}
+		l.dnsConn = dnsConn
+		l.dnsTCPListener = dnsTCPListener
+		l.waitGroup.Wrap(func() { l.dnsUDPLoop(dnsConn) })
+		l.waitGroup.Wrap(func() { util.TCPServer(dnsTCPListener, &dnsTCPServer{context: context}) })
+	}
+
+	if l.options.EvictProducerHeartbeats > 0 {
+		l.waitGroup.Wrap(func() { l.evictionLoop() })
 	}
-	l.httpListener = httpListener
-	httpServer := &httpServer{context: context}
-	l.waitGroup.Wrap(func() { util.HTTPServer(httpListener, httpServer) })
+
+	l.waitGroup.Wrap(func() { l.httpProducerLoop() })
+}
+
+// RealTCPAddr returns the address the (first) TCP listener is bound to
+func (l *NSQLookupd) RealTCPAddr() *net.TCPAddr {
+	return l.tcpAddr
+}
+
+// RealHTTPAddr returns the address the (first) HTTP listener is bound to
+func (l *NSQLookupd) RealHTTPAddr() *net.TCPAddr {
+	return l.httpAddr
+}
+
+// RealDNSAddr returns the address the DNS listeners are bound to (nil when
+// --dns-address isn't set)
+func (l *NSQLookupd) RealDNSAddr() *net.UDPAddr {
+	return l.dnsAddr
 }
 
 func (l *NSQLookupd) Exit() {
-	if l.tcpListener != nil {
-		l.tcpListener.Close()
+	close(l.exitChan)
+
+	for _, tcpListener := range l.tcpListeners {
+		tcpListener.Close()
 	}
 
-	if l.httpListener != nil {
-		l.httpListener.Close()
+	for _, httpListener := range l.httpListeners {
+		httpListener.Close()
+	}
+
+	if l.dnsConn != nil {
+		l.dnsConn.Close()
+		l.dnsTCPListener.Close()
 	}
 	l.waitGroup.Wait()
 }
+
+// workerIDCollisions returns the addresses of the active producers whose
+// message IDs can collide with peerInfo's (see PeerInfo.WorkerIDCollides)
+func (l *NSQLookupd) workerIDCollisions(peerInfo *PeerInfo) []string {
+	producers := l.DB.FindProducers("client", "", "").FilterByActive(
+		l.options.InactiveProducerTimeout, 0).FilterByWorkerIDCollision(peerInfo)
+	addresses := make([]string, len(producers))
+	for i, p := range producers {
+		addresses[i] = net.JoinHostPort(p.peerInfo.BroadcastAddress, strconv.Itoa(p.peerInfo.TcpPort))
+	}
+	return addresses
+}
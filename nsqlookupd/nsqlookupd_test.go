@@ -1,9 +1,11 @@
 package nsqlookupd
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	"github.com/bitly/go-nsq"
+	"github.com/bitly/go-simplejson"
 	"github.com/bitly/nsq/util"
 	lookuputil "github.com/bitly/nsq/util/lookupd"
 	"github.com/bmizerany/assert"
@@ -11,21 +13,24 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
 
 func mustStartLookupd(options *nsqlookupdOptions) (*net.TCPAddr, *net.TCPAddr, *NSQLookupd) {
-	tcpAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	httpAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	options.TCPAddresses = []string{"127.0.0.1:0"}
+	options.HTTPAddresses = []string{"127.0.0.1:0"}
 
 	nsqlookupd := NewNSQLookupd(options)
-	nsqlookupd.tcpAddr = tcpAddr
-	nsqlookupd.httpAddr = httpAddr
 	nsqlookupd.Main()
 
-	return nsqlookupd.tcpListener.Addr().(*net.TCPAddr), nsqlookupd.httpListener.Addr().(*net.TCPAddr), nsqlookupd
+	return nsqlookupd.tcpAddr, nsqlookupd.httpAddr, nsqlookupd
 }
 
 func mustConnectLookupd(t *testing.T, tcpAddr *net.TCPAddr) net.Conn {
@@ -352,3 +357,543 @@ func TestTombstonedNodes(t *testing.T) {
 	assert.Equal(t, producers[0].Topics[0].Topic, topicName)
 	assert.Equal(t, producers[0].Topics[0].Tombstoned, true)
 }
+
+func TestBroadcastAddresses(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(NewNSQLookupdOptions())
+	defer nsqlookupd.Exit()
+
+	topicName := "broadcast_addresses"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	ci := make(map[string]interface{})
+	ci["tcp_port"] = 5000
+	ci["http_port"] = 5555
+	ci["broadcast_address"] = "10.0.0.1"
+	ci["broadcast_addresses"] = []string{"10.0.0.1", "fe80::1"}
+	ci["hostname"] = "ip.address"
+	ci["version"] = "fake-version"
+	cmd, _ := nsq.Identify(ci)
+	err := cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	_, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+
+	nsq.Register(topicName, "").Write(conn)
+	v, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, v, []byte("OK"))
+
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	data, err := util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	addrs, err := data.Get("producers").GetIndex(0).Get("broadcast_addresses").Array()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, addrs, []interface{}{"10.0.0.1", "fe80::1"})
+
+	// tombstoning by the IPv6 address matches the same producer
+	endpoint = fmt.Sprintf("http://%s/tombstone_topic_producer?topic=%s&node=%s",
+		httpAddr, topicName, url.QueryEscape("[fe80::1]:5555"))
+	_, err = util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+
+	producers := nsqlookupd.DB.FindProducers("topic", topicName, "")
+	assert.Equal(t, len(producers), 1)
+	assert.Equal(t, producers[0].tombstoned, true)
+}
+
+func TestStaleProducerEviction(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQLookupdOptions()
+	options.ProducerHeartbeatInterval = 50 * time.Millisecond
+	options.StaleProducerHeartbeats = 2
+	options.EvictProducerHeartbeats = 4
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(options)
+	defer nsqlookupd.Exit()
+
+	topicName := "stale_producers"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	identify(t, conn, "ip.address", 5000, 5555, "fake-version")
+
+	nsq.Register(topicName, "").Write(conn)
+	_, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+
+	countProducers := func(endpoint string) int {
+		data, err := util.ApiRequest(endpoint)
+		assert.Equal(t, err, nil)
+		producers, err := data.Get("producers").Array()
+		assert.Equal(t, err, nil)
+		return len(producers)
+	}
+
+	lookupEndpoint := fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	assert.Equal(t, countProducers(lookupEndpoint), 1)
+	assert.Equal(t, countProducers(fmt.Sprintf("http://%s/producers?status=healthy", httpAddr)), 1)
+
+	time.Sleep(110 * time.Millisecond)
+
+	// stale producers are no longer handed out
+	assert.Equal(t, countProducers(lookupEndpoint), 0)
+	assert.Equal(t, countProducers(fmt.Sprintf("http://%s/producers?status=stale", httpAddr)), 1)
+
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Equal(t, countProducers(fmt.Sprintf("http://%s/producers", httpAddr)), 0)
+	assert.Equal(t, len(nsqlookupd.DB.FindProducers("topic", topicName, "")), 0)
+
+	// an evicted producer is disconnected the next time it's heard from
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	nsq.Ping().Write(conn)
+	v, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.HasPrefix(string(v), "E_EVICTED"), true)
+	_, err = nsq.ReadResponse(conn)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestLookupHasMessages(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(NewNSQLookupdOptions())
+	defer nsqlookupd.Exit()
+
+	topicName := "has_messages"
+
+	// one producer reports messages, one reports none and one never reports
+	conns := make([]net.Conn, 3)
+	for i := range conns {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		identify(t, conn, fmt.Sprintf("ip.address.%d", i), 5000+i, 5555+i, "fake-version")
+		nsq.Register(topicName, "").Write(conn)
+		_, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		conns[i] = conn
+	}
+
+	for i, depth := range []int64{10, 0} {
+		body := fmt.Sprintf(`{"%s": %d, "other": 5}`, topicName, depth)
+		cmd := &nsq.Command{Name: []byte("DEPTH"), Body: []byte(body)}
+		err := cmd.Write(conns[i])
+		assert.Equal(t, err, nil)
+		v, err := nsq.ReadResponse(conns[i])
+		assert.Equal(t, err, nil)
+		assert.Equal(t, v, []byte("OK"))
+	}
+
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	data, err := util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(data.Get("producers").MustArray()), 3)
+
+	data, err = util.ApiRequest(endpoint + "&has_messages=true")
+	assert.Equal(t, err, nil)
+	producers := data.Get("producers")
+	assert.Equal(t, len(producers.MustArray()), 2)
+	addrs := []string{
+		producers.GetIndex(0).Get("broadcast_address").MustString(),
+		producers.GetIndex(1).Get("broadcast_address").MustString(),
+	}
+	sort.Strings(addrs)
+	assert.Equal(t, addrs, []string{"ip.address.0", "ip.address.2"})
+}
+
+func TestTopicConfig(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tmpDir, err := ioutil.TempDir("", "nsqlookupd-test-")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(tmpDir)
+
+	options := NewNSQLookupdOptions()
+	options.TopicConfigFile = path.Join(tmpDir, "topic_config.json")
+	_, httpAddr, nsqlookupd := mustStartLookupd(options)
+	defer nsqlookupd.Exit()
+
+	endpoint := fmt.Sprintf("http://%s/topic_config?topic=configured", httpAddr)
+	data, err := util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data.Get("config").Interface(), nil)
+
+	_, err = util.ApiRequest(fmt.Sprintf("http://%s/set_topic_config?topic=configured&max_depth=-1", httpAddr))
+	assert.NotEqual(t, err, nil)
+	_, err = util.ApiRequest(fmt.Sprintf("http://%s/set_topic_config?topic=configured&retention_period=bogus", httpAddr))
+	assert.NotEqual(t, err, nil)
+
+	_, err = util.ApiRequest(fmt.Sprintf("http://%s/set_topic_config?topic=configured"+
+		"&retention_period=24h&max_depth=1000&ephemeral_channels=true", httpAddr))
+	assert.Equal(t, err, nil)
+
+	data, err = util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data.Get("config").Get("retention_period").MustString(), "24h")
+	assert.Equal(t, data.Get("config").Get("max_depth").MustInt64(), int64(1000))
+	assert.Equal(t, data.Get("config").Get("ephemeral_channels").MustBool(), true)
+
+	data, err = util.ApiRequest(fmt.Sprintf("http://%s/topic_configs", httpAddr))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(data.Get("configs").MustMap()), 1)
+
+	// the configuration survives a restart
+	db, err := NewTopicConfigDB(options.TopicConfigFile)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, db.Get("configured"), &TopicConfig{
+		RetentionPeriod:   "24h",
+		MaxDepth:          1000,
+		EphemeralChannels: true,
+	})
+
+	// as nsqd fetches it
+	cfg, err := lookuputil.GetLookupdTopicConfig("configured", []string{httpAddr.String()})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cfg, &lookuputil.TopicConfig{
+		RetentionPeriod:   "24h",
+		MaxDepth:          1000,
+		EphemeralChannels: true,
+	})
+
+	_, err = util.ApiRequest(fmt.Sprintf("http://%s/delete_topic_config?topic=configured", httpAddr))
+	assert.Equal(t, err, nil)
+	_, err = util.ApiRequest(fmt.Sprintf("http://%s/delete_topic_config?topic=configured", httpAddr))
+	assert.NotEqual(t, err, nil)
+
+	data, err = util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data.Get("config").Interface(), nil)
+
+	cfg, err = lookuputil.GetLookupdTopicConfig("configured", []string{httpAddr.String()})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cfg, (*lookuputil.TopicConfig)(nil))
+}
+
+func TestMetrics(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(NewNSQLookupdOptions())
+	defer nsqlookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	identify(t, conn, "ip.address", 5000, 5555, "fake-version")
+	nsq.Register("metrics", "ch").Write(conn)
+	_, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	nsq.UnRegister("metrics", "ch").Write(conn)
+	_, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+
+	for i := 0; i < 2; i++ {
+		_, err = util.ApiRequest(fmt.Sprintf("http://%s/lookup?topic=metrics", httpAddr))
+		assert.Equal(t, err, nil)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", httpAddr))
+	assert.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	for _, line := range []string{
+		`nsqlookupd_registrations_total{category="client"} 1`,
+		`nsqlookupd_registrations_total{category="channel"} 1`,
+		`nsqlookupd_registrations_total{category="topic"} 1`,
+		`nsqlookupd_unregistrations_total{category="channel"} 1`,
+		`nsqlookupd_queries_total{endpoint="lookup"} 2`,
+		`nsqlookupd_topics 1`,
+		`nsqlookupd_producers 1`,
+		`nsqlookupd_topic_producers{topic="metrics"} 1`,
+	} {
+		assert.Equal(t, strings.Contains(string(body), line+"\n"), true)
+	}
+	conn.Close()
+}
+
+func TestProducerLabels(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(NewNSQLookupdOptions())
+	defer nsqlookupd.Exit()
+
+	topicName := "producer_labels"
+
+	for i, region := range []string{"us-east", "us-west"} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		ci := make(map[string]interface{})
+		ci["tcp_port"] = 5000 + i
+		ci["http_port"] = 5555 + i
+		ci["broadcast_address"] = "ip.address"
+		ci["hostname"] = "ip.address"
+		ci["version"] = "fake-version"
+		ci["labels"] = map[string]string{"region": region, "tier": "standard"}
+		cmd, _ := nsq.Identify(ci)
+		err := cmd.Write(conn)
+		assert.Equal(t, err, nil)
+		_, err = nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+
+		nsq.Register(topicName, "").Write(conn)
+		v, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, v, []byte("OK"))
+	}
+
+	lookup := func(query string) []interface{} {
+		endpoint := fmt.Sprintf("http://%s/lookup?topic=%s&%s", httpAddr, topicName, query)
+		data, err := util.ApiRequest(endpoint)
+		assert.Equal(t, err, nil)
+		producers, err := data.Get("producers").Array()
+		assert.Equal(t, err, nil)
+		return producers
+	}
+
+	assert.Equal(t, len(lookup("label=tier=standard")), 2)
+	assert.Equal(t, len(lookup("label=region=us-west")), 1)
+	assert.Equal(t, len(lookup("label=region=us-west&label=tier=premium")), 0)
+
+	// preferred producers, but not only those
+	producers := lookup("prefer_label=region=us-east")
+	assert.Equal(t, len(producers), 1)
+	labels := producers[0].(map[string]interface{})["labels"].(map[string]interface{})
+	assert.Equal(t, labels["region"], "us-east")
+	assert.Equal(t, len(lookup("prefer_label=region=eu-west")), 2)
+
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s&label=region", httpAddr, topicName)
+	_, err := util.ApiRequest(endpoint)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestLookupReplicas(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(NewNSQLookupdOptions())
+	defer nsqlookupd.Exit()
+
+	topicName := "replicas"
+
+	// the topic is a replica on one of the producers
+	conns := make([]net.Conn, 2)
+	for i := range conns {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		identify(t, conn, fmt.Sprintf("ip.address.%d", i), 5000+i, 5555+i, "fake-version")
+		nsq.Register(topicName, "").Write(conn)
+		_, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		conns[i] = conn
+	}
+
+	body := fmt.Sprintf(`{"%s": "us-east"}`, topicName)
+	cmd := &nsq.Command{Name: []byte("REPLICAS"), Body: []byte(body)}
+	err := cmd.Write(conns[0])
+	assert.Equal(t, err, nil)
+	v, err := nsq.ReadResponse(conns[0])
+	assert.Equal(t, err, nil)
+	assert.Equal(t, v, []byte("OK"))
+
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	data, err := util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	producers := data.Get("producers")
+	assert.Equal(t, len(producers.MustArray()), 2)
+	for i := range producers.MustArray() {
+		producer := producers.GetIndex(i)
+		replica := producer.Get("broadcast_address").MustString() == "ip.address.0"
+		assert.Equal(t, producer.Get("read_only").MustBool(), replica)
+		if replica {
+			assert.Equal(t, producer.Get("replica_of").MustString(), "us-east")
+		}
+	}
+
+	data, err = util.ApiRequest(endpoint + "&writable=true")
+	assert.Equal(t, err, nil)
+	producers = data.Get("producers")
+	assert.Equal(t, len(producers.MustArray()), 1)
+	assert.Equal(t, producers.GetIndex(0).Get("broadcast_address").MustString(), "ip.address.1")
+}
+
+func TestLookupShards(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(NewNSQLookupdOptions())
+	defer nsqlookupd.Exit()
+
+	topicName := "orders"
+
+	// one of the producers is being resharded
+	for i, shards := range []int{2, 4} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		identify(t, conn, fmt.Sprintf("ip.address.%d", i), 5000+i, 5555+i, "fake-version")
+		body := fmt.Sprintf(`{"%s": %d}`, topicName, shards)
+		cmd := &nsq.Command{Name: []byte("SHARDS"), Body: []byte(body)}
+		err := cmd.Write(conn)
+		assert.Equal(t, err, nil)
+		v, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, v, []byte("OK"))
+	}
+
+	// the sharded topic isn't registered, but it's listed with its shards
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	data, err := util.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(data.Get("producers").MustArray()), 2)
+	assert.Equal(t, data.Get("shards").Get("count").MustInt(), 4)
+	shardTopics, _ := data.Get("shards").Get("topics").StringArray()
+	assert.Equal(t, shardTopics, []string{"orders.0", "orders.1", "orders.2", "orders.3"})
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=unsharded", httpAddr)
+	_, err = util.ApiRequest(endpoint)
+	assert.NotEqual(t, err, nil)
+}
+
+// dnsQuery sends a DNS query for name over UDP and returns the rcode and the
+// answers (as <type> <data> strings)
+func dnsQuery(t *testing.T, addr *net.UDPAddr, name string, qtype uint16) (uint16, []string) {
+	conn, err := net.Dial("udp", addr.String())
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = appendDNSName(msg, name)
+	msg = appendUint16(msg, qtype)
+	msg = appendUint16(msg, dnsClassIN)
+	_, err = conn.Write(msg)
+	assert.Equal(t, err, nil)
+
+	buf := make([]byte, maxDNSUDPSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	assert.Equal(t, err, nil)
+	resp := buf[:n]
+	assert.Equal(t, resp[0:2], []byte{0x12, 0x34})
+
+	_, off, err := readDNSName(resp, dnsHeaderSize)
+	assert.Equal(t, err, nil)
+	off += 4
+	var answers []string
+	for i := 0; i < int(binary.BigEndian.Uint16(resp[6:])); i++ {
+		_, off, err = readDNSName(resp, off)
+		assert.Equal(t, err, nil)
+		rrtype := binary.BigEndian.Uint16(resp[off:])
+		rdata := resp[off+10 : off+10+int(binary.BigEndian.Uint16(resp[off+8:]))]
+		switch rrtype {
+		case dnsTypeA, dnsTypeAAAA:
+			answers = append(answers, fmt.Sprintf("%d %s", rrtype, net.IP(rdata)))
+		case dnsTypeSRV:
+			target, _, err := readDNSName(rdata, 6)
+			assert.Equal(t, err, nil)
+			answers = append(answers, fmt.Sprintf("%d %d %s", rrtype, binary.BigEndian.Uint16(rdata[4:]), target))
+		}
+		off += 10 + len(rdata)
+	}
+	sort.Strings(answers)
+	return binary.BigEndian.Uint16(resp[2:]) & 0xf, answers
+}
+
+func TestDNS(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewNSQLookupdOptions()
+	options.DNSAddress = "127.0.0.1:0"
+	tcpAddr, _, nsqlookupd := mustStartLookupd(options)
+	defer nsqlookupd.Exit()
+	dnsAddr := nsqlookupd.RealDNSAddr()
+
+	topicName := "dnsTopic"
+	for i, address := range []string{"10.0.0.1", "nsqd.example.com"} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		identify(t, conn, address, 4150+i, 4250+i, "fake-version")
+		nsq.Register(topicName, "").Write(conn)
+		_, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+	}
+
+	// topic names are matched regardless of case
+	rcode, answers := dnsQuery(t, dnsAddr, "_nsqd._tcp.dnstopic.nsq.", dnsTypeSRV)
+	assert.Equal(t, rcode, dnsRcodeSuccess)
+	assert.Equal(t, answers, []string{"33 4150 ip-10-0-0-1.nsq.", "33 4151 nsqd.example.com."})
+
+	rcode, answers = dnsQuery(t, dnsAddr, "_nsqd-http._tcp.dnsTopic.nsq.", dnsTypeSRV)
+	assert.Equal(t, rcode, dnsRcodeSuccess)
+	assert.Equal(t, answers, []string{"33 4250 ip-10-0-0-1.nsq.", "33 4251 nsqd.example.com."})
+
+	rcode, answers = dnsQuery(t, dnsAddr, "dnsTopic.nsq.", dnsTypeA)
+	assert.Equal(t, rcode, dnsRcodeSuccess)
+	assert.Equal(t, answers, []string{"1 10.0.0.1"})
+
+	rcode, answers = dnsQuery(t, dnsAddr, "ip-10-0-0-1.nsq.", dnsTypeA)
+	assert.Equal(t, rcode, dnsRcodeSuccess)
+	assert.Equal(t, answers, []string{"1 10.0.0.1"})
+
+	rcode, _ = dnsQuery(t, dnsAddr, "_nsqd._tcp.unknown.nsq.", dnsTypeSRV)
+	assert.Equal(t, rcode, dnsRcodeNXDomain)
+
+	rcode, _ = dnsQuery(t, dnsAddr, "example.com.", dnsTypeA)
+	assert.Equal(t, rcode, dnsRcodeRefused)
+}
+
+func TestWorkerIDCollision(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(NewNSQLookupdOptions())
+	defer nsqlookupd.Exit()
+
+	identifyWorker := func(tcpPort int, workerID int, idGenerator string) []interface{} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		ci := make(map[string]interface{})
+		ci["tcp_port"] = tcpPort
+		ci["http_port"] = tcpPort + 1
+		ci["broadcast_address"] = "ip.address"
+		ci["hostname"] = "ip.address"
+		ci["version"] = "fake-version"
+		ci["worker_id"] = workerID
+		ci["id_generator"] = idGenerator
+		cmd, _ := nsq.Identify(ci)
+		err := cmd.Write(conn)
+		assert.Equal(t, err, nil)
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		_, data, _ := nsq.UnpackResponse(resp)
+		js, err := simplejson.NewJson(data)
+		assert.Equal(t, err, nil)
+		return js.Get("worker_id_collisions").MustArray()
+	}
+
+	assert.Equal(t, len(identifyWorker(5000, 1, "snowflake")), 0)
+	assert.Equal(t, len(identifyWorker(5010, 2, "snowflake")), 0)
+	// the same worker id only matters for snowflake IDs
+	assert.Equal(t, len(identifyWorker(5020, 1, "ulid")), 0)
+	collisions := identifyWorker(5030, 1, "snowflake")
+	assert.Equal(t, collisions, []interface{}{"ip.address:5000"})
+
+	data, err := util.ApiRequest(fmt.Sprintf("http://%s/nodes", httpAddr))
+	assert.Equal(t, err, nil)
+	nodes, _ := data.Get("producers").Array()
+	assert.Equal(t, len(nodes), 4)
+	var colliding []string
+	for i := range nodes {
+		node := data.Get("producers").GetIndex(i)
+		if len(node.Get("worker_id_collisions").MustArray()) > 0 {
+			assert.Equal(t, node.Get("worker_id").MustInt(), 1)
+			assert.Equal(t, node.Get("id_generator").MustString(), "snowflake")
+			colliding = append(colliding, fmt.Sprintf("%d", node.Get("tcp_port").MustInt()))
+		}
+	}
+	sort.Strings(colliding)
+	assert.Equal(t, colliding, []string{"5000", "5030"})
+}
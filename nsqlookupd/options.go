@@ -9,12 +9,28 @@ import (
 type nsqlookupdOptions struct {
 	Verbose bool `flag:"verbose"`
 
-	TCPAddress       string `flag:"tcp-address"`
-	HTTPAddress      string `flag:"http-address"`
-	BroadcastAddress string `flag:"broadcast-address"`
+	TCPAddresses     []string `flag:"tcp-address" cfg:"tcp_addresses"`
+	HTTPAddresses    []string `flag:"http-address" cfg:"http_addresses"`
+	BroadcastAddress string   `flag:"broadcast-address"`
 
 	InactiveProducerTimeout time.Duration `flag:"inactive-producer-timeout"`
 	TombstoneLifetime       time.Duration `flag:"tombstone-lifetime"`
+
+	ProducerHeartbeatInterval time.Duration `flag:"producer-heartbeat-interval"`
+	StaleProducerHeartbeats   int           `flag:"stale-producer-heartbeats"`
+	EvictProducerHeartbeats   int           `flag:"evict-producer-heartbeats"`
+	HTTPProducerTimeout       time.Duration `flag:"http-producer-timeout"`
+
+	TopicConfigFile string `flag:"topic-config-file"`
+
+	WorkerIDLeaseTTL time.Duration `flag:"worker-id-lease-ttl"`
+
+	DNSAddress string        `flag:"dns-address"`
+	DNSDomain  string        `flag:"dns-domain"`
+	DNSTTL     time.Duration `flag:"dns-ttl"`
+
+	HTTPDebug          bool   `flag:"http-debug"`
+	HTTPDebugAuthToken string `flag:"http-debug-auth-token"`
 }
 
 func NewNSQLookupdOptions() *nsqlookupdOptions {
@@ -24,11 +40,21 @@ func NewNSQLookupdOptions() *nsqlookupdOptions {
 	}
 
 	return &nsqlookupdOptions{
-		TCPAddress:       "0.0.0.0:4160",
-		HTTPAddress:      "0.0.0.0:4161",
+		TCPAddresses:     []string{"0.0.0.0:4160"},
+		HTTPAddresses:    []string{"0.0.0.0:4161"},
 		BroadcastAddress: hostname,
 
 		InactiveProducerTimeout: 300 * time.Second,
 		TombstoneLifetime:       45 * time.Second,
+
+		ProducerHeartbeatInterval: 15 * time.Second,
+		StaleProducerHeartbeats:   3,
+		EvictProducerHeartbeats:   0,
+		HTTPProducerTimeout:       60 * time.Second,
+
+		WorkerIDLeaseTTL: 5 * time.Minute,
+
+		DNSDomain: "nsq.",
+		DNSTTL:    5 * time.Second,
 	}
 }
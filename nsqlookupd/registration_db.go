@@ -2,6 +2,8 @@ package nsqlookupd
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -9,6 +11,10 @@ import (
 type RegistrationDB struct {
 	sync.RWMutex
 	registrationMap map[Registration]Producers
+
+	// producers added to/removed from registrations, by category
+	registerCounts   map[string]uint64
+	unregisterCounts map[string]uint64
 }
 
 type Registration struct {
@@ -23,10 +29,160 @@ type PeerInfo struct {
 	RemoteAddress    string `json:"remote_address"`
 	Hostname         string `json:"hostname"`
 	BroadcastAddress string `json:"broadcast_address"`
-	TcpPort          int    `json:"tcp_port"`
-	HttpPort         int    `json:"http_port"`
-	Version          string `json:"version"`
-	lastUpdate       time.Time
+	// BroadcastAddresses optionally lists every address the producer can be
+	// reached at (ie. both an IPv4 and an IPv6 address)
+	BroadcastAddresses []string `json:"broadcast_addresses,omitempty"`
+	TcpPort            int      `json:"tcp_port"`
+	HttpPort           int      `json:"http_port"`
+	Version            string   `json:"version"`
+	lastUpdate         time.Time
+	evicted            int32
+
+	// Labels are the producer's <key>=<value> labels (ie. region, rack)
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// WorkerID and IDGenerator are the producer's --worker-id and
+	// --id-generator, the worker id is what keeps its snowflake message IDs
+	// from colliding with other producers'
+	WorkerID    int64  `json:"worker_id"`
+	IDGenerator string `json:"id_generator,omitempty"`
+
+	// topicDepths is the per topic depth last reported (with DEPTH) by the
+	// producer, nil if it has never reported
+	depthMutex  sync.RWMutex
+	topicDepths map[string]int64
+
+	// replicaTopics are the producer's topics that are replicas, and the
+	// cluster each is replicated from, as last reported (with REPLICAS)
+	replicaMutex  sync.RWMutex
+	replicaTopics map[string]string
+
+	// shardedTopics are the producer's sharded topics and the number of
+	// shards of each, as last reported (with SHARDS)
+	shardMutex    sync.RWMutex
+	shardedTopics map[string]int
+
+	// topicAnnotations are the annotations (owner, description etc.) of the
+	// producer's topics and their channels, as last reported (with ANNOTATIONS)
+	annotationMutex  sync.RWMutex
+	topicAnnotations map[string]*TopicAnnotations
+}
+
+// TopicAnnotations are a topic's annotations and those of its channels
+type TopicAnnotations struct {
+	Annotations map[string]string            `json:"annotations,omitempty"`
+	Channels    map[string]map[string]string `json:"channels,omitempty"`
+}
+
+// HasLabels returns whether the producer has all of labels
+func (p *PeerInfo) HasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if p.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// WorkerIDCollides returns whether other is another producer whose message IDs
+// can collide with p's (both generate snowflake IDs with the same worker id)
+func (p *PeerInfo) WorkerIDCollides(other *PeerInfo) bool {
+	return p != other && p.IDGenerator == "snowflake" && other.IDGenerator == "snowflake" &&
+		p.WorkerID == other.WorkerID
+}
+
+func (p *PeerInfo) SetTopicDepths(depths map[string]int64) {
+	p.depthMutex.Lock()
+	p.topicDepths = depths
+	p.depthMutex.Unlock()
+}
+
+// HasMessages returns whether the producer last reported a non-zero depth for
+// topic... producers that don't report depths are assumed to have messages
+func (p *PeerInfo) HasMessages(topic string) bool {
+	p.depthMutex.RLock()
+	defer p.depthMutex.RUnlock()
+	if p.topicDepths == nil {
+		return true
+	}
+	return p.topicDepths[topic] > 0
+}
+
+func (p *PeerInfo) SetReplicaTopics(replicas map[string]string) {
+	p.replicaMutex.Lock()
+	p.replicaTopics = replicas
+	p.replicaMutex.Unlock()
+}
+
+// ReplicaOf returns the cluster the producer's topic is replicated from, ""
+// when it isn't a replica (which the producer only accepts replicated
+// publishes to)
+func (p *PeerInfo) ReplicaOf(topic string) string {
+	p.replicaMutex.RLock()
+	defer p.replicaMutex.RUnlock()
+	return p.replicaTopics[topic]
+}
+
+func (p *PeerInfo) SetShardedTopics(shards map[string]int) {
+	p.shardMutex.Lock()
+	p.shardedTopics = shards
+	p.shardMutex.Unlock()
+}
+
+// Shards returns the number of shards of the producer's topic, 0 when it
+// isn't sharded
+func (p *PeerInfo) Shards(topic string) int {
+	p.shardMutex.RLock()
+	defer p.shardMutex.RUnlock()
+	return p.shardedTopics[topic]
+}
+
+func (p *PeerInfo) SetTopicAnnotations(annotations map[string]*TopicAnnotations) {
+	p.annotationMutex.Lock()
+	p.topicAnnotations = annotations
+	p.annotationMutex.Unlock()
+}
+
+// TopicAnnotations returns the annotations of the producer's topic and its
+// channels, nil if there aren't any
+func (p *PeerInfo) TopicAnnotations(topic string) *TopicAnnotations {
+	p.annotationMutex.RLock()
+	defer p.annotationMutex.RUnlock()
+	return p.topicAnnotations[topic]
+}
+
+// HTTPAddresses returns the <addr>:<port> of every broadcast address
+func (p *PeerInfo) HTTPAddresses() []string {
+	addrs := []string{net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.HttpPort))}
+	for _, a := range p.BroadcastAddresses {
+		if a == p.BroadcastAddress {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(a, strconv.Itoa(p.HttpPort)))
+	}
+	return addrs
+}
+
+// MissedHeartbeats returns how many consecutive heartbeats (PINGs) the
+// producer has failed to send, given that it should send one every interval
+func (p *PeerInfo) MissedHeartbeats(interval time.Duration) int {
+	if interval <= 0 {
+		return 0
+	}
+	return int(time.Now().Sub(p.lastUpdate) / interval)
+}
+
+// Health scores the producer as "healthy", "degraded" (it has missed at
+// least one heartbeat) or "stale" (it has missed staleHeartbeats or more)
+func (p *PeerInfo) Health(interval time.Duration, staleHeartbeats int) string {
+	missed := p.MissedHeartbeats(interval)
+	switch {
+	case staleHeartbeats > 0 && missed >= staleHeartbeats:
+		return "stale"
+	case missed > 0:
+		return "degraded"
+	}
+	return "healthy"
 }
 
 type Producer struct {
@@ -52,7 +208,9 @@ func (p *Producer) IsTombstoned(lifetime time.Duration) bool {
 
 func NewRegistrationDB() *RegistrationDB {
 	return &RegistrationDB{
-		registrationMap: make(map[Registration]Producers),
+		registrationMap:  make(map[Registration]Producers),
+		registerCounts:   make(map[string]uint64),
+		unregisterCounts: make(map[string]uint64),
 	}
 }
 
@@ -79,6 +237,7 @@ func (r *RegistrationDB) AddProducer(k Registration, p *Producer) bool {
 	}
 	if found == false {
 		r.registrationMap[k] = append(producers, p)
+		r.registerCounts[k.Category]++
 	}
 	return !found
 }
@@ -102,9 +261,28 @@ func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
 	}
 	// Note: this leaves keys in the DB even if they have empty lists
 	r.registrationMap[k] = cleaned
+	if removed {
+		r.unregisterCounts[k.Category]++
+	}
 	return removed, len(cleaned)
 }
 
+// ChurnCounts returns (copies of) how many times producers have been added to
+// and removed from registrations, by category
+func (r *RegistrationDB) ChurnCounts() (map[string]uint64, map[string]uint64) {
+	r.RLock()
+	defer r.RUnlock()
+	registers := make(map[string]uint64, len(r.registerCounts))
+	for category, count := range r.registerCounts {
+		registers[category] = count
+	}
+	unregisters := make(map[string]uint64, len(r.unregisterCounts))
+	for category, count := range r.unregisterCounts {
+		unregisters[category] = count
+	}
+	return registers, unregisters
+}
+
 // remove a Registration and all it's producers
 func (r *RegistrationDB) RemoveRegistration(k Registration) {
 	r.Lock()
@@ -214,6 +392,99 @@ func (pp Producers) FilterByActive(inactivityTimeout time.Duration, tombstoneLif
 	return results
 }
 
+func (pp Producers) FilterByHealth(interval time.Duration, staleHeartbeats int) Producers {
+	results := make(Producers, 0)
+	for _, p := range pp {
+		if p.peerInfo.Health(interval, staleHeartbeats) == "stale" {
+			continue
+		}
+		results = append(results, p)
+	}
+	return results
+}
+
+func (pp Producers) FilterByMessages(topic string) Producers {
+	results := make(Producers, 0)
+	for _, p := range pp {
+		if !p.peerInfo.HasMessages(topic) {
+			continue
+		}
+		results = append(results, p)
+	}
+	return results
+}
+
+// FilterByLabels returns the producers with all of labels
+func (pp Producers) FilterByLabels(labels map[string]string) Producers {
+	results := make(Producers, 0)
+	for _, p := range pp {
+		if !p.peerInfo.HasLabels(labels) {
+			continue
+		}
+		results = append(results, p)
+	}
+	return results
+}
+
+// FilterByWritable returns the producers that accept publishes to topic (ie.
+// whose topic isn't a replica)
+func (pp Producers) FilterByWritable(topic string) Producers {
+	results := make(Producers, 0)
+	for _, p := range pp {
+		if p.peerInfo.ReplicaOf(topic) != "" {
+			continue
+		}
+		results = append(results, p)
+	}
+	return results
+}
+
+// FilterBySharded returns the producers that have topic as a sharded topic
+func (pp Producers) FilterBySharded(topic string) Producers {
+	results := make(Producers, 0)
+	for _, p := range pp {
+		if p.peerInfo.Shards(topic) == 0 {
+			continue
+		}
+		results = append(results, p)
+	}
+	return results
+}
+
+// FilterByWorkerIDCollision returns the producers whose message IDs can collide
+// with peerInfo's
+func (pp Producers) FilterByWorkerIDCollision(peerInfo *PeerInfo) Producers {
+	results := make(Producers, 0)
+	for _, p := range pp {
+		if !p.peerInfo.WorkerIDCollides(peerInfo) {
+			continue
+		}
+		results = append(results, p)
+	}
+	return results
+}
+
+// TopicPeerInfo is a producer's PeerInfo along with the state of one of its
+// topics
+type TopicPeerInfo struct {
+	*PeerInfo
+	ReadOnly  bool   `json:"read_only"`
+	ReplicaOf string `json:"replica_of,omitempty"`
+}
+
+func (pp Producers) TopicPeerInfo(topic string) []*TopicPeerInfo {
+	results := make([]*TopicPeerInfo, 0)
+	for _, p := range pp {
+		replicaOf := p.peerInfo.ReplicaOf(topic)
+		results = append(results, &TopicPeerInfo{
+			PeerInfo:  p.peerInfo,
+			ReadOnly:  replicaOf != "",
+			ReplicaOf: replicaOf,
+		})
+	}
+	return results
+}
+
 func (pp Producers) PeerInfo() []*PeerInfo {
 	results := make([]*PeerInfo, 0)
 	for _, p := range pp {
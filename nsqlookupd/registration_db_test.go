@@ -16,9 +16,12 @@ func TestRegistrationDB(t *testing.T) {
 
 	sec30 := 30 * time.Second
 	beginningOfTime := time.Unix(1348797047, 0)
-	pi1 := &PeerInfo{"1", "remote_addr:1", "host", "b_addr", 1, 2, "v1", beginningOfTime}
-	pi2 := &PeerInfo{"2", "remote_addr:2", "host", "b_addr", 2, 3, "v1", beginningOfTime}
-	pi3 := &PeerInfo{"3", "remote_addr:3", "host", "b_addr", 3, 4, "v1", beginningOfTime}
+	pi1 := &PeerInfo{id: "1", RemoteAddress: "remote_addr:1", Hostname: "host", BroadcastAddress: "b_addr",
+		TcpPort: 1, HttpPort: 2, Version: "v1", lastUpdate: beginningOfTime}
+	pi2 := &PeerInfo{id: "2", RemoteAddress: "remote_addr:2", Hostname: "host", BroadcastAddress: "b_addr",
+		TcpPort: 2, HttpPort: 3, Version: "v1", lastUpdate: beginningOfTime}
+	pi3 := &PeerInfo{id: "3", RemoteAddress: "remote_addr:3", Hostname: "host", BroadcastAddress: "b_addr",
+		TcpPort: 3, HttpPort: 4, Version: "v1", lastUpdate: beginningOfTime}
 	p1 := &Producer{pi1, false, beginningOfTime}
 	p2 := &Producer{pi2, false, beginningOfTime}
 	p3 := &Producer{pi3, false, beginningOfTime}
@@ -0,0 +1,120 @@
+package nsqlookupd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// TopicConfig is the cluster-wide configuration of a topic, nsqd fetches it
+// (from /topic_config) and applies it whenever it creates the topic locally
+type TopicConfig struct {
+	// RetentionPeriod is a duration (ie. "24h"), "0s" disables retention
+	RetentionPeriod string `json:"retention_period,omitempty"`
+	// MaxDepth rejects publishes once any queue of the topic is this deep
+	MaxDepth int64 `json:"max_depth,omitempty"`
+	// EphemeralChannels makes channels created on the topic ephemeral
+	EphemeralChannels bool `json:"ephemeral_channels,omitempty"`
+}
+
+// TopicConfigDB stores TopicConfig by topic name, persisting to fileName
+// (if set) on every change so that it survives a restart
+type TopicConfigDB struct {
+	sync.RWMutex
+	fileName string
+	configs  map[string]*TopicConfig
+}
+
+func NewTopicConfigDB(fileName string) (*TopicConfigDB, error) {
+	db := &TopicConfigDB{
+		fileName: fileName,
+		configs:  make(map[string]*TopicConfig),
+	}
+	if fileName == "" {
+		return db, nil
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &db.configs)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Get returns a copy of the configuration of topic, nil if it has none
+func (db *TopicConfigDB) Get(topic string) *TopicConfig {
+	db.RLock()
+	defer db.RUnlock()
+	cfg, ok := db.configs[topic]
+	if !ok {
+		return nil
+	}
+	c := *cfg
+	return &c
+}
+
+func (db *TopicConfigDB) All() map[string]*TopicConfig {
+	db.RLock()
+	defer db.RUnlock()
+	configs := make(map[string]*TopicConfig, len(db.configs))
+	for topic, cfg := range db.configs {
+		c := *cfg
+		configs[topic] = &c
+	}
+	return configs
+}
+
+func (db *TopicConfigDB) Set(topic string, cfg *TopicConfig) error {
+	db.Lock()
+	defer db.Unlock()
+	c := *cfg
+	db.configs[topic] = &c
+	return db.persist()
+}
+
+// Delete removes the configuration of topic, returning false if it had none
+func (db *TopicConfigDB) Delete(topic string) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.configs[topic]; !ok {
+		return false, nil
+	}
+	delete(db.configs, topic)
+	return true, db.persist()
+}
+
+// this expects the caller to hold the lock
+func (db *TopicConfigDB) persist() error {
+	if db.fileName == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(db.configs)
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := db.fileName + ".tmp"
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	return os.Rename(tmpFileName, db.fileName)
+}
@@ -0,0 +1,136 @@
+package nsqlookupd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// nsqd started with --worker-id-lease leases its worker id from nsqlookupd
+// (LEASE_WORKER_ID) rather than it being assigned by hand. A lease is held by
+// an owner (the nsqd's broadcast address and TCP port, so that a restarted
+// nsqd gets its id back) until it expires, nsqd renews it while connected.
+// The ids of the snowflake producers that didn't lease theirs aren't leased
+// to anyone else.
+//
+// nsqlookupd don't share their leases, nsqd leases the same id from each of
+// them (see nsqd's worker_id_lease.go)
+
+var errWorkerIDsExhausted = errors.New("no free worker ids")
+
+// WorkerIDLeaseRequest is the body of a LEASE_WORKER_ID command
+type WorkerIDLeaseRequest struct {
+	Owner string `json:"owner"`
+	// the id to lease, -1 for any
+	WorkerID int64 `json:"worker_id"`
+	// ids are [0,MaxWorkerID)
+	MaxWorkerID int64 `json:"max_worker_id"`
+	// only WorkerID will do (ie. renewing it), otherwise the lowest free id
+	// from WorkerID is leased if it isn't free
+	Exact bool `json:"exact"`
+}
+
+// WorkerIDConflictError is returned when the requested id is held by another
+// owner
+type WorkerIDConflictError struct {
+	WorkerID int64
+	Owner    string
+}
+
+func (e *WorkerIDConflictError) Error() string {
+	return fmt.Sprintf("worker id %d is leased to %s", e.WorkerID, e.Owner)
+}
+
+type workerIDLease struct {
+	owner    string
+	workerID int64
+	expires  time.Time
+}
+
+type workerIDLeases struct {
+	sync.Mutex
+	byOwner map[string]*workerIDLease
+	byID    map[int64]*workerIDLease
+}
+
+func newWorkerIDLeases() *workerIDLeases {
+	return &workerIDLeases{
+		byOwner: make(map[string]*workerIDLease),
+		byID:    make(map[int64]*workerIDLease),
+	}
+}
+
+// Lease leases a worker id to req.Owner for ttl, inUse are the ids (and
+// owners) of the producers that didn't lease theirs
+func (l *workerIDLeases) Lease(req *WorkerIDLeaseRequest, inUse map[int64]string, ttl time.Duration) (int64, error) {
+	now := time.Now()
+
+	l.Lock()
+	defer l.Unlock()
+
+	for id, lease := range l.byID {
+		if now.After(lease.expires) {
+			delete(l.byID, id)
+			delete(l.byOwner, lease.owner)
+		}
+	}
+
+	holder := func(id int64) string {
+		if lease, ok := l.byID[id]; ok {
+			return lease.owner
+		}
+		return inUse[id]
+	}
+
+	id := req.WorkerID
+	if id < 0 || id >= req.MaxWorkerID || (holder(id) != "" && holder(id) != req.Owner) {
+		if req.Exact {
+			return 0, &WorkerIDConflictError{id, holder(id)}
+		}
+		if lease, ok := l.byOwner[req.Owner]; ok && req.WorkerID < 0 {
+			id = lease.workerID
+		} else {
+			// the lowest free id from the requested one (wrapping around)
+			start := req.WorkerID
+			if start < 0 || start >= req.MaxWorkerID {
+				start = 0
+			}
+			id = -1
+			for i := int64(0); i < req.MaxWorkerID; i++ {
+				candidate := (start + i) % req.MaxWorkerID
+				if holder(candidate) == "" {
+					id = candidate
+					break
+				}
+			}
+			if id < 0 {
+				return 0, errWorkerIDsExhausted
+			}
+		}
+	}
+
+	if lease, ok := l.byOwner[req.Owner]; ok {
+		delete(l.byID, lease.workerID)
+	}
+	lease := &workerIDLease{req.Owner, id, now.Add(ttl)}
+	l.byOwner[req.Owner] = lease
+	l.byID[id] = lease
+	return id, nil
+}
+
+// workerIDsInUse returns the worker ids (and owners) of the active snowflake
+// producers
+func (l *NSQLookupd) workerIDsInUse() map[int64]string {
+	inUse := make(map[int64]string)
+	producers := l.DB.FindProducers("client", "", "").FilterByActive(l.options.InactiveProducerTimeout, 0)
+	for _, p := range producers {
+		if p.peerInfo.IDGenerator != "snowflake" {
+			continue
+		}
+		inUse[p.peerInfo.WorkerID] = net.JoinHostPort(p.peerInfo.BroadcastAddress, strconv.Itoa(p.peerInfo.TcpPort))
+	}
+	return inUse
+}
@@ -3,11 +3,18 @@ package util
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 )
 
 func ApiResponse(w http.ResponseWriter, statusCode int, statusTxt string, data interface{}) {
+	contentType := "application/json; charset=utf-8"
+	if v1, ok := w.(*v1ResponseWriter); ok {
+		statusCode = v1StatusCode(statusCode, statusTxt)
+		contentType = v1.contentType
+	}
+
 	response, err := json.Marshal(struct {
 		StatusCode int         `json:"status_code"`
 		StatusTxt  string      `json:"status_txt"`
@@ -21,8 +28,19 @@ func ApiResponse(w http.ResponseWriter, statusCode int, statusTxt string, data i
 		response = []byte(fmt.Sprintf(`{"status_code":500, "status_txt":"%s", "data":null}`, err.Error()))
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
 	w.WriteHeader(statusCode)
 	w.Write(response)
 }
+
+// OKResponse writes the plain text "OK" of /ping and /pub (the JSON envelope
+// for v1 requests)
+func OKResponse(w http.ResponseWriter) {
+	if IsV1(w) {
+		ApiResponse(w, 200, "OK", nil)
+		return
+	}
+	w.Header().Set("Content-Length", "2")
+	io.WriteString(w, "OK")
+}
@@ -0,0 +1,93 @@
+package util
+
+import (
+	"net/http"
+	"strings"
+)
+
+// V1MediaType is the media type of v1 API responses, a client that Accepts it
+// gets v1 responses from the legacy (unversioned) endpoints too
+const V1MediaType = "application/vnd.nsq; version=1.0"
+
+// the v1 API is the legacy endpoints under /v1/ except that every response
+// (including errors and the plain text "OK"s) is the JSON envelope written by
+// ApiResponse, with an HTTP status code that reflects its status_txt
+type v1ResponseWriter struct {
+	http.ResponseWriter
+	contentType string
+}
+
+// NewV1ResponseWriter wraps w so that responses written via ApiResponse and
+// OKResponse follow the v1 conventions, their Content-Type is V1MediaType if
+// req Accepts it (application/json otherwise)
+func NewV1ResponseWriter(w http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	contentType := "application/json; charset=utf-8"
+	if AcceptsV1(req) {
+		contentType = V1MediaType
+	}
+	return &v1ResponseWriter{w, contentType}
+}
+
+// Flush is passed through for the streaming endpoints
+func (w *v1ResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// IsV1 returns whether w is responding to a v1 API request
+func IsV1(w http.ResponseWriter) bool {
+	_, ok := w.(*v1ResponseWriter)
+	return ok
+}
+
+// AcceptsV1 returns whether req negotiated the v1 API via its Accept header
+func AcceptsV1(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType := strings.Replace(strings.TrimSpace(accept), " ", "", -1)
+		if strings.HasPrefix(mediaType, "application/vnd.nsq;version=1") {
+			return true
+		}
+	}
+	return false
+}
+
+// V1Handler serves the v1 API (under /v1/ or negotiated via the Accept header)
+// with handler, which routes on the legacy paths
+func V1Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/v1/") {
+			req.URL.Path = req.URL.Path[len("/v1"):]
+			w = NewV1ResponseWriter(w, req)
+		} else if AcceptsV1(req) {
+			w = NewV1ResponseWriter(w, req)
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// v1StatusCode is the HTTP status code of a v1 response, the legacy endpoints
+// respond 500 to most errors, including those that are the client's
+func v1StatusCode(statusCode int, statusTxt string) int {
+	if statusCode != 500 {
+		return statusCode
+	}
+	switch {
+	case strings.HasSuffix(statusTxt, "_TOO_BIG"):
+		return 413
+	case strings.HasSuffix(statusTxt, "_NOT_FOUND"),
+		// the legacy endpoints use these for topics/channels that don't exist
+		statusTxt == "INVALID_TOPIC", statusTxt == "INVALID_CHANNEL":
+		return 404
+	case strings.HasSuffix(statusTxt, "_CREATION_DENIED"), statusTxt == "MSG_REJECTED":
+		return 403
+	case strings.HasPrefix(statusTxt, "ALREADY_"):
+		return 409
+	case strings.HasPrefix(statusTxt, "MISSING_ARG_"),
+		strings.HasPrefix(statusTxt, "INVALID_"),
+		strings.HasPrefix(statusTxt, "BAD_"),
+		statusTxt == "MSG_EMPTY", statusTxt == "RETENTION_DISABLED":
+		return 400
+	}
+	return statusCode
+}
@@ -0,0 +1,292 @@
+// Package bench has what nsq_bench_producer and nsq_bench_consumer share, a
+// connection to nsqd that negotiates features (TLS, compression) the same way
+// client libraries do, and latency/throughput reporting.
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
+	"github.com/mreiferson/go-snappystream"
+)
+
+// ConnOptions are the features a Conn negotiates with nsqd
+type ConnOptions struct {
+	TLS                   bool
+	TLSInsecureSkipVerify bool
+	TLSRootCAFile         string
+	Deflate               bool
+	DeflateLevel          int
+	Snappy                bool
+	OutputBufferSize      int
+	OutputBufferTimeout   time.Duration
+	SampleRate            int
+}
+
+// AddConnFlags adds the flags for ConnOptions to the command line flags
+func AddConnFlags() *ConnOptions {
+	o := &ConnOptions{}
+	flag.BoolVar(&o.TLS, "tls", false, "negotiate TLS")
+	flag.BoolVar(&o.TLSInsecureSkipVerify, "tls-insecure-skip-verify", false, "don't verify nsqd's TLS certificate")
+	flag.StringVar(&o.TLSRootCAFile, "tls-root-ca-file", "", "path to a PEM CA file to verify nsqd's TLS certificate with")
+	flag.BoolVar(&o.Deflate, "deflate", false, "negotiate deflate compression")
+	flag.IntVar(&o.DeflateLevel, "deflate-level", 6, "deflate compression level (1-9)")
+	flag.BoolVar(&o.Snappy, "snappy", false, "negotiate snappy compression")
+	flag.IntVar(&o.OutputBufferSize, "output-buffer-size", 0, "nsqd's output buffer size for the connection in bytes (0 for nsqd's default, -1 to disable)")
+	flag.DurationVar(&o.OutputBufferTimeout, "output-buffer-timeout", 0, "nsqd's output buffer timeout for the connection (0 for nsqd's default)")
+	flag.IntVar(&o.SampleRate, "sample-rate", 0, "percentage of messages nsqd delivers (0 for all)")
+	return o
+}
+
+// String describes the features, as they're reported with the results
+func (o *ConnOptions) String() string {
+	var features []string
+	if o.TLS {
+		features = append(features, "tls")
+	}
+	if o.Snappy {
+		features = append(features, "snappy")
+	}
+	if o.Deflate {
+		features = append(features, fmt.Sprintf("deflate(%d)", o.DeflateLevel))
+	}
+	if len(features) == 0 {
+		return "none"
+	}
+	return strings.Join(features, ",")
+}
+
+func (o *ConnOptions) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: o.TLSInsecureSkipVerify}
+	if o.TLSRootCAFile != "" {
+		pem, err := ioutil.ReadFile(o.TLSRootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + o.TLSRootCAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Conn is a V2 protocol connection to nsqd
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+	// flusher is the compression writer under w, flushed along with it
+	flusher interface {
+		Flush() error
+	}
+}
+
+// Dial connects to nsqd at addr and IDENTIFYs, negotiating opts
+func Dial(addr string, opts *ConnOptions) (*Conn, error) {
+	netConn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		Conn: netConn,
+		r:    bufio.NewReader(netConn),
+		w:    bufio.NewWriter(netConn),
+	}
+	err = c.identify(addr, opts)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) identify(addr string, opts *ConnOptions) error {
+	_, err := c.w.Write(nsq.MagicV2)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	ci := map[string]interface{}{
+		"short_id":            strings.Split(hostname, ".")[0],
+		"long_id":             hostname,
+		"user_agent":          "nsq_bench/" + util.BINARY_VERSION,
+		"feature_negotiation": true,
+		"tls_v1":              opts.TLS,
+		"deflate":             opts.Deflate,
+		"deflate_level":       opts.DeflateLevel,
+		"snappy":              opts.Snappy,
+		"sample_rate":         opts.SampleRate,
+	}
+	if opts.OutputBufferSize != 0 {
+		ci["output_buffer_size"] = opts.OutputBufferSize
+	}
+	if opts.OutputBufferTimeout != 0 {
+		ci["output_buffer_timeout"] = int(opts.OutputBufferTimeout / time.Millisecond)
+	}
+	cmd, err := nsq.Identify(ci)
+	if err != nil {
+		return err
+	}
+	data, err := c.Command(cmd)
+	if err != nil {
+		return fmt.Errorf("IDENTIFY failed - %s", err.Error())
+	}
+
+	resp := struct {
+		TLSv1   bool `json:"tls_v1"`
+		Deflate bool `json:"deflate"`
+		Snappy  bool `json:"snappy"`
+	}{}
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		return fmt.Errorf("IDENTIFY response (%s) isn't feature negotiation - %s", data, err.Error())
+	}
+	if resp.TLSv1 != opts.TLS || resp.Deflate != opts.Deflate ||
+		resp.Snappy != opts.Snappy {
+		return fmt.Errorf("nsqd negotiated %s", data)
+	}
+
+	// the order nsqd upgrades in, each is followed by an OK over the upgraded
+	// connection, the decompressing readers read from the (buffered) reader
+	// they replace as it may already have read the start of what's compressed
+	var conn io.Writer = c.Conn
+	if resp.TLSv1 {
+		tlsConfig, err := opts.tlsConfig()
+		if err != nil {
+			return err
+		}
+		if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(c.Conn, tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			return err
+		}
+		conn = tlsConn
+		c.r = bufio.NewReader(tlsConn)
+		c.w = bufio.NewWriter(conn)
+		err = c.readOK("TLS")
+		if err != nil {
+			return err
+		}
+	}
+	if resp.Snappy {
+		c.r = bufio.NewReader(snappystream.NewReader(c.r, snappystream.SkipVerifyChecksum))
+		c.w = bufio.NewWriter(snappystream.NewWriter(conn))
+		err = c.readOK("snappy")
+		if err != nil {
+			return err
+		}
+	}
+	if resp.Deflate {
+		fw, _ := flate.NewWriter(conn, opts.DeflateLevel)
+		c.r = bufio.NewReader(flate.NewReader(c.r))
+		c.w = bufio.NewWriter(fw)
+		c.flusher = fw
+		err = c.readOK("deflate")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) readOK(upgrade string) error {
+	frameType, data, err := c.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if frameType != nsq.FrameTypeResponse || !bytes.Equal(data, []byte("OK")) {
+		return fmt.Errorf("%s upgrade failed - %s", upgrade, data)
+	}
+	return nil
+}
+
+// WriteCommand buffers cmd, it's sent by Flush
+func (c *Conn) WriteCommand(cmd *nsq.Command) error {
+	return cmd.Write(c.w)
+}
+
+// Flush sends what's been written
+func (c *Conn) Flush() error {
+	c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	err := c.w.Flush()
+	if err != nil {
+		return err
+	}
+	if c.flusher != nil {
+		return c.flusher.Flush()
+	}
+	return nil
+}
+
+// Buffered returns the number of bytes read from the connection that haven't
+// been read as frames yet
+func (c *Conn) Buffered() int {
+	return c.r.Buffered()
+}
+
+// Command sends cmd and reads its response (an error frame is an error)
+func (c *Conn) Command(cmd *nsq.Command) ([]byte, error) {
+	err := c.WriteCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Flush()
+	if err != nil {
+		return nil, err
+	}
+	frameType, data, err := c.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if frameType == nsq.FrameTypeError {
+		return nil, errors.New(string(data))
+	}
+	return data, nil
+}
+
+// ReadFrame reads the next frame, responding to heartbeats (which aren't
+// returned)
+func (c *Conn) ReadFrame() (int32, []byte, error) {
+	for {
+		resp, err := nsq.ReadResponse(c.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		frameType, data, err := nsq.UnpackResponse(resp)
+		if err != nil {
+			return 0, nil, err
+		}
+		if frameType == nsq.FrameTypeResponse && bytes.HasPrefix(data, []byte("_heartbeat_")) {
+			err = c.WriteCommand(nsq.Nop())
+			if err == nil {
+				err = c.Flush()
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		return frameType, data, nil
+	}
+	panic("unreachable")
+}
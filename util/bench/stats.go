@@ -0,0 +1,138 @@
+package bench
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bitly/nsq/util"
+	"github.com/bmizerany/perks/quantile"
+)
+
+// Percentiles are the latency percentiles reported
+var Percentiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// Stats counts the messages (and bytes) a benchmark sends or receives, and
+// the distribution of their latencies
+type Stats struct {
+	sync.Mutex
+	start      time.Time
+	count      int64
+	bytes      int64
+	errors     int64
+	latencies  *quantile.Stream
+	maxLatency time.Duration
+	sumLatency time.Duration
+
+	lastReport time.Time
+	lastCount  int64
+	lastBytes  int64
+}
+
+func NewStats() *Stats {
+	now := time.Now()
+	return &Stats{
+		start:      now,
+		lastReport: now,
+		latencies:  quantile.NewTargeted(Percentiles...),
+	}
+}
+
+// Record counts count messages of size bytes (each) that took latency
+func (s *Stats) Record(count int, size int, latency time.Duration) {
+	s.Lock()
+	s.count += int64(count)
+	s.bytes += int64(count * size)
+	for i := 0; i < count; i++ {
+		s.latencies.Insert(float64(latency))
+	}
+	s.sumLatency += time.Duration(count) * latency
+	if latency > s.maxLatency {
+		s.maxLatency = latency
+	}
+	s.Unlock()
+}
+
+// Error counts a failed publish or delivery
+func (s *Stats) Error() {
+	s.Lock()
+	s.errors++
+	s.Unlock()
+}
+
+// Count returns how many messages have been recorded
+func (s *Stats) Count() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.count
+}
+
+// ReportLoop logs the throughput since the last report every interval until
+// exitChan is closed
+func (s *Stats) ReportLoop(interval time.Duration, exitChan chan int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-exitChan:
+			return
+		}
+
+		s.Lock()
+		now := time.Now()
+		elapsed := now.Sub(s.lastReport).Seconds()
+		count, bytes := s.count-s.lastCount, s.bytes-s.lastBytes
+		s.lastReport, s.lastCount, s.lastBytes = now, s.count, s.bytes
+		p99 := time.Duration(s.latencies.Query(0.99))
+		s.Unlock()
+
+		log.Printf("%.03f msgs/s - %.03f MB/s - p99 %s (total %d)",
+			float64(count)/elapsed, float64(bytes)/elapsed/1024/1024, p99, s.Count())
+	}
+}
+
+// Report writes the results
+func (s *Stats) Report(w io.Writer, description string) {
+	s.Lock()
+	defer s.Unlock()
+
+	duration := time.Since(s.start)
+	fmt.Fprintf(w, "%s\n", description)
+	fmt.Fprintf(w, "duration: %s\n", duration)
+	fmt.Fprintf(w, "messages: %d (%d errors)\n", s.count, s.errors)
+	fmt.Fprintf(w, "throughput: %.03f msgs/s - %.03f MB/s\n",
+		float64(s.count)/duration.Seconds(), float64(s.bytes)/duration.Seconds()/1024/1024)
+	if s.count == 0 {
+		return
+	}
+	fmt.Fprintf(w, "latency: mean %s", util.NanoSecondToHuman(float64(s.sumLatency)/float64(s.count)))
+	for _, p := range Percentiles {
+		fmt.Fprintf(w, " - p%g %s", p*100, util.NanoSecondToHuman(s.latencies.Query(p)))
+	}
+	fmt.Fprintf(w, " - max %s\n", util.NanoSecondToHuman(float64(s.maxLatency)))
+}
+
+// TimestampSize is the size of the timestamp PutTimestamp puts at the start of
+// a message body
+const TimestampSize = 8
+
+// PutTimestamp puts the time (unix nanoseconds) at the start of body, for the
+// consumer to measure end to end latency with
+func PutTimestamp(body []byte, t time.Time) {
+	if len(body) >= TimestampSize {
+		binary.BigEndian.PutUint64(body, uint64(t.UnixNano()))
+	}
+}
+
+// Timestamp is the time PutTimestamp put at the start of body, or the zero
+// time when it's too short
+func Timestamp(body []byte) time.Time {
+	if len(body) < TimestampSize {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(body)))
+}
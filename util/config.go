@@ -0,0 +1,25 @@
+package util
+
+// ListenAddressConfigKeys are the config file keys of the listen addresses,
+// which were single addresses before they became lists
+var ListenAddressConfigKeys = map[string]string{
+	"tcp_address":  "tcp_addresses",
+	"http_address": "http_addresses",
+}
+
+// UpgradeConfigKeys maps the deprecated (single value) keys of cfg to the
+// lists that replaced them, as one element lists, so that config files
+// written for older versions keep working (a list, if set, takes precedence)
+func UpgradeConfigKeys(cfg map[string]interface{}, keys map[string]string) {
+	for oldKey, newKey := range keys {
+		v, ok := cfg[oldKey]
+		if !ok {
+			continue
+		}
+		delete(cfg, oldKey)
+		if _, ok := cfg[newKey]; ok {
+			continue
+		}
+		cfg[newKey] = []interface{}{v}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build go1.1
+// +build go1.1
+
+package util
+
+import (
+	"runtime/debug"
+)
+
+// freeOSMemory forces a garbage collection and returns as much memory to the
+// OS as possible
+func freeOSMemory() {
+	debug.FreeOSMemory()
+}
@@ -0,0 +1,14 @@
+//go:build !go1.1
+// +build !go1.1
+
+package util
+
+import (
+	"runtime"
+)
+
+// freeOSMemory only forces a garbage collection, returning memory to the OS
+// on demand needs Go 1.1 (the scavenger still does so over time)
+func freeOSMemory() {
+	runtime.GC()
+}
@@ -0,0 +1,135 @@
+package util
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	httpprof "net/http/pprof"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+// DebugHandler serves the runtime diagnostics endpoints under /debug/ (pprof
+// profiles, execution traces when built with Go 1.5+, a goroutine dump and
+// forced GC)
+//
+// every request must present the auth token, either as
+// "Authorization: Bearer <token>" or as the password of HTTP basic auth (so
+// that `go tool pprof http://:<token>@host:port/debug/pprof/heap` works),
+// without one nothing is authorized
+type DebugHandler struct {
+	authToken string
+}
+
+func NewDebugHandler(authToken string) *DebugHandler {
+	return &DebugHandler{authToken: authToken}
+}
+
+// Authorized returns whether req presents the auth token
+func (h *DebugHandler) Authorized(req *http.Request) bool {
+	if h.authToken == "" {
+		return false
+	}
+
+	var token string
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Basic ") {
+		token = basicAuthPassword(auth[len("Basic "):])
+	} else if strings.HasPrefix(auth, "Bearer ") {
+		token = auth[len("Bearer "):]
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.authToken)) == 1
+}
+
+// basicAuthPassword returns the password of base64 encoded "user:password"
+// credentials ("" when they're malformed)
+func basicAuthPassword(credentials string) string {
+	b, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return ""
+	}
+	i := strings.Index(string(b), ":")
+	if i < 0 {
+		return ""
+	}
+	return string(b[i+1:])
+}
+
+func (h *DebugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !h.Authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="debug"`)
+		ApiResponse(w, 401, "UNAUTHORIZED", nil)
+		return
+	}
+
+	switch req.URL.Path {
+	case "/debug/pprof", "/debug/pprof/":
+		httpprof.Index(w, req)
+	case "/debug/pprof/cmdline":
+		httpprof.Cmdline(w, req)
+	case "/debug/pprof/symbol":
+		httpprof.Symbol(w, req)
+	case "/debug/pprof/profile":
+		httpprof.Profile(w, req)
+	case "/debug/pprof/trace":
+		traceHandler(w, req)
+	case "/debug/goroutines":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		pprof.Lookup("goroutine").WriteTo(w, 2)
+	case "/debug/gc":
+		h.gcHandler(w, req)
+	default:
+		if strings.HasPrefix(req.URL.Path, "/debug/pprof/") {
+			name := req.URL.Path[len("/debug/pprof/"):]
+			if pprof.Lookup(name) != nil {
+				httpprof.Handler(name).ServeHTTP(w, req)
+				return
+			}
+		}
+		ApiResponse(w, 404, "NOT_FOUND", nil)
+	}
+}
+
+type heapStats struct {
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapSys      uint64 `json:"heap_sys"`
+	HeapIdle     uint64 `json:"heap_idle"`
+	HeapReleased uint64 `json:"heap_released"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	NumGC        uint32 `json:"num_gc"`
+}
+
+func newHeapStats() heapStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return heapStats{
+		HeapAlloc:    ms.HeapAlloc,
+		HeapSys:      ms.HeapSys,
+		HeapIdle:     ms.HeapIdle,
+		HeapReleased: ms.HeapReleased,
+		HeapObjects:  ms.HeapObjects,
+		NumGC:        ms.NumGC,
+	}
+}
+
+// gcHandler forces a garbage collection (returning as much memory to the OS
+// as possible, with Go 1.1+) and reports heap stats from before and after
+func (h *DebugHandler) gcHandler(w http.ResponseWriter, req *http.Request) {
+	before := newHeapStats()
+	start := time.Now()
+	freeOSMemory()
+	duration := time.Now().Sub(start)
+	after := newHeapStats()
+
+	ApiResponse(w, 200, "OK", struct {
+		Before     heapStats `json:"before"`
+		After      heapStats `json:"after"`
+		DurationMs int64     `json:"duration_ms"`
+	}{
+		Before:     before,
+		After:      after,
+		DurationMs: int64(duration / time.Millisecond),
+	})
+}
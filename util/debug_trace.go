@@ -0,0 +1,15 @@
+//go:build go1.5
+// +build go1.5
+
+package util
+
+import (
+	"net/http"
+	httpprof "net/http/pprof"
+)
+
+// traceHandler captures a runtime execution trace (for `go tool trace`), for
+// ?seconds= (by default 1)
+func traceHandler(w http.ResponseWriter, req *http.Request) {
+	httpprof.Trace(w, req)
+}
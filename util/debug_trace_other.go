@@ -0,0 +1,13 @@
+//go:build !go1.5
+// +build !go1.5
+
+package util
+
+import (
+	"net/http"
+)
+
+// traceHandler is unavailable, runtime execution traces need Go 1.5
+func traceHandler(w http.ResponseWriter, req *http.Request) {
+	ApiResponse(w, 501, "TRACE_UNSUPPORTED", nil)
+}
@@ -0,0 +1,19 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseLabels parses <key>=<value> labels (ie. region=us-east) into a map
+func ParseLabels(labels []string) (map[string]string, error) {
+	m := make(map[string]string, len(labels))
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label %q - must be <key>=<value>", label)
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/bitly/go-simplejson"
 	"github.com/bitly/nsq/util"
 	"github.com/bitly/nsq/util/semver"
 )
@@ -83,6 +84,58 @@ func GetLookupdTopicChannels(topic string, lookupdHTTPAddrs []string) ([]string,
 	return allChannels, nil
 }
 
+// TopicConfig is the cluster-wide configuration of a topic (see nsqlookupd /topic_config)
+type TopicConfig struct {
+	RetentionPeriod   string
+	MaxDepth          int64
+	EphemeralChannels bool
+}
+
+// GetLookupdTopicConfig returns the configuration of the given topic from the
+// first of the given lookupd (in order) that has one, nil if none do
+func GetLookupdTopicConfig(topic string, lookupdHTTPAddrs []string) (*TopicConfig, error) {
+	success := false
+	configs := make([]*TopicConfig, len(lookupdHTTPAddrs))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i, addr := range lookupdHTTPAddrs {
+		wg.Add(1)
+		endpoint := fmt.Sprintf("http://%s/topic_config?topic=%s", addr, url.QueryEscape(topic))
+		log.Printf("LOOKUPD: querying %s", endpoint)
+		go func(i int, endpoint string) {
+			data, err := util.ApiRequest(endpoint)
+			lock.Lock()
+			defer lock.Unlock()
+			defer wg.Done()
+			if err != nil {
+				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				return
+			}
+			success = true
+			// {"data":{"config":{"retention_period":"24h","max_depth":1000}}}
+			cfg, ok := data.CheckGet("config")
+			if !ok || cfg.Interface() == nil {
+				return
+			}
+			configs[i] = &TopicConfig{
+				RetentionPeriod:   cfg.Get("retention_period").MustString(),
+				MaxDepth:          cfg.Get("max_depth").MustInt64(),
+				EphemeralChannels: cfg.Get("ephemeral_channels").MustBool(),
+			}
+		}(i, endpoint)
+	}
+	wg.Wait()
+	if success == false {
+		return nil, errors.New("unable to query any lookupd")
+	}
+	for _, cfg := range configs {
+		if cfg != nil {
+			return cfg, nil
+		}
+	}
+	return nil, nil
+}
+
 // GetLookupdProducers returns a slice of pointers to Producer structs
 // containing metadata for each node connected to given lookupds
 func GetLookupdProducers(lookupdHTTPAddrs []string) ([]*Producer, error) {
@@ -263,6 +316,44 @@ func GetNSQDTopics(nsqdHTTPAddrs []string) ([]string, error) {
 	return topics, nil
 }
 
+// GetNSQDResources sets the Resources of each of the given producers (from
+// its /info), those that fail to respond are left nil
+func GetNSQDResources(producers []*Producer) {
+	var wg sync.WaitGroup
+	for _, p := range producers {
+		wg.Add(1)
+		endpoint := fmt.Sprintf("http://%s/info", p.HTTPAddress())
+		log.Printf("NSQD: querying %s", endpoint)
+
+		go func(p *Producer, endpoint string) {
+			defer wg.Done()
+			data, err := util.ApiRequest(endpoint)
+			if err != nil {
+				log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
+				return
+			}
+			r, ok := data.CheckGet("resources")
+			if !ok {
+				// an nsqd that predates resource stats
+				return
+			}
+			p.Resources = &NodeResources{
+				RSSBytes:       r.Get("rss_bytes").MustInt64(),
+				HeapBytes:      r.Get("heap_bytes").MustInt64(),
+				NumGC:          r.Get("num_gc").MustInt64(),
+				GCPauseLastNs:  r.Get("gc_pause_last_ns").MustInt64(),
+				GCPauseTotalNs: r.Get("gc_pause_total_ns").MustInt64(),
+				OpenFDs:        r.Get("open_fds").MustInt64(),
+				MaxFDs:         r.Get("max_fds").MustInt64(),
+				DataPath:       r.Get("data_path").MustString(),
+				DiskTotalBytes: r.Get("disk_total_bytes").MustInt64(),
+				DiskFreeBytes:  r.Get("disk_free_bytes").MustInt64(),
+			}
+		}(p, endpoint)
+	}
+	wg.Wait()
+}
+
 // GetNSQDTopicProducers returns a []string containing the addresses of all the nsqd
 // that produce the given topic out of the given nsqd
 func GetNSQDTopicProducers(topic string, nsqdHTTPAddrs []string) ([]string, error) {
@@ -345,6 +436,17 @@ func GetNSQDStats(nsqdHTTPAddrs []string, selectedTopic string) ([]*TopicStats,
 
 				e2eProcessingLatency := util.E2eProcessingLatencyAggregateFromJson(t.Get("e2e_processing_latency"), topicName, "", addr)
 
+				var producers []*TopicProducer
+				for k := range t.Get("producers").MustArray() {
+					p := t.Get("producers").GetIndex(k)
+					producers = append(producers, &TopicProducer{
+						Protocol:     p.Get("protocol").MustString(),
+						Address:      p.Get("address").MustString(),
+						Name:         p.Get("name").MustString(),
+						MessageCount: p.Get("message_count").MustInt64(),
+					})
+				}
+
 				topicStats := &TopicStats{
 					HostAddress:  addr,
 					TopicName:    topicName,
@@ -354,6 +456,8 @@ func GetNSQDStats(nsqdHTTPAddrs []string, selectedTopic string) ([]*TopicStats,
 					MessageCount: t.Get("message_count").MustInt64(),
 					ChannelCount: len(channels),
 					Paused:       t.Get("paused").MustBool(),
+					Annotations:  annotationsFromJson(t.Get("annotations")),
+					Producers:    producers,
 
 					E2eProcessingLatency: e2eProcessingLatency,
 				}
@@ -392,6 +496,7 @@ func GetNSQDStats(nsqdHTTPAddrs []string, selectedTopic string) ([]*TopicStats,
 						BackendDepth:  backendDepth,
 						MemoryDepth:   depth - backendDepth,
 						Paused:        c.Get("paused").MustBool(),
+						Annotations:   annotationsFromJson(c.Get("annotations")),
 						InFlightCount: c.Get("in_flight_count").MustInt64(),
 						DeferredCount: c.Get("deferred_count").MustInt64(),
 						MessageCount:  c.Get("message_count").MustInt64(),
@@ -412,9 +517,10 @@ func GetNSQDStats(nsqdHTTPAddrs []string, selectedTopic string) ([]*TopicStats,
 						connectedDuration := time.Now().Sub(connected).Seconds()
 
 						clientStats := &ClientStats{
-							HostAddress: addr,
-							Version:     client.Get("version").MustString(),
-							UserAgent:   client.Get("user_agent").MustString(),
+							HostAddress:   addr,
+							Version:       client.Get("version").MustString(),
+							UserAgent:     client.Get("user_agent").MustString(),
+							RemoteAddress: client.Get("remote_address").MustString(),
 							Identifier: fmt.Sprintf("%s:%s", client.Get("name").MustString(),
 								strings.Split(client.Get("remote_address").MustString(), ":")[1]),
 							ConnectedDuration: time.Duration(int64(connectedDuration)) * time.Second, // truncate to second
@@ -446,3 +552,19 @@ func GetNSQDStats(nsqdHTTPAddrs []string, selectedTopic string) ([]*TopicStats,
 	}
 	return topicStatsList, channelStatsMap, nil
 }
+
+// annotationsFromJson returns a topic's or channel's annotations from its
+// nsqd stats, nil if it has none
+func annotationsFromJson(js *simplejson.Json) map[string]string {
+	m, err := js.Map()
+	if err != nil || len(m) == 0 {
+		return nil
+	}
+	annotations := make(map[string]string, len(m))
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			annotations[k] = s
+		}
+	}
+	return annotations
+}
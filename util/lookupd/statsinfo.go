@@ -2,7 +2,9 @@ package lookupd
 
 import (
 	"fmt"
+	"net"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/bitly/nsq/util"
@@ -27,17 +29,18 @@ type Producer struct {
 	TcpPort          int             `json:"tcp_port"`
 	HttpPort         int             `json:"http_port"`
 	Version          string          `json:"version"`
-	VersionObj       *semver.Version `json:-`
+	VersionObj       *semver.Version `json:"-"`
 	Topics           ProducerTopics  `json:"topics"`
-	OutOfDate        bool
+	OutOfDate        bool            `json:"out_of_date"`
+	Resources        *NodeResources  `json:"-"`
 }
 
 func (p *Producer) HTTPAddress() string {
-	return fmt.Sprintf("%s:%d", p.BroadcastAddress, p.HttpPort)
+	return net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.HttpPort))
 }
 
 func (p *Producer) TCPAddress() string {
-	return fmt.Sprintf("%s:%d", p.BroadcastAddress, p.TcpPort)
+	return net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TcpPort))
 }
 
 // IsInconsistent checks for cases where an unexpected number of nsqd connections are
@@ -47,22 +50,88 @@ func (p *Producer) IsInconsistent(numLookupd int) bool {
 	return len(p.RemoteAddresses) != numLookupd
 }
 
+// NodeResources is an nsqd's use of resources (as reported by its /info),
+// counts that the nsqd can't determine on its platform are 0
+type NodeResources struct {
+	RSSBytes       int64
+	HeapBytes      int64
+	NumGC          int64
+	GCPauseLastNs  int64
+	GCPauseTotalNs int64
+	OpenFDs        int64
+	MaxFDs         int64
+	DataPath       string
+	DiskTotalBytes int64
+	DiskFreeBytes  int64
+}
+
+// FDsClass is the class of open file descriptors as a fraction of the limit
+func (r *NodeResources) FDsClass() string {
+	if r.MaxFDs <= 0 {
+		return ""
+	}
+	return thresholdClass(float64(r.OpenFDs)/float64(r.MaxFDs), 0.7, 0.9)
+}
+
+// DiskClass is the class of the used fraction of the --data-path volume
+func (r *NodeResources) DiskClass() string {
+	if r.DiskTotalBytes <= 0 {
+		return ""
+	}
+	used := r.DiskTotalBytes - r.DiskFreeBytes
+	return thresholdClass(float64(used)/float64(r.DiskTotalBytes), 0.8, 0.9)
+}
+
+// GCPauseClass is the class of the most recent GC pause (in seconds)
+func (r *NodeResources) GCPauseClass() string {
+	return thresholdClass(float64(r.GCPauseLastNs)/1e9, 0.05, 0.2)
+}
+
+func (r *NodeResources) DiskUsedBytes() int64 {
+	return r.DiskTotalBytes - r.DiskFreeBytes
+}
+
+func thresholdClass(v float64, yellow float64, red float64) string {
+	switch {
+	case v >= red:
+		return "text-error"
+	case v >= yellow:
+		return "text-warning"
+	}
+	return ""
+}
+
 type TopicStats struct {
-	HostAddress  string
-	TopicName    string
-	Depth        int64
-	MemoryDepth  int64
-	BackendDepth int64
-	MessageCount int64
-	ChannelCount int
-	Aggregate    bool
-	Channels     []*ChannelStats
-	Paused       bool
-
-	E2eProcessingLatency *util.E2eProcessingLatencyAggregate
+	HostAddress  string          `json:"host_address"`
+	TopicName    string          `json:"topic_name"`
+	Depth        int64           `json:"depth"`
+	MemoryDepth  int64           `json:"memory_depth"`
+	BackendDepth int64           `json:"backend_depth"`
+	MessageCount int64           `json:"message_count"`
+	ChannelCount int             `json:"channel_count"`
+	Aggregate    bool            `json:"aggregate"`
+	Channels     []*ChannelStats `json:"channels"`
+	Paused       bool            `json:"paused"`
+
+	// Annotations are the topic's owner, description etc.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Producers are who recently published to the topic on the node
+	Producers []*TopicProducer `json:"producers,omitempty"`
+
+	E2eProcessingLatency *util.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
 	numAggregates        int
 }
 
+// TopicProducer is a client (by remote address) or, for HTTP, a source IP
+// that published to a topic
+type TopicProducer struct {
+	Protocol     string `json:"protocol"`
+	Address      string `json:"address"`
+	Name         string `json:"name"`
+	MessageCount int64  `json:"message_count"`
+}
+
 func (t *TopicStats) Add(a *TopicStats) {
 	t.Aggregate = true
 	t.TopicName = a.TopicName
@@ -76,6 +145,7 @@ func (t *TopicStats) Add(a *TopicStats) {
 	if a.Paused {
 		t.Paused = a.Paused
 	}
+	t.Annotations = mergeAnnotations(t.Annotations, a.Annotations)
 	t.numAggregates += 1
 	t.E2eProcessingLatency = t.E2eProcessingLatency.Add(a.E2eProcessingLatency, t.numAggregates)
 }
@@ -98,24 +168,27 @@ func (t *TopicStats) Host() string {
 }
 
 type ChannelStats struct {
-	HostAddress   string
-	TopicName     string
-	ChannelName   string
-	Depth         int64
-	MemoryDepth   int64
-	BackendDepth  int64
-	InFlightCount int64
-	DeferredCount int64
-	RequeueCount  int64
-	TimeoutCount  int64
-	MessageCount  int64
-	ClientCount   int
-	Selected      bool
-	HostStats     []*ChannelStats
-	Clients       []*ClientStats
-	Paused        bool
-
-	E2eProcessingLatency *util.E2eProcessingLatencyAggregate
+	HostAddress   string          `json:"host_address"`
+	TopicName     string          `json:"topic_name"`
+	ChannelName   string          `json:"channel_name"`
+	Depth         int64           `json:"depth"`
+	MemoryDepth   int64           `json:"memory_depth"`
+	BackendDepth  int64           `json:"backend_depth"`
+	InFlightCount int64           `json:"in_flight_count"`
+	DeferredCount int64           `json:"deferred_count"`
+	RequeueCount  int64           `json:"requeue_count"`
+	TimeoutCount  int64           `json:"timeout_count"`
+	MessageCount  int64           `json:"message_count"`
+	ClientCount   int             `json:"client_count"`
+	Selected      bool            `json:"selected"`
+	HostStats     []*ChannelStats `json:"host_stats"`
+	Clients       []*ClientStats  `json:"clients"`
+	Paused        bool            `json:"paused"`
+
+	// Annotations are the channel's owner, description etc.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	E2eProcessingLatency *util.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
 }
 
 func (c *ChannelStats) Add(a *ChannelStats) {
@@ -131,6 +204,7 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	if a.Paused {
 		c.Paused = a.Paused
 	}
+	c.Annotations = mergeAnnotations(c.Annotations, a.Annotations)
 	c.HostStats = append(c.HostStats, a)
 	c.E2eProcessingLatency = c.E2eProcessingLatency.Add(a.E2eProcessingLatency, len(c.HostStats))
 	sort.Sort(ChannelStatsByHost{c.HostStats})
@@ -153,21 +227,36 @@ func (c *ChannelStats) Host() string {
 	return h
 }
 
+// mergeAnnotations adds the annotations of b that a doesn't have to a, nsqd
+// only disagree while a topic or channel is being annotated
+func mergeAnnotations(a map[string]string, b map[string]string) map[string]string {
+	for k, v := range b {
+		if a == nil {
+			a = make(map[string]string)
+		}
+		if _, ok := a[k]; !ok {
+			a[k] = v
+		}
+	}
+	return a
+}
+
 type ClientStats struct {
-	HostAddress       string
-	Version           string
-	UserAgent         string
-	Identifier        string
-	ConnectedDuration time.Duration
-	InFlightCount     int
-	ReadyCount        int
-	FinishCount       int64
-	RequeueCount      int64
-	MessageCount      int64
-	SampleRate        int32
-	TLS               bool
-	Deflate           bool
-	Snappy            bool
+	HostAddress       string        `json:"host_address"`
+	Version           string        `json:"version"`
+	UserAgent         string        `json:"user_agent"`
+	RemoteAddress     string        `json:"remote_address"`
+	Identifier        string        `json:"identifier"`
+	ConnectedDuration time.Duration `json:"connected_duration"`
+	InFlightCount     int           `json:"in_flight_count"`
+	ReadyCount        int           `json:"ready_count"`
+	FinishCount       int64         `json:"finish_count"`
+	RequeueCount      int64         `json:"requeue_count"`
+	MessageCount      int64         `json:"message_count"`
+	SampleRate        int32         `json:"sample_rate"`
+	TLS               bool          `json:"tls"`
+	Deflate           bool          `json:"deflate"`
+	Snappy            bool          `json:"snappy"`
 }
 
 func (c *ClientStats) HasUserAgent() bool {
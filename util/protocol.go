@@ -30,21 +30,32 @@ func SendResponse(w io.Writer, data []byte) (int, error) {
 // SendFramedResponse is a server side utility function to prefix data with a length header
 // and frame header and write to the supplied Writer
 func SendFramedResponse(w io.Writer, frameType int32, data []byte) (int, error) {
-	beBuf := make([]byte, 4)
-	size := uint32(len(data)) + 4
+	return SendFramedResponseParts(w, frameType, data)
+}
 
-	binary.BigEndian.PutUint32(beBuf, size)
-	n, err := w.Write(beBuf)
-	if err != nil {
-		return n, err
+// SendFramedResponseParts is SendFramedResponse for a frame whose data is in
+// parts, each is written as it is (rather than first being copied together)
+// so that large ones can go straight through a bufio.Writer to the connection
+func SendFramedResponseParts(w io.Writer, frameType int32, parts ...[]byte) (int, error) {
+	var beBuf [8]byte
+	size := uint32(4)
+	for _, part := range parts {
+		size += uint32(len(part))
 	}
 
-	binary.BigEndian.PutUint32(beBuf, uint32(frameType))
-	n, err = w.Write(beBuf)
+	binary.BigEndian.PutUint32(beBuf[0:4], size)
+	binary.BigEndian.PutUint32(beBuf[4:8], uint32(frameType))
+	total, err := w.Write(beBuf[:])
 	if err != nil {
-		return n + 4, err
+		return total, err
 	}
 
-	n, err = w.Write(data)
-	return n + 8, err
+	for _, part := range parts {
+		n, err := w.Write(part)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
 }
@@ -0,0 +1,15 @@
+package util
+
+import (
+	"strconv"
+)
+
+// ShardTopicNames returns the topics a sharded topic is split into, for
+// orders with 4 shards that's orders.0 to orders.3
+func ShardTopicNames(topic string, shards int) []string {
+	names := make([]string, shards)
+	for i := range names {
+		names[i] = topic + "." + strconv.Itoa(i)
+	}
+	return names
+}
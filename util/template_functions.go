@@ -55,3 +55,19 @@ func NanoSecondToHuman(v float64) string {
 	}
 	return fmt.Sprintf("%0.1f%s", v, suffix)
 }
+
+func HumanBytes(v uint64) string {
+	const unit = 1024
+	if v < unit {
+		return fmt.Sprintf("%dB", v)
+	}
+	f := float64(v)
+	var suffix string
+	for _, suffix = range []string{"KB", "MB", "GB", "TB"} {
+		f /= unit
+		if f < unit {
+			break
+		}
+	}
+	return fmt.Sprintf("%0.1f%s", f, suffix)
+}